@@ -495,6 +495,9 @@ func (b *bucket) ErrorAs(err error, i interface{}) bool {
 }
 
 func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
+	if err == errHoldsUnimplemented {
+		return gcerrors.Unimplemented
+	}
 	serr, ok := err.(azblob.StorageError)
 	switch {
 	case !ok:
@@ -628,6 +631,14 @@ func (b *bucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driv
 	return page, nil
 }
 
+// errHoldsUnimplemented is returned for holds, which azureblob does not support.
+var errHoldsUnimplemented = errors.New("azureblob: holds are not supported")
+
+// SetHold implements driver.SetHold.
+func (b *bucket) SetHold(ctx context.Context, key string, hold bool) error {
+	return errHoldsUnimplemented
+}
+
 // SignedURL implements driver.SignedURL.
 func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
 	if b.opts.Credential == nil {
@@ -693,6 +704,9 @@ func unescapeKey(key string) string {
 
 // NewTypedWriter implements driver.NewTypedWriter.
 func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	if opts.Hold {
+		return nil, errHoldsUnimplemented
+	}
 	key = escapeKey(key, false)
 	blockBlobURL := b.containerURL.NewBlockBlobURL(key)
 	if opts.BufferSize == 0 {
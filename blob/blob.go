@@ -194,6 +194,13 @@ type Attributes struct {
 	Size int64
 	// MD5 is an MD5 hash of the blob contents or nil if not available.
 	MD5 []byte
+	// Hold reports whether the blob has a hold on it; see WriterOptions.Hold.
+	Hold bool
+	// RetainUntil is the time before which the provider's retention settings,
+	// such as a bucket retention policy, prevent the blob from being deleted
+	// or replaced. It is the zero time if there is no such restriction, or if
+	// the provider doesn't report it.
+	RetainUntil time.Time
 
 	asFunc func(interface{}) bool
 }
@@ -222,6 +229,22 @@ type Writer struct {
 	md5hash    hash.Hash
 	provider   string // for metric collection
 	closed     bool
+	err        error // the first error returned by Write; aborts the write at Close
+
+	contentLength int64 // from WriterOptions.ContentLength
+	written       int64 // the number of bytes passed to Write so far
+
+	onProgress func(WriteProgress) // from WriterOptions.OnProgress
+	progressMu sync.Mutex          // serializes calls to onProgress, and protects progress
+	progress   WriteProgress
+
+	// trailing holds the metadata set by SetMetadata, which Close adds to
+	// metadata, from WriterOptions.Metadata. mdCtx and mdKey are needed to
+	// update the blob's metadata after it has been written.
+	trailing map[string]string
+	metadata map[string]string
+	mdCtx    context.Context
+	mdKey    string
 
 	// These fields exist only when w is not yet created.
 	//
@@ -245,6 +268,15 @@ const sniffLen = 512
 // even if the actual write eventually fails. The write is only guaranteed to
 // have succeeded if Close returns no error.
 func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.contentLength > 0 {
+		if w.written+int64(len(p)) > w.contentLength {
+			if w.err == nil {
+				w.err = gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: write exceeds the WriterOptions.ContentLength you specified (%d)", w.contentLength)
+			}
+			return 0, w.err
+		}
+		w.written += int64(len(p))
+	}
 	if len(w.contentMD5) > 0 {
 		if _, err := w.md5hash.Write(p); err != nil {
 			return 0, err
@@ -274,10 +306,23 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 // Close closes the blob writer. The write operation is not guaranteed to have succeeded until
 // Close returns with no error.
 // Close may return an error if the context provided to create the Writer is
-// canceled or reaches its deadline.
+// canceled or reaches its deadline; in that case, the write is aborted.
+//
+// If a call to Write returned an error, Close aborts the write, so that no blob
+// is created from the partial content, and returns that error. Providers that
+// upload in parts discard the parts that were uploaded.
 func (w *Writer) Close() (err error) {
 	w.closed = true
 	defer func() { w.end(err) }()
+	if w.err != nil {
+		// Cancel the context before closing the driver's writer, so that it
+		// aborts the upload instead of completing it.
+		w.cancel()
+		if w.w != nil {
+			_ = w.w.Close()
+		}
+		return w.err
+	}
 	if len(w.contentMD5) > 0 {
 		// Verify the MD5 hash of what was written matches the ContentMD5 provided
 		// by the user.
@@ -292,15 +337,131 @@ func (w *Writer) Close() (err error) {
 			return gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: the WriterOptions.ContentMD5 you specified (%X) did not match what was written (%X)", w.contentMD5, md5sum)
 		}
 	}
+	if w.contentLength > 0 && w.written != w.contentLength {
+		// Too few bytes were written; abort the write as above.
+		w.cancel()
+		if w.w != nil {
+			_ = w.w.Close()
+		}
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: the WriterOptions.ContentLength you specified (%d) did not match the number of bytes written (%d)", w.contentLength, w.written)
+	}
 
 	defer w.cancel()
-	if w.w != nil {
+	if w.w == nil {
+		// The driver's writer has not been created yet, so the trailing metadata
+		// can be passed to it with the rest.
+		if len(w.trailing) > 0 {
+			w.opts.Metadata = w.allMetadata()
+			w.trailing = nil
+		}
+		if _, err := w.open(w.buf.Bytes()); err != nil {
+			return err
+		}
 		return wrapError(w.b, w.w.Close())
 	}
-	if _, err := w.open(w.buf.Bytes()); err != nil {
-		return err
+	if len(w.trailing) == 0 {
+		return wrapError(w.b, w.w.Close())
+	}
+	if s, ok := w.w.(driver.MetadataSetter); ok {
+		if err := s.SetMetadata(w.allMetadata()); err != nil {
+			w.cancel()
+			_ = w.w.Close()
+			return wrapError(w.b, err)
+		}
+		return wrapError(w.b, w.w.Close())
+	}
+	u, ok := w.b.(driver.MetadataUpdater)
+	if !ok {
+		w.cancel()
+		_ = w.w.Close()
+		return errSetMetadataUnimplemented
 	}
-	return wrapError(w.b, w.w.Close())
+	if err := w.w.Close(); err != nil {
+		return wrapError(w.b, err)
+	}
+	return wrapError(w.b, u.UpdateMetadata(w.mdCtx, w.mdKey, w.allMetadata()))
+}
+
+// SetMetadata sets the value of a key of the blob's metadata, like
+// WriterOptions.Metadata, when the Writer is closed. It is for metadata that
+// is only known once the content has been written, like a checksum or a count
+// of the records written. A key set both in WriterOptions.Metadata and with
+// SetMetadata gets the value from SetMetadata. Keys are case-insensitive, as
+// with WriterOptions.Metadata.
+//
+// SetMetadata must be called before Close. The metadata is written with the
+// blob if it is small enough to still be buffered, or if the provider can set
+// metadata at the end of a write. Otherwise, the provider updates the
+// metadata of the blob once it has been written, so readers may briefly see
+// the blob without it. Some providers update metadata by copying the blob onto
+// itself, which takes longer the larger the blob is; s3blob can copy at most
+// 5 GiB in one request, and copies larger blobs in parts of 1 GiB. If the
+// update fails, Close returns the error, but the blob has already been
+// written without the metadata.
+//
+// If the provider can do neither, SetMetadata returns an error whose code is
+// gcerrors.Unimplemented. While the content is still buffered, that is only
+// known once the provider's writer is created; the next Write then fails with
+// that error instead, and Close aborts the write.
+func (w *Writer) SetMetadata(key, value string) error {
+	if w.closed {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: SetMetadata called after Close")
+	}
+	if key == "" {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "blob: SetMetadata key may not be an empty string")
+	}
+	if !utf8.ValidString(key) {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "blob: SetMetadata key must be a valid UTF-8 string: %q", key)
+	}
+	if !utf8.ValidString(value) {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "blob: SetMetadata value must be a valid UTF-8 string: %q", value)
+	}
+	if w.w != nil && !w.canSetMetadata() {
+		return errSetMetadataUnimplemented
+	}
+	if w.trailing == nil {
+		w.trailing = map[string]string{}
+	}
+	w.trailing[strings.ToLower(key)] = value
+	return nil
+}
+
+var errSetMetadataUnimplemented = gcerr.Newf(gcerr.Unimplemented, nil, "blob: this provider cannot set metadata after a blob's content is written")
+
+// canSetMetadata reports whether the metadata set by SetMetadata can be
+// written once the driver's writer has been created.
+func (w *Writer) canSetMetadata() bool {
+	if _, ok := w.w.(driver.MetadataSetter); ok {
+		return true
+	}
+	_, ok := w.b.(driver.MetadataUpdater)
+	return ok
+}
+
+// abort makes Close abort the write with err, unless the write has already
+// failed.
+func (w *Writer) abort(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// delete deletes the blob written by w.
+func (w *Writer) delete(ctx context.Context) error {
+	return wrapError(w.b, w.b.Delete(ctx, w.mdKey))
+}
+
+// allMetadata returns the metadata from WriterOptions with the trailing
+// metadata added.
+func (w *Writer) allMetadata() map[string]string {
+	md := make(map[string]string, len(w.metadata)+len(w.trailing))
+	for k, v := range w.metadata {
+		md[k] = v
+	}
+	for k, v := range w.trailing {
+		md[k] = v
+	}
+	return md
 }
 
 // open tries to detect the MIME type of p and write it to the blob.
@@ -309,7 +470,12 @@ func (w *Writer) open(p []byte) (int, error) {
 	ct := http.DetectContentType(p)
 	var err error
 	if w.w, err = w.b.NewTypedWriter(w.ctx, w.key, ct, w.opts); err != nil {
-		return 0, wrapError(w.b, err)
+		w.err = wrapError(w.b, err)
+		return 0, w.err
+	}
+	if len(w.trailing) > 0 && !w.canSetMetadata() {
+		w.err = errSetMetadataUnimplemented
+		return 0, w.err
 	}
 	w.buf = nil
 	w.ctx = nil
@@ -322,9 +488,41 @@ func (w *Writer) write(p []byte) (int, error) {
 	n, err := w.w.Write(p)
 	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(oc.ProviderKey, w.provider)},
 		bytesWrittenMeasure.M(int64(n)))
+	if n > 0 {
+		w.reportProgress(int64(n), 0)
+	}
+	if err != nil && w.err == nil {
+		w.err = wrapError(w.b, err)
+	}
 	return n, wrapError(w.b, err)
 }
 
+// reportProgress adds to the progress of the write and passes it to the
+// OnProgress callback, if any.
+func (w *Writer) reportProgress(bytes int64, parts int) {
+	if w.onProgress == nil {
+		return
+	}
+	w.progressMu.Lock()
+	defer w.progressMu.Unlock()
+	w.progress.BytesWritten += bytes
+	w.progress.PartsCompleted += parts
+	w.onProgress(w.progress)
+}
+
+// WriteProgress describes how much of a write has been done. It is passed to
+// WriterOptions.OnProgress.
+type WriteProgress struct {
+	// BytesWritten is the number of bytes passed to the provider so far. Providers
+	// may buffer bytes before uploading them.
+	BytesWritten int64
+
+	// PartsCompleted is the number of parts of the blob that the provider has
+	// finished uploading, for providers that upload in parts and report them.
+	// It is always 0 for other providers.
+	PartsCompleted int
+}
+
 // ListOptions sets options for listing blobs via Bucket.List.
 type ListOptions struct {
 	// Prefix indicates that only blobs with a key starting with this prefix
@@ -602,6 +800,8 @@ func (b *Bucket) Attributes(ctx context.Context, key string) (_ *Attributes, err
 		ModTime:            a.ModTime,
 		Size:               a.Size,
 		MD5:                a.MD5,
+		Hold:               a.Hold,
+		RetainUntil:        a.RetainUntil,
 		asFunc:             a.AsFunc,
 	}, nil
 }
@@ -717,6 +917,9 @@ func (b *Bucket) NewWriter(ctx context.Context, key string, opts *WriterOptions)
 	if opts == nil {
 		opts = &WriterOptions{}
 	}
+	if opts.ContentLength < 0 {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "blob: WriterOptions.ContentLength must not be negative: %d", opts.ContentLength)
+	}
 	dopts := &driver.WriterOptions{
 		CacheControl:       opts.CacheControl,
 		ContentDisposition: opts.ContentDisposition,
@@ -724,7 +927,9 @@ func (b *Bucket) NewWriter(ctx context.Context, key string, opts *WriterOptions)
 		ContentLanguage:    opts.ContentLanguage,
 		ContentMD5:         opts.ContentMD5,
 		BufferSize:         opts.BufferSize,
+		ContentLength:      opts.ContentLength,
 		BeforeWrite:        opts.BeforeWrite,
+		Hold:               opts.Hold,
 	}
 	if len(opts.Metadata) > 0 {
 		// Providers are inconsistent, but at least some treat keys
@@ -773,6 +978,16 @@ func (b *Bucket) NewWriter(ctx context.Context, key string, opts *WriterOptions)
 		contentMD5: opts.ContentMD5,
 		md5hash:    md5.New(),
 		provider:   b.tracer.Provider,
+		onProgress: opts.OnProgress,
+
+		contentLength: opts.ContentLength,
+
+		metadata: dopts.Metadata,
+		mdCtx:    ctx,
+		mdKey:    key,
+	}
+	if opts.OnProgress != nil {
+		dopts.OnPartCompleted = func() { w.reportProgress(0, 1) }
 	}
 	if opts.ContentType != "" {
 		t, p, err := mime.ParseMediaType(opts.ContentType)
@@ -856,6 +1071,27 @@ func (b *Bucket) Delete(ctx context.Context, key string) (err error) {
 	return wrapError(b.b, b.b.Delete(ctx, key))
 }
 
+// SetHold places a hold on the blob stored at key if hold is true, and
+// releases it otherwise. See WriterOptions.Hold.
+//
+// If the blob does not exist, SetHold returns an error for which
+// gcerrors.Code will return gcerrors.NotFound.
+// If the provider doesn't support holds, it returns an error for which
+// gcerrors.Code will return gcerrors.Unimplemented.
+func (b *Bucket) SetHold(ctx context.Context, key string, hold bool) (err error) {
+	if !utf8.ValidString(key) {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "blob: SetHold key must be a valid UTF-8 string: %q", key)
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return errClosed
+	}
+	ctx = b.tracer.Start(ctx, "SetHold")
+	defer func() { b.tracer.End(ctx, err) }()
+	return wrapError(b.b, b.b.SetHold(ctx, key, hold))
+}
+
 // SignedURL returns a URL that can be used to GET the blob for the duration
 // specified in opts.Expiry.
 //
@@ -937,6 +1173,19 @@ type WriterOptions struct {
 	// smaller BufferSize may reduce memory usage.
 	BufferSize int
 
+	// ContentLength, if positive, is the number of bytes that will be written.
+	// Knowing the size up front lets some providers stream the blob to the
+	// service in a single request instead of buffering it to decide whether to
+	// split it into parts, which saves memory when writing many blobs at once.
+	// Providers that can't make use of it ignore it.
+	//
+	// If a Write would exceed ContentLength, it returns an error, and if fewer
+	// than ContentLength bytes have been written, Close returns an error; either
+	// way, the write is aborted.
+	//
+	// If 0, the size is unknown.
+	ContentLength int64
+
 	// CacheControl specifies caching attributes that providers may use
 	// when serving the blob.
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Cache-Control
@@ -982,6 +1231,21 @@ type WriterOptions struct {
 	// asFunc converts its argument to provider-specific types.
 	// See https://gocloud.dev/concepts/as/ for background information.
 	BeforeWrite func(asFunc func(interface{}) bool) error
+
+	// OnProgress is a callback that, if non-nil, is called as the write
+	// progresses: each time Write passes bytes to the provider, and each time
+	// the provider finishes uploading a part of the blob. Calls are serialized,
+	// but may happen on a goroutine other than the one calling Write or Close.
+	OnProgress func(WriteProgress)
+
+	// Hold, if true, places a hold on the blob, which prevents it from being
+	// deleted or replaced until the hold is released with Bucket.SetHold.
+	// Holds are used to keep blobs unchanged for compliance purposes (sometimes
+	// called WORM, for "write once, read many").
+	//
+	// Providers that don't support holds return an error for which
+	// gcerrors.Code returns gcerrors.Unimplemented.
+	Hold bool
 }
 
 // CopyOptions sets options for Copy.
@@ -1112,3 +1376,17 @@ func PrefixedBucket(bucket *Bucket, prefix string) *Bucket {
 	bucket.closed = true
 	return NewBucket(driver.NewPrefixedBucket(bucket.b, prefix))
 }
+
+// WithMiddleware returns a *Bucket based on bucket whose driver is wrapped by
+// mws, as described in driver.Chain: the first middleware sees each call
+// first. Metrics and traces are still attributed to bucket's provider.
+//
+// bucket will be closed and no longer usable after this function returns.
+func WithMiddleware(bucket *Bucket, mws ...driver.Middleware) *Bucket {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.closed = true
+	b := NewBucket(driver.Chain(bucket.b, mws...))
+	b.tracer.Provider = bucket.tracer.Provider
+	return b
+}
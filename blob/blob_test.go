@@ -98,6 +98,69 @@ func (b *fakeAttributes) ErrorCode(err error) gcerrors.ErrorCode {
 	return gcerrors.Unknown
 }
 
+// recordingMiddleware returns a driver.Middleware that appends name to *calls
+// whenever Attributes is called.
+func recordingMiddleware(name string, calls *[]string) driver.Middleware {
+	return func(next driver.Bucket) driver.Bucket {
+		return &recordingBucket{Bucket: next, name: name, calls: calls}
+	}
+}
+
+type recordingBucket struct {
+	driver.Bucket
+	name  string
+	calls *[]string
+}
+
+func (b *recordingBucket) Attributes(ctx context.Context, key string) (*driver.Attributes, error) {
+	*b.calls = append(*b.calls, b.name)
+	return b.Bucket.Attributes(ctx, key)
+}
+
+func (b *recordingBucket) As(i interface{}) bool {
+	if p, ok := i.(**recordingBucket); ok && b.name == "outer" {
+		*p = b
+		return true
+	}
+	return b.Bucket.As(i)
+}
+
+func (b *fakeAttributes) As(i interface{}) bool {
+	p, ok := i.(**fakeAttributes)
+	if !ok {
+		return false
+	}
+	*p = b
+	return true
+}
+
+func TestWithMiddleware(t *testing.T) {
+	ctx := context.Background()
+	var calls []string
+	drv := &fakeAttributes{attributesErr: errNotFound}
+	orig := NewBucket(drv)
+	b := WithMiddleware(orig, recordingMiddleware("outer", &calls), recordingMiddleware("inner", &calls))
+
+	if _, err := orig.Attributes(ctx, "key"); err != errClosed {
+		t.Errorf("got %v, want errClosed for the original bucket", err)
+	}
+	_, err := b.Attributes(ctx, "key")
+	if got := gcerrors.Code(err); got != gcerrors.NotFound {
+		t.Errorf("got error code %v, want NotFound", got)
+	}
+	if want := []string{"outer", "inner"}; !cmp.Equal(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+	var gotDrv *fakeAttributes
+	if !b.As(&gotDrv) || gotDrv != drv {
+		t.Error("As did not pass through to the underlying driver")
+	}
+	var gotMW *recordingBucket
+	if !b.As(&gotMW) || gotMW.name != "outer" {
+		t.Error("As did not return the middleware's own type")
+	}
+}
+
 // Verify that ListIterator works even if driver.ListPaged returns empty pages.
 func TestListIterator(t *testing.T) {
 	ctx := context.Background()
@@ -148,6 +211,236 @@ func (b *fakeLister) ListPaged(ctx context.Context, opts *driver.ListOptions) (*
 	return &driver.ListPage{Objects: objs, NextPageToken: []byte{1}}, nil
 }
 
+// partsWriter implements driver.Bucket. Only NewTypedWriter is implemented,
+// returning a writer that completes a part every partSize bytes, and that fails
+// writes once failAfter bytes have been written, if failAfter is positive.
+type partsWriter struct {
+	driver.Bucket
+	partSize  int
+	failAfter int
+
+	ctx    context.Context       // from the most recent NewTypedWriter
+	opts   *driver.WriterOptions // from the most recent NewTypedWriter
+	closed bool
+}
+
+func (b *partsWriter) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	b.ctx = ctx
+	b.opts = opts
+	return &partsDriverWriter{b: b, opts: opts}, nil
+}
+
+func (b *partsWriter) ErrorCode(err error) gcerrors.ErrorCode {
+	return gcerrors.Unknown
+}
+
+type partsDriverWriter struct {
+	b       *partsWriter
+	opts    *driver.WriterOptions
+	written int
+}
+
+func (w *partsDriverWriter) Write(p []byte) (int, error) {
+	if w.b.failAfter > 0 && w.written+len(p) > w.b.failAfter {
+		return 0, errFake
+	}
+	for range p {
+		w.written++
+		if w.written%w.b.partSize == 0 && w.opts.OnPartCompleted != nil {
+			w.opts.OnPartCompleted()
+		}
+	}
+	return len(p), nil
+}
+
+func (w *partsDriverWriter) Close() error {
+	w.b.closed = true
+	return w.b.ctx.Err()
+}
+
+func TestWriterProgress(t *testing.T) {
+	ctx := context.Background()
+	db := &partsWriter{partSize: 4}
+	b := NewBucket(db)
+	var got []WriteProgress
+	opts := &WriterOptions{
+		ContentType: "text/plain",
+		OnProgress:  func(p WriteProgress) { got = append(got, p) },
+	}
+	w, err := b.NewWriter(ctx, "key", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"abc", "defgh"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Parts are reported as the driver completes them, during the second Write;
+	// its bytes are reported when it returns.
+	want := []WriteProgress{
+		{BytesWritten: 3},
+		{BytesWritten: 3, PartsCompleted: 1},
+		{BytesWritten: 3, PartsCompleted: 2},
+		{BytesWritten: 8, PartsCompleted: 2},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("progress mismatch (-got +want):\n%s", diff)
+	}
+}
+
+// Verify that Close aborts the write after Write fails.
+func TestWriterCloseAfterWriteError(t *testing.T) {
+	ctx := context.Background()
+	db := &partsWriter{partSize: 4, failAfter: 4}
+	b := NewBucket(db)
+	w, err := b.NewWriter(ctx, "key", &WriterOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("defgh")); err == nil {
+		t.Fatal("got nil error from Write, want error")
+	}
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), errFake.Error()) {
+		t.Errorf("got error %v from Close, want the error from Write", err)
+	}
+	if !db.closed {
+		t.Error("driver writer was not closed")
+	}
+	if db.ctx.Err() == nil {
+		t.Error("driver writer's context was not canceled, so the write was not aborted")
+	}
+}
+
+// Verify that metadata set by Writer.SetMetadata is passed to the driver when
+// its writer is created at Close, and that the write is aborted when the
+// provider cannot set it later.
+func TestWriterSetMetadata(t *testing.T) {
+	ctx := context.Background()
+	db := &partsWriter{partSize: 4}
+	b := NewBucket(db)
+
+	// The content is buffered to detect its type until Close.
+	w, err := b.NewWriter(ctx, "key", &WriterOptions{Metadata: map[string]string{"a": "1", "b": "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetMetadata("B", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetMetadata("", "x"); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("SetMetadata with empty key: got %v, want InvalidArgument", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "1", "b": "3"}
+	if diff := cmp.Diff(db.opts.Metadata, want); diff != "" {
+		t.Errorf("metadata mismatch (-got +want):\n%s", diff)
+	}
+	if err := w.SetMetadata("c", "4"); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("SetMetadata after Close: got %v, want FailedPrecondition", err)
+	}
+
+	// The driver's writer is created at once, and can't set metadata.
+	w, err = b.NewWriter(ctx, "key", &WriterOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetMetadata("count", "1"); gcerrors.Code(err) != gcerrors.Unimplemented {
+		t.Errorf("got %v from SetMetadata, want Unimplemented", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The driver's writer is created once enough content is buffered to
+	// detect its type, which fails the write.
+	w, err = b.NewWriter(ctx, "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetMetadata("count", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, sniffLen)); gcerrors.Code(err) != gcerrors.Unimplemented {
+		t.Errorf("got %v from Write, want Unimplemented", err)
+	}
+	if err := w.Close(); gcerrors.Code(err) != gcerrors.Unimplemented {
+		t.Errorf("got %v from Close, want Unimplemented", err)
+	}
+	if db.ctx.Err() == nil {
+		t.Error("driver writer's context was not canceled, so the write was not aborted")
+	}
+}
+
+// Verify that writes of a number of bytes other than WriterOptions.ContentLength
+// are aborted.
+func TestWriterContentLength(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		description  string
+		writes       []string
+		wantWriteErr bool
+		wantCloseErr bool
+	}{
+		{"exact", []string{"abc", "defgh"}, false, false},
+		{"too few bytes", []string{"abc"}, false, true},
+		{"too many bytes", []string{"abc", "defghi"}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			db := &partsWriter{partSize: 4}
+			b := NewBucket(db)
+			w, err := b.NewWriter(ctx, "key", &WriterOptions{ContentType: "text/plain", ContentLength: 8})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := db.opts.ContentLength; got != 8 {
+				t.Errorf("driver got ContentLength %d, want 8", got)
+			}
+			var writeErr error
+			for _, s := range test.writes {
+				if _, err := w.Write([]byte(s)); err != nil {
+					writeErr = err
+				}
+			}
+			if (writeErr != nil) != test.wantWriteErr {
+				t.Errorf("got Write error %v, want error %v", writeErr, test.wantWriteErr)
+			}
+			err = w.Close()
+			if (err != nil) != test.wantCloseErr {
+				t.Fatalf("got Close error %v, want error %v", err, test.wantCloseErr)
+			}
+			if err != nil {
+				if got := gcerrors.Code(err); got != gcerrors.FailedPrecondition {
+					t.Errorf("got error code %v, want FailedPrecondition", got)
+				}
+				if db.ctx.Err() == nil {
+					t.Error("driver writer's context was not canceled, so the write was not aborted")
+				}
+			}
+		})
+	}
+
+	b := NewBucket(&partsWriter{partSize: 4})
+	if _, err := b.NewWriter(ctx, "key", &WriterOptions{ContentLength: -1}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("got error %v for negative ContentLength, want InvalidArgument", err)
+	}
+}
+
 // erroringBucket implements driver.Bucket. All interface methods that return
 // errors are implemented, and return errFake.
 // In addition, when passed the key "work", NewRangedReader and NewTypedWriter
@@ -215,6 +508,10 @@ func (b *erroringBucket) SignedURL(ctx context.Context, key string, opts *driver
 	return "", errFake
 }
 
+func (b *erroringBucket) SetHold(ctx context.Context, key string, hold bool) error {
+	return errFake
+}
+
 func (b *erroringBucket) Close() error {
 	return errFake
 }
@@ -296,6 +593,9 @@ func TestErrorsAreWrapped(t *testing.T) {
 	_, err = b.SignedURL(ctx, "", nil)
 	verifyWrap("SignedURL", err)
 
+	err = b.SetHold(ctx, "", true)
+	verifyWrap("SetHold", err)
+
 	err = b.Close()
 	verifyWrap("Close", err)
 }
@@ -346,6 +646,9 @@ func TestBucketIsClosed(t *testing.T) {
 	if _, err := bucket.SignedURL(ctx, "", nil); err != errClosed {
 		t.Error(err)
 	}
+	if err := bucket.SetHold(ctx, "", true); err != errClosed {
+		t.Error(err)
+	}
 	if err := bucket.Close(); err != errClosed {
 		t.Error(err)
 	}
@@ -0,0 +1,321 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blobcache provides an in-memory read cache for blob buckets that is
+// kept coherent by the provider's change notifications.
+//
+// A Cache holds the contents of small blobs. Install it on a bucket with
+// blob.WithMiddleware(bucket, cache.Middleware()): full reads of a blob are
+// then served from memory after the first. Writes, copies and deletes made
+// through the bucket invalidate the cached blob at once. Changes made by
+// other processes are seen when the provider's notification of the change
+// arrives on a pubsub subscription passed to Cache.Invalidations, so the cache
+// lags the bucket by the notification delay, usually a few seconds. Set
+// Options.TTL to bound how stale a blob can be if notifications are lost.
+//
+// Notifications are decoded by an EventDecoder. S3Events decodes Amazon S3
+// event notifications delivered through SQS or SNS, and GCSNotifications
+// decodes Cloud Storage Pub/Sub notifications.
+//
+// Reads served from the cache do not reach the provider, so their
+// ReaderOptions.BeforeRead callbacks and Reader.As support no types.
+package blobcache // import "gocloud.dev/blob/blobcache"
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob/driver"
+	"gocloud.dev/pubsub"
+)
+
+// Options sets options for a Cache.
+type Options struct {
+	// MaxBytes is the most bytes of blob contents that the cache holds. The
+	// least recently used blobs are evicted to stay under it.
+	// Defaults to 64 MiB.
+	MaxBytes int64
+	// MaxBlobBytes is the size of the largest blob that is cached.
+	// Defaults to 1 MiB.
+	MaxBlobBytes int64
+	// TTL, if positive, is how long a blob stays cached, even if no
+	// notification invalidates it.
+	TTL time.Duration
+}
+
+const (
+	defaultMaxBytes     = 64 << 20
+	defaultMaxBlobBytes = 1 << 20
+)
+
+// A Cache holds the contents of blobs read through buckets using its
+// Middleware. It is safe for concurrent use.
+type Cache struct {
+	opts Options
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // by key; values are *entry
+	lru     list.List                // front is most recently used
+	size    int64
+	// epoch is incremented by every invalidation. A blob read in one epoch is
+	// not cached if the epoch has changed by the time the read finishes,
+	// because it may have been invalidated in between.
+	epoch uint64
+}
+
+type entry struct {
+	key     string
+	data    []byte
+	attrs   driver.ReaderAttributes
+	expires time.Time // zero if there is no TTL
+}
+
+// New returns an empty Cache. opts may be nil.
+func New(opts *Options) *Cache {
+	c := &Cache{entries: map[string]*list.Element{}}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.MaxBytes <= 0 {
+		c.opts.MaxBytes = defaultMaxBytes
+	}
+	if c.opts.MaxBlobBytes <= 0 {
+		c.opts.MaxBlobBytes = defaultMaxBlobBytes
+	}
+	if c.opts.MaxBlobBytes > c.opts.MaxBytes {
+		c.opts.MaxBlobBytes = c.opts.MaxBytes
+	}
+	return c
+}
+
+// Middleware returns a driver.Middleware that serves reads from c and
+// invalidates blobs in c when they are written, copied over or deleted.
+//
+// The keys in c are those of the bucket the middleware is installed on. A
+// Cache should not be shared by buckets that name different blobs by the same
+// key.
+func (c *Cache) Middleware() driver.Middleware {
+	return func(next driver.Bucket) driver.Bucket {
+		return &bucket{Bucket: next, cache: c}
+	}
+}
+
+// Invalidate removes the blob with key from c.
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if e := c.entries[key]; e != nil {
+		c.remove(e)
+	}
+}
+
+// InvalidateAll removes every blob from c.
+func (c *Cache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.size = 0
+}
+
+// Len returns the number of blobs in c.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// remove removes e from c. It must be called with c.mu held.
+func (c *Cache) remove(e *list.Element) {
+	ent := c.lru.Remove(e).(*entry)
+	delete(c.entries, ent.key)
+	c.size -= int64(len(ent.data))
+}
+
+// get returns the cached entry for key, or nil, and the current epoch.
+func (c *Cache) get(key string) (*entry, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return nil, c.epoch
+	}
+	ent := e.Value.(*entry)
+	if !ent.expires.IsZero() && time.Now().After(ent.expires) {
+		c.remove(e)
+		return nil, c.epoch
+	}
+	c.lru.MoveToFront(e)
+	return ent, c.epoch
+}
+
+// add caches ent, unless there has been an invalidation since epoch.
+func (c *Cache) add(ent *entry, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch != epoch {
+		return
+	}
+	if e := c.entries[ent.key]; e != nil {
+		c.remove(e)
+	}
+	if c.opts.TTL > 0 {
+		ent.expires = time.Now().Add(c.opts.TTL)
+	}
+	c.entries[ent.key] = c.lru.PushFront(ent)
+	c.size += int64(len(ent.data))
+	for c.size > c.opts.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// An EventDecoder returns the keys of the blobs that a change notification
+// says have changed. An error means that the message is not a notification
+// c can understand.
+type EventDecoder func(*pubsub.Message) ([]string, error)
+
+// Invalidations receives change notifications from sub, decodes each with
+// decode and invalidates the blobs it names, until ctx is done or Receive
+// fails. It returns the error from Receive.
+//
+// A message that decode cannot understand invalidates the whole cache, since
+// there is no telling which blobs it was about. Every message is acked once it
+// has been handled.
+func (c *Cache) Invalidations(ctx context.Context, sub *pubsub.Subscription, decode EventDecoder) error {
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		keys, err := decode(msg)
+		if err != nil {
+			c.InvalidateAll()
+		}
+		for _, k := range keys {
+			c.Invalidate(k)
+		}
+		msg.Ack()
+	}
+}
+
+// bucket implements driver.Bucket, serving reads from cache.
+type bucket struct {
+	driver.Bucket
+	cache *Cache
+}
+
+func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	ent, epoch := b.cache.get(key)
+	if ent != nil {
+		if opts.BeforeRead != nil {
+			if err := opts.BeforeRead(func(interface{}) bool { return false }); err != nil {
+				return nil, err
+			}
+		}
+		return newCachedReader(ent, offset, length), nil
+	}
+	r, err := b.Bucket.NewRangeReader(ctx, key, offset, length, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Only a read of the whole blob can fill the cache.
+	attrs := *r.Attributes()
+	if offset != 0 || length >= 0 || attrs.Size < 0 || attrs.Size > b.cache.opts.MaxBlobBytes {
+		return r, nil
+	}
+	return &fillingReader{Reader: r, cache: b.cache, key: key, attrs: attrs, epoch: epoch}, nil
+}
+
+func (b *bucket) NewTypedWriter(ctx context.Context, key, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	w, err := b.Bucket.NewTypedWriter(ctx, key, contentType, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{Writer: w, cache: b.cache, key: key}, nil
+}
+
+func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	defer b.cache.Invalidate(dstKey)
+	return b.Bucket.Copy(ctx, dstKey, srcKey, opts)
+}
+
+func (b *bucket) Delete(ctx context.Context, key string) error {
+	defer b.cache.Invalidate(key)
+	return b.Bucket.Delete(ctx, key)
+}
+
+// writer invalidates the blob it writes when it is closed. A read that starts
+// before then may see the old contents, but will not cache them.
+type writer struct {
+	driver.Writer
+	cache *Cache
+	key   string
+}
+
+func (w *writer) Close() error {
+	defer w.cache.Invalidate(w.key)
+	return w.Writer.Close()
+}
+
+// fillingReader reads a whole blob from the provider, and caches it if it is
+// read to the end.
+type fillingReader struct {
+	driver.Reader
+	cache *Cache
+	key   string
+	attrs driver.ReaderAttributes
+	epoch uint64
+	buf   bytes.Buffer
+	err   error // the first error from Read
+}
+
+func (r *fillingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.err == nil {
+		r.buf.Write(p[:n])
+		r.err = err
+		if err == io.EOF && int64(r.buf.Len()) == r.attrs.Size {
+			r.cache.add(&entry{key: r.key, data: r.buf.Bytes(), attrs: r.attrs}, r.epoch)
+		}
+	}
+	return n, err
+}
+
+// cachedReader reads a range of a cached blob.
+type cachedReader struct {
+	io.Reader
+	attrs driver.ReaderAttributes
+}
+
+func newCachedReader(ent *entry, offset, length int64) *cachedReader {
+	data := ent.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return &cachedReader{Reader: bytes.NewReader(data), attrs: ent.attrs}
+}
+
+func (r *cachedReader) Close() error                         { return nil }
+func (r *cachedReader) Attributes() *driver.ReaderAttributes { return &r.attrs }
+func (r *cachedReader) As(interface{}) bool                  { return false }
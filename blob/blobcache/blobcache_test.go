@@ -0,0 +1,265 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blobcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+// newBuckets returns a bucket that reads through c, and another for the same
+// directory that stands for a different process changing blobs behind the
+// cache's back. Call cleanup to close them and remove the directory.
+func newBuckets(t *testing.T, c *Cache) (cached, other *blob.Bucket, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fileblob.OpenBucket(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	other, err = fileblob.OpenBucket(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cached = blob.WithMiddleware(b, c.Middleware())
+	return cached, other, func() {
+		cached.Close()
+		other.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func write(t *testing.T, b *blob.Bucket, key, val string) {
+	t.Helper()
+	if err := b.WriteAll(context.Background(), key, []byte(val), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRead(t *testing.T, b *blob.Bucket, key, want string) {
+	t.Helper()
+	got, err := b.ReadAll(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s: got %q, want %q", key, got, want)
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	c := New(nil)
+	cached, other, cleanup := newBuckets(t, c)
+	defer cleanup()
+
+	write(t, other, "a", "hello")
+	checkRead(t, cached, "a", "hello")
+	if got := c.Len(); got != 1 {
+		t.Fatalf("got %d cached blobs, want 1", got)
+	}
+	// Changes made elsewhere are not seen until the blob is invalidated.
+	write(t, other, "a", "world")
+	checkRead(t, cached, "a", "hello")
+	r, err := cached.NewRangeReader(ctx, "a", 1, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ell" {
+		t.Errorf("range read: got %q, want %q", got, "ell")
+	}
+	c.Invalidate("a")
+	checkRead(t, cached, "a", "world")
+
+	// Changes made through the cached bucket are seen at once.
+	write(t, cached, "a", "again")
+	checkRead(t, cached, "a", "again")
+	if err := cached.Copy(ctx, "a", "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("after Copy: got %d cached blobs, want 0", got)
+	}
+	checkRead(t, cached, "a", "again")
+	if err := cached.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cached.ReadAll(ctx, "a"); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("after Delete: got %v, want NotFound", err)
+	}
+
+	// Partial reads don't fill the cache.
+	write(t, other, "b", "partial")
+	r, err = cached.NewRangeReader(ctx, "b", 0, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if got := c.Len(); got != 0 {
+		t.Errorf("after a partial read: got %d cached blobs, want 0", got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c := New(&Options{MaxBytes: 10, MaxBlobBytes: 6})
+	cached, other, cleanup := newBuckets(t, c)
+	defer cleanup()
+	write(t, other, "big", "1234567")
+	write(t, other, "a", "12345")
+	write(t, other, "b", "12345")
+	write(t, other, "c", "1")
+
+	checkRead(t, cached, "big", "1234567")
+	if got := c.Len(); got != 0 {
+		t.Errorf("got %d cached blobs, want 0", got)
+	}
+	checkRead(t, cached, "a", "12345")
+	checkRead(t, cached, "b", "12345")
+	checkRead(t, cached, "c", "1")
+	// "a" was evicted to make room for "c".
+	c.mu.Lock()
+	var keys []string
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	evicted := c.entries["a"] == nil
+	c.mu.Unlock()
+	if len(keys) != 2 || !evicted {
+		t.Errorf("got cached blobs %v, want b and c", keys)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c := New(&Options{TTL: time.Millisecond})
+	cached, other, cleanup := newBuckets(t, c)
+	defer cleanup()
+	write(t, other, "a", "old")
+	checkRead(t, cached, "a", "old")
+	write(t, other, "a", "new")
+	time.Sleep(5 * time.Millisecond)
+	checkRead(t, cached, "a", "new")
+}
+
+func TestInvalidations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := New(nil)
+	cached, other, cleanup := newBuckets(t, c)
+	defer cleanup()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(topic, time.Minute)
+	defer sub.Shutdown(ctx)
+	done := make(chan error)
+	go func() { done <- c.Invalidations(ctx, sub, GCSNotifications) }()
+
+	write(t, other, "a", "old")
+	checkRead(t, cached, "a", "old")
+	write(t, other, "a", "new")
+	if err := topic.Send(ctx, &pubsub.Message{Metadata: map[string]string{"objectId": "a", "eventType": "OBJECT_FINALIZE"}}); err != nil {
+		t.Fatal(err)
+	}
+	for c.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	checkRead(t, cached, "a", "new")
+
+	// A message that isn't a notification invalidates everything.
+	write(t, other, "b", "b")
+	checkRead(t, cached, "b", "b")
+	if err := topic.Send(ctx, &pubsub.Message{Body: []byte("?")}); err != nil {
+		t.Fatal(err)
+	}
+	for c.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("got nil error from Invalidations after cancel, want error")
+	}
+}
+
+func TestS3Events(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "records",
+			body: `{"Records": [{"eventName": "ObjectCreated:Put", "s3": {"object": {"key": "dir/a+b%2Bc"}}},
+				{"eventName": "ObjectRemoved:Delete", "s3": {"object": {"key": "x"}}}]}`,
+			want: []string{"dir/a b+c", "x"},
+		},
+		{
+			name: "SNS",
+			body: `{"Type": "Notification", "Message": "{\"Records\": [{\"s3\": {\"object\": {\"key\": \"a\"}}}]}"}`,
+			want: []string{"a"},
+		},
+		{
+			name: "test event",
+			body: `{"Service": "Amazon S3", "Event": "s3:TestEvent"}`,
+		},
+		{name: "not JSON", body: "?", wantErr: true},
+		{name: "no records", body: `{"a": 1}`, wantErr: true},
+		{name: "bad key", body: `{"Records": [{"s3": {"object": {"key": "%z"}}}]}`, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := S3Events(&pubsub.Message{Body: []byte(test.body)})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error: %t", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGCSNotifications(t *testing.T) {
+	got, err := GCSNotifications(&pubsub.Message{Metadata: map[string]string{"objectId": "dir/a b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir/a b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := GCSNotifications(&pubsub.Message{Body: []byte("x")}); err == nil || !strings.Contains(err.Error(), "objectId") {
+		t.Errorf("got error %v, want one about objectId", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blobcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"gocloud.dev/pubsub"
+)
+
+// s3Event is the part of an Amazon S3 event notification that S3Events uses.
+// See https://docs.aws.amazon.com/AmazonS3/latest/dev/notification-content-structure.html.
+type s3Event struct {
+	Records []struct {
+		S3 struct {
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+	// Event is set for the test event that S3 sends when notifications are
+	// configured.
+	Event string
+}
+
+// snsNotification is the envelope that SNS puts around a message when raw
+// message delivery is off.
+type snsNotification struct {
+	Type    string
+	Message string
+}
+
+// S3Events is an EventDecoder for Amazon S3 event notifications, delivered
+// through SQS either directly or by way of SNS. It returns the key of each
+// record; S3's test event has none.
+func S3Events(msg *pubsub.Message) ([]string, error) {
+	body := msg.Body
+	var n snsNotification
+	if err := json.Unmarshal(body, &n); err == nil && n.Type == "Notification" {
+		body = []byte(n.Message)
+	}
+	var e s3Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, fmt.Errorf("blobcache: not an S3 event notification: %v", err)
+	}
+	if len(e.Records) == 0 && e.Event != "s3:TestEvent" {
+		return nil, fmt.Errorf("blobcache: S3 event notification has no records")
+	}
+	var keys []string
+	for _, r := range e.Records {
+		// Keys are URL-encoded as in a query string.
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("blobcache: bad key in S3 event notification: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// GCSNotifications is an EventDecoder for Cloud Storage Pub/Sub notifications.
+// It returns the key from the objectId attribute.
+// See https://cloud.google.com/storage/docs/pubsub-notifications.
+func GCSNotifications(msg *pubsub.Message) ([]string, error) {
+	key, ok := msg.Metadata["objectId"]
+	if !ok {
+		return nil, fmt.Errorf("blobcache: not a Cloud Storage notification: no objectId attribute")
+	}
+	return []string{key}, nil
+}
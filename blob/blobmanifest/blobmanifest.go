@@ -0,0 +1,264 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blobmanifest records the blobs under a prefix of a bucket in a
+// manifest, and checks whether they have changed since, so that a dataset
+// kept in any bucket can be snapshotted and reproduced.
+//
+// Snapshot lists a prefix and writes a Manifest of the keys, sizes, MD5
+// hashes and generations of its blobs as a JSON blob. A blob is only visible
+// once it has been written completely, so readers see either the old
+// manifest or the new one. Verify later lists the prefix again and reports
+// every blob that was added, removed or changed.
+//
+// A listing is not a consistent snapshot on most providers: blobs written
+// while Snapshot lists may or may not be recorded. Run Verify after writing
+// the manifest to check that nothing changed during the listing.
+package blobmanifest // import "gocloud.dev/blob/blobmanifest"
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// Entry describes one blob in a Manifest.
+type Entry struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// MD5 is the MD5 hash of the blob's contents, or nil if the provider did
+	// not report it and Options.ReadMissingMD5 was false.
+	MD5 []byte `json:"md5,omitempty"`
+	// Generation identifies the version of the blob, as returned by
+	// Options.Generation. It is empty if that is nil.
+	Generation string `json:"generation,omitempty"`
+}
+
+// A Manifest lists the blobs under a prefix of a bucket.
+type Manifest struct {
+	// Prefix is the prefix that was listed.
+	Prefix string `json:"prefix"`
+	// Key is the key that Snapshot wrote the manifest to. It is not listed
+	// in Entries, or checked by Verify, even if it has Prefix.
+	Key string `json:"key,omitempty"`
+	// Created is when the listing started.
+	Created time.Time `json:"created"`
+	// Entries are the blobs, in the order they were listed, which is the
+	// lexicographical order of their keys.
+	Entries []Entry `json:"entries"`
+}
+
+// Options sets options for Build, Snapshot and Verify. Verify should be
+// passed the same options as the call that made the manifest.
+type Options struct {
+	// ReadMissingMD5 makes blobs whose MD5 hash the provider does not report
+	// be read and hashed. Otherwise their Entry.MD5 is nil.
+	ReadMissingMD5 bool
+
+	// Generation, if not nil, returns the provider's identifier of the
+	// version of a listed blob, such as a Cloud Storage generation number or
+	// an S3 ETag, which it can get using ListObject.As.
+	Generation func(*blob.ListObject) (string, error)
+}
+
+// Build lists the blobs whose keys have prefix and returns a Manifest of
+// them. It does not write the manifest. opts may be nil.
+func Build(ctx context.Context, b *blob.Bucket, prefix string, opts *Options) (*Manifest, error) {
+	return build(ctx, b, prefix, "", opts)
+}
+
+func build(ctx context.Context, b *blob.Bucket, prefix, self string, opts *Options) (*Manifest, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	m := &Manifest{Prefix: prefix, Key: self, Created: time.Now().UTC(), Entries: []Entry{}}
+	iter := b.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if obj.Key == self {
+			continue
+		}
+		e := Entry{Key: obj.Key, Size: obj.Size, ModTime: obj.ModTime.UTC(), MD5: obj.MD5}
+		if e.MD5 == nil && opts.ReadMissingMD5 {
+			if e.MD5, err = readMD5(ctx, b, obj.Key); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Generation != nil {
+			if e.Generation, err = opts.Generation(obj); err != nil {
+				return nil, err
+			}
+		}
+		m.Entries = append(m.Entries, e)
+	}
+}
+
+func readMD5(ctx context.Context, b *blob.Bucket, key string) ([]byte, error) {
+	r, err := b.NewReader(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Snapshot lists the blobs whose keys have prefix and writes a Manifest of
+// them to key, which may itself have prefix. It returns the manifest.
+// opts may be nil.
+func Snapshot(ctx context.Context, b *blob.Bucket, prefix, key string, opts *Options) (*Manifest, error) {
+	m, err := build(ctx, b, prefix, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := Write(ctx, b, key, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Write writes m to key as JSON.
+func Write(ctx context.Context, b *blob.Bucket, key string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.WriteAll(ctx, key, data, &blob.WriterOptions{ContentType: "application/json"})
+}
+
+// Read reads a Manifest written by Snapshot or Write.
+func Read(ctx context.Context, b *blob.Bucket, key string) (*Manifest, error) {
+	data, err := b.ReadAll(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("blobmanifest: %q is not a manifest: %v", key, err)
+	}
+	return &m, nil
+}
+
+// DriftKind is the kind of a Drift.
+type DriftKind int
+
+const (
+	// Added means the blob is not in the manifest.
+	Added DriftKind = iota
+	// Removed means the blob is in the manifest but not in the bucket.
+	Removed
+	// Changed means the blob differs from its entry in the manifest.
+	Changed
+)
+
+func (k DriftKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	default:
+		return "DriftKind(?)"
+	}
+}
+
+// Drift is a difference between a Manifest and the bucket.
+type Drift struct {
+	Kind DriftKind
+	Key  string
+	// Want is the entry in the manifest, or nil if the blob was added.
+	Want *Entry
+	// Got is the entry for the blob now, or nil if it was removed.
+	Got *Entry
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s %s", d.Kind, d.Key)
+}
+
+// Verify lists m.Prefix again and returns the differences from m, ordered by
+// key. It returns no differences if the blobs are unchanged.
+//
+// An entry has changed if its size, MD5 hash or generation differ. Hashes
+// and generations are only compared when both entries have them; if neither
+// can be compared, modification times are compared instead. opts may be nil.
+func Verify(ctx context.Context, b *blob.Bucket, m *Manifest, opts *Options) ([]Drift, error) {
+	now, err := build(ctx, b, m.Prefix, m.Key, opts)
+	if err != nil {
+		return nil, err
+	}
+	want := map[string]*Entry{}
+	for i := range m.Entries {
+		want[m.Entries[i].Key] = &m.Entries[i]
+	}
+	var drift []Drift
+	for i := range now.Entries {
+		got := &now.Entries[i]
+		w, ok := want[got.Key]
+		delete(want, got.Key)
+		switch {
+		case !ok:
+			drift = append(drift, Drift{Kind: Added, Key: got.Key, Got: got})
+		case changed(w, got):
+			drift = append(drift, Drift{Kind: Changed, Key: got.Key, Want: w, Got: got})
+		}
+	}
+	// What is left in want was removed.
+	for i := range m.Entries {
+		if w, ok := want[m.Entries[i].Key]; ok {
+			drift = append(drift, Drift{Kind: Removed, Key: w.Key, Want: w})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Key < drift[j].Key })
+	return drift, nil
+}
+
+func changed(want, got *Entry) bool {
+	if want.Size != got.Size {
+		return true
+	}
+	compared := false
+	if want.MD5 != nil && got.MD5 != nil {
+		if !bytes.Equal(want.MD5, got.MD5) {
+			return true
+		}
+		compared = true
+	}
+	if want.Generation != "" && got.Generation != "" {
+		if want.Generation != got.Generation {
+			return true
+		}
+		compared = true
+	}
+	return !compared && !want.ModTime.Equal(got.ModTime)
+}
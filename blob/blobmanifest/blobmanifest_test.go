@@ -0,0 +1,166 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blobmanifest
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+)
+
+func TestSnapshotAndVerify(t *testing.T) {
+	ctx := context.Background()
+	b := memblob.OpenBucket(nil)
+	defer b.Close()
+	write := func(key, data string) {
+		t.Helper()
+		if err := b.WriteAll(ctx, key, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("data/a", "aaa")
+	write("data/b", "b")
+	write("data/c", "c")
+	write("other", "x")
+
+	m, err := Snapshot(ctx, b, "data/", "data/MANIFEST", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range m.Entries {
+		keys = append(keys, e.Key)
+	}
+	if diff := cmp.Diff(keys, []string{"data/a", "data/b", "data/c"}); diff != "" {
+		t.Errorf("keys: %s", diff)
+	}
+	sum := md5.Sum([]byte("aaa"))
+	if e := m.Entries[0]; e.Size != 3 || !cmp.Equal(e.MD5, sum[:]) {
+		t.Errorf("got %+v, want size 3 and MD5 %x", e, sum)
+	}
+
+	// The manifest reads back as written, and matches the bucket.
+	got, err := Read(ctx, b, "data/MANIFEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, m); diff != "" {
+		t.Errorf("Read: %s", diff)
+	}
+	drift, err := Verify(ctx, b, got, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("got drift %v before any change", drift)
+	}
+
+	write("data/a", "AAA") // same size, different contents
+	write("data/d", "d")
+	write("other", "y")
+	if err := b.Delete(ctx, "data/b"); err != nil {
+		t.Fatal(err)
+	}
+	drift, err = Verify(ctx, b, got, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(fmt.Sprint(drift), "[changed data/a removed data/b added data/d]"); diff != "" {
+		t.Error(diff)
+	}
+	if drift[0].Want == nil || drift[0].Got == nil || drift[1].Got != nil || drift[2].Want != nil {
+		t.Errorf("wrong entries in drift: %+v", drift)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+	b := memblob.OpenBucket(nil)
+	defer b.Close()
+	if err := b.WriteAll(ctx, "k", []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	gen := "1"
+	opts := &Options{
+		Generation: func(*blob.ListObject) (string, error) { return gen, nil },
+	}
+	m, err := Build(ctx, b, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Entries[0].Generation; got != "1" {
+		t.Errorf("got generation %q, want 1", got)
+	}
+	gen = "2"
+	drift, err := Verify(ctx, b, m, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 1 || drift[0].Kind != Changed {
+		t.Errorf("got %v, want k changed", drift)
+	}
+
+	// Without hashes or generations, modification times are compared.
+	m.Entries[0].MD5 = nil
+	drift, err = Verify(ctx, b, m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("got %v, want no drift", drift)
+	}
+	m.Entries[0].ModTime = m.Entries[0].ModTime.Add(-time.Hour)
+	drift, err = Verify(ctx, b, m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 1 || drift[0].Kind != Changed {
+		t.Errorf("got %v, want k changed", drift)
+	}
+}
+
+func TestReadMD5(t *testing.T) {
+	ctx := context.Background()
+	b := memblob.OpenBucket(nil)
+	defer b.Close()
+	if err := b.WriteAll(ctx, "k", []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readMD5(ctx, b, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := md5.Sum([]byte("v")); !cmp.Equal(got, want[:]) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestReadNotManifest(t *testing.T) {
+	ctx := context.Background()
+	b := memblob.OpenBucket(nil)
+	defer b.Close()
+	if err := b.WriteAll(ctx, "m", []byte("not json"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(ctx, b, "m"); err == nil {
+		t.Error("got nil, want error")
+	}
+}
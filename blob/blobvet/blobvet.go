@@ -0,0 +1,239 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blobvet defines an Analyzer that reports misuse of blob.Writer and
+// blob.Reader that can silently lose data or leak resources.
+//
+// Run it with the gocdk-blob-vet command:
+//
+//	go install gocloud.dev/blob/blobvet/cmd/gocdk-blob-vet
+//	gocdk-blob-vet ./...
+//
+// or add it to a CI vet step with go vet -vettool=$(which gocdk-blob-vet).
+//
+// The analyzer reports
+//   - calls to Writer.Close whose error is ignored, including deferred calls.
+//     A blob is written only when Close succeeds, so ignoring its error can
+//     lose data silently;
+//   - Writers and Readers that are opened into a local variable and never
+//     closed, unless the variable is passed on to other code, which may close
+//     it. An unclosed Writer never writes its blob, and an unclosed Reader
+//     leaks resources.
+package blobvet // import "gocloud.dev/blob/blobvet"
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+)
+
+const doc = `report misuse of blob.Writer and blob.Reader
+
+The blobvet analyzer reports ignored errors from blob.Writer.Close, and
+Writers and Readers that are never closed.`
+
+// Analyzer reports misuse of blob.Writer and blob.Reader.
+var Analyzer = &analysis.Analyzer{
+	Name:     "blobvet",
+	Doc:      doc,
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+const blobPath = "gocloud.dev/blob"
+
+// opened is a local variable that holds a Writer or Reader.
+type opened struct {
+	pos    token.Pos // where it was opened
+	what   string    // "Writer" or "Reader"
+	closed bool      // whether Close is called on it
+	passed bool      // whether it is used other than by calling its methods
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	insp := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+
+	// Find the local variables assigned Writers and Readers, and the calls to
+	// Writer.Close whose error is ignored.
+	vars := map[*types.Var]*opened{}
+	var order []*types.Var
+	nodeFilter := []ast.Node{
+		(*ast.AssignStmt)(nil),
+		(*ast.ValueSpec)(nil),
+		(*ast.ExprStmt)(nil),
+		(*ast.DeferStmt)(nil),
+		(*ast.GoStmt)(nil),
+	}
+	insp.Preorder(nodeFilter, func(n ast.Node) {
+		var lhs, rhs []ast.Expr
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			lhs, rhs = n.Lhs, n.Rhs
+			if len(rhs) == 1 && isBlank(lhs[0]) && isWriterClose(pass, rhs[0]) {
+				pass.Reportf(n.Pos(), "error from blob.Writer.Close is ignored; the blob may not have been written")
+			}
+		case *ast.ValueSpec:
+			for _, name := range n.Names {
+				lhs = append(lhs, name)
+			}
+			rhs = n.Values
+		case *ast.ExprStmt:
+			if isWriterClose(pass, n.X) {
+				pass.Reportf(n.Pos(), "error from blob.Writer.Close is ignored; the blob may not have been written")
+			}
+			return
+		case *ast.DeferStmt:
+			if isWriterClose(pass, n.Call) {
+				pass.Reportf(n.Pos(), "error from deferred blob.Writer.Close is ignored; the blob may not have been written")
+			}
+			return
+		case *ast.GoStmt:
+			if isWriterClose(pass, n.Call) {
+				pass.Reportf(n.Pos(), "error from blob.Writer.Close is ignored; the blob may not have been written")
+			}
+			return
+		}
+		if len(rhs) != 1 || len(lhs) == 0 {
+			return
+		}
+		what := openedType(pass, rhs[0])
+		if what == "" {
+			return
+		}
+		id, ok := lhs[0].(*ast.Ident)
+		if !ok {
+			return
+		}
+		v, ok := pass.TypesInfo.ObjectOf(id).(*types.Var)
+		if !ok || v.Parent() == nil || v.Parent() == v.Pkg().Scope() {
+			// Not a local variable.
+			return
+		}
+		if vars[v] == nil {
+			vars[v] = &opened{pos: id.Pos(), what: what}
+			order = append(order, v)
+		}
+	})
+	if len(vars) == 0 {
+		return nil, nil
+	}
+
+	// Find out how the variables are used.
+	insp.WithStack([]ast.Node{(*ast.Ident)(nil)}, func(n ast.Node, push bool, stack []ast.Node) bool {
+		if !push {
+			return true
+		}
+		id := n.(*ast.Ident)
+		v, ok := pass.TypesInfo.Uses[id].(*types.Var)
+		if !ok || vars[v] == nil {
+			return true
+		}
+		o := vars[v]
+		switch parent := stack[len(stack)-2].(type) {
+		case *ast.SelectorExpr:
+			if parent.X == id && parent.Sel.Name == "Close" {
+				o.closed = true
+			}
+		case *ast.AssignStmt:
+			if !isLHS(parent, id) {
+				o.passed = true
+			}
+		default:
+			o.passed = true
+		}
+		return true
+	})
+	for _, v := range order {
+		o := vars[v]
+		if !o.closed && !o.passed {
+			pass.Reportf(o.pos, "blob.%s %s is never closed", o.what, v.Name())
+		}
+	}
+	return nil, nil
+}
+
+// isBlobMethod reports whether e is a call to a method of the blob type recv
+// with one of the given names, and returns the name.
+func isBlobMethod(pass *analysis.Pass, e ast.Expr, recv string, names ...string) (string, bool) {
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return "", false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+	fn, ok := pass.TypesInfo.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != blobPath {
+		return "", false
+	}
+	sig := fn.Type().(*types.Signature)
+	if sig.Recv() == nil || typeName(sig.Recv().Type()) != recv {
+		return "", false
+	}
+	for _, name := range names {
+		if fn.Name() == name {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func isWriterClose(pass *analysis.Pass, e ast.Expr) bool {
+	_, ok := isBlobMethod(pass, e, "Writer", "Close")
+	return ok
+}
+
+// openedType returns "Writer" or "Reader" if e opens one, or "".
+func openedType(pass *analysis.Pass, e ast.Expr) string {
+	name, ok := isBlobMethod(pass, e, "Bucket", "NewWriter", "NewReader", "NewRangeReader")
+	switch {
+	case !ok:
+		return ""
+	case name == "NewWriter":
+		return "Writer"
+	default:
+		return "Reader"
+	}
+}
+
+// typeName returns the name of the named type t or *t, or "".
+func typeName(t types.Type) string {
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	if n, ok := t.(*types.Named); ok {
+		return n.Obj().Name()
+	}
+	return ""
+}
+
+func isBlank(e ast.Expr) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == "_"
+}
+
+// isLHS reports whether id is assigned to by a.
+func isLHS(a *ast.AssignStmt, id *ast.Ident) bool {
+	for _, e := range a.Lhs {
+		if e == id {
+			return true
+		}
+	}
+	return false
+}
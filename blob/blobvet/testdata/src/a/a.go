@@ -0,0 +1,74 @@
+package a
+
+import (
+	"context"
+	"io"
+
+	"gocloud.dev/blob"
+)
+
+func ignoredClose(ctx context.Context, b *blob.Bucket) {
+	w, _ := b.NewWriter(ctx, "key", nil)
+	w.Write([]byte("hello"))
+	w.Close() // want `error from blob.Writer.Close is ignored`
+}
+
+func blankClose(ctx context.Context, b *blob.Bucket) {
+	w, _ := b.NewWriter(ctx, "key", nil)
+	_ = w.Close() // want `error from blob.Writer.Close is ignored`
+}
+
+func deferredClose(ctx context.Context, b *blob.Bucket) error {
+	w, err := b.NewWriter(ctx, "key", nil)
+	if err != nil {
+		return err
+	}
+	defer w.Close() // want `error from deferred blob.Writer.Close is ignored`
+	_, err = w.Write([]byte("hello"))
+	return err
+}
+
+func checkedClose(ctx context.Context, b *blob.Bucket) error {
+	w, err := b.NewWriter(ctx, "key", nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func unclosedWriter(ctx context.Context, b *blob.Bucket) {
+	w, _ := b.NewWriter(ctx, "key", nil) // want `blob.Writer w is never closed`
+	w.Write([]byte("hello"))
+}
+
+func unclosedReader(ctx context.Context, b *blob.Bucket) {
+	var r, _ = b.NewRangeReader(ctx, "key", 0, 10, nil) // want `blob.Reader r is never closed`
+	r.Read(make([]byte, 10))
+}
+
+// A Reader's Close error does not lose data.
+func deferredReaderClose(ctx context.Context, b *blob.Bucket) {
+	r, _ := b.NewReader(ctx, "key", nil)
+	defer r.Close()
+	r.Read(make([]byte, 10))
+}
+
+// Writers passed on are closed elsewhere.
+func returned(ctx context.Context, b *blob.Bucket) (*blob.Writer, error) {
+	w, err := b.NewWriter(ctx, "key", nil)
+	return w, err
+}
+
+func closeLater(ctx context.Context, b *blob.Bucket, ws []io.WriteCloser) []io.WriteCloser {
+	w, _ := b.NewWriter(ctx, "key", nil)
+	return append(ws, w)
+}
+
+func closedInClosure(ctx context.Context, b *blob.Bucket) error {
+	w, _ := b.NewWriter(ctx, "key", nil)
+	finish := func() error { return w.Close() }
+	return finish()
+}
@@ -0,0 +1,28 @@
+// Package blob is a stub of gocloud.dev/blob for the tests of blobvet.
+package blob
+
+import "context"
+
+type Bucket struct{}
+
+func (b *Bucket) NewWriter(ctx context.Context, key string, opts interface{}) (*Writer, error) {
+	return nil, nil
+}
+
+func (b *Bucket) NewReader(ctx context.Context, key string, opts interface{}) (*Reader, error) {
+	return nil, nil
+}
+
+func (b *Bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts interface{}) (*Reader, error) {
+	return nil, nil
+}
+
+type Writer struct{}
+
+func (w *Writer) Write(p []byte) (int, error) { return len(p), nil }
+func (w *Writer) Close() error                { return nil }
+
+type Reader struct{}
+
+func (r *Reader) Read(p []byte) (int, error) { return 0, nil }
+func (r *Reader) Close() error               { return nil }
@@ -54,12 +54,40 @@ type Writer interface {
 	io.WriteCloser
 }
 
+// MetadataSetter is an optional interface for Writers that can set the
+// metadata of the blob when it is closed, after its content has been written.
+type MetadataSetter interface {
+	// SetMetadata replaces the metadata that the Writer writes with md. It is
+	// called at most once, after the last call to Write and before Close.
+	// Keys are guaranteed to be non-empty and lowercased.
+	SetMetadata(md map[string]string) error
+}
+
+// MetadataUpdater is an optional interface for Buckets that can replace the
+// metadata of an existing blob, in place or by copying the blob onto itself.
+// The portable type uses it to set metadata that is only known after a blob
+// has been written, for Writers that do not implement MetadataSetter.
+type MetadataUpdater interface {
+	// UpdateMetadata replaces the metadata of the blob at key with md, leaving
+	// its content and other attributes unchanged. If the blob does not exist,
+	// UpdateMetadata must return an error for which ErrorCode returns
+	// gcerrors.NotFound. Keys are guaranteed to be non-empty and lowercased,
+	// and md includes every key of the metadata the blob was written with, so
+	// drivers may merge md into the existing metadata instead of replacing it.
+	UpdateMetadata(ctx context.Context, key string, md map[string]string) error
+}
+
 // WriterOptions controls behaviors of Writer.
 type WriterOptions struct {
 	// BufferSize changes the default size in byte of the maximum part Writer can
 	// write in a single request, if supported. Larger objects will be split into
 	// multiple requests.
 	BufferSize int
+	// ContentLength, if positive, is the number of bytes that will be written.
+	// The portable type aborts writes of any other number of bytes. Drivers may
+	// use it to upload the blob in a single streaming request instead of
+	// buffering it.
+	ContentLength int64
 	// CacheControl specifies caching attributes that providers may use
 	// when serving the blob.
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Cache-Control
@@ -90,6 +118,15 @@ type WriterOptions struct {
 	// asFunc allows providers to expose provider-specific types;
 	// see Bucket.As for more details.
 	BeforeWrite func(asFunc func(interface{}) bool) error
+	// OnPartCompleted, if non-nil, should be called each time the provider
+	// finishes uploading a part of the blob, for providers that upload in
+	// parts. It may be called from any goroutine.
+	OnPartCompleted func()
+	// Hold, if true, places a hold on the blob when it is written, which
+	// prevents it from being deleted or replaced until the hold is released.
+	// Providers that don't support holds must return an error for which
+	// ErrorCode returns gcerrors.Unimplemented from NewTypedWriter.
+	Hold bool
 }
 
 // CopyOptions controls options for Copy.
@@ -143,6 +180,11 @@ type Attributes struct {
 	Size int64
 	// MD5 is an MD5 hash of the blob contents or nil if not available.
 	MD5 []byte
+	// Hold reports whether the blob has a hold on it.
+	Hold bool
+	// RetainUntil is the time before which the provider's retention settings
+	// prevent the blob from being deleted or replaced, or the zero time.
+	RetainUntil time.Time
 	// AsFunc allows providers to expose provider-specific types;
 	// see Bucket.As for more details.
 	// If not set, no provider-specific types are supported.
@@ -294,6 +336,14 @@ type Bucket interface {
 	// gcerrors.Unimplemented.
 	SignedURL(ctx context.Context, key string, opts *SignedURLOptions) (string, error)
 
+	// SetHold places a hold on the object associated with key if hold is true,
+	// and releases it otherwise. If the specified object does not exist,
+	// SetHold must return an error for which ErrorCode returns
+	// gcerrors.NotFound.
+	// If not supported, return an error for which ErrorCode returns
+	// gcerrors.Unimplemented.
+	SetHold(ctx context.Context, key string, hold bool) error
+
 	// Close cleans up any resources used by the Bucket. Once Close is called,
 	// there will be no method calls to the Bucket other than As, ErrorAs, and
 	// ErrorCode. There may be open readers or writers that will receive calls.
@@ -307,6 +357,28 @@ type SignedURLOptions struct {
 	Expiry time.Duration
 }
 
+// A Middleware returns a Bucket that wraps next, adding behavior such as
+// metrics, encryption, key rewriting or retries.
+//
+// The returned Bucket should forward every call it does not handle to next,
+// including As, ErrorAs and ErrorCode, so that provider-specific types and
+// error codes remain reachable through a chain of middlewares. Embedding next
+// as an anonymous field forwards all methods automatically; a middleware that
+// wants to expose its own type via As should check for it before delegating.
+type Middleware func(next Bucket) Bucket
+
+// Chain returns a Bucket that wraps b with each of mws.
+//
+// The first middleware is the outermost: a call on the returned Bucket is seen
+// by mws[0], then mws[1], and so on, before reaching b. Results flow back in the
+// reverse order. In other words, Chain(b, m1, m2) is equivalent to m1(m2(b)).
+func Chain(b Bucket, mws ...Middleware) Bucket {
+	for i := len(mws) - 1; i >= 0; i-- {
+		b = mws[i](b)
+	}
+	return b
+}
+
 // prefixedBucket implements Bucket by prepending prefix to all keys.
 type prefixedBucket struct {
 	base   Bucket
@@ -358,4 +430,7 @@ func (b *prefixedBucket) Delete(ctx context.Context, key string) error {
 func (b *prefixedBucket) SignedURL(ctx context.Context, key string, opts *SignedURLOptions) (string, error) {
 	return b.base.SignedURL(ctx, b.prefix+key, opts)
 }
+func (b *prefixedBucket) SetHold(ctx context.Context, key string, hold bool) error {
+	return b.base.SetHold(ctx, b.prefix+key, hold)
+}
 func (b *prefixedBucket) Close() error { return b.base.Close() }
@@ -61,6 +61,7 @@ import (
 	"gocloud.dev/blob/driver"
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/internal/escape"
+	"gocloud.dev/internal/gcerr"
 )
 
 const defaultPageSize = 1000
@@ -111,6 +112,11 @@ type Options struct {
 	// contains a signature produced by the URLSigner.
 	// URLSigner is only required for utilizing the SignedURL API.
 	URLSigner URLSigner
+
+	// Permissions, if non-nil, maps blob metadata to the permissions and
+	// ownership of the files that hold blobs, for uses such as staging
+	// deployment artifacts where they matter. See PermissionMapping.
+	Permissions *PermissionMapping
 }
 
 type bucket struct {
@@ -193,6 +199,9 @@ func unescapeKey(s string) string {
 }
 
 func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
+	if e, ok := err.(*gcerr.Error); ok {
+		return e.Code
+	}
 	switch {
 	case os.IsNotExist(err):
 		return gcerrors.NotFound
@@ -373,7 +382,7 @@ func (b *bucket) Attributes(ctx context.Context, key string) (*driver.Attributes
 		ContentEncoding:    xa.ContentEncoding,
 		ContentLanguage:    xa.ContentLanguage,
 		ContentType:        xa.ContentType,
-		Metadata:           xa.Metadata,
+		Metadata:           b.opts.Permissions.metadata(xa.Metadata, info),
 		ModTime:            info.ModTime(),
 		Size:               info.Size(),
 		MD5:                xa.MD5,
@@ -443,10 +452,17 @@ func (r *reader) As(i interface{}) bool { return false }
 
 // NewTypedWriter implements driver.NewTypedWriter.
 func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	if opts.Hold {
+		return nil, errHoldsUnimplemented
+	}
 	path, err := b.path(key)
 	if err != nil {
 		return nil, err
 	}
+	perms, err := b.opts.Permissions.parse(opts.Metadata)
+	if err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
 		return nil, err
 	}
@@ -476,6 +492,7 @@ func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType str
 		f:          f,
 		path:       path,
 		attrs:      attrs,
+		perms:      perms,
 		contentMD5: opts.ContentMD5,
 		md5hash:    md5.New(),
 	}
@@ -487,6 +504,7 @@ type writer struct {
 	f          *os.File
 	path       string
 	attrs      xattrs
+	perms      filePerms
 	contentMD5 []byte
 	// We compute the MD5 hash so that we can store it with the file attributes,
 	// not for verification.
@@ -519,6 +537,11 @@ func (w *writer) Close() error {
 	md5sum := w.md5hash.Sum(nil)
 	w.attrs.MD5 = md5sum
 
+	// Set the permissions before the file becomes visible.
+	if err := w.perms.apply(w.f.Name()); err != nil {
+		return err
+	}
+
 	// Write the attributes file.
 	if err := setAttrs(w.path, w.attrs); err != nil {
 		return err
@@ -531,11 +554,22 @@ func (w *writer) Close() error {
 	return nil
 }
 
+// UpdateMetadata implements driver.MetadataUpdater. It rewrites the attributes
+// file of the blob, and does not change the permissions of the file holding it.
+func (b *bucket) UpdateMetadata(ctx context.Context, key string, md map[string]string) error {
+	path, _, xa, err := b.forKey(key)
+	if err != nil {
+		return err
+	}
+	xa.Metadata = md
+	return setAttrs(path, *xa)
+}
+
 // Copy implements driver.Copy.
 func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
 	// Note: we could use NewRangedReader here, but since we need to copy all of
 	// the metadata (from xa), it's more efficient to do it directly.
-	srcPath, _, xa, err := b.forKey(srcKey)
+	srcPath, info, xa, err := b.forKey(srcKey)
 	if err != nil {
 		return err
 	}
@@ -552,7 +586,7 @@ func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.C
 		ContentDisposition: xa.ContentDisposition,
 		ContentEncoding:    xa.ContentEncoding,
 		ContentLanguage:    xa.ContentLanguage,
-		Metadata:           xa.Metadata,
+		Metadata:           b.opts.Permissions.metadata(xa.Metadata, info),
 		BeforeWrite:        opts.BeforeCopy,
 	}
 	// Create a cancelable context so we can cancel the write if there are
@@ -600,6 +634,15 @@ func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedU
 	return surl.String(), nil
 }
 
+// errHoldsUnimplemented is returned when a caller asks for a hold, since files
+// cannot be protected from deletion by their owner.
+var errHoldsUnimplemented = gcerr.Newf(gcerr.Unimplemented, nil, "fileblob: holds are not supported")
+
+// SetHold implements driver.SetHold.
+func (b *bucket) SetHold(ctx context.Context, key string, hold bool) error {
+	return errHoldsUnimplemented
+}
+
 // URLSigner defines an interface for creating and verifying a signed URL for
 // objects in a fileblob bucket. Signed URLs are typically used for granting
 // access to an otherwise-protected resource without requiring further
@@ -25,12 +25,15 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 
 	"gocloud.dev/blob"
 	"gocloud.dev/blob/driver"
 	"gocloud.dev/blob/drivertest"
+	"gocloud.dev/gcerrors"
 )
 
 type harness struct {
@@ -253,3 +256,111 @@ func TestOpenBucketFromURL(t *testing.T) {
 		}
 	}
 }
+
+func TestPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX permissions are not supported on Windows")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "fileblob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := OpenBucket(dir, &Options{Permissions: &PermissionMapping{ModeKey: "Mode", UIDKey: "UID", GIDKey: "GID"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// Changing ownership to the current owner is always allowed.
+	md := map[string]string{
+		"mode": "0751",
+		"uid":  strconv.Itoa(os.Getuid()),
+		"gid":  strconv.Itoa(os.Getgid()),
+	}
+	if err := b.WriteAll(ctx, "exe", []byte("x"), &blob.WriterOptions{Metadata: md}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Copy(ctx, "exe-copy", "exe", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"exe", "exe-copy"} {
+		info, err := os.Stat(filepath.Join(dir, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0751 {
+			t.Errorf("%s: got file mode %v, want 0751", key, info.Mode().Perm())
+		}
+		attrs, err := b.Attributes(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range md {
+			if got := attrs.Metadata[k]; got != v {
+				t.Errorf("%s: got metadata %q=%q, want %q", key, k, got, v)
+			}
+		}
+	}
+
+	// The mode reported by Attributes follows the file.
+	if err := os.Chmod(filepath.Join(dir, "exe"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := b.Attributes(ctx, "exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attrs.Metadata["mode"]; got != "0700" {
+		t.Errorf("after chmod: got mode %q, want 0700", got)
+	}
+
+	// Invalid values fail the write.
+	for _, md := range []map[string]string{{"mode": "0999"}, {"mode": "01777"}, {"uid": "-1"}, {"gid": "x"}} {
+		err := b.WriteAll(ctx, "bad", []byte("x"), &blob.WriterOptions{Metadata: md})
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", md, err)
+		}
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "fileblob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := OpenBucket(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// The writer is created at once because the content type is known, so the
+	// metadata is updated after the blob is written.
+	w, err := b.NewWriter(ctx, "key", &blob.WriterOptions{ContentType: "text/plain", Metadata: map[string]string{"a": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("one\ntwo\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetMetadata("Lines", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := b.Attributes(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attrs.Metadata; len(got) != 2 || got["a"] != "1" || got["lines"] != "2" {
+		t.Errorf("got metadata %v, want a=1 and lines=2", got)
+	}
+	if attrs.ContentType != "text/plain" || attrs.Size != 8 {
+		t.Errorf("got content type %q and size %d, want text/plain and 8", attrs.ContentType, attrs.Size)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileblob
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gocloud.dev/internal/gcerr"
+)
+
+// PermissionMapping maps blob metadata to the POSIX permissions and ownership
+// of the files that hold blobs. Each field names a metadata key; an empty field
+// leaves that attribute unmapped. Keys are matched case-insensitively, since the
+// blob package lowercases metadata keys.
+//
+// When a blob is written with a mapped key in its metadata, its file gets the
+// corresponding mode, owner or group. Attributes reports the file's current
+// values under the mapped keys, so changes made outside the bucket are visible.
+// Copy gives the copy the permissions and ownership of the original. Files
+// written without a mode have mode 0600.
+type PermissionMapping struct {
+	// ModeKey is the metadata key holding the file's permission bits, as an
+	// octal number such as "0755".
+	ModeKey string
+
+	// UIDKey is the metadata key holding the numeric user ID of the file's
+	// owner. Changing a file's owner usually requires privileges; if it fails,
+	// so does the write. Ownership is not supported on Windows.
+	UIDKey string
+
+	// GIDKey is the metadata key holding the numeric group ID of the file's
+	// group.
+	GIDKey string
+}
+
+// filePerms holds the permissions to give a file. A uid or gid of -1 leaves
+// that ID unchanged, as with os.Chown.
+type filePerms struct {
+	mode     os.FileMode
+	setMode  bool
+	uid, gid int
+}
+
+// parse returns the permissions that md, the metadata of a blob being written,
+// asks for.
+func (m *PermissionMapping) parse(md map[string]string) (filePerms, error) {
+	p := filePerms{uid: -1, gid: -1}
+	if m == nil {
+		return p, nil
+	}
+	if v, ok := md[strings.ToLower(m.ModeKey)]; ok && m.ModeKey != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+			return p, gcerr.Newf(gcerr.InvalidArgument, nil, "fileblob: metadata %q: invalid file mode %q", m.ModeKey, v)
+		}
+		p.mode = os.FileMode(mode)
+		p.setMode = true
+	}
+	var err error
+	if p.uid, err = parseID(md, m.UIDKey); err != nil {
+		return p, err
+	}
+	if p.gid, err = parseID(md, m.GIDKey); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// parseID parses the user or group ID in md under key, returning -1 if it is
+// absent.
+func parseID(md map[string]string, key string) (int, error) {
+	v, ok := md[strings.ToLower(key)]
+	if !ok || key == "" {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil || id < 0 {
+		return -1, gcerr.Newf(gcerr.InvalidArgument, nil, "fileblob: metadata %q: invalid ID %q", key, v)
+	}
+	return id, nil
+}
+
+// apply gives the file at path the permissions p.
+func (p filePerms) apply(path string) error {
+	if p.setMode {
+		if err := os.Chmod(path, p.mode); err != nil {
+			return err
+		}
+	}
+	if p.uid != -1 || p.gid != -1 {
+		return os.Chown(path, p.uid, p.gid)
+	}
+	return nil
+}
+
+// metadata returns md with the mapped keys set from info, the file holding the
+// blob. It does not modify md.
+func (m *PermissionMapping) metadata(md map[string]string, info os.FileInfo) map[string]string {
+	if m == nil {
+		return md
+	}
+	out := make(map[string]string, len(md)+3)
+	for k, v := range md {
+		out[k] = v
+	}
+	if m.ModeKey != "" {
+		out[strings.ToLower(m.ModeKey)] = fmt.Sprintf("%04o", info.Mode().Perm())
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		if m.UIDKey != "" {
+			out[strings.ToLower(m.UIDKey)] = strconv.Itoa(uid)
+		}
+		if m.GIDKey != "" {
+			out[strings.ToLower(m.GIDKey)] = strconv.Itoa(gid)
+		}
+	}
+	return out
+}
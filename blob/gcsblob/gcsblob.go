@@ -45,6 +45,25 @@
 //  - Attributes: storage.ObjectAttrs
 //  - CopyOptions.BeforeCopy: *CopyObjectHandles, *storage.Copier
 //  - WriterOptions.BeforeWrite: **storage.ObjectHandle, *storage.Writer
+//
+// Holds and Retention
+//
+// WriterOptions.Hold, Bucket.SetHold and Attributes.Hold use GCS temporary
+// holds. Attributes.RetainUntil is the object's retention expiration time,
+// which GCS computes from the bucket's retention policy.
+// To place an event-based hold on an object, set EventBasedHold on the
+// *storage.Writer from WriterOptions.BeforeWrite; Attributes.As exposes it in
+// storage.ObjectAttrs. To set or lock a bucket's retention policy, use the
+// *storage.Client from Bucket.As.
+// See https://cloud.google.com/storage/docs/object-holds and
+// https://cloud.google.com/storage/docs/bucket-lock for more details.
+//
+// Streaming Writes
+//
+// When WriterOptions.ContentLength is set, gcsblob uploads the blob in a single
+// request as it is written, instead of buffering chunks of BufferSize bytes for
+// a resumable upload. A single-request upload can't be resumed, so a failure
+// partway through fails the whole write.
 package gcsblob // import "gocloud.dev/blob/gcsblob"
 
 import (
@@ -258,6 +277,10 @@ func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
 		switch gerr.Code {
 		case http.StatusNotFound:
 			return gcerrors.NotFound
+		case http.StatusForbidden:
+			// Returned, among others, when a hold or a retention policy prevents
+			// an object from being deleted or replaced.
+			return gcerrors.PermissionDenied
 		case http.StatusPreconditionFailed:
 			return gcerrors.FailedPrecondition
 		}
@@ -379,6 +402,8 @@ func (b *bucket) Attributes(ctx context.Context, key string) (*driver.Attributes
 		ModTime:            attrs.Updated,
 		Size:               attrs.Size,
 		MD5:                attrs.MD5,
+		Hold:               attrs.TemporaryHold,
+		RetainUntil:        attrs.RetentionExpirationTime,
 		AsFunc: func(i interface{}) bool {
 			p, ok := i.(*storage.ObjectAttrs)
 			if !ok {
@@ -466,6 +491,10 @@ func unescapeKey(key string) string {
 }
 
 // NewTypedWriter implements driver.NewTypedWriter.
+//
+// If ctx is canceled before the writer is closed, the upload fails and no object
+// is written. GCS discards the data of resumable uploads that are never
+// completed after a week, so unlike S3 there is nothing to clean up.
 func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
 	key = escapeKey(key)
 	bkt := b.client.Bucket(b.name)
@@ -483,8 +512,18 @@ func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType str
 		w.ContentLanguage = opts.ContentLanguage
 		w.ContentType = contentType
 		w.ChunkSize = bufferSize(opts.BufferSize)
+		if opts.ContentLength > 0 {
+			// The size is known, so stream the blob in a single request
+			// instead of buffering chunks for a resumable upload.
+			w.ChunkSize = 0
+		}
 		w.Metadata = opts.Metadata
 		w.MD5 = opts.ContentMD5
+		w.TemporaryHold = opts.Hold
+		if opts.OnPartCompleted != nil {
+			// ProgressFunc is called each time a chunk is uploaded.
+			w.ProgressFunc = func(int64) { opts.OnPartCompleted() }
+		}
 		return w
 	}
 
@@ -514,6 +553,16 @@ func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType str
 	return w, nil
 }
 
+// UpdateMetadata implements driver.MetadataUpdater. GCS merges the keys of md
+// into the blob's metadata rather than replacing it, which is the same here,
+// since md includes every key the blob was written with.
+func (b *bucket) UpdateMetadata(ctx context.Context, key string, md map[string]string) error {
+	key = escapeKey(key)
+	obj := b.client.Bucket(b.name).Object(key)
+	_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: md})
+	return err
+}
+
 // CopyObjectHandles holds the ObjectHandles for the destination and source
 // of a Copy. It is used by the BeforeCopy As hook.
 type CopyObjectHandles struct {
@@ -572,6 +621,15 @@ func (b *bucket) Delete(ctx context.Context, key string) error {
 	return obj.Delete(ctx)
 }
 
+// SetHold implements driver.SetHold.
+func (b *bucket) SetHold(ctx context.Context, key string, hold bool) error {
+	key = escapeKey(key)
+	bkt := b.client.Bucket(b.name)
+	obj := bkt.Object(key)
+	_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{TemporaryHold: hold})
+	return err
+}
+
 func (b *bucket) SignedURL(ctx context.Context, key string, dopts *driver.SignedURLOptions) (string, error) {
 	if b.opts.GoogleAccessID == "" || (b.opts.PrivateKey == nil && b.opts.SignBytes == nil) {
 		return "", errors.New("to use SignedURL, you must call OpenBucket with a valid Options.GoogleAccessID and exactly one of Options.PrivateKey or Options.SignBytes")
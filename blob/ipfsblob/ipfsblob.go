@@ -0,0 +1,645 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipfsblob provides a blob implementation backed by IPFS, a
+// content-addressed store. Use OpenBucket to construct a *blob.Bucket.
+//
+// Content addressing
+//
+// The key of a blob is its content identifier (CID), optionally followed by
+// a slash-separated path within a directory, like "bafy.../index.html". A key
+// is derived from the blob's contents, so it cannot be chosen: write with an
+// empty key, and use Write or the *Result exposed by As to learn the CID.
+// A write with a non-empty key fails, after adding the contents, unless the
+// key is the CID of the contents.
+//
+// Writes and listing use the HTTP API of an IPFS node, such as Kubo. Reads use
+// the node too, or an HTTP gateway if Options.GatewayURL is set; a bucket with
+// only a gateway is read-only. Written blobs are pinned by the node, ListPaged
+// lists the pinned blobs, and Delete unpins a blob, so that the node may
+// remove it at its next garbage collection. Other nodes may still hold it.
+//
+// IPFS stores only the bytes of a blob. The content type, metadata and other
+// attributes given when writing are discarded; blobs are read with the content
+// type reported by the gateway, or "application/octet-stream", and without a
+// modification time or MD5 hash. Copy and SetHold are not supported. SignedURL
+// returns the gateway URL of the blob, which does not expire.
+//
+// Reading a CID that neither the node nor the gateway has may block while it
+// is searched for on the network, until the context is done.
+//
+// URLs
+//
+// For blob.OpenBucket, ipfsblob registers for the scheme "ipfs".
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://gocloud.dev/concepts/urls/ for background information.
+//
+// As
+//
+// ipfsblob exposes the following types for As:
+//  - Bucket: *http.Client
+//  - BeforeWrite: **Result
+//  - Error: *APIError
+package ipfsblob // import "gocloud.dev/blob/ipfsblob"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/driver"
+	"gocloud.dev/gcerrors"
+	"golang.org/x/xerrors"
+)
+
+const defaultPageSize = 1000
+
+var (
+	errNotImplemented = errors.New("ipfsblob: not implemented")
+	errReadOnly       = errors.New("ipfsblob: the bucket has no API URL, so it is read-only")
+	errKeyMismatch    = errors.New("ipfsblob: the key is not the CID of the written contents")
+)
+
+func init() {
+	blob.DefaultURLMux().RegisterBucket(Scheme, &URLOpener{})
+}
+
+// Scheme is the URL scheme ipfsblob registers its URLOpener under on
+// blob.DefaultMux.
+const Scheme = "ipfs"
+
+// URLOpener opens URLs like "ipfs://localhost:5001", for the node whose HTTP
+// API is at http://localhost:5001.
+//
+// The following query parameters are supported:
+//   - gateway: the URL of an HTTP gateway to read from. With a gateway, the
+//       host may be empty, as in "ipfs://?gateway=https://ipfs.io", for a
+//       read-only bucket.
+type URLOpener struct {
+	// Options specifies the options to pass to OpenBucket.
+	Options Options
+}
+
+// OpenBucketURL opens a blob.Bucket based on u.
+func (o *URLOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob.Bucket, error) {
+	opts := o.Options
+	for param, values := range u.Query() {
+		switch param {
+		case "gateway":
+			opts.GatewayURL = values[0]
+		default:
+			return nil, fmt.Errorf("open bucket %v: invalid query parameter %q", u, param)
+		}
+	}
+	var apiURL string
+	if u.Host != "" {
+		apiURL = "http://" + u.Host
+	}
+	return OpenBucket(apiURL, &opts)
+}
+
+// Options sets options for constructing a *blob.Bucket backed by IPFS.
+type Options struct {
+	// GatewayURL is the URL of an HTTP gateway, like "https://ipfs.io", to
+	// read blobs from. If empty, blobs are read from the node.
+	GatewayURL string
+
+	// Client is the HTTP client used for requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// A Result holds the CID of a written blob once its Writer is closed. To get
+// it, call the asFunc of blob.WriterOptions.BeforeWrite with a **Result, or
+// use Write.
+type Result struct {
+	// CID is the content identifier of the blob, which is its key.
+	CID string
+}
+
+// Write writes data to bucket, which must be an ipfsblob bucket, and returns
+// the key of the new blob. opts may be nil; its BeforeWrite, if any, is called
+// as usual.
+func Write(ctx context.Context, bucket *blob.Bucket, data []byte, opts *blob.WriterOptions) (string, error) {
+	var o blob.WriterOptions
+	if opts != nil {
+		o = *opts
+	}
+	var res *Result
+	o.BeforeWrite = func(asFunc func(interface{}) bool) error {
+		if !asFunc(&res) {
+			return errors.New("ipfsblob: Write requires an ipfsblob bucket")
+		}
+		if opts != nil && opts.BeforeWrite != nil {
+			return opts.BeforeWrite(asFunc)
+		}
+		return nil
+	}
+	if err := bucket.WriteAll(ctx, "", data, &o); err != nil {
+		return "", err
+	}
+	return res.CID, nil
+}
+
+// An APIError is an error response from the node or the gateway.
+type APIError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Message is the error message of the node, or the body of the response.
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("ipfsblob: status %d: %s", e.StatusCode, e.Message)
+}
+
+type bucket struct {
+	api     string // the base URL of the node's HTTP API, or empty
+	gateway string // the base URL of the gateway, or empty
+	client  *http.Client
+}
+
+// OpenBucket returns a *blob.Bucket backed by the IPFS node whose HTTP API is
+// at apiURL, like "http://localhost:5001". apiURL may be empty if
+// opts.GatewayURL is set, for a read-only bucket.
+func OpenBucket(apiURL string, opts *Options) (*blob.Bucket, error) {
+	b, err := openBucket(apiURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	return blob.NewBucket(b), nil
+}
+
+func openBucket(apiURL string, opts *Options) (*bucket, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if apiURL == "" && opts.GatewayURL == "" {
+		return nil, errors.New("ipfsblob: need an API URL or a gateway URL")
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &bucket{
+		api:     strings.TrimSuffix(apiURL, "/"),
+		gateway: strings.TrimSuffix(opts.GatewayURL, "/"),
+		client:  client,
+	}, nil
+}
+
+func (b *bucket) Close() error {
+	return nil
+}
+
+func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
+	switch err {
+	case errNotImplemented:
+		return gcerrors.Unimplemented
+	case errReadOnly, errKeyMismatch:
+		return gcerrors.FailedPrecondition
+	}
+	var e *APIError
+	if !xerrors.As(err, &e) {
+		return gcerrors.Unknown
+	}
+	msg := strings.ToLower(e.Message)
+	switch {
+	case e.StatusCode == http.StatusNotFound,
+		strings.Contains(msg, "not found"),
+		strings.Contains(msg, "no link named"),
+		strings.Contains(msg, "not pinned"):
+		return gcerrors.NotFound
+	case e.StatusCode == http.StatusBadRequest,
+		strings.Contains(msg, "invalid"):
+		return gcerrors.InvalidArgument
+	case e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusUnauthorized:
+		return gcerrors.PermissionDenied
+	case e.StatusCode == http.StatusTooManyRequests:
+		return gcerrors.ResourceExhausted
+	default:
+		return gcerrors.Unknown
+	}
+}
+
+// As implements driver.As.
+func (b *bucket) As(i interface{}) bool {
+	p, ok := i.(**http.Client)
+	if !ok {
+		return false
+	}
+	*p = b.client
+	return true
+}
+
+// ErrorAs implements driver.ErrorAs.
+func (b *bucket) ErrorAs(err error, i interface{}) bool {
+	e, ok := err.(*APIError)
+	if !ok {
+		return false
+	}
+	p, ok := i.(**APIError)
+	if !ok {
+		return false
+	}
+	*p = e
+	return true
+}
+
+// call calls the API command cmd with args, and returns the response, whose
+// body the caller must close.
+func (b *bucket) call(ctx context.Context, cmd string, args url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	if b.api == "" {
+		return nil, errReadOnly
+	}
+	u := b.api + "/api/v0/" + cmd
+	if len(args) > 0 {
+		u += "?" + args.Encode()
+	}
+	// The API accepts only POST requests.
+	req, err := http.NewRequest(http.MethodPost, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return b.do(ctx, req)
+}
+
+// do sends req, and returns an *APIError if the response is not a success.
+func (b *bucket) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	// The node's errors are JSON objects with a Message field.
+	var msg struct{ Message string }
+	if json.Unmarshal(body, &msg) == nil && msg.Message != "" {
+		e.Message = msg.Message
+	}
+	return nil, e
+}
+
+// callJSON calls cmd and decodes its JSON response into v.
+func (b *bucket) callJSON(ctx context.Context, cmd string, args url.Values, v interface{}) error {
+	resp, err := b.call(ctx, cmd, args, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Attributes implements driver.Attributes.
+func (b *bucket) Attributes(ctx context.Context, key string) (*driver.Attributes, error) {
+	size, contentType, err := b.stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &driver.Attributes{
+		ContentType: contentType,
+		Size:        size,
+	}, nil
+}
+
+// stat returns the size and content type of the blob with key.
+func (b *bucket) stat(ctx context.Context, key string) (int64, string, error) {
+	if b.api == "" {
+		req, err := http.NewRequest(http.MethodHead, b.gatewayURL(key), nil)
+		if err != nil {
+			return 0, "", err
+		}
+		resp, err := b.do(ctx, req)
+		if err != nil {
+			return 0, "", err
+		}
+		resp.Body.Close()
+		return resp.ContentLength, contentType(resp), nil
+	}
+	var st struct {
+		Size int64
+		Type string
+	}
+	if err := b.callJSON(ctx, "files/stat", url.Values{"arg": {"/ipfs/" + key}}, &st); err != nil {
+		return 0, "", err
+	}
+	if st.Type == "directory" {
+		return 0, "", &APIError{StatusCode: http.StatusBadRequest, Message: "invalid key: " + key + " is a directory"}
+	}
+	return st.Size, defaultContentType, nil
+}
+
+const defaultContentType = "application/octet-stream"
+
+func contentType(resp *http.Response) string {
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		return ct
+	}
+	return defaultContentType
+}
+
+func (b *bucket) gatewayURL(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return b.gateway + "/ipfs/" + strings.Join(parts, "/")
+}
+
+// ListPaged implements driver.ListPaged. It lists the blobs pinned by the
+// node, without their sizes.
+func (b *bucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
+	if opts.BeforeList != nil {
+		if err := opts.BeforeList(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
+	var pins struct {
+		Keys map[string]struct{ Type string }
+	}
+	if err := b.callJSON(ctx, "pin/ls", url.Values{"type": {"recursive"}}, &pins); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k := range pins.Keys {
+		if strings.HasPrefix(k, opts.Prefix) && k > string(opts.PageToken) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	var page driver.ListPage
+	for _, k := range keys {
+		if len(page.Objects) == pageSize {
+			page.NextPageToken = []byte(page.Objects[pageSize-1].Key)
+			break
+		}
+		page.Objects = append(page.Objects, &driver.ListObject{Key: k})
+	}
+	return &page, nil
+}
+
+// NewRangeReader implements driver.NewRangeReader.
+func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	var (
+		body  io.ReadCloser
+		attrs driver.ReaderAttributes
+	)
+	if b.gateway != "" && length != 0 {
+		req, err := http.NewRequest(http.MethodGet, b.gatewayURL(key), nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 || length > 0 {
+			r := fmt.Sprintf("bytes=%d-", offset)
+			if length > 0 {
+				r += strconv.FormatInt(offset+length-1, 10)
+			}
+			req.Header.Set("Range", r)
+		}
+		resp, err := b.do(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		attrs.ContentType = contentType(resp)
+		attrs.Size = resp.ContentLength
+		if resp.StatusCode == http.StatusPartialContent {
+			attrs.Size = totalSize(resp.Header.Get("Content-Range"))
+		}
+		body = resp.Body
+	} else {
+		size, ct, err := b.stat(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		attrs = driver.ReaderAttributes{ContentType: ct, Size: size}
+		if length == 0 || offset >= size {
+			body = ioutil.NopCloser(strings.NewReader(""))
+		} else {
+			args := url.Values{"arg": {key}, "offset": {strconv.FormatInt(offset, 10)}}
+			if length > 0 {
+				args.Set("length", strconv.FormatInt(length, 10))
+			}
+			resp, err := b.call(ctx, "cat", args, nil, "")
+			if err != nil {
+				return nil, err
+			}
+			body = resp.Body
+		}
+	}
+	if opts.BeforeRead != nil {
+		if err := opts.BeforeRead(func(interface{}) bool { return false }); err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+	return &reader{body: body, attrs: attrs}, nil
+}
+
+// totalSize returns the complete length in a Content-Range header like
+// "bytes 0-9/100", or -1 if it is unknown.
+func totalSize(contentRange string) int64 {
+	i := strings.LastIndexByte(contentRange, '/')
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+type reader struct {
+	body  io.ReadCloser
+	attrs driver.ReaderAttributes
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	return r.body.Read(p)
+}
+
+func (r *reader) Close() error {
+	return r.body.Close()
+}
+
+func (r *reader) Attributes() *driver.ReaderAttributes {
+	return &r.attrs
+}
+
+func (r *reader) As(i interface{}) bool { return false }
+
+// NewTypedWriter implements driver.NewTypedWriter. The contents are added to
+// the node as they are written, and pinned.
+func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	if b.api == "" {
+		return nil, errReadOnly
+	}
+	if opts.Hold {
+		return nil, errNotImplemented
+	}
+	w := &writer{key: key, result: &Result{}, done: make(chan struct{})}
+	if opts.BeforeWrite != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**Result)
+			if !ok {
+				return false
+			}
+			*p = w.result
+			return true
+		}
+		if err := opts.BeforeWrite(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	pr, pw := io.Pipe()
+	w.pw = pw
+	w.mw = multipart.NewWriter(pw)
+	args := url.Values{
+		"cid-version": {"1"},
+		"pin":         {"true"},
+		"quieter":     {"true"},
+	}
+	go func() {
+		defer close(w.done)
+		resp, err := b.call(ctx, "add", args, pr, w.mw.FormDataContentType())
+		if err != nil {
+			w.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		defer resp.Body.Close()
+		// The response is a stream of JSON objects; the last is for the root
+		// of the added contents.
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var added struct{ Hash string }
+			if err := dec.Decode(&added); err == io.EOF {
+				break
+			} else if err != nil {
+				w.err = err
+				return
+			}
+			w.cid = added.Hash
+		}
+	}()
+	return w, nil
+}
+
+type writer struct {
+	key    string
+	result *Result
+	pw     *io.PipeWriter
+	mw     *multipart.Writer
+	part   io.Writer // created by the first write
+
+	done chan struct{} // closed when the request is done
+	cid  string
+	err  error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.part == nil {
+		part, err := w.mw.CreateFormFile("file", "blob")
+		if err != nil {
+			return 0, err
+		}
+		w.part = part
+	}
+	return w.part.Write(p)
+}
+
+func (w *writer) Close() error {
+	if _, err := w.Write(nil); err != nil {
+		return w.wait(err)
+	}
+	if err := w.mw.Close(); err != nil {
+		return w.wait(err)
+	}
+	w.pw.Close()
+	if err := w.wait(nil); err != nil {
+		return err
+	}
+	if w.cid == "" {
+		return errors.New("ipfsblob: the node did not return a CID")
+	}
+	w.result.CID = w.cid
+	if w.key != "" && w.key != w.cid {
+		return errKeyMismatch
+	}
+	return nil
+}
+
+// wait waits for the request to finish, and returns its error, or err if it
+// has none.
+func (w *writer) wait(err error) error {
+	if err != nil {
+		w.pw.CloseWithError(err)
+	}
+	<-w.done
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+// Copy implements driver.Copy. It is not supported: the key of a blob is
+// determined by its contents.
+func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	return errNotImplemented
+}
+
+// Delete implements driver.Delete. It unpins the blob.
+func (b *bucket) Delete(ctx context.Context, key string) error {
+	resp, err := b.call(ctx, "pin/rm", url.Values{"arg": {key}}, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// SignedURL implements driver.SignedURL. It returns the gateway URL of the
+// blob.
+func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
+	if b.gateway == "" {
+		return "", errNotImplemented
+	}
+	return b.gatewayURL(key), nil
+}
+
+// SetHold implements driver.SetHold.
+func (b *bucket) SetHold(ctx context.Context, key string, hold bool) error {
+	return errNotImplemented
+}
@@ -0,0 +1,319 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfsblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// fakeNode serves the parts of the HTTP API of an IPFS node, and of a
+// gateway, that ipfsblob uses. Its CIDs are not real ones.
+type fakeNode struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	pins   map[string]bool
+}
+
+// newFakeNode starts a fakeNode. Close the server when done with it.
+func newFakeNode() (*fakeNode, *httptest.Server) {
+	n := &fakeNode{blocks: map[string][]byte{}, pins: map[string]bool{}}
+	return n, httptest.NewServer(n)
+}
+
+func fakeCID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "bafk" + hex.EncodeToString(sum[:10])
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fail := func(msg string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Message": msg, "Code": 0, "Type": "error"})
+	}
+	if strings.HasPrefix(r.URL.Path, "/ipfs/") {
+		data, ok := n.blocks[strings.TrimPrefix(r.URL.Path, "/ipfs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	arg := r.URL.Query().Get("arg")
+	switch strings.TrimPrefix(r.URL.Path, "/api/v0/") {
+	case "add":
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		cid := fakeCID(data)
+		n.blocks[cid] = data
+		n.pins[cid] = true
+		json.NewEncoder(w).Encode(map[string]string{"Name": "blob", "Hash": cid, "Size": strconv.Itoa(len(data))})
+	case "files/stat":
+		data, ok := n.blocks[strings.TrimPrefix(arg, "/ipfs/")]
+		if !ok {
+			fail("block was not found locally (offline): ipld: could not find " + arg)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Hash": arg, "Size": len(data), "Type": "file"})
+	case "cat":
+		data, ok := n.blocks[arg]
+		if !ok {
+			fail("block was not found locally (offline)")
+			return
+		}
+		off, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		data = data[off:]
+		if l := r.URL.Query().Get("length"); l != "" {
+			n, _ := strconv.Atoi(l)
+			if n < len(data) {
+				data = data[:n]
+			}
+		}
+		w.Write(data)
+	case "pin/ls":
+		keys := map[string]interface{}{}
+		for k := range n.pins {
+			keys[k] = map[string]string{"Type": "recursive"}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Keys": keys})
+	case "pin/rm":
+		if !n.pins[arg] {
+			fail("not pinned or pinned indirectly")
+			return
+		}
+		delete(n.pins, arg)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Pins": []string{arg}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	ctx := context.Background()
+	node, srv := newFakeNode()
+	defer srv.Close()
+	for _, gateway := range []string{"", srv.URL} {
+		t.Run(fmt.Sprintf("gateway=%q", gateway), func(t *testing.T) {
+			b, err := OpenBucket(srv.URL, &Options{GatewayURL: gateway})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+
+			data := []byte("hello, content-addressed world")
+			key, err := Write(ctx, b, data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fakeCID(data); key != want {
+				t.Fatalf("got key %q, want %q", key, want)
+			}
+			got, err := b.ReadAll(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %q, want %q", got, data)
+			}
+			r, err := b.NewRangeReader(ctx, key, 7, 7, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "content" || r.Size() != int64(len(data)) {
+				t.Errorf("range read: got %q of size %d, want %q of size %d", got, r.Size(), "content", len(data))
+			}
+			attrs, err := b.Attributes(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.Size != int64(len(data)) {
+				t.Errorf("got size %d, want %d", attrs.Size, len(data))
+			}
+
+			// Writing with the CID as the key succeeds; with another key it fails.
+			if err := b.WriteAll(ctx, key, data, nil); err != nil {
+				t.Errorf("write with the CID as key: %v", err)
+			}
+			if err := b.WriteAll(ctx, key, []byte("other"), nil); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+				t.Errorf("write with the wrong key: got %v, want FailedPrecondition", err)
+			}
+			node.mu.Lock()
+			delete(node.pins, fakeCID([]byte("other")))
+			node.mu.Unlock()
+
+			iter := b.List(nil)
+			obj, err := iter.Next(ctx)
+			if err != nil || obj.Key != key {
+				t.Errorf("List: got %v, %v; want the written blob", obj, err)
+			}
+
+			if err := b.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Delete(ctx, key); gcerrors.Code(err) != gcerrors.NotFound {
+				t.Errorf("second Delete: got %v, want NotFound", err)
+			}
+			if _, err := b.ReadAll(ctx, fakeCID([]byte("missing"))); gcerrors.Code(err) != gcerrors.NotFound {
+				t.Errorf("read of a missing blob: got %v, want NotFound", err)
+			}
+			if err := b.Copy(ctx, "a", key, nil); gcerrors.Code(err) != gcerrors.Unimplemented {
+				t.Errorf("Copy: got %v, want Unimplemented", err)
+			}
+		})
+	}
+}
+
+func TestGatewayOnly(t *testing.T) {
+	ctx := context.Background()
+	node, srv := newFakeNode()
+	defer srv.Close()
+	data := []byte("published")
+	node.blocks[fakeCID(data)] = data
+
+	b, err := OpenBucket("", &Options{GatewayURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	key := fakeCID(data)
+	got, err := b.ReadAll(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	attrs, err := b.Attributes(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != int64(len(data)) || attrs.ContentType != "text/plain" {
+		t.Errorf("got attributes %+v, want size %d and the gateway's content type", attrs, len(data))
+	}
+	url, err := b.SignedURL(ctx, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/ipfs/" + key; url != want {
+		t.Errorf("SignedURL: got %q, want %q", url, want)
+	}
+	if _, err := Write(ctx, b, data, nil); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("write to a read-only bucket: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestErrorAs(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newFakeNode()
+	defer srv.Close()
+	b, err := OpenBucket(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, err = b.ReadAll(ctx, "missing")
+	var apiErr *APIError
+	if !b.ErrorAs(err, &apiErr) {
+		t.Fatalf("ErrorAs(%v) failed", err)
+	}
+	if apiErr.StatusCode != http.StatusInternalServerError || !strings.Contains(apiErr.Message, "not found") {
+		t.Errorf("got %+v, want the node's error", apiErr)
+	}
+	var client *http.Client
+	if !b.As(&client) || client != http.DefaultClient {
+		t.Error("As(*http.Client) failed")
+	}
+}
+
+func TestOpenBucketFromURL(t *testing.T) {
+	tests := []struct {
+		URL     string
+		WantErr bool
+	}{
+		{"ipfs://localhost:5001", false},
+		{"ipfs://localhost:5001?gateway=https://ipfs.io", false},
+		{"ipfs://?gateway=https://ipfs.io", false},
+		// Neither a node nor a gateway.
+		{"ipfs://", true},
+		// Invalid parameter.
+		{"ipfs://localhost:5001?param=value", true},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		b, err := blob.OpenBucket(ctx, test.URL)
+		if b != nil {
+			defer b.Close()
+		}
+		if (err != nil) != test.WantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.WantErr)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	b, err := openBucket("http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		err  error
+		want gcerrors.ErrorCode
+	}{
+		{errNotImplemented, gcerrors.Unimplemented},
+		{errReadOnly, gcerrors.FailedPrecondition},
+		{&APIError{StatusCode: 404}, gcerrors.NotFound},
+		{&APIError{StatusCode: 500, Message: "no link named \"x\" under bafy"}, gcerrors.NotFound},
+		{&APIError{StatusCode: 500, Message: "invalid path \"x\""}, gcerrors.InvalidArgument},
+		{&APIError{StatusCode: 403}, gcerrors.PermissionDenied},
+		{&APIError{StatusCode: 429}, gcerrors.ResourceExhausted},
+		{&APIError{StatusCode: 500, Message: "oops"}, gcerrors.Unknown},
+	} {
+		if got := b.ErrorCode(test.err); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.err, got, test.want)
+		}
+	}
+}
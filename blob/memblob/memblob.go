@@ -51,6 +51,7 @@ const defaultPageSize = 1000
 var (
 	errNotFound       = errors.New("blob not found")
 	errNotImplemented = errors.New("not implemented")
+	errHeld           = errors.New("blob has a hold on it")
 )
 
 func init() {
@@ -109,6 +110,8 @@ func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
 		return gcerrors.NotFound
 	case errNotImplemented:
 		return gcerrors.Unimplemented
+	case errHeld:
+		return gcerrors.PermissionDenied
 	default:
 		return gcerrors.Unknown
 	}
@@ -314,6 +317,12 @@ func (w *writer) Write(p []byte) (n int, err error) {
 	return w.buf.Write(p)
 }
 
+// SetMetadata implements driver.MetadataSetter.
+func (w *writer) SetMetadata(md map[string]string) error {
+	w.metadata = md
+	return nil
+}
+
 func (w *writer) Close() error {
 	// Check if the write was cancelled.
 	if err := w.ctx.Err(); err != nil {
@@ -334,14 +343,25 @@ func (w *writer) Close() error {
 			Size:               int64(len(content)),
 			ModTime:            time.Now(),
 			MD5:                md5sum,
+			Hold:               w.opts.Hold,
 		},
 	}
 	w.b.mu.Lock()
 	defer w.b.mu.Unlock()
+	if w.b.isHeld(w.key) {
+		return errHeld
+	}
 	w.b.blobs[w.key] = entry
 	return nil
 }
 
+// isHeld reports whether the blob at key has a hold on it.
+// b.mu must be held.
+func (b *bucket) isHeld(key string) bool {
+	e := b.blobs[key]
+	return e != nil && e.Attributes.Hold
+}
+
 // Copy implements driver.Copy.
 func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
 	b.mu.Lock()
@@ -354,6 +374,15 @@ func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.C
 	if v == nil {
 		return errNotFound
 	}
+	if b.isHeld(dstKey) {
+		return errHeld
+	}
+	if v.Attributes.Hold {
+		// Holds are not copied.
+		attrs := *v.Attributes
+		attrs.Hold = false
+		v = &blobEntry{Content: v.Content, Attributes: &attrs}
+	}
 	b.blobs[dstKey] = v
 	return nil
 }
@@ -366,10 +395,29 @@ func (b *bucket) Delete(ctx context.Context, key string) error {
 	if b.blobs[key] == nil {
 		return errNotFound
 	}
+	if b.isHeld(key) {
+		return errHeld
+	}
 	delete(b.blobs, key)
 	return nil
 }
 
+// SetHold implements driver.SetHold.
+func (b *bucket) SetHold(ctx context.Context, key string, hold bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := b.blobs[key]
+	if e == nil {
+		return errNotFound
+	}
+	// Entries may be shared by Copy, so don't modify e.
+	attrs := *e.Attributes
+	attrs.Hold = hold
+	b.blobs[key] = &blobEntry{Content: e.Content, Attributes: &attrs}
+	return nil
+}
+
 func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
 	return "", errNotImplemented
 }
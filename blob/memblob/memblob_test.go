@@ -22,6 +22,7 @@ import (
 	"gocloud.dev/blob"
 	"gocloud.dev/blob/driver"
 	"gocloud.dev/blob/drivertest"
+	"gocloud.dev/gcerrors"
 )
 
 type harness struct {
@@ -86,3 +87,70 @@ func TestOpenBucketFromURL(t *testing.T) {
 		}
 	}
 }
+
+func TestHold(t *testing.T) {
+	ctx := context.Background()
+	b := OpenBucket(nil)
+	defer b.Close()
+
+	if err := b.WriteAll(ctx, "held", []byte("x"), &blob.WriterOptions{Hold: true}); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := b.Attributes(ctx, "held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attrs.Hold {
+		t.Error("got Hold false, want true")
+	}
+	if err := b.Delete(ctx, "held"); gcerrors.Code(err) != gcerrors.PermissionDenied {
+		t.Errorf("Delete: got %v, want PermissionDenied", err)
+	}
+	if err := b.WriteAll(ctx, "held", []byte("y"), nil); gcerrors.Code(err) != gcerrors.PermissionDenied {
+		t.Errorf("overwrite: got %v, want PermissionDenied", err)
+	}
+	// Copies don't inherit the hold.
+	if err := b.Copy(ctx, "copy", "held", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "copy"); err != nil {
+		t.Errorf("Delete of copy: %v", err)
+	}
+
+	if err := b.SetHold(ctx, "held", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "held"); err != nil {
+		t.Errorf("Delete after release: %v", err)
+	}
+	if err := b.SetHold(ctx, "held", true); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("SetHold of missing blob: got %v, want NotFound", err)
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	ctx := context.Background()
+	b := OpenBucket(nil)
+	defer b.Close()
+
+	w, err := b.NewWriter(ctx, "key", &blob.WriterOptions{ContentType: "text/plain", Metadata: map[string]string{"a": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("one\ntwo\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetMetadata("Lines", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := b.Attributes(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attrs.Metadata; len(got) != 2 || got["a"] != "1" || got["lines"] != "2" {
+		t.Errorf("got metadata %v, want a=1 and lines=2", got)
+	}
+}
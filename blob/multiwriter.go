@@ -0,0 +1,212 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gocloud.dev/internal/gcerr"
+)
+
+// MultiWriterOptions controls the behavior of a MultiWriter.
+type MultiWriterOptions struct {
+	// RollbackOnFailure makes the writes of a MultiWriter all succeed or all
+	// fail. If a Write to one of the Writers fails, the MultiWriter returns the
+	// error, and Close aborts every write. If the Close of one of the Writers
+	// fails, Close deletes the blobs written by the others.
+	//
+	// Deleting a blob does not restore the blob it replaced, if any, so a
+	// rollback may lose data that existed before the write.
+	//
+	// Otherwise, a MultiWriter writes on to the Writers that have not failed,
+	// and the blobs they write are kept.
+	RollbackOnFailure bool
+}
+
+// A MultiWriter writes the same content to several blob Writers at once, for
+// example to copy data to two buckets during a migration, or to keep a blob in
+// two regions. Each call to Write writes to all of the Writers concurrently.
+//
+// Like a Writer, a MultiWriter must be closed, and its content is only
+// guaranteed to have been written if Close returns no error. A MultiWriter
+// closes its Writers, which must not be used directly.
+type MultiWriter struct {
+	ctx      context.Context
+	ws       []*Writer
+	errs     []error // the first error of each Writer
+	rollback bool
+	aborted  bool // whether the writes have been aborted for a rollback
+	closed   bool
+}
+
+// NewMultiWriter returns a MultiWriter that writes to ws. ctx is used to
+// delete blobs if the writes are rolled back. A nil MultiWriterOptions is
+// treated the same as the zero value.
+func NewMultiWriter(ctx context.Context, opts *MultiWriterOptions, ws ...*Writer) *MultiWriter {
+	if opts == nil {
+		opts = &MultiWriterOptions{}
+	}
+	return &MultiWriter{
+		ctx:      ctx,
+		ws:       ws,
+		errs:     make([]error, len(ws)),
+		rollback: opts.RollbackOnFailure,
+	}
+}
+
+// Write implements the io.Writer interface (https://golang.org/pkg/io/#Writer).
+// It writes p to each Writer that has not failed. It returns an error if every
+// Writer has failed or, if RollbackOnFailure is set, if any Writer has.
+func (mw *MultiWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: MultiWriter.Write called after Close")
+	}
+	if err := mw.failure(); err != nil {
+		return 0, err
+	}
+	var wg sync.WaitGroup
+	for i, w := range mw.ws {
+		if mw.errs[i] != nil {
+			continue
+		}
+		i, w := i, w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n, err := w.Write(p); err != nil {
+				mw.errs[i] = err
+			} else if n < len(p) {
+				mw.errs[i] = gcerr.Newf(gcerr.Internal, nil, "blob: short write (%d of %d bytes)", n, len(p))
+				w.abort(mw.errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	if err := mw.failure(); err != nil {
+		if mw.rollback && !mw.aborted {
+			mw.aborted = true
+			for _, w := range mw.ws {
+				w.abort(errAborted)
+			}
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// failure returns the error that Write should return, if any.
+func (mw *MultiWriter) failure() error {
+	var merr MultiWriteError
+	for i, err := range mw.errs {
+		if err != nil {
+			merr = append(merr, MultiWriteFailure{Index: i, Err: err})
+		}
+	}
+	if len(merr) == 0 || (!mw.rollback && len(merr) < len(mw.ws)) {
+		return nil
+	}
+	return merr
+}
+
+// errAborted is the error with which the Writers of a MultiWriter abort their
+// writes when another Writer fails.
+var errAborted = gcerr.Newf(gcerr.Canceled, nil, "blob: write aborted because another write of the MultiWriter failed")
+
+// Close closes all the Writers concurrently. It returns a MultiWriteError
+// that reports the Writers whose writes failed, or nil if none did. If
+// RollbackOnFailure is set and any write failed, Close deletes the blobs that
+// were written, and the MultiWriteError also reports the Writers whose blobs
+// could not be deleted.
+func (mw *MultiWriter) Close() error {
+	if mw.closed {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: MultiWriter.Close called twice")
+	}
+	mw.closed = true
+	var wg sync.WaitGroup
+	for i, w := range mw.ws {
+		i, w := i, w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The Writers that were aborted because of another's failure
+			// return errAborted, which is not reported.
+			if err := w.Close(); err != nil && mw.errs[i] == nil && !mw.aborted {
+				mw.errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	var merr MultiWriteError
+	for i, err := range mw.errs {
+		if err != nil {
+			merr = append(merr, MultiWriteFailure{Index: i, Err: err})
+		}
+	}
+	if len(merr) == 0 {
+		return nil
+	}
+	if mw.rollback && !mw.aborted {
+		for i, w := range mw.ws {
+			if mw.errs[i] != nil {
+				continue
+			}
+			if err := w.delete(mw.ctx); err != nil {
+				merr = append(merr, MultiWriteFailure{Index: i, Err: err, RollbackFailed: true})
+			}
+		}
+	}
+	return merr
+}
+
+// A MultiWriteFailure reports the failure of one of the Writers of a
+// MultiWriter.
+type MultiWriteFailure struct {
+	Index int   // the position of the Writer in the list passed to NewMultiWriter
+	Err   error // the error from the Writer, or from deleting its blob
+
+	// RollbackFailed reports that the Writer wrote its blob, but the blob
+	// could not be deleted when the writes were rolled back.
+	RollbackFailed bool
+}
+
+// A MultiWriteError is returned by the methods of MultiWriter when the writes
+// fail. It holds the failures of the individual Writers.
+type MultiWriteError []MultiWriteFailure
+
+func (e MultiWriteError) Error() string {
+	var s []string
+	for _, f := range e {
+		if f.RollbackFailed {
+			s = append(s, fmt.Sprintf("writer %d: rollback: %v", f.Index, f.Err))
+		} else {
+			s = append(s, fmt.Sprintf("writer %d: %v", f.Index, f.Err))
+		}
+	}
+	return strings.Join(s, "; ")
+}
+
+// Unwrap returns the error in e, if there is exactly one. If there is more
+// than one error, Unwrap returns nil, since there is no way to determine which
+// should be returned.
+func (e MultiWriteError) Unwrap() error {
+	if len(e) == 1 {
+		return e[0].Err
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob_test
+
+import (
+	"context"
+	"testing"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/gcerrors"
+)
+
+func TestMultiWriter(t *testing.T) {
+	ctx := context.Background()
+	const key = "k"
+	content := []byte("hello")
+
+	for _, test := range []struct {
+		name     string
+		opts     [2]*blob.WriterOptions // options for each Writer
+		rollback bool
+		wantErr  bool         // whether MultiWriter.Write fails
+		wantFail map[int]bool // the indexes in the error from Close
+		wantBlob [2]bool      // whether each bucket has the blob afterwards
+	}{
+		{
+			name:     "success",
+			wantBlob: [2]bool{true, true},
+		},
+		{
+			name:     "write fails, best effort",
+			opts:     [2]*blob.WriterOptions{nil, {ContentLength: 3}},
+			wantFail: map[int]bool{1: true},
+			wantBlob: [2]bool{true, false},
+		},
+		{
+			name:     "all writes fail",
+			opts:     [2]*blob.WriterOptions{{ContentLength: 3}, {ContentLength: 3}},
+			wantErr:  true,
+			wantFail: map[int]bool{0: true, 1: true},
+		},
+		{
+			name:     "write fails, rollback",
+			opts:     [2]*blob.WriterOptions{nil, {ContentLength: 3}},
+			rollback: true,
+			wantErr:  true,
+			wantFail: map[int]bool{1: true},
+		},
+		{
+			name:     "close fails, best effort",
+			opts:     [2]*blob.WriterOptions{{ContentMD5: []byte("bad")}, nil},
+			wantFail: map[int]bool{0: true},
+			wantBlob: [2]bool{false, true},
+		},
+		{
+			name:     "close fails, rollback",
+			opts:     [2]*blob.WriterOptions{{ContentMD5: []byte("bad")}, nil},
+			rollback: true,
+			wantFail: map[int]bool{0: true},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				buckets [2]*blob.Bucket
+				ws      []*blob.Writer
+			)
+			for i := range buckets {
+				buckets[i] = memblob.OpenBucket(nil)
+				defer buckets[i].Close()
+				opts := test.opts[i]
+				if opts == nil {
+					opts = &blob.WriterOptions{}
+				}
+				opts.ContentType = "text/plain"
+				w, err := buckets[i].NewWriter(ctx, key, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ws = append(ws, w)
+			}
+			mw := blob.NewMultiWriter(ctx, &blob.MultiWriterOptions{RollbackOnFailure: test.rollback}, ws...)
+			n, err := mw.Write(content)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("Write: got error %v, want error: %t", err, test.wantErr)
+			}
+			if err == nil && n != len(content) {
+				t.Errorf("Write: got %d bytes, want %d", n, len(content))
+			}
+
+			err = mw.Close()
+			gotFail := map[int]bool{}
+			if err != nil {
+				merr, ok := err.(blob.MultiWriteError)
+				if !ok {
+					t.Fatalf("Close: got %v (%[1]T), want a MultiWriteError", err)
+				}
+				for _, f := range merr {
+					if f.RollbackFailed {
+						t.Errorf("Close: rollback of writer %d failed: %v", f.Index, f.Err)
+					}
+					if gcerrors.Code(f.Err) != gcerrors.FailedPrecondition {
+						t.Errorf("Close: writer %d: got %v, want FailedPrecondition", f.Index, f.Err)
+					}
+					gotFail[f.Index] = true
+				}
+			}
+			if len(gotFail) != len(test.wantFail) {
+				t.Errorf("Close: got failures %v, want %v", gotFail, test.wantFail)
+			}
+			for i := range test.wantFail {
+				if !gotFail[i] {
+					t.Errorf("Close: got failures %v, want %v", gotFail, test.wantFail)
+				}
+			}
+			if err := mw.Close(); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+				t.Errorf("second Close: got %v, want FailedPrecondition", err)
+			}
+
+			for i, b := range buckets {
+				got, err := b.ReadAll(ctx, key)
+				switch {
+				case test.wantBlob[i] && err != nil:
+					t.Errorf("bucket %d: %v", i, err)
+				case test.wantBlob[i] && string(got) != string(content):
+					t.Errorf("bucket %d: got %q, want %q", i, got, content)
+				case !test.wantBlob[i] && gcerrors.Code(err) != gcerrors.NotFound:
+					t.Errorf("bucket %d: got %v, want NotFound", i, err)
+				}
+			}
+		})
+	}
+}
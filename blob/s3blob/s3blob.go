@@ -25,6 +25,14 @@
 // see URLOpener.
 // See https://gocloud.dev/concepts/urls/ for background information.
 //
+// Requester Pays and Access Points
+//
+// Set Options.RequesterPays to read and write buckets configured with Requester
+// Pays; the requests made by the bucket are then charged to the caller's
+// account. To reach a bucket through an S3 Access Point, pass the access
+// point's ARN as the bucket name to OpenBucket. The URL opener supports both
+// with the "requester_pays" and "access_point" query parameters.
+//
 // Escaping
 //
 // Go CDK supports all UTF-8 strings; to make this work with providers lacking
@@ -51,6 +59,17 @@
 //  - Attributes: s3.HeadObjectOutput
 //  - CopyOptions.BeforeCopy: *s3.CopyObjectInput
 //  - WriterOptions.BeforeWrite: *s3manager.UploadInput
+//
+// Streaming Writes
+//
+// Writers normally upload through s3manager.Uploader, which buffers each part
+// in memory, and uploads blobs larger than a part in several parts. When
+// WriterOptions.ContentLength is set and is at most 5 GiB, the largest object a
+// single PutObject call can create, s3blob instead streams the blob in a single
+// PutObject call as it is written. The fields of the UploadInput exposed to
+// BeforeWrite are copied to the s3.PutObjectInput. S3 can't verify a SHA-256
+// hash of a streamed body, so its payload is unsigned; ContentMD5, if set, is
+// still checked. The body can't be replayed, so the call isn't retried.
 package s3blob // import "gocloud.dev/blob/s3blob"
 
 import (
@@ -66,10 +85,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/google/wire"
@@ -82,6 +105,18 @@ import (
 
 const defaultPageSize = 1000
 
+// maxPutSize is the size of the largest object that a single PutObject call can
+// create.
+const maxPutSize = 5 << 30
+
+// maxCopySize is the size of the largest object that a single CopyObject call
+// can copy. Larger objects are copied in parts of copyPartSize bytes, which
+// keeps the largest object S3 allows, 5 TiB, under the limit of 10,000 parts.
+const (
+	maxCopySize  = 5 << 30
+	copyPartSize = 1 << 30
+)
+
 func init() {
 	blob.DefaultURLMux().RegisterBucket(Scheme, new(lazySessionOpener))
 }
@@ -124,6 +159,13 @@ const Scheme = "s3"
 //
 // The URL host is used as the bucket name.
 //
+// The following query parameters are supported:
+//
+//   - requester_pays: if "true", sets Options.RequesterPays.
+//   - access_point: the ARN of an S3 Access Point to open instead of the
+//     bucket named by the host, which must then be empty, as in
+//     "s3://?access_point=arn:aws:s3:us-west-2:123456789012:accesspoint/myap".
+//
 // See gocloud.dev/aws/ConfigFromURLParams for supported query parameters
 // that affect the default AWS session.
 type URLOpener struct {
@@ -139,12 +181,30 @@ func (o *URLOpener) OpenBucketURL(ctx context.Context, u *url.URL) (*blob.Bucket
 	configProvider := &gcaws.ConfigOverrider{
 		Base: o.ConfigProvider,
 	}
-	overrideCfg, err := gcaws.ConfigFromURLParams(u.Query())
+	q := u.Query()
+	opts := o.Options
+	if v := q.Get("requester_pays"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("open bucket %v: invalid value %q for query parameter \"requester_pays\": %v", u, v, err)
+		}
+		opts.RequesterPays = b
+		q.Del("requester_pays")
+	}
+	bucketName := u.Host
+	if arn := q.Get("access_point"); arn != "" {
+		if u.Host != "" {
+			return nil, fmt.Errorf("open bucket %v: URL host must be empty when query parameter \"access_point\" is set", u)
+		}
+		bucketName = arn
+		q.Del("access_point")
+	}
+	overrideCfg, err := gcaws.ConfigFromURLParams(q)
 	if err != nil {
 		return nil, fmt.Errorf("open bucket %v: %v", u, err)
 	}
 	configProvider.Configs = append(configProvider.Configs, overrideCfg)
-	return OpenBucket(ctx, configProvider, u.Host, &o.Options)
+	return OpenBucket(ctx, configProvider, bucketName, &opts)
 }
 
 // Options sets options for constructing a *blob.Bucket backed by fileblob.
@@ -153,6 +213,11 @@ type Options struct {
 	// Some S3-compatible providers (like CEPH) do not currently support
 	// ListObjectsV2.
 	UseLegacyList bool
+
+	// RequesterPays, if true, accepts the charges for the requests made to a
+	// bucket configured with Requester Pays. Requests to such a bucket fail
+	// with an access denied error unless it is set.
+	RequesterPays bool
 }
 
 // openBucket returns an S3 Bucket.
@@ -166,16 +231,83 @@ func openBucket(ctx context.Context, sess client.ConfigProvider, bucketName stri
 	if opts == nil {
 		opts = &Options{}
 	}
-	return &bucket{
+	b := &bucket{
 		name:          bucketName,
-		client:        s3.New(sess),
+		copySource:    bucketName + "/",
 		useLegacyList: opts.UseLegacyList,
+	}
+	if strings.HasPrefix(bucketName, "arn:") {
+		ap, err := parseAccessPointARN(bucketName)
+		if err != nil {
+			return nil, fmt.Errorf("s3blob.OpenBucket: %v", err)
+		}
+		// Requests are sent to the access point's endpoint, with the access
+		// point's name and account in place of the bucket name.
+		b.name = ap.name + "-" + ap.account
+		b.copySource = bucketName + "/object/"
+		b.client = s3.New(sess, &aws.Config{
+			Region:           aws.String(ap.region),
+			Endpoint:         aws.String(ap.endpoint),
+			S3ForcePathStyle: aws.Bool(false),
+		})
+	} else {
+		b.client = s3.New(sess)
+	}
+	if opts.RequesterPays {
+		// Set the header on every request, including those made by the
+		// multipart uploader and presigned URLs.
+		b.client.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("x-amz-request-payer", s3.RequestPayerRequester)
+		})
+	}
+	return b, nil
+}
+
+// accessPoint holds the parts of an S3 Access Point ARN.
+type accessPoint struct {
+	region, account, name string
+	endpoint              string // the base URL of the access point's requests
+}
+
+// parseAccessPointARN parses an S3 Access Point ARN, like
+// "arn:aws:s3:us-west-2:123456789012:accesspoint/myap".
+func parseAccessPointARN(arn string) (*accessPoint, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "s3" || parts[3] == "" || parts[4] == "" {
+		return nil, fmt.Errorf("invalid S3 access point ARN %q", arn)
+	}
+	var dnsSuffix string
+	switch parts[1] {
+	case "aws", "aws-us-gov":
+		dnsSuffix = "amazonaws.com"
+	case "aws-cn":
+		dnsSuffix = "amazonaws.com.cn"
+	default:
+		return nil, fmt.Errorf("invalid S3 access point ARN %q: unsupported partition %q", arn, parts[1])
+	}
+	var name string
+	for _, prefix := range []string{"accesspoint/", "accesspoint:"} {
+		if strings.HasPrefix(parts[5], prefix) {
+			name = strings.TrimPrefix(parts[5], prefix)
+			break
+		}
+	}
+	if name == "" || strings.ContainsAny(name, "/:") {
+		return nil, fmt.Errorf("invalid S3 access point ARN %q: resource must be \"accesspoint/<name>\"", arn)
+	}
+	return &accessPoint{
+		region:   parts[3],
+		account:  parts[4],
+		name:     name,
+		endpoint: "https://s3-accesspoint." + parts[3] + "." + dnsSuffix,
 	}, nil
 }
 
 // OpenBucket returns a *blob.Bucket backed by S3.
 // AWS buckets are bound to a region; sess must have been created using an
 // aws.Config with Region set to the right region for bucketName.
+// bucketName may also be the ARN of an S3 Access Point, in which case the
+// region is taken from the ARN.
 // See the package documentation for an example.
 func OpenBucket(ctx context.Context, sess client.ConfigProvider, bucketName string, opts *Options) (*blob.Bucket, error) {
 	drv, err := openBucket(ctx, sess, bucketName, opts)
@@ -219,9 +351,14 @@ type writer struct {
 	w *io.PipeWriter // created when the first byte is written
 
 	ctx      context.Context
+	client   *s3.S3
 	uploader *s3manager.Uploader
 	req      *s3manager.UploadInput
-	donec    chan struct{} // closed when done writing
+	// If contentLength > 0, the blob is streamed with a single PutObject call
+	// instead of using uploader.
+	contentLength   int64
+	onPartCompleted func()
+	donec           chan struct{} // closed when done writing
 	// The following fields will be written before donec closes:
 	err error
 }
@@ -262,8 +399,14 @@ func (w *writer) open(pr *io.PipeReader) error {
 		} else {
 			w.req.Body = pr
 		}
-		_, err := w.uploader.UploadWithContext(w.ctx, w.req)
+		var err error
+		if w.contentLength > 0 && pr != nil {
+			err = w.put(pr)
+		} else {
+			_, err = w.uploader.UploadWithContext(w.ctx, w.req)
+		}
 		if err != nil {
+			w.abortMultipartUpload(err)
 			w.err = err
 			if pr != nil {
 				pr.CloseWithError(err)
@@ -274,6 +417,30 @@ func (w *writer) open(pr *io.PipeReader) error {
 	return nil
 }
 
+// put uploads the blob read from r with a single PutObject call, without
+// buffering it.
+func (w *writer) put(r io.Reader) error {
+	in := &s3.PutObjectInput{}
+	awsutil.Copy(in, w.req)
+	in.Body = aws.ReadSeekCloser(r)
+	in.ContentLength = aws.Int64(w.contentLength)
+	req, _ := w.client.PutObjectRequest(in)
+	req.SetContext(w.ctx)
+	// r can't be rewound, so neither hash it for the signature nor retry.
+	req.Handlers.Sign.Swap(v4.SignRequestHandler.Name, v4.BuildNamedHandler(v4.SignRequestHandler.Name, func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+		s.UnsignedPayload = true
+	}))
+	req.Retryer = client.DefaultRetryer{NumMaxRetries: 0}
+	if err := req.Send(); err != nil {
+		return err
+	}
+	if w.onPartCompleted != nil {
+		w.onPartCompleted()
+	}
+	return nil
+}
+
 // Close completes the writer and closes it. Any error occurring during write
 // will be returned. If a writer is closed before any Write is called, Close
 // will create an empty file at the given key.
@@ -281,6 +448,9 @@ func (w *writer) Close() error {
 	if w.w == nil {
 		// We never got any bytes written. We'll write an http.NoBody.
 		w.open(nil)
+	} else if err := w.ctx.Err(); err != nil {
+		// Fail the upload rather than completing it with partial content.
+		w.w.CloseWithError(err)
 	} else if err := w.w.Close(); err != nil {
 		return err
 	}
@@ -288,9 +458,68 @@ func (w *writer) Close() error {
 	return w.err
 }
 
+// abortMultipartUpload aborts the multipart upload that failed with err, if
+// any. The uploader aborts failed multipart uploads itself, but it does so using
+// w.ctx, so the abort fails if the upload failed because w.ctx was canceled.
+func (w *writer) abortMultipartUpload(err error) {
+	mf, ok := err.(s3manager.MultiUploadFailure)
+	if !ok || w.ctx.Err() == nil {
+		return
+	}
+	// Best effort; parts that are left behind can be cleaned up using
+	// AbortIncompleteUploads.
+	_, _ = w.client.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   w.req.Bucket,
+		Key:      w.req.Key,
+		UploadId: aws.String(mf.UploadID()),
+	})
+}
+
+// AbortIncompleteUploads aborts the multipart uploads in bucketName that were
+// started before the given time and never completed or aborted, for example
+// because the process writing them crashed. Only uploads whose keys start with
+// prefix are aborted. S3 keeps and charges for the parts of such uploads until
+// they are aborted. It returns the number of uploads aborted.
+//
+// Alternatively, an AbortIncompleteMultipartUpload lifecycle rule on the bucket
+// has S3 abort them automatically; see
+// https://docs.aws.amazon.com/AmazonS3/latest/dev/mpuoverview.html#mpu-abort-incomplete-mpu-lifecycle-config.
+func AbortIncompleteUploads(ctx context.Context, client *s3.S3, bucketName, prefix string, before time.Time) (int, error) {
+	in := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(escapeKey(prefix)),
+	}
+	var stale []*s3.MultipartUpload
+	err := client.ListMultipartUploadsPagesWithContext(ctx, in, func(page *s3.ListMultipartUploadsOutput, _ bool) bool {
+		for _, u := range page.Uploads {
+			if u.Initiated != nil && u.Initiated.Before(before) {
+				stale = append(stale, u)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, u := range stale {
+		_, err := client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucketName),
+			Key:      u.Key,
+			UploadId: u.UploadId,
+		})
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
 // bucket represents an S3 bucket and handles read, write and delete operations.
 type bucket struct {
 	name          string
+	copySource    string // prefix of the CopySource of objects in the bucket
 	client        *s3.S3
 	useLegacyList bool
 }
@@ -300,6 +529,9 @@ func (b *bucket) Close() error {
 }
 
 func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
+	if err == errHoldsUnimplemented {
+		return gcerrors.Unimplemented
+	}
 	e, ok := err.(awserr.Error)
 	if !ok {
 		return gcerrors.Unknown
@@ -620,27 +852,31 @@ func unescapeKey(key string) string {
 
 // NewTypedWriter implements driver.NewTypedWriter.
 func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	if opts.Hold {
+		return nil, errHoldsUnimplemented
+	}
 	key = escapeKey(key)
 	uploader := s3manager.NewUploaderWithClient(b.client, func(u *s3manager.Uploader) {
 		if opts.BufferSize != 0 {
 			u.PartSize = int64(opts.BufferSize)
 		}
+		if opts.OnPartCompleted != nil {
+			u.RequestOptions = append(u.RequestOptions, func(r *request.Request) {
+				r.Handlers.Complete.PushBack(func(r *request.Request) {
+					// Blobs smaller than the part size are uploaded in a
+					// single PutObject call.
+					if r.Error == nil && (r.Operation.Name == "UploadPart" || r.Operation.Name == "PutObject") {
+						opts.OnPartCompleted()
+					}
+				})
+			})
+		}
 	})
-	md := make(map[string]*string, len(opts.Metadata))
-	for k, v := range opts.Metadata {
-		// See the package comments for more details on escaping of metadata
-		// keys & values.
-		k = escape.HexEscape(url.PathEscape(k), func(runes []rune, i int) bool {
-			c := runes[i]
-			return c == '@' || c == ':' || c == '='
-		})
-		md[k] = aws.String(url.PathEscape(v))
-	}
 	req := &s3manager.UploadInput{
 		Bucket:      aws.String(b.name),
 		ContentType: aws.String(contentType),
 		Key:         aws.String(key),
-		Metadata:    md,
+		Metadata:    escapeMetadata(opts.Metadata),
 	}
 	if opts.CacheControl != "" {
 		req.CacheControl = aws.String(opts.CacheControl)
@@ -670,12 +906,199 @@ func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType str
 			return nil, err
 		}
 	}
-	return &writer{
+	w := &writer{
 		ctx:      ctx,
+		client:   b.client,
 		uploader: uploader,
 		req:      req,
 		donec:    make(chan struct{}),
-	}, nil
+	}
+	if opts.ContentLength > 0 && opts.ContentLength <= maxPutSize {
+		w.contentLength = opts.ContentLength
+		w.onPartCompleted = opts.OnPartCompleted
+	}
+	return w, nil
+}
+
+// escapeMetadata escapes the keys and values of md for S3.
+func escapeMetadata(md map[string]string) map[string]*string {
+	emd := make(map[string]*string, len(md))
+	for k, v := range md {
+		// See the package comments for more details on escaping of metadata
+		// keys & values.
+		k = escape.HexEscape(url.PathEscape(k), func(runes []rune, i int) bool {
+			c := runes[i]
+			return c == '@' || c == ':' || c == '='
+		})
+		emd[k] = aws.String(url.PathEscape(v))
+	}
+	return emd
+}
+
+// UpdateMetadata implements driver.MetadataUpdater. S3 cannot change the
+// metadata of an object in place, so the object is copied onto itself with
+// the new metadata. The copy replaces the other attributes too, so they are
+// read first and copied over: the headers, server-side encryption, storage
+// class, tags and ACL. A single CopyObject call can copy at most 5 GiB, so
+// larger objects are copied in parts of copyPartSize.
+//
+// Besides s3:GetObject and s3:PutObject, this needs s3:GetObjectAcl, and
+// s3:PutObjectAcl for objects whose ACL grants more than the owner's full
+// control. Objects larger than 5 GiB also need s3:GetObjectTagging.
+func (b *bucket) UpdateMetadata(ctx context.Context, key string, md map[string]string) error {
+	key = escapeKey(key)
+	head, err := b.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	acl, err := b.client.GetObjectAclWithContext(ctx, &s3.GetObjectAclInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(head.ContentLength) > maxCopySize {
+		err = b.copyInParts(ctx, key, head, md)
+	} else {
+		_, err = b.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:                  aws.String(b.name),
+			CopySource:              aws.String(b.copySource + key),
+			CopySourceIfMatch:       head.ETag,
+			Key:                     aws.String(key),
+			MetadataDirective:       aws.String(s3.MetadataDirectiveReplace),
+			Metadata:                escapeMetadata(md),
+			TaggingDirective:        aws.String(s3.TaggingDirectiveCopy),
+			CacheControl:            head.CacheControl,
+			ContentDisposition:      head.ContentDisposition,
+			ContentEncoding:         head.ContentEncoding,
+			ContentLanguage:         head.ContentLanguage,
+			ContentType:             head.ContentType,
+			ServerSideEncryption:    head.ServerSideEncryption,
+			SSEKMSKeyId:             head.SSEKMSKeyId,
+			StorageClass:            head.StorageClass,
+			WebsiteRedirectLocation: head.WebsiteRedirectLocation,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	// The copy gets the default ACL, which only grants its owner full
+	// control. Skip restoring an ACL that is no different, as buckets with
+	// ACLs disabled reject PutObjectAcl.
+	if isOwnerOnlyACL(acl) {
+		return nil
+	}
+	_, err = b.client.PutObjectAclWithContext(ctx, &s3.PutObjectAclInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+		AccessControlPolicy: &s3.AccessControlPolicy{
+			Grants: acl.Grants,
+			Owner:  acl.Owner,
+		},
+	})
+	return err
+}
+
+// copyInParts copies the object at key, whose attributes are in head, onto
+// itself with metadata md, using a multipart upload with one UploadPartCopy
+// call per copyPartSize bytes. It is used for objects too large for
+// CopyObject.
+func (b *bucket) copyInParts(ctx context.Context, key string, head *s3.HeadObjectOutput, md map[string]string) error {
+	tags, err := b.client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	tagging := url.Values{}
+	for _, t := range tags.TagSet {
+		tagging.Set(aws.StringValue(t.Key), aws.StringValue(t.Value))
+	}
+	up, err := b.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                  aws.String(b.name),
+		Key:                     aws.String(key),
+		Metadata:                escapeMetadata(md),
+		Tagging:                 aws.String(tagging.Encode()),
+		CacheControl:            head.CacheControl,
+		ContentDisposition:      head.ContentDisposition,
+		ContentEncoding:         head.ContentEncoding,
+		ContentLanguage:         head.ContentLanguage,
+		ContentType:             head.ContentType,
+		ServerSideEncryption:    head.ServerSideEncryption,
+		SSEKMSKeyId:             head.SSEKMSKeyId,
+		StorageClass:            head.StorageClass,
+		WebsiteRedirectLocation: head.WebsiteRedirectLocation,
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.copyParts(ctx, key, head, up.UploadId); err != nil {
+		// Use a fresh context, as ctx may be the reason the copy failed.
+		_, _ = b.client.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(b.name),
+			Key:      aws.String(key),
+			UploadId: up.UploadId,
+		})
+		return err
+	}
+	return nil
+}
+
+// copyParts copies the object at key onto the multipart upload uploadID in
+// parts, and completes the upload.
+func (b *bucket) copyParts(ctx context.Context, key string, head *s3.HeadObjectOutput, uploadID *string) error {
+	size := aws.Int64Value(head.ContentLength)
+	var parts []*s3.CompletedPart
+	for start, n := int64(0), int64(1); start < size; start, n = start+copyPartSize, n+1 {
+		end := start + copyPartSize
+		if end > size {
+			end = size
+		}
+		out, err := b.client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:            aws.String(b.name),
+			CopySource:        aws.String(b.copySource + key),
+			CopySourceIfMatch: head.ETag,
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+			Key:               aws.String(key),
+			PartNumber:        aws.Int64(n),
+			UploadId:          uploadID,
+		})
+		if err != nil {
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int64(n),
+		})
+	}
+	_, err := b.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.name),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// isOwnerOnlyACL reports whether acl grants nothing but its owner's full
+// control, as the default ACL does.
+func isOwnerOnlyACL(acl *s3.GetObjectAclOutput) bool {
+	if len(acl.Grants) == 0 {
+		return true
+	}
+	if len(acl.Grants) > 1 || acl.Owner == nil {
+		return false
+	}
+	g := acl.Grants[0]
+	return g.Grantee != nil &&
+		aws.StringValue(g.Grantee.Type) == s3.TypeCanonicalUser &&
+		aws.StringValue(g.Grantee.ID) == aws.StringValue(acl.Owner.ID) &&
+		aws.StringValue(g.Permission) == s3.PermissionFullControl
 }
 
 // Copy implements driver.Copy.
@@ -684,7 +1107,7 @@ func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.C
 	srcKey = escapeKey(srcKey)
 	input := &s3.CopyObjectInput{
 		Bucket:     aws.String(b.name),
-		CopySource: aws.String(b.name + "/" + srcKey),
+		CopySource: aws.String(b.copySource + srcKey),
 		Key:        aws.String(dstKey),
 	}
 	if opts.BeforeCopy != nil {
@@ -718,6 +1141,14 @@ func (b *bucket) Delete(ctx context.Context, key string) error {
 	return err
 }
 
+// errHoldsUnimplemented is returned for holds, which s3blob does not support.
+var errHoldsUnimplemented = errors.New("s3blob: holds are not supported")
+
+// SetHold implements driver.SetHold.
+func (b *bucket) SetHold(ctx context.Context, key string, hold bool) error {
+	return errHoldsUnimplemented
+}
+
 func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
 	key = escapeKey(key)
 	in := &s3.GetObjectInput{
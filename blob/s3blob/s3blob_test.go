@@ -226,6 +226,16 @@ func TestOpenBucket(t *testing.T) {
 			bucketName:  "foo",
 			want:        "foo",
 		},
+		{
+			description: "access point ARN",
+			bucketName:  "arn:aws:s3:us-west-2:123456789012:accesspoint/myap",
+			want:        "myap-123456789012",
+		},
+		{
+			description: "malformed access point ARN results in error",
+			bucketName:  "arn:aws:s3:us-west-2:123456789012:bucket/foo",
+			wantErr:     true,
+		},
 	}
 
 	ctx := context.Background()
@@ -256,6 +266,37 @@ func TestOpenBucket(t *testing.T) {
 	}
 }
 
+func TestParseAccessPointARN(t *testing.T) {
+	for _, test := range []struct {
+		arn     string
+		want    *accessPoint
+		wantErr bool
+	}{
+		{
+			arn:  "arn:aws:s3:us-west-2:123456789012:accesspoint/myap",
+			want: &accessPoint{region: "us-west-2", account: "123456789012", name: "myap", endpoint: "https://s3-accesspoint.us-west-2.amazonaws.com"},
+		},
+		{
+			arn:  "arn:aws-cn:s3:cn-north-1:123456789012:accesspoint:myap",
+			want: &accessPoint{region: "cn-north-1", account: "123456789012", name: "myap", endpoint: "https://s3-accesspoint.cn-north-1.amazonaws.com.cn"},
+		},
+		{arn: "arn:aws:s3:::mybucket", wantErr: true},
+		{arn: "arn:aws:s3:us-west-2:123456789012:accesspoint/", wantErr: true},
+		{arn: "arn:aws:s3:us-west-2:123456789012:accesspoint/myap/object/key", wantErr: true},
+		{arn: "arn:aws:sqs:us-west-2:123456789012:accesspoint/myap", wantErr: true},
+		{arn: "arn:other:s3:us-west-2:123456789012:accesspoint/myap", wantErr: true},
+	} {
+		got, err := parseAccessPointARN(test.arn)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.arn, err, test.wantErr)
+			continue
+		}
+		if err == nil && *got != *test.want {
+			t.Errorf("%s: got %+v, want %+v", test.arn, got, test.want)
+		}
+	}
+}
+
 func TestOpenBucketFromURL(t *testing.T) {
 	tests := []struct {
 		URL     string
@@ -267,6 +308,16 @@ func TestOpenBucketFromURL(t *testing.T) {
 		{"s3://mybucket?region=us-west1", false},
 		// Invalid parameter.
 		{"s3://mybucket?param=value", true},
+		// OK, setting requester_pays.
+		{"s3://mybucket?requester_pays=true", false},
+		// Invalid requester_pays.
+		{"s3://mybucket?requester_pays=maybe", true},
+		// OK, using an access point.
+		{"s3://?access_point=arn:aws:s3:us-west-2:123456789012:accesspoint/myap", false},
+		// Access point with a bucket name.
+		{"s3://mybucket?access_point=arn:aws:s3:us-west-2:123456789012:accesspoint/myap", true},
+		// Invalid access point ARN.
+		{"s3://?access_point=arn:aws:s3:us-west-2:123456789012:bucket/foo", true},
 	}
 
 	ctx := context.Background()
@@ -0,0 +1,681 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bigtabledocstore provides an implementation of the docstore API for
+// Google Cloud Bigtable, storing each document in its own row of a table.
+//
+// The row key of a document is its key, which must be a string. Each top-level
+// field of the document is stored in a column, as the gob encoding of the
+// field's value. By default, the column of a field is in the column family
+// Options.Family, with the field's name as its qualifier; Options.Columns puts
+// fields in other columns. The column families must exist in the table, and
+// should keep only one version of each cell: see
+// https://cloud.google.com/bigtable/docs/garbage-collection.
+//
+//
+// Action Lists
+//
+// The Get actions in each group of an action list are executed with a single
+// ReadRows call. Each write action is a conditional mutation of its row, and
+// the write actions run concurrently. Writes that depend on the stored
+// document, like Update or a Replace with a revision, first read the row, and
+// then apply their mutation only if the document's revision has not changed,
+// retrying if it has. bigtabledocstore calls the BeforeDo function before the
+// ReadRows call with an as function that exposes *bigtable.Table, and before
+// each attempt of a write with an as function that exposes the write's
+// *bigtable.Mutation.
+//
+//
+// Queries
+//
+// A query reads the rows of a range of keys and evaluates its filters on the
+// client. If the collection has a key field, filters on that field with
+// string values narrow the range: "=", ">", ">=", "<", "<=" and the has-prefix
+// operator are answered by the range alone. Otherwise, the query scans the
+// whole table.
+//
+// Bigtable returns rows in key order, so Query.OrderBy on the key field in
+// ascending order costs nothing. Other orders are sorted on the client, after
+// reading all the matching documents.
+//
+//
+// As
+//
+// bigtabledocstore exposes the following types for As:
+// - Collection: *bigtable.Table, *bigtable.Client
+// - ActionList.BeforeDo: *bigtable.Table for Gets, *bigtable.Mutation for writes
+// - Query.BeforeQuery: *bigtable.Table, and bigtable.RowRange: the range of rows
+//   read
+// - DocumentIterator: bigtable.RowRange
+// - Error: *status.Status
+//
+//
+// Special Considerations
+//
+// Field values are stored in the gob encoding, which preserves their types but
+// is not readily decoded outside of Go. Unsigned integers are stored as int64s.
+package bigtabledocstore // import "gocloud.dev/docstore/bigtabledocstore"
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/bigtable"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultFamily is the default value of Options.Family.
+const DefaultFamily = "d"
+
+// MaxDocumentSize is the largest row Bigtable accepts, in bytes.
+// See https://cloud.google.com/bigtable/quotas#limits-data-size.
+const MaxDocumentSize = 256 << 20
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// Family is the column family of the fields that are not in Columns.
+	// Defaults to DefaultFamily.
+	Family string
+
+	// Columns maps the names of top-level document fields to the columns that
+	// hold them, for fields that are not stored in Family under their own names.
+	Columns map[string]Column
+
+	// The maximum number of write actions that run concurrently for a single
+	// call to ActionList.Do. If less than 1, there is no limit.
+	MaxOutstandingActionRPCs int
+}
+
+// A Column is a column of a Bigtable table.
+type Column struct {
+	// Family is the column family. Defaults to Options.Family.
+	Family string
+
+	// Qualifier is the column qualifier. Defaults to the name of the field.
+	Qualifier string
+}
+
+type collection struct {
+	client    *bigtable.Client
+	tableName string
+	table     *bigtable.Table
+	keyField  string
+	keyFunc   func(docstore.Document) interface{}
+	opts      *Options
+	columns   map[string]Column // by field name, for the fields in opts.Columns
+	fields    map[Column]string // by column, for the fields in opts.Columns
+
+	beforeDoMu sync.Mutex // serializes calls to BeforeDo
+}
+
+// OpenCollection opens a docstore collection whose documents are stored in
+// the table of client named tableName. keyField is the document field holding
+// the primary key, which must be a string.
+func OpenCollection(client *bigtable.Client, tableName, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, tableName, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens a docstore collection whose documents are
+// stored in the table of client named tableName. keyFunc takes a document and
+// returns its primary key, which must be a string. It should return nil if the
+// document is missing the information to construct a key. This will cause all
+// actions, even Create, to fail.
+func OpenCollectionWithKeyFunc(client *bigtable.Client, tableName string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, tableName, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(client *bigtable.Client, tableName, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if client == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "bigtabledocstore: client is nil")
+	}
+	if tableName == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "bigtabledocstore: table name is empty")
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "bigtabledocstore: must provide either keyField or keyFunc")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	if opts.Family == "" {
+		opts.Family = DefaultFamily
+	}
+	c := &collection{
+		client:    client,
+		tableName: tableName,
+		table:     client.Open(tableName),
+		keyField:  keyField,
+		keyFunc:   keyFunc,
+		opts:      opts,
+		columns:   map[string]Column{},
+		fields:    map[Column]string{},
+	}
+	for name, col := range opts.Columns {
+		if col.Family == "" {
+			col.Family = opts.Family
+		}
+		if col.Qualifier == "" {
+			col.Qualifier = name
+		}
+		if other, ok := c.fields[col]; ok {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "bigtabledocstore: fields %q and %q are both in column %s:%s",
+				other, name, col.Family, col.Qualifier)
+		}
+		c.columns[name] = col
+		c.fields[col] = name
+	}
+	return c, nil
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// rowKey returns the row key of the document of a, whose key must be a
+// string.
+func rowKey(a *driver.Action) (string, error) {
+	s, ok := a.Key.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "bigtabledocstore: key %v is a %T, not a string", a.Key, a.Key)
+	}
+	return s, nil
+}
+
+func (c *collection) RevisionField() string { return c.opts.RevisionField }
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return MaxDocumentSize }
+
+// column returns the column that holds the top-level field name.
+func (c *collection) column(name string) Column {
+	if col, ok := c.columns[name]; ok {
+		return col
+	}
+	return Column{Family: c.opts.Family, Qualifier: name}
+}
+
+// field returns the name of the field held in col, and whether there is one.
+func (c *collection) field(col Column) (string, bool) {
+	if name, ok := c.fields[col]; ok {
+		return name, true
+	}
+	if col.Family != c.opts.Family {
+		return "", false
+	}
+	if _, ok := c.columns[col.Qualifier]; ok {
+		// The field of that name is stored elsewhere.
+		return "", false
+	}
+	return col.Qualifier, true
+}
+
+// readFilter keeps the latest cell of each column.
+var readFilter = bigtable.RowFilter(bigtable.LatestNFilter(1))
+
+// A storedDoc is a document read from a row.
+type storedDoc struct {
+	doc map[string]interface{}
+	rev []byte // the stored encoding of the revision, if any
+}
+
+// decodeRow decodes the document stored in r. Cells in columns that hold no
+// field are ignored.
+func (c *collection) decodeRow(r bigtable.Row) (*storedDoc, error) {
+	sd := &storedDoc{doc: map[string]interface{}{}}
+	for fam, items := range r {
+		for _, item := range items {
+			col := Column{Family: fam, Qualifier: strings.TrimPrefix(item.Column, fam+":")}
+			name, ok := c.field(col)
+			if !ok {
+				continue
+			}
+			v, err := gobcodec.UnmarshalValue(item.Value)
+			if err != nil {
+				return nil, gcerr.Newf(gcerr.Internal, err, "bigtabledocstore: decoding column %s of row %q", item.Column, item.Row)
+			}
+			sd.doc[name] = v
+			if name == c.opts.RevisionField {
+				sd.rev = item.Value
+			}
+		}
+	}
+	return sd, nil
+}
+
+// readRow reads the document in the row with key rkey. It returns nil if there
+// is none.
+func (c *collection) readRow(ctx context.Context, rkey string) (*storedDoc, error) {
+	r, err := c.table.ReadRow(ctx, rkey, readFilter)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) == 0 {
+		return nil, nil
+	}
+	return c.decodeRow(r)
+}
+
+// mutation returns a mutation that replaces the contents of a row with doc.
+func (c *collection) mutation(doc map[string]interface{}) (*bigtable.Mutation, error) {
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m := bigtable.NewMutation()
+	// Mutations are applied in order, so this removes only the old cells.
+	m.DeleteRow()
+	for _, name := range names {
+		b, err := gobcodec.MarshalValue(doc[name])
+		if err != nil {
+			return nil, err
+		}
+		col := c.column(name)
+		m.Set(col.Family, col.Qualifier, bigtable.ServerTime, b)
+	}
+	return m, nil
+}
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	for _, group := range [][]*driver.Action{beforeGets, gets, writes, afterGets} {
+		if driver.ShouldStop(opts, errs) {
+			driver.SkipActions(group, errs)
+			continue
+		}
+		if len(group) > 0 && group[0].Kind == driver.Get {
+			c.runGets(ctx, group, errs, opts)
+		} else {
+			c.runWrites(ctx, group, errs, opts)
+		}
+	}
+	return driver.NewActionListError(errs)
+}
+
+// beforeDo calls opts.BeforeDo, if any, with an as function that exposes val.
+func (c *collection) beforeDo(opts *driver.RunActionsOptions, val interface{}) error {
+	if opts.BeforeDo == nil {
+		return nil
+	}
+	c.beforeDoMu.Lock()
+	defer c.beforeDoMu.Unlock()
+	return opts.BeforeDo(driver.AsFunc(val))
+}
+
+// runGets reads the documents of gets with a single ReadRows call.
+func (c *collection) runGets(ctx context.Context, gets []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	var (
+		rkeys  bigtable.RowList
+		byRKey = map[string][]*driver.Action{}
+	)
+	for _, a := range gets {
+		rkey, err := rowKey(a)
+		if err != nil {
+			errs[a.Index] = err
+			continue
+		}
+		if byRKey[rkey] == nil {
+			rkeys = append(rkeys, rkey)
+		}
+		byRKey[rkey] = append(byRKey[rkey], a)
+	}
+	if len(rkeys) == 0 {
+		return
+	}
+	setErr := func(err error) {
+		for _, as := range byRKey {
+			for _, a := range as {
+				errs[a.Index] = err
+			}
+		}
+	}
+	if err := c.beforeDo(opts, c.table); err != nil {
+		setErr(err)
+		return
+	}
+	docs := map[string]*storedDoc{}
+	var decodeErr error
+	err := c.table.ReadRows(ctx, rkeys, func(r bigtable.Row) bool {
+		sd, err := c.decodeRow(r)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		docs[r.Key()] = sd
+		return true
+	}, readFilter)
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		setErr(err)
+		return
+	}
+	for rkey, as := range byRKey {
+		for _, a := range as {
+			if sd := docs[rkey]; sd == nil {
+				errs[a.Index] = gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+			} else {
+				errs[a.Index] = gobcodec.DecodeDoc(sd.doc, a.Doc, a.FieldPaths, c.opts.RevisionField)
+			}
+		}
+	}
+}
+
+// runWrites runs each write action concurrently. With FailFast, it stops
+// starting actions once one fails.
+func (c *collection) runWrites(ctx context.Context, writes []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	mapdoc.RunConcurrently(writes, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+		return c.runWrite(ctx, a, opts)
+	})
+}
+
+// runWrite executes a single write action, retrying it if the document changes
+// between reading it and writing it.
+func (c *collection) runWrite(ctx context.Context, a *driver.Action, opts *driver.RunActionsOptions) error {
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	rkey, err := rowKey(a)
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		done, err := c.write(ctx, rkey, a, opts)
+		if err != nil || done {
+			return err
+		}
+		if i == mapdoc.MaxWriteAttempts {
+			return gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q kept changing during the write", a.Key)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// write makes one attempt at the write action a on the row with key rkey. It
+// reports false if the row changed after it was read, so that the write was
+// not applied.
+func (c *collection) write(ctx context.Context, rkey string, a *driver.Action, opts *driver.RunActionsOptions) (bool, error) {
+	wantRev, err := c.revision(a.Doc)
+	if err != nil {
+		return false, err
+	}
+	blind := wantRev == nil && len(a.Conditions) == 0
+	switch {
+	case a.Kind == driver.Create && len(a.Conditions) == 0:
+		// Write the document only if the row is empty.
+		return true, c.create(ctx, rkey, a, opts)
+	case blind && a.Kind == driver.Put:
+		return true, c.put(ctx, rkey, a, opts)
+	case blind && a.Kind == driver.Delete:
+		m := bigtable.NewMutation()
+		m.DeleteRow()
+		return true, c.applyMutation(ctx, rkey, m, opts)
+	}
+
+	current, err := c.readRow(ctx, rkey)
+	if err != nil {
+		return false, err
+	}
+	exists := current != nil
+	switch {
+	case exists && a.Kind == driver.Create:
+		return false, gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %q exists", a.Key)
+	case !exists && a.Kind == driver.Delete:
+		return true, nil
+	case !exists && len(a.Conditions) > 0:
+		return false, gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q does not exist", a.Key)
+	case !exists && (a.Kind == driver.Replace || a.Kind == driver.Update):
+		return false, gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+	case exists && !eval.FiltersMatch(a.Conditions, current.doc):
+		return false, gcerr.Newf(gcerr.FailedPrecondition, nil, "conditions not satisfied for document with key %q", a.Key)
+	}
+	if exists && wantRev != nil {
+		if curRev := current.doc[c.opts.RevisionField]; *wantRev != curRev {
+			return false, gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %v, current %v", *wantRev, curRev)
+		}
+	}
+	var unchanged bigtable.Filter
+	if exists {
+		unchanged = c.revisionFilter(current.rev)
+	}
+
+	switch a.Kind {
+	case driver.Delete:
+		m := bigtable.NewMutation()
+		m.DeleteRow()
+		return c.applyIf(ctx, rkey, unchanged, m, opts)
+	case driver.Update:
+		if err := eval.ApplyMods(current.doc, a.Mods); err != nil {
+			return false, err
+		}
+		return c.writeDoc(ctx, rkey, a, current.doc, unchanged, opts)
+	default:
+		doc, err := gobcodec.EncodeDoc(a.Doc)
+		if err != nil {
+			return false, err
+		}
+		return c.writeDoc(ctx, rkey, a, doc, unchanged, opts)
+	}
+}
+
+// revision returns the revision in doc, or nil if it has none.
+func (c *collection) revision(doc driver.Document) (*string, error) {
+	rev, err := doc.GetField(c.opts.RevisionField)
+	if err != nil || rev == nil {
+		return nil, nil // no incoming revision information: nothing to check
+	}
+	s, ok := rev.(string)
+	if !ok {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want string", c.opts.RevisionField, rev)
+	}
+	return &s, nil
+}
+
+// rowExists is true of a row with any cells.
+var rowExists = bigtable.CellsPerRowLimitFilter(1)
+
+// revisionFilter returns a filter that is true of a row whose revision is
+// still rev, the stored encoding of the revision read from it. A row written
+// without a revision can only be checked for existence.
+func (c *collection) revisionFilter(rev []byte) bigtable.Filter {
+	if rev == nil {
+		return rowExists
+	}
+	col := c.column(c.opts.RevisionField)
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter(regexp.QuoteMeta(col.Family)),
+		bigtable.ColumnFilter(regexp.QuoteMeta(col.Qualifier)),
+		bigtable.LatestNFilter(1),
+		bigtable.ValueFilter(quoteBytes(rev)))
+}
+
+// quoteBytes returns a regular expression that matches exactly b. Bigtable
+// matches values byte by byte, and b is binary, so every byte is escaped.
+func quoteBytes(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		fmt.Fprintf(&sb, `\x%02x`, c)
+	}
+	return sb.String()
+}
+
+// create writes the document of a to the row with key rkey if the row is
+// empty.
+func (c *collection) create(ctx context.Context, rkey string, a *driver.Action, opts *driver.RunActionsOptions) error {
+	doc, err := gobcodec.EncodeDoc(a.Doc)
+	if err != nil {
+		return err
+	}
+	rev := driver.UniqueString()
+	doc[c.opts.RevisionField] = rev
+	m, err := c.mutation(doc)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	if err := c.applyMutation(ctx, rkey, bigtable.NewCondMutation(rowExists, nil, m), opts, bigtable.GetCondMutationResult(&exists)); err != nil {
+		return err
+	}
+	if exists {
+		return gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %q exists", a.Key)
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, rev)
+	return nil
+}
+
+// put writes the document of a to the row with key rkey, whatever the row
+// holds.
+func (c *collection) put(ctx context.Context, rkey string, a *driver.Action, opts *driver.RunActionsOptions) error {
+	doc, err := gobcodec.EncodeDoc(a.Doc)
+	if err != nil {
+		return err
+	}
+	rev := driver.UniqueString()
+	doc[c.opts.RevisionField] = rev
+	m, err := c.mutation(doc)
+	if err != nil {
+		return err
+	}
+	if err := c.applyMutation(ctx, rkey, m, opts); err != nil {
+		return err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, rev)
+	return nil
+}
+
+// writeDoc writes doc, with a new revision, to the row with key rkey. If
+// unchanged is non-nil, the row is written only if unchanged is true of it;
+// otherwise, only if the row is empty. It reports whether doc was written.
+func (c *collection) writeDoc(ctx context.Context, rkey string, a *driver.Action, doc map[string]interface{}, unchanged bigtable.Filter, opts *driver.RunActionsOptions) (bool, error) {
+	rev := driver.UniqueString()
+	doc[c.opts.RevisionField] = rev
+	m, err := c.mutation(doc)
+	if err != nil {
+		return false, err
+	}
+	ok, err := c.applyIf(ctx, rkey, unchanged, m, opts)
+	if err != nil || !ok {
+		return false, err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, rev)
+	return true, nil
+}
+
+// applyIf applies m to the row with key rkey if unchanged is true of it, or if
+// unchanged is nil, if the row is empty. It reports whether m was applied.
+func (c *collection) applyIf(ctx context.Context, rkey string, unchanged bigtable.Filter, m *bigtable.Mutation, opts *driver.RunActionsOptions) (bool, error) {
+	var (
+		cm      *bigtable.Mutation
+		matched bool
+	)
+	if unchanged != nil {
+		cm = bigtable.NewCondMutation(unchanged, m, nil)
+	} else {
+		cm = bigtable.NewCondMutation(rowExists, nil, m)
+	}
+	if err := c.applyMutation(ctx, rkey, cm, opts, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return false, err
+	}
+	return matched == (unchanged != nil), nil
+}
+
+// applyMutation calls the BeforeDo function, then applies m to the row with key
+// rkey.
+func (c *collection) applyMutation(ctx context.Context, rkey string, m *bigtable.Mutation, opts *driver.RunActionsOptions, aopts ...bigtable.ApplyOption) error {
+	if err := c.beforeDo(opts, m); err != nil {
+		return err
+	}
+	return c.table.Apply(ctx, rkey, m, aopts...)
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool {
+	switch p := i.(type) {
+	case **bigtable.Table:
+		*p = c.table
+	case **bigtable.Client:
+		*p = c.client
+	default:
+		return false
+	}
+	return true
+}
+
+// ErrorAs implements driver.Collection.ErrorAs.
+func (c *collection) ErrorAs(err error, i interface{}) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	p, ok := i.(**status.Status)
+	if !ok {
+		return false
+	}
+	*p = s
+	return true
+}
+
+// ErrorCode implements driver.Collection.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	if g, ok := err.(*gcerr.Error); ok {
+		return g.Code
+	}
+	return gcerr.GRPCCode(err)
+}
+
+// Close implements driver.Collection.Close. It does not close the client.
+func (c *collection) Close() error { return nil }
@@ -0,0 +1,310 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigtabledocstore
+
+// The tests run against bttest, the in-memory Bigtable server of the Go client,
+// so they need no credentials or emulator.
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/gcerrors"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+const (
+	project  = "test-project"
+	instance = "test-instance"
+	table1   = "docstore-test-1"
+	table2   = "docstore-test-2"
+	table3   = "docstore-test-3"
+
+	// otherFamily is a column family of the test tables besides DefaultFamily.
+	otherFamily = "x"
+)
+
+// testServer is a bttest server with clients connected to it.
+type testServer struct {
+	srv    *bttest.Server
+	conn   *grpc.ClientConn
+	client *bigtable.Client
+	admin  *bigtable.AdminClient
+}
+
+func newTestServer(ctx context.Context) (*testServer, error) {
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	s := &testServer{srv: srv, conn: conn}
+	if s.client, err = bigtable.NewClient(ctx, project, instance, option.WithGRPCConn(conn)); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.admin, err = bigtable.NewAdminClient(ctx, project, instance, option.WithGRPCConn(conn)); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// reset deletes and recreates a table, with the column families DefaultFamily
+// and otherFamily.
+func (s *testServer) reset(ctx context.Context, table string) error {
+	_ = s.admin.DeleteTable(ctx, table) // it may not exist
+	return s.admin.CreateTableFromConf(ctx, &bigtable.TableConf{
+		TableID: table,
+		Families: map[string]bigtable.GCPolicy{
+			DefaultFamily: bigtable.MaxVersionsPolicy(1),
+			otherFamily:   bigtable.MaxVersionsPolicy(1),
+		},
+	})
+}
+
+func (s *testServer) close() {
+	// The clients share the connection, so closing either closes it.
+	s.conn.Close()
+	s.srv.Close()
+}
+
+type harness struct {
+	*testServer
+}
+
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	s, err := newTestServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &harness{s}, nil
+}
+
+func (h *harness) MakeCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, table1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, table1, drivertest.KeyField, nil, nil)
+}
+
+func (h *harness) MakeTwoKeyCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, table2); err != nil {
+		return nil, err
+	}
+	// Store a field in another family, to exercise Options.Columns.
+	opts := &Options{Columns: map[string]Column{"Score": {Family: otherFamily}}}
+	return newCollection(h.client, table2, "", drivertest.HighScoreKey, opts)
+}
+
+func (h *harness) MakeAlternateRevisionFieldCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, table1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, table1, drivertest.KeyField, nil, &Options{RevisionField: drivertest.AlternateRevisionField})
+}
+
+func (*harness) BeforeDoTypes() []interface{} {
+	return []interface{}{&bigtable.Table{}, &bigtable.Mutation{}}
+}
+
+func (*harness) BeforeQueryTypes() []interface{} {
+	return []interface{}{&bigtable.Table{}, bigtable.RowRange{}}
+}
+
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
+func (h *harness) Close() { h.close() }
+
+// asMatrix lists the types that the As methods support. The error of a Create
+// of an existing document comes from the driver, not from Bigtable, so it has
+// no status.
+var asMatrix = drivertest.AsMatrix{
+	Collection: []interface{}{new(*bigtable.Table), new(*bigtable.Client)},
+	Iterator:   []interface{}{new(bigtable.RowRange)},
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, nil, []drivertest.AsTest{asMatrix})
+}
+
+func BenchmarkConformance(b *testing.B) {
+	ctx := context.Background()
+	s, err := newTestServer(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.close()
+	if err := s.reset(ctx, table3); err != nil {
+		b.Fatal(err)
+	}
+	coll, err := newCollection(s.client, table3, drivertest.KeyField, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	drivertest.RunBenchmarks(b, docstore.NewCollection(coll))
+}
+
+// Bigtable-specific tests.
+
+func TestPlanRange(t *testing.T) {
+	c := &collection{keyField: "name"}
+	key := func(op string, v interface{}) driver.Filter {
+		return driver.Filter{FieldPath: []string{"name"}, Op: op, Value: v}
+	}
+	for _, test := range []struct {
+		fs         []driver.Filter
+		start, end string
+		pushed     int
+	}{
+		{nil, "", "", 0},
+		{[]driver.Filter{key("=", "b")}, "b", "b\x00", 1},
+		{[]driver.Filter{key(">", "b")}, "b\x00", "", 1},
+		{[]driver.Filter{key(">=", "b"), key("<", "d")}, "b", "d", 2},
+		{[]driver.Filter{key(">", "b"), key("<=", "d")}, "b\x00", "d\x00", 2},
+		{[]driver.Filter{key(driver.HasPrefixOp, "ab")}, "ab", "ac", 1},
+		{[]driver.Filter{key(driver.HasPrefixOp, "a\xff")}, "a\xff", "b", 1},
+		{[]driver.Filter{key(driver.HasPrefixOp, "a"), key(">=", "b")}, "b", "b", 2}, // empty
+		{[]driver.Filter{key("<", "")}, "\x00", "\x00", 1},                           // empty
+		// Not on the key, or not a string.
+		{[]driver.Filter{{FieldPath: []string{"other"}, Op: "=", Value: "b"}}, "", "", 0},
+		{[]driver.Filter{key("=", 1)}, "", "", 0},
+		{[]driver.Filter{key(driver.EqualFoldOp, "b")}, "", "", 0},
+		{[]driver.Filter{key(driver.ExistsOp, nil)}, "", "", 0},
+	} {
+		p := c.planRange(test.fs)
+		if p.start != test.start || p.end != test.end || len(p.pushed) != test.pushed || len(p.pushed)+len(p.local) != len(test.fs) {
+			t.Errorf("%+v: got [%q, %q) with %d pushed, %d local; want [%q, %q) with %d pushed",
+				test.fs, p.start, p.end, len(p.pushed), len(p.local), test.start, test.end, test.pushed)
+		}
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	for _, test := range []struct{ in, want string }{
+		{"", ""},
+		{"a", "b"},
+		{"ab", "ac"},
+		{"a\xff\xff", "b"},
+		{"\xff", ""},
+	} {
+		if got := prefixSuccessor(test.in); got != test.want {
+			t.Errorf("prefixSuccessor(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestNewCollectionErrors(t *testing.T) {
+	client := &bigtable.Client{}
+	for _, test := range []struct {
+		name     string
+		client   *bigtable.Client
+		table    string
+		keyField string
+		opts     *Options
+	}{
+		{"nil client", nil, "t", "name", nil},
+		{"no table", client, "", "name", nil},
+		{"no key", client, "t", "", nil},
+		{"shared column", client, "t", "name", &Options{Columns: map[string]Column{
+			"a": {Qualifier: "c"},
+			"b": {Family: DefaultFamily, Qualifier: "c"},
+		}}},
+	} {
+		_, err := newCollection(test.client, test.table, test.keyField, nil, test.opts)
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", test.name, err)
+		}
+	}
+}
+
+// TestColumns checks that fields are stored in the columns of Options.Columns,
+// and that cells in columns that hold no field are ignored.
+func TestColumns(t *testing.T) {
+	ctx := context.Background()
+	s, err := newTestServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.reset(ctx, table1); err != nil {
+		t.Fatal(err)
+	}
+	coll, err := OpenCollection(s.client, table1, "name", &Options{Columns: map[string]Column{
+		"a": {Family: otherFamily},
+		"b": {Qualifier: "bee"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	doc := map[string]interface{}{"name": "k", "a": 1, "b": "two", "c": true}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := s.client.Open(table1).ReadRow(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	for _, items := range row {
+		for _, item := range items {
+			v, err := gobcodec.UnmarshalValue(item.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[item.Column] = v
+		}
+	}
+	want := map[string]interface{}{
+		"d:name":                             "k",
+		"x:a":                                int64(1),
+		"d:bee":                              "two",
+		"d:c":                                true,
+		"d:" + docstore.DefaultRevisionField: got["d:"+docstore.DefaultRevisionField],
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("cells: got=-, want=+: %s", diff)
+	}
+
+	// A cell written by another program in a column of no field.
+	m := bigtable.NewMutation()
+	m.Set(otherFamily, "unknown", bigtable.ServerTime, []byte("not gob"))
+	if err := s.client.Open(table1).Apply(ctx, "k", m); err != nil {
+		t.Fatal(err)
+	}
+	gdoc := map[string]interface{}{"name": "k"}
+	if err := coll.Get(ctx, gdoc); err != nil {
+		t.Fatal(err)
+	}
+	delete(gdoc, docstore.DefaultRevisionField)
+	wantDoc := map[string]interface{}{"name": "k", "a": int64(1), "b": "two", "c": true}
+	if diff := cmp.Diff(gdoc, wantDoc); diff != "" {
+		t.Errorf("document: got=-, want=+: %s", diff)
+	}
+}
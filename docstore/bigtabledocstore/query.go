@@ -0,0 +1,421 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigtabledocstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+)
+
+// eval evaluates filters and sort orders on the rows read from Bigtable, and
+// applies modifications to them.
+var eval = mapdoc.Evaluator{EncodeValue: gobcodec.EncodeValue}
+
+// batchSize is the number of rows read by each ReadRows call of a query.
+const batchSize = 1000
+
+// SupportsFilter implements driver.SupportsFilter. Filters that do not narrow
+// the range of rows are evaluated on the client.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// A rangePlan says which rows to read for a query.
+type rangePlan struct {
+	start  string          // the first row key that may match
+	end    string          // the row key after the last that may match, or "" for none
+	pushed []driver.Filter // the filters that the range answers
+	local  []driver.Filter // the filters evaluated on the client
+}
+
+// scan returns the kind of scan the plan needs.
+func (p rangePlan) scan() driver.ScanKind {
+	if len(p.pushed) == 0 {
+		return driver.ScanFull
+	}
+	return driver.ScanRange
+}
+
+// planRange returns the range of rows that may hold the documents matching
+// fs.
+func (c *collection) planRange(fs []driver.Filter) rangePlan {
+	var p rangePlan
+	raise := func(s string) {
+		if s > p.start {
+			p.start = s
+		}
+	}
+	lower := func(s string) {
+		if p.end == "" || (s != "" && s < p.end) {
+			p.end = s
+		}
+	}
+	for _, f := range fs {
+		s, ok := c.keyValue(f)
+		if !ok {
+			p.local = append(p.local, f)
+			continue
+		}
+		switch f.Op {
+		case driver.EqualOp:
+			raise(s)
+			lower(s + "\x00")
+		case ">":
+			raise(s + "\x00")
+		case ">=":
+			raise(s)
+		case "<":
+			if s == "" {
+				// No row key is less than the empty string. Bigtable row keys cannot
+				// be empty, so this range is empty.
+				raise("\x00")
+				lower("\x00")
+			} else {
+				lower(s)
+			}
+		case "<=":
+			lower(s + "\x00")
+		case driver.HasPrefixOp:
+			raise(s)
+			lower(prefixSuccessor(s))
+		default:
+			p.local = append(p.local, f)
+			continue
+		}
+		p.pushed = append(p.pushed, f)
+	}
+	return p
+}
+
+// rows returns the range of rows to read. It is invalid, and so reads nothing,
+// if no row can match.
+func (p rangePlan) rows() bigtable.RowRange { return bigtable.NewRange(p.start, p.end) }
+
+// keyValue returns the value of f as a string if f is a filter on the key
+// field with a string value.
+func (c *collection) keyValue(f driver.Filter) (string, bool) {
+	if c.keyField == "" || len(f.FieldPath) != 1 || f.FieldPath[0] != c.keyField {
+		return "", false
+	}
+	v := reflect.ValueOf(f.Value)
+	if v.Kind() != reflect.String {
+		return "", false
+	}
+	return v.String(), true
+}
+
+// prefixSuccessor returns the smallest string greater than every string that
+// begins with prefix, or "" if there is none.
+func prefixSuccessor(prefix string) string {
+	n := len(prefix) - 1
+	for n >= 0 && prefix[n] == '\xff' {
+		n--
+	}
+	if n < 0 {
+		return ""
+	}
+	return prefix[:n] + string([]byte{prefix[n] + 1})
+}
+
+// beforeQuery calls q.BeforeQuery, if any, with an as function that exposes the
+// table and the range of rows read.
+func (c *collection) beforeQuery(q *driver.Query, rows bigtable.RowRange) error {
+	if q.BeforeQuery == nil {
+		return nil
+	}
+	return q.BeforeQuery(func(i interface{}) bool {
+		switch i := i.(type) {
+		case **bigtable.Table:
+			*i = c.table
+		case *bigtable.RowRange:
+			*i = rows
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+// A rowReader reads the rows of a range in batches.
+type rowReader struct {
+	coll       *collection
+	start, end string // the remaining range, as in rangePlan
+	done       bool
+}
+
+// next returns the next batch of rows, or io.EOF if there are no more.
+func (r *rowReader) next(ctx context.Context) ([]bigtable.Row, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	var rows []bigtable.Row
+	err := r.coll.table.ReadRows(ctx, bigtable.NewRange(r.start, r.end), func(row bigtable.Row) bool {
+		rows = append(rows, row)
+		return true
+	}, readFilter, bigtable.LimitRows(batchSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < batchSize {
+		r.done = true
+	} else {
+		// Continue after the last row read.
+		r.start = rows[len(rows)-1].Key() + "\x00"
+	}
+	if len(rows) == 0 {
+		return nil, io.EOF
+	}
+	return rows, nil
+}
+
+// A match is a stored document that satisfies a query's filters.
+type match struct {
+	rkey string
+	sd   *storedDoc
+}
+
+// matches returns the documents in rows that satisfy fs.
+func (c *collection) matches(rows []bigtable.Row, fs []driver.Filter) ([]match, error) {
+	var ms []match
+	for _, r := range rows {
+		sd, err := c.decodeRow(r)
+		if err != nil {
+			return nil, err
+		}
+		if eval.FiltersMatch(fs, sd.doc) {
+			ms = append(ms, match{r.Key(), sd})
+		}
+	}
+	return ms, nil
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	p := c.planRange(q.Filters)
+	if err := c.beforeQuery(q, p.rows()); err != nil {
+		return nil, err
+	}
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	it := &docIterator{
+		coll:       c,
+		reader:     &rowReader{coll: c, start: p.start, end: p.end},
+		rows:       p.rows(),
+		filters:    p.local,
+		limit:      q.Limit,
+		fieldPaths: fps,
+	}
+	if q.OrderByField != "" && !(q.OrderByField == c.keyField && q.OrderAscending) {
+		// Rows are in key order, so read all the results and sort them here.
+		for {
+			err := it.nextBatch(ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		eval.SortDocs(it.docs, strings.Split(q.OrderByField, "."), q.OrderAscending)
+	}
+	return it, nil
+}
+
+// docIterator returns the documents that match a query, reading them a batch
+// of rows at a time.
+type docIterator struct {
+	coll       *collection
+	reader     *rowReader
+	rows       bigtable.RowRange // the range of the query
+	docs       []map[string]interface{}
+	filters    []driver.Filter
+	limit      int
+	count      int
+	fieldPaths [][]string
+	err        error
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.limit > 0 && it.count >= it.limit {
+		it.Stop()
+		return it.err
+	}
+	for len(it.docs) == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := it.nextBatch(ctx); err != nil {
+			it.err = err
+			return err
+		}
+	}
+	if err := gobcodec.DecodeDoc(it.docs[0], doc, it.fieldPaths, it.coll.opts.RevisionField); err != nil {
+		it.err = err
+		return it.err
+	}
+	it.docs = it.docs[1:]
+	it.count++
+	return nil
+}
+
+// nextBatch appends the matching documents of the next batch of rows to
+// it.docs. It returns io.EOF if there are no more rows.
+func (it *docIterator) nextBatch(ctx context.Context) error {
+	rows, err := it.reader.next(ctx)
+	if err != nil {
+		return err
+	}
+	ms, err := it.coll.matches(rows, it.filters)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		it.docs = append(it.docs, m.sd.doc)
+	}
+	return nil
+}
+
+func (it *docIterator) Stop() {
+	it.docs = nil
+	it.err = io.EOF
+}
+
+// As implements driver.DocumentIterator.As. It exposes the range of rows that
+// the query reads as bigtable.RowRange.
+func (it *docIterator) As(i interface{}) bool {
+	p, ok := i.(*bigtable.RowRange)
+	if !ok {
+		return false
+	}
+	*p = it.rows
+	return true
+}
+
+// QueryPlan implements driver.QueryPlan. The description is the range of rows
+// read.
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	p := c.planRange(q.Filters)
+	return &driver.QueryPlan{
+		Description:   fmt.Sprintf("ReadRows %s %s", c.tableName, p.rows()),
+		Scan:          p.scan(),
+		ServerFilters: p.pushed,
+		ClientFilters: p.local,
+	}, nil
+}
+
+// matchingDocs returns the documents that match q. It reads them all before
+// returning, so that changing them cannot affect the read.
+func (c *collection) matchingDocs(ctx context.Context, q *driver.Query) ([]match, error) {
+	p := c.planRange(q.Filters)
+	if err := c.beforeQuery(q, p.rows()); err != nil {
+		return nil, err
+	}
+	r := &rowReader{coll: c, start: p.start, end: p.end}
+	var ms []match
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rows, err := r.next(ctx)
+		if err == io.EOF {
+			return ms, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch, err := c.matches(rows, p.local)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, batch...)
+	}
+}
+
+// RunDeleteQuery implements driver.RunDeleteQuery. Each matching document is
+// deleted on its own, provided it still matches.
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	return c.rewriteMatches(ctx, q, nil)
+}
+
+// RunUpdateQuery implements driver.RunUpdateQuery. Each matching document is
+// updated on its own, provided it still matches.
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	return c.rewriteMatches(ctx, q, mods)
+}
+
+// rewriteMatches applies mods to each document that matches q, or deletes it if
+// mods is nil. A document that changes before it is written is read again, and
+// rewritten if it still matches.
+func (c *collection) rewriteMatches(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	ms, err := c.matchingDocs(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		for i := 1; ; i++ {
+			done, err := c.rewrite(ctx, m, q.Filters, mods)
+			if err != nil {
+				return err
+			}
+			if done || i == mapdoc.MaxWriteAttempts {
+				break
+			}
+			if m.sd, err = c.readRow(ctx, m.rkey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewrite applies mods to the matching document m, or deletes it if mods is
+// nil, if m still satisfies fs. It reports false if the document changed after
+// it was read.
+func (c *collection) rewrite(ctx context.Context, m match, fs []driver.Filter, mods []driver.Mod) (bool, error) {
+	if m.sd == nil || !eval.FiltersMatch(fs, m.sd.doc) {
+		return true, nil
+	}
+	unchanged := c.revisionFilter(m.sd.rev)
+	var mut *bigtable.Mutation
+	if mods == nil {
+		mut = bigtable.NewMutation()
+		mut.DeleteRow()
+	} else {
+		if err := eval.ApplyMods(m.sd.doc, mods); err != nil {
+			return false, err
+		}
+		m.sd.doc[c.opts.RevisionField] = driver.UniqueString()
+		var err error
+		if mut, err = c.mutation(m.sd.doc); err != nil {
+			return false, err
+		}
+	}
+	var matched bool
+	err := c.table.Apply(ctx, m.rkey, bigtable.NewCondMutation(unchanged, mut, nil), bigtable.GetCondMutationResult(&matched))
+	return matched, err
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigtabledocstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/bigtable"
+	"gocloud.dev/docstore"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	docstore.DefaultURLMux().RegisterCollection(Scheme, new(URLOpener))
+}
+
+// Scheme is the URL scheme bigtabledocstore registers its URLOpener under on
+// docstore.DefaultMux.
+const Scheme = "bigtable"
+
+// URLOpener opens Bigtable URLs like
+// "bigtable://myproject/myinstance/mytable?key_field=myID".
+//
+// The URL's host is the project ID, and its path is the instance ID followed
+// by the table name.
+//
+// The following query parameters are supported:
+//
+//   - key_field (required): the document field holding the primary key.
+//   - family (optional): the value of Options.Family.
+//
+// The URLOpener creates a client for each project and instance it opens a
+// collection in, and uses it for later collections in the same instance. The
+// clients use Application Default Credentials unless ClientOptions say
+// otherwise.
+type URLOpener struct {
+	// ClientOptions are passed to bigtable.NewClient.
+	ClientOptions []option.ClientOption
+
+	// Options specifies the options to pass to OpenCollection.
+	Options Options
+
+	mu      sync.Mutex
+	clients map[string]*bigtable.Client // by "project/instance"
+}
+
+// OpenCollectionURL opens a docstore.Collection based on u.
+func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	opts := o.Options
+	q := u.Query()
+	keyField := q.Get("key_field")
+	if keyField == "" {
+		return nil, fmt.Errorf("open collection %v: key_field is required", u)
+	}
+	q.Del("key_field")
+	if f := q.Get("family"); f != "" {
+		opts.Family = f
+	}
+	q.Del("family")
+	for param := range q {
+		return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+	}
+	project := u.Host
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if project == "" || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("open collection %v: URL must be bigtable://project/instance/table", u)
+	}
+	client, err := o.client(ctx, project, parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("open collection %v: %v", u, err)
+	}
+	return OpenCollection(client, parts[1], keyField, &opts)
+}
+
+// client returns the client for the instance, creating it if needed.
+func (o *URLOpener) client(ctx context.Context, project, instance string) (*bigtable.Client, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := project + "/" + instance
+	if c := o.clients[key]; c != nil {
+		return c, nil
+	}
+	c, err := bigtable.NewClient(ctx, project, instance, o.ClientOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if o.clients == nil {
+		o.clients = map[string]*bigtable.Client{}
+	}
+	o.clients[key] = c
+	return c, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigtabledocstore
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+func TestOpenCollectionURL(t *testing.T) {
+	ctx := context.Background()
+	s, err := newTestServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	o := &URLOpener{ClientOptions: []option.ClientOption{option.WithGRPCConn(s.conn)}}
+
+	tests := []struct {
+		URL     string
+		wantErr bool
+	}{
+		// OK.
+		{"bigtable://myproject/myinstance/mytable?key_field=_id", false},
+		// OK, with family.
+		{"bigtable://myproject/myinstance/mytable?key_field=_id&family=f", false},
+		{"bigtable://myproject/myinstance/mytable", true},                           // missing key_field
+		{"bigtable:///myinstance/mytable?key_field=_id", true},                      // missing project
+		{"bigtable://myproject/mytable?key_field=_id", true},                        // missing instance
+		{"bigtable://myproject/myinstance/my/table?key_field=_id", true},            // table with slash
+		{"bigtable://myproject/myinstance/mytable?key_field=_id&param=value", true}, // invalid parameter
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = o.OpenCollectionURL(ctx, u)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.wantErr)
+		}
+	}
+	if got := len(o.clients); got != 1 {
+		t.Errorf("got %d clients, want 1", got)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package boltdocstore provides an implementation of the docstore API that
+// persists documents in a bbolt database file (https://github.com/etcd-io/bbolt).
+// It is suitable for local-first applications that need a durable store
+// without a server, and behaves like memdocstore otherwise.
+//
+// Each collection is a bucket of the database, and each document is stored
+// under its key, which must be a string. Document values keep their Go types,
+// including []byte and time.Time.
+//
+//
+// Action Lists
+//
+// Action lists are executed concurrently, like those of memdocstore. Each Get
+// runs in its own read-only transaction, and each write in its own read-write
+// transaction; bbolt runs one read-write transaction at a time.
+//
+// boltdocstore calls the BeforeDo function of an ActionList once before executing
+// the actions, with an as function that exposes *bolt.DB.
+//
+//
+// Queries
+//
+// Queries scan the bucket in key order with a cursor, reading a batch of
+// documents in each read-only transaction, so an iterator that is not stopped
+// does not hold back writes. Filters on the key field narrow the range of keys
+// scanned. All other filters are evaluated on each document scanned. A query
+// with an OrderBy clause reads all the matching documents in a single
+// transaction before sorting them.
+//
+// RunDeleteQuery and RunUpdateQuery execute in a single read-write transaction,
+// so they are atomic.
+//
+//
+// Revisions
+//
+// Revisions are int64 values from the bucket's sequence, which is incremented on
+// each write to the collection and persisted with it.
+//
+//
+// As
+//
+// boltdocstore exposes the following types for As:
+// - Collection: *bolt.DB
+// - ActionList.BeforeDo: *bolt.DB
+// - Query.BeforeQuery: *bolt.DB
+//
+//
+// URLs
+//
+// For docstore.OpenCollection, boltdocstore registers for the scheme
+// "bolt".
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://gocloud.dev/concepts/urls/ for background information.
+package boltdocstore // import "gocloud.dev/docstore/boltdocstore"
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+)
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// The maximum number of concurrent goroutines started for a single call to
+	// ActionList.Do. If less than 1, there is no limit.
+	MaxOutstandingActionRPCs int
+
+	// The maximum size of a document in bytes, as estimated by
+	// driver.EstimateSize. If less than 1, there is no limit.
+	MaxDocumentSize int
+}
+
+// OpenCollection opens a *docstore.Collection whose documents are stored in the
+// bucket of db with the given name, which is created if it does not exist.
+// keyField is the document field holding the primary key of the collection,
+// which must be a string. The collection does not close db.
+func OpenCollection(db *bolt.DB, bucket, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(db, bucket, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens a *docstore.Collection whose documents are
+// stored in the bucket of db with the given name, which is created if it does
+// not exist. keyFunc takes a document and returns the document's primary key,
+// which must be a string. It should return nil if the document is missing the
+// information to construct a key. This will cause all actions, even Create, to
+// fail.
+func OpenCollectionWithKeyFunc(db *bolt.DB, bucket string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(db, bucket, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(db *bolt.DB, bucket, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if db == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "boltdocstore: db is nil")
+	}
+	if bucket == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "boltdocstore: bucket name is empty")
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "must provide either keyField or keyFunc")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &collection{
+		db:       db,
+		bucket:   []byte(bucket),
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+	}, nil
+}
+
+type collection struct {
+	db       *bolt.DB
+	bucket   []byte
+	keyField string
+	keyFunc  func(docstore.Document) interface{}
+	opts     *Options
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// keyBytes returns the bbolt key for the document key.
+func keyBytes(key interface{}) ([]byte, error) {
+	s, ok := key.(string)
+	if !ok {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "boltdocstore: key %v is a %T, not a string", key, key)
+	}
+	if s == "" {
+		// bbolt does not allow empty keys.
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "boltdocstore: key is empty")
+	}
+	return []byte(s), nil
+}
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return c.opts.MaxDocumentSize }
+
+func (c *collection) RevisionField() string {
+	return c.opts.RevisionField
+}
+
+// ErrorCode implements driver.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	switch err {
+	case bolt.ErrDatabaseNotOpen, bolt.ErrTxClosed:
+		return gcerr.FailedPrecondition
+	case bolt.ErrDatabaseReadOnly, bolt.ErrTxNotWritable:
+		return gcerr.PermissionDenied
+	case bolt.ErrValueTooLarge:
+		return gcerr.InvalidArgument
+	case bolt.ErrTimeout:
+		return gcerr.DeadlineExceeded
+	}
+	return gcerrors.Code(err)
+}
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+
+	// Run the actions concurrently with each other. With FailFast, stop starting
+	// actions once one fails.
+	run := func(as []*driver.Action) {
+		mapdoc.RunConcurrently(as, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+			return c.runAction(ctx, a)
+		})
+	}
+
+	if opts.BeforeDo != nil {
+		if err := opts.BeforeDo(driver.AsFunc(c.db)); err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return driver.NewActionListError(errs)
+		}
+	}
+
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	run(beforeGets)
+	run(gets)
+	run(writes)
+	run(afterGets)
+	return driver.NewActionListError(errs)
+}
+
+// runAction executes a single action in its own transaction.
+func (c *collection) runAction(ctx context.Context, a *driver.Action) error {
+	// Stop if the context is done.
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if a.Kind == driver.Get {
+		return c.db.View(func(tx *bolt.Tx) error {
+			b, err := c.bucketOf(tx)
+			if err != nil {
+				return err
+			}
+			k, err := keyBytes(a.Key)
+			if err != nil {
+				return err
+			}
+			current, err := getDoc(b, k)
+			if err != nil {
+				return err
+			}
+			if current == nil {
+				return gcerr.Newf(gcerr.NotFound, nil, "document with key %v does not exist", a.Key)
+			}
+			return gobcodec.DecodeDoc(current, a.Doc, a.FieldPaths, c.opts.RevisionField)
+		})
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := c.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		return c.runWrite(b, a)
+	})
+}
+
+// bucketOf returns the collection's bucket in tx.
+func (c *collection) bucketOf(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket(c.bucket)
+	if b == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "boltdocstore: bucket %q does not exist", c.bucket)
+	}
+	return b, nil
+}
+
+// getDoc returns the document stored under k in b, or nil if there is none.
+func getDoc(b *bolt.Bucket, k []byte) (map[string]interface{}, error) {
+	v := b.Get(k)
+	if v == nil {
+		return nil, nil
+	}
+	return gobcodec.Unmarshal(v)
+}
+
+// putDoc stores doc under k in b.
+func putDoc(b *bolt.Bucket, k []byte, doc map[string]interface{}) error {
+	v, err := gobcodec.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, v)
+}
+
+// runWrite executes the write action a on the bucket b of a read-write
+// transaction. The transaction is rolled back if it fails, so a does not
+// change the stored document unless it succeeds.
+func (c *collection) runWrite(b *bolt.Bucket, a *driver.Action) error {
+	// If the user didn't supply a value for the key field of a Create, create a
+	// new one.
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		// Set the new key in the document.
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	k, err := keyBytes(a.Key)
+	if err != nil {
+		return err
+	}
+	current, err := getDoc(b, k)
+	if err != nil {
+		return err
+	}
+	exists := current != nil
+	// Check for a NotFound error.
+	if !exists && (a.Kind == driver.Replace || a.Kind == driver.Update) {
+		return gcerr.Newf(gcerr.NotFound, nil, "document with key %v does not exist", a.Key)
+	}
+	if len(a.Conditions) > 0 && (exists || a.Kind != driver.Delete) {
+		if err := checkConditions(current, a.Conditions); err != nil {
+			return err
+		}
+	}
+	if err := c.checkRevision(a.Doc, current); err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	switch a.Kind {
+	case driver.Create:
+		// It is an error to attempt to create an existing document.
+		if exists {
+			return gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %v exists", a.Key)
+		}
+		fallthrough
+
+	case driver.Replace, driver.Put:
+		if doc, err = gobcodec.EncodeDoc(a.Doc); err != nil {
+			return err
+		}
+
+	case driver.Delete:
+		return b.Delete(k)
+
+	case driver.Update:
+		if err := eval.ApplyMods(current, a.Mods); err != nil {
+			return err
+		}
+		doc = current
+
+	default:
+		return gcerr.Newf(gcerr.Internal, nil, "unknown kind %v", a.Kind)
+	}
+	if err := c.changeRevision(b, doc); err != nil {
+		return err
+	}
+	if err := putDoc(b, k, doc); err != nil {
+		return err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, doc[c.opts.RevisionField])
+	return nil
+}
+
+// changeRevision sets the revision of doc, which is about to be written to b, to
+// the next value of b's sequence.
+func (c *collection) changeRevision(b *bolt.Bucket, doc map[string]interface{}) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	doc[c.opts.RevisionField] = int64(seq)
+	return nil
+}
+
+// checkConditions returns a FailedPrecondition error unless doc, which may be
+// nil, satisfies all the conditions.
+func checkConditions(doc map[string]interface{}, conds []driver.Filter) error {
+	if doc == nil {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "document does not exist")
+	}
+	ddoc, err := driver.NewDocument(doc)
+	if err != nil {
+		return err
+	}
+	for _, f := range conds {
+		if !driver.EvaluateFilter(f, ddoc) {
+			return gcerr.Newf(gcerr.FailedPrecondition, nil, "condition %s %s %v not satisfied",
+				strings.Join(f.FieldPath, "."), f.Op, f.Value)
+		}
+	}
+	return nil
+}
+
+func (c *collection) checkRevision(arg driver.Document, current map[string]interface{}) error {
+	if current == nil {
+		return nil // no existing document
+	}
+	curRev := current[c.opts.RevisionField]
+	wantRev, err := arg.GetField(c.opts.RevisionField)
+	if err != nil || wantRev == nil {
+		return nil // no incoming revision information: nothing to check
+	}
+	if reflect.TypeOf(wantRev) != reflect.TypeOf(curRev) {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want %T", c.opts.RevisionField, wantRev, curRev)
+	}
+	if wantRev != curRev {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %v, current %v", wantRev, curRev)
+	}
+	return nil
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool {
+	p, ok := i.(**bolt.DB)
+	if !ok {
+		return false
+	}
+	*p = c.db
+	return true
+}
+
+// ErrorAs implements driver.Collection.ErrorAs.
+func (c *collection) ErrorAs(err error, i interface{}) bool { return false }
+
+// Close implements driver.Collection.Close. It does not close the database.
+func (c *collection) Close() error { return nil }
@@ -0,0 +1,271 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boltdocstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	bolt "go.etcd.io/bbolt"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/gcerrors"
+)
+
+// openDB opens a database in a new temporary directory, and returns a function
+// that closes and removes it.
+func openDB(t *testing.T) (*bolt.DB, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "boltdocstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, path, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+type harness struct {
+	db    *bolt.DB
+	done  func()
+	nColl int
+}
+
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	db, _, done := openDB(t)
+	return &harness{db: db, done: done}, nil
+}
+
+// bucket returns a new bucket name, so that each test starts with an empty
+// collection.
+func (h *harness) bucket() string {
+	h.nColl++
+	return fmt.Sprintf("coll%d", h.nColl)
+}
+
+func (h *harness) MakeCollection(context.Context) (driver.Collection, error) {
+	return newCollection(h.db, h.bucket(), drivertest.KeyField, nil, nil)
+}
+
+func (h *harness) MakeTwoKeyCollection(context.Context) (driver.Collection, error) {
+	return newCollection(h.db, h.bucket(), "", drivertest.HighScoreKey, nil)
+}
+
+func (h *harness) MakeAlternateRevisionFieldCollection(context.Context) (driver.Collection, error) {
+	return newCollection(h.db, h.bucket(), drivertest.KeyField, nil, &Options{RevisionField: drivertest.AlternateRevisionField})
+}
+
+func (*harness) BeforeDoTypes() []interface{}          { return []interface{}{&bolt.DB{}} }
+func (*harness) BeforeQueryTypes() []interface{}       { return []interface{}{&bolt.DB{}} }
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
+func (h *harness) Close() { h.done() }
+
+// asMatrix lists the types that the As methods support. The iterators expose
+// no types.
+var asMatrix = drivertest.AsMatrix{
+	Collection:  []interface{}{new(*bolt.DB)},
+	Unsupported: []interface{}{new(string)},
+}
+
+func TestConformance(t *testing.T) {
+	// CodecTester is nil because boltdocstore stores the encoded values as they are.
+	drivertest.RunConformanceTests(t, newHarness, nil, []drivertest.AsTest{asMatrix})
+}
+
+type docmap = map[string]interface{}
+
+func TestPersistence(t *testing.T) {
+	// Check that documents and revisions survive reopening the database.
+	ctx := context.Background()
+	db, path, done := openDB(t)
+	defer done()
+	coll, err := OpenCollection(db, "persist", drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	now := time.Now().UTC()
+	doc := docmap{drivertest.KeyField: "k", "b": []byte{1, 2}, "t": now, "m": docmap{"x": int64(1)}}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	rev := doc[docstore.DefaultRevisionField]
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	coll, err = OpenCollection(db, "persist", drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	got := docmap{drivertest.KeyField: "k"}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, doc) {
+		t.Errorf("got %v, want %v", got, doc)
+	}
+	// The revision sequence continues where it left off.
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	if r := doc[docstore.DefaultRevisionField].(int64); r <= rev.(int64) {
+		t.Errorf("revision after reopening is %d, want more than %d", r, rev)
+	}
+}
+
+func TestUpdateAtomic(t *testing.T) {
+	// Check that a failed update leaves the document unchanged.
+	ctx := context.Background()
+	db, _, done := openDB(t)
+	defer done()
+	coll, err := OpenCollection(db, "atomic", drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	doc := docmap{drivertest.KeyField: "testUpdateAtomic", "a": "A", "b": "B"}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	mods := docstore.Mods{"a": "Y", "b.c": "Z"} // "b" is not a map, so "b.c" is an error
+	if errc := gcerrors.Code(coll.Update(ctx, doc, mods)); errc != gcerrors.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", errc)
+	}
+	got := docmap{drivertest.KeyField: doc[drivertest.KeyField]}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, doc) {
+		t.Errorf("got %v, want %v", got, doc)
+	}
+}
+
+func TestNonStringKey(t *testing.T) {
+	ctx := context.Background()
+	db, _, done := openDB(t)
+	defer done()
+	coll, err := OpenCollection(db, "keys", drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	err = coll.Put(ctx, docmap{drivertest.KeyField: 1})
+	if errc := gcerrors.Code(err); errc != gcerrors.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", errc)
+	}
+}
+
+func TestKeyRangeQueries(t *testing.T) {
+	// Queries on the key field scan only part of the bucket, and queries read more
+	// than one batch.
+	ctx := context.Background()
+	db, _, done := openDB(t)
+	defer done()
+	coll, err := OpenCollection(db, "ranges", drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	const n = 2*scanBatchSize + 10
+	actions := coll.Actions()
+	for i := 0; i < n; i++ {
+		actions.Put(docmap{drivertest.KeyField: fmt.Sprintf("%c%04d", 'a'+i%3, i), "n": i})
+	}
+	if err := actions.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	count := func(q *docstore.Query) int {
+		t.Helper()
+		it := q.Get(ctx)
+		defer it.Stop()
+		c := 0
+		for {
+			err := it.Next(ctx, docmap{})
+			if err == io.EOF {
+				return c
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c++
+		}
+	}
+	for i, test := range []struct {
+		q    *docstore.Query
+		want int
+	}{
+		{coll.Query(), n},
+		{coll.Query().Where(drivertest.KeyField, "=", "b0001"), 1},
+		{coll.Query().Where(drivertest.KeyField, ">=", "b"), 2 * n / 3},
+		{coll.Query().Where(drivertest.KeyField, "<", "b"), n / 3},
+		{coll.Query().Where(drivertest.KeyField, ">", "a0000").Where(drivertest.KeyField, "<=", "a0003"), 1},
+		{coll.Query().WhereHasPrefix(drivertest.KeyField, "c"), n / 3},
+		{coll.Query().Where("n", "<", 10), 10},
+		{coll.Query().Limit(scanBatchSize + 1), scanBatchSize + 1},
+	} {
+		if got := count(test.q); got != test.want {
+			t.Errorf("#%d: got %d documents, want %d", i, got, test.want)
+		}
+	}
+}
+
+func TestQueryPlan(t *testing.T) {
+	db, _, done := openDB(t)
+	defer done()
+	coll, err := OpenCollection(db, "plans", drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	for _, test := range []struct {
+		q    *docstore.Query
+		want string
+	}{
+		{coll.Query(), "full scan"},
+		{coll.Query().Where("a", "=", "x"), "full scan"},
+		{coll.Query().Where(drivertest.KeyField, ">", "x"), "key range scan"},
+	} {
+		plan, err := test.q.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.Description != test.want {
+			t.Errorf("got %q, want %q", plan.Description, test.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boltdocstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+)
+
+// eval evaluates filters and sort orders on the documents read from the
+// database, and applies modifications to them.
+var eval = mapdoc.Evaluator{EncodeValue: gobcodec.EncodeValue}
+
+// scanBatchSize is the number of documents a query iterator reads in each
+// read-only transaction.
+const scanBatchSize = 100
+
+// SupportsFilter implements driver.SupportsFilter.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// A keyRange is a range of keys to scan, derived from the query's filters on
+// the key field. A nil bound is unbounded.
+type keyRange struct {
+	start  []byte // the first key that may match
+	end    []byte // the last key that may match
+	prefix []byte // every matching key has this prefix
+}
+
+// queryRange returns the range of keys that can match fs, and whether it is
+// narrower than the whole bucket.
+func (c *collection) queryRange(fs []driver.Filter) (keyRange, bool) {
+	var r keyRange
+	if c.keyField == "" {
+		return r, false
+	}
+	narrowed := false
+	for _, f := range fs {
+		if len(f.FieldPath) != 1 || f.FieldPath[0] != c.keyField {
+			continue
+		}
+		s, ok := f.Value.(string)
+		if !ok {
+			continue
+		}
+		v := []byte(s)
+		switch f.Op {
+		case driver.EqualOp:
+			r.raiseStart(v)
+			r.lowerEnd(v)
+		case ">", ">=":
+			r.raiseStart(v)
+		case "<", "<=":
+			r.lowerEnd(v)
+		case driver.HasPrefixOp:
+			r.raiseStart(v)
+			if len(v) > len(r.prefix) {
+				r.prefix = v
+			}
+		default:
+			continue
+		}
+		narrowed = true
+	}
+	return r, narrowed
+}
+
+func (r *keyRange) raiseStart(k []byte) {
+	if r.start == nil || bytes.Compare(k, r.start) > 0 {
+		r.start = k
+	}
+}
+
+func (r *keyRange) lowerEnd(k []byte) {
+	if r.end == nil || bytes.Compare(k, r.end) < 0 {
+		r.end = k
+	}
+}
+
+// beyond reports whether k, and so every key after it, is past the end of r.
+func (r *keyRange) beyond(k []byte) bool {
+	if r.end != nil && bytes.Compare(k, r.end) > 0 {
+		return true
+	}
+	return r.prefix != nil && !bytes.HasPrefix(k, r.prefix) && bytes.Compare(k, r.prefix) > 0
+}
+
+// scan calls f with each document in b whose key is in r and is after the key
+// after, in key order, until f returns false. It returns the key of the last
+// document passed to f.
+func scan(b *bolt.Bucket, r keyRange, after []byte, f func(k []byte, doc map[string]interface{}) bool) ([]byte, error) {
+	cur := b.Cursor()
+	var k, v []byte
+	switch {
+	case after != nil:
+		k, v = cur.Seek(after)
+		if bytes.Equal(k, after) {
+			k, v = cur.Next()
+		}
+	case r.start != nil:
+		k, v = cur.Seek(r.start)
+	default:
+		k, v = cur.First()
+	}
+	var last []byte
+	for ; k != nil && !r.beyond(k); k, v = cur.Next() {
+		doc, err := gobcodec.Unmarshal(v)
+		if err != nil {
+			return last, err
+		}
+		// Keys are only valid for the life of the transaction.
+		last = append([]byte(nil), k...)
+		if !f(last, doc) {
+			break
+		}
+	}
+	return last, nil
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(driver.AsFunc(c.db)); err != nil {
+			return nil, err
+		}
+	}
+	r, _ := c.queryRange(q.Filters)
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	it := &docIterator{
+		coll:       c,
+		filters:    q.Filters,
+		keys:       r,
+		limit:      q.Limit,
+		fieldPaths: fps,
+	}
+	if q.OrderByField != "" {
+		// Sorting requires all the results.
+		docs, err := c.matchingDocs(q.Filters, r)
+		if err != nil {
+			return nil, err
+		}
+		eval.SortDocs(docs, strings.Split(q.OrderByField, "."), q.OrderAscending)
+		if q.Limit > 0 && len(docs) > q.Limit {
+			docs = docs[:q.Limit]
+		}
+		it.docs = docs
+		it.done = true
+	}
+	return it, nil
+}
+
+// matchingDocs returns all the documents in the collection that match fs and
+// whose keys are in r, reading them in a single transaction.
+func (c *collection) matchingDocs(fs []driver.Filter, r keyRange) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b, err := c.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		_, err = scan(b, r, nil, func(_ []byte, doc map[string]interface{}) bool {
+			if eval.FiltersMatch(fs, doc) {
+				docs = append(docs, doc)
+			}
+			return true
+		})
+		return err
+	})
+	return docs, err
+}
+
+// docIterator reads the results of a query in batches, each in its own
+// read-only transaction, resuming after the last key it read. Documents written
+// between batches are seen if their keys are after that key.
+type docIterator struct {
+	coll       *collection
+	filters    []driver.Filter
+	keys       keyRange
+	limit      int
+	fieldPaths [][]string
+
+	docs     []map[string]interface{} // the current batch
+	lastKey  []byte                   // the last key scanned
+	returned int                      // the number of documents returned
+	done     bool                     // no batches remain
+	err      error
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.limit > 0 && it.returned >= it.limit {
+		it.err = io.EOF
+		return it.err
+	}
+	for len(it.docs) == 0 {
+		if it.done {
+			it.err = io.EOF
+			return it.err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := it.nextBatch(); err != nil {
+			it.err = err
+			return err
+		}
+	}
+	if err := gobcodec.DecodeDoc(it.docs[0], doc, it.fieldPaths, it.coll.opts.RevisionField); err != nil {
+		it.err = err
+		return it.err
+	}
+	it.docs = it.docs[1:]
+	it.returned++
+	return nil
+}
+
+// nextBatch reads the next matching documents, scanning at most scanBatchSize
+// documents.
+func (it *docIterator) nextBatch() error {
+	return it.coll.db.View(func(tx *bolt.Tx) error {
+		b, err := it.coll.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		n := 0
+		last, err := scan(b, it.keys, it.lastKey, func(_ []byte, doc map[string]interface{}) bool {
+			if eval.FiltersMatch(it.filters, doc) {
+				it.docs = append(it.docs, doc)
+			}
+			n++
+			return n < scanBatchSize
+		})
+		if err != nil {
+			return err
+		}
+		if n < scanBatchSize {
+			it.done = true
+		}
+		it.lastKey = last
+		return nil
+	})
+}
+
+func (it *docIterator) Stop() { it.err = io.EOF }
+
+func (it *docIterator) As(i interface{}) bool { return false }
+
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	var n int64
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b, err := c.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		n = int64(b.Stats().KeyN)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.queryRange(q.Filters); ok {
+		return &driver.QueryPlan{
+			Description:   "key range scan",
+			Scan:          driver.ScanRange,
+			ServerFilters: q.Filters,
+		}, nil
+	}
+	return &driver.QueryPlan{
+		Description:   "full scan",
+		Scan:          driver.ScanFull,
+		ServerFilters: q.Filters,
+		EstimatedScan: n,
+	}, nil
+}
+
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(driver.AsFunc(c.db)); err != nil {
+			return err
+		}
+	}
+	r, _ := c.queryRange(q.Filters)
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := c.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		// Modifying a bucket while iterating over it is not supported, so collect
+		// the keys first.
+		var keys [][]byte
+		if _, err := scan(b, r, nil, func(k []byte, doc map[string]interface{}) bool {
+			if eval.FiltersMatch(q.Filters, doc) {
+				keys = append(keys, k)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(driver.AsFunc(c.db)); err != nil {
+			return err
+		}
+	}
+	r, _ := c.queryRange(q.Filters)
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := c.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		var (
+			keys [][]byte
+			docs []map[string]interface{}
+		)
+		if _, err := scan(b, r, nil, func(k []byte, doc map[string]interface{}) bool {
+			if eval.FiltersMatch(q.Filters, doc) {
+				keys = append(keys, k)
+				docs = append(docs, doc)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		// If any update fails, the transaction is rolled back.
+		for i, doc := range docs {
+			if err := eval.ApplyMods(doc, mods); err != nil {
+				return err
+			}
+			if err := c.changeRevision(b, doc); err != nil {
+				return err
+			}
+			if err := putDoc(b, keys[i], doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
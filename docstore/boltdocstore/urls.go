@@ -0,0 +1,103 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boltdocstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gocloud.dev/docstore"
+)
+
+func init() {
+	docstore.DefaultURLMux().RegisterCollection(Scheme, &URLOpener{})
+}
+
+// Scheme is the URL scheme boltdocstore registers its URLOpener under on
+// docstore.DefaultMux.
+const Scheme = "bolt"
+
+// URLOpener opens URLs like "bolt://collection/_id?file=/path/to/my.db".
+//
+// The URL's host is the name of the collection, which is the name of its bucket.
+// The URL's path is used as the keyField.
+//
+// The following query parameters are supported:
+//   - file (required): the path of the database file, which is created if it
+//     does not exist.
+//
+// The URLOpener opens each database file once, and keeps it open for the life
+// of the process, because bbolt locks the file while it is open.
+type URLOpener struct {
+	// Options specifies the options to pass to OpenCollection.
+	Options Options
+
+	mu  sync.Mutex
+	dbs map[string]*bolt.DB
+}
+
+// OpenCollectionURL opens a docstore.Collection based on u.
+func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	q := u.Query()
+	path := q.Get("file")
+	q.Del("file")
+	for param := range q {
+		return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("open collection %v: missing file query parameter", u)
+	}
+	collName := u.Host
+	if collName == "" {
+		return nil, fmt.Errorf("open collection %v: empty collection name", u)
+	}
+	keyName := u.Path
+	if strings.HasPrefix(keyName, "/") {
+		keyName = keyName[1:]
+	}
+	if keyName == "" || strings.ContainsRune(keyName, '/') {
+		return nil, fmt.Errorf("open collection %v: invalid key name %q (must be non-empty and have no slashes)", u, keyName)
+	}
+	db, err := o.openDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("open collection %v: %v", u, err)
+	}
+	opts := o.Options
+	return OpenCollection(db, collName, keyName, &opts)
+}
+
+// openDB returns the database at path, opening it if necessary.
+func (o *URLOpener) openDB(path string) (*bolt.DB, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if db, ok := o.dbs[path]; ok {
+		return db, nil
+	}
+	// Time out rather than wait forever if another process has the file open.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if o.dbs == nil {
+		o.dbs = map[string]*bolt.DB{}
+	}
+	o.dbs[path] = db
+	return db, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boltdocstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gocloud.dev/docstore"
+)
+
+func TestOpenCollectionFromURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltdocstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test.db")
+
+	tests := []struct {
+		URL     string
+		wantErr bool
+	}{
+		// OK.
+		{"bolt://coll/_id?file=" + file, false},
+		// OK, same file.
+		{"bolt://coll2/foo?file=" + file, false},
+		{"bolt://coll/_id", true},                                      // missing file
+		{"bolt://?file=" + file, true},                                 // missing collection
+		{"bolt://coll?file=" + file, true},                             // missing key
+		{"bolt://coll/my/key?file=" + file, true},                      // key with slash
+		{"bolt://coll/_id?file=" + file + "&param=value", true},        // invalid parameter
+		{"bolt://coll/_id?file=" + filepath.Join(dir, "x", "y"), true}, // directory does not exist
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		_, err := docstore.OpenCollection(ctx, test.URL)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.wantErr)
+		}
+	}
+}
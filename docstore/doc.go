@@ -63,6 +63,45 @@
 // encoding/json. Docstore also honors a "json" struct tag if there is no "docstore"
 // tag on the field.
 //
+// For example, with
+//
+//   type Player struct {
+//       Name  string `docstore:"name"`
+//       Score int    `docstore:"score,omitempty"`
+//   }
+//
+// the Score field is stored as "score", and is not stored at all when it is zero,
+// which keeps documents with many empty fields small. An omitted field is
+// missing from the stored document, not stored with its zero value, and that
+// shows in a few ways:
+//   - Getting the document, with or without the field path "score", leaves Score
+//     zero in a struct and leaves the "score" key out of a map. It is not an
+//     error to Get a field path that is missing from the document.
+//   - A query with Where("score", "=", 0) does not return the document, but one
+//     with WhereNotExists("score") does. Documents without the field may also be
+//     left out of queries that are ordered by it.
+//   - Put and Replace write the whole document, so they remove an omitted field
+//     that was stored before. An Update only changes the fields in its Mods, and
+//     stores a zero value that it is given, since Mods are not struct fields.
+//
+// Embedded structs are flattened, also like encoding/json: the fields of an
+// embedded struct, or of a struct pointed to by an embedded pointer, are stored
+// as fields of the document, unless the embedded field has a name in its tag,
+// in which case it is stored as a single field with that name. The "inline" tag
+// option flattens a named struct field in the same way, and the "noinline"
+// option stores an embedded struct as a single field, named after its type:
+//
+//   type Player struct {
+//       Name    string `docstore:"name"`
+//       Stats                              // the fields of Stats are fields of the document
+//       Address `docstore:",noinline"`     // stored in the field "Address"
+//       Prefs   Prefs `docstore:",inline"` // the fields of Prefs are fields of the document
+//   }
+//
+// Field paths, in Get, Update and queries, refer to flattened fields by their
+// own names, as in "Wins" for Stats.Wins, and to the fields of a nested struct
+// with a dot, as in "Address.City". All providers store the same document shape.
+//
 //
 // Representing Data
 //
@@ -73,6 +112,24 @@
 // encoding.BinaryMarshaler or encoding.TextMarshaler is permitted. This set of types
 // closely matches the encoding/json package.
 //
+// A type that implements json.Marshaler but not encoding.TextMarshaler, such as
+// an enum that marshals to a string, can be stored by adding the "json" option to
+// the struct tag of the field, as in `docstore:"color,json"`. The field is then
+// stored as the value that encoding/json produces for it, and read back with
+// json.Unmarshal. The option applies only to struct fields, so it does not affect
+// maps, or values passed to Update or to queries.
+//
+// A type can also be stored as the values of another type, like strings, by
+// implementing DocstoreMarshaler and DocstoreUnmarshaler. Docstore then stores
+// its values, wherever they appear, as the values MarshalDocstore returns, and
+// calls UnmarshalDocstore when it reads them. To store a type from another
+// package this way, such as a decimal or date type, define a type based on it
+// and give that type the methods.
+//
+// A time.Duration is stored as an integer number of nanoseconds. Decoding it
+// into a time.Duration field restores the duration, but decoding it into an
+// interface{}, as when the document is a map, produces an int64.
+//
 // Times deserve special mention. Docstore can store and retrieve values of type
 // time.Time, with two caveats. First, the timezone will not be preserved. Second,
 // Docstore guarantees only that time.Time values are represented to millisecond
@@ -104,13 +161,14 @@
 //
 // Actions
 //
-// Docstore supports six actions on documents:
+// Docstore supports seven actions on documents:
 //   - Get retrieves a document.
 //   - Create creates a new document.
 //   - Replace replaces an existing document.
 //   - Put puts a document into a collection whether or not it is already present.
 //   - Update applies a set of modifications to a document.
 //   - Delete deletes a document.
+//   - GetOrCreate retrieves a document, creating it first if it is absent.
 //
 // Each action acts atomically on a single document. You can execute actions
 // individually--the Collection type has a method for each one--or you can group them
@@ -125,6 +183,9 @@
 // document are ordered with respect to each other. See the documentation of
 // ActionList for details.
 //
+// By default, every action in a list is attempted, even if some fail. Call
+// ActionList.FailFast to stop at the first failure instead.
+//
 //
 // Revisions
 //
@@ -154,6 +215,11 @@
 //      DocstoreRevision interface{}
 //    }
 //
+// A revision is meaningful only to the collection that assigned it. To copy a
+// document to another collection, for example during an export or migration,
+// first call Collection.CleanDocument on the collection it was read from. That
+// removes the revision and any fields the provider added for its own bookkeeping.
+//
 //
 // Queries
 //
@@ -167,12 +233,17 @@
 // The Where methods defines a filter condition, much like a WHERE clause in SQL.
 // Conditions are of the form "field op value", where field is any document field
 // path (including dot-separated paths), op is one of "=", ">", "<", ">=" or "<=",
-// and value can be any value.
+// and value can be any value. Boolean values can only be compared with "=". To
+// filter on whether a document has a field at all, use WhereExists and
+// WhereNotExists. To match the beginning of a string, use WhereHasPrefix. To
+// compare strings ignoring case, use WhereEqualFold and WhereHasPrefixFold.
 //
 // You can make multiple Where calls. In some cases, parts of a Where clause may be
 // processed on the client rather than natively by the provider, which may have
 // performance implications for large result sets. See the provider-specific package
-// documentation for details.
+// documentation for details. If a provider cannot evaluate a filter at all, the
+// docstore package evaluates it on the documents the provider returns. Call
+// Query.Plan to see which filters will be evaluated where.
 //
 // Use the DocumentIterator returned from Query.Get by repeatedly calling its Next
 // method until it returns io.EOF. Always call Stop when you are finished with an
@@ -192,6 +263,26 @@
 //         fmt.Println(m)
 //     }
 //
+// DocumentIterator.ForEach and DocumentIterator.Chan handle the loop for you;
+// ForEachConcurrent also processes documents concurrently.
+//
+//     newDoc := func() docstore.Document { return map[string]interface{}{} }
+//     err := iter.ForEach(ctx, newDoc, func(doc docstore.Document) error {
+//         fmt.Println(doc)
+//         return nil
+//     })
+//
+// With Go 1.23 or later, Query.Docs and DocumentIterator.All return iterators
+// for a range loop. Docs also calls Get and Stop, and decodes each document into
+// a map:
+//
+//     for m, err := range coll.Query().Where("size", ">", 10).Docs(ctx) {
+//         if err != nil {
+//             return err
+//         }
+//         fmt.Println(m)
+//     }
+//
 //
 // Errors
 //
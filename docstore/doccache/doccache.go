@@ -0,0 +1,261 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package doccache keeps a copy of a whole docstore collection in memory.
+//
+// It is meant for small collections that are read much more often than they
+// are written, like configuration or lookup tables. A Cache reads every
+// document of the collection when it is created, and again at each poll
+// interval. If any document was added, removed or changed, as shown by its
+// revision, the Cache makes a new Snapshot with the next generation number.
+// Snapshots are immutable, so readers can use one for as long as they like
+// without locking, and a reader that looks up several documents in the same
+// Snapshot sees a consistent view of them, as of the time it was read.
+package doccache // import "gocloud.dev/docstore/doccache"
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/internal/gcerr"
+)
+
+// DefaultPollInterval is the poll interval used when Options.PollInterval is
+// zero.
+const DefaultPollInterval = 30 * time.Second
+
+// Options sets options for a Cache.
+type Options struct {
+	// PollInterval is how often the collection is read.
+	// Defaults to DefaultPollInterval.
+	PollInterval time.Duration
+
+	// KeyFunc returns the key of a document. It must be set if the keyField
+	// passed to New is empty.
+	KeyFunc func(doc map[string]interface{}) interface{}
+
+	// RevisionField is the name of the collection's revision field.
+	// Defaults to docstore.DefaultRevisionField. A document without a
+	// revision is compared with its previous version field by field.
+	RevisionField string
+}
+
+// A Snapshot is the contents of the collection at one time. Its documents
+// must not be modified.
+type Snapshot struct {
+	// Generation is 1 for the first Snapshot of a Cache, and increases by one
+	// with each later Snapshot.
+	Generation uint64
+
+	// Time is when the collection was read.
+	Time time.Time
+
+	docs map[interface{}]map[string]interface{}
+}
+
+// Get returns the document with key, and whether there is one.
+func (s *Snapshot) Get(key interface{}) (map[string]interface{}, bool) {
+	doc, ok := s.docs[key]
+	return doc, ok
+}
+
+// Len returns the number of documents in s.
+func (s *Snapshot) Len() int { return len(s.docs) }
+
+// Range calls f with the key and document of each document in s, in no
+// particular order, until f returns false.
+func (s *Snapshot) Range(f func(key interface{}, doc map[string]interface{}) bool) {
+	for k, d := range s.docs {
+		if !f(k, d) {
+			return
+		}
+	}
+}
+
+// A Cache holds the latest Snapshot of a collection.
+type Cache struct {
+	coll     *docstore.Collection
+	keyField string
+	opts     Options
+	cancel   func()
+	done     chan struct{}
+
+	refreshMu sync.Mutex // held during Refresh, so reads are applied in order
+
+	mu      sync.Mutex
+	snap    *Snapshot
+	changed chan struct{} // closed and replaced when snap changes
+	err     error         // the error of the latest read, if it failed
+}
+
+// New reads the collection and returns a Cache that polls it for changes
+// until Close is called. keyField is the name of the field that holds the key
+// of each document. opts may be nil.
+func New(ctx context.Context, coll *docstore.Collection, keyField string, opts *Options) (*Cache, error) {
+	c := &Cache{coll: coll, keyField: keyField, changed: make(chan struct{}), done: make(chan struct{})}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if keyField == "" && c.opts.KeyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "doccache: need a key field or Options.KeyFunc")
+	}
+	if c.opts.PollInterval <= 0 {
+		c.opts.PollInterval = DefaultPollInterval
+	}
+	if c.opts.RevisionField == "" {
+		c.opts.RevisionField = docstore.DefaultRevisionField
+	}
+	if err := c.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	pctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.poll(pctx)
+	return c, nil
+}
+
+func (c *Cache) poll(ctx context.Context) {
+	defer close(c.done)
+	t := time.NewTicker(c.opts.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			// The error is kept for Err.
+			_ = c.Refresh(ctx)
+		}
+	}
+}
+
+// Snapshot returns the latest Snapshot.
+func (c *Cache) Snapshot() *Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snap
+}
+
+// Wait returns the first Snapshot with a generation greater than gen, waiting
+// for it if need be, or ctx's error if ctx is done first.
+func (c *Cache) Wait(ctx context.Context, gen uint64) (*Snapshot, error) {
+	for {
+		c.mu.Lock()
+		snap, changed := c.snap, c.changed
+		c.mu.Unlock()
+		if snap.Generation > gen {
+			return snap, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Err returns the error from the latest read of the collection, or nil if it
+// succeeded. While reads fail, the Cache keeps the last Snapshot it made.
+func (c *Cache) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Refresh reads the collection now, making a new Snapshot if it has changed.
+func (c *Cache) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	start := time.Now()
+	docs, err := c.read(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	if err != nil {
+		return err
+	}
+	if c.snap != nil && c.same(c.snap.docs, docs) {
+		return nil
+	}
+	var gen uint64 = 1
+	if c.snap != nil {
+		gen = c.snap.Generation + 1
+	}
+	c.snap = &Snapshot{Generation: gen, Time: start, docs: docs}
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// read returns all the documents of the collection, by key.
+func (c *Cache) read(ctx context.Context) (map[interface{}]map[string]interface{}, error) {
+	iter := c.coll.Query().Get(ctx)
+	defer iter.Stop()
+	docs := map[interface{}]map[string]interface{}{}
+	for {
+		doc := map[string]interface{}{}
+		err := iter.Next(ctx, doc)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var key interface{}
+		if c.keyField != "" {
+			key = doc[c.keyField]
+		} else {
+			key = c.opts.KeyFunc(doc)
+		}
+		if key == nil || !reflect.TypeOf(key).Comparable() {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "doccache: document has a missing or invalid key %v", key)
+		}
+		docs[key] = doc
+	}
+}
+
+// same reports whether the documents in new are those in old, with the same
+// revisions.
+func (c *Cache) same(old, new map[interface{}]map[string]interface{}) bool {
+	if len(old) != len(new) {
+		return false
+	}
+	for k, nd := range new {
+		od, ok := old[k]
+		if !ok {
+			return false
+		}
+		orev, ook := od[c.opts.RevisionField]
+		nrev, nok := nd[c.opts.RevisionField]
+		if ook && nok {
+			if !reflect.DeepEqual(orev, nrev) {
+				return false
+			}
+		} else if !reflect.DeepEqual(od, nd) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops polling the collection. It does not close the collection.
+func (c *Cache) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doccache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/memdocstore"
+	"gocloud.dev/gcerrors"
+)
+
+type doc = map[string]interface{}
+
+func newCollection(t *testing.T) *docstore.Collection {
+	t.Helper()
+	coll, err := memdocstore.OpenCollection("name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coll
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	coll := newCollection(t)
+	defer coll.Close()
+	for _, name := range []string{"a", "b"} {
+		if err := coll.Put(ctx, doc{"name": name, "n": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := New(ctx, coll, "name", &Options{PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	snap := c.Snapshot()
+	if snap.Generation != 1 || snap.Len() != 2 {
+		t.Fatalf("got generation %d with %d documents, want 1 with 2", snap.Generation, snap.Len())
+	}
+	if d, ok := snap.Get("a"); !ok || d["n"] != int64(1) {
+		t.Errorf(`Get("a") = %v, %t; want a document with n = 1`, d, ok)
+	}
+	if _, ok := snap.Get("c"); ok {
+		t.Error(`Get("c") found a document`)
+	}
+
+	// Reading an unchanged collection makes no new snapshot.
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Snapshot(); got != snap {
+		t.Errorf("got generation %d after no change, want the same snapshot", got.Generation)
+	}
+
+	for i, change := range []func() error{
+		func() error { return coll.Update(ctx, doc{"name": "a"}, docstore.Mods{"n": 2}) },
+		func() error { return coll.Put(ctx, doc{"name": "c"}) },
+		func() error { return coll.Delete(ctx, doc{"name": "b"}) },
+	} {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := c.Snapshot().Generation, uint64(i+2); got != want {
+			t.Errorf("change %d: got generation %d, want %d", i, got, want)
+		}
+	}
+	var keys []string
+	c.Snapshot().Range(func(k interface{}, d map[string]interface{}) bool {
+		keys = append(keys, fmt.Sprint(k))
+		return true
+	})
+	if len(keys) != 2 {
+		t.Errorf("got keys %v, want a and c", keys)
+	}
+	// The old snapshot is unchanged.
+	if d, _ := snap.Get("a"); d["n"] != int64(1) || snap.Len() != 2 {
+		t.Errorf("first snapshot changed: %v", snap.docs)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	ctx := context.Background()
+	coll := newCollection(t)
+	defer coll.Close()
+	c, err := New(ctx, coll, "name", &Options{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := coll.Put(ctx, doc{"name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	snap, err := c.Wait(wctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snap.Get("a"); !ok {
+		t.Error("new snapshot lacks the new document")
+	}
+
+	// Wait returns when ctx is done.
+	wctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Wait(wctx, snap.Generation); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	ctx := context.Background()
+	coll, err := memdocstore.OpenCollectionWithKeyFunc(func(d docstore.Document) interface{} {
+		m := d.(map[string]interface{})
+		return [2]interface{}{m["game"], m["player"]}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	if err := coll.Put(ctx, doc{"game": "g", "player": "p", "score": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(ctx, coll, "", nil); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Fatalf("without a key: got %v, want InvalidArgument", err)
+	}
+	c, err := New(ctx, coll, "", &Options{KeyFunc: func(d map[string]interface{}) interface{} {
+		return [2]interface{}{d["game"], d["player"]}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.Snapshot().Get([2]interface{}{"g", "p"}); !ok {
+		t.Error("document not found by its key")
+	}
+}
+
+func TestErr(t *testing.T) {
+	ctx := context.Background()
+	// Every query after the first in each second fails.
+	coll, err := memdocstore.OpenCollection("name", &memdocstore.Options{Faults: []memdocstore.Fault{
+		{Ops: []string{memdocstore.GetQueryOp}, PerSecond: 1, Code: gcerrors.ResourceExhausted},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	if err := coll.Put(ctx, doc{"name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(ctx, coll, "name", &Options{PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Refresh(ctx); gcerrors.Code(err) != gcerrors.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+	if c.Err() == nil {
+		t.Error("Err: got nil after a failed read")
+	}
+	if c.Snapshot().Len() != 1 {
+		t.Error("the snapshot was lost after a failed read")
+	}
+	time.Sleep(time.Second)
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Err(); err != nil {
+		t.Errorf("Err: got %v after a successful read", err)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package docjoin joins the results of a docstore query with small
+// collections held in memory.
+//
+// Docstore providers cannot join collections, so the join is done in the
+// client, as a hash join: LoadTable reads a small "dimension" collection (or
+// the results of a query on it) into a Table, indexed by one field. An
+// Iterator then reads documents from a query on a larger collection, looks up
+// each document's value of a field in one or more Tables, and copies fields of
+// the matching documents into it.
+//
+// For example, to add each order's customer name:
+//
+//	customers, err := docjoin.LoadTable(ctx, customerColl.Query(), "ID", nil)
+//	...
+//	iter, err := docjoin.New(orderColl.Query().Get(ctx), docjoin.Join{
+//		Table:  customers,
+//		On:     "CustomerID",
+//		Fields: map[string]string{"Name": "CustomerName"},
+//	})
+//	...
+//	defer iter.Stop()
+//	for {
+//		order := map[string]interface{}{}
+//		err := iter.Next(ctx, order)
+//		...
+//	}
+//
+// Documents are read and returned as maps, since joined documents usually have
+// fields that no single struct type describes.
+//
+// Keys are compared after converting numbers to a common type, so an int64
+// key from one provider matches a float64 key with the same value from
+// another.
+package docjoin // import "gocloud.dev/docstore/docjoin"
+
+import (
+	"context"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/internal/gcerr"
+)
+
+// DefaultMaxDocuments is the maximum number of documents in a Table when
+// TableOptions.MaxDocuments is zero.
+const DefaultMaxDocuments = 10000
+
+// TableOptions sets options for LoadTable.
+type TableOptions struct {
+	// MaxDocuments is the most documents that LoadTable reads. If the query
+	// returns more, LoadTable fails with a ResourceExhausted error, since
+	// Tables are meant for small collections.
+	// Defaults to DefaultMaxDocuments. Set it to a negative number for no
+	// limit.
+	MaxDocuments int
+}
+
+// A Table holds documents in memory, indexed by the value of one field.
+// It is safe for concurrent use, and may be used in any number of Joins.
+type Table struct {
+	keyPath []string
+	docs    map[interface{}][]map[string]interface{}
+	n       int
+}
+
+// LoadTable runs q and returns a Table of its results, indexed by the value of
+// keyField. keyField may be a dot-separated path to a field of a nested
+// document. Documents without the field are skipped. Several documents may
+// have the same key. opts may be nil.
+func LoadTable(ctx context.Context, q *docstore.Query, keyField string, opts *TableOptions) (*Table, error) {
+	keyPath, err := parsePath(keyField)
+	if err != nil {
+		return nil, err
+	}
+	max := DefaultMaxDocuments
+	if opts != nil && opts.MaxDocuments != 0 {
+		max = opts.MaxDocuments
+	}
+	t := &Table{keyPath: keyPath, docs: map[interface{}][]map[string]interface{}{}}
+	iter := q.Get(ctx)
+	defer iter.Stop()
+	for {
+		doc := map[string]interface{}{}
+		err := iter.Next(ctx, doc)
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if max > 0 && t.n == max {
+			return nil, gcerr.Newf(gcerr.ResourceExhausted, nil, "docjoin: query returned more than %d documents", max)
+		}
+		v, ok := getPath(doc, keyPath)
+		if !ok {
+			continue
+		}
+		key, ok := normalizeKey(v)
+		if !ok {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "docjoin: document has a key of type %T, which cannot be joined on", v)
+		}
+		t.docs[key] = append(t.docs[key], doc)
+		t.n++
+	}
+}
+
+// Len returns the number of documents in t.
+func (t *Table) Len() int { return t.n }
+
+// Lookup returns the documents whose key field equals key. They must not be
+// modified.
+func (t *Table) Lookup(key interface{}) []map[string]interface{} {
+	k, ok := normalizeKey(key)
+	if !ok {
+		return nil
+	}
+	return t.docs[k]
+}
+
+// A Join describes how to combine the documents of a Table with those of an
+// Iterator.
+type Join struct {
+	// Table holds the documents to join. Required.
+	Table *Table
+
+	// On is the field of the iterator's documents whose value is looked up in
+	// Table. It may be a dot-separated path. Required.
+	On string
+
+	// Fields maps fields of the Table's documents to the fields of the
+	// iterator's documents that they are copied to. Both may be dot-separated
+	// paths. Fields missing from a Table document are not copied.
+	Fields map[string]string
+
+	// Into, if not empty, is the field that a copy of the whole matching Table
+	// document is stored in. At least one of Fields and Into must be set.
+	Into string
+
+	// Required makes the join an inner join: documents without a match in
+	// Table, or without an On field, are skipped. By default they are
+	// returned without the joined fields, as in a left outer join.
+	Required bool
+}
+
+// compiled is a Join with its paths parsed.
+type compiled struct {
+	Join
+	on     []string
+	fields [][2][]string // from, to
+	into   []string
+}
+
+func (j *Join) compile() (*compiled, error) {
+	if j.Table == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "docjoin: Join with no Table")
+	}
+	if len(j.Fields) == 0 && j.Into == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "docjoin: Join on %q has neither Fields nor Into", j.On)
+	}
+	c := &compiled{Join: *j}
+	var err error
+	if c.on, err = parsePath(j.On); err != nil {
+		return nil, err
+	}
+	for from, to := range j.Fields {
+		fp, err := parsePath(from)
+		if err != nil {
+			return nil, err
+		}
+		tp, err := parsePath(to)
+		if err != nil {
+			return nil, err
+		}
+		c.fields = append(c.fields, [2][]string{fp, tp})
+	}
+	if j.Into != "" {
+		if c.into, err = parsePath(j.Into); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// An Iterator returns the documents of a docstore.DocumentIterator, joined
+// with Tables.
+type Iterator struct {
+	iter    *docstore.DocumentIterator
+	joins   []*compiled
+	pending []map[string]interface{} // joined documents not yet returned
+}
+
+// New returns an Iterator that reads the documents of iter and applies joins
+// to each, in order. A later Join may look up a field set by an earlier one.
+//
+// If a document matches several documents of a Table, the Iterator returns a
+// copy of it for each match.
+func New(iter *docstore.DocumentIterator, joins ...Join) (*Iterator, error) {
+	it := &Iterator{iter: iter}
+	for i := range joins {
+		c, err := joins[i].compile()
+		if err != nil {
+			return nil, err
+		}
+		it.joins = append(it.joins, c)
+	}
+	return it, nil
+}
+
+// Next stores the fields of the next joined document into doc. It returns
+// io.EOF at the end of the results, or another error from the underlying
+// iterator.
+func (it *Iterator) Next(ctx context.Context, doc map[string]interface{}) error {
+	for len(it.pending) == 0 {
+		d := map[string]interface{}{}
+		if err := it.iter.Next(ctx, d); err != nil {
+			return err
+		}
+		it.pending = it.join(d)
+	}
+	for k, v := range it.pending[0] {
+		doc[k] = v
+	}
+	it.pending[0] = nil
+	it.pending = it.pending[1:]
+	return nil
+}
+
+// join returns the results of applying the Iterator's joins to doc.
+func (it *Iterator) join(doc map[string]interface{}) []map[string]interface{} {
+	rows := []map[string]interface{}{doc}
+	for _, j := range it.joins {
+		var next []map[string]interface{}
+		for _, row := range rows {
+			var matches []map[string]interface{}
+			if v, ok := getPath(row, j.on); ok {
+				matches = j.Table.Lookup(v)
+			}
+			if len(matches) == 0 {
+				if !j.Required {
+					next = append(next, row)
+				}
+				continue
+			}
+			for i, m := range matches {
+				out := row
+				if i < len(matches)-1 {
+					out = copyValue(row).(map[string]interface{})
+				}
+				j.apply(out, m)
+				next = append(next, out)
+			}
+		}
+		rows = next
+	}
+	return rows
+}
+
+// apply copies the fields of the Table document m into doc.
+func (j *compiled) apply(doc, m map[string]interface{}) {
+	for _, f := range j.fields {
+		if v, ok := getPath(m, f[0]); ok {
+			setPath(doc, f[1], copyValue(v))
+		}
+	}
+	if j.into != nil {
+		setPath(doc, j.into, copyValue(m))
+	}
+}
+
+// Stop stops the underlying iterator.
+func (it *Iterator) Stop() {
+	it.iter.Stop()
+	it.pending = nil
+}
+
+func parsePath(field string) ([]string, error) {
+	if field == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "docjoin: empty field path")
+	}
+	path := strings.Split(field, ".")
+	for _, p := range path {
+		if p == "" {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "docjoin: invalid field path %q", field)
+		}
+	}
+	return path, nil
+}
+
+func getPath(doc map[string]interface{}, path []string) (interface{}, bool) {
+	for _, p := range path[:len(path)-1] {
+		m, ok := doc[p].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		doc = m
+	}
+	v, ok := doc[path[len(path)-1]]
+	return v, ok && v != nil
+}
+
+// setPath sets the field at path in doc to v, creating or replacing
+// intermediate documents as needed.
+func setPath(doc map[string]interface{}, path []string, v interface{}) {
+	for _, p := range path[:len(path)-1] {
+		m, ok := doc[p].(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{}
+			doc[p] = m
+		}
+		doc = m
+	}
+	doc[path[len(path)-1]] = v
+}
+
+// copyValue returns a deep copy of the maps and slices in v, so that joined
+// documents do not share them with each other or with a Table.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = copyValue(e)
+		}
+		return s
+	case []byte:
+		return append([]byte(nil), v...)
+	default:
+		return v
+	}
+}
+
+// normalizeKey converts v to a value that can be a map key and that compares
+// equal to the same value decoded as a different type: integers, and floats
+// with integer values, become int64; other floats become float64; byte slices
+// become strings. It reports false if v cannot be a key.
+func normalizeKey(v interface{}) (interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			return float64(u), true
+		}
+		return int64(u), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f), true
+		}
+		return f, true
+	case reflect.String:
+		return rv.String(), true
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return string(rv.Bytes()), true
+		}
+		return nil, false
+	case reflect.Invalid:
+		return nil, false
+	}
+	if !rv.Type().Comparable() {
+		return nil, false
+	}
+	return v, true
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docjoin
+
+import (
+	"context"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/memdocstore"
+	"gocloud.dev/gcerrors"
+)
+
+type doc = map[string]interface{}
+
+func newCollection(t *testing.T, keyField string, docs ...doc) *docstore.Collection {
+	t.Helper()
+	coll, err := memdocstore.OpenCollection(keyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs {
+		if err := coll.Put(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return coll
+}
+
+// collect returns all the documents of it, without revisions, sorted by the
+// "id" field and then by the "n" field.
+func collect(t *testing.T, it *Iterator) []doc {
+	t.Helper()
+	defer it.Stop()
+	var got []doc
+	for {
+		d := doc{}
+		err := it.Next(context.Background(), d)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(d, docstore.DefaultRevisionField)
+		got = append(got, d)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		if got[i]["id"] != got[j]["id"] {
+			return got[i]["id"].(string) < got[j]["id"].(string)
+		}
+		ni, _ := got[i]["n"].(int64)
+		nj, _ := got[j]["n"].(int64)
+		return ni < nj
+	})
+	return got
+}
+
+func TestJoin(t *testing.T) {
+	ctx := context.Background()
+	customers := newCollection(t, "cid",
+		doc{"cid": int64(1), "name": "Ann", "address": doc{"country": "NZ"}},
+		doc{"cid": int64(2), "name": "Bob", "address": doc{"country": "FR"}},
+	)
+	defer customers.Close()
+	countries := newCollection(t, "code",
+		doc{"code": "NZ", "region": "Oceania"},
+		doc{"code": "FR", "region": "Europe"},
+	)
+	defer countries.Close()
+	orders := newCollection(t, "id",
+		doc{"id": "o1", "customer": 1.0},
+		doc{"id": "o2", "customer": int64(2)},
+		doc{"id": "o3", "customer": int64(3)},
+		doc{"id": "o4"},
+	)
+	defer orders.Close()
+	ct, err := LoadTable(ctx, customers.Query(), "cid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct.Len() != 2 {
+		t.Errorf("got %d customers, want 2", ct.Len())
+	}
+	rt, err := LoadTable(ctx, countries.Query(), "code", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		joins []Join
+		want  []doc
+	}{
+		{
+			name: "left",
+			joins: []Join{{
+				Table:  ct,
+				On:     "customer",
+				Fields: map[string]string{"name": "customerName", "address.country": "ship.country"},
+			}},
+			want: []doc{
+				{"id": "o1", "customer": 1.0, "customerName": "Ann", "ship": doc{"country": "NZ"}},
+				{"id": "o2", "customer": int64(2), "customerName": "Bob", "ship": doc{"country": "FR"}},
+				{"id": "o3", "customer": int64(3)},
+				{"id": "o4"},
+			},
+		},
+		{
+			name:  "inner into",
+			joins: []Join{{Table: ct, On: "customer", Into: "c", Required: true}},
+			want: []doc{
+				{"id": "o1", "customer": 1.0, "c": doc{"cid": int64(1), "name": "Ann", "address": doc{"country": "NZ"}}},
+				{"id": "o2", "customer": int64(2), "c": doc{"cid": int64(2), "name": "Bob", "address": doc{"country": "FR"}}},
+			},
+		},
+		{
+			name: "chained",
+			joins: []Join{
+				{Table: ct, On: "customer", Fields: map[string]string{"address.country": "country"}, Required: true},
+				{Table: rt, On: "country", Fields: map[string]string{"region": "region"}},
+			},
+			want: []doc{
+				{"id": "o1", "customer": 1.0, "country": "NZ", "region": "Oceania"},
+				{"id": "o2", "customer": int64(2), "country": "FR", "region": "Europe"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			it, err := New(orders.Query().Get(ctx), test.joins...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := collect(t, it)
+			for _, d := range got {
+				if c, ok := d["c"].(doc); ok {
+					delete(c, docstore.DefaultRevisionField)
+				}
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestJoinManyMatches(t *testing.T) {
+	ctx := context.Background()
+	// Each tag has several documents, keyed by "tid" but joined on "tag".
+	tags := newCollection(t, "tid",
+		doc{"tid": "t1", "tag": "red", "n": int64(1)},
+		doc{"tid": "t2", "tag": "red", "n": int64(2)},
+		doc{"tid": "t3", "tag": "blue", "n": int64(3)},
+		doc{"tid": "t4"},
+	)
+	defer tags.Close()
+	items := newCollection(t, "id",
+		doc{"id": "a", "tag": "red", "extra": doc{"x": int64(1)}},
+		doc{"id": "b", "tag": "blue"},
+	)
+	defer items.Close()
+	tt, err := LoadTable(ctx, tags.Query(), "tag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tt.Len() != 3 {
+		t.Errorf("got %d documents, want 3 (one without a key)", tt.Len())
+	}
+	if got := len(tt.Lookup("red")); got != 2 {
+		t.Errorf(`Lookup("red") returned %d documents, want 2`, got)
+	}
+	it, err := New(items.Query().Get(ctx), Join{Table: tt, On: "tag", Fields: map[string]string{"n": "n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := collect(t, it)
+	want := []doc{
+		{"id": "a", "tag": "red", "extra": doc{"x": int64(1)}, "n": int64(1)},
+		{"id": "a", "tag": "red", "extra": doc{"x": int64(1)}, "n": int64(2)},
+		{"id": "b", "tag": "blue", "n": int64(3)},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	// The copies of a document do not share nested documents.
+	got[0]["extra"].(doc)["x"] = int64(9)
+	if got[1]["extra"].(doc)["x"] != int64(1) {
+		t.Error("copies of a joined document share a nested document")
+	}
+}
+
+func TestLoadTableLimit(t *testing.T) {
+	ctx := context.Background()
+	coll := newCollection(t, "id", doc{"id": "a"}, doc{"id": "b"}, doc{"id": "c"})
+	defer coll.Close()
+	_, err := LoadTable(ctx, coll.Query(), "id", &TableOptions{MaxDocuments: 2})
+	if gcerrors.Code(err) != gcerrors.ResourceExhausted {
+		t.Errorf("got %v, want ResourceExhausted", err)
+	}
+	if _, err := LoadTable(ctx, coll.Query(), "id", &TableOptions{MaxDocuments: 3}); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadTable(ctx, coll.Query(), "id", &TableOptions{MaxDocuments: -1}); err != nil {
+		t.Error(err)
+	}
+	// The query may restrict the documents loaded.
+	tab, err := LoadTable(ctx, coll.Query().Where("id", ">", "a"), "id", &TableOptions{MaxDocuments: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tab.Len() != 2 {
+		t.Errorf("got %d documents, want 2", tab.Len())
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	ctx := context.Background()
+	coll := newCollection(t, "id", doc{"id": "a", "list": []interface{}{1}})
+	defer coll.Close()
+	if _, err := LoadTable(ctx, coll.Query(), "list", nil); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("list key: got %v, want InvalidArgument", err)
+	}
+	if _, err := LoadTable(ctx, coll.Query(), "a..b", nil); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("bad key path: got %v, want InvalidArgument", err)
+	}
+	tab, err := LoadTable(ctx, coll.Query(), "id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range []Join{
+		{On: "id", Into: "x"},
+		{Table: tab, On: "id"},
+		{Table: tab, On: "", Into: "x"},
+		{Table: tab, On: "id", Into: "x."},
+		{Table: tab, On: "id", Fields: map[string]string{"a": ""}},
+	} {
+		if _, err := New(coll.Query().Get(ctx), j); gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%+v: got %v, want InvalidArgument", j, err)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	type name string
+	for _, test := range []struct {
+		in, want interface{}
+	}{
+		{int32(3), int64(3)},
+		{uint8(3), int64(3)},
+		{3.0, int64(3)},
+		{float32(2.5), 2.5},
+		{"a", "a"},
+		{name("a"), "a"},
+		{[]byte("a"), "a"},
+		{true, true},
+	} {
+		got, ok := normalizeKey(test.in)
+		if !ok || got != test.want {
+			t.Errorf("%#v: got %#v, %t; want %#v", test.in, got, ok, test.want)
+		}
+	}
+	for _, in := range []interface{}{nil, []int{1}, map[string]interface{}{}} {
+		if _, ok := normalizeKey(in); ok {
+			t.Errorf("%#v: got ok, want not ok", in)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 	"unicode/utf8"
 
 	"gocloud.dev/docstore/driver"
@@ -39,12 +40,39 @@ import (
 // structs, the exported fields are the document fields.
 type Document = interface{}
 
+// DocstoreMarshaler is implemented by types whose values are stored as the
+// values of another type, such as a decimal type that is stored as a string.
+// Docstore calls MarshalDocstore wherever a value of the type appears: in
+// documents, in Update mods, and in query and If values. For example:
+//
+//   func (d Decimal) MarshalDocstore() (interface{}, error) { return d.String(), nil }
+//
+// A method that returns a string or number makes the values usable in queries,
+// but the stored values sort in the order of the returned values, which may
+// differ from the order of the type's values.
+type DocstoreMarshaler = driver.DocstoreMarshaler
+
+// DocstoreUnmarshaler is implemented by types that decode themselves from the
+// value that their MarshalDocstore method returns. For example:
+//
+//   func (d *Decimal) UnmarshalDocstore(decode func(interface{}) error) error {
+//       var s string
+//       if err := decode(&s); err != nil {
+//           return err
+//       }
+//       return d.Parse(s)
+//   }
+type DocstoreUnmarshaler = driver.DocstoreUnmarshaler
+
 // A Collection is a set of documents.
 // TODO(jba): make the docstring look more like blob.Bucket.
 type Collection struct {
-	driver driver.Collection
-	mu     sync.Mutex
-	closed bool
+	driver     driver.Collection
+	slowLog    *slowLog // nil if slow operations are not logged
+	stringOpts StringOptions
+	keyGen     KeyGenerator // nil to let the driver generate keys
+	mu         sync.Mutex
+	closed     bool
 }
 
 // NewCollection is intended for use by provider implementations.
@@ -69,6 +97,20 @@ func newCollection(d driver.Collection) *Collection {
 	return c
 }
 
+// derive closes c and returns a new Collection with the same driver and
+// options, which the caller can then change. The With functions use it so that
+// each keeps the options set by the others.
+func (c *Collection) derive() *Collection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c2 := NewCollection(c.driver)
+	c2.slowLog = c.slowLog
+	c2.stringOpts = c.stringOpts
+	c2.keyGen = c.keyGen
+	return c2
+}
+
 // DefaultRevisionField is the default name of the document field used for document revision
 // information, to implement optimistic locking.
 // See the Revisions section of the package documentation.
@@ -81,6 +123,30 @@ func (c *Collection) revisionField() string {
 	return DefaultRevisionField
 }
 
+// CleanDocument removes from doc the fields that c manages for its own
+// bookkeeping: the revision field, and any provider-internal fields that c's
+// driver adds to the documents it returns. Call it on a document read from c
+// before writing the document to a different collection, so that the write does
+// not carry c's revision or fields the other collection knows nothing about.
+//
+// Fields are deleted from map documents. Struct fields are set to their zero value.
+func (c *Collection) CleanDocument(doc Document) error {
+	ddoc, err := driver.NewDocument(doc)
+	if err != nil {
+		return wrapError(c.driver, err)
+	}
+	fields := []string{c.revisionField()}
+	if l, ok := c.driver.(driver.InternalFieldLister); ok {
+		fields = append(fields, l.InternalFields()...)
+	}
+	for _, f := range fields {
+		if err := ddoc.ClearField(f); err != nil {
+			return wrapError(c.driver, err)
+		}
+	}
+	return nil
+}
+
 // A FieldPath is a dot-separated sequence of UTF-8 field names. Examples:
 //   room
 //   room.size
@@ -101,7 +167,7 @@ func (c *Collection) Actions() *ActionList {
 // The writes in an action list (Put, Create, Replace, Update and Delete actions)
 // must refer to distinct documents and are unordered with respect to each other.
 // Each write happens independently of the others: all actions will be executed, even
-// if some fail.
+// if some fail, unless FailFast is called.
 //
 // The Gets in an action list must also refer to distinct documents and are unordered
 // and independent of each other.
@@ -115,15 +181,28 @@ type ActionList struct {
 	coll     *Collection
 	actions  []*Action
 	beforeDo func(asFunc func(interface{}) bool) error
+	failFast bool
+	err      error // an error from building the list, returned by Do
 }
 
 // An Action is a read or write on a single document.
 // Use the methods of ActionList to create and execute Actions.
 type Action struct {
-	kind       driver.ActionKind
-	doc        Document
-	fieldpaths []FieldPath // paths to retrieve, for Get
-	mods       Mods        // modifications to make, for Update
+	kind        driver.ActionKind
+	doc         Document
+	fieldpaths  []FieldPath // paths to retrieve, for Get
+	mods        Mods        // modifications to make, for Update
+	getOrCreate bool        // a Create that reads the document if it already exists
+	conditions  []condition // conditions on the stored document, for writes
+	changes     *ChangeSet  // where to store the changes made by an Update
+}
+
+// A condition is a requirement on a field of the stored document, added by
+// ActionList.If.
+type condition struct {
+	fp    FieldPath
+	op    string
+	value interface{}
 }
 
 func (l *ActionList) add(a *Action) *ActionList {
@@ -138,7 +217,9 @@ func (l *ActionList) add(a *Action) *ActionList {
 //
 // If the document doesn't have key fields, or the key fields are empty, meaning
 // 0, a nil interface value, or any empty array or string, key fields with
-// unique values will be created and doc will be populated with them.
+// unique values will be created and doc will be populated with them. How the
+// values are generated depends on the provider, unless the Collection was
+// returned by WithKeyGenerator.
 //
 // The revision field of the document must be absent or nil.
 //
@@ -188,13 +269,36 @@ func (l *ActionList) Delete(doc Document) *ActionList {
 	return l.add(&Action{kind: driver.Delete, doc: doc})
 }
 
+// GetOrCreate adds an action that either retrieves an existing document or creates
+// it, to the given ActionList, and returns the ActionList. The key fields of doc
+// must be set, and its revision field must be absent or nil.
+//
+// If no document with doc's key exists, GetOrCreate behaves like Create: doc is
+// written, and its revision field is set. Otherwise, the stored document is left
+// unchanged and doc is populated from it, as with Get. As with Get, it is undefined
+// whether fields of doc that are not in the stored document are removed, unchanged
+// or zeroed.
+//
+// Unlike a Get followed by a Create, GetOrCreate is safe to run concurrently with
+// other GetOrCreates on the same document: exactly one of them creates the
+// document, and the others see its contents. It is implemented as a Create,
+// followed by a Get if the document already exists; if the document is deleted
+// between the two, the Create is retried.
+//
+// GetOrCreate counts as a write when checking an ActionList for duplicate keys.
+func (l *ActionList) GetOrCreate(doc Document) *ActionList {
+	return l.add(&Action{kind: driver.Create, doc: doc, getOrCreate: true})
+}
+
 // Get adds an action that retrieves a document to the given ActionList, and returns the ActionList.
 // Only the key fields of doc are used.
 // If fps is omitted, doc will contain all the fields of the retrieved document. If
 // fps is present, only the given field paths are retrieved, in addition to the
 // revision field. It is undefined whether other fields of doc at the time of the
 // call are removed, unchanged, or zeroed, so for portable behavior doc should
-// contain only the key fields.
+// contain only the key fields. A field path that is missing from the stored
+// document, such as that of an empty field with the omitempty tag option, is
+// not an error; it is not set in doc.
 func (l *ActionList) Get(doc Document, fps ...FieldPath) *ActionList {
 	return l.add(&Action{
 		kind:       driver.Get,
@@ -230,6 +334,83 @@ func (l *ActionList) Update(doc Document, mods Mods) *ActionList {
 	})
 }
 
+// If adds a condition to the action most recently added to the ActionList, and
+// returns the ActionList. The action is performed only if the field of the stored
+// document at fp satisfies the condition; otherwise, the action fails with an
+// error whose code is FailedPrecondition. Multiple calls to If on the same action
+// are combined with AND. The ops and values are those accepted by Query.Where.
+//
+// For example, this Put succeeds only if the stored document's Status field is
+// "pending":
+//
+//   coll.Actions().Put(doc).If("Status", "=", "pending").Do(ctx)
+//
+// Conditions can be added to Replace, Put, Update and Delete actions, and are
+// checked atomically with the write, in addition to any revision check. A
+// document that does not exist satisfies no conditions, except that a Delete of
+// a missing document succeeds, as it does without conditions.
+//
+// Not all providers support conditions on arbitrary fields; those that do not
+// fail the action with an error whose code is Unimplemented.
+func (l *ActionList) If(fp FieldPath, op string, value interface{}) *ActionList {
+	if len(l.actions) == 0 {
+		if l.err == nil {
+			l.err = gcerr.Newf(gcerr.InvalidArgument, nil, "If called on an empty ActionList")
+		}
+		return l
+	}
+	a := l.actions[len(l.actions)-1]
+	a.conditions = append(a.conditions, condition{fp, op, value})
+	return l
+}
+
+// ReportChanges makes the action most recently added to the ActionList, which
+// must be an Update, set *cs to the values that it changed when it succeeds, and
+// returns the ActionList. The changes are reported by the provider as part of
+// the Update, so they are exactly those that the Update made, with no separate
+// Get that could race with other writers. That makes them suitable for audit
+// trails.
+//
+// For example:
+//
+//   var cs docstore.ChangeSet
+//   err := coll.Actions().Update(doc, mods).ReportChanges(&cs).Do(ctx)
+//
+// If the action fails, *cs is unchanged.
+//
+// Not all providers can report changes; those that cannot fail the action with
+// an error whose code is Unimplemented.
+func (l *ActionList) ReportChanges(cs *ChangeSet) *ActionList {
+	if l.err != nil {
+		return l
+	}
+	switch {
+	case len(l.actions) == 0:
+		l.err = gcerr.Newf(gcerr.InvalidArgument, nil, "ReportChanges called on an empty ActionList")
+	case l.actions[len(l.actions)-1].kind != driver.Update:
+		l.err = gcerr.Newf(gcerr.InvalidArgument, nil, "ReportChanges called on a %s action; only Update actions report changes",
+			l.actions[len(l.actions)-1].kind)
+	case cs == nil:
+		l.err = gcerr.Newf(gcerr.InvalidArgument, nil, "ReportChanges called with a nil ChangeSet")
+	default:
+		l.actions[len(l.actions)-1].changes = cs
+	}
+	return l
+}
+
+// A ChangeSet maps the field paths of an Update's mods to the values at those
+// paths before and after the Update. See ActionList.ReportChanges.
+type ChangeSet map[FieldPath]Change
+
+// A Change is the value of a field before and after an Update. Old is nil if
+// the field did not exist, and New is nil if the Update deleted it. Values are
+// in the form that the provider stores them in, as they would be decoded into
+// an interface{}: for example, numbers may be int64 or float64, and nested
+// documents are map[string]interface{}.
+type Change struct {
+	Old, New interface{}
+}
+
 // Mods is a map from field paths to modifications.
 // At present, a modification is one of:
 // - nil, to delete the field
@@ -292,35 +473,299 @@ func (l *ActionList) BeforeDo(f func(asFunc func(interface{}) bool) error) *Acti
 	return l
 }
 
+// FailFast makes Do stop executing the action list after the first failure,
+// instead of attempting every action. Since the actions are unordered, which
+// actions run before the failure is noticed depends on the provider, which may
+// execute many actions in a single batch. Actions that were not attempted are
+// reported in the ActionListError with errors whose code is gcerrors.Canceled.
+// A GetOrCreate of an existing document is not a failure: when the list has
+// GetOrCreate actions, Do runs them, and any Gets of the same documents, before
+// the other actions.
+//
+// Use FailFast when later actions are pointless if any action fails, to avoid
+// wasted work. Without it, Do attempts every action and reports every failure.
+func (l *ActionList) FailFast() *ActionList {
+	l.failFast = true
+	return l
+}
+
 // Do executes the action list.
 //
 // If Do returns a non-nil error, it will be of type ActionListError. If any action
 // fails, the returned error will contain the position in the ActionList of each
 // failed action.
 //
-// All the actions will be executed. Docstore tries to execute the actions as
-// efficiently as possible. Sometimes this makes it impossible to attribute failures
-// to specific actions; in such cases, the returned ActionListError will have entries
-// whose Index field is negative.
-func (l *ActionList) Do(ctx context.Context) error {
+// All the actions will be executed, unless FailFast was called. Docstore tries
+// to execute the actions as efficiently as possible. If the provider limits the
+// number of actions that can be run together, Do splits a longer list into
+// several parts, run one after the other, and reports errors at their positions
+// in the whole list. Sometimes this makes it impossible to attribute failures
+// to specific actions; in such cases, the returned ActionListError will have
+// entries whose Index field is negative.
+func (l *ActionList) Do(ctx context.Context) (err error) {
+	if s := l.coll.slowLog; s != nil {
+		start := time.Now()
+		defer func() { s.logActions(l, start, err) }()
+	}
 	if err := l.coll.checkClosed(); err != nil {
 		return ActionListError{{-1, errClosed}}
 	}
+	if l.err != nil {
+		return ActionListError{{-1, l.err}}
+	}
 	das, err := l.toDriverActions()
 	if err != nil {
 		return err
 	}
-	dopts := &driver.RunActionsOptions{BeforeDo: l.beforeDo}
-	alerr := ActionListError(l.coll.driver.RunActions(ctx, das, dopts))
+	dopts := &driver.RunActionsOptions{BeforeDo: l.beforeDo, FailFast: l.failFast}
+	var alerr ActionListError
+	if first, rest := splitGetOrCreates(l.actions, das); l.failFast && len(first) > 0 {
+		// The Create of a GetOrCreate fails when the document exists, but the
+		// action succeeds, so that failure must not stop the other actions. Run
+		// the GetOrCreates first, without FailFast, and the rest only if they
+		// all succeed.
+		gopts := *dopts
+		gopts.FailFast = false
+		alerr = l.runPart(ctx, das, first, &gopts)
+		if len(alerr) > 0 {
+			errs := make([]error, len(das))
+			driver.SkipActions(rest, errs)
+			for _, e := range driver.NewActionListError(errs) {
+				e.Err = wrapError(l.coll.driver, e.Err)
+				alerr = append(alerr, e)
+			}
+		} else {
+			alerr = l.runPart(ctx, das, rest, dopts)
+		}
+	} else {
+		alerr = l.runPart(ctx, das, das, dopts)
+	}
+	l.setChangeSets(das, alerr)
 	if len(alerr) == 0 {
 		return nil // Explicitly return nil, because alerr is not of type error.
 	}
-	for i := range alerr {
-		alerr[i].Err = wrapError(l.coll.driver, alerr[i].Err)
+	return alerr
+}
+
+// splitGetOrCreates divides das, the result of toDriverActions for actions, into
+// the GetOrCreate actions together with the Gets of the same documents, and the
+// rest.
+func splitGetOrCreates(actions []*Action, das []*driver.Action) (first, rest []*driver.Action) {
+	keys := map[interface{}]bool{}
+	for _, a := range das {
+		if actions[a.Index].getOrCreate {
+			keys[a.Key] = true
+		}
+	}
+	if len(keys) == 0 {
+		return nil, das
+	}
+	for _, a := range das {
+		if keys[a.Key] {
+			first = append(first, a)
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	return first, rest
+}
+
+// runPart runs part, some of the actions of das, the result of toDriverActions,
+// completes the GetOrCreates among them, and returns their wrapped errors. The
+// indexes in the returned error are positions in das.
+func (l *ActionList) runPart(ctx context.Context, das, part []*driver.Action, opts *driver.RunActionsOptions) ActionListError {
+	if len(part) == 0 {
+		return nil
+	}
+	// Drivers expect the index of each action to be its position in the list
+	// they are passed.
+	indexes := make([]int, len(part))
+	for i, a := range part {
+		indexes[i] = a.Index
+		a.Index = i
+	}
+	perr := l.coll.runActions(ctx, part, opts)
+	for i, a := range part {
+		a.Index = indexes[i]
+	}
+	var alerr ActionListError
+	for _, e := range perr {
+		if e.Index >= 0 {
+			e.Index = indexes[e.Index]
+		}
+		e.Err = wrapError(l.coll.driver, e.Err)
+		alerr = append(alerr, e)
+	}
+	return l.finishGetOrCreates(ctx, das, alerr, opts)
+}
+
+// runActions runs das, whose indexes are their positions in the list, splitting
+// it into lists no longer than the driver's limit if it has one. The indexes in
+// the returned error are positions in das.
+func (c *Collection) runActions(ctx context.Context, das []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	max := 0
+	if l, ok := c.driver.(driver.ActionLimiter); ok {
+		max = l.MaxActions()
+	}
+	if max <= 0 || len(das) <= max {
+		return c.driver.RunActions(ctx, das, opts)
+	}
+	var alerr driver.ActionListError
+	for start := 0; start < len(das); start += max {
+		if opts.FailFast && len(alerr) > 0 {
+			errs := make([]error, len(das))
+			driver.SkipActions(das[start:], errs)
+			return append(alerr, driver.NewActionListError(errs)...)
+		}
+		end := start + max
+		if end > len(das) {
+			end = len(das)
+		}
+		part := das[start:end]
+		// Drivers expect the index of each action to be its position in the
+		// list they are passed.
+		for i, a := range part {
+			a.Index = i
+		}
+		perr := c.driver.RunActions(ctx, part, opts)
+		for i, a := range part {
+			a.Index = start + i
+		}
+		for _, e := range perr {
+			if e.Index >= 0 {
+				e.Index += start
+			}
+			alerr = append(alerr, e)
+		}
+	}
+	return alerr
+}
+
+// Validate checks the actions in the list as Do does before running them, and
+// also checks that every document and modification that would be written can be
+// encoded. It does not communicate with the provider's service, so it can be
+// used in unit tests to catch mistakes in building action lists: missing or
+// duplicate keys, revision fields on Create, invalid field paths, mods and
+// conditions, documents that are too large, and values of unsupported types.
+//
+// A nil result does not mean that Do will succeed, since Do may fail for reasons
+// that depend on the data in the service. If Validate fails, it returns an
+// ActionListError, like Do.
+func (l *ActionList) Validate() error {
+	if err := l.coll.checkClosed(); err != nil {
+		return ActionListError{{-1, errClosed}}
+	}
+	if l.err != nil {
+		return ActionListError{{-1, l.err}}
+	}
+	das, err := l.toDriverActions()
+	if err != nil {
+		return err
+	}
+	var alerr ActionListError
+	for _, a := range das {
+		if err := checkEncodable(a); err != nil {
+			alerr = append(alerr, struct {
+				Index int
+				Err   error
+			}{a.Index, gcerr.Newf(gcerr.InvalidArgument, err, "cannot encode %s action", a.Kind)})
+		}
+	}
+	if len(alerr) == 0 {
+		return nil
 	}
 	return alerr
 }
 
+// checkEncodable returns an error if the document or modifications that a would
+// write cannot be encoded.
+func checkEncodable(a *driver.Action) error {
+	switch a.Kind {
+	case driver.Get, driver.Delete:
+		return nil
+	case driver.Update:
+		for _, m := range a.Mods {
+			v := m.Value
+			if inc, ok := v.(driver.IncOp); ok {
+				v = inc.Amount
+			}
+			if v == nil {
+				continue
+			}
+			if _, err := driver.EstimateValueSize(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		_, _, err := driver.EstimateSize(a.Doc)
+		return err
+	}
+}
+
+// finishGetOrCreates completes the GetOrCreate actions whose Create failed because
+// the document already exists, and returns the remaining errors.
+// das must be the result of toDriverActions, so das[i] corresponds to l.actions[i].
+func (l *ActionList) finishGetOrCreates(ctx context.Context, das []*driver.Action, alerr ActionListError, opts *driver.RunActionsOptions) ActionListError {
+	var res ActionListError
+	for _, e := range alerr {
+		if e.Index >= 0 && l.actions[e.Index].getOrCreate && gcerrors.Code(e.Err) == gcerrors.AlreadyExists {
+			e.Err = l.coll.getExisting(ctx, das[e.Index], opts)
+		}
+		if e.Err != nil {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// setChangeSets stores the changes reported for the successful Update actions
+// that asked for them.
+// das must be the result of toDriverActions, so das[i] corresponds to l.actions[i].
+func (l *ActionList) setChangeSets(das []*driver.Action, alerr ActionListError) {
+	failed := map[int]bool{}
+	for _, e := range alerr {
+		failed[e.Index] = true
+	}
+	for i, a := range l.actions {
+		if a.changes == nil || failed[i] || failed[-1] {
+			continue
+		}
+		cs := ChangeSet{}
+		for _, c := range das[i].Changes {
+			cs[FieldPath(strings.Join(c.FieldPath, "."))] = Change{Old: c.Old, New: c.New}
+		}
+		*a.changes = cs
+	}
+}
+
+// getExisting retrieves the document of a, which is known to have existed when a
+// Create for it failed. If the document has since been deleted, getExisting
+// tries to create it again.
+func (c *Collection) getExisting(ctx context.Context, a *driver.Action, opts *driver.RunActionsOptions) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := c.runAction(ctx, &driver.Action{Kind: driver.Get, Doc: a.Doc, Key: a.Key}, opts)
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			return err
+		}
+		err = c.runAction(ctx, &driver.Action{Kind: driver.Create, Doc: a.Doc, Key: a.Key}, opts)
+		if gcerrors.Code(err) != gcerrors.AlreadyExists {
+			return err
+		}
+	}
+}
+
+// runAction runs a single driver action and returns its wrapped error.
+func (c *Collection) runAction(ctx context.Context, a *driver.Action, opts *driver.RunActionsOptions) error {
+	if alerr := c.driver.RunActions(ctx, []*driver.Action{a}, opts); len(alerr) > 0 {
+		return wrapError(c.driver, alerr[0].Err)
+	}
+	return nil
+}
+
 func (l *ActionList) toDriverActions() ([]*driver.Action, error) {
 	var das []*driver.Action
 	var alerr ActionListError
@@ -363,6 +808,8 @@ func (c *Collection) toDriverAction(a *Action) (*driver.Action, error) {
 	if err != nil {
 		return nil, err
 	}
+	sopts := c.stringOpts
+	normalizeDocument(sopts, a.doc)
 	key, err := c.driver.Key(ddoc)
 	if err != nil {
 		if gcerrors.Code(err) != gcerr.InvalidArgument {
@@ -370,12 +817,18 @@ func (c *Collection) toDriverAction(a *Action) (*driver.Action, error) {
 		}
 		return nil, err
 	}
-	if key == nil && a.kind != driver.Create {
+	if err := checkActionStrings(sopts, a, ddoc, key); err != nil {
+		return nil, err
+	}
+	if key == nil && (a.kind != driver.Create || a.getOrCreate) {
 		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
 	}
 	if reflect.ValueOf(key).Kind() == reflect.Ptr {
 		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "keys cannot be pointers")
 	}
+	if key != nil && !reflect.TypeOf(key).Comparable() {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "keys must be comparable, got a %T", key)
+	}
 	rev, _ := ddoc.GetField(c.revisionField())
 	if a.kind == driver.Create && rev != nil {
 		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "cannot create a document with a revision field")
@@ -386,6 +839,9 @@ func (c *Collection) toDriverAction(a *Action) (*driver.Action, error) {
 		kind = driver.Replace
 	}
 	d := &driver.Action{Kind: kind, Doc: ddoc, Key: key}
+	if kind == driver.Create && c.keyGen != nil {
+		d.KeyGenerator = c.keyGen
+	}
 	if a.fieldpaths != nil {
 		d.FieldPaths, err = parseFieldPaths(a.fieldpaths)
 		if err != nil {
@@ -397,10 +853,105 @@ func (c *Collection) toDriverAction(a *Action) (*driver.Action, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := applyStringOptionsToMods(sopts, d.Mods); err != nil {
+			return nil, err
+		}
+	}
+	if a.changes != nil {
+		if r, ok := c.driver.(driver.ChangeReporter); !ok || !r.ReportsChanges() {
+			return nil, gcerr.Newf(gcerr.Unimplemented, nil, "this provider cannot report the changes made by an Update")
+		}
+		d.ReportChanges = true
+	}
+	if len(a.conditions) > 0 {
+		if d.Conditions, err = toDriverConditions(a); err != nil {
+			return nil, err
+		}
+		if err := applyStringOptionsToFilters(sopts, d.Conditions); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkSize(d); err != nil {
+		return nil, err
 	}
 	return d, nil
 }
 
+func toDriverConditions(a *Action) ([]driver.Filter, error) {
+	if a.kind == driver.Get || a.kind == driver.Create {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "conditions are not allowed on %s actions", a.kind)
+	}
+	var fs []driver.Filter
+	for _, c := range a.conditions {
+		fp, err := parseFieldPath(c.fp)
+		if err != nil {
+			return nil, err
+		}
+		if !validOp[c.op] {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "invalid condition operator: %q. Use one of: =, >, <, >=, <=", c.op)
+		}
+		value, err := driver.Convert(c.value)
+		if err != nil {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, err, "invalid condition value: %v", c.value)
+		}
+		if !validFilterValue(value) {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "invalid condition value: %v", c.value)
+		}
+		if reflect.TypeOf(value).Kind() == reflect.Bool && c.op != driver.EqualOp {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "invalid condition operator %q for bool value: use =", c.op)
+		}
+		fs = append(fs, driver.Filter{FieldPath: fp, Op: c.op, Value: value})
+	}
+	return fs, nil
+}
+
+// checkSize returns an InvalidArgument error if the action would write a document
+// larger than the driver's maximum document size. For an Update, only the sizes of
+// the new values are known, so checkSize verifies that no single value is too
+// large.
+func (c *Collection) checkSize(a *driver.Action) error {
+	max := c.driver.MaxDocumentSize()
+	if max <= 0 {
+		return nil
+	}
+	switch a.Kind {
+	case driver.Create, driver.Replace, driver.Put:
+		size, fields, err := driver.EstimateSize(a.Doc)
+		if err != nil {
+			return err
+		}
+		if size <= max {
+			return nil
+		}
+		var largest string
+		for f, n := range fields {
+			if n > fields[largest] || (n == fields[largest] && f < largest) {
+				largest = f
+			}
+		}
+		return gcerr.Newf(gcerr.InvalidArgument, nil,
+			"document size of at least %d bytes exceeds the maximum of %d; the largest field is %q, with at least %d bytes",
+			size, max, largest, fields[largest])
+	case driver.Update:
+		for _, m := range a.Mods {
+			if _, ok := m.Value.(driver.IncOp); ok || m.Value == nil {
+				continue
+			}
+			fp := strings.Join(m.FieldPath, ".")
+			size, err := driver.EstimateValueSize(m.Value)
+			if err != nil {
+				return err
+			}
+			if size += len(fp); size > max {
+				return gcerr.Newf(gcerr.InvalidArgument, nil,
+					"update of field %q with at least %d bytes exceeds the maximum document size of %d",
+					fp, size, max)
+			}
+		}
+	}
+	return nil
+}
+
 func parseFieldPaths(fps []FieldPath) ([][]string, error) {
 	res := make([][]string, len(fps))
 	for i, s := range fps {
@@ -491,13 +1042,20 @@ func (l *ActionList) String() string {
 
 func (a *Action) String() string {
 	buf := &strings.Builder{}
-	fmt.Fprintf(buf, "%s(%v", a.kind, a.doc)
+	kind := a.kind.String()
+	if a.getOrCreate {
+		kind = "GetOrCreate"
+	}
+	fmt.Fprintf(buf, "%s(%v", kind, a.doc)
 	for _, fp := range a.fieldpaths {
 		fmt.Fprintf(buf, ", %s", fp)
 	}
 	for _, m := range a.mods {
 		fmt.Fprintf(buf, ", %v", m)
 	}
+	for _, c := range a.conditions {
+		fmt.Fprintf(buf, ", if %s %s %v", c.fp, c.op, c.value)
+	}
 	fmt.Fprint(buf, ")")
 	return buf.String()
 }
@@ -538,6 +1096,15 @@ func (c *Collection) Delete(ctx context.Context, doc Document) error {
 	return nil
 }
 
+// GetOrCreate is a convenience for building and running a single-element action list.
+// See ActionList.GetOrCreate.
+func (c *Collection) GetOrCreate(ctx context.Context, doc Document) error {
+	if err := c.Actions().GetOrCreate(doc).Do(ctx); err != nil {
+		return err.(ActionListError).Unwrap()
+	}
+	return nil
+}
+
 // Get is a convenience for building and running a single-element action list.
 // See ActionList.Get.
 func (c *Collection) Get(ctx context.Context, doc Document, fps ...FieldPath) error {
@@ -16,12 +16,15 @@ package docstore
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"gocloud.dev/docstore/driver"
 	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
 )
 
 func TestToDriverMods(t *testing.T) {
@@ -75,6 +78,7 @@ func TestToDriverActionsErrors(t *testing.T) {
 	dn := map[string]interface{}{"key": nil}
 	d1 := map[string]interface{}{"key": 1}
 	d2 := map[string]interface{}{"key": 2}
+	ds := map[string]interface{}{"key": []int{1}}
 
 	for _, test := range []struct {
 		alist *ActionList
@@ -83,6 +87,8 @@ func TestToDriverActionsErrors(t *testing.T) {
 		// Missing keys.
 		{c.Actions().Put(dn), []int{0}},
 		{c.Actions().Get(dn).Replace(dn).Create(dn).Update(dn, Mods{"a": 1}), []int{0, 1, 3}},
+		// Keys that are not comparable.
+		{c.Actions().Put(d1).Get(ds), []int{1}},
 		// Duplicate documents.
 		{c.Actions().Get(d1).Get(d2), nil},
 		{c.Actions().Get(d1).Put(d1), nil},
@@ -120,6 +126,105 @@ func TestToDriverActionsErrors(t *testing.T) {
 	}
 }
 
+func TestValidate(t *testing.T) {
+	c := &Collection{driver: fakeDriverCollection{}}
+	d1 := map[string]interface{}{"key": 1}
+	d2 := map[string]interface{}{"key": 2, "f": func() {}}
+	d3 := map[string]interface{}{"key": 3, DefaultRevisionField: 1}
+
+	for _, test := range []struct {
+		alist *ActionList
+		want  []int // error indexes; nil if no error
+	}{
+		{c.Actions().Put(d1).Get(d2).Delete(d2), nil},
+		{c.Actions().Put(d1).Put(d2), []int{1}},                          // unencodable document
+		{c.Actions().Update(d1, Mods{"a": make(chan int)}), []int{0}},    // unencodable mod
+		{c.Actions().Update(d1, Mods{"a": Increment(1), "b": nil}), nil}, // increment and delete
+		{c.Actions().Create(d3), []int{0}},                               // revision field on Create
+		{c.Actions().Get(d1).Get(d1).Replace(d2), []int{1}},              // errors before encoding are returned alone
+		{c.Actions().Put(d1).If("a", "!=", 1), []int{0}},                 // bad condition
+	} {
+		err := test.alist.Validate()
+		if err == nil {
+			if len(test.want) > 0 {
+				t.Errorf("%s: got nil, want error", test.alist)
+			}
+			continue
+		}
+		var got []int
+		for _, e := range err.(ActionListError) {
+			if gcerrors.Code(e.Err) != gcerrors.InvalidArgument {
+				t.Errorf("%s: got %v, want InvalidArgument", test.alist, e.Err)
+			}
+			got = append(got, e.Index)
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.alist, got, test.want)
+		}
+	}
+}
+
+func TestReportChangesErrors(t *testing.T) {
+	c := &Collection{driver: fakeDriverCollection{}}
+	d1 := map[string]interface{}{"key": 1}
+	var cs ChangeSet
+
+	for _, test := range []struct {
+		alist     *ActionList
+		wantIndex int
+		wantCode  gcerrors.ErrorCode
+	}{
+		{c.Actions().ReportChanges(&cs), -1, gcerrors.InvalidArgument},                          // empty list
+		{c.Actions().Put(d1).ReportChanges(&cs), -1, gcerrors.InvalidArgument},                  // not an Update
+		{c.Actions().Update(d1, Mods{"a": 1}).ReportChanges(nil), -1, gcerrors.InvalidArgument}, // nil ChangeSet
+		{c.Actions().Update(d1, Mods{"a": 1}).ReportChanges(&cs), 0, gcerrors.Unimplemented},    // provider can't report
+	} {
+		err := test.alist.Validate()
+		alerr, ok := err.(ActionListError)
+		if !ok || len(alerr) != 1 {
+			t.Errorf("%s: got %v, want one error", test.alist, err)
+			continue
+		}
+		if got := alerr[0]; got.Index != test.wantIndex || gcerrors.Code(got.Err) != test.wantCode {
+			t.Errorf("%s: got index %d, code %v; want %d, %v", test.alist, got.Index, gcerrors.Code(got.Err), test.wantIndex, test.wantCode)
+		}
+	}
+}
+
+type internalFieldsCollection struct {
+	fakeDriverCollection
+}
+
+func (internalFieldsCollection) InternalFields() []string { return []string{"_internal"} }
+
+func TestCleanDocument(t *testing.T) {
+	c := &Collection{driver: internalFieldsCollection{}}
+
+	m := map[string]interface{}{"key": 1, "a": 2, DefaultRevisionField: 3, "_internal": 4}
+	if err := c.CleanDocument(m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"key": 1, "a": 2}; !cmp.Equal(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+
+	type S struct {
+		Key              int
+		DocstoreRevision interface{}
+	}
+	s := &S{Key: 1, DocstoreRevision: 3}
+	if err := c.CleanDocument(s); err != nil {
+		t.Fatal(err)
+	}
+	if want := (&S{Key: 1}); !cmp.Equal(s, want) {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+
+	if err := c.CleanDocument(S{}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("non-pointer struct: got %v, want InvalidArgument", err)
+	}
+}
+
 func TestClosedErrors(t *testing.T) {
 	// Check that all collection methods return errClosed if the collection is closed.
 	ctx := context.Background()
@@ -160,6 +265,82 @@ func TestClosedErrors(t *testing.T) {
 	check(iter.Next(ctx, doc))
 }
 
+// limitDriver runs at most max actions at a time. It fails the actions on
+// documents whose key starts with "bad".
+type limitDriver struct {
+	fakeDriverCollection
+	max   int
+	sizes []int // the lengths of the lists passed to RunActions
+}
+
+func (d *limitDriver) MaxActions() int { return d.max }
+
+func (d *limitDriver) RunActions(ctx context.Context, as []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	d.sizes = append(d.sizes, len(as))
+	errs := make([]error, len(as))
+	for _, a := range as {
+		if strings.HasPrefix(a.Key.(string), "bad") {
+			errs[a.Index] = gcerr.Newf(gcerr.FailedPrecondition, nil, "bad key %v", a.Key)
+		}
+	}
+	return driver.NewActionListError(errs)
+}
+
+func TestActionListSplitting(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name      string
+		keys      []string
+		failFast  bool
+		wantSizes []int
+		wantErrs  map[int]gcerrors.ErrorCode
+	}{
+		{
+			name:      "within limit",
+			keys:      []string{"a", "b", "c"},
+			wantSizes: []int{3},
+		},
+		{
+			name:      "split",
+			keys:      []string{"a", "b", "c", "d", "bad1", "f", "bad2"},
+			wantSizes: []int{3, 3, 1},
+			wantErrs:  map[int]gcerrors.ErrorCode{4: gcerrors.FailedPrecondition, 6: gcerrors.FailedPrecondition},
+		},
+		{
+			name:      "fail fast",
+			keys:      []string{"a", "bad", "c", "d", "e"},
+			failFast:  true,
+			wantSizes: []int{3},
+			wantErrs:  map[int]gcerrors.ErrorCode{1: gcerrors.FailedPrecondition, 3: gcerrors.Canceled, 4: gcerrors.Canceled},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := &limitDriver{max: 3}
+			c := &Collection{driver: d}
+			l := c.Actions()
+			for _, k := range test.keys {
+				l.Put(map[string]interface{}{"key": k})
+			}
+			if test.failFast {
+				l.FailFast()
+			}
+			err := l.Do(ctx)
+			if !cmp.Equal(d.sizes, test.wantSizes) {
+				t.Errorf("got lists of %v actions, want %v", d.sizes, test.wantSizes)
+			}
+			gotErrs := map[int]gcerrors.ErrorCode{}
+			if err != nil {
+				for _, e := range err.(ActionListError) {
+					gotErrs[e.Index] = gcerrors.Code(e.Err)
+				}
+			}
+			if !cmp.Equal(gotErrs, test.wantErrs, cmpopts.EquateEmpty()) {
+				t.Errorf("got errors %v, want %v", gotErrs, test.wantErrs)
+			}
+		})
+	}
+}
+
 type fakeDriverCollection struct {
 	driver.Collection
 }
@@ -170,6 +351,8 @@ func (fakeDriverCollection) Key(doc driver.Document) (interface{}, error) {
 
 func (fakeDriverCollection) RevisionField() string { return DefaultRevisionField }
 
+func (fakeDriverCollection) MaxDocumentSize() int { return 0 }
+
 func (fakeDriverCollection) Close() error { return nil }
 
 func (fakeDriverCollection) RunGetQuery(context.Context, *driver.Query) (driver.DocumentIterator, error) {
@@ -0,0 +1,458 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package docstorevet defines an Analyzer that checks the struct types of
+// docstore documents at build time, finding mistakes that docstore would
+// otherwise report only when the documents are used.
+//
+// Run it with the gocdk-docstore-vet command:
+//
+//	go install gocloud.dev/docstore/docstorevet/cmd/gocdk-docstore-vet
+//	gocdk-docstore-vet ./...
+//
+// or with go vet -vettool=$(which gocdk-docstore-vet).
+//
+// Document types are the struct types with fields that have docstore tags,
+// and the types of the documents passed to the methods of Collection,
+// ActionList and DocumentIterator. For them, the analyzer reports
+//   - docstore tag options other than omitempty, json, inline and noinline,
+//     and json tag options other than omitempty;
+//   - misuse of the inline option, with a name or on a field that is not a
+//     struct;
+//   - fields with the same name;
+//   - fields of types that docstore cannot encode, like channels, functions
+//     and maps whose keys are not strings, integers or
+//     encoding.TextMarshalers;
+//   - revision fields whose type is not interface{};
+//   - Create actions on document literals that set the revision field;
+//   - with the -keys flag, documents that have none of the given key fields.
+package docstorevet // import "gocloud.dev/docstore/docstorevet"
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+)
+
+const doc = `check the struct types of docstore documents
+
+The docstorevet analyzer reports invalid docstore struct tags, fields
+that docstore cannot encode, duplicate field names, misuse of the
+revision field and, with -keys, documents without key fields.`
+
+// Analyzer checks the struct types of docstore documents.
+var Analyzer = &analysis.Analyzer{
+	Name:     "docstorevet",
+	Doc:      doc,
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+var (
+	revisionField string // the name of the revision field
+	keyFields     string // comma-separated names of key fields; empty to skip the check
+)
+
+func init() {
+	Analyzer.Flags.StringVar(&revisionField, "revision", "DocstoreRevision", "name of the revision field of documents")
+	Analyzer.Flags.StringVar(&keyFields, "keys", "", "comma-separated names of key fields, one of which every document must have")
+}
+
+const docstorePath = "gocloud.dev/docstore"
+
+// docArgs maps the docstore methods that take documents to the index of their
+// document argument.
+var docArgs = map[string]int{
+	"Collection.Create":      1,
+	"Collection.Replace":     1,
+	"Collection.Put":         1,
+	"Collection.Delete":      1,
+	"Collection.GetOrCreate": 1,
+	"Collection.Get":         1,
+	"Collection.Update":      1,
+	"ActionList.Create":      0,
+	"ActionList.Replace":     0,
+	"ActionList.Put":         0,
+	"ActionList.Delete":      0,
+	"ActionList.GetOrCreate": 0,
+	"ActionList.Get":         0,
+	"ActionList.Update":      0,
+	"DocumentIterator.Next":  1,
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	c := &checker{
+		pass:      pass,
+		docs:      map[types.Type]bool{},
+		structs:   map[types.Type]bool{},
+		embedding: map[types.Type]bool{},
+		reported:  map[string]bool{},
+	}
+	insp := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+	nodeFilter := []ast.Node{(*ast.TypeSpec)(nil), (*ast.CallExpr)(nil)}
+	insp.Preorder(nodeFilter, func(n ast.Node) {
+		switch n := n.(type) {
+		case *ast.TypeSpec:
+			if st, ok := n.Type.(*ast.StructType); ok && hasDocstoreTag(st) {
+				if obj := pass.TypesInfo.Defs[n.Name]; obj != nil {
+					c.checkDocument(obj.Type(), n.Name.Pos())
+				}
+			}
+		case *ast.CallExpr:
+			c.checkCall(n)
+		}
+	})
+	return nil, nil
+}
+
+// hasDocstoreTag reports whether a field of st has a docstore tag.
+func hasDocstoreTag(st *ast.StructType) bool {
+	for _, f := range st.Fields.List {
+		if f.Tag == nil {
+			continue
+		}
+		tag, err := strconv.Unquote(f.Tag.Value)
+		if err != nil {
+			continue
+		}
+		if _, ok := reflect.StructTag(tag).Lookup("docstore"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type checker struct {
+	pass      *analysis.Pass
+	docs      map[types.Type]bool // document types checked
+	structs   map[types.Type]bool // struct types of fields checked
+	embedding map[types.Type]bool // embedded struct types being checked
+	reported  map[string]bool     // problems reported, by position and message
+}
+
+// checkCall checks the document passed to a docstore method.
+func (c *checker) checkCall(call *ast.CallExpr) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return
+	}
+	fn, ok := c.pass.TypesInfo.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != docstorePath {
+		return
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return
+	}
+	i, ok := docArgs[typeName(recv.Type())+"."+fn.Name()]
+	if !ok || i >= len(call.Args) {
+		return
+	}
+	arg := call.Args[i]
+	c.checkDocument(c.pass.TypesInfo.TypeOf(arg), arg.Pos())
+	if fn.Name() == "Create" {
+		c.checkCreate(arg)
+	}
+}
+
+// typeName returns the name of the named type t or *t, or "".
+func typeName(t types.Type) string {
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	if n, ok := t.(*types.Named); ok {
+		return n.Obj().Name()
+	}
+	return ""
+}
+
+// A field is a field of a document, by its docstore name.
+type field struct {
+	name string
+	v    *types.Var
+}
+
+// checkDocument checks the document type t, or *t. Maps and interfaces are
+// checked at run time. Problems that cannot be reported at the declaration of
+// a field, because it is in another package, are reported at pos.
+func (c *checker) checkDocument(t types.Type, pos token.Pos) {
+	if t == nil {
+		return
+	}
+	if p, ok := t.Underlying().(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	st, ok := t.Underlying().(*types.Struct)
+	if !ok || c.docs[t] {
+		return
+	}
+	c.docs[t] = true
+	c.structs[t] = true
+	fields := c.checkStruct(st, pos)
+	for _, f := range fields {
+		if f.name == revisionField && !types.IsInterface(f.v.Type()) {
+			c.report(f.v, pos, "revision field %s has type %s; it should be interface{}, since providers use different types for revisions",
+				f.v.Name(), types.TypeString(f.v.Type(), types.RelativeTo(c.pass.Pkg)))
+		}
+	}
+	if keyFields == "" {
+		return
+	}
+	keys := strings.Split(keyFields, ",")
+	for _, f := range fields {
+		for _, k := range keys {
+			if f.name == k {
+				return
+			}
+		}
+	}
+	c.pass.Reportf(pos, "document type %s has no key field (%s)",
+		types.TypeString(t, types.RelativeTo(c.pass.Pkg)), strings.Join(keys, " or "))
+}
+
+// checkStruct checks the fields of st and returns them, including the fields
+// of embedded structs.
+func (c *checker) checkStruct(st *types.Struct, pos token.Pos) []field {
+	var fields []field
+	byName := map[string]*types.Var{}
+	for i := 0; i < st.NumFields(); i++ {
+		v := st.Field(i)
+		if !v.Exported() && !v.Embedded() {
+			continue
+		}
+		name, keep, opts, isDocstore := parseTag(reflect.StructTag(st.Tag(i)))
+		if !keep {
+			continue
+		}
+		var asJSON, inline, noInline bool
+		for _, o := range opts {
+			switch {
+			case o == "omitempty":
+				continue
+			case o == "json" && isDocstore:
+				// The field is encoded with encoding/json, so its type is
+				// not checked.
+				asJSON = true
+				continue
+			case o == "inline" && isDocstore:
+				inline = true
+				continue
+			case o == "noinline" && isDocstore:
+				noInline = true
+				continue
+			}
+			if isDocstore {
+				c.report(v, pos, "unknown docstore tag option %q", o)
+			} else {
+				c.report(v, pos, "json tag option %q is not supported by docstore; add a docstore tag", o)
+			}
+		}
+		if inline && (name != "" || asJSON) {
+			c.report(v, pos, "docstore tag option \"inline\" cannot be used with a name or the \"json\" option")
+		}
+		if (v.Embedded() && name == "" && !noInline) || inline {
+			t := v.Type()
+			if p, ok := t.Underlying().(*types.Pointer); ok {
+				t = p.Elem()
+			}
+			if est, ok := t.Underlying().(*types.Struct); ok {
+				// Collect the fields of embedded structs for each document,
+				// but not those of structs that embed themselves.
+				if !c.embedding[t] {
+					c.embedding[t] = true
+					fields = append(fields, c.checkStruct(est, pos)...)
+					delete(c.embedding, t)
+				}
+				continue
+			}
+			if inline {
+				c.report(v, pos, "field %s has docstore tag option \"inline\", but its type %s is not a struct",
+					v.Name(), types.TypeString(v.Type(), types.RelativeTo(c.pass.Pkg)))
+				continue
+			}
+		}
+		if !v.Exported() {
+			// An unexported embedded field that is not flattened.
+			continue
+		}
+		if name == "" {
+			name = v.Name()
+		}
+		if w := byName[name]; w != nil {
+			c.report(v, pos, "field %s has the same docstore name %q as field %s", v.Name(), name, w.Name())
+		}
+		byName[name] = v
+		fields = append(fields, field{name, v})
+		if !asJSON {
+			c.checkType(v.Type(), v, pos)
+		}
+	}
+	return fields
+}
+
+// parseTag interprets the tags of a field like docstore does. isDocstore is
+// false if the field has no docstore tag, so that its json tag is used.
+func parseTag(tag reflect.StructTag) (name string, keep bool, opts []string, isDocstore bool) {
+	s, isDocstore := tag.Lookup("docstore")
+	if !isDocstore {
+		s = tag.Get("json")
+	}
+	parts := strings.Split(s, ",")
+	if parts[0] == "-" && len(parts) == 1 {
+		return "", false, nil, isDocstore
+	}
+	return parts[0], true, parts[1:], isDocstore
+}
+
+// checkType reports the parts of the type t of field v that docstore cannot
+// encode.
+func (c *checker) checkType(t types.Type, v *types.Var, pos token.Pos) {
+	if marshals(t) {
+		return
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch u.Kind() {
+		case types.Complex64, types.Complex128, types.UnsafePointer:
+			c.reportType(t, v, pos)
+		}
+	case *types.Chan, *types.Signature:
+		c.reportType(t, v, pos)
+	case *types.Pointer:
+		c.checkType(u.Elem(), v, pos)
+	case *types.Slice:
+		c.checkType(u.Elem(), v, pos)
+	case *types.Array:
+		c.checkType(u.Elem(), v, pos)
+	case *types.Map:
+		if !validKey(u.Key()) {
+			c.report(v, pos, "field %s has map key type %s; docstore map keys must be strings, integers or encoding.TextMarshalers",
+				v.Name(), types.TypeString(u.Key(), types.RelativeTo(c.pass.Pkg)))
+		}
+		c.checkType(u.Elem(), v, pos)
+	case *types.Struct:
+		if !c.structs[t] {
+			c.structs[t] = true
+			c.checkStruct(u, pos)
+		}
+	}
+}
+
+func (c *checker) reportType(t types.Type, v *types.Var, pos token.Pos) {
+	c.report(v, pos, "field %s has type %s, which docstore cannot encode",
+		v.Name(), types.TypeString(t, types.RelativeTo(c.pass.Pkg)))
+}
+
+// report reports a problem with field v at its declaration, or at pos if v is
+// declared in another package. A field of a struct that several documents
+// embed is reported once.
+func (c *checker) report(v *types.Var, pos token.Pos, format string, args ...interface{}) {
+	if v.Pkg() == c.pass.Pkg {
+		pos = v.Pos()
+	}
+	msg := fmt.Sprintf(format, args...)
+	key := fmt.Sprintf("%d %s", pos, msg)
+	if c.reported[key] {
+		return
+	}
+	c.reported[key] = true
+	c.pass.Reportf(pos, "%s", msg)
+}
+
+// marshals reports whether docstore encodes values of type t with one of the
+// methods of t, rather than by their kind.
+func marshals(t types.Type) bool {
+	return hasMethod(t, "MarshalBinary") || hasMethod(t, "MarshalText") || hasMethod(t, "ProtoMessage")
+}
+
+func hasMethod(t types.Type, name string) bool {
+	ms := types.NewMethodSet(t)
+	for i := 0; i < ms.Len(); i++ {
+		if ms.At(i).Obj().Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validKey reports whether docstore can encode map keys of type t.
+func validKey(t types.Type) bool {
+	if b, ok := t.Underlying().(*types.Basic); ok && b.Info()&(types.IsString|types.IsInteger) != 0 {
+		return true
+	}
+	return hasMethod(t, "MarshalText")
+}
+
+// checkCreate reports a document literal passed to Create that sets the
+// revision field.
+func (c *checker) checkCreate(arg ast.Expr) {
+	if u, ok := arg.(*ast.UnaryExpr); ok && u.Op == token.AND {
+		arg = u.X
+	}
+	lit, ok := arg.(*ast.CompositeLit)
+	if !ok {
+		return
+	}
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok || isNil(kv.Value) {
+			continue
+		}
+		var name string
+		switch k := kv.Key.(type) {
+		case *ast.Ident: // a struct field
+			name = c.docName(lit, k)
+		case *ast.BasicLit: // a map key
+			if k.Kind == token.STRING {
+				name, _ = strconv.Unquote(k.Value)
+			}
+		}
+		if name == revisionField {
+			c.pass.Reportf(kv.Pos(), "Create fails for documents with a revision field set")
+		}
+	}
+}
+
+// docName returns the docstore name of the struct field key of lit.
+func (c *checker) docName(lit *ast.CompositeLit, key *ast.Ident) string {
+	v, ok := c.pass.TypesInfo.Uses[key].(*types.Var)
+	if !ok {
+		return ""
+	}
+	st, ok := c.pass.TypesInfo.TypeOf(lit).Underlying().(*types.Struct)
+	if !ok {
+		return ""
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		if st.Field(i) == v {
+			if name, _, _, _ := parseTag(reflect.StructTag(st.Tag(i))); name != "" {
+				return name
+			}
+		}
+	}
+	return v.Name()
+}
+
+func isNil(e ast.Expr) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == "nil"
+}
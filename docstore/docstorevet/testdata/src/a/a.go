@@ -0,0 +1,79 @@
+package a
+
+import (
+	"context"
+	"time"
+
+	"gocloud.dev/docstore"
+)
+
+// Tagged is a document because it has docstore tags.
+type Tagged struct {
+	Name  string             `docstore:"name"`
+	Count int                `docstore:"count,omitempty"`
+	Bad   int                `docstore:"bad,string"` // want `unknown docstore tag option "string"`
+	Same  string             `docstore:"name"`       // want `field Same has the same docstore name "name" as field Name`
+	Skip  chan int           `docstore:"-"`
+	JSON  map[float64]string `docstore:"json,json"`
+}
+
+// Inlined has fields that are flattened or not by tag options.
+type Inlined struct {
+	Name   string `docstore:"name"`
+	Inner  `docstore:",noinline"`
+	Flat   Point `docstore:",inline"`
+	Named  *Size `docstore:"named,inline"` // want `docstore tag option "inline" cannot be used with a name or the "json" option`
+	Scalar int   `docstore:",inline"`      // want `field Scalar has docstore tag option "inline", but its type int is not a struct`
+}
+
+type Point struct{ X, Y int }
+
+type Size struct{ W, H int }
+
+// Untagged is checked because it is passed to Put.
+type Untagged struct {
+	Ch         chan int           // want `field Ch has type chan int, which docstore cannot encode`
+	F          func()             // want `field F has type func\(\), which docstore cannot encode`
+	C          []complex128       // want `field C has type complex128, which docstore cannot encode`
+	M          map[float64]string // want `field M has map key type float64`
+	OK         map[int]*time.Time
+	T          time.Time
+	J          string `json:"j,string"` // want `json tag option "string" is not supported by docstore`
+	Nested     Inner
+	unexported chan int
+}
+
+type Inner struct {
+	Ch chan int // want `field Ch has type chan int, which docstore cannot encode`
+}
+
+// Revised has a revision field of the wrong type.
+type Revised struct {
+	Name             string `docstore:"name"`
+	DocstoreRevision int64  // want `revision field DocstoreRevision has type int64; it should be interface{}`
+}
+
+type Good struct {
+	Name             string `docstore:"name"`
+	DocstoreRevision interface{}
+}
+
+type Embedding struct {
+	Embedded
+	Name string `docstore:"name"`
+}
+
+type Embedded struct {
+	Ch chan bool // want `field Ch has type chan bool, which docstore cannot encode`
+}
+
+func f(ctx context.Context, coll *docstore.Collection) {
+	coll.Put(ctx, &Untagged{})
+	coll.Put(ctx, &Embedding{})
+	coll.Create(ctx, &Good{Name: "a", DocstoreRevision: 1}) // want `Create fails for documents with a revision field set`
+	coll.Create(ctx, &Good{Name: "a", DocstoreRevision: nil})
+	coll.Actions().Create(map[string]interface{}{"name": "a", "DocstoreRevision": "r"}) // want `Create fails for documents with a revision field set`
+	coll.Put(ctx, map[string]interface{}{"c": make(chan int)})
+	var g Good
+	coll.Query().Get(ctx).Next(ctx, &g)
+}
@@ -0,0 +1,28 @@
+package b
+
+import (
+	"context"
+
+	"gocloud.dev/docstore"
+)
+
+type Keyed struct {
+	ID string `docstore:"id"`
+}
+
+type Unkeyed struct { // want `document type Unkeyed has no key field \(id or Name\)`
+	Value string `docstore:"value"`
+}
+
+type Named struct {
+	Name string
+}
+
+type Other struct {
+	Value string
+}
+
+func f(ctx context.Context, coll *docstore.Collection) {
+	coll.Put(ctx, &Named{})
+	coll.Put(ctx, &Other{}) // want `document type Other has no key field \(id or Name\)`
+}
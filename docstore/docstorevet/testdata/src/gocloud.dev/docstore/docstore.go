@@ -0,0 +1,31 @@
+// Package docstore is a stub of gocloud.dev/docstore for the tests of
+// docstorevet.
+package docstore
+
+import "context"
+
+type Document = interface{}
+
+type Mods map[string]interface{}
+
+type Collection struct{}
+
+func (c *Collection) Create(ctx context.Context, doc Document) error             { return nil }
+func (c *Collection) Put(ctx context.Context, doc Document) error                { return nil }
+func (c *Collection) Get(ctx context.Context, doc Document, fps ...string) error { return nil }
+func (c *Collection) Update(ctx context.Context, doc Document, mods Mods) error  { return nil }
+func (c *Collection) Actions() *ActionList                                       { return nil }
+func (c *Collection) Query() *Query                                              { return nil }
+
+type ActionList struct{}
+
+func (l *ActionList) Create(doc Document) *ActionList { return l }
+func (l *ActionList) Put(doc Document) *ActionList    { return l }
+
+type Query struct{}
+
+func (q *Query) Get(ctx context.Context) *DocumentIterator { return nil }
+
+type DocumentIterator struct{}
+
+func (it *DocumentIterator) Next(ctx context.Context, dst Document) error { return nil }
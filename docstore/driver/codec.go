@@ -18,10 +18,13 @@
 package driver
 
 import (
+	"bytes"
 	"encoding"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"gocloud.dev/docstore/internal/fields"
@@ -34,6 +37,10 @@ var (
 	textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
 	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 	protoMessageType      = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	durationType          = reflect.TypeOf(time.Duration(0))
+
+	docstoreMarshalerType   = reflect.TypeOf((*DocstoreMarshaler)(nil)).Elem()
+	docstoreUnmarshalerType = reflect.TypeOf((*DocstoreUnmarshaler)(nil)).Elem()
 )
 
 // An Encoder encodes Go values in some other form (e.g. JSON, protocol buffers).
@@ -97,8 +104,16 @@ type Encoder interface {
 // Encode encodes the value using the given Encoder. It traverses the value,
 // iterating over arrays, slices, maps and the exported fields of structs. If it
 // encounters a non-nil pointer, it encodes the value that it points to.
+//
+// A time.Duration is encoded as its int64 number of nanoseconds with EncodeInt,
+// for every provider. Decode decodes the integer back into a time.Duration, but
+// decoding into an interface{} produces the integer.
+//
 // Encode treats a few interfaces specially:
 //
+// If the value implements DocstoreMarshaler, Encode invokes MarshalDocstore on
+// it and encodes the resulting value.
+//
 // If the value implements encoding.BinaryMarshaler, Encode invokes MarshalBinary
 // on it and encodes the resulting byte slice.
 //
@@ -108,6 +123,23 @@ type Encoder interface {
 // If the value implements proto.Message, Encode invokes proto.Marshal on it and encodes
 // the resulting byte slice. Here proto is the package "github.com/golang/protobuf/proto".
 //
+// As in encoding/json, these methods are also used when they have pointer
+// receivers and the value is addressable, such as a field of a struct passed by
+// pointer. A nil pointer is encoded as nil, without calling any method.
+//
+// A struct field with the "json" tag option, as in `docstore:"name,json"`, is
+// encoded as its encoding/json representation: Encode invokes json.Marshal on
+// the field, which calls its MarshalJSON method if it has one, and encodes the
+// resulting JSON value as a map, list, string, number, bool or nil. Use it for
+// types that implement json.Marshaler but not encoding.TextMarshaler.
+//
+// As in encoding/json, the fields of an embedded struct, or of a struct pointed
+// to by an embedded pointer, are encoded as fields of the struct that embeds
+// it, unless the embedded field has a name in its tag. The "inline" tag option
+// does the same for a named struct field, and the "noinline" option encodes an
+// embedded struct as a single field, named after its type unless the tag gives
+// a name.
+//
 // Not every map key type can be encoded. Only strings, integers (signed or
 // unsigned), and types that implement encoding.TextMarshaler are permitted as map
 // keys. These restrictions match exactly those of the encoding/json package.
@@ -120,36 +152,47 @@ func encode(v reflect.Value, enc Encoder) error {
 		enc.EncodeNil()
 		return nil
 	}
+	if v.Type() == durationType {
+		enc.EncodeInt(v.Int())
+		return nil
+	}
 	done, err := enc.EncodeSpecial(v)
 	if done {
 		return err
 	}
-	if v.Type().Implements(binaryMarshalerType) {
-		bytes, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		enc.EncodeNil()
+		return nil
+	}
+	if m, ok := implementation(v, docstoreMarshalerType); ok {
+		x, err := m.(DocstoreMarshaler).MarshalDocstore()
+		if err != nil {
+			return err
+		}
+		return encode(reflect.ValueOf(x), enc)
+	}
+	if m, ok := implementation(v, binaryMarshalerType); ok {
+		b, err := m.(encoding.BinaryMarshaler).MarshalBinary()
 		if err != nil {
 			return err
 		}
-		enc.EncodeBytes(bytes)
+		enc.EncodeBytes(b)
 		return nil
 	}
-	if v.Type().Implements(protoMessageType) {
-		if v.IsNil() {
-			enc.EncodeNil()
-		} else {
-			bytes, err := proto.Marshal(v.Interface().(proto.Message))
-			if err != nil {
-				return err
-			}
-			enc.EncodeBytes(bytes)
+	if m, ok := implementation(v, protoMessageType); ok {
+		b, err := proto.Marshal(m.(proto.Message))
+		if err != nil {
+			return err
 		}
+		enc.EncodeBytes(b)
 		return nil
 	}
-	if v.Type().Implements(textMarshalerType) {
-		bytes, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+	if m, ok := implementation(v, textMarshalerType); ok {
+		b, err := m.(encoding.TextMarshaler).MarshalText()
 		if err != nil {
 			return err
 		}
-		enc.EncodeString(string(bytes))
+		enc.EncodeString(string(b))
 		return nil
 	}
 	switch v.Kind() {
@@ -174,10 +217,6 @@ func encode(v reflect.Value, enc Encoder) error {
 	case reflect.Map:
 		return encodeMap(v, enc)
 	case reflect.Ptr:
-		if v.IsNil() {
-			enc.EncodeNil()
-			return nil
-		}
 		return encode(v.Elem(), enc)
 	case reflect.Interface:
 		if v.IsNil() {
@@ -199,6 +238,56 @@ func encode(v reflect.Value, enc Encoder) error {
 	return nil
 }
 
+// implementation returns the value of v, or its address, that implements the
+// interface type t, and whether there is one. As in encoding/json, the methods
+// of *T are used for a value of type T only if the value is addressable.
+func implementation(v reflect.Value, t reflect.Type) (interface{}, bool) {
+	if v.Type().Implements(t) {
+		return v.Interface(), true
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(v.Type()).Implements(t) {
+		return v.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+// encodeJSON encodes v as the value that json.Marshal produces for it.
+func encodeJSON(v reflect.Value, enc Encoder) error {
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var x interface{}
+	if err := dec.Decode(&x); err != nil {
+		return err
+	}
+	return encode(reflect.ValueOf(fromJSONNumbers(x)), enc)
+}
+
+// fromJSONNumbers replaces the json.Numbers in x, a value decoded from JSON, with
+// int64s if they are integers that fit, and float64s otherwise.
+func fromJSONNumbers(x interface{}) interface{} {
+	switch x := x.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		for i, e := range x {
+			x[i] = fromJSONNumbers(e)
+		}
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = fromJSONNumbers(e)
+		}
+	}
+	return x
+}
+
 // Encode an array or non-nil slice.
 func encodeList(v reflect.Value, enc Encoder) error {
 	// Byte slices encode specially.
@@ -273,10 +362,15 @@ func encodeStructWithFields(v reflect.Value, fields fields.List, e Encoder) erro
 			// struct value. So we just ignore it.
 			continue
 		}
-		if f.ParsedTag.(tagOptions).omitEmpty && IsEmptyValue(fv) {
+		opts := f.ParsedTag.(tagOptions)
+		if opts.omitEmpty && IsEmptyValue(fv) {
 			continue
 		}
-		if err := encode(fv, e2); err != nil {
+		encodeField := encode
+		if opts.json {
+			encodeField = encodeJSON
+		}
+		if err := encodeField(fv, e2); err != nil {
 			return err
 		}
 		e2.MapKey(f.Name)
@@ -361,8 +455,9 @@ type Decoder interface {
 
 // Decode decodes the value held in the Decoder d into v.
 // Decode creates slices, maps and pointer elements as needed.
-// It treats values that implement encoding.BinaryUnmarshaler, encoding.TextUnmarshaler
-// and proto.Message specially; see Encode.
+// It treats values that implement DocstoreUnmarshaler, encoding.BinaryUnmarshaler,
+// encoding.TextUnmarshaler and proto.Message specially, and decodes struct fields with the "json" tag
+// option by invoking json.Unmarshal; see Encode.
 func Decode(v reflect.Value, d Decoder) error {
 	return wrap(decode(v, d), gcerr.InvalidArgument)
 }
@@ -383,15 +478,22 @@ func decode(v reflect.Value, d Decoder) error {
 		}
 	}
 
-	if done, val, err := d.AsSpecial(v); done {
-		if err != nil {
-			return err
+	// A duration is decoded as an integer, below, without giving the Decoder a
+	// chance to treat it specially.
+	if v.Type() != durationType {
+		if done, val, err := d.AsSpecial(v); done {
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(val))
+			return nil
 		}
-		v.Set(reflect.ValueOf(val))
-		return nil
 	}
 
 	// Handle implemented interfaces first.
+	if reflect.PtrTo(v.Type()).Implements(docstoreUnmarshalerType) {
+		return v.Addr().Interface().(DocstoreUnmarshaler).UnmarshalDocstore(decodeFunc(d))
+	}
 	if reflect.PtrTo(v.Type()).Implements(binaryUnmarshalerType) {
 		if b, ok := d.AsBytes(); ok {
 			return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
@@ -650,7 +752,7 @@ func unstringifyMapKey(key string, keyType reflect.Type) (reflect.Value, error)
 }
 
 func decodeStruct(v reflect.Value, d Decoder) error {
-	fields, err := fieldCache.Fields(v.Type())
+	desc, err := descriptorOf(v.Type())
 	if err != nil {
 		return err
 	}
@@ -658,7 +760,7 @@ func decodeStruct(v reflect.Value, d Decoder) error {
 		if err != nil {
 			return false
 		}
-		f := fields.Match(key)
+		f := desc.match(key)
 		if f == nil {
 			err = gcerr.Newf(gcerr.InvalidArgument, nil, "no field matching %q in %s", key, v.Type())
 			return false
@@ -670,12 +772,30 @@ func decodeStruct(v reflect.Value, d Decoder) error {
 				key, v.Type())
 			return false
 		}
-		err = decode(fv, d2)
+		if f.ParsedTag.(tagOptions).json {
+			err = decodeJSON(fv, d2)
+		} else {
+			err = decode(fv, d2)
+		}
 		return err == nil
 	})
 	return err
 }
 
+// decodeJSON decodes a value encoded by encodeJSON into v, by invoking
+// json.Unmarshal on its JSON representation.
+func decodeJSON(v reflect.Value, d Decoder) error {
+	x, err := d.AsInterface()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v.Addr().Interface())
+}
+
 // fieldByIndexCreate retrieves the the field of v at the given index if present,
 // creating embedded struct pointers where necessary.
 // v must be a struct. index must refer to a valid field of v's type.
@@ -735,9 +855,14 @@ func IsEmptyValue(v reflect.Value) bool {
 
 // Options for struct tags.
 type tagOptions struct {
-	omitEmpty bool // do not encode value if empty
+	omitEmpty bool             // do not encode value if empty
+	json      bool             // encode value as its encoding/json representation
+	embedding fields.Embedding // whether the fields of a struct value are promoted
 }
 
+// Embedding implements fields.EmbeddingTag.
+func (o tagOptions) Embedding() fields.Embedding { return o.embedding }
+
 // parseTag interprets docstore struct field tags.
 func parseTag(t reflect.StructTag) (name string, keep bool, other interface{}, err error) {
 	var opts []string
@@ -751,9 +876,19 @@ func parseTag(t reflect.StructTag) (name string, keep bool, other interface{}, e
 		switch opt {
 		case "omitempty":
 			tagOpts.omitEmpty = true
+		case "json":
+			tagOpts.json = true
+		case "inline":
+			tagOpts.embedding = fields.Inline
+		case "noinline":
+			tagOpts.embedding = fields.NoInline
 		default:
 			return "", false, nil, gcerr.Newf(gcerr.InvalidArgument, nil, "unknown tag option: %q", opt)
 		}
 	}
+	if tagOpts.embedding == fields.Inline && (name != "" || tagOpts.json) {
+		// The field has no name or encoding of its own.
+		return "", false, nil, gcerr.Newf(gcerr.InvalidArgument, nil, "tag option \"inline\" cannot be used with a name or the \"json\" option")
+	}
 	return name, keep, tagOpts, nil
 }
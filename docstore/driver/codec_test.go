@@ -15,6 +15,7 @@
 package driver
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -110,6 +111,7 @@ func TestEncode(t *testing.T) {
 		{nullptr, nil},
 		{seven, int64(seven)},
 		{&seven, int64(seven)},
+		{90*time.Second + 5, int64(90e9 + 5)},
 		{[]byte{1, 2}, []byte{1, 2}},
 		{[2]byte{3, 4}, []interface{}{uint64(3), uint64(4)}},
 		{[]int(nil), nil},
@@ -209,6 +211,136 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+// ptrText implements encoding.TextMarshaler with a pointer receiver.
+type ptrText struct{ S string }
+
+func (p *ptrText) MarshalText() ([]byte, error) { return []byte(p.S), nil }
+func (p *ptrText) UnmarshalText(b []byte) error { p.S = string(b); return nil }
+
+// color implements json.Marshaler, but not encoding.TextMarshaler.
+type color int
+
+var colorNames = []string{"red", "green"}
+
+func (c color) MarshalJSON() ([]byte, error) { return json.Marshal(colorNames[c]) }
+
+func (c *color) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for i, n := range colorNames {
+		if n == s {
+			*c = color(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown color %q", s)
+}
+
+type marshalers struct {
+	P      ptrText
+	NilTE  *te
+	Color  color          `docstore:"color,json"`
+	Colors []color        `docstore:"colors,json"`
+	Counts map[string]int `docstore:"counts,json"`
+	NilPtr *color         `docstore:"nilptr,json"`
+}
+
+func TestMarshalers(t *testing.T) {
+	in := &marshalers{
+		P:      ptrText{"p"},
+		Color:  1,
+		Colors: []color{1, 0},
+		Counts: map[string]int{"a": 1},
+	}
+	want := map[string]interface{}{
+		"P":      "p",
+		"NilTE":  nil,
+		"color":  "green",
+		"colors": []interface{}{"green", "red"},
+		"counts": map[string]interface{}{"a": int64(1)},
+		"nilptr": nil,
+	}
+	enc := &testEncoder{}
+	if err := Encode(reflect.ValueOf(in), enc); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(enc.val, want); diff != "" {
+		t.Fatalf("Encode (got=-, want=+):\n%s", diff)
+	}
+
+	got := &marshalers{NilPtr: new(color)}
+	if err := Decode(reflect.ValueOf(got).Elem(), testDecoder{enc.val}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, in); diff != "" {
+		t.Errorf("Decode (got=-, want=+):\n%s", diff)
+	}
+
+	// A value that json.Unmarshal rejects is an error.
+	bad := map[string]interface{}{"color": "blue"}
+	if err := Decode(reflect.ValueOf(got).Elem(), testDecoder{bad}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("Decode of a bad color: got %v, want InvalidArgument", err)
+	}
+}
+
+type Inner struct{ A, B int }
+
+type embeddings struct {
+	Inner  `docstore:",noinline"`
+	Embed1         // flattened by default
+	N      Inner   `docstore:",inline"`
+	P      *Embed2 `docstore:",inline"`
+}
+
+func TestEmbeddingOptions(t *testing.T) {
+	in := &embeddings{
+		Inner:  Inner{A: 1, B: 2},
+		Embed1: Embed1{E1: "e1"},
+		N:      Inner{A: 3, B: 4},
+		P:      &Embed2{E2: "e2"},
+	}
+	want := map[string]interface{}{
+		"Inner": map[string]interface{}{"A": int64(1), "B": int64(2)},
+		"E1":    "e1",
+		"A":     int64(3),
+		"B":     int64(4),
+		"E2":    "e2",
+	}
+	enc := &testEncoder{}
+	if err := Encode(reflect.ValueOf(in), enc); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(enc.val, want); diff != "" {
+		t.Fatalf("Encode (got=-, want=+):\n%s", diff)
+	}
+	got := &embeddings{}
+	if err := Decode(reflect.ValueOf(got).Elem(), testDecoder{enc.val}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, in); diff != "" {
+		t.Errorf("Decode (got=-, want=+):\n%s", diff)
+	}
+
+	for _, bad := range []interface{}{
+		struct {
+			N Inner `docstore:"n,inline"`
+		}{},
+		struct {
+			N Inner `docstore:",inline,json"`
+		}{},
+		struct {
+			X int `docstore:",inline"`
+		}{},
+	} {
+		err := Encode(reflect.ValueOf(bad), &testEncoder{})
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%T: got %v, want InvalidArgument", bad, err)
+		}
+	}
+}
+
 type badBinaryMarshaler struct{}
 
 func (badBinaryMarshaler) MarshalBinary() ([]byte, error) { return nil, errors.New("bad") }
@@ -322,6 +454,8 @@ func TestDecode(t *testing.T) {
 	}{
 		{new(interface{}), nil, nil},
 		{new(int), int64(7), int(7)},
+		{new(time.Duration), int64(90e9 + 5), 90*time.Second + 5},
+		{new(time.Duration), float64(2e9), 2 * time.Second},
 		{new(uint8), uint64(250), uint8(250)},
 		{new(bool), true, true},
 		{new(string), "x", "x"},
@@ -0,0 +1,113 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"gocloud.dev/docstore/internal/fields"
+)
+
+// A structDescriptor describes a struct type for Documents and the codec: its
+// fields, and maps from names to them.
+//
+// Looking up a field by name with fields.List.Match compares the name with
+// every field in turn, folding case for each. The maps make a lookup a single
+// map access, or two for a name that differs from the field's in case.
+type structDescriptor struct {
+	fields fields.List
+	exact  map[string]*fields.Field // by name
+	folded map[string]*fields.Field // by foldName of the name
+}
+
+// descriptors maps a reflect.Type to its *structDescriptor.
+var descriptors sync.Map
+
+// descriptorOf returns the descriptor of the struct type t, which is computed
+// once per type.
+func descriptorOf(t reflect.Type) (*structDescriptor, error) {
+	if d, ok := descriptors.Load(t); ok {
+		return d.(*structDescriptor), nil
+	}
+	fs, err := fieldCache.Fields(t)
+	if err != nil {
+		// Don't cache the error; fieldCache already does.
+		return nil, err
+	}
+	d := &structDescriptor{
+		fields: fs,
+		exact:  make(map[string]*fields.Field, len(fs)),
+		folded: make(map[string]*fields.Field, len(fs)),
+	}
+	for i := range fs {
+		f := &fs[i]
+		if _, ok := d.exact[f.Name]; !ok {
+			d.exact[f.Name] = f
+		}
+		// Like Match, prefer the first field whose name folds to the same key.
+		k := foldName(f.Name)
+		if _, ok := d.folded[k]; !ok {
+			d.folded[k] = f
+		}
+	}
+	// If another goroutine stored a descriptor first, use it instead.
+	actual, _ := descriptors.LoadOrStore(t, d)
+	return actual.(*structDescriptor), nil
+}
+
+// match returns the field whose name best matches name, as fields.List.Match
+// does: a field with exactly that name, or else the first one whose name is
+// equal to it under Unicode case folding. It returns nil if there is none.
+func (d *structDescriptor) match(name string) *fields.Field {
+	if f, ok := d.exact[name]; ok {
+		return f
+	}
+	return d.folded[foldName(name)]
+}
+
+// foldName returns a key for s under simple Unicode case folding: two strings
+// have the same key if and only if strings.EqualFold reports they are equal.
+// Each rune is replaced by the smallest rune it folds to, which for ASCII
+// letters is the upper-case letter.
+func foldName(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		// 'k' and 's' also fold to non-ASCII runes, but those are larger than 'K'
+		// and 'S'.
+		return strings.ToUpper(s)
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		b.WriteRune(min)
+	}
+	return b.String()
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// wide is a struct with enough fields that a linear search for a name is
+// noticeably slower than a map lookup.
+type wide struct {
+	ID          string
+	Name        string
+	Description string
+	Owner       string
+	Kind        string `docstore:"kind"`
+	Created     int64
+	Updated     int64
+	Count       int
+	Score       float64
+	Enabled     bool
+	Tags        []string
+	Attrs       map[string]interface{}
+	Parent      string
+	Region      string
+	Zone        string
+	Status      string `docstore:"status"`
+}
+
+func TestDescriptorMatch(t *testing.T) {
+	type T struct {
+		Name   int
+		NAME   int
+		Kelvin int `docstore:"K"` // KELVIN SIGN, which folds to 'k'
+		Straße int
+		Sun    int `docstore:"ſun"` // LATIN SMALL LETTER LONG S, which folds to 's'
+	}
+	for _, typ := range []reflect.Type{reflect.TypeOf(T{}), reflect.TypeOf(wide{})} {
+		fs, err := fieldCache.Fields(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := descriptorOf(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range fs {
+			names = append(names, f.Name, strings.ToLower(f.Name), strings.ToUpper(f.Name), f.Name+"x")
+		}
+		names = append(names, "k", "K", "sun", "SUN", "STRASSE", "straSSe", "straße", "", "missing")
+		for _, name := range names {
+			want := fs.Match(name)
+			got := d.match(name)
+			if got != want {
+				t.Errorf("%s: match(%q) = %v, want %v", typ, name, got, want)
+			}
+		}
+	}
+}
+
+func TestDescriptorOfCaches(t *testing.T) {
+	typ := reflect.TypeOf(wide{})
+	d1, err := descriptorOf(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := descriptorOf(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 != d2 {
+		t.Error("got different descriptors for the same type")
+	}
+}
+
+func BenchmarkStructFieldLookup(b *testing.B) {
+	typ := reflect.TypeOf(wide{})
+	// The last field, found after scanning all the others, and a name that
+	// differs from it in case.
+	for _, name := range []string{"status", "STATUS"} {
+		b.Run("Match/"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				fs, err := fieldCache.Fields(typ)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if fs.Match(name) == nil {
+					b.Fatal("no match")
+				}
+			}
+		})
+		b.Run("descriptor/"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d, err := descriptorOf(typ)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if d.match(name) == nil {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetField(b *testing.B) {
+	doc, err := NewDocument(&wide{Status: "ok"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := doc.GetField("status"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetField(b *testing.B) {
+	doc, err := NewDocument(&wide{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := doc.SetField("status", "ok"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeStruct(b *testing.B) {
+	m := map[string]interface{}{
+		"ID": "1", "Name": "n", "Description": "d", "Owner": "o", "kind": "k",
+		"Created": int64(1), "Updated": int64(2), "Count": 3, "Score": 4.5, "Enabled": true,
+		"Parent": "p", "Region": "r", "Zone": "z", "status": "s",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var w wide
+		doc, err := NewDocument(&w)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := doc.Decode(testDecoder{m}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
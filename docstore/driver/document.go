@@ -17,7 +17,6 @@ package driver
 import (
 	"reflect"
 
-	"gocloud.dev/docstore/internal/fields"
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/internal/gcerr"
 )
@@ -28,7 +27,7 @@ type Document struct {
 	Origin interface{}            // the argument to NewDocument
 	m      map[string]interface{} // nil if it's a *struct
 	s      reflect.Value          // the struct reflected
-	fields fields.List            // for structs
+	desc   *structDescriptor      // for structs
 }
 
 // Create a new document from doc, which must be a non-nil map[string]interface{} or struct pointer.
@@ -51,11 +50,11 @@ func NewDocument(doc interface{}) (Document, error) {
 	if v.IsNil() {
 		return Document{}, gcerr.Newf(gcerr.InvalidArgument, nil, "document struct pointer cannot be nil")
 	}
-	fields, err := fieldCache.Fields(t)
+	desc, err := descriptorOf(t)
 	if err != nil {
 		return Document{}, err
 	}
-	return Document{Origin: doc, s: v.Elem(), fields: fields}, nil
+	return Document{Origin: doc, s: v.Elem(), desc: desc}, nil
 }
 
 // GetField returns the value of the named document field.
@@ -110,7 +109,7 @@ func (d Document) Get(fp []string) (interface{}, error) {
 }
 
 func (d Document) structField(name string) (reflect.Value, error) {
-	f := d.fields.Match(name)
+	f := d.desc.match(name)
 	if f == nil {
 		return reflect.Value{}, gcerr.Newf(gcerr.NotFound, nil, "field %q not found in struct type %s", name, d.s.Type())
 	}
@@ -150,12 +149,69 @@ func (d Document) SetField(field string, value interface{}) error {
 	return nil
 }
 
+// ClearField removes the field from the document. Map fields are deleted; struct
+// fields are set to their zero value. It is not an error if a struct has no such
+// field.
+func (d Document) ClearField(field string) error {
+	if d.m != nil {
+		delete(d.m, field)
+		return nil
+	}
+	if d.desc.match(field) == nil {
+		return nil
+	}
+	v, err := d.structField(field)
+	if err != nil {
+		return err
+	}
+	if !v.CanSet() {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot clear field %s in struct of type %s: not addressable",
+			field, d.s.Type())
+	}
+	v.Set(reflect.Zero(v.Type()))
+	return nil
+}
+
+// Clear removes the value at the field path from the document, as ClearField
+// does for a single field. Nested structs are cleared in place. It is not an
+// error if the document has nothing at the field path.
+func (d Document) Clear(fp []string) error {
+	if len(fp) == 1 {
+		return d.ClearField(fp[0])
+	}
+	var x interface{}
+	if d.m != nil {
+		var ok bool
+		if x, ok = d.m[fp[0]]; !ok {
+			return nil
+		}
+	} else {
+		if d.desc.match(fp[0]) == nil {
+			return nil
+		}
+		v, err := d.structField(fp[0])
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Struct && v.CanAddr() {
+			v = v.Addr()
+		}
+		x = v.Interface()
+	}
+	d2, err := NewDocument(x)
+	if err != nil {
+		// The value is not a document, so nothing is under it.
+		return nil
+	}
+	return d2.Clear(fp[1:])
+}
+
 // Encode encodes the document using the given Encoder.
 func (d Document) Encode(e Encoder) error {
 	if d.m != nil {
 		return encodeMap(reflect.ValueOf(d.m), e)
 	}
-	return encodeStructWithFields(d.s, d.fields, e)
+	return encodeStructWithFields(d.s, d.desc.fields, e)
 }
 
 // Decode decodes the document using the given Decoder.
@@ -42,6 +42,11 @@ type Collection interface {
 	// If the empty string is returned, docstore.RevisionField will be used.
 	RevisionField() string
 
+	// MaxDocumentSize returns the largest document, in bytes, that the provider
+	// accepts, or 0 if there is no limit. The docstore package compares it with an
+	// estimate of each document's size (see EstimateSize) before calling RunActions.
+	MaxDocumentSize() int
+
 	// RunActions executes a slice of actions.
 	//
 	// If unordered is false, it must appear as if the actions were executed in the
@@ -56,6 +61,13 @@ type Collection interface {
 	// opts controls the behavior of RunActions and is guaranteed to be non-nil.
 	RunActions(ctx context.Context, actions []*Action, opts *RunActionsOptions) ActionListError
 
+	// SupportsFilter reports whether the driver can evaluate the filter as part of
+	// a query. Filters for which SupportsFilter returns false are removed from the
+	// Query before it is passed to RunGetQuery, RunDeleteQuery, RunUpdateQuery or
+	// QueryPlan, and the docstore package evaluates them on the documents that the
+	// driver returns.
+	SupportsFilter(Filter) bool
+
 	// RunGetQuery executes a Query.
 	//
 	// Implementations can choose to execute the Query as one single request or
@@ -69,7 +81,7 @@ type Collection interface {
 	RunUpdateQuery(context.Context, *Query, []Mod) error
 
 	// QueryPlan returns the plan for the query.
-	QueryPlan(*Query) (string, error)
+	QueryPlan(*Query) (*QueryPlan, error)
 
 	// As converts i to provider-specific types.
 	// See https://gocloud.dev/concepts/as/ for background information.
@@ -91,6 +103,47 @@ type Collection interface {
 	Close() error
 }
 
+// OrderBySupporter is an optional interface for Collections that cannot sort
+// the results of every query, such as those that can only sort with the help
+// of an index. Collections that do not implement it must sort the results of
+// every query with an OrderByField.
+type OrderBySupporter interface {
+	// SupportsOrderBy reports whether the collection can return the results of
+	// q, which has an OrderByField, in order. If it returns false and the user
+	// allows it, the docstore package sorts the results of the query without the
+	// OrderByField instead.
+	SupportsOrderBy(q *Query) bool
+}
+
+// ChangeReporter is an optional interface for Collections that can report the
+// values that an Update action changed, without a separate read. The docstore
+// package fails Update actions that ask for changes with Unimplemented if the
+// Collection does not implement it, or if ReportsChanges returns false.
+type ChangeReporter interface {
+	// ReportsChanges reports whether the collection sets Action.Changes for
+	// Update actions with ReportChanges set.
+	ReportsChanges() bool
+}
+
+// ActionLimiter is an optional interface for Collections whose service limits
+// the number of actions that can be run together, for instance because they are
+// sent in a single batch or transaction. The docstore package splits longer
+// action lists into several calls to RunActions, run one after the other.
+type ActionLimiter interface {
+	// MaxActions returns the largest number of actions that RunActions can be
+	// passed, or 0 if there is no limit.
+	MaxActions() int
+}
+
+// InternalFieldLister is an optional interface for Collections whose provider
+// adds fields to the documents it returns for its own bookkeeping.
+type InternalFieldLister interface {
+	// InternalFields returns the names of the top-level fields, other than the
+	// revision field, that the provider adds to the documents it returns. They
+	// are removed by docstore.Collection.CleanDocument.
+	InternalFields() []string
+}
+
 // ActionKind describes the type of an action.
 type ActionKind int
 
@@ -113,6 +166,34 @@ type Action struct {
 	FieldPaths [][]string  // field paths to retrieve, for Get only
 	Mods       []Mod       // modifications to make, for Update only
 	Index      int         // the index of the action in the original action list
+
+	// Conditions that the stored document must satisfy for a write other than
+	// Create to succeed, combined with AND. If the document does not exist or
+	// does not satisfy them, the action should fail with FailedPrecondition,
+	// except that a Delete of a missing document succeeds.
+	Conditions []Filter
+
+	// ReportChanges, set only on Update actions and only for Collections that
+	// implement ChangeReporter, asks the driver to set Changes when the action
+	// succeeds.
+	ReportChanges bool
+
+	// Changes is set by the driver to the old and new values of the field path
+	// of each of Mods, if ReportChanges is true and the action succeeds.
+	Changes []Change
+
+	// KeyGenerator, set only on Create actions, generates the key of a document
+	// created without one. If it is nil, the driver generates the key in its
+	// own way. Drivers that use strings as keys can call GenerateKey.
+	KeyGenerator func() string
+}
+
+// A Change is the value at a field path of a document before and after an
+// Update. Old is nil if the field did not exist, and New is nil if the
+// Update deleted it.
+type Change struct {
+	FieldPath []string
+	Old, New  interface{}
 }
 
 // A Mod is a modification to a field path in a document.
@@ -158,6 +239,15 @@ type RunActionsOptions struct {
 	// or group of the underlying provider's actions is executed. asFunc allows
 	// providers to expose provider-specific types.
 	BeforeDo func(asFunc func(interface{}) bool) error
+
+	// FailFast, if true, asks RunActions to stop after the first failure instead of
+	// attempting every action. RunActions must not start any action after it learns
+	// that an earlier one has failed, though actions that are already in progress,
+	// such as the rest of a batch sent in a single RPC, may complete. Skipped
+	// actions are reported with the error set by SkipActions.
+	//
+	// If FailFast is false, RunActions attempts every action, however many fail.
+	FailFast bool
 }
 
 // A Query defines a query operation to find documents within a collection based
@@ -191,13 +281,76 @@ type Query struct {
 // A Filter defines a filter expression used to filter the query result.
 // If the value is a number type, the filter uses numeric comparison.
 // If the value is a string type, the filter uses UTF-8 string comparison.
+// If the value is a bool, the operation is always EqualOp.
+// If the operation is ExistsOp or NotExistsOp, the value is nil.
+// If the operation is HasPrefixOp, EqualFoldOp or HasPrefixFoldOp, the value is
+// a string.
+//
+// The field path may have more than one component, denoting a field in a nested
+// map or struct: []string{"m", "a"} refers to field "a" of the value at field
+// "m". If any component along the path is missing or is not a map or struct, the
+// filter is false, except that NotExistsOp is true.
 // TODO(#1762): support comparison of other types.
 type Filter struct {
 	FieldPath []string    // the field path to filter
-	Op        string      // the operation, supports =, >, >=, <, <=
+	Op        string      // the operation, supports =, >, >=, <, <= and the Op constants below
 	Value     interface{} // the value to compare using the operation
 }
 
+// A QueryPlan describes how a driver will execute a query.
+type QueryPlan struct {
+	// Description is a short, provider-specific summary of the plan, suitable for
+	// display.
+	Description string
+
+	// Index is the name of the index used to satisfy the query, or the empty string
+	// if no secondary index is used or the driver cannot tell.
+	Index string
+
+	// Scan describes which documents are examined to execute the query.
+	Scan ScanKind
+
+	// ServerFilters are the filters that are evaluated by the provider service.
+	ServerFilters []Filter
+
+	// ClientFilters are the filters that are evaluated by the client after
+	// documents have been retrieved from the service.
+	ClientFilters []Filter
+
+	// EstimatedScan is the estimated number of documents that will be examined to
+	// execute the query. Zero means the driver cannot provide an estimate.
+	EstimatedScan int64
+}
+
+// ScanKind describes which documents a query examines.
+type ScanKind int
+
+const (
+	// ScanUnknown means the driver cannot tell which documents will be examined,
+	// because the service chooses how to execute the query.
+	ScanUnknown ScanKind = iota
+	// ScanFull means every document in the collection is examined.
+	ScanFull
+	// ScanRange means only the documents in a range of the primary key or of an
+	// index are examined.
+	ScanRange
+	// ScanLookup means the documents are read directly by their keys.
+	ScanLookup
+)
+
+func (k ScanKind) String() string {
+	switch k {
+	case ScanFull:
+		return "full"
+	case ScanRange:
+		return "range"
+	case ScanLookup:
+		return "lookup"
+	default:
+		return "unknown"
+	}
+}
+
 // A DocumentIterator iterates through the results (for Get action).
 type DocumentIterator interface {
 
@@ -219,3 +372,28 @@ type DocumentIterator interface {
 // EqualOp is the name of the equality operator.
 // It is defined here to avoid confusion between "=" and "==".
 const EqualOp = "="
+
+const (
+	// ExistsOp is the operator of a filter that is true of documents that have a
+	// value, possibly nil, at the filter's field path.
+	ExistsOp = "exists"
+
+	// NotExistsOp is the operator of a filter that is true of documents that have
+	// no value at the filter's field path.
+	NotExistsOp = "not-exists"
+
+	// HasPrefixOp is the operator of a filter that is true of documents whose
+	// value at the filter's field path is a string that begins with the filter's
+	// value.
+	HasPrefixOp = "has-prefix"
+
+	// EqualFoldOp is the operator of a filter that is true of documents whose
+	// value at the filter's field path is a string equal to the filter's value
+	// under Unicode case folding, as with strings.EqualFold.
+	EqualFoldOp = "equal-fold"
+
+	// HasPrefixFoldOp is the operator of a filter that is true of documents whose
+	// value at the filter's field path is a string that begins with the filter's
+	// value under Unicode case folding.
+	HasPrefixFoldOp = "has-prefix-fold"
+)
@@ -0,0 +1,62 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// DocstoreMarshaler is implemented by types whose values are stored as the
+// values of another type, such as a decimal type that is stored as a string.
+type DocstoreMarshaler interface {
+	// MarshalDocstore returns the value to store in place of the receiver. The
+	// value must not itself be of a type that implements DocstoreMarshaler.
+	MarshalDocstore() (interface{}, error)
+}
+
+// DocstoreUnmarshaler is implemented by types that decode themselves from a
+// value stored by their MarshalDocstore method.
+type DocstoreUnmarshaler interface {
+	// UnmarshalDocstore sets the receiver from a stored value. It should call
+	// decode with a pointer to a variable of the type that MarshalDocstore
+	// returns, and decode sets the variable to the stored value.
+	UnmarshalDocstore(decode func(interface{}) error) error
+}
+
+// decodeFunc returns the function that decode passes to UnmarshalDocstore to
+// decode d.
+func decodeFunc(d Decoder) func(interface{}) error {
+	return func(p interface{}) error {
+		v := reflect.ValueOf(p)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return fmt.Errorf("UnmarshalDocstore: decode needs a non-nil pointer, got %T", p)
+		}
+		return decode(v.Elem(), d)
+	}
+}
+
+// Convert returns the value that Encode encodes in place of x: the result of
+// x.MarshalDocstore if x implements DocstoreMarshaler, or x itself otherwise.
+func Convert(x interface{}) (interface{}, error) {
+	m, ok := x.(DocstoreMarshaler)
+	if !ok {
+		return x, nil
+	}
+	if v := reflect.ValueOf(x); v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, nil
+	}
+	return m.MarshalDocstore()
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/gcerrors"
+)
+
+// money is a type with unexported fields, which docstore cannot encode
+// without its MarshalDocstore method.
+type money struct{ units, cents int64 }
+
+func (m money) MarshalDocstore() (interface{}, error) {
+	return fmt.Sprintf("%d.%02d", m.units, m.cents), nil
+}
+
+func (m *money) UnmarshalDocstore(decode func(interface{}) error) error {
+	var s string
+	if err := decode(&s); err != nil {
+		return err
+	}
+	_, err := fmt.Sscanf(s, "%d.%d", &m.units, &m.cents)
+	return err
+}
+
+type withMoney struct {
+	Price  money
+	Ptr    *money
+	Prices []money
+	ByName map[string]money
+}
+
+func TestDocstoreMarshaler(t *testing.T) {
+	in := &withMoney{
+		Price:  money{1, 50},
+		Ptr:    &money{2, 5},
+		Prices: []money{{3, 0}},
+		ByName: map[string]money{"a": {4, 99}},
+	}
+	want := map[string]interface{}{
+		"Price":  "1.50",
+		"Ptr":    "2.05",
+		"Prices": []interface{}{"3.00"},
+		"ByName": map[string]interface{}{"a": "4.99"},
+	}
+	enc := &testEncoder{}
+	if err := Encode(reflect.ValueOf(in), enc); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(enc.val, want); diff != "" {
+		t.Fatalf("Encode (got=-, want=+):\n%s", diff)
+	}
+
+	var got withMoney
+	if err := Decode(reflect.ValueOf(&got).Elem(), testDecoder{enc.val}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&got, in, cmp.AllowUnexported(money{})); diff != "" {
+		t.Errorf("Decode (got=-, want=+):\n%s", diff)
+	}
+
+	// An error from UnmarshalDocstore is an InvalidArgument error.
+	for _, bad := range []map[string]interface{}{{"Price": "x"}, {"Price": 1}} {
+		if err := Decode(reflect.ValueOf(&got).Elem(), testDecoder{bad}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("Decode of %v: got %v, want InvalidArgument", bad, err)
+		}
+	}
+
+	c, err := Convert(money{5, 1})
+	if err != nil || c != "5.01" {
+		t.Errorf("Convert: got %v, %v; want 5.01", c, err)
+	}
+	if c, err := Convert((*money)(nil)); err != nil || c != nil {
+		t.Errorf("Convert of a nil pointer: got %v, %v; want nil", c, err)
+	}
+	if c, err := Convert(5); err != nil || c != 5 {
+		t.Errorf("Convert of a value without MarshalDocstore: got %v, %v; want 5", c, err)
+	}
+}
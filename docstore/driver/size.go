@@ -0,0 +1,112 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"time"
+)
+
+// EstimateSize returns an estimate of the encoded size of doc in bytes, along with
+// the estimated size of each of its top-level fields.
+//
+// The estimate follows the rules that most providers use to compute document
+// size: a field counts the length of its name plus the size of its value; strings
+// and byte slices count their length; numbers and times count 8 bytes; booleans
+// and nils count 1 byte; lists and maps count the sum of their elements. Providers
+// add their own overhead, so the estimate is a lower bound on the stored size.
+func EstimateSize(doc Document) (int, map[string]int, error) {
+	e := &sizeEncoder{isDoc: true}
+	if err := doc.Encode(e); err != nil {
+		return 0, nil, err
+	}
+	if e.child == nil {
+		return 0, nil, nil
+	}
+	return e.child.total, e.child.fields, nil
+}
+
+// EstimateValueSize returns an estimate, using the rules of EstimateSize, of the
+// encoded size of the Go value v.
+func EstimateValueSize(v interface{}) (int, error) {
+	e := &sizeEncoder{}
+	if err := Encode(reflect.ValueOf(v), e); err != nil {
+		return 0, err
+	}
+	return e.size(), nil
+}
+
+// sizeEncoder is an Encoder that computes sizes instead of encoding values.
+type sizeEncoder struct {
+	isDoc  bool           // this encoder is for the document itself
+	val    int            // the size of the scalar value most recently encoded
+	child  *sizeEncoder   // the encoder for the list or map most recently encoded
+	total  int            // for lists and maps, the sum of the element sizes
+	fields map[string]int // for the document's map, the size of each field
+}
+
+// size returns the size of the value most recently encoded.
+func (e *sizeEncoder) size() int {
+	if e.child != nil {
+		return e.child.total
+	}
+	return e.val
+}
+
+func (e *sizeEncoder) scalar(n int) {
+	e.val = n
+	e.child = nil
+}
+
+func (e *sizeEncoder) EncodeNil()            { e.scalar(1) }
+func (e *sizeEncoder) EncodeBool(bool)       { e.scalar(1) }
+func (e *sizeEncoder) EncodeString(s string) { e.scalar(len(s)) }
+func (e *sizeEncoder) EncodeInt(int64)       { e.scalar(8) }
+func (e *sizeEncoder) EncodeUint(uint64)     { e.scalar(8) }
+func (e *sizeEncoder) EncodeFloat(float64)   { e.scalar(8) }
+func (e *sizeEncoder) EncodeBytes(b []byte)  { e.scalar(len(b)) }
+
+func (e *sizeEncoder) EncodeList(int) Encoder {
+	e.child = &sizeEncoder{}
+	return e.child
+}
+
+func (e *sizeEncoder) ListIndex(int) { e.total += e.size() }
+
+func (e *sizeEncoder) EncodeMap(n int) Encoder {
+	e.child = &sizeEncoder{}
+	if e.isDoc {
+		e.child.fields = make(map[string]int, n)
+	}
+	return e.child
+}
+
+func (e *sizeEncoder) MapKey(k string) {
+	n := len(k) + e.size()
+	e.total += n
+	if e.fields != nil {
+		e.fields[k] = n
+	}
+}
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+func (e *sizeEncoder) EncodeSpecial(v reflect.Value) (bool, error) {
+	if v.Type() == typeOfTime {
+		e.scalar(8)
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEstimateSize(t *testing.T) {
+	type S struct {
+		Name string
+		N    int
+		T    time.Time
+		L    []bool
+		M    map[string]interface{}
+	}
+	s := &S{
+		Name: "abc",
+		L:    []bool{true, false},
+		M:    map[string]interface{}{"xy": nil, "b": []byte("12345")},
+	}
+	wantFields := map[string]int{
+		"Name": 4 + 3,
+		"N":    1 + 8,
+		"T":    1 + 8,
+		"L":    1 + 2,
+		"M":    1 + (2 + 1) + (1 + 5),
+	}
+	wantTotal := 0
+	for _, n := range wantFields {
+		wantTotal += n
+	}
+	for _, doc := range []interface{}{
+		s,
+		map[string]interface{}{"Name": s.Name, "N": s.N, "T": s.T, "L": s.L, "M": s.M},
+	} {
+		ddoc, err := NewDocument(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total, fields, err := EstimateSize(ddoc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != wantTotal {
+			t.Errorf("%T: total: got %d, want %d", doc, total, wantTotal)
+		}
+		if diff := cmp.Diff(fields, wantFields); diff != "" {
+			t.Errorf("%T: fields: %s", doc, diff)
+		}
+	}
+
+	got, err := EstimateValueSize([]string{"a", "bc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3; got != want {
+		t.Errorf("EstimateValueSize: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"unicode/utf8"
+)
+
+// FindInvalidUTF8 returns the first field name or string value in doc that is not
+// valid UTF-8, and true, or "" and false if there is none.
+func FindInvalidUTF8(doc Document) (string, bool, error) {
+	e := &utf8Encoder{}
+	if err := doc.Encode(e); err != nil {
+		return "", false, err
+	}
+	return e.invalid, e.found, nil
+}
+
+// FindInvalidUTF8Value is like FindInvalidUTF8, but for the Go value v.
+func FindInvalidUTF8Value(v interface{}) (string, bool, error) {
+	e := &utf8Encoder{}
+	if err := Encode(reflect.ValueOf(v), e); err != nil {
+		return "", false, err
+	}
+	return e.invalid, e.found, nil
+}
+
+// utf8Encoder is an Encoder that looks for invalid UTF-8 instead of encoding
+// values. The same encoder is used for nested lists and maps.
+type utf8Encoder struct {
+	invalid string
+	found   bool
+}
+
+func (e *utf8Encoder) check(s string) {
+	if !e.found && !utf8.ValidString(s) {
+		e.invalid = s
+		e.found = true
+	}
+}
+
+func (e *utf8Encoder) EncodeNil()             {}
+func (e *utf8Encoder) EncodeBool(bool)        {}
+func (e *utf8Encoder) EncodeString(s string)  { e.check(s) }
+func (e *utf8Encoder) EncodeInt(int64)        {}
+func (e *utf8Encoder) EncodeUint(uint64)      {}
+func (e *utf8Encoder) EncodeFloat(float64)    {}
+func (e *utf8Encoder) EncodeBytes([]byte)     {}
+func (e *utf8Encoder) EncodeList(int) Encoder { return e }
+func (e *utf8Encoder) ListIndex(int)          {}
+func (e *utf8Encoder) EncodeMap(int) Encoder  { return e }
+func (e *utf8Encoder) MapKey(k string)        { e.check(k) }
+
+func (e *utf8Encoder) EncodeSpecial(v reflect.Value) (bool, error) {
+	// Times have no strings to check.
+	return v.Type() == typeOfTime, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindInvalidUTF8(t *testing.T) {
+	const bad = "a\xffb"
+	for _, test := range []struct {
+		doc  map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"a": "é", "t": time.Now(), "b": []byte(bad)}, ""},
+		{map[string]interface{}{"a": bad}, bad},
+		{map[string]interface{}{bad: 1}, bad},
+		{map[string]interface{}{"m": map[string]interface{}{"l": []interface{}{1, bad}}}, bad},
+	} {
+		ddoc, err := NewDocument(test.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, found, err := FindInvalidUTF8(ddoc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want || found != (test.want != "") {
+			t.Errorf("%v: got (%q, %t), want %q", test.doc, got, found, test.want)
+		}
+	}
+	if _, found, err := FindInvalidUTF8Value([]string{"x", bad}); err != nil || !found {
+		t.Errorf("FindInvalidUTF8Value: got (%t, %v), want (true, nil)", found, err)
+	}
+}
@@ -15,17 +15,31 @@
 package driver
 
 import (
+	"math/big"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
+	"gocloud.dev/internal/gcerr"
 )
 
 // UniqueString generates a string that is unique with high probability.
 // Driver implementations can use it to generate keys for Create actions.
 func UniqueString() string { return uuid.New().String() }
 
+// GenerateKey returns a key for a, a Create action whose document has no key:
+// the result of a.KeyGenerator if it is set, and otherwise a UniqueString.
+func GenerateKey(a *Action) string {
+	if a.KeyGenerator != nil {
+		return a.KeyGenerator()
+	}
+	return UniqueString()
+}
+
 // SplitActions divides the actions slice into sub-slices much like strings.Split.
 // The split function should report whether two consecutive actions should be split,
 // that is, should be in different sub-slices. The first argument to split is the
@@ -53,6 +67,37 @@ func SplitActions(actions []*Action, split func(a, b *Action) bool) [][]*Action
 	return groups
 }
 
+// errNotAttempted is the error for actions skipped because of
+// RunActionsOptions.FailFast.
+var errNotAttempted = gcerr.Newf(gcerr.Canceled, nil, "action not attempted because an earlier action failed")
+
+// SkipActions sets the error of each action in actions that does not already
+// have one to an error with code Canceled, reporting that the action was not
+// attempted. Drivers call it for the actions they skip when
+// RunActionsOptions.FailFast is true.
+func SkipActions(actions []*Action, errs []error) {
+	for _, a := range actions {
+		if errs[a.Index] == nil {
+			errs[a.Index] = errNotAttempted
+		}
+	}
+}
+
+// ShouldStop reports whether RunActions should skip the actions it has not yet
+// started: that is, whether opts.FailFast is true and errs, a slice of per-action
+// errors, holds an error. errs must not be modified concurrently.
+func ShouldStop(opts *RunActionsOptions, errs []error) bool {
+	if !opts.FailFast {
+		return false
+	}
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // GroupActions separates actions into four sets: writes, gets that must happen before the writes,
 // gets that must happen after the writes, and gets that can happen concurrently with the writes.
 func GroupActions(actions []*Action) (beforeGets, getList, writeList, afterGets []*Action) {
@@ -210,3 +255,146 @@ func (t *Throttle) Release() {
 func (t *Throttle) Wait() {
 	t.wg.Wait()
 }
+
+// CompareValues compares two values, which should be strings, numbers, bools or
+// time.Time values. It returns -1, 0 or 1 if x1 is less than, equal to or greater
+// than x2, respectively; false is less than true. The second return value is false
+// if the values cannot be compared.
+//
+// Numbers of different types are compared exactly, without first converting
+// them to a common type.
+func CompareValues(x1, x2 interface{}) (int, bool) {
+	v1 := reflect.ValueOf(x1)
+	v2 := reflect.ValueOf(x2)
+	if v1.Kind() == reflect.String && v2.Kind() == reflect.String {
+		return strings.Compare(v1.String(), v2.String()), true
+	}
+	if v1.Kind() == reflect.Bool && v2.Kind() == reflect.Bool {
+		switch b1, b2 := v1.Bool(), v2.Bool(); {
+		case b1 == b2:
+			return 0, true
+		case b2:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	bf1 := toBigFloat(v1)
+	bf2 := toBigFloat(v2)
+	if bf1 != nil && bf2 != nil {
+		return bf1.Cmp(bf2), true
+	}
+	if t1, ok := x1.(time.Time); ok {
+		if t2, ok := x2.(time.Time); ok {
+			switch {
+			case t1.Before(t2):
+				return -1, true
+			case t1.After(t2):
+				return 1, true
+			default:
+				return 0, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func toBigFloat(x reflect.Value) *big.Float {
+	var f big.Float
+	switch x.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.SetInt64(x.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f.SetUint64(x.Uint())
+	case reflect.Float32, reflect.Float64:
+		f.SetFloat64(x.Float())
+	default:
+		return nil
+	}
+	return &f
+}
+
+// ApplyComparison reports whether c, the result of CompareValues or the like,
+// satisfies op, which must be one of the filter operators ("=", "<", etc.).
+func ApplyComparison(op string, c int) bool {
+	switch op {
+	case EqualOp:
+		return c == 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	default:
+		panic("bad op")
+	}
+}
+
+// EvaluateFilter reports whether the filter is true of the document.
+// A missing field, or a value that cannot be compared to the filter's value,
+// makes the filter false, except for a NotExistsOp filter.
+func EvaluateFilter(f Filter, doc Document) bool {
+	val, err := doc.Get(f.FieldPath)
+	switch f.Op {
+	case ExistsOp:
+		return err == nil
+	case NotExistsOp:
+		return err != nil
+	}
+	if err != nil {
+		return false
+	}
+	if IsStringOp(f.Op) {
+		return MatchString(f.Op, val, f.Value)
+	}
+	c, ok := CompareValues(val, f.Value)
+	if !ok {
+		return false
+	}
+	return ApplyComparison(f.Op, c)
+}
+
+// IsFoldOp reports whether op is one of the case-insensitive string operators,
+// EqualFoldOp and HasPrefixFoldOp.
+func IsFoldOp(op string) bool {
+	return op == EqualFoldOp || op == HasPrefixFoldOp
+}
+
+// IsStringOp reports whether op is one of the operators that apply only to
+// strings: HasPrefixOp, EqualFoldOp and HasPrefixFoldOp.
+func IsStringOp(op string) bool {
+	return op == HasPrefixOp || IsFoldOp(op)
+}
+
+// MatchString reports whether the document value val satisfies op, which must be
+// one of the operators for which IsStringOp is true, with respect to the filter
+// value s. It is false if val or s is not a string.
+func MatchString(op string, val, s interface{}) bool {
+	v1 := reflect.ValueOf(val)
+	v2 := reflect.ValueOf(s)
+	if v1.Kind() != reflect.String || v2.Kind() != reflect.String {
+		return false
+	}
+	str, pre := v1.String(), v2.String()
+	switch op {
+	case HasPrefixOp:
+		return strings.HasPrefix(str, pre)
+	case EqualFoldOp:
+		return strings.EqualFold(str, pre)
+	case HasPrefixFoldOp:
+		// Simple case folding maps runes to runes, so a string and its prefix
+		// under folding have the same number of runes.
+		n := utf8.RuneCountInString(pre)
+		i := 0
+		for ; n > 0 && i < len(str); n-- {
+			_, size := utf8.DecodeRuneInString(str[i:])
+			i += size
+		}
+		return n == 0 && strings.EqualFold(str[:i], pre)
+	default:
+		panic("bad op")
+	}
+}
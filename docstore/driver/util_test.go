@@ -16,7 +16,9 @@ package driver
 
 import (
 	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -172,3 +174,85 @@ func TestGroupByFieldPath(t *testing.T) {
 		}
 	}
 }
+
+func TestCompareValues(t *testing.T) {
+	t1 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		x1, x2 interface{}
+		want   int
+		wantOK bool
+	}{
+		{"a", "b", -1, true},
+		{"b", "b", 0, true},
+		{int8(3), 2.5, 1, true},
+		{uint(1), int64(1), 0, true},
+		{int64(math.MaxInt64), float64(math.MaxInt64), -1, true}, // the float rounds up to 2^63
+		{t1, t1.Add(time.Second), -1, true},
+		{false, true, -1, true},
+		{true, true, 0, true},
+		{"1", 1, 0, false},
+		{true, 1, 0, false},
+		{t1, 1, 0, false},
+		{nil, 1, 0, false},
+	} {
+		got, gotOK := CompareValues(test.x1, test.x2)
+		if got != test.want || gotOK != test.wantOK {
+			t.Errorf("CompareValues(%v, %v) = (%d, %t), want (%d, %t)",
+				test.x1, test.x2, got, gotOK, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestEvaluateFilter(t *testing.T) {
+	doc, err := NewDocument(map[string]interface{}{"a": nil, "b": true, "m": map[string]interface{}{"n": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		f    Filter
+		want bool
+	}{
+		{Filter{[]string{"a"}, ExistsOp, nil}, true},
+		{Filter{[]string{"a"}, NotExistsOp, nil}, false},
+		{Filter{[]string{"z"}, ExistsOp, nil}, false},
+		{Filter{[]string{"z"}, NotExistsOp, nil}, true},
+		{Filter{[]string{"m", "n"}, ExistsOp, nil}, true},
+		{Filter{[]string{"m", "z"}, NotExistsOp, nil}, true},
+		{Filter{[]string{"b"}, EqualOp, true}, true},
+		{Filter{[]string{"b"}, EqualOp, false}, false},
+		{Filter{[]string{"m", "n"}, ">", 0}, true},
+		{Filter{[]string{"z"}, EqualOp, 1}, false},
+	} {
+		if got := EvaluateFilter(test.f, doc); got != test.want {
+			t.Errorf("%+v: got %t, want %t", test.f, got, test.want)
+		}
+	}
+}
+
+func TestMatchString(t *testing.T) {
+	for _, test := range []struct {
+		op     string
+		val, s interface{}
+		want   bool
+	}{
+		{EqualFoldOp, "Hello", "hELLO", true},
+		{EqualFoldOp, "Hello", "Hell", false},
+		{EqualFoldOp, "Straße", "STRASSE", false}, // simple folding only
+		{EqualFoldOp, "K", "k", true},             // Kelvin sign
+		{EqualFoldOp, 1, "1", false},
+		{HasPrefixFoldOp, "Hello", "HEL", true},
+		{HasPrefixFoldOp, "Hello", "", true},
+		{HasPrefixFoldOp, "Hello", "hello!", false},
+		{HasPrefixFoldOp, "Kelvin", "ke", true},
+		{HasPrefixFoldOp, "ελληνικά", "ΕΛΛ", true},
+		{HasPrefixFoldOp, "Hello", "help", false},
+		{HasPrefixOp, "Hello", "He", true},
+		{HasPrefixOp, "Hello", "he", false},
+		{HasPrefixOp, "Hello", "", true},
+		{HasPrefixOp, []byte("Hello"), "He", false},
+	} {
+		if got := MatchString(test.op, test.val, test.s); got != test.want {
+			t.Errorf("MatchString(%q, %v, %v) = %t, want %t", test.op, test.val, test.s, got, test.want)
+		}
+	}
+}
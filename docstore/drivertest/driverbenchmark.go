@@ -17,17 +17,23 @@ package drivertest
 import (
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 
 	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
 )
 
-// RunBenchmarks runs benchmarks for docstore drivers.
+// RunBenchmarks runs benchmarks for docstore drivers. The benchmarks report
+// memory allocations, so that drivers can be compared by the garbage they
+// create as well as by their speed. coll must support queries.
 func RunBenchmarks(b *testing.B, coll *docstore.Collection) {
 	defer coll.Close()
-	clearCollection(b, coll)
+	clearCollection(b, coll, AllCapabilities)
 	b.Run("BenchmarkSingleActionPut", func(b *testing.B) {
 		benchmarkSingleActionPut(10, b, coll)
 	})
@@ -40,7 +46,33 @@ func RunBenchmarks(b *testing.B, coll *docstore.Collection) {
 	b.Run("BenchmarkActionListGet", func(b *testing.B) {
 		benchmarkActionListGet(100, b, coll)
 	})
-	clearCollection(b, coll)
+	b.Run("BenchmarkActionListPutLarge", func(b *testing.B) {
+		for _, n := range []int{100, 500} {
+			b.Run(strconv.Itoa(n), func(b *testing.B) {
+				benchmarkActionListPutLarge(n, 1<<10, b, coll)
+			})
+		}
+	})
+	b.Run("BenchmarkMixed", func(b *testing.B) {
+		for _, pct := range []int{10, 50, 90} {
+			b.Run(fmt.Sprintf("%dPercentWrites", pct), func(b *testing.B) {
+				benchmarkMixed(100, pct, b, coll)
+			})
+		}
+	})
+	// The query benchmarks need a collection that holds only their documents.
+	for _, n := range []int{100, 1000} {
+		clearCollection(b, coll, AllCapabilities)
+		putQueryDocs(n, b, coll)
+		b.Run(fmt.Sprintf("BenchmarkQueryScan/%d", n), func(b *testing.B) {
+			benchmarkQuery(n, func(q *docstore.Query) *docstore.Query { return q }, b, coll)
+		})
+		b.Run(fmt.Sprintf("BenchmarkQueryFiltered/%d", n), func(b *testing.B) {
+			filter := func(q *docstore.Query) *docstore.Query { return q.Where("g", "=", 3) }
+			benchmarkQuery(n/queryGroups, filter, b, coll)
+		})
+	}
+	clearCollection(b, coll, AllCapabilities)
 }
 
 func benchmarkSingleActionPut(n int, b *testing.B, coll *docstore.Collection) {
@@ -48,6 +80,7 @@ func benchmarkSingleActionPut(n int, b *testing.B, coll *docstore.Collection) {
 	const baseKey = "benchmarksingleaction-put-"
 	var nextID uint32
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
@@ -75,6 +108,7 @@ func benchmarkSingleActionGet(n int, b *testing.B, coll *docstore.Collection) {
 		b.Fatal(err)
 	}
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
@@ -93,6 +127,7 @@ func benchmarkActionListPut(n int, b *testing.B, coll *docstore.Collection) {
 	const baseKey = "benchmarkactionlist-put-"
 	var nextID uint32
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
@@ -122,6 +157,7 @@ func benchmarkActionListGet(n int, b *testing.B, coll *docstore.Collection) {
 		b.Fatal(err)
 	}
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
@@ -136,3 +172,107 @@ func benchmarkActionListGet(n int, b *testing.B, coll *docstore.Collection) {
 		}
 	})
 }
+
+func benchmarkActionListPutLarge(n, size int, b *testing.B, coll *docstore.Collection) {
+	ctx := context.Background()
+	baseKey := fmt.Sprintf("benchmarkactionlist-putlarge-%d-", n)
+	payload := strings.Repeat("x", size)
+	var nextID uint32
+
+	b.ReportAllocs()
+	b.SetBytes(int64(n * size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		actions := coll.Actions()
+		for j := 0; j < n; j++ {
+			key := fmt.Sprintf("%s%d", baseKey, atomic.AddUint32(&nextID, 1))
+			actions.Put(docmap{KeyField: key, "P": payload})
+		}
+		if err := actions.Do(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkMixed gets and puts documents among n at random, with writePct
+// percent of the actions being puts.
+func benchmarkMixed(n, writePct int, b *testing.B, coll *docstore.Collection) {
+	ctx := context.Background()
+	baseKey := fmt.Sprintf("benchmarkmixed-%d-", writePct)
+	puts := coll.Actions()
+	for i := 0; i < n; i++ {
+		puts.Put(docmap{KeyField: baseKey + strconv.Itoa(i), "n": i})
+	}
+	if err := puts.Do(ctx); err != nil {
+		b.Fatal(err)
+	}
+	var seed int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			key := baseKey + strconv.Itoa(r.Intn(n))
+			var err error
+			if r.Intn(100) < writePct {
+				err = coll.Put(ctx, docmap{KeyField: key, "n": r.Intn(n)})
+			} else {
+				err = coll.Get(ctx, docmap{KeyField: key})
+			}
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// queryGroups is the number of distinct values of the "g" field of the
+// documents that putQueryDocs writes.
+const queryGroups = 10
+
+// putQueryDocs writes n documents for the query benchmarks.
+func putQueryDocs(n int, b *testing.B, coll *docstore.Collection) {
+	ctx := context.Background()
+	const batchSize = 100
+	for i := 0; i < n; i += batchSize {
+		puts := coll.Actions()
+		for j := i; j < i+batchSize && j < n; j++ {
+			puts.Put(docmap{KeyField: "benchmarkquery-" + strconv.Itoa(j), "n": j, "g": j % queryGroups})
+		}
+		if err := puts.Do(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkQuery runs the query returned by filter, checking that it returns
+// want documents.
+func benchmarkQuery(want int, filter func(*docstore.Query) *docstore.Query, b *testing.B, coll *docstore.Collection) {
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter := filter(coll.Query()).Get(ctx)
+		got := 0
+		for {
+			err := iter.Next(ctx, docmap{})
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				iter.Stop()
+				if gcerrors.Code(err) == gcerrors.Unimplemented {
+					b.Skipf("query not supported: %v", err)
+				}
+				b.Fatal(err)
+			}
+			got++
+		}
+		iter.Stop()
+		if got != want {
+			b.Fatalf("got %d documents, want %d", got, want)
+		}
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"io"
 	"math"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -65,10 +67,78 @@ type Harness interface {
 	// function given to BeforeQuery.
 	BeforeQueryTypes() []interface{}
 
+	// Capabilities returns the features that the harness's collections support.
+	// Conformance tests that need other features are skipped, so a new driver
+	// can run the tests before it implements everything. Drivers that support
+	// all features should return AllCapabilities. Tests are skipped before
+	// they call the harness's Make methods, so a harness can wait until then
+	// to connect to the provider.
+	Capabilities() Capabilities
+
 	// Close closes resources used by the harness.
 	Close()
 }
 
+// Capabilities is a set of optional collection features that conformance tests
+// depend on.
+type Capabilities uint
+
+const (
+	// Queries means the collection supports Get queries, with filters,
+	// ordering and limits. Without delete queries, the tests delete the
+	// documents a query returns to start with an empty collection; without
+	// either, the harness's collections must start empty.
+	Queries Capabilities = 1 << iota
+	// Updates means the collection supports Update actions.
+	Updates
+	// OrderedActions means an action list may get a document both before and
+	// after it writes it, and the gets see the document's state at those
+	// points.
+	OrderedActions
+	// DeleteQueries means the collection supports Query.Delete.
+	DeleteQueries
+	// UpdateQueries means the collection supports Query.Update.
+	UpdateQueries
+	// Concurrency means the tests may use a collection from many goroutines
+	// at once. Harnesses that replay recorded RPCs lack it, because the order
+	// of concurrent RPCs varies from run to run.
+	Concurrency
+	// Cancellation means the tests may cancel contexts while the collection
+	// is in use. Harnesses that replay recorded RPCs lack it, because whether
+	// an interrupted RPC is sent varies from run to run.
+	Cancellation
+	// Stress means the tests may write documents near the provider's size
+	// limit, and action lists with hundreds of actions. Harnesses that replay
+	// recorded RPCs lack it, to keep the recordings small.
+	Stress
+
+	// AllCapabilities is the set of all capabilities.
+	AllCapabilities = Queries | Updates | OrderedActions | DeleteQueries | UpdateQueries | Concurrency | Cancellation | Stress
+)
+
+var capabilityNames = []string{"Queries", "Updates", "OrderedActions", "DeleteQueries", "UpdateQueries", "Concurrency", "Cancellation", "Stress"}
+
+func (c Capabilities) String() string {
+	var names []string
+	for i, n := range capabilityNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// skipUnsupported skips t unless h supports all of need.
+func skipUnsupported(t *testing.T, h Harness, need Capabilities) {
+	t.Helper()
+	if missing := need &^ h.Capabilities(); missing != 0 {
+		t.Skipf("harness does not support %s", missing)
+	}
+}
+
 // HarnessMaker describes functions that construct a harness for running tests.
 // It is called exactly once per test; Harness.Close() will be called when the test is complete.
 type HarnessMaker func(ctx context.Context, t *testing.T) (Harness, error)
@@ -147,25 +217,144 @@ func (v verifyAsFailsOnNil) ErrorCheck(c *docstore.Collection, err error) (ret e
 	return nil
 }
 
+// AsMatrix is an AsTest that checks the As methods against lists of the types
+// a provider supports, so that the provider's tests need not implement AsTest.
+// Each entry is a pointer to a variable of a supported type, as it would be
+// passed to As: for example, new(*sql.DB) if Collection.As supports *sql.DB.
+// A successful As must not set a variable of pointer or interface type to nil.
+type AsMatrix struct {
+	// Collection holds the types that Collection.As must support.
+	Collection []interface{}
+	// Iterator holds the types that DocumentIterator.As may support. The
+	// iterator of each test query must support at least one of them, since
+	// a provider may run different queries in different ways. If Iterator is
+	// empty, the iterators are not checked.
+	Iterator []interface{}
+	// Error holds the types that Collection.ErrorAs may support for the error
+	// from creating a document that already exists. It must support at least
+	// one of them. If Error is empty, the error is not checked.
+	Error []interface{}
+	// Unsupported holds types that Collection.As, DocumentIterator.As and
+	// Collection.ErrorAs must all reject.
+	Unsupported []interface{}
+}
+
+// Name implements AsTest.Name. It returns the name that the providers' own
+// AsTests used, so that the subtest keeps the name of its recorded replays.
+func (m AsMatrix) Name() string { return "verify As" }
+
+// CollectionCheck implements AsTest.CollectionCheck.
+func (m AsMatrix) CollectionCheck(coll *docstore.Collection) error {
+	for _, p := range m.Collection {
+		if err := checkAs("Collection.As", coll.As, p); err != nil {
+			return err
+		}
+	}
+	return checkUnsupported("Collection.As", coll.As, m.Unsupported)
+}
+
+// QueryCheck implements AsTest.QueryCheck.
+func (m AsMatrix) QueryCheck(it *docstore.DocumentIterator) error {
+	if err := checkAny("DocumentIterator.As", it.As, m.Iterator); err != nil {
+		return err
+	}
+	return checkUnsupported("DocumentIterator.As", it.As, m.Unsupported)
+}
+
+// ErrorCheck implements AsTest.ErrorCheck.
+func (m AsMatrix) ErrorCheck(c *docstore.Collection, err error) error {
+	errorAs := func(i interface{}) bool { return c.ErrorAs(err, i) }
+	if err := checkAny("Collection.ErrorAs", errorAs, m.Error); err != nil {
+		return err
+	}
+	return checkUnsupported("Collection.ErrorAs", errorAs, m.Unsupported)
+}
+
+// checkAs calls as with a new variable of the type p points to, and returns
+// an error unless it succeeds and sets the variable, if it is a pointer or
+// interface, to non-nil.
+func checkAs(name string, as func(interface{}) bool, p interface{}) error {
+	v := reflect.New(reflect.TypeOf(p).Elem())
+	if !as(v.Interface()) {
+		return fmt.Errorf("%s failed for %s", name, v.Type().Elem())
+	}
+	if k := v.Elem().Kind(); (k == reflect.Ptr || k == reflect.Interface) && v.Elem().IsNil() {
+		return fmt.Errorf("%s succeeded for %s, but set it to nil", name, v.Type().Elem())
+	}
+	return nil
+}
+
+// checkAny returns nil if checkAs succeeds for one of ps, or if ps is empty.
+func checkAny(name string, as func(interface{}) bool, ps []interface{}) error {
+	var err error
+	for _, p := range ps {
+		if err = checkAs(name, as, p); err == nil {
+			return nil
+		}
+	}
+	if len(ps) > 1 {
+		return fmt.Errorf("%s failed for all of %v", name, typeNames(ps))
+	}
+	return err
+}
+
+// checkUnsupported returns an error if as succeeds for any of ps.
+func checkUnsupported(name string, as func(interface{}) bool, ps []interface{}) error {
+	for _, p := range ps {
+		v := reflect.New(reflect.TypeOf(p).Elem())
+		if as(v.Interface()) {
+			return fmt.Errorf("%s succeeded for %s, want failure", name, v.Type().Elem())
+		}
+	}
+	return nil
+}
+
+// typeNames returns the names of the types that ps point to.
+func typeNames(ps []interface{}) []string {
+	var names []string
+	for _, p := range ps {
+		names = append(names, reflect.TypeOf(p).Elem().String())
+	}
+	return names
+}
+
 // RunConformanceTests runs conformance tests for provider implementations of docstore.
 func RunConformanceTests(t *testing.T, newHarness HarnessMaker, ct CodecTester, asTests []AsTest) {
 	t.Run("TypeDrivenCodec", func(t *testing.T) { testTypeDrivenDecode(t, ct) })
 	t.Run("BlindCodec", func(t *testing.T) { testBlindDecode(t, ct) })
-
-	t.Run("Create", func(t *testing.T) { withCollection(t, newHarness, testCreate) })
-	t.Run("Put", func(t *testing.T) { withCollection(t, newHarness, testPut) })
-	t.Run("Replace", func(t *testing.T) { withCollection(t, newHarness, testReplace) })
-	t.Run("Get", func(t *testing.T) { withCollection(t, newHarness, testGet) })
-	t.Run("Delete", func(t *testing.T) { withCollection(t, newHarness, testDelete) })
-	t.Run("Update", func(t *testing.T) { withCollection(t, newHarness, testUpdate) })
-	t.Run("Data", func(t *testing.T) { withCollection(t, newHarness, testData) })
-	t.Run("MultipleActions", func(t *testing.T) { withCollection(t, newHarness, testMultipleActions) })
-	t.Run("UnorderedActions", func(t *testing.T) { withCollection(t, newHarness, testUnorderedActions) })
-	t.Run("GetQueryKeyField", func(t *testing.T) { withCollection(t, newHarness, testGetQueryKeyField) })
-
-	t.Run("GetQuery", func(t *testing.T) { withTwoKeyCollection(t, newHarness, testGetQuery) })
-	t.Run("DeleteQuery", func(t *testing.T) { withTwoKeyCollection(t, newHarness, testDeleteQuery) })
-	t.Run("UpdateQuery", func(t *testing.T) { withTwoKeyCollection(t, newHarness, testUpdateQuery) })
+	t.Run("FuzzCodec", func(t *testing.T) { testCodecFuzz(t, ct) })
+
+	t.Run("Create", func(t *testing.T) { withCollection(t, newHarness, 0, testCreate) })
+	t.Run("Put", func(t *testing.T) { withCollection(t, newHarness, 0, testPut) })
+	t.Run("Replace", func(t *testing.T) { withCollection(t, newHarness, 0, testReplace) })
+	t.Run("Get", func(t *testing.T) { withCollection(t, newHarness, 0, testGet) })
+	t.Run("Delete", func(t *testing.T) { withCollection(t, newHarness, 0, testDelete) })
+	t.Run("Update", func(t *testing.T) { withCollection(t, newHarness, Updates, testUpdate) })
+	t.Run("Data", func(t *testing.T) { withCollection(t, newHarness, 0, testData) })
+	t.Run("Durations", func(t *testing.T) { withCollection(t, newHarness, 0, testDurations) })
+	t.Run("OmitEmpty", func(t *testing.T) { withCollection(t, newHarness, 0, testOmitEmpty) })
+	t.Run("Embedding", func(t *testing.T) { withHarnessAndCollection(t, newHarness, 0, testEmbedding) })
+	t.Run("Marshaler", func(t *testing.T) { withHarnessAndCollection(t, newHarness, 0, testMarshaler) })
+	t.Run("Strings", func(t *testing.T) { withHarnessAndCollection(t, newHarness, Queries|Updates, testStrings) })
+	t.Run("SpecialStrings", func(t *testing.T) { withHarnessAndCollection(t, newHarness, 0, testSpecialStrings) })
+	t.Run("AlternateKeys", func(t *testing.T) { testAlternateKeys(t, newHarness) })
+	t.Run("MultipleActions", func(t *testing.T) { withCollection(t, newHarness, OrderedActions, testMultipleActions) })
+	t.Run("UnorderedActions", func(t *testing.T) { withCollection(t, newHarness, 0, testUnorderedActions) })
+	t.Run("FailFast", func(t *testing.T) { withCollection(t, newHarness, 0, testFailFast) })
+	t.Run("ConcurrentWriters", func(t *testing.T) { withCollection(t, newHarness, Concurrency, testConcurrentWriters) })
+	t.Run("ContextDone", func(t *testing.T) { withHarnessAndCollection(t, newHarness, Cancellation, testContextDone) })
+	t.Run("LargeDocuments", func(t *testing.T) { withDriverCollection(t, newHarness, Stress, testLargeDocuments) })
+	t.Run("LargeActionLists", func(t *testing.T) { withHarnessAndCollection(t, newHarness, Stress, testLargeActionLists) })
+	t.Run("GetQueryKeyField", func(t *testing.T) { withCollection(t, newHarness, Queries, testGetQueryKeyField) })
+	t.Run("ExistsQuery", func(t *testing.T) { withCollection(t, newHarness, Queries, testExistsQuery) })
+	t.Run("NestedQuery", func(t *testing.T) { withCollection(t, newHarness, Queries, testNestedQuery) })
+	t.Run("FoldQuery", func(t *testing.T) { withCollection(t, newHarness, Queries, testFoldQuery) })
+	t.Run("PrefixQuery", func(t *testing.T) { withCollection(t, newHarness, Queries, testPrefixQuery) })
+
+	t.Run("GetQuery", func(t *testing.T) { withTwoKeyCollection(t, newHarness, Queries, testGetQuery) })
+	t.Run("DeleteQuery", func(t *testing.T) { withTwoKeyCollection(t, newHarness, Queries|DeleteQueries, testDeleteQuery) })
+	t.Run("UpdateQuery", func(t *testing.T) { withTwoKeyCollection(t, newHarness, Queries|UpdateQueries, testUpdateQuery) })
+	t.Run("KeysetPagination", func(t *testing.T) { withTwoKeyCollection(t, newHarness, Queries, testKeysetPagination) })
 
 	t.Run("BeforeDo", func(t *testing.T) { testBeforeDo(t, newHarness) })
 	t.Run("BeforeQuery", func(t *testing.T) { testBeforeQuery(t, newHarness) })
@@ -177,7 +366,7 @@ func RunConformanceTests(t *testing.T, newHarness HarnessMaker, ct CodecTester,
 				t.Fatalf("AsTest.Name is required")
 			}
 			t.Run(st.Name(), func(t *testing.T) {
-				withTwoKeyCollection(t, newHarness, func(t *testing.T, coll *docstore.Collection) {
+				withTwoKeyCollection(t, newHarness, Queries, func(t *testing.T, coll *docstore.Collection) {
 					testAs(t, coll, st)
 				})
 			})
@@ -185,13 +374,22 @@ func RunConformanceTests(t *testing.T, newHarness HarnessMaker, ct CodecTester,
 	})
 }
 
-func withHarnessAndCollection(t *testing.T, newHarness HarnessMaker, f func(*testing.T, context.Context, Harness, *ds.Collection)) {
+func withHarnessAndCollection(t *testing.T, newHarness HarnessMaker, need Capabilities, f func(*testing.T, context.Context, Harness, *ds.Collection)) {
+	withDriverCollection(t, newHarness, need, func(t *testing.T, ctx context.Context, h Harness, _ driver.Collection, coll *ds.Collection) {
+		f(t, ctx, h, coll)
+	})
+}
+
+// withDriverCollection is like withHarnessAndCollection, but also passes f the
+// driver collection underlying coll.
+func withDriverCollection(t *testing.T, newHarness HarnessMaker, need Capabilities, f func(*testing.T, context.Context, Harness, driver.Collection, *ds.Collection)) {
 	ctx := context.Background()
 	h, err := newHarness(ctx, t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer h.Close()
+	skipUnsupported(t, h, need)
 
 	dc, err := h.MakeCollection(ctx)
 	if err != nil {
@@ -199,12 +397,12 @@ func withHarnessAndCollection(t *testing.T, newHarness HarnessMaker, f func(*tes
 	}
 	coll := ds.NewCollection(dc)
 	defer coll.Close()
-	clearCollection(t, coll)
-	f(t, ctx, h, coll)
+	clearCollection(t, coll, h.Capabilities())
+	f(t, ctx, h, dc, coll)
 }
 
-func withCollection(t *testing.T, newHarness HarnessMaker, f func(*testing.T, *ds.Collection, string)) {
-	withHarnessAndCollection(t, newHarness, func(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+func withCollection(t *testing.T, newHarness HarnessMaker, need Capabilities, f func(*testing.T, *ds.Collection, string)) {
+	withHarnessAndCollection(t, newHarness, need, func(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
 		t.Run("StdRev", func(t *testing.T) { f(t, coll, ds.DefaultRevisionField) })
 		dc, err := h.MakeAlternateRevisionFieldCollection(ctx)
 		if err != nil {
@@ -212,18 +410,19 @@ func withCollection(t *testing.T, newHarness HarnessMaker, f func(*testing.T, *d
 		}
 		coll = ds.NewCollection(dc)
 		defer coll.Close()
-		clearCollection(t, coll)
+		clearCollection(t, coll, h.Capabilities())
 		t.Run("AltRev", func(t *testing.T) { f(t, coll, AlternateRevisionField) })
 	})
 }
 
-func withTwoKeyCollection(t *testing.T, newHarness HarnessMaker, f func(*testing.T, *ds.Collection)) {
+func withTwoKeyCollection(t *testing.T, newHarness HarnessMaker, need Capabilities, f func(*testing.T, *ds.Collection)) {
 	ctx := context.Background()
 	h, err := newHarness(ctx, t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer h.Close()
+	skipUnsupported(t, h, need)
 
 	dc, err := h.MakeTwoKeyCollection(ctx)
 	if err != nil {
@@ -231,7 +430,7 @@ func withTwoKeyCollection(t *testing.T, newHarness HarnessMaker, f func(*testing
 	}
 	coll := ds.NewCollection(dc)
 	defer coll.Close()
-	clearCollection(t, coll)
+	clearCollection(t, coll, h.Capabilities())
 	f(t, coll)
 }
 
@@ -820,9 +1019,291 @@ func testData(t *testing.T, coll *ds.Collection, revField string) {
 			t.Errorf("%v: got %v (%T), want %v (%T)", test.in, g, g, test.want, test.want)
 		}
 	}
+}
+
+func testDurations(t *testing.T, coll *ds.Collection, revField string) {
+	ctx := context.Background()
+
+	// A time.Duration is stored as its nanoseconds.
+	d := 90*time.Second + 5
+	doc := docmap{KeyField: "testDurations", "val": d}
+	got := docmap{KeyField: doc[KeyField]}
+	if err := coll.Actions().Put(doc).Get(got).Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := got["val"].(int64); !ok || g != int64(d) {
+		t.Errorf("got %v (%T), want %d (int64)", got["val"], got["val"], int64(d))
+	}
+
+	// A time.Duration is decoded back into a time.Duration.
+	type durations struct {
+		Name             string `docstore:"name"`
+		DocstoreRevision interface{}
+		Etag             interface{}
+		D                time.Duration
+		DS               []time.Duration
+	}
+	in := &durations{Name: "testDurations", D: d, DS: []time.Duration{-time.Millisecond}}
+	if err := coll.Put(ctx, in); err != nil {
+		t.Fatal(err)
+	}
+	out := &durations{Name: in.Name}
+	if err := coll.Get(ctx, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.D != in.D || len(out.DS) != 1 || out.DS[0] != in.DS[0] {
+		t.Errorf("durations: got %v, %v; want %v, %v", out.D, out.DS, in.D, in.DS)
+	}
+}
+
+func testStrings(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	const (
+		composed   = "caf\u00e9"  // é as a single code point
+		decomposed = "cafe\u0301" // e followed by a combining acute accent
+		invalid    = "a\xffb"
+	)
+	revField := ds.DefaultRevisionField
+
+	// Valid UTF-8 round-trips unchanged by default, without normalization.
+	t.Run("Valid", func(t *testing.T) {
+		for _, s := range []string{composed, decomposed, "\u65e5\u672c\u8a9e", "\U0001F600"} {
+			doc := docmap{KeyField: "testStrings" + s, "s": s}
+			got := docmap{KeyField: doc[KeyField]}
+			if err := coll.Actions().Put(doc).Get(got).Do(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got["s"] != s {
+				t.Errorf("got %+q, want %+q", got["s"], s)
+			}
+			if err := coll.Delete(ctx, docmap{KeyField: doc[KeyField]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	withOptions := func(t *testing.T, opts *ds.StringOptions) *ds.Collection {
+		dc, err := h.MakeCollection(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds.WithStringOptions(ds.NewCollection(dc), opts)
+	}
 
-	// TODO: strings: valid vs. invalid unicode
+	t.Run("RejectInvalidUTF8", func(t *testing.T) {
+		coll := withOptions(t, &ds.StringOptions{RejectInvalidUTF8: true})
+		defer coll.Close()
+		doc := docmap{KeyField: "testRejectInvalidUTF8", "s": "ok"}
+		if err := coll.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+		defer coll.Delete(ctx, docmap{KeyField: doc[KeyField]})
+
+		checkCode(t, coll.Put(ctx, docmap{KeyField: "testRejectInvalidUTF8", "s": invalid}), gcerrors.InvalidArgument)
+		checkCode(t, coll.Put(ctx, docmap{KeyField: "testRejectInvalidUTF8", "m": docmap{invalid: 1}}), gcerrors.InvalidArgument)
+		checkCode(t, coll.Put(ctx, docmap{KeyField: invalid}), gcerrors.InvalidArgument)
+		checkCode(t, coll.Get(ctx, docmap{KeyField: invalid}), gcerrors.InvalidArgument)
+		checkCode(t, coll.Update(ctx, doc, ds.Mods{"s": invalid}), gcerrors.InvalidArgument)
+		checkCode(t, coll.Actions().Put(doc).If("s", "=", invalid).Do(ctx), gcerrors.InvalidArgument)
+		iter := coll.Query().Where("s", "=", invalid).Get(ctx)
+		defer iter.Stop()
+		checkCode(t, iter.Next(ctx, docmap{}), gcerrors.InvalidArgument)
+
+		// The document is unchanged.
+		got := docmap{KeyField: doc[KeyField]}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if got["s"] != "ok" {
+			t.Errorf("got %q, want %q", got["s"], "ok")
+		}
+	})
+
+	t.Run("NormalizeNFC", func(t *testing.T) {
+		coll := withOptions(t, &ds.StringOptions{NormalizeNFC: true})
+		defer coll.Close()
+		key := "testNormalizeNFC" + decomposed
+		doc := docmap{KeyField: key, "s": decomposed, "l": []interface{}{decomposed}}
+		if err := coll.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+		defer coll.Delete(ctx, docmap{KeyField: "testNormalizeNFC" + composed})
+		// The document was normalized in place.
+		want := docmap{
+			KeyField: "testNormalizeNFC" + composed,
+			"s":      composed,
+			"l":      []interface{}{composed},
+			revField: doc[revField],
+		}
+		if diff := cmp.Diff(doc, want); diff != "" {
+			t.Errorf("document after Put: %s", diff)
+		}
+		// Either form of the key finds it.
+		for _, k := range []string{"testNormalizeNFC" + composed, key} {
+			got := docmap{KeyField: k}
+			if err := coll.Get(ctx, got); err != nil {
+				t.Fatal(err)
+			}
+			if got["s"] != composed {
+				t.Errorf("got %+q, want %+q", got["s"], composed)
+			}
+		}
+		// Either form of a filter value matches it.
+		for _, v := range []string{composed, decomposed} {
+			iter := coll.Query().Where(KeyField, "=", "testNormalizeNFC"+composed).Where("s", "=", v).Get(ctx)
+			got := mustCollect(ctx, t, iter)
+			iter.Stop()
+			if len(got) != 1 {
+				t.Errorf("query for %+q: got %d documents, want 1", v, len(got))
+			}
+		}
+		// Mods are normalized.
+		if err := coll.Update(ctx, docmap{KeyField: key}, ds.Mods{"t": decomposed}); err != nil {
+			t.Fatal(err)
+		}
+		got := docmap{KeyField: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if got["t"] != composed {
+			t.Errorf("got %+q, want %+q", got["t"], composed)
+		}
+	})
+}
 
+// specialStrings are keys, field names and values that providers must escape
+// or reject, since they contain separators, are not ASCII, or are long.
+var specialStrings = []struct {
+	name, s string
+}{
+	{"NonASCII", "\u65e5\u672c\u8a9e"},
+	{"Emoji", "\U0001F600"},
+	{"Accent", "caf\u00e9"},
+	{"Pipe", "a|b"},
+	{"Slash", "a/b"},
+	{"LeadingSlash", "/a"},
+	{"EscapedSlash", "a%2Fb"},
+	{"Backslash", `a\b`},
+	{"Dot", "a.b"},
+	{"DotDot", ".."},
+	{"Colon", "a:b"},
+	{"Spaces", " a b "},
+	{"Quotes", `a"b'c`},
+	{"Backtick", "a`b"},
+	{"URLChars", "#?&="},
+	{"Dollar", "$a"},
+	{"Underscores", "__a__"},
+	{"Newline", "a\nb"},
+	{"Long", strings.Repeat("x", 500)},
+	{"LongNonASCII", strings.Repeat("\u00e9", 250)},
+}
+
+// testSpecialStrings checks that keys, field names and values made of
+// specialStrings round-trip, and are not confused with one another. A
+// provider may reject one that it does not support, but only with
+// InvalidArgument.
+func testSpecialStrings(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	// put puts doc, and reports whether the provider accepted it.
+	put := func(t *testing.T, doc docmap) bool {
+		t.Helper()
+		err := coll.Put(ctx, doc)
+		if err == nil {
+			return true
+		}
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("got %v, want success or InvalidArgument", err)
+		}
+		return false
+	}
+
+	t.Run("Keys", func(t *testing.T) {
+		// Put all the keys before reading any, so that keys that a provider
+		// escapes to the same string overwrite each other.
+		var stored []string
+		for _, ss := range specialStrings {
+			if put(t, docmap{KeyField: ss.s, "s": ss.s}) {
+				stored = append(stored, ss.s)
+			} else {
+				t.Logf("%s: key rejected", ss.name)
+			}
+		}
+		for _, k := range stored {
+			got := docmap{KeyField: k}
+			if err := coll.Get(ctx, got); err != nil {
+				t.Errorf("key %+q: %v", k, err)
+				continue
+			}
+			if got["s"] != k {
+				t.Errorf("key %+q: got document for %+q", k, got["s"])
+			}
+		}
+		if h.Capabilities()&Queries != 0 {
+			for _, k := range stored {
+				iter := coll.Query().Where("s", "=", k).Get(ctx)
+				got := mustCollect(ctx, t, iter)
+				iter.Stop()
+				if len(got) != 1 || got[0][KeyField] != k {
+					t.Errorf("query for %+q: got %v, want the document with that key", k, got)
+				}
+			}
+		}
+		for _, k := range stored {
+			if err := coll.Delete(ctx, docmap{KeyField: k}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("EmptyKey", func(t *testing.T) {
+		if !put(t, docmap{KeyField: "", "s": "empty"}) {
+			return
+		}
+		defer coll.Delete(ctx, docmap{KeyField: ""})
+		got := docmap{KeyField: ""}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if got["s"] != "empty" {
+			t.Errorf("got %v, want the document with the empty key", got)
+		}
+	})
+
+	t.Run("FieldNames", func(t *testing.T) {
+		// Each name is in its own document, since a provider may reject some.
+		for _, ss := range specialStrings {
+			key := "testSpecialFieldNames" + ss.name
+			doc := docmap{KeyField: key, ss.s: ss.name, "m": docmap{ss.s: ss.name}}
+			if !put(t, doc) {
+				t.Logf("%s: field name rejected", ss.name)
+				continue
+			}
+			got := docmap{KeyField: key}
+			if err := coll.Get(ctx, got); err != nil {
+				t.Fatal(err)
+			}
+			want := docmap{KeyField: key, ss.s: ss.name, "m": map[string]interface{}{ss.s: ss.name}}
+			delete(got, ds.DefaultRevisionField)
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("%s: %s", ss.name, diff)
+			}
+		}
+	})
+
+	t.Run("EmptyValue", func(t *testing.T) {
+		// Some providers cannot store empty strings, and store null instead.
+		doc := docmap{KeyField: "testSpecialEmptyValue", "s": "", "l": []interface{}{""}}
+		if err := coll.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+		got := docmap{KeyField: doc[KeyField]}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []interface{}{got["s"], got["l"].([]interface{})[0]} {
+			if v != "" && v != nil {
+				t.Errorf("got %+v, want an empty string or nil", v)
+			}
+		}
+	})
 }
 
 var (
@@ -867,6 +1348,7 @@ func testTypeDrivenDecode(t *testing.T, ct CodecTester) {
 		By: []byte{6, 7, 8},
 		P:  &s,
 		T:  milliTime,
+		D:  90*time.Second + 5,
 	}
 
 	check(dsrt, &docstoreRoundTrip{}, ct.DocstoreEncode, ct.DocstoreDecode)
@@ -1045,6 +1527,7 @@ type docstoreRoundTrip struct {
 	M  map[string]bool
 	P  *string
 	T  time.Time
+	D  time.Duration
 }
 
 // TODO(jba): add more fields: structs; embedding.
@@ -1165,6 +1648,173 @@ func testGetQueryKeyField(t *testing.T, coll *ds.Collection, revField string) {
 
 func sortByKeyField(d1, d2 docmap) bool { return d1[KeyField].(string) < d2[KeyField].(string) }
 
+func testExistsQuery(t *testing.T, coll *ds.Collection, revField string) {
+	// Query on the presence of fields, and on boolean fields.
+	ctx := context.Background()
+	docs := []docmap{
+		{KeyField: "ex1", "a": "x", "flag": true},
+		{KeyField: "ex2", "a": nil, "flag": false},
+		{KeyField: "ex3", "flag": true},
+	}
+	al := coll.Actions()
+	for _, d := range docs {
+		al.Put(d)
+	}
+	if err := al.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		q    *ds.Query
+		want []string // keys of the documents
+	}{
+		{"Exists", coll.Query().WhereExists("a"), []string{"ex1", "ex2"}},
+		{"NotExists", coll.Query().WhereNotExists("a"), []string{"ex3"}},
+		{"True", coll.Query().Where("flag", "=", true), []string{"ex1", "ex3"}},
+		{"False", coll.Query().Where("flag", "=", false), []string{"ex2"}},
+		{"ExistsFalse", coll.Query().WhereExists("a").Where("flag", "=", false), []string{"ex2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			iter := tc.q.Get(ctx)
+			defer iter.Stop()
+			var got []string
+			for _, d := range mustCollect(ctx, t, iter) {
+				got = append(got, d[KeyField].(string))
+			}
+			if diff := cmp.Diff(got, tc.want, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func testNestedQuery(t *testing.T, coll *ds.Collection, revField string) {
+	// Query on fields of nested maps, using dotted field paths.
+	ctx := context.Background()
+	docs := []docmap{
+		{KeyField: "nq1", "m": map[string]interface{}{"a": 1, "b": "x"}},
+		{KeyField: "nq2", "m": map[string]interface{}{"a": 2, "c": map[string]interface{}{"d": "y"}}},
+		{KeyField: "nq3", "m": "not a map"},
+		{KeyField: "nq4"},
+	}
+	al := coll.Actions()
+	for _, d := range docs {
+		al.Put(d)
+	}
+	if err := al.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		q    *ds.Query
+		want []string // keys of the documents
+	}{
+		{"Equal", coll.Query().Where("m.a", "=", 1), []string{"nq1"}},
+		{"Greater", coll.Query().Where("m.a", ">", 0), []string{"nq1", "nq2"}},
+		{"String", coll.Query().Where("m.b", "=", "x"), []string{"nq1"}},
+		{"Deep", coll.Query().Where("m.c.d", "=", "y"), []string{"nq2"}},
+		{"Two", coll.Query().Where("m.a", ">=", 1).Where("m.b", "=", "x"), []string{"nq1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			iter := tc.q.Get(ctx)
+			defer iter.Stop()
+			var got []string
+			for _, d := range mustCollect(ctx, t, iter) {
+				got = append(got, d[KeyField].(string))
+			}
+			if diff := cmp.Diff(got, tc.want, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func testFoldQuery(t *testing.T, coll *ds.Collection, revField string) {
+	// Query on strings, ignoring case.
+	ctx := context.Background()
+	docs := []docmap{
+		{KeyField: "fq1", "s": "Hello"},
+		{KeyField: "fq2", "s": "HELLO, world"},
+		{KeyField: "fq3", "s": "help"},
+		{KeyField: "fq4", "s": "a.b"},
+		{KeyField: "fq5", "s": 1},
+	}
+	al := coll.Actions()
+	for _, d := range docs {
+		al.Put(d)
+	}
+	if err := al.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		q    *ds.Query
+		want []string // keys of the documents
+	}{
+		{"Equal", coll.Query().WhereEqualFold("s", "hello"), []string{"fq1"}},
+		{"Prefix", coll.Query().WhereHasPrefixFold("s", "hel"), []string{"fq1", "fq2", "fq3"}},
+		{"PrefixLonger", coll.Query().WhereHasPrefixFold("s", "hello, WORLD"), []string{"fq2"}},
+		{"Special", coll.Query().WhereEqualFold("s", "A.B"), []string{"fq4"}},
+		{"NoMatch", coll.Query().WhereEqualFold("s", "a?b"), nil},
+		{"WithOtherFilter", coll.Query().WhereHasPrefixFold("s", "HEL").Where("s", "<", "Help"), []string{"fq1", "fq2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			iter := tc.q.Get(ctx)
+			defer iter.Stop()
+			var got []string
+			for _, d := range mustCollect(ctx, t, iter) {
+				got = append(got, d[KeyField].(string))
+			}
+			if diff := cmp.Diff(got, tc.want, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func testPrefixQuery(t *testing.T, coll *ds.Collection, revField string) {
+	// Query on the beginnings of strings.
+	ctx := context.Background()
+	docs := []docmap{
+		{KeyField: "pq1", "s": "abc"},
+		{KeyField: "pq2", "s": "abd"},
+		{KeyField: "pq3", "s": "ab"},
+		{KeyField: "pq4", "s": "Abc"},
+		{KeyField: "pq5", "s": "ac"},
+		{KeyField: "pq6", "s": 1},
+	}
+	al := coll.Actions()
+	for _, d := range docs {
+		al.Put(d)
+	}
+	if err := al.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		q    *ds.Query
+		want []string // keys of the documents
+	}{
+		{"Prefix", coll.Query().WhereHasPrefix("s", "ab"), []string{"pq1", "pq2", "pq3"}},
+		{"Whole", coll.Query().WhereHasPrefix("s", "abc"), []string{"pq1"}},
+		{"Empty", coll.Query().WhereHasPrefix("s", ""), []string{"pq1", "pq2", "pq3", "pq4", "pq5"}},
+		{"NoMatch", coll.Query().WhereHasPrefix("s", "abcd"), nil},
+		{"WithOtherFilter", coll.Query().WhereHasPrefix("s", "ab").Where("s", ">", "abc"), []string{"pq2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			iter := tc.q.Get(ctx)
+			defer iter.Stop()
+			var got []string
+			for _, d := range mustCollect(ctx, t, iter) {
+				got = append(got, d[KeyField].(string))
+			}
+			if diff := cmp.Diff(got, tc.want, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
 func testGetQuery(t *testing.T, coll *ds.Collection) {
 	ctx := context.Background()
 	addQueryDocuments(t, coll)
@@ -1419,27 +2069,31 @@ func filterHighScores(hs []*HighScore, f func(*HighScore) bool) []*HighScore {
 }
 
 // clearCollection delete all documents from this collection after test.
-func clearCollection(fataler interface{ Fatalf(string, ...interface{}) }, coll *docstore.Collection) {
-	if err := coll.Query().Delete(context.Background()); err != nil {
-		fataler.Fatalf("%+v", err)
-	}
-}
-
-func forEach(ctx context.Context, iter *ds.DocumentIterator, create func() interface{}, handle func(interface{}) error) error {
-	for {
-		doc := create()
-		err := iter.Next(ctx, doc)
-		if err == io.EOF {
-			break
+// clearCollection deletes all the documents of coll, using a delete query if
+// caps allows, or else deleting the documents that a query returns.
+func clearCollection(fataler interface{ Fatalf(string, ...interface{}) }, coll *docstore.Collection, caps Capabilities) {
+	ctx := context.Background()
+	switch {
+	case caps&DeleteQueries != 0:
+		if err := coll.Query().Delete(ctx); err != nil {
+			fataler.Fatalf("%+v", err)
 		}
-		if err != nil {
-			return err
+	case caps&Queries != 0:
+		actions := coll.Actions()
+		err := coll.Query().Get(ctx).ForEach(ctx,
+			func() interface{} { return docmap{} },
+			func(d interface{}) error { actions.Delete(d.(docmap)); return nil })
+		if err == nil {
+			err = actions.Do(ctx)
 		}
-		if err := handle(doc); err != nil {
-			return err
+		if err != nil {
+			fataler.Fatalf("%+v", err)
 		}
 	}
-	return nil
+}
+
+func forEach(ctx context.Context, iter *ds.DocumentIterator, create func() interface{}, handle func(interface{}) error) error {
+	return iter.ForEach(ctx, create, handle)
 }
 
 func mustCollect(ctx context.Context, t *testing.T, iter *ds.DocumentIterator) []docmap {
@@ -1460,6 +2114,137 @@ func mustCollectHighScores(ctx context.Context, t *testing.T, iter *ds.DocumentI
 	return hs
 }
 
+// testKeysetPagination walks a large result page by page. Docstore has no page
+// tokens, so each page starts after the sort key of the last document of the
+// one before, which works across iterators and collections. Page tokens, when
+// drivers support them, should pass the same checks.
+func testKeysetPagination(t *testing.T, coll *ds.Collection) {
+	ctx := context.Background()
+	const (
+		game     = "Paging"
+		n        = 200
+		pageSize = 17
+	)
+	var players []string
+	for i := 0; i < n; i += 50 {
+		actions := coll.Actions()
+		for j := i; j < i+50; j++ {
+			p := fmt.Sprintf("player%03d", j)
+			players = append(players, p)
+			actions.Put(&HighScore{Game: game, Player: p, Score: j, Time: date(1, 1)})
+		}
+		if err := actions.Do(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		actions := coll.Actions()
+		for _, p := range players {
+			actions.Delete(&HighScore{Game: game, Player: p})
+		}
+		if err := actions.Do(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// page returns the players after the cursor, in order. As in testGetQuery,
+	// the filter on Player cannot be on the empty string.
+	page := func(after string, dir string, limit int) []string {
+		t.Helper()
+		q := coll.Query().Where("Game", "=", game).OrderBy("Player", dir)
+		if dir == ds.Ascending {
+			q = q.Where("Player", ">", after)
+		} else {
+			q = q.Where("Player", "<", after)
+		}
+		if limit > 0 {
+			q = q.Limit(limit)
+		}
+		hs, err := collectHighScores(ctx, q.Get(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ps []string
+		for _, h := range hs {
+			ps = append(ps, h.Player)
+		}
+		return ps
+	}
+	// walk pages through the players from the cursor, and returns them.
+	walk := func(cursor, dir string) []string {
+		t.Helper()
+		var got []string
+		for pages := 0; ; pages++ {
+			if pages > n {
+				t.Fatal("too many pages")
+			}
+			ps := page(cursor, dir, pageSize)
+			if len(ps) > pageSize {
+				t.Fatalf("got a page of %d documents, want at most %d", len(ps), pageSize)
+			}
+			got = append(got, ps...)
+			if len(ps) < pageSize {
+				return got
+			}
+			cursor = ps[len(ps)-1]
+		}
+	}
+	reversed := func(ps []string) []string {
+		r := make([]string, len(ps))
+		for i, p := range ps {
+			r[len(ps)-1-i] = p
+		}
+		return r
+	}
+
+	t.Run("Ascending", func(t *testing.T) {
+		// No document is skipped or repeated.
+		if diff := cmp.Diff(walk(".", ds.Ascending), players); diff != "" {
+			t.Error(diff)
+		}
+	})
+	t.Run("Descending", func(t *testing.T) {
+		if diff := cmp.Diff(walk("~", ds.Descending), reversed(players)); diff != "" {
+			t.Error(diff)
+		}
+	})
+	t.Run("Resume", func(t *testing.T) {
+		// Stop an iterator partway through a page, and resume from the last
+		// document read with a new query.
+		iter := coll.Query().Where("Game", "=", game).Where("Player", ">", ".").
+			OrderBy("Player", ds.Ascending).Limit(pageSize).Get(ctx)
+		var got []string
+		for i := 0; i < 5; i++ {
+			var h HighScore
+			if err := iter.Next(ctx, &h); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, h.Player)
+		}
+		iter.Stop()
+		got = append(got, walk(got[len(got)-1], ds.Ascending)...)
+		if diff := cmp.Diff(got, players); diff != "" {
+			t.Error(diff)
+		}
+	})
+	t.Run("WritesBetweenPages", func(t *testing.T) {
+		// A document written behind the cursor is not seen, and one written
+		// ahead of it is, exactly once.
+		first := page(".", ds.Ascending, pageSize)
+		behind := &HighScore{Game: game, Player: "player000a", Time: date(1, 1)}
+		ahead := &HighScore{Game: game, Player: "player150a", Time: date(1, 1)}
+		if err := coll.Actions().Put(behind).Put(ahead).Do(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer coll.Actions().Delete(behind).Delete(ahead).Do(ctx)
+		got := append(first, walk(first[len(first)-1], ds.Ascending)...)
+		want := append(append(append([]string{}, players[:151]...), ahead.Player), players[151:]...)
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Error(diff)
+		}
+	})
+}
+
 func collectHighScores(ctx context.Context, iter *ds.DocumentIterator) ([]*HighScore, error) {
 	var hs []*HighScore
 	collect := func(h interface{}) error { hs = append(hs, h.(*HighScore)); return nil }
@@ -1632,9 +2417,520 @@ func testUnorderedActions(t *testing.T, coll *ds.Collection, revField string) {
 	}
 }
 
+func testFailFast(t *testing.T, coll *ds.Collection, revField string) {
+	// A Get that precedes a write of the same document runs before the write. When
+	// the Get fails, a fail-fast action list must skip the write.
+	ctx := context.Background()
+	for _, failFast := range []bool{false, true} {
+		key := fmt.Sprintf("testFailFast%t", failFast)
+		actions := coll.Actions().Get(docmap{KeyField: key}).Put(docmap{KeyField: key, "s": "x"})
+		if failFast {
+			actions.FailFast()
+		}
+		err := actions.Do(ctx)
+		alerr, ok := err.(ds.ActionListError)
+		if !ok {
+			t.Fatalf("failFast=%t: got %v (%T), want ActionListError", failFast, err, err)
+		}
+		putCode := gcerrors.OK
+		for _, e := range alerr {
+			switch e.Index {
+			case 0:
+				if gcerrors.Code(e.Err) != gcerrors.NotFound {
+					t.Errorf("failFast=%t: get of missing doc: got %v, want NotFound", failFast, e.Err)
+				}
+			case 1:
+				putCode = gcerrors.Code(e.Err)
+			default:
+				t.Errorf("failFast=%t: unexpected error at index %d: %v", failFast, e.Index, e.Err)
+			}
+		}
+		wantPutCode := gcerrors.OK
+		if failFast {
+			wantPutCode = gcerrors.Canceled
+		}
+		if putCode != wantPutCode {
+			t.Errorf("failFast=%t: put: got code %v, want %v", failFast, putCode, wantPutCode)
+		}
+		err = coll.Get(ctx, docmap{KeyField: key})
+		if exists := err == nil; exists == failFast {
+			t.Errorf("failFast=%t: after Do, document exists is %t, want %t", failFast, exists, !failFast)
+		}
+	}
+
+	// A GetOrCreate of an existing document succeeds, so it must not stop the
+	// other actions of a fail-fast action list.
+	existing := docmap{KeyField: "testFailFastGetOrCreate", "s": "old"}
+	if err := coll.Put(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+	got := docmap{KeyField: existing[KeyField], "s": "new"}
+	reread := docmap{KeyField: existing[KeyField]}
+	actions := coll.Actions().GetOrCreate(got).Get(reread)
+	var keys []string
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("testFailFastGetOrCreate%d", i)
+		keys = append(keys, key)
+		actions.Put(docmap{KeyField: key, "s": "x"})
+	}
+	if err := actions.FailFast().Do(ctx); err != nil {
+		t.Fatalf("GetOrCreate of existing doc with FailFast: %v", err)
+	}
+	if got["s"] != "old" {
+		t.Errorf("GetOrCreate of existing doc: got s = %v, want %q", got["s"], "old")
+	}
+	if reread["s"] != "old" {
+		t.Errorf("Get of existing doc: got s = %v, want %q", reread["s"], "old")
+	}
+	for _, key := range keys {
+		if err := coll.Get(ctx, docmap{KeyField: key}); err != nil {
+			t.Errorf("after GetOrCreate with FailFast, %s: %v", key, err)
+		}
+	}
+}
+
+// testContextDone checks that actions and queries whose context is canceled
+// or past its deadline, before or during the call, return promptly with an
+// error whose code is Canceled or DeadlineExceeded.
+func testContextDone(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+
+	// actions returns an action list with a write and a read of each of n
+	// documents, and an update of another if the collection supports them,
+	// and the number of actions in it.
+	actions := func(t *testing.T, prefix string, n int) (*ds.ActionList, int) {
+		al := coll.Actions()
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("%s%d", prefix, i)
+			al.Put(docmap{KeyField: key, "s": "x"}).Get(docmap{KeyField: key})
+		}
+		if h.Capabilities()&Updates == 0 {
+			return al, 2 * n
+		}
+		key := prefix + "Update"
+		if err := coll.Put(ctx, docmap{KeyField: key, "s": "x"}); err != nil {
+			t.Fatal(err)
+		}
+		return al.Update(docmap{KeyField: key}, ds.Mods{"s": "y"}), 2*n + 1
+	}
+	// checkActions checks that err is an ActionListError whose errors all
+	// have code want, and, if all is true, that every action failed.
+	checkActions := func(t *testing.T, err error, n int, all bool, want gcerrors.ErrorCode) {
+		t.Helper()
+		alerr, ok := err.(ds.ActionListError)
+		if !ok || len(alerr) == 0 {
+			t.Fatalf("got %v (%T), want ActionListError", err, err)
+		}
+		for _, e := range alerr {
+			if got := gcerrors.Code(e.Err); got != want {
+				t.Errorf("action %d: got %v (code %v), want %v", e.Index, e.Err, got, want)
+			}
+		}
+		// An error with a negative index applies to the whole list.
+		if all && alerr[0].Index >= 0 && len(alerr) < n {
+			t.Errorf("%d of %d actions failed, want all", len(alerr), n)
+		}
+	}
+
+	t.Run("ActionsCanceled", func(t *testing.T) {
+		al, n := actions(t, "testContextDoneCanceled", 2)
+		var err error
+		promptly(t, "Do", func() { err = al.Do(canceled) })
+		checkActions(t, err, n, true, gcerrors.Canceled)
+	})
+	t.Run("ActionsExpired", func(t *testing.T) {
+		al, n := actions(t, "testContextDoneExpired", 2)
+		var err error
+		promptly(t, "Do", func() { err = al.Do(expired) })
+		checkActions(t, err, n, true, gcerrors.DeadlineExceeded)
+	})
+	t.Run("ActionsCanceledDuring", func(t *testing.T) {
+		// Cancel the context once Do has started, before the provider is
+		// called. Some actions may still succeed, depending on when the provider
+		// calls BeforeDo.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		al, n := actions(t, "testContextDoneDuring", 5)
+		al.BeforeDo(func(func(interface{}) bool) error {
+			cancel()
+			return nil
+		})
+		var err error
+		promptly(t, "Do", func() { err = al.Do(ctx) })
+		checkActions(t, err, n, false, gcerrors.Canceled)
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		skipUnsupported(t, h, Queries)
+		for i := 0; i < 3; i++ {
+			if err := coll.Put(ctx, docmap{KeyField: fmt.Sprintf("testContextDoneQuery%d", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// next returns the error from the first call to Next on an iterator
+		// for all documents, run with ctx.
+		next := func(ctx context.Context) error {
+			iter := coll.Query().Get(ctx)
+			defer iter.Stop()
+			var err error
+			promptly(t, "Next", func() { err = iter.Next(ctx, docmap{}) })
+			return err
+		}
+		if err := next(canceled); gcerrors.Code(err) != gcerrors.Canceled {
+			t.Errorf("canceled: got %v, want Canceled", err)
+		}
+		if err := next(expired); gcerrors.Code(err) != gcerrors.DeadlineExceeded {
+			t.Errorf("expired: got %v, want DeadlineExceeded", err)
+		}
+
+		// Cancel the context after the first document has been returned. The
+		// iterator may have more documents buffered, but must not return them.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		iter := coll.Query().Get(ctx)
+		defer iter.Stop()
+		if err := iter.Next(ctx, docmap{}); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		var err error
+		promptly(t, "Next", func() { err = iter.Next(ctx, docmap{}) })
+		if gcerrors.Code(err) != gcerrors.Canceled {
+			t.Errorf("canceled during iteration: got %v, want Canceled", err)
+		}
+	})
+}
+
+// promptly calls f, and fails t if f does not return within a few seconds.
+func promptly(t *testing.T, what string, f func()) {
+	t.Helper()
+	const timeout = 10 * time.Second
+	if !returnsWithin(timeout, f) {
+		t.Fatalf("%s did not return within %v after its context was done", what, timeout)
+	}
+}
+
+// returnsWithin calls f in a goroutine, and reports whether it returns within d.
+func returnsWithin(d time.Duration, f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// stressTimeout is how long the stress tests wait for an action list before
+// deciding that it hangs.
+const stressTimeout = 2 * time.Minute
+
+// maxStressDocSize caps the size of the documents written by
+// testLargeDocuments, so that providers with very high limits are not asked to
+// store huge documents.
+const maxStressDocSize = 4 << 20
+
+// doWithin runs al, and fails t if it does not finish within stressTimeout.
+func doWithin(t *testing.T, ctx context.Context, al *ds.ActionList) error {
+	t.Helper()
+	var err error
+	if !returnsWithin(stressTimeout, func() { err = al.Do(ctx) }) {
+		t.Fatalf("action list did not finish within %v", stressTimeout)
+	}
+	return err
+}
+
+// testLargeDocuments checks that documents close to the provider's size limit
+// are stored whole, and that larger ones are rejected with InvalidArgument.
+func testLargeDocuments(t *testing.T, ctx context.Context, h Harness, dc driver.Collection, coll *ds.Collection) {
+	max := dc.MaxDocumentSize()
+	size := maxStressDocSize
+	if max > 0 && max*3/4 < size {
+		// Leave room for the provider's overhead, which the estimate of the
+		// document's size does not include.
+		size = max * 3 / 4
+	}
+
+	t.Run("NearLimit", func(t *testing.T) {
+		key := "testLargeDocumentsNearLimit"
+		s := strings.Repeat("x", size-len(KeyField)-len(key)-len("s"))
+		if err := doWithin(t, ctx, coll.Actions().Put(docmap{KeyField: key, "s": s})); err != nil {
+			t.Fatalf("Put of a document of about %d bytes: %v", size, err)
+		}
+		got := docmap{KeyField: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if g, _ := got["s"].(string); g != s {
+			t.Errorf("got back a string of %d bytes, want the %d bytes written", len(g), len(s))
+		}
+	})
+
+	t.Run("ManyFields", func(t *testing.T) {
+		const nFields = 500
+		key := "testLargeDocumentsManyFields"
+		doc := docmap{KeyField: key}
+		for i := 0; i < nFields; i++ {
+			doc[fmt.Sprintf("f%03d", i)] = int64(i)
+		}
+		if err := doWithin(t, ctx, coll.Actions().Put(doc)); err != nil {
+			t.Fatal(err)
+		}
+		got := docmap{KeyField: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < nFields; i++ {
+			f := fmt.Sprintf("f%03d", i)
+			if n, ok := toInt64(got[f]); !ok || n != int64(i) {
+				t.Fatalf("field %s: got %v, want %d", f, got[f], i)
+			}
+		}
+	})
+
+	t.Run("OverLimit", func(t *testing.T) {
+		if max <= 0 {
+			t.Skip("the provider has no document size limit")
+		}
+		key := "testLargeDocumentsOverLimit"
+		err := doWithin(t, ctx, coll.Actions().Put(docmap{KeyField: key, "s": strings.Repeat("x", max)}))
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("Put of a document over the limit of %d bytes: got %v, want InvalidArgument", max, err)
+		}
+		if err := coll.Get(ctx, docmap{KeyField: key}); gcerrors.Code(err) != gcerrors.NotFound {
+			t.Errorf("Get after a rejected Put: got %v, want NotFound", err)
+		}
+		if h.Capabilities()&Updates == 0 {
+			return
+		}
+		if err := coll.Put(ctx, docmap{KeyField: key, "s": "x"}); err != nil {
+			t.Fatal(err)
+		}
+		err = doWithin(t, ctx, coll.Actions().Update(docmap{KeyField: key}, ds.Mods{"s": strings.Repeat("x", max)}))
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("Update with a value over the limit of %d bytes: got %v, want InvalidArgument", max, err)
+		}
+	})
+}
+
+// testLargeActionLists checks that action lists with hundreds of actions run
+// every action, or fail with errors that say why.
+func testLargeActionLists(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	const n = 250
+	key := func(i int) string { return fmt.Sprintf("testLargeActionLists%03d", i) }
+
+	puts := coll.Actions()
+	for i := 0; i < n; i++ {
+		puts.Put(docmap{KeyField: key(i), "n": i})
+	}
+	if err := doWithin(t, ctx, puts); err != nil {
+		// A provider may limit the number of actions in a list, but must say
+		// so with a meaningful code.
+		for _, e := range err.(ds.ActionListError) {
+			if c := gcerrors.Code(e.Err); c != gcerrors.InvalidArgument && c != gcerrors.ResourceExhausted {
+				t.Errorf("action %d: got %v (code %v), want success, InvalidArgument or ResourceExhausted", e.Index, e.Err, c)
+			}
+		}
+		t.Skipf("the provider rejects action lists of %d writes: %v", n, err)
+	}
+
+	// Every document must have been written.
+	gets := coll.Actions()
+	docs := make([]docmap, n)
+	for i := range docs {
+		docs[i] = docmap{KeyField: key(i)}
+		gets.Get(docs[i])
+	}
+	if err := doWithin(t, ctx, gets); err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range docs {
+		if got, ok := toInt64(d["n"]); !ok || got != int64(i) {
+			t.Fatalf("%s: got n=%v, want %d", key(i), d["n"], i)
+		}
+	}
+
+	// Delete the even documents, and update the odd ones if the collection
+	// supports it.
+	writes := coll.Actions()
+	for i := 0; i < n; i++ {
+		switch {
+		case i%2 == 0:
+			writes.Delete(docmap{KeyField: key(i)})
+		case h.Capabilities()&Updates != 0:
+			writes.Update(docmap{KeyField: key(i)}, ds.Mods{"n": -i})
+		}
+	}
+	if err := doWithin(t, ctx, writes); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		got := docmap{KeyField: key(i)}
+		err := coll.Get(ctx, got)
+		if i%2 == 0 {
+			if gcerrors.Code(err) != gcerrors.NotFound {
+				t.Fatalf("%s: got %v after Delete, want NotFound", key(i), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := int64(i)
+		if h.Capabilities()&Updates != 0 {
+			want = -want
+		}
+		if n, _ := toInt64(got["n"]); n != want {
+			t.Fatalf("%s: got n=%v, want %d", key(i), got["n"], want)
+		}
+	}
+}
+
+// testConcurrentWriters checks that revisions let exactly one of several
+// concurrent writers of the same version of a document succeed.
+func testConcurrentWriters(t *testing.T, coll *ds.Collection, revField string) {
+	ctx := context.Background()
+	const writers = 8
+
+	t.Run("SameRevision", func(t *testing.T) {
+		// All writers replace the document read at the same revision, so only
+		// the first write can succeed.
+		key := "testConcurrentWritersSameRevision"
+		if err := coll.Put(ctx, docmap{KeyField: key, "n": 0}); err != nil {
+			t.Fatal(err)
+		}
+		got := docmap{KeyField: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, writers)
+		for i := 0; i < writers; i++ {
+			i := i
+			doc := clone(got)
+			doc["n"] = i + 1
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = coll.Replace(ctx, doc)
+			}()
+		}
+		wg.Wait()
+		winner := -1
+		for i, err := range errs {
+			switch {
+			case err == nil && winner >= 0:
+				t.Errorf("writers %d and %d both succeeded", winner, i)
+			case err == nil:
+				winner = i
+			case gcerrors.Code(err) != gcerrors.FailedPrecondition:
+				t.Errorf("writer %d: got %v, want FailedPrecondition", i, err)
+			}
+		}
+		if winner < 0 {
+			t.Fatal("no writer succeeded")
+		}
+		got = docmap{KeyField: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := toInt64(got["n"]); n != int64(winner+1) {
+			t.Errorf("got n=%v, want the winning writer's %d", got["n"], winner+1)
+		}
+	})
+
+	t.Run("ReadModifyWrite", func(t *testing.T) {
+		// Each writer increments a counter a number of times, reading it and
+		// writing it back with the revision it read, and retrying when another
+		// writer got there first. No increment may be lost.
+		const increments = 5
+		key := "testConcurrentWritersReadModifyWrite"
+		if err := coll.Put(ctx, docmap{KeyField: key, "n": 0}); err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg        sync.WaitGroup
+			mu        sync.Mutex
+			succeeded int
+			conflicts int
+		)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for done := 0; done < increments; {
+					doc := docmap{KeyField: key}
+					if err := coll.Get(ctx, doc); err != nil {
+						t.Error(err)
+						return
+					}
+					n, ok := toInt64(doc["n"])
+					if !ok {
+						t.Errorf("n is %v (%[1]T), want an integer", doc["n"])
+						return
+					}
+					doc["n"] = n + 1
+					err := coll.Replace(ctx, doc)
+					mu.Lock()
+					switch {
+					case err == nil:
+						succeeded++
+						done++
+					case gcerrors.Code(err) == gcerrors.FailedPrecondition:
+						conflicts++
+					default:
+						t.Error(err)
+						mu.Unlock()
+						return
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
+		if succeeded != writers*increments {
+			t.Errorf("%d writes succeeded, want %d", succeeded, writers*increments)
+		}
+		got := docmap{KeyField: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := toInt64(got["n"]); n != writers*increments {
+			t.Errorf("got n=%v after %d successful writes (%d conflicts), want %d",
+				got["n"], succeeded, conflicts, writers*increments)
+		}
+	})
+}
+
+// toInt64 converts an integer or integral float, as decoded into an
+// interface{} by different drivers, to an int64.
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case float64:
+		return int64(v), v == math.Trunc(v)
+	}
+	return 0, false
+}
+
 // Verify that BeforeDo is invoked, and its as function behaves as expected.
 func testBeforeDo(t *testing.T, newHarness HarnessMaker) {
-	withHarnessAndCollection(t, newHarness, func(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	withHarnessAndCollection(t, newHarness, 0, func(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
 		var called bool
 		beforeDo := func(asFunc func(interface{}) bool) error {
 			called = true
@@ -1686,7 +2982,9 @@ func testBeforeDo(t *testing.T, newHarness HarnessMaker) {
 		check(func(l *docstore.ActionList) { l.Create(doc) })
 		check(func(l *docstore.ActionList) { l.Replace(doc) })
 		check(func(l *docstore.ActionList) { l.Put(doc) })
-		check(func(l *docstore.ActionList) { l.Update(doc, docstore.Mods{"a": 1}) })
+		if h.Capabilities()&Updates != 0 {
+			check(func(l *docstore.ActionList) { l.Update(doc, docstore.Mods{"a": 1}) })
+		}
 		check(func(l *docstore.ActionList) { l.Get(doc) })
 		check(func(l *docstore.ActionList) { l.Delete(doc) })
 	})
@@ -1694,7 +2992,7 @@ func testBeforeDo(t *testing.T, newHarness HarnessMaker) {
 
 // Verify that BeforeQuery is invoked, and its as function behaves as expected.
 func testBeforeQuery(t *testing.T, newHarness HarnessMaker) {
-	withHarnessAndCollection(t, newHarness, func(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	withHarnessAndCollection(t, newHarness, Queries, func(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
 		var called bool
 		beforeQuery := func(asFunc func(interface{}) bool) error {
 			called = true
@@ -0,0 +1,330 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drivertest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// codecFuzzSeeds is the number of random documents that the conformance tests
+// round-trip through a provider's codec.
+const codecFuzzSeeds = 200
+
+// testCodecFuzz round-trips random documents through the docstore codec of ct.
+// It complements the fixed cases of testTypeDrivenDecode and testBlindDecode.
+func testCodecFuzz(t *testing.T, ct CodecTester) {
+	if ct == nil {
+		t.Skip("no CodecTester")
+	}
+	for seed := int64(1); seed <= codecFuzzSeeds && !t.Failed(); seed++ {
+		checkCodecRoundTrip(t, ct, seed)
+	}
+}
+
+// checkCodecRoundTrip encodes and decodes the documents generated from seed.
+func checkCodecRoundTrip(t *testing.T, ct CodecTester, seed int64) {
+	t.Helper()
+	g := &docGen{r: rand.New(rand.NewSource(seed))}
+
+	// Decoding into the type that was encoded must reproduce the document.
+	in := g.fuzzDoc(0)
+	enc, err := ct.DocstoreEncode(in)
+	if err != nil {
+		t.Fatalf("seed %d: encoding %+v: %v", seed, in, err)
+	}
+	out := &fuzzDoc{}
+	if err := ct.DocstoreDecode(enc, out); err != nil {
+		t.Fatalf("seed %d: decoding %+v: %v", seed, in, err)
+	}
+	if diff := cmp.Diff(in, out, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("seed %d: type-driven round trip (-in +out):\n%s", seed, diff)
+	}
+
+	// Decoding into a map must produce equivalent values, though their types
+	// may differ: see testBlindDecode.
+	m := g.doc(0)
+	enc, err = ct.DocstoreEncode(m)
+	if err != nil {
+		t.Fatalf("seed %d: encoding %v: %v", seed, m, err)
+	}
+	got := map[string]interface{}{}
+	if err := ct.DocstoreDecode(enc, got); err != nil {
+		t.Fatalf("seed %d: decoding %v: %v", seed, m, err)
+	}
+	if msg := blindMismatch("", m, got); msg != "" {
+		t.Errorf("seed %d: blind round trip of %v: %s", seed, m, msg)
+	}
+}
+
+// fuzzDoc is the type of the documents that checkCodecRoundTrip decodes by
+// type.
+type fuzzDoc struct {
+	I  int64
+	F  float64
+	S  string
+	B  bool
+	By []byte
+	T  time.Time
+	L  []string
+	M  map[string]int64
+	N  *fuzzDoc
+}
+
+// maxFuzzDepth limits the nesting of generated documents.
+const maxFuzzDepth = 3
+
+// docGen generates random documents. It sticks to values that every
+// provider represents exactly: integers that fit in a float64, finite
+// floats, strings without NUL bytes, and times in milliseconds between 1970
+// and 2100.
+type docGen struct {
+	r *rand.Rand
+}
+
+func (g *docGen) fuzzDoc(depth int) *fuzzDoc {
+	d := &fuzzDoc{
+		I:  g.int(),
+		F:  g.float(),
+		S:  g.string(),
+		B:  g.r.Intn(2) == 0,
+		By: g.bytes(),
+		T:  g.time(),
+	}
+	for i := g.r.Intn(4); i > 0; i-- {
+		d.L = append(d.L, g.string())
+	}
+	if n := g.r.Intn(4); n > 0 {
+		d.M = map[string]int64{}
+		for i := 0; i < n; i++ {
+			d.M[g.key()] = g.int()
+		}
+	}
+	if depth < maxFuzzDepth && g.r.Intn(2) == 0 {
+		d.N = g.fuzzDoc(depth + 1)
+	}
+	return d
+}
+
+// doc returns a random map document.
+func (g *docGen) doc(depth int) map[string]interface{} {
+	m := map[string]interface{}{}
+	for i := g.r.Intn(6); i > 0; i-- {
+		m[g.key()] = g.value(depth)
+	}
+	return m
+}
+
+func (g *docGen) value(depth int) interface{} {
+	kinds := 7
+	if depth < maxFuzzDepth {
+		kinds += 2 // maps and lists
+	}
+	switch g.r.Intn(kinds) {
+	case 0:
+		return nil
+	case 1:
+		return g.r.Intn(2) == 0
+	case 2:
+		return g.int()
+	case 3:
+		return g.float()
+	case 4:
+		return g.string()
+	case 5:
+		return g.bytes()
+	case 6:
+		return g.time()
+	case 7:
+		return g.doc(depth + 1)
+	default:
+		var l []interface{}
+		for i := g.r.Intn(4); i > 0; i-- {
+			l = append(l, g.value(depth+1))
+		}
+		return l
+	}
+}
+
+func (g *docGen) int() int64 {
+	n := g.r.Int63n(1 << 53)
+	if g.r.Intn(2) == 0 {
+		n = -n
+	}
+	// Favor small numbers, which some codecs encode differently.
+	if g.r.Intn(2) == 0 {
+		n %= 1000
+	}
+	return n
+}
+
+func (g *docGen) float() float64 {
+	f := g.r.NormFloat64() * math.Pow(10, float64(g.r.Intn(41)-20))
+	if f == 0 {
+		return 0 // not -0
+	}
+	return f
+}
+
+// fuzzRunes are the runes that strings are made of, besides ASCII.
+var fuzzRunes = []rune("éßΩжשع世界😀\u200b\ufffd")
+
+func (g *docGen) string() string {
+	rs := make([]rune, g.r.Intn(12))
+	for i := range rs {
+		if g.r.Intn(4) == 0 {
+			rs[i] = fuzzRunes[g.r.Intn(len(fuzzRunes))]
+		} else {
+			rs[i] = rune(1 + g.r.Intn(0x7f))
+		}
+	}
+	return string(rs)
+}
+
+// key returns a random field name. Field names are letters and digits, since
+// some providers restrict the other characters in them.
+func (g *docGen) key() string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 1+g.r.Intn(8))
+	b[0] = chars[g.r.Intn(52)]
+	for i := 1; i < len(b); i++ {
+		b[i] = chars[g.r.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+func (g *docGen) bytes() []byte {
+	b := make([]byte, g.r.Intn(10))
+	g.r.Read(b)
+	return b
+}
+
+func (g *docGen) time() time.Time {
+	const end = 4102444800000 // 2100-01-01, in milliseconds
+	return time.Unix(0, g.r.Int63n(end)*int64(time.Millisecond)).UTC()
+}
+
+// blindMismatch returns a description of the first difference between want, a
+// value generated by docGen, and got, its round trip through a codec, or ""
+// if they are equivalent. Numbers are equivalent if they are equal, whatever
+// their types; times may also be decoded as RFC 3339 strings, byte slices as
+// base64 strings, and empty strings, lists and maps as nil.
+func blindMismatch(path string, want, got interface{}) string {
+	mismatch := func() string {
+		return fmt.Sprintf("at %q: got %v (%[2]T), want %v (%[3]T)", path, got, want)
+	}
+	switch w := want.(type) {
+	case nil, bool:
+		if got != want {
+			return mismatch()
+		}
+	case string:
+		// DynamoDB, for one, stores the empty string as null.
+		if got != want && !(got == nil && w == "") {
+			return mismatch()
+		}
+	case int64:
+		if f, ok := toFloat64(got); !ok || f != float64(w) {
+			return mismatch()
+		}
+	case float64:
+		if f, ok := toFloat64(got); !ok || f != w {
+			return mismatch()
+		}
+	case []byte:
+		switch g := got.(type) {
+		case []byte:
+			if !bytes.Equal(g, w) {
+				return mismatch()
+			}
+		case string:
+			if g != base64.StdEncoding.EncodeToString(w) {
+				return mismatch()
+			}
+		case nil:
+			if len(w) > 0 {
+				return mismatch()
+			}
+		default:
+			return mismatch()
+		}
+	case time.Time:
+		switch g := got.(type) {
+		case time.Time:
+			if !g.Equal(w) {
+				return mismatch()
+			}
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, g); err != nil || !t.Equal(w) {
+				return mismatch()
+			}
+		default:
+			return mismatch()
+		}
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok && !(got == nil && len(w) == 0) {
+			return mismatch()
+		}
+		if len(g) != len(w) {
+			return mismatch()
+		}
+		for k, v := range w {
+			if msg := blindMismatch(path+"."+k, v, g[k]); msg != "" {
+				return msg
+			}
+		}
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok && !(got == nil && len(w) == 0) {
+			return mismatch()
+		}
+		if len(g) != len(w) {
+			return mismatch()
+		}
+		for i, v := range w {
+			if msg := blindMismatch(fmt.Sprintf("%s[%d]", path, i), v, g[i]); msg != "" {
+				return msg
+			}
+		}
+	default:
+		return fmt.Sprintf("at %q: unexpected generated value %v (%[2]T)", path, want)
+	}
+	return ""
+}
+
+// toFloat64 converts a decoded number to a float64.
+func toFloat64(x interface{}) (float64, bool) {
+	v := reflect.ValueOf(x)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	default:
+		return 0, false
+	}
+}
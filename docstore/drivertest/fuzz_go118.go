@@ -0,0 +1,33 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package drivertest
+
+import "testing"
+
+// FuzzCodec runs the round trips of the conformance tests with seeds chosen
+// by the fuzzing engine. Call it from a fuzz target in a provider's tests:
+//
+//	func FuzzCodec(f *testing.F) { drivertest.FuzzCodec(f, codecTester{}) }
+//
+// and run it with go test -fuzz FuzzCodec.
+func FuzzCodec(f *testing.F, ct CodecTester) {
+	for seed := int64(1); seed <= 10; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) { checkCodecRoundTrip(t, ct, seed) })
+}
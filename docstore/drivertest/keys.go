@@ -0,0 +1,255 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drivertest
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ds "gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/gcerrors"
+)
+
+// AlternateKeyHarness is an optional interface for harnesses whose collections
+// can have keys that are not strings. The AlternateKeys conformance tests are
+// skipped for harnesses that do not implement it.
+type AlternateKeyHarness interface {
+	// MakeIntKeyCollection makes a driver.Collection for testing, whose single
+	// primary key field, named drivertest.KeyField, holds integers. Integer
+	// keys of different Go types but equal values must refer to the same
+	// document.
+	MakeIntKeyCollection(context.Context) (driver.Collection, error)
+
+	// MakeStructKeyCollection makes a driver.Collection for testing. The
+	// collection will consist entirely of Ranking structs, whose key is the
+	// struct in their ID field. Use drivertest.RankingKey as the key function.
+	MakeStructKeyCollection(context.Context) (driver.Collection, error)
+}
+
+// RankingID is the composite key of a Ranking.
+type RankingID struct {
+	Game string
+	Rank int
+}
+
+// Ranking is the document type of the collections made by
+// AlternateKeyHarness.MakeStructKeyCollection.
+type Ranking struct {
+	ID               RankingID
+	Player           string
+	DocstoreRevision interface{}
+}
+
+// RankingKey returns the key of a Ranking, its ID.
+func RankingKey(doc ds.Document) interface{} {
+	return doc.(*Ranking).ID
+}
+
+// intKeyDoc is a document of a collection made by
+// AlternateKeyHarness.MakeIntKeyCollection.
+type intKeyDoc struct {
+	Name             int64 `docstore:"name"` // must be KeyField
+	S                string
+	DocstoreRevision interface{}
+}
+
+// testAlternateKeys tests collections whose keys are integers or structs.
+func testAlternateKeys(t *testing.T, newHarness HarnessMaker) {
+	ctx := context.Background()
+	h, err := newHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ah, ok := h.(AlternateKeyHarness)
+	if !ok {
+		t.Skip("harness does not implement AlternateKeyHarness")
+	}
+	t.Run("Int", func(t *testing.T) {
+		dc, err := ah.MakeIntKeyCollection(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coll := ds.NewCollection(dc)
+		defer coll.Close()
+		clearCollection(t, coll, h.Capabilities())
+		testIntKeys(t, ctx, coll, h.Capabilities())
+	})
+	t.Run("Struct", func(t *testing.T) {
+		dc, err := ah.MakeStructKeyCollection(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coll := ds.NewCollection(dc)
+		defer coll.Close()
+		testStructKeys(t, ctx, coll, h.Capabilities())
+	})
+}
+
+// testIntKeys checks that documents with integer keys can be written and read
+// with keys of any integer type, and are not confused with one another.
+func testIntKeys(t *testing.T, ctx context.Context, coll *ds.Collection, caps Capabilities) {
+	defer func() {
+		if err := coll.Actions().Delete(docmap{KeyField: 1}).Delete(docmap{KeyField: 2}).Delete(docmap{KeyField: 10}).Do(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// get returns the value of S in the document with the given key.
+	get := func(key interface{}) (string, error) {
+		doc := docmap{KeyField: key}
+		if err := coll.Get(ctx, doc); err != nil {
+			return "", err
+		}
+		s, _ := doc["S"].(string)
+		return s, nil
+	}
+	check := func(key interface{}, want string) {
+		t.Helper()
+		got, err := get(key)
+		if err != nil {
+			t.Errorf("Get %v (%[1]T): %v", key, err)
+		} else if got != want {
+			t.Errorf("Get %v (%[1]T): got %q, want %q", key, got, want)
+		}
+	}
+
+	for key, s := range map[int]string{1: "one", 2: "two", 10: "ten"} {
+		if err := coll.Put(ctx, docmap{KeyField: key, "S": s}); err != nil {
+			t.Fatalf("Put %d: %v", key, err)
+		}
+	}
+	check(int64(1), "one")
+	check(int32(2), "two")
+	check(uint8(10), "ten")
+	got := &intKeyDoc{Name: 2}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.S != "two" {
+		t.Errorf("Get into a struct: got %q, want %q", got.S, "two")
+	}
+
+	// Writes with keys of other types affect the same documents.
+	if err := coll.Replace(ctx, &intKeyDoc{Name: 2, S: "deux"}); err != nil {
+		t.Fatal(err)
+	}
+	check(2, "deux")
+	if caps&Updates != 0 {
+		if err := coll.Update(ctx, docmap{KeyField: int16(1)}, ds.Mods{"S": "un"}); err != nil {
+			t.Fatal(err)
+		}
+		check(1, "un")
+	}
+	if err := coll.Delete(ctx, docmap{KeyField: int64(10)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(10); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("Get after Delete: got %v, want NotFound", err)
+	}
+
+	if caps&Queries != 0 {
+		iter := coll.Query().Where(KeyField, ">", 1).Get(ctx)
+		defer iter.Stop()
+		docs := mustCollect(ctx, t, iter)
+		if len(docs) != 1 {
+			t.Fatalf("query for keys > 1: got %v, want one document", docs)
+		}
+		if k, ok := toFloat64(docs[0][KeyField]); !ok || k != 2 {
+			t.Errorf("query for keys > 1: got key %v (%[1]T), want 2", docs[0][KeyField])
+		}
+	}
+}
+
+// testStructKeys checks that documents with struct keys can be written and
+// read, and that keys that differ in one field are not confused.
+func testStructKeys(t *testing.T, ctx context.Context, coll *ds.Collection, caps Capabilities) {
+	ids := []RankingID{{"Chess", 1}, {"Chess", 2}, {"Go", 1}}
+	deleteAll := func() {
+		actions := coll.Actions()
+		for _, id := range ids {
+			actions.Delete(&Ranking{ID: id})
+		}
+		if err := actions.Do(ctx); err != nil {
+			t.Error(err)
+		}
+	}
+	deleteAll()
+	defer deleteAll()
+
+	check := func(id RankingID, want string) {
+		t.Helper()
+		got := &Ranking{ID: id}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Errorf("Get %+v: %v", id, err)
+		} else if got.Player != want {
+			t.Errorf("Get %+v: got player %q, want %q", id, got.Player, want)
+		}
+	}
+
+	actions := coll.Actions()
+	for i, p := range []string{"alice", "bob", "carol"} {
+		actions.Put(&Ranking{ID: ids[i], Player: p})
+	}
+	if err := actions.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(ids[0], "alice")
+	check(ids[1], "bob")
+	check(ids[2], "carol")
+
+	if err := coll.Put(ctx, &Ranking{ID: ids[1], Player: "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	check(ids[1], "dave")
+	want2 := "carol"
+	if caps&Updates != 0 {
+		if err := coll.Update(ctx, &Ranking{ID: ids[2]}, ds.Mods{"Player": "erin"}); err != nil {
+			t.Fatal(err)
+		}
+		want2 = "erin"
+		check(ids[2], want2)
+	}
+	if err := coll.Delete(ctx, &Ranking{ID: ids[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Get(ctx, &Ranking{ID: ids[0]}); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("Get after Delete: got %v, want NotFound", err)
+	}
+	// A key that differs only in Game is a different document.
+	check(ids[2], want2)
+
+	if caps&Queries != 0 {
+		iter := coll.Query().Where("ID.Game", "=", "Chess").Get(ctx)
+		defer iter.Stop()
+		var got []RankingID
+		for {
+			var r Ranking
+			if err := iter.Next(ctx, &r); err != nil {
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+				break
+			}
+			got = append(got, r.ID)
+		}
+		if want := []RankingID{ids[1]}; !cmp.Equal(got, want) {
+			t.Errorf("query for Chess: got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ds "gocloud.dev/docstore"
+)
+
+// civilDate is a date without a time zone, like civil.Date. Docstore cannot
+// encode it without its MarshalDocstore method, because its fields are
+// unexported.
+type civilDate struct{ year, month, day int }
+
+func (d civilDate) MarshalDocstore() (interface{}, error) {
+	return fmt.Sprintf("%04d-%02d-%02d", d.year, d.month, d.day), nil
+}
+
+func (d *civilDate) UnmarshalDocstore(decode func(interface{}) error) error {
+	var s string
+	if err := decode(&s); err != nil {
+		return err
+	}
+	_, err := fmt.Sscanf(s, "%d-%d-%d", &d.year, &d.month, &d.day)
+	return err
+}
+
+type marshalDoc struct {
+	Name             string `docstore:"name"`
+	DocstoreRevision interface{}
+
+	Date  civilDate
+	Dates []civilDate
+}
+
+// testMarshaler checks that values of a type that implements
+// DocstoreMarshaler are stored as the values its MarshalDocstore method
+// returns, and can be used in Update mods and queries.
+func testMarshaler(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	const key = "testMarshaler"
+	defer func() {
+		if err := coll.Delete(ctx, docmap{KeyField: key}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	doc := &marshalDoc{
+		Name:  key,
+		Date:  civilDate{2019, 7, 4},
+		Dates: []civilDate{{2020, 1, 2}},
+	}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	got := docmap{KeyField: key}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got["Date"] != "2019-07-04" {
+		t.Errorf(`field "Date": got %v, want "2019-07-04"`, got["Date"])
+	}
+	if diff := cmp.Diff(got["Dates"], []interface{}{"2020-01-02"}); diff != "" {
+		t.Errorf(`field "Dates" (got=-, want=+):\n%s`, diff)
+	}
+
+	check := func(want *marshalDoc) {
+		t.Helper()
+		got := &marshalDoc{Name: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		want.DocstoreRevision = got.DocstoreRevision
+		if diff := cmp.Diff(got, want, cmp.AllowUnexported(civilDate{})); diff != "" {
+			t.Errorf("Get into a struct (got=-, want=+):\n%s", diff)
+		}
+	}
+	check(doc)
+
+	if h.Capabilities()&Updates != 0 {
+		d := civilDate{2019, 12, 25}
+		if err := coll.Update(ctx, &marshalDoc{Name: key}, ds.Mods{"Date": d}); err != nil {
+			t.Fatal(err)
+		}
+		doc.Date = d
+		check(doc)
+	}
+
+	if h.Capabilities()&Queries != 0 {
+		iter := coll.Query().Where("Date", ">", civilDate{2019, 1, 1}).Get(ctx)
+		defer iter.Stop()
+		var got marshalDoc
+		if err := iter.Next(ctx, &got); err != nil {
+			t.Fatalf("query with a marshaled value: %v", err)
+		}
+		if got.Name != key {
+			t.Errorf("query with a marshaled value: got %q, want %q", got.Name, key)
+		}
+	}
+}
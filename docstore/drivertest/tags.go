@@ -0,0 +1,209 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drivertest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ds "gocloud.dev/docstore"
+)
+
+// omitEmptyDoc is a document whose fields are renamed, and omitted when empty.
+type omitEmptyDoc struct {
+	Name             string `docstore:"name"`
+	DocstoreRevision interface{}
+	Etag             interface{}
+
+	S    string            `docstore:"s,omitempty"`
+	I    int               `docstore:"i,omitempty"`
+	M    map[string]string `docstore:"m,omitempty"`
+	P    *int              `docstore:"p,omitempty"`
+	Kept int               `docstore:"kept"`
+}
+
+// testOmitEmpty checks that fields with the omitempty tag option are stored
+// under their tag names, and not stored at all when they are empty.
+func testOmitEmpty(t *testing.T, coll *ds.Collection, revField string) {
+	ctx := context.Background()
+	const key = "testOmitEmpty"
+	omitted := []string{"s", "i", "m", "p"}
+	defer func() {
+		if err := coll.Delete(ctx, docmap{KeyField: key}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// getMap returns the stored document as a map.
+	getMap := func(fps ...ds.FieldPath) docmap {
+		t.Helper()
+		got := docmap{KeyField: key}
+		if err := coll.Get(ctx, got, fps...); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	seven := 7
+	full := &omitEmptyDoc{Name: key, S: "x", I: 1, M: map[string]string{"a": "b"}, P: &seven, Kept: 2}
+	if err := coll.Put(ctx, full); err != nil {
+		t.Fatal(err)
+	}
+	got := getMap()
+	for _, f := range append(omitted, "kept") {
+		if _, ok := got[f]; !ok {
+			t.Errorf("non-empty field %q was not stored under its tag name: got %v", f, got)
+		}
+	}
+
+	// Put replaces the whole document, so the fields that are now empty are
+	// removed.
+	if err := coll.Put(ctx, &omitEmptyDoc{Name: key}); err != nil {
+		t.Fatal(err)
+	}
+	got = getMap()
+	for _, f := range omitted {
+		if v, ok := got[f]; ok {
+			t.Errorf("empty field %q was stored with value %v", f, v)
+		}
+	}
+	if _, ok := got["kept"]; !ok {
+		t.Errorf("empty field without omitempty was not stored: got %v", got)
+	}
+
+	// Getting an omitted field by its path is not an error; the field is
+	// absent from a map, and zero in a struct.
+	got = getMap("s", "kept")
+	if v, ok := got["s"]; ok {
+		t.Errorf("Get with field path: got omitted field with value %v", v)
+	}
+	gotDoc := &omitEmptyDoc{Name: key}
+	if err := coll.Get(ctx, gotDoc, "s", "i", "kept"); err != nil {
+		t.Fatal(err)
+	}
+	if gotDoc.S != "" || gotDoc.I != 0 {
+		t.Errorf("Get into a struct with field paths: got %+v, want empty fields", gotDoc)
+	}
+
+	gotDoc = &omitEmptyDoc{Name: key}
+	if err := coll.Get(ctx, gotDoc); err != nil {
+		t.Fatal(err)
+	}
+	want := &omitEmptyDoc{Name: key, DocstoreRevision: gotDoc.DocstoreRevision, Etag: gotDoc.Etag}
+	if diff := cmp.Diff(gotDoc, want); diff != "" {
+		t.Errorf("Get into a struct (got=-, want=+):\n%s", diff)
+	}
+}
+
+// embeddingDoc is a document with struct fields that are flattened into it, or
+// nested, by default or because of the inline and noinline tag options.
+type embeddingDoc struct {
+	Name             string `docstore:"name"`
+	DocstoreRevision interface{}
+
+	embStats                         // flattened
+	RankingID `docstore:",noinline"` // stored in the field "RankingID"
+	Loc       embLoc                 `docstore:",inline"` // flattened
+	Nested    embLoc                 // stored in the field "Nested"
+}
+
+type embStats struct{ Wins, Losses int }
+
+type embLoc struct{ City string }
+
+// testEmbedding checks that all providers store embedded and inlined structs in
+// the same document shape.
+func testEmbedding(t *testing.T, ctx context.Context, h Harness, coll *ds.Collection) {
+	const key = "testEmbedding"
+	defer func() {
+		if err := coll.Delete(ctx, docmap{KeyField: key}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	doc := &embeddingDoc{
+		Name:      key,
+		embStats:  embStats{Wins: 3, Losses: 1},
+		RankingID: RankingID{Game: "chess", Rank: 2},
+		Loc:       embLoc{City: "Paris"},
+		Nested:    embLoc{City: "Lyon"},
+	}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	got := docmap{KeyField: key}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"Wins", "Losses"} {
+		if n, ok := toFloat64(got[f]); !ok || n == 0 {
+			t.Errorf("field %q of an embedded struct: got %v, want it flattened into the document", f, got[f])
+		}
+	}
+	if got["City"] != "Paris" {
+		t.Errorf(`field "City" of an inlined struct: got %v, want "Paris"`, got["City"])
+	}
+	// nested returns the value of the field f of the map in got[name].
+	nested := func(name, f string) interface{} {
+		m, ok := got[name].(map[string]interface{})
+		if !ok {
+			t.Errorf("field %q: got %v (%[2]T), want a nested map", name, got[name])
+			return nil
+		}
+		return m[f]
+	}
+	if g := nested("RankingID", "Game"); g != "chess" {
+		t.Errorf(`field "RankingID.Game" of a noinline struct: got %v, want "chess"`, g)
+	}
+	if g := nested("Nested", "City"); g != "Lyon" {
+		t.Errorf(`field "Nested.City": got %v, want "Lyon"`, g)
+	}
+
+	check := func(want *embeddingDoc) {
+		t.Helper()
+		got := &embeddingDoc{Name: key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		want.DocstoreRevision = got.DocstoreRevision
+		if diff := cmp.Diff(got, want, cmp.AllowUnexported(embeddingDoc{})); diff != "" {
+			t.Errorf("Get into a struct (got=-, want=+):\n%s", diff)
+		}
+	}
+	check(doc)
+
+	if h.Capabilities()&Updates != 0 {
+		if err := coll.Update(ctx, &embeddingDoc{Name: key}, ds.Mods{"Wins": 4, "RankingID.Rank": 1}); err != nil {
+			t.Fatal(err)
+		}
+		doc.Wins = 4
+		doc.Rank = 1
+		check(doc)
+	}
+
+	if h.Capabilities()&Queries != 0 {
+		iter := coll.Query().Where("City", "=", "Paris").Get(ctx)
+		defer iter.Stop()
+		var got embeddingDoc
+		if err := iter.Next(ctx, &got); err != nil {
+			t.Fatalf("query on an inlined field: %v", err)
+		}
+		if got.Name != key {
+			t.Errorf("query on an inlined field: got %q, want %q", got.Name, key)
+		}
+	}
+}
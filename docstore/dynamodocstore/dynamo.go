@@ -26,6 +26,16 @@
 // URLOpener.
 // See https://gocloud.dev/concepts/urls/ for background information.
 //
+// Throttling
+//
+// When DynamoDB throttles a request, or leaves some keys of a BatchGetItem
+// unprocessed, dynamodocstore retries the request, or only the unprocessed
+// keys, with exponential backoff; see Options.MaxRetries. This is in addition
+// to the retries of the AWS SDK. Each action of an action list succeeds or
+// fails on its own: an action whose request was still throttled after the
+// last retry fails with a ResourceExhausted error, while the other actions of
+// the list keep their results.
+//
 // As
 //
 // dynamodocstore exposes the following types for As:
@@ -44,17 +54,21 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
 	dyn "github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	gax "github.com/googleapis/gax-go"
 	gcaws "gocloud.dev/aws"
 	"gocloud.dev/docstore"
 	"gocloud.dev/docstore/driver"
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/internal/retry"
 )
 
 func init() {
@@ -194,8 +208,27 @@ type Options struct {
 	// The maximum number of concurrent goroutines started for a single call to
 	// ActionList.Do. If less than 1, there is no limit.
 	MaxOutstandingActionRPCs int
+
+	// PartitionKeyTemplate, if non-nil, builds the partition key attribute from
+	// document fields, for tables that hold several kinds of entity (single-table
+	// design). The attribute is not a field of the collection's documents: it is
+	// added to every item written and removed from every item read.
+	// If the template has a single field, a value for it is generated, like a
+	// partition key, for documents created without one.
+	PartitionKeyTemplate *KeyTemplate
+
+	// SortKeyTemplate is like PartitionKeyTemplate, for the sort key attribute.
+	SortKeyTemplate *KeyTemplate
+
+	// MaxRetries is the most times that a throttled request, or the keys that
+	// a BatchGetItem left unprocessed, are retried. Defaults to
+	// DefaultMaxRetries. If negative, requests are not retried.
+	MaxRetries int
 }
 
+// DefaultMaxRetries is the number of retries when Options.MaxRetries is zero.
+const DefaultMaxRetries = 8
+
 // RunQueryFunc is the type of the function passed to RunQueryFallback.
 type RunQueryFunc func(context.Context, *driver.Query) (driver.DocumentIterator, error)
 
@@ -231,6 +264,9 @@ func newCollection(db *dyn.DynamoDB, tableName, partitionKey, sortKey string, op
 
 // Key returns a two-element array with the partition key and sort key, if any.
 func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.hasKeyTemplates() {
+		return c.templateKey(doc)
+	}
 	var keys [2]interface{}
 	var err error
 	keys[0], err = doc.GetField(c.partitionKey)
@@ -245,14 +281,31 @@ func (c *collection) Key(doc driver.Document) (interface{}, error) {
 
 func (c *collection) RevisionField() string { return c.opts.RevisionField }
 
+// MaxDocumentSize is the largest item DynamoDB accepts, in bytes.
+// See https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/Limits.html.
+const MaxDocumentSize = 400 * 1024
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return MaxDocumentSize }
+
 func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
 	errs := make([]error, len(actions))
 	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
 	c.runGets(ctx, beforeGets, errs, opts)
+	if driver.ShouldStop(opts, errs) {
+		driver.SkipActions(gets, errs)
+		driver.SkipActions(writes, errs)
+		driver.SkipActions(afterGets, errs)
+		return driver.NewActionListError(errs)
+	}
 	ch := make(chan struct{})
 	go func() { defer close(ch); c.runWrites(ctx, writes, errs, opts) }()
 	c.runGets(ctx, gets, errs, opts)
 	<-ch
+	if driver.ShouldStop(opts, errs) {
+		driver.SkipActions(afterGets, errs)
+		return driver.NewActionListError(errs)
+	}
 	c.runGets(ctx, afterGets, errs, opts)
 	return driver.NewActionListError(errs)
 }
@@ -291,7 +344,7 @@ func (c *collection) batchGet(ctx context.Context, gets []*driver.Action, errs [
 
 	keys := make([]map[string]*dyn.AttributeValue, 0, end-start+1)
 	for i := start; i <= end; i++ {
-		av, err := encodeDocKeyFields(gets[i].Doc, c.partitionKey, c.sortKey)
+		av, err := c.encodeKey(gets[i].Doc)
 		if err != nil {
 			errs[gets[i].Index] = err
 		}
@@ -339,41 +392,99 @@ func (c *collection) batchGet(ctx context.Context, gets []*driver.Action, errs [
 			return
 		}
 	}
-	out, err := c.db.BatchGetItemWithContext(ctx, in)
-	if err != nil {
-		setErr(err)
-		return
-	}
 	found := make([]bool, end-start+1)
 	am := mapActionIndices(gets, start, end)
-	for _, item := range out.Responses[c.table] {
-		if item != nil {
-			key := map[string]interface{}{c.partitionKey: nil}
-			if c.sortKey != "" {
-				key[c.sortKey] = nil
-			}
-			keysOnly, err := driver.NewDocument(key)
-			if err != nil {
-				panic(err)
-			}
-			err = decodeDoc(&dyn.AttributeValue{M: item}, keysOnly)
-			if err != nil {
-				continue
+	// DynamoDB may return only some of the items, leaving the keys of the rest
+	// unprocessed. Only those keys are requested again.
+	var unprocessed map[interface{}]bool
+	err := c.retry(ctx, func() error {
+		out, err := c.db.BatchGetItemWithContext(ctx, in)
+		if err != nil {
+			return err
+		}
+		for _, item := range out.Responses[c.table] {
+			if item != nil {
+				decKey, err := c.itemKey(item)
+				if err != nil {
+					continue
+				}
+				i := am[decKey]
+				errs[gets[i].Index] = c.decodeItem(item, gets[i].Doc)
+				found[i-start] = true
 			}
-			decKey, err := c.Key(keysOnly)
-			if err != nil {
-				continue
+		}
+		ka := out.UnprocessedKeys[c.table]
+		if ka == nil || len(ka.Keys) == 0 {
+			return nil
+		}
+		unprocessed = map[interface{}]bool{}
+		for _, k := range ka.Keys {
+			if decKey, err := c.itemKey(k); err == nil {
+				unprocessed[decKey] = true
 			}
-			i := am[decKey]
-			errs[gets[i].Index] = decodeDoc(&dyn.AttributeValue{M: item}, gets[i].Doc)
-			found[i-start] = true
 		}
-	}
+		in = &dyn.BatchGetItemInput{RequestItems: map[string]*dyn.KeysAndAttributes{c.table: ka}}
+		return errUnprocessed
+	})
 	for delta, f := range found {
-		if !f {
-			errs[gets[start+delta].Index] = gcerr.Newf(gcerr.NotFound, nil, "item %v not found", gets[start+delta].Doc)
+		if f {
+			continue
+		}
+		a := gets[start+delta]
+		switch {
+		case err == errUnprocessed && unprocessed[a.Key]:
+			errs[a.Index] = gcerr.Newf(gcerr.ResourceExhausted, nil, "item %v not processed after %d retries", a.Doc, c.maxRetries())
+		case err != nil && err != errUnprocessed:
+			errs[a.Index] = err
+		default:
+			errs[a.Index] = gcerr.Newf(gcerr.NotFound, nil, "item %v not found", a.Doc)
+		}
+	}
+}
+
+// errUnprocessed is returned to retry when a BatchGetItem leaves keys
+// unprocessed.
+var errUnprocessed = errors.New("unprocessed keys")
+
+func (c *collection) maxRetries() int {
+	if c.opts.MaxRetries == 0 {
+		return DefaultMaxRetries
+	}
+	if c.opts.MaxRetries < 0 {
+		return 0
+	}
+	return c.opts.MaxRetries
+}
+
+// retry calls f until it succeeds, fails with an error other than throttling
+// or errUnprocessed, or has been retried c.maxRetries() times.
+func (c *collection) retry(ctx context.Context, f func() error) error {
+	n, max := 0, c.maxRetries()
+	isRetryable := func(err error) bool {
+		if n == max || !(err == errUnprocessed || isThrottled(err)) {
+			return false
 		}
+		n++
+		return true
 	}
+	return retry.Call(ctx, backoff, isRetryable, f)
+}
+
+// backoff controls the pauses between retries. It is a variable so that tests
+// can shorten it.
+var backoff = gax.Backoff{Initial: 50 * time.Millisecond, Max: 5 * time.Second, Multiplier: 2}
+
+// isThrottled reports whether err means that DynamoDB throttled the request.
+func isThrottled(err error) bool {
+	ae, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch ae.Code() {
+	case dyn.ErrCodeProvisionedThroughputExceededException, dyn.ErrCodeRequestLimitExceeded, "ThrottlingException":
+		return true
+	}
+	return false
 }
 
 func mapActionIndices(actions []*driver.Action, start, end int) map[interface{}]int {
@@ -396,22 +507,34 @@ func (c *collection) runWrites(ctx context.Context, writes []*driver.Action, err
 		}
 	}
 
+	var failed int32 // set when a write fails, for opts.FailFast
+	if len(ops) < len(writes) {
+		failed = 1
+	}
+	var skipped []*driver.Action
 	t := driver.NewThrottle(c.opts.MaxOutstandingActionRPCs)
 	for _, op := range ops {
 		op := op
 		t.Acquire()
+		if opts.FailFast && atomic.LoadInt32(&failed) != 0 {
+			t.Release()
+			skipped = append(skipped, op.action)
+			continue
+		}
 		go func() {
 			defer t.Release()
 			err := op.run(ctx)
 			a := op.action
 			if err != nil {
 				errs[a.Index] = err
+				atomic.StoreInt32(&failed, 1)
 			} else {
 				c.onSuccess(op)
 			}
 		}()
 	}
 	t.Wait()
+	driver.SkipActions(skipped, errs)
 }
 
 // A writeOp describes a single write to DynamoDB. The write can be executed
@@ -442,18 +565,24 @@ func (c *collection) newPut(a *driver.Action, opts *driver.RunActionsOptions) (*
 	if err != nil {
 		return nil, err
 	}
-	mf := c.missingKeyField(av.M)
-	if a.Kind != driver.Create && mf != "" {
-		return nil, fmt.Errorf("missing key field %q", mf)
-	}
 	var newPartitionKey string
-	if mf == c.partitionKey {
-		newPartitionKey = driver.UniqueString()
-		av.M[c.partitionKey] = new(dyn.AttributeValue).SetS(newPartitionKey)
-	}
-	if c.sortKey != "" && mf == c.sortKey {
-		// It doesn't make sense to generate a random sort key.
-		return nil, fmt.Errorf("missing sort key %q", c.sortKey)
+	if c.hasKeyTemplates() {
+		if newPartitionKey, err = c.setTemplateKeys(a, av.M); err != nil {
+			return nil, err
+		}
+	} else {
+		mf := c.missingKeyField(av.M)
+		if a.Kind != driver.Create && mf != "" {
+			return nil, fmt.Errorf("missing key field %q", mf)
+		}
+		if mf == c.partitionKey {
+			newPartitionKey = driver.GenerateKey(a)
+			av.M[c.partitionKey] = new(dyn.AttributeValue).SetS(newPartitionKey)
+		}
+		if c.sortKey != "" && mf == c.sortKey {
+			// It doesn't make sense to generate a random sort key.
+			return nil, fmt.Errorf("missing sort key %q", c.sortKey)
+		}
 	}
 	rev := driver.UniqueString()
 	if av.M[c.opts.RevisionField], err = encodeValue(rev); err != nil {
@@ -500,12 +629,15 @@ func (c *collection) runPut(ctx context.Context, dput *dyn.Put, a *driver.Action
 			return err
 		}
 	}
-	_, err := c.db.PutItemWithContext(ctx, in)
+	err := c.retry(ctx, func() error {
+		_, err := c.db.PutItemWithContext(ctx, in)
+		return err
+	})
 	if ae, ok := err.(awserr.Error); ok && ae.Code() == dyn.ErrCodeConditionalCheckFailedException {
 		if a.Kind == driver.Create {
 			err = gcerr.Newf(gcerr.AlreadyExists, err, "document already exists")
 		}
-		if rev, _ := a.Doc.GetField(c.opts.RevisionField); rev == nil && a.Kind == driver.Replace {
+		if rev, _ := a.Doc.GetField(c.opts.RevisionField); rev == nil && a.Kind == driver.Replace && len(a.Conditions) == 0 {
 			err = gcerr.Newf(gcerr.NotFound, nil, "document not found")
 		}
 	}
@@ -513,7 +645,7 @@ func (c *collection) runPut(ctx context.Context, dput *dyn.Put, a *driver.Action
 }
 
 func (c *collection) newDelete(a *driver.Action, opts *driver.RunActionsOptions) (*writeOp, error) {
-	av, err := encodeDocKeyFields(a.Doc, c.partitionKey, c.sortKey)
+	av, err := c.encodeKey(a.Doc)
 	if err != nil {
 		return nil, err
 	}
@@ -550,17 +682,22 @@ func (c *collection) newDelete(a *driver.Action, opts *driver.RunActionsOptions)
 					return err
 				}
 			}
-			_, err := c.db.DeleteItemWithContext(ctx, in)
-			return err
+			return c.retry(ctx, func() error {
+				_, err := c.db.DeleteItemWithContext(ctx, in)
+				return err
+			})
 		},
 	}, nil
 }
 
 func (c *collection) newUpdate(a *driver.Action, opts *driver.RunActionsOptions) (*writeOp, error) {
-	av, err := encodeDocKeyFields(a.Doc, c.partitionKey, c.sortKey)
+	av, err := c.encodeKey(a.Doc)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.checkTemplateMods(a.Mods); err != nil {
+		return nil, err
+	}
 	var ub expression.UpdateBuilder
 	for _, m := range a.Mods {
 		// TODO(shantuo): check for invalid field paths
@@ -609,8 +746,10 @@ func (c *collection) newUpdate(a *driver.Action, opts *driver.RunActionsOptions)
 					return err
 				}
 			}
-			_, err := c.db.UpdateItemWithContext(ctx, in)
-			return err
+			return c.retry(ctx, func() error {
+				_, err := c.db.UpdateItemWithContext(ctx, in)
+				return err
+			})
 		},
 	}, nil
 }
@@ -619,7 +758,7 @@ func (c *collection) newUpdate(a *driver.Action, opts *driver.RunActionsOptions)
 func (c *collection) onSuccess(op *writeOp) {
 	// Set the new partition key (if any) and the new revision into the user's document.
 	if op.newPartitionKey != "" {
-		_ = op.action.Doc.SetField(c.partitionKey, op.newPartitionKey) // cannot fail
+		_ = op.action.Doc.SetField(c.generatedKeyField(), op.newPartitionKey) // cannot fail
 	}
 	if op.newRevision != "" {
 		_ = op.action.Doc.SetField(c.opts.RevisionField, op.newRevision) // OK if there is no revision field
@@ -636,8 +775,29 @@ func (c *collection) missingKeyField(m map[string]*dyn.AttributeValue) string {
 	return ""
 }
 
-// Construct the precondition for the action.
+// Construct the precondition for the action, including its conditions.
 func (c *collection) precondition(a *driver.Action) (*expression.ConditionBuilder, error) {
+	cb, err := c.kindPrecondition(a)
+	if err != nil || len(a.Conditions) == 0 {
+		return cb, err
+	}
+	conds := toFilter(a.Conditions[0])
+	for _, f := range a.Conditions[1:] {
+		conds = conds.And(toFilter(f))
+	}
+	if a.Kind == driver.Delete {
+		// Deleting a missing document is not an error.
+		conds = expression.AttributeNotExists(expression.Name(c.partitionKey)).Or(conds)
+	}
+	if cb == nil {
+		return &conds, nil
+	}
+	and := cb.And(conds)
+	return &and, nil
+}
+
+// Construct the precondition for the action's kind.
+func (c *collection) kindPrecondition(a *driver.Action) (*expression.ConditionBuilder, error) {
 	switch a.Kind {
 	case driver.Create:
 		// Precondition: the document doesn't already exist. (Precisely: the partitionKey
@@ -16,17 +16,25 @@ package dynamodocstore
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	dyn "github.com/aws/aws-sdk-go/service/dynamodb"
+	gax "github.com/googleapis/gax-go"
 	gcaws "gocloud.dev/aws"
 	"gocloud.dev/docstore"
 	"gocloud.dev/docstore/driver"
@@ -64,6 +72,7 @@ type harness struct {
 }
 
 func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	setup.SkipIfNotRecorded(t)
 	sess, _, done, state := setup.NewAWSSession(ctx, t, region)
 	drivertest.MakeUniqueStringDeterministicForTesting(state)
 	return &harness{sess: sess, closer: done}, nil
@@ -78,6 +87,12 @@ func (*harness) BeforeQueryTypes() []interface{} {
 	return []interface{}{&dyn.QueryInput{}, &dyn.ScanInput{}}
 }
 
+// Capabilities excludes Concurrency, Cancellation and Stress because the tests
+// replay recorded RPCs.
+func (*harness) Capabilities() drivertest.Capabilities {
+	return drivertest.AllCapabilities &^ (drivertest.Concurrency | drivertest.Cancellation | drivertest.Stress)
+}
+
 func (h *harness) Close() {
 	h.closer()
 }
@@ -168,42 +183,19 @@ func (it *highScoreSliceIterator) Next(ctx context.Context, doc driver.Document)
 func (*highScoreSliceIterator) Stop()               {}
 func (*highScoreSliceIterator) As(interface{}) bool { return false }
 
-type verifyAs struct{}
-
-func (verifyAs) Name() string {
-	return "verify As"
-}
-
-func (verifyAs) CollectionCheck(coll *docstore.Collection) error {
-	var db *dyn.DynamoDB
-	if !coll.As(&db) {
-		return errors.New("Collection.As failed")
-	}
-	return nil
-}
-
-func (verifyAs) QueryCheck(it *docstore.DocumentIterator) error {
-	var so *dyn.ScanOutput
-	var qo *dyn.QueryOutput
-	if !it.As(&so) && !it.As(&qo) {
-		return errors.New("DocumentIterator.As failed")
-	}
-	return nil
-}
-
-func (v verifyAs) ErrorCheck(k *docstore.Collection, err error) error {
-	var e awserr.Error
-	if !k.ErrorAs(err, &e) {
-		return errors.New("Collection.ErrorAs failed")
-	}
-	return nil
+// asMatrix lists the types that the As methods support. Iterators are for
+// either scans or queries.
+var asMatrix = drivertest.AsMatrix{
+	Collection: []interface{}{new(*dyn.DynamoDB)},
+	Iterator:   []interface{}{new(*dyn.ScanOutput), new(*dyn.QueryOutput)},
+	Error:      []interface{}{new(awserr.Error)},
 }
 
 func TestConformance(t *testing.T) {
 	// Note: when running -record repeatedly in a short time period, change the argument
 	// in the call below to generate unique transaction tokens.
 	drivertest.MakeUniqueStringDeterministicForTesting(1)
-	drivertest.RunConformanceTests(t, newHarness, &codecTester{}, []drivertest.AsTest{verifyAs{}})
+	drivertest.RunConformanceTests(t, newHarness, &codecTester{}, []drivertest.AsTest{asMatrix})
 }
 
 func BenchmarkConformance(b *testing.B) {
@@ -282,3 +274,185 @@ func TestProcessURL(t *testing.T) {
 		}
 	}
 }
+
+const fakeTable = "docstore-test-fake"
+
+// fakeDynamo serves BatchGetItem and PutItem for a table keyed by "name", to
+// test how throttling is handled.
+type fakeDynamo struct {
+	mu        sync.Mutex
+	items     map[string]map[string]interface{} // by name
+	batchSize int                               // the most items a BatchGetItem returns
+	throttle  map[string]int                    // by name, the number of PutItems to throttle
+	calls     map[string]int                    // by operation
+}
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	f.calls[op]++
+	var in map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := func(item interface{}) string {
+		return item.(map[string]interface{})["name"].(map[string]interface{})["S"].(string)
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	switch op {
+	case "BatchGetItem":
+		keys := in["RequestItems"].(map[string]interface{})[fakeTable].(map[string]interface{})["Keys"].([]interface{})
+		var items, unprocessed []interface{}
+		for _, k := range keys {
+			if len(items)+len(unprocessed) >= f.batchSize {
+				unprocessed = append(unprocessed, k)
+			} else if item, ok := f.items[name(k)]; ok {
+				items = append(items, item)
+			}
+		}
+		out := map[string]interface{}{"Responses": map[string]interface{}{fakeTable: items}}
+		if len(unprocessed) > 0 {
+			out["UnprocessedKeys"] = map[string]interface{}{fakeTable: map[string]interface{}{"Keys": unprocessed}}
+		}
+		json.NewEncoder(w).Encode(out)
+	case "PutItem":
+		item := in["Item"].(map[string]interface{})
+		n := name(item)
+		if f.throttle[n] > 0 {
+			f.throttle[n]--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ProvisionedThroughputExceededException","message":"slow down"}`)
+			return
+		}
+		f.items[n] = item
+		fmt.Fprint(w, `{}`)
+	default:
+		http.Error(w, "unsupported operation "+op, http.StatusBadRequest)
+	}
+}
+
+// newFakeCollection returns a collection backed by f, and a function that
+// closes it and restores the retry backoff.
+func newFakeCollection(t *testing.T, f *fakeDynamo, maxRetries int) (*docstore.Collection, func()) {
+	t.Helper()
+	old := backoff
+	backoff = gax.Backoff{Initial: time.Millisecond, Max: time.Millisecond}
+	srv := httptest.NewServer(f)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String(region),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		srv.Close()
+		backoff = old
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(&collection{
+		db:           dyn.New(sess),
+		table:        fakeTable,
+		partitionKey: "name",
+		opts:         &Options{RevisionField: docstore.DefaultRevisionField, MaxRetries: maxRetries},
+	})
+	return coll, func() {
+		coll.Close()
+		srv.Close()
+		backoff = old
+	}
+}
+
+func TestBatchGetUnprocessedKeys(t *testing.T) {
+	ctx := context.Background()
+	newFake := func() *fakeDynamo {
+		f := &fakeDynamo{items: map[string]map[string]interface{}{}, batchSize: 1, calls: map[string]int{}}
+		for _, n := range []string{"a", "b", "c"} {
+			f.items[n] = map[string]interface{}{"name": map[string]interface{}{"S": n}, "x": map[string]interface{}{"S": "x" + n}}
+		}
+		return f
+	}
+	get := func(coll *docstore.Collection) ([]map[string]interface{}, error) {
+		docs := []map[string]interface{}{{"name": "a"}, {"name": "b"}, {"name": "c"}, {"name": "d"}}
+		al := coll.Actions()
+		for _, d := range docs {
+			al.Get(d)
+		}
+		return docs, al.Do(ctx)
+	}
+
+	// With enough retries, every key is processed.
+	f := newFake()
+	coll, cleanup := newFakeCollection(t, f, 0)
+	defer cleanup()
+	docs, err := get(coll)
+	alerr, ok := err.(docstore.ActionListError)
+	if !ok || len(alerr) != 1 || alerr[0].Index != 3 || gcerrors.Code(alerr[0].Err) != gcerrors.NotFound {
+		t.Fatalf("got %v, want only a NotFound error for d", err)
+	}
+	for _, d := range docs[:3] {
+		if d["x"] != "x"+d["name"].(string) {
+			t.Errorf("got %v, want it read", d)
+		}
+	}
+	if got := f.calls["BatchGetItem"]; got != 4 {
+		t.Errorf("got %d calls, want 4", got)
+	}
+
+	// Keys that are still unprocessed after the last retry fail on their own.
+	f = newFake()
+	coll, cleanup = newFakeCollection(t, f, 1)
+	defer cleanup()
+	docs, err = get(coll)
+	alerr, ok = err.(docstore.ActionListError)
+	if !ok || len(alerr) != 2 {
+		t.Fatalf("got %v, want errors for c and d", err)
+	}
+	for _, e := range alerr {
+		if e.Index < 2 || gcerrors.Code(e.Err) != gcerrors.ResourceExhausted {
+			t.Errorf("action %d: got %v, want ResourceExhausted", e.Index, e.Err)
+		}
+	}
+	if docs[0]["x"] != "xa" || docs[1]["x"] != "xb" {
+		t.Errorf("got %v and %v, want them read", docs[0], docs[1])
+	}
+}
+
+func TestThrottledWrites(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeDynamo{items: map[string]map[string]interface{}{}, throttle: map[string]int{"a": 2, "b": 5}, calls: map[string]int{}}
+	coll, cleanup := newFakeCollection(t, f, 3)
+	defer cleanup()
+	a, b, c := map[string]interface{}{"name": "a"}, map[string]interface{}{"name": "b"}, map[string]interface{}{"name": "c"}
+	err := coll.Actions().Put(a).Put(b).Put(c).Do(ctx)
+	// a succeeds after two retries, but b is throttled more than three times.
+	alerr, ok := err.(docstore.ActionListError)
+	if !ok || len(alerr) != 1 || alerr[0].Index != 1 || gcerrors.Code(alerr[0].Err) != gcerrors.ResourceExhausted {
+		t.Fatalf("got %v, want only a ResourceExhausted error for b", err)
+	}
+	var ae awserr.Error
+	if !coll.ErrorAs(alerr[0].Err, &ae) || ae.Code() != dyn.ErrCodeProvisionedThroughputExceededException {
+		t.Errorf("got %v, want the throttling error", alerr[0].Err)
+	}
+	if _, ok := f.items["a"]; !ok {
+		t.Error("a was not written")
+	}
+	if _, ok := f.items["c"]; !ok {
+		t.Error("c was not written")
+	}
+	if a[docstore.DefaultRevisionField] == nil || b[docstore.DefaultRevisionField] != nil {
+		t.Errorf("got revisions %v and %v, want only a's set", a[docstore.DefaultRevisionField], b[docstore.DefaultRevisionField])
+	}
+	if got := f.calls["PutItem"]; got != 3+4+1 {
+		t.Errorf("got %d PutItem calls, want 8", got)
+	}
+
+	// With retries disabled, the first throttling error is returned.
+	f.throttle["c"] = 1
+	coll, cleanup = newFakeCollection(t, f, -1)
+	defer cleanup()
+	if err := coll.Put(ctx, c); gcerrors.Code(err) != gcerrors.ResourceExhausted {
+		t.Errorf("got %v, want ResourceExhausted", err)
+	}
+}
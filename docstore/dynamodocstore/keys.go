@@ -0,0 +1,351 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodocstore
+
+import (
+	"fmt"
+	"strings"
+
+	dyn "github.com/aws/aws-sdk-go/service/dynamodb"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/internal/gcerr"
+)
+
+// A KeyTemplate describes how a key attribute of a table is built from the
+// fields of a document, as in DynamoDB's single-table design. The attribute is
+// a string: Prefix, followed by the values of Fields separated by Delimiter.
+// For example, with Prefix "ORDER#" and Fields ["Customer", "ID"], the document
+// {Customer: "alice", ID: "17"} has the key attribute "ORDER#alice#17".
+//
+// A template with no Fields yields the constant Prefix, which places all the
+// documents of a collection in a single partition.
+//
+// Field values must be strings or integers, and must not contain Delimiter, so
+// that different documents cannot have the same key attribute.
+type KeyTemplate struct {
+	// Prefix is prepended to the key attribute. It typically names the type of
+	// entity held by the collection, like "USER#".
+	Prefix string
+
+	// Fields are the top-level document fields whose values make up the rest of
+	// the key attribute.
+	Fields []string
+
+	// Delimiter separates the field values. Defaults to "#".
+	Delimiter string
+}
+
+func (t *KeyTemplate) delimiter() string {
+	if t.Delimiter == "" {
+		return "#"
+	}
+	return t.Delimiter
+}
+
+// build returns the key attribute for the document whose fields are returned by
+// get. It reports false if a field is missing or nil.
+func (t *KeyTemplate) build(get func(string) (interface{}, error)) (string, bool, error) {
+	delim := t.delimiter()
+	vals := make([]string, len(t.Fields))
+	for i, f := range t.Fields {
+		v, err := get(f)
+		if err != nil || v == nil {
+			return "", false, nil
+		}
+		if vals[i], err = formatKeyValue(f, v); err != nil {
+			return "", false, err
+		}
+		if strings.Contains(vals[i], delim) {
+			return "", false, gcerr.Newf(gcerr.InvalidArgument, nil, "key template field %q has the value %q, which contains the delimiter %q", f, vals[i], delim)
+		}
+	}
+	return t.Prefix + strings.Join(vals, delim), true, nil
+}
+
+// hasField reports whether f is one of the fields of t.
+func (t *KeyTemplate) hasField(f string) bool {
+	for _, tf := range t.Fields {
+		if tf == f {
+			return true
+		}
+	}
+	return false
+}
+
+func formatKeyValue(field string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "key template field %q has a value of type %T; want a string or integer", field, v)
+	}
+}
+
+// A keyAttribute is the partition or sort key attribute of the table, along
+// with the template it is built from, if any.
+type keyAttribute struct {
+	name string
+	tmpl *KeyTemplate
+}
+
+func (c *collection) keyAttrs() []keyAttribute {
+	ks := []keyAttribute{{c.partitionKey, c.opts.PartitionKeyTemplate}}
+	if c.sortKey != "" {
+		ks = append(ks, keyAttribute{c.sortKey, c.opts.SortKeyTemplate})
+	}
+	return ks
+}
+
+func (c *collection) hasKeyTemplates() bool {
+	return c.opts.PartitionKeyTemplate != nil || (c.sortKey != "" && c.opts.SortKeyTemplate != nil)
+}
+
+// generatedKeyField returns the document field that receives a generated key
+// when a document is created without one, or "" if keys cannot be generated.
+func (c *collection) generatedKeyField() string {
+	t := c.opts.PartitionKeyTemplate
+	switch {
+	case t == nil:
+		return c.partitionKey
+	case len(t.Fields) == 1:
+		return t.Fields[0]
+	default:
+		return ""
+	}
+}
+
+// templateKey implements Key for a collection with key templates.
+func (c *collection) templateKey(doc driver.Document) (interface{}, error) {
+	var keys [2]interface{}
+	for i, k := range c.keyAttrs() {
+		if k.tmpl == nil {
+			keys[i], _ = doc.GetField(k.name) // keys[i] is nil if the field is missing
+			continue
+		}
+		s, ok, err := k.tmpl.build(doc.GetField)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys[i] = s
+		}
+	}
+	if keys[0] == nil {
+		return nil, nil // missing key is not an error
+	}
+	return keys, nil
+}
+
+// encodeKey returns the key attributes of doc, for use as the key of a
+// GetItem, DeleteItem or UpdateItem request.
+func (c *collection) encodeKey(doc driver.Document) (*dyn.AttributeValue, error) {
+	if !c.hasKeyTemplates() {
+		return encodeDocKeyFields(doc, c.partitionKey, c.sortKey)
+	}
+	m := map[string]*dyn.AttributeValue{}
+	for _, k := range c.keyAttrs() {
+		if k.tmpl == nil {
+			v, err := doc.GetField(k.name)
+			if err != nil {
+				return nil, err
+			}
+			if m[k.name], err = encodeValue(v); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s, ok, err := k.tmpl.build(doc.GetField)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing a field of key attribute %q", k.name)
+		}
+		m[k.name] = new(dyn.AttributeValue).SetS(s)
+	}
+	return new(dyn.AttributeValue).SetM(m), nil
+}
+
+// setTemplateKeys sets the key attributes of the encoded document m, the item
+// written for a. If a creates a document without a partition key, it generates
+// one, adds it to m and returns it.
+func (c *collection) setTemplateKeys(a *driver.Action, m map[string]*dyn.AttributeValue) (string, error) {
+	get := a.Doc.GetField
+	var newKey string
+	if f := c.generatedKeyField(); a.Kind == driver.Create && f != "" {
+		if v, err := get(f); err != nil || v == nil {
+			newKey = driver.GenerateKey(a)
+			m[f] = new(dyn.AttributeValue).SetS(newKey)
+			get = func(name string) (interface{}, error) {
+				if name == f {
+					return newKey, nil
+				}
+				return a.Doc.GetField(name)
+			}
+		}
+	}
+	for _, k := range c.keyAttrs() {
+		if k.tmpl == nil {
+			if v, ok := m[k.name]; !ok || v.NULL != nil {
+				return "", fmt.Errorf("missing key field %q", k.name)
+			}
+			continue
+		}
+		s, ok, err := k.tmpl.build(get)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", gcerr.Newf(gcerr.InvalidArgument, nil, "missing a field of key attribute %q", k.name)
+		}
+		m[k.name] = new(dyn.AttributeValue).SetS(s)
+	}
+	return newKey, nil
+}
+
+// checkTemplateMods returns an error if a mod changes a field that a key
+// attribute is built from, since that would move the document to a new key.
+func (c *collection) checkTemplateMods(mods []driver.Mod) error {
+	for _, m := range mods {
+		for _, k := range c.keyAttrs() {
+			if k.tmpl != nil && k.tmpl.hasField(m.FieldPath[0]) {
+				return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot update field %q of key attribute %q", m.FieldPath[0], k.name)
+			}
+		}
+	}
+	return nil
+}
+
+// itemKey returns the key of an item read from the table, in the form returned
+// by Key.
+func (c *collection) itemKey(item map[string]*dyn.AttributeValue) (interface{}, error) {
+	key := map[string]interface{}{c.partitionKey: nil}
+	if c.sortKey != "" {
+		key[c.sortKey] = nil
+	}
+	keysOnly, err := driver.NewDocument(key)
+	if err != nil {
+		panic(err)
+	}
+	if err := decodeDoc(&dyn.AttributeValue{M: item}, keysOnly); err != nil {
+		return nil, err
+	}
+	if !c.hasKeyTemplates() {
+		return c.Key(keysOnly)
+	}
+	// The key attributes are what Key builds from the templates.
+	var keys [2]interface{}
+	keys[0] = key[c.partitionKey]
+	if c.sortKey != "" {
+		keys[1] = key[c.sortKey]
+	}
+	return keys, nil
+}
+
+// decodeItem decodes an item read from the table into doc. Key attributes built
+// from templates are not fields of the document, so they are left out.
+func (c *collection) decodeItem(item map[string]*dyn.AttributeValue, doc driver.Document) error {
+	if c.hasKeyTemplates() {
+		m := make(map[string]*dyn.AttributeValue, len(item))
+		for k, v := range item {
+			m[k] = v
+		}
+		for _, k := range c.keyAttrs() {
+			if k.tmpl != nil {
+				delete(m, k.name)
+			}
+		}
+		item = m
+	}
+	return decodeDoc(&dyn.AttributeValue{M: item}, doc)
+}
+
+// keyFieldPaths returns the field paths a document needs for Key to succeed.
+func (c *collection) keyFieldPaths() [][]string {
+	var fps [][]string
+	for _, k := range c.keyAttrs() {
+		if k.tmpl == nil {
+			fps = append(fps, []string{k.name})
+			continue
+		}
+		for _, f := range k.tmpl.Fields {
+			fps = append(fps, []string{f})
+		}
+	}
+	return fps
+}
+
+// withKeyFilters returns a copy of q with filters on the key attributes built
+// from templates, so that DynamoDB can use the table's keys to run it and only
+// the items of this collection are returned. The filters are derived from q's
+// filters on the template fields, which remain in the query.
+func (c *collection) withKeyFilters(q *driver.Query) *driver.Query {
+	q2 := *q
+	q2.Filters = append([]driver.Filter(nil), q.Filters...)
+	add := func(attr, op string, val interface{}) {
+		q2.Filters = append(q2.Filters, driver.Filter{FieldPath: []string{attr}, Op: op, Value: val})
+	}
+	if t := c.opts.PartitionKeyTemplate; t != nil {
+		if len(t.Fields) == 0 {
+			add(c.partitionKey, driver.EqualOp, t.Prefix)
+		} else if v, ok := templateFilterValue(q, t, driver.EqualOp); ok {
+			add(c.partitionKey, driver.EqualOp, t.Prefix+v)
+		} else if t.Prefix != "" {
+			add(c.partitionKey, driver.HasPrefixOp, t.Prefix)
+		}
+	}
+	if t := c.opts.SortKeyTemplate; t != nil && c.sortKey != "" {
+		added := false
+		for _, op := range []string{driver.EqualOp, driver.HasPrefixOp, ">", ">=", "<", "<="} {
+			if v, ok := templateFilterValue(q, t, op); ok {
+				add(c.sortKey, op, t.Prefix+v)
+				added = true
+				break
+			}
+		}
+		if !added && t.Prefix != "" {
+			add(c.sortKey, driver.HasPrefixOp, t.Prefix)
+		}
+		if len(t.Fields) == 1 && q.OrderByField == t.Fields[0] {
+			q2.OrderByField = c.sortKey
+		}
+	}
+	return &q2
+}
+
+// templateFilterValue returns the value of a filter of q with operator op on
+// the only field of t. Only equality filters may have integer values, since
+// key attributes compare as strings.
+func templateFilterValue(q *driver.Query, t *KeyTemplate, op string) (string, bool) {
+	if len(t.Fields) != 1 {
+		return "", false
+	}
+	for _, f := range q.Filters {
+		if f.Op != op || !driver.FieldPathEqualsField(f.FieldPath, t.Fields[0]) {
+			continue
+		}
+		if s, ok := f.Value.(string); ok {
+			return s, true
+		}
+		if op == driver.EqualOp {
+			if s, err := formatKeyValue(t.Fields[0], f.Value); err == nil {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodocstore
+
+import (
+	"testing"
+
+	dyn "github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/gcerrors"
+)
+
+// newTemplateCollection returns a collection for a single-table design where
+// the partition key is "ORDER#<Customer>" and the sort key is "ITEM#<ID>".
+func newTemplateCollection() *collection {
+	return &collection{
+		partitionKey: "PK",
+		sortKey:      "SK",
+		opts: &Options{
+			PartitionKeyTemplate: &KeyTemplate{Prefix: "ORDER#", Fields: []string{"Customer"}},
+			SortKeyTemplate:      &KeyTemplate{Prefix: "ITEM#", Fields: []string{"ID"}},
+		},
+	}
+}
+
+func TestTemplateKeys(t *testing.T) {
+	c := newTemplateCollection()
+	doc, err := driver.NewDocument(map[string]interface{}{"Customer": "alice", "ID": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := c.Key(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [2]interface{}{"ORDER#alice", "ITEM#7"}; key != want {
+		t.Errorf("Key: got %v, want %v", key, want)
+	}
+
+	// A Create without the partition key field generates it.
+	doc, err = driver.NewDocument(map[string]interface{}{"ID": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]*dyn.AttributeValue{}
+	newKey, err := c.setTemplateKeys(&driver.Action{Kind: driver.Create, Doc: doc, KeyGenerator: func() string { return "gen" }}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey != "gen" {
+		t.Errorf("got new key %q, want %q", newKey, "gen")
+	}
+	got := map[string]string{}
+	for k, v := range m {
+		got[k] = *v.S
+	}
+	want := map[string]string{"Customer": "gen", "PK": "ORDER#gen", "SK": "ITEM#x"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("item: %s", diff)
+	}
+	if _, err := c.setTemplateKeys(&driver.Action{Kind: driver.Put, Doc: doc}, m); err == nil {
+		t.Error("Put without a partition key field: got nil error, want error")
+	}
+
+	if err := c.checkTemplateMods([]driver.Mod{{FieldPath: []string{"ID"}, Value: "y"}}); err == nil {
+		t.Error("update of a key template field: got nil error, want error")
+	}
+	if err := c.checkTemplateMods([]driver.Mod{{FieldPath: []string{"Total"}, Value: 1}}); err != nil {
+		t.Errorf("update of another field: %v", err)
+	}
+}
+
+func TestKeyTemplateDelimiter(t *testing.T) {
+	get := func(m map[string]interface{}) func(string) (interface{}, error) {
+		return func(f string) (interface{}, error) { return m[f], nil }
+	}
+	tmpl := &KeyTemplate{Prefix: "ORDER#", Fields: []string{"Customer", "ID"}}
+	// Without the check, both documents would have the key "ORDER#a#b#c".
+	for _, doc := range []map[string]interface{}{
+		{"Customer": "a#b", "ID": "c"},
+		{"Customer": "a", "ID": "b#c"},
+	} {
+		if _, _, err := tmpl.build(get(doc)); gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", doc, err)
+		}
+	}
+
+	// Only the delimiter in use is rejected.
+	tmpl.Delimiter = "|"
+	s, ok, err := tmpl.build(get(map[string]interface{}{"Customer": "a#b", "ID": 7}))
+	if err != nil || !ok || s != "ORDER#a#b|7" {
+		t.Errorf(`with delimiter "|": got %q, %t, %v; want "ORDER#a#b|7", true, nil`, s, ok, err)
+	}
+}
+
+func TestWithKeyFilters(t *testing.T) {
+	c := newTemplateCollection()
+	for _, test := range []struct {
+		desc      string
+		filters   []driver.Filter
+		orderBy   string
+		want      []driver.Filter // added filters
+		wantOrder string
+	}{
+		{
+			desc: "no filters",
+			want: []driver.Filter{
+				{FieldPath: []string{"PK"}, Op: driver.HasPrefixOp, Value: "ORDER#"},
+				{FieldPath: []string{"SK"}, Op: driver.HasPrefixOp, Value: "ITEM#"},
+			},
+		},
+		{
+			desc: "partition and sort fields",
+			filters: []driver.Filter{
+				{FieldPath: []string{"Customer"}, Op: driver.EqualOp, Value: "alice"},
+				{FieldPath: []string{"ID"}, Op: ">", Value: "3"},
+			},
+			orderBy: "ID",
+			want: []driver.Filter{
+				{FieldPath: []string{"PK"}, Op: driver.EqualOp, Value: "ORDER#alice"},
+				{FieldPath: []string{"SK"}, Op: ">", Value: "ITEM#3"},
+			},
+			wantOrder: "SK",
+		},
+		{
+			desc: "integer range is not a key condition",
+			filters: []driver.Filter{
+				{FieldPath: []string{"Customer"}, Op: driver.EqualOp, Value: 5},
+				{FieldPath: []string{"ID"}, Op: "<", Value: 3},
+			},
+			want: []driver.Filter{
+				{FieldPath: []string{"PK"}, Op: driver.EqualOp, Value: "ORDER#5"},
+				{FieldPath: []string{"SK"}, Op: driver.HasPrefixOp, Value: "ITEM#"},
+			},
+		},
+	} {
+		q := &driver.Query{Filters: test.filters, OrderByField: test.orderBy}
+		got := c.withKeyFilters(q)
+		if diff := cmp.Diff(got.Filters, append(test.filters, test.want...)); diff != "" {
+			t.Errorf("%s: filters: %s", test.desc, diff)
+		}
+		wantOrder := test.wantOrder
+		if wantOrder == "" {
+			wantOrder = test.orderBy
+		}
+		if got.OrderByField != wantOrder {
+			t.Errorf("%s: got OrderByField %q, want %q", test.desc, got.OrderByField, wantOrder)
+		}
+		if len(q.Filters) != len(test.filters) {
+			t.Errorf("%s: original query was modified", test.desc)
+		}
+	}
+
+	// A template without fields puts the collection in a single partition.
+	c.opts.PartitionKeyTemplate = &KeyTemplate{Prefix: "USERS"}
+	got := c.withKeyFilters(&driver.Query{})
+	want := driver.Filter{FieldPath: []string{"PK"}, Op: driver.EqualOp, Value: "USERS"}
+	if diff := cmp.Diff(got.Filters[0], want); diff != "" {
+		t.Error(diff)
+	}
+}
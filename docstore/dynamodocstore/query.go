@@ -36,6 +36,25 @@ import (
 
 type avmap = map[string]*dyn.AttributeValue
 
+// SupportsFilter implements driver.SupportsFilter.
+// DynamoDB has no case-insensitive comparison, so EqualFoldOp and
+// HasPrefixFoldOp filters are left to the docstore package.
+func (c *collection) SupportsFilter(f driver.Filter) bool { return !driver.IsFoldOp(f.Op) }
+
+// SupportsOrderBy implements driver.OrderBySupporter. DynamoDB can sort only
+// by the sort key of the table or of an index, and only with an equality filter
+// on the partition key, unless RunQueryFallback runs the query.
+func (c *collection) SupportsOrderBy(q *driver.Query) bool {
+	if c.opts.RunQueryFallback != nil {
+		return true
+	}
+	if c.hasKeyTemplates() {
+		q = c.withKeyFilters(q)
+	}
+	indexName, pkey, _ := c.bestQueryable(q)
+	return indexName != nil || pkey != ""
+}
+
 func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
 	qr, err := c.planQuery(q)
 	if err != nil {
@@ -67,6 +86,9 @@ func (c *collection) checkPlan(qr *queryRunner) error {
 }
 
 func (c *collection) planQuery(q *driver.Query) (*queryRunner, error) {
+	if c.hasKeyTemplates() {
+		q = c.withKeyFilters(q)
+	}
 	var cb expression.Builder
 	cbUsed := false // It's an error to build an empty Builder.
 	// Set up the projection expression.
@@ -101,7 +123,7 @@ func (c *collection) planQuery(q *driver.Query) (*queryRunner, error) {
 			// for every value of the partition key and merge the results.
 			// TODO(jba): If the query has a reasonable limit N, then we can run a scan and keep
 			// the top N documents in memory.
-			return nil, gcerr.Newf(gcerr.Unimplemented, nil, "query requires a table scan, but has an ordering requirement; add an index or provide Options.RunQueryFallback")
+			return nil, gcerr.Newf(gcerr.Unimplemented, nil, "query requires a table scan, but has an ordering requirement; add an index, provide Options.RunQueryFallback, or call Query.AllowLocalSort")
 		}
 		if len(q.Filters) > 0 {
 			cb = cb.WithFilter(filtersToConditionBuilder(q.Filters))
@@ -269,13 +291,13 @@ func keyAttributes(ks []*dyn.KeySchemaElement) (pkey, skey string) {
 	return pkey, skey
 }
 
-// Reports whether q has a filter that mentions the top-level field.
+// Reports whether q has a filter that compares the top-level field to a value.
 func hasFilter(q *driver.Query, field string) bool {
 	if field == "" {
 		return false
 	}
 	for _, f := range q.Filters {
-		if driver.FieldPathEqualsField(f.FieldPath, field) {
+		if !isExistenceFilter(f) && driver.FieldPathEqualsField(f.FieldPath, field) {
 			return true
 		}
 	}
@@ -292,6 +314,11 @@ func hasEqualityFilter(q *driver.Query, field string) bool {
 	return false
 }
 
+// isExistenceFilter reports whether f tests for the presence of a field.
+func isExistenceFilter(f driver.Filter) bool {
+	return f.Op == driver.ExistsOp || f.Op == driver.NotExistsOp
+}
+
 type queryRunner struct {
 	c         *collection
 	scanIn    *dyn.ScanInput
@@ -392,6 +419,10 @@ func filtersToConditionBuilder(fs []driver.Filter) expression.ConditionBuilder {
 }
 
 func toKeyCondition(f driver.Filter, pkey, skey string) (expression.KeyConditionBuilder, bool) {
+	if isExistenceFilter(f) {
+		// Key conditions can only compare values.
+		return expression.KeyConditionBuilder{}, false
+	}
 	kp := strings.Join(f.FieldPath, ".")
 	if kp == pkey || kp == skey {
 		key := expression.Key(kp)
@@ -407,6 +438,12 @@ func toKeyCondition(f driver.Filter, pkey, skey string) (expression.KeyCondition
 			return expression.KeyGreaterThanEqual(key, val), true
 		case ">":
 			return expression.KeyGreaterThan(key, val), true
+		case driver.HasPrefixOp:
+			// Only a sort key condition can match a prefix.
+			if kp != skey {
+				return expression.KeyConditionBuilder{}, false
+			}
+			return expression.KeyBeginsWith(key, f.Value.(string)), true
 		default:
 			panic(fmt.Sprint("invalid filter operation:", f.Op))
 		}
@@ -416,6 +453,14 @@ func toKeyCondition(f driver.Filter, pkey, skey string) (expression.KeyCondition
 
 func toFilter(f driver.Filter) expression.ConditionBuilder {
 	name := expression.Name(strings.Join(f.FieldPath, "."))
+	switch f.Op {
+	case driver.ExistsOp:
+		return expression.AttributeExists(name)
+	case driver.NotExistsOp:
+		return expression.AttributeNotExists(name)
+	case driver.HasPrefixOp:
+		return expression.BeginsWith(name, f.Value.(string))
+	}
 	val := expression.Value(f.Value)
 	switch f.Op {
 	case "<":
@@ -456,7 +501,7 @@ func (it *documentIterator) Next(ctx context.Context, doc driver.Document) error
 		}
 		it.curr = 0
 	}
-	if err := decodeDoc(&dyn.AttributeValue{M: it.items[it.curr]}, doc); err != nil {
+	if err := it.qr.c.decodeItem(it.items[it.curr], doc); err != nil {
 		return err
 	}
 	it.curr++
@@ -473,12 +518,28 @@ func (it *documentIterator) As(i interface{}) bool {
 	return it.asFunc(i)
 }
 
-func (c *collection) QueryPlan(q *driver.Query) (string, error) {
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
 	qr, err := c.planQuery(q)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	// All filters are evaluated by DynamoDB, either as key conditions or as
+	// filter expressions.
+	plan := &driver.QueryPlan{
+		Description:   qr.queryPlan(),
+		Scan:          driver.ScanRange,
+		ServerFilters: q.Filters,
+	}
+	if qr.scanIn != nil {
+		plan.Scan = driver.ScanFull
+	}
+	if qr.queryIn != nil && qr.queryIn.IndexName != nil {
+		plan.Index = *qr.queryIn.IndexName
+	}
+	if plan.Scan == driver.ScanFull && c.description.ItemCount != nil {
+		plan.EstimatedScan = *c.description.ItemCount
 	}
-	return qr.queryPlan(), nil
+	return plan, nil
 }
 
 func (qr *queryRunner) queryPlan() string {
@@ -500,10 +561,7 @@ func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods [
 }
 
 func (c *collection) runActionQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
-	q.FieldPaths = [][]string{{c.partitionKey}}
-	if c.sortKey != "" {
-		q.FieldPaths = append(q.FieldPaths, []string{c.sortKey})
-	}
+	q.FieldPaths = c.keyFieldPaths()
 	qr, err := c.planQuery(q)
 	if err != nil {
 		return err
@@ -521,7 +579,7 @@ func (c *collection) runActionQuery(ctx context.Context, q *driver.Query, mods [
 			if err != nil {
 				return err
 			}
-			if err := decodeDoc(&dyn.AttributeValue{M: item}, doc); err != nil {
+			if err := c.decodeItem(item, doc); err != nil {
 				return err
 			}
 			key, err := c.Key(doc)
@@ -0,0 +1,744 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package elasticdocstore provides an implementation of the docstore API for
+// Elasticsearch (https://www.elastic.co/elasticsearch) and OpenSearch, storing
+// a collection's documents in an index.
+//
+// The key of a document, which must be a non-empty string without slashes, is
+// its _id in the index. The document itself is the _source, without the
+// revision field: the revision is formed from the document's _seq_no and
+// _primary_term, which Elasticsearch changes on every write.
+//
+// The index's mapping is up to the application, which describes the fields
+// that queries can use with Options.SearchFields. Because times are stored as
+// strings with nanosecond precision, date detection should be turned off if the
+// mapping is dynamic.
+//
+//
+// Action Lists
+//
+// The Get actions in each group of an action list are executed with a single
+// multi-get request. Each write action runs on its own, concurrently with the
+// others. Writes that depend on the current document, such as those with a
+// revision or conditions, read it and write it back with if_seq_no and
+// if_primary_term. If the document changes in between, the write is retried.
+// elasticdocstore calls the BeforeDo function once, before any request is
+// made, with an as function that exposes *elasticsearch.Client.
+//
+// Writes are not visible to searches until the index is refreshed. Set
+// Options.Refresh to control that.
+//
+//
+// Queries
+//
+// Filters on the fields in Options.SearchFields are sent to Elasticsearch:
+// comparisons as term and range queries, and HasPrefix filters on keyword
+// fields as prefix queries. The other filters are evaluated on the client, and
+// so are all the filters again, so that the results are exact even though the
+// mapping coerces values. Query.OrderBy is sent as a sort if the field is a
+// keyword or numeric search field. Otherwise, the results are sorted on the
+// client, after reading all the matching documents. Queries that may return
+// more than one page of results use the scroll API. QueryPlan describes the
+// search request.
+//
+// Query.Delete uses the delete by query API when all the filters can be sent to
+// Elasticsearch, relying on the mapping to match values exactly. Otherwise, and for Query.Update, each matching document is
+// changed on its own, provided it still matches.
+//
+//
+// As
+//
+// elasticdocstore exposes the following types for As:
+// - Collection: *elasticsearch.Client
+// - ActionList.BeforeDo: *elasticsearch.Client
+// - Query.BeforeQuery: *esapi.SearchRequest, or *esapi.DeleteByQueryRequest
+//   for Query.Delete when it uses the delete by query API
+// - DocumentIterator: *SearchResponse, the most recent page of results
+// - ErrorAs: *Error
+//
+//
+// Special Considerations
+//
+// JSON has no binary or time types. []byte values are stored as base64 strings,
+// and time.Time values as RFC 3339 strings in UTC with nanosecond precision.
+// They are decoded to those types when the destination has them, but as strings
+// when decoding into an interface{}. Query filters on time.Time values compare
+// the strings, which sort in time order.
+package elasticdocstore // import "gocloud.dev/docstore/elasticdocstore"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+)
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// Refresh is the refresh parameter of the requests that write documents:
+	// "true" makes each write visible to searches immediately, "wait_for" waits
+	// until the next refresh makes it visible, and "false" or the empty string
+	// returns without waiting. For Query.Delete, both "true" and "wait_for"
+	// refresh the index once the documents are deleted.
+	Refresh string
+
+	// The maximum number of write actions that run concurrently for a single
+	// call to ActionList.Do. If less than 1, there is no limit.
+	MaxOutstandingActionRPCs int
+
+	// SearchFields are the fields of the index's mapping that queries can send
+	// filters and sorts on to Elasticsearch. Queries on other fields are
+	// evaluated on the client.
+	SearchFields []SearchField
+}
+
+// Types of SearchField.
+const (
+	SearchKeyword = "keyword"
+	SearchNumeric = "numeric"
+	SearchBoolean = "boolean"
+)
+
+// A SearchField is a field of the index's mapping.
+type SearchField struct {
+	// FieldPath is the document field path, with components separated by
+	// dots, as in "a.b".
+	FieldPath string
+
+	// Type is the kind of field in the mapping. SearchKeyword fields, mapped as
+	// keyword, are used for filters on strings and times. SearchNumeric fields,
+	// mapped with any of the numeric types, are used for filters on numbers;
+	// fields that may hold non-integers should be mapped as double, since values
+	// are coerced to the field's type when indexed. SearchBoolean fields, mapped
+	// as boolean, are used for filters on booleans.
+	Type string
+}
+
+type collection struct {
+	client   *elasticsearch.Client
+	index    string
+	keyField string
+	keyFunc  func(docstore.Document) interface{}
+	opts     *Options
+
+	beforeDoMu sync.Mutex // serializes calls to BeforeDo
+}
+
+// OpenCollection opens a docstore collection whose documents are stored in the
+// Elasticsearch index. keyField is the document field holding the primary key,
+// which must be a string.
+func OpenCollection(client *elasticsearch.Client, index, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, index, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens a docstore collection whose documents are
+// stored in the Elasticsearch index. keyFunc takes a document and returns its
+// primary key, which must be a string. It should return nil if the document is
+// missing the information to construct a key. This will cause all actions, even
+// Create, to fail.
+func OpenCollectionWithKeyFunc(client *elasticsearch.Client, index string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, index, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(client *elasticsearch.Client, index, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if client == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: client is nil")
+	}
+	if index == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: index is empty")
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: must provide either keyField or keyFunc")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	switch opts.Refresh {
+	case "", "true", "false", "wait_for":
+	default:
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: invalid Refresh %q", opts.Refresh)
+	}
+	for _, f := range opts.SearchFields {
+		if f.FieldPath == "" {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: search field has an empty field path")
+		}
+		if f.Type != SearchKeyword && f.Type != SearchNumeric && f.Type != SearchBoolean {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: search field %q has type %q, want %q, %q or %q",
+				f.FieldPath, f.Type, SearchKeyword, SearchNumeric, SearchBoolean)
+		}
+	}
+	return &collection{
+		client:   client,
+		index:    index,
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+	}, nil
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// docID returns the _id of the document of a.
+func docID(a *driver.Action) (string, error) {
+	s, ok := a.Key.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: key %v is a %T, not a string", a.Key, a.Key)
+	}
+	// The client puts the _id in the request path without escaping slashes.
+	if s == "" || strings.ContainsRune(s, '/') {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: key %q is empty or has a slash", s)
+	}
+	return s, nil
+}
+
+func (c *collection) RevisionField() string { return c.opts.RevisionField }
+
+// MaxDocumentSize implements driver.MaxDocumentSize. The limit on the size of
+// a request is a setting of the cluster, so there is no limit here.
+func (c *collection) MaxDocumentSize() int { return 0 }
+
+// A revision identifies a version of a document by the sequence number and
+// primary term of the operation that wrote it.
+type revision struct {
+	seqNo, primaryTerm int
+}
+
+func (r revision) String() string { return fmt.Sprintf("%d:%d", r.seqNo, r.primaryTerm) }
+
+// parseRevision parses the string form of a revision.
+func parseRevision(s string) (revision, error) {
+	i := strings.IndexByte(s, ':')
+	if i >= 0 {
+		seqNo, err1 := strconv.Atoi(s[:i])
+		primaryTerm, err2 := strconv.Atoi(s[i+1:])
+		if err1 == nil && err2 == nil {
+			return revision{seqNo, primaryTerm}, nil
+		}
+	}
+	return revision{}, gcerr.Newf(gcerr.InvalidArgument, nil, "elasticdocstore: malformed revision %q", s)
+}
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+	if err := c.beforeDo(opts); err != nil {
+		for _, a := range actions {
+			errs[a.Index] = err
+		}
+		return driver.NewActionListError(errs)
+	}
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	for _, group := range [][]*driver.Action{beforeGets, gets, writes, afterGets} {
+		if driver.ShouldStop(opts, errs) {
+			driver.SkipActions(group, errs)
+			continue
+		}
+		if len(group) > 0 && group[0].Kind == driver.Get {
+			c.runGets(ctx, group, errs)
+		} else {
+			c.runWrites(ctx, group, errs, opts)
+		}
+	}
+	return driver.NewActionListError(errs)
+}
+
+// beforeDo calls opts.BeforeDo, if any, with an as function that exposes the
+// client.
+func (c *collection) beforeDo(opts *driver.RunActionsOptions) error {
+	if opts.BeforeDo == nil {
+		return nil
+	}
+	c.beforeDoMu.Lock()
+	defer c.beforeDoMu.Unlock()
+	return opts.BeforeDo(driver.AsFunc(c.client))
+}
+
+// do performs req and decodes the JSON body of a successful response into v,
+// if v is non-nil. An unsuccessful response is returned as an *Error.
+func (c *collection) do(ctx context.Context, req esapi.Request, v interface{}) error {
+	res, err := req.Do(ctx, c.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return newError(res)
+	}
+	if v == nil {
+		_, err := io.Copy(ioutil.Discard, res.Body)
+		return err
+	}
+	d := json.NewDecoder(res.Body)
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// body returns a request body holding the JSON encoding of v.
+func body(v interface{}) (io.Reader, error) {
+	b, err := jsoncodec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// A getResult is a document in the response to a multi-get request.
+type getResult struct {
+	ID          string          `json:"_id"`
+	Found       bool            `json:"found"`
+	SeqNo       int             `json:"_seq_no"`
+	PrimaryTerm int             `json:"_primary_term"`
+	Source      json.RawMessage `json:"_source"`
+	Error       *errorBody      `json:"error"`
+}
+
+// decodeSource decodes the _source of a document and adds its revision.
+func decodeSource(source json.RawMessage, rev revision, revField string) (map[string]interface{}, error) {
+	v, err := jsoncodec.Unmarshal(source)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, gcerr.Newf(gcerr.Internal, nil, "elasticdocstore: _source is a JSON %T, not an object", v)
+	}
+	m[revField] = rev.String()
+	return m, nil
+}
+
+// readAll reads the documents with the given ids in a single multi-get
+// request. The document of a missing id is nil.
+func (c *collection) readAll(ctx context.Context, ids []string) ([]map[string]interface{}, []revision, error) {
+	b, err := body(map[string]interface{}{"ids": ids})
+	if err != nil {
+		return nil, nil, err
+	}
+	var res struct {
+		Docs []getResult `json:"docs"`
+	}
+	if err := c.do(ctx, esapi.MgetRequest{Index: c.index, Body: b}, &res); err != nil {
+		return nil, nil, err
+	}
+	if len(res.Docs) != len(ids) {
+		return nil, nil, gcerr.Newf(gcerr.Internal, nil, "elasticdocstore: got %d documents from multi-get, want %d", len(res.Docs), len(ids))
+	}
+	docs := make([]map[string]interface{}, len(ids))
+	revs := make([]revision, len(ids))
+	for i, r := range res.Docs {
+		if r.Error != nil {
+			return nil, nil, &Error{StatusCode: http.StatusInternalServerError, Type: r.Error.Type, Reason: r.Error.Reason}
+		}
+		if !r.Found {
+			continue
+		}
+		revs[i] = revision{r.SeqNo, r.PrimaryTerm}
+		if docs[i], err = decodeSource(r.Source, revs[i], c.opts.RevisionField); err != nil {
+			return nil, nil, err
+		}
+	}
+	return docs, revs, nil
+}
+
+// read reads the document with the given id. It returns a nil document if
+// there is none.
+func (c *collection) read(ctx context.Context, id string) (map[string]interface{}, revision, error) {
+	docs, revs, err := c.readAll(ctx, []string{id})
+	if err != nil {
+		return nil, revision{}, err
+	}
+	return docs[0], revs[0], nil
+}
+
+// runGets reads the documents of gets with a single multi-get request.
+func (c *collection) runGets(ctx context.Context, gets []*driver.Action, errs []error) {
+	var (
+		ids  []string
+		byID = map[string][]*driver.Action{}
+	)
+	for _, a := range gets {
+		id, err := docID(a)
+		if err != nil {
+			errs[a.Index] = err
+			continue
+		}
+		if byID[id] == nil {
+			ids = append(ids, id)
+		}
+		byID[id] = append(byID[id], a)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	docs, _, err := c.readAll(ctx, ids)
+	if err != nil {
+		for _, as := range byID {
+			for _, a := range as {
+				errs[a.Index] = err
+			}
+		}
+		return
+	}
+	for i, id := range ids {
+		for _, a := range byID[id] {
+			if docs[i] == nil {
+				errs[a.Index] = gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+			} else {
+				errs[a.Index] = codec.DecodeDoc(docs[i], a.Doc, a.FieldPaths, c.opts.RevisionField)
+			}
+		}
+	}
+}
+
+// runWrites runs each write action concurrently. With FailFast, it stops
+// starting actions once one fails.
+func (c *collection) runWrites(ctx context.Context, writes []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	mapdoc.RunConcurrently(writes, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+		return c.runWrite(ctx, a)
+	})
+}
+
+// runWrite executes a single write action, retrying it if the document changes
+// between reading and writing it.
+func (c *collection) runWrite(ctx context.Context, a *driver.Action) error {
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	id, err := docID(a)
+	if err != nil {
+		return err
+	}
+	wantRev, err := c.revisionOf(a.Doc)
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		err := c.write(ctx, id, a, wantRev)
+		if !isConflict(err) || i == mapdoc.MaxWriteAttempts {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// revisionOf returns the revision of doc, or nil if it has none.
+func (c *collection) revisionOf(doc driver.Document) (*revision, error) {
+	v, err := doc.GetField(c.opts.RevisionField)
+	if err != nil || v == nil {
+		return nil, nil // no incoming revision information
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want string", c.opts.RevisionField, v)
+	}
+	rev, err := parseRevision(s)
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// write executes the write action a on the document with the given id. If a
+// depends on the current document, it writes only if the document has not
+// changed since it was read, and returns a conflict error otherwise.
+func (c *collection) write(ctx context.Context, id string, a *driver.Action, wantRev *revision) error {
+	blind := len(a.Conditions) == 0 && wantRev == nil
+	switch {
+	case a.Kind == driver.Create:
+		err := c.indexDoc(ctx, id, a, nil, "create")
+		if isConflict(err) {
+			return gcerr.Newf(gcerr.AlreadyExists, err, "Create: document with key %q exists", a.Key)
+		}
+		return err
+	case blind && a.Kind == driver.Put:
+		return c.indexDoc(ctx, id, a, nil, "")
+	case blind && a.Kind == driver.Delete:
+		return c.delete(ctx, id, nil)
+	}
+
+	current, rev, err := c.read(ctx, id)
+	if err != nil {
+		return err
+	}
+	exists := current != nil
+	switch {
+	case !exists && a.Kind == driver.Delete:
+		return nil
+	case !exists && (len(a.Conditions) > 0 || wantRev != nil):
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q does not exist", a.Key)
+	case !exists && (a.Kind == driver.Replace || a.Kind == driver.Update):
+		return gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+	case exists && !eval.FiltersMatch(a.Conditions, current):
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "conditions not satisfied for document with key %q", a.Key)
+	case exists && wantRev != nil && *wantRev != rev:
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %v, current %v", wantRev, rev)
+	}
+
+	switch a.Kind {
+	case driver.Delete:
+		return c.delete(ctx, id, &rev)
+	case driver.Replace, driver.Put:
+		return c.indexDoc(ctx, id, a, &rev, "")
+	case driver.Update:
+		if err := eval.ApplyMods(current, a.Mods); err != nil {
+			return err
+		}
+		delete(current, c.opts.RevisionField)
+		newRev, err := c.indexSource(ctx, id, current, &rev, "")
+		if err != nil {
+			return err
+		}
+		// Ignore errors. It's fine if the doc doesn't have a revision field.
+		_ = a.Doc.SetField(c.opts.RevisionField, newRev.String())
+		return nil
+	default:
+		return gcerr.Newf(gcerr.Internal, nil, "unknown kind %v", a.Kind)
+	}
+}
+
+// indexDoc stores the document of a under id, and sets the document's revision
+// field.
+func (c *collection) indexDoc(ctx context.Context, id string, a *driver.Action, ifRev *revision, opType string) error {
+	doc, err := codec.EncodeDoc(a.Doc)
+	if err != nil {
+		return err
+	}
+	// The revision is not part of the _source.
+	delete(doc, c.opts.RevisionField)
+	rev, err := c.indexSource(ctx, id, doc, ifRev, opType)
+	if err != nil {
+		return err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, rev.String())
+	return nil
+}
+
+// A writeResult is the response to an index or delete request.
+type writeResult struct {
+	SeqNo       int `json:"_seq_no"`
+	PrimaryTerm int `json:"_primary_term"`
+}
+
+// indexSource stores doc as the _source of the document with the given id,
+// only if the document's current revision is ifRev if that is non-nil. It
+// returns the new revision.
+func (c *collection) indexSource(ctx context.Context, id string, doc map[string]interface{}, ifRev *revision, opType string) (revision, error) {
+	b, err := body(doc)
+	if err != nil {
+		return revision{}, err
+	}
+	req := esapi.IndexRequest{
+		Index:      c.index,
+		DocumentID: id,
+		Body:       b,
+		OpType:     opType,
+		Refresh:    c.opts.Refresh,
+	}
+	if ifRev != nil {
+		req.IfSeqNo = &ifRev.seqNo
+		req.IfPrimaryTerm = &ifRev.primaryTerm
+	}
+	var res writeResult
+	if err := c.do(ctx, req, &res); err != nil {
+		return revision{}, err
+	}
+	return revision{res.SeqNo, res.PrimaryTerm}, nil
+}
+
+// delete deletes the document with the given id, only if its current revision
+// is ifRev if that is non-nil. Deleting a missing document succeeds.
+func (c *collection) delete(ctx context.Context, id string, ifRev *revision) error {
+	req := esapi.DeleteRequest{
+		Index:      c.index,
+		DocumentID: id,
+		Refresh:    c.opts.Refresh,
+	}
+	if ifRev != nil {
+		req.IfSeqNo = &ifRev.seqNo
+		req.IfPrimaryTerm = &ifRev.primaryTerm
+	}
+	err := c.do(ctx, req, nil)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusNotFound && e.Type == "" {
+		// The document does not exist, rather than the index.
+		return nil
+	}
+	return err
+}
+
+// Error is an error response from Elasticsearch.
+type Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Type is the type of the error, like "version_conflict_engine_exception".
+	// It is empty if the response did not describe the error, as when a
+	// document is not found.
+	Type string
+	// Reason is a description of the error.
+	Reason string
+}
+
+func (e *Error) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("elasticdocstore: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("elasticdocstore: %s: %s: %s", http.StatusText(e.StatusCode), e.Type, e.Reason)
+}
+
+// An errorBody is the description of an error in a response.
+type errorBody struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// newError returns the *Error for the unsuccessful response res.
+func newError(res *esapi.Response) error {
+	e := &Error{StatusCode: res.StatusCode}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		e.Reason = err.Error()
+		return e
+	}
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		e.Reason = string(b)
+		return e
+	}
+	// The error is usually an object, but some older APIs make it a string.
+	var eb errorBody
+	if json.Unmarshal(body.Error, &eb) == nil {
+		e.Type, e.Reason = eb.Type, eb.Reason
+	} else if json.Unmarshal(body.Error, &e.Reason) == nil {
+		e.Type = "error"
+	}
+	return e
+}
+
+// isConflict reports whether err is a version conflict.
+func isConflict(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusConflict
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool {
+	p, ok := i.(**elasticsearch.Client)
+	if !ok {
+		return false
+	}
+	*p = c.client
+	return true
+}
+
+// ErrorAs implements driver.Collection.ErrorAs.
+func (c *collection) ErrorAs(err error, i interface{}) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	p, ok := i.(**Error)
+	if !ok {
+		return false
+	}
+	*p = e
+	return true
+}
+
+// ErrorCode implements driver.Collection.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	if g, ok := err.(*gcerr.Error); ok {
+		return g.Code
+	}
+	switch err {
+	case context.Canceled:
+		return gcerr.Canceled
+	case context.DeadlineExceeded:
+		return gcerr.DeadlineExceeded
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return gcerr.Unknown
+	}
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return gcerr.InvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return gcerr.PermissionDenied
+	case http.StatusNotFound:
+		return gcerr.NotFound
+	case http.StatusConflict:
+		// The document kept changing during the write.
+		return gcerr.FailedPrecondition
+	case http.StatusRequestEntityTooLarge:
+		return gcerr.InvalidArgument
+	case http.StatusTooManyRequests:
+		return gcerr.ResourceExhausted
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return gcerr.DeadlineExceeded
+	case http.StatusNotImplemented:
+		return gcerr.Unimplemented
+	case http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusBadGateway:
+		return gcerr.Internal
+	}
+	return gcerr.Unknown
+}
+
+// Close implements driver.Collection.Close. It does not close the client.
+func (c *collection) Close() error { return nil }
@@ -0,0 +1,396 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elasticdocstore
+
+// To run these tests against a real Elasticsearch server, first run
+// ./localelasticsearch.sh.
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/internal/testing/setup"
+)
+
+const (
+	serverURL = "http://localhost:9200"
+	index1    = "docstore-test-1"
+	index2    = "docstore-test-2"
+	index3    = "docstore-test-3"
+)
+
+// searchFields are the fields of drivertest.HighScore that the conformance
+// tests query, and the key field.
+var searchFields = []SearchField{
+	{FieldPath: drivertest.KeyField, Type: SearchKeyword},
+	{FieldPath: "Game", Type: SearchKeyword},
+	{FieldPath: "Player", Type: SearchKeyword},
+	{FieldPath: "Score", Type: SearchNumeric},
+	{FieldPath: "Time", Type: SearchKeyword},
+}
+
+// mapping is the mapping of the test indexes. It is not dynamic, because the
+// conformance tests store values of different types in the same field.
+const mapping = `{
+	"settings": {"number_of_shards": 1, "number_of_replicas": 0},
+	"mappings": {
+		"dynamic": false,
+		"properties": {
+			"name": {"type": "keyword"},
+			"Game": {"type": "keyword"},
+			"Player": {"type": "keyword"},
+			"Score": {"type": "long"},
+			"Time": {"type": "keyword"}
+		}
+	}
+}`
+
+type harness struct {
+	client *elasticsearch.Client
+}
+
+// reset deletes and recreates an index.
+func (h *harness) reset(ctx context.Context, index string) error {
+	c := &collection{client: h.client}
+	err := c.do(ctx, esapi.IndicesDeleteRequest{Index: []string{index}}, nil)
+	if err != nil && c.ErrorCode(err) != gcerr.NotFound {
+		return err
+	}
+	return c.do(ctx, esapi.IndicesCreateRequest{Index: index, Body: strings.NewReader(mapping)}, nil)
+}
+
+func options(revField string) *Options {
+	return &Options{RevisionField: revField, Refresh: "true", SearchFields: searchFields}
+}
+
+func (h *harness) MakeCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, index1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, index1, drivertest.KeyField, nil, options(""))
+}
+
+func (h *harness) MakeTwoKeyCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, index2); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, index2, "", drivertest.HighScoreKey, options(""))
+}
+
+func (h *harness) MakeAlternateRevisionFieldCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, index1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, index1, drivertest.KeyField, nil, options(drivertest.AlternateRevisionField))
+}
+
+func (*harness) BeforeDoTypes() []interface{} {
+	return []interface{}{&elasticsearch.Client{}}
+}
+
+func (*harness) BeforeQueryTypes() []interface{} {
+	return []interface{}{&esapi.SearchRequest{}, &esapi.DeleteByQueryRequest{}}
+}
+
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
+func (*harness) Close() {}
+
+type codecTester struct{}
+
+func (codecTester) UnsupportedTypes() []drivertest.UnsupportedType {
+	return []drivertest.UnsupportedType{drivertest.BinarySet}
+}
+
+func (codecTester) DocstoreEncode(x interface{}) (interface{}, error) {
+	m, err := codec.EncodeDoc(drivertest.MustDocument(x))
+	if err != nil {
+		return nil, err
+	}
+	return jsoncodec.Marshal(m)
+}
+
+func (codecTester) DocstoreDecode(value, dest interface{}) error {
+	v, err := jsoncodec.Unmarshal(value.([]byte))
+	if err != nil {
+		return err
+	}
+	return codec.DecodeDoc(v.(map[string]interface{}), drivertest.MustDocument(dest), nil, docstore.DefaultRevisionField)
+}
+
+func (codecTester) NativeEncode(x interface{}) (interface{}, error) {
+	return json.Marshal(x)
+}
+
+func (codecTester) NativeDecode(value, dest interface{}) error {
+	return json.Unmarshal(value.([]byte), dest)
+}
+
+// asMatrix lists the types that the As methods support.
+var asMatrix = drivertest.AsMatrix{
+	Collection: []interface{}{new(*elasticsearch.Client)},
+	Iterator:   []interface{}{new(*SearchResponse)},
+	Error:      []interface{}{new(*Error)},
+}
+
+func TestConformance(t *testing.T) {
+	h := &harness{client: newTestClient(t)}
+	newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
+		return h, nil
+	}
+	drivertest.RunConformanceTests(t, newHarness, codecTester{}, []drivertest.AsTest{asMatrix})
+}
+
+func newTestClient(t *testing.T) *elasticsearch.Client {
+	if !setup.HasDockerTestEnvironment() {
+		t.Skip("Skipping Elasticsearch tests since the Elasticsearch server is not available")
+	}
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{serverURL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c := &collection{client: client}
+	if err := c.do(ctx, esapi.InfoRequest{}, nil); err != nil {
+		t.Fatalf("connecting to %s: %v", serverURL, err)
+	}
+	return client
+}
+
+func BenchmarkConformance(b *testing.B) {
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{serverURL}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := &harness{client: client}
+	if err := h.reset(context.Background(), index3); err != nil {
+		b.Fatal(err)
+	}
+	coll, err := newCollection(client, index3, drivertest.KeyField, nil, options(""))
+	if err != nil {
+		b.Fatal(err)
+	}
+	drivertest.RunBenchmarks(b, docstore.NewCollection(coll))
+}
+
+// Elasticsearch-specific tests.
+
+func TestPlanSearch(t *testing.T) {
+	c, err := newCollection(&elasticsearch.Client{}, "idx", "name", nil, &Options{SearchFields: []SearchField{
+		{FieldPath: "s", Type: SearchKeyword},
+		{FieldPath: "m.n", Type: SearchNumeric},
+		{FieldPath: "b", Type: SearchBoolean},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		f    driver.Filter
+		want string // empty if the filter is not sent to Elasticsearch
+	}{
+		{driver.Filter{FieldPath: []string{"s"}, Op: "=", Value: "a"}, `{"term":{"s":"a"}}`},
+		{driver.Filter{FieldPath: []string{"s"}, Op: "<", Value: "a"}, `{"range":{"s":{"lt":"a"}}}`},
+		{driver.Filter{FieldPath: []string{"s"}, Op: driver.HasPrefixOp, Value: "a"}, `{"prefix":{"s":"a"}}`},
+		{driver.Filter{FieldPath: []string{"s"}, Op: ">=", Value: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)},
+			`{"range":{"s":{"gte":"2019-06-01T00:00:00.000000000Z"}}}`},
+		{driver.Filter{FieldPath: []string{"s"}, Op: "=", Value: 1}, ""},
+		{driver.Filter{FieldPath: []string{"s"}, Op: driver.EqualFoldOp, Value: "a"}, ""},
+		{driver.Filter{FieldPath: []string{"m", "n"}, Op: ">", Value: 2.5}, `{"range":{"m.n":{"gt":2.5}}}`},
+		{driver.Filter{FieldPath: []string{"m", "n"}, Op: "<=", Value: uint(7)}, `{"range":{"m.n":{"lte":7}}}`},
+		{driver.Filter{FieldPath: []string{"m", "n"}, Op: driver.HasPrefixOp, Value: 1}, ""},
+		{driver.Filter{FieldPath: []string{"b"}, Op: "=", Value: true}, `{"term":{"b":true}}`},
+		{driver.Filter{FieldPath: []string{"b"}, Op: ">", Value: false}, ""},
+		{driver.Filter{FieldPath: []string{"b"}, Op: driver.ExistsOp}, ""},
+		{driver.Filter{FieldPath: []string{"other"}, Op: "=", Value: 1}, ""},
+	} {
+		cl, ok := c.filterClause(test.f)
+		got := ""
+		if ok {
+			b, err := json.Marshal(cl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = string(b)
+		}
+		if got != test.want {
+			t.Errorf("%+v: got %s, want %s", test.f, got, test.want)
+		}
+	}
+
+	sFilter := driver.Filter{FieldPath: []string{"s"}, Op: "=", Value: "x"}
+	existsFilter := driver.Filter{FieldPath: []string{"b"}, Op: driver.ExistsOp}
+	for _, test := range []struct {
+		q                   *driver.Query
+		wantScroll, wantLoc bool
+	}{
+		{&driver.Query{Filters: []driver.Filter{sFilter}, Limit: 10}, false, false},
+		{&driver.Query{Filters: []driver.Filter{sFilter}}, true, false},
+		{&driver.Query{Filters: []driver.Filter{existsFilter}, Limit: 10}, true, false},
+		{&driver.Query{OrderByField: "s", Limit: 10}, false, false},
+		{&driver.Query{OrderByField: "other", Limit: 10}, true, true},
+	} {
+		p := c.planSearch(test.q)
+		if p.scroll != test.wantScroll || p.sortLocal != test.wantLoc {
+			t.Errorf("%+v: got scroll %t, sort locally %t; want %t, %t", test.q, p.scroll, p.sortLocal, test.wantScroll, test.wantLoc)
+		}
+	}
+
+	plan, err := c.QueryPlan(&driver.Query{Filters: []driver.Filter{sFilter, existsFilter}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &driver.QueryPlan{
+		Description: `search idx {"query":{"bool":{"filter":[{"term":{"s":"x"}}]}},` +
+			`"seq_no_primary_term":true,"size":1000,"sort":["_doc"]}`,
+		Scan:          driver.ScanRange,
+		ServerFilters: []driver.Filter{sFilter},
+		ClientFilters: []driver.Filter{existsFilter},
+	}
+	if diff := cmp.Diff(plan, want); diff != "" {
+		t.Error(diff)
+	}
+	if plan, err = c.QueryPlan(&driver.Query{Filters: []driver.Filter{existsFilter}}); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Scan != driver.ScanFull {
+		t.Errorf("got %+v, want a full scan", plan)
+	}
+}
+
+func TestNewCollectionErrors(t *testing.T) {
+	for _, opts := range []*Options{
+		{Refresh: "sometimes"},
+		{SearchFields: []SearchField{{Type: SearchKeyword}}},
+		{SearchFields: []SearchField{{FieldPath: "a", Type: "text"}}},
+	} {
+		if _, err := newCollection(&elasticsearch.Client{}, "idx", "name", nil, opts); err == nil {
+			t.Errorf("%+v: got nil error, want error", opts)
+		}
+	}
+	if _, err := newCollection(&elasticsearch.Client{}, "", "name", nil, nil); err == nil {
+		t.Error("empty index: got nil error, want error")
+	}
+}
+
+func TestRevision(t *testing.T) {
+	r := revision{seqNo: 12, primaryTerm: 3}
+	got, err := parseRevision(r.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != r {
+		t.Errorf("got %v, want %v", got, r)
+	}
+	for _, s := range []string{"", "12", "12:", "a:3", "12:3:4"} {
+		if _, err := parseRevision(s); gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%q: got %v, want InvalidArgument", s, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := &collection{}
+	for _, test := range []struct {
+		status   int
+		body     string
+		want     *Error
+		wantCode gcerr.ErrorCode
+	}{
+		{
+			http.StatusConflict,
+			`{"error": {"type": "version_conflict_engine_exception", "reason": "[k]: version conflict"}, "status": 409}`,
+			&Error{StatusCode: 409, Type: "version_conflict_engine_exception", Reason: "[k]: version conflict"},
+			gcerr.FailedPrecondition,
+		},
+		{
+			http.StatusNotFound,
+			`{"_index": "idx", "_id": "k", "result": "not_found"}`,
+			&Error{StatusCode: 404},
+			gcerr.NotFound,
+		},
+		{
+			http.StatusBadRequest,
+			`{"error": "no handler found", "status": 400}`,
+			&Error{StatusCode: 400, Type: "error", Reason: "no handler found"},
+			gcerr.InvalidArgument,
+		},
+		{
+			http.StatusTooManyRequests,
+			`not JSON`,
+			&Error{StatusCode: 429, Reason: "not JSON"},
+			gcerr.ResourceExhausted,
+		},
+		{
+			http.StatusServiceUnavailable, `{}`, &Error{StatusCode: 503}, gcerr.Internal,
+		},
+	} {
+		err := newError(&esapi.Response{StatusCode: test.status, Body: ioutil.NopCloser(strings.NewReader(test.body))})
+		if diff := cmp.Diff(err, test.want); diff != "" {
+			t.Errorf("%d: %s", test.status, diff)
+		}
+		if got := c.ErrorCode(err); got != test.wantCode {
+			t.Errorf("%d: got code %v, want %v", test.status, got, test.wantCode)
+		}
+		var e *Error
+		if !c.ErrorAs(err, &e) || e != err {
+			t.Errorf("%d: ErrorAs failed", test.status)
+		}
+	}
+	if !isConflict(&Error{StatusCode: http.StatusConflict}) || isConflict(&Error{StatusCode: http.StatusNotFound}) {
+		t.Error("isConflict is wrong")
+	}
+}
+
+func TestFiltersMatch(t *testing.T) {
+	doc, err := decodeSource([]byte(`{"n": 3, "s": "Go", "t": "2019-06-01T01:00:00.000000000Z", "m": {"x": null}}`),
+		revision{1, 1}, docstore.DefaultRevisionField)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := doc[docstore.DefaultRevisionField], "1:1"; got != want {
+		t.Errorf("revision: got %v, want %v", got, want)
+	}
+	for _, test := range []struct {
+		f    driver.Filter
+		want bool
+	}{
+		{driver.Filter{FieldPath: []string{"n"}, Op: ">", Value: 2.5}, true},
+		{driver.Filter{FieldPath: []string{"n"}, Op: "=", Value: "3"}, false},
+		{driver.Filter{FieldPath: []string{"s"}, Op: driver.EqualFoldOp, Value: "go"}, true},
+		{driver.Filter{FieldPath: []string{"t"}, Op: "<", Value: time.Date(2019, 6, 1, 2, 0, 0, 0, time.UTC)}, true},
+		{driver.Filter{FieldPath: []string{"m", "x"}, Op: driver.ExistsOp}, true},
+		{driver.Filter{FieldPath: []string{"m", "y"}, Op: driver.NotExistsOp}, true},
+		{driver.Filter{FieldPath: []string{"s", "y"}, Op: "=", Value: 1}, false},
+	} {
+		if got := eval.FiltersMatch([]driver.Filter{test.f}, doc); got != test.want {
+			t.Errorf("%+v: got %t, want %t", test.f, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elasticdocstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+)
+
+// eval evaluates the filters and sort orders that Elasticsearch cannot, on the
+// documents it returns, and applies modifications to documents.
+var eval = mapdoc.Evaluator{ToGo: codec.ToGo, EncodeValue: codec.EncodeValue}
+
+const (
+	// batchSize is the number of documents requested by each search or scroll.
+	batchSize = 1000
+
+	// scrollKeepAlive is how long Elasticsearch keeps a scroll's results
+	// between requests. It must be a whole number of seconds under a minute,
+	// because Elasticsearch does not parse the form that time.Duration.String
+	// gives longer durations.
+	scrollKeepAlive = 30 * time.Second
+)
+
+// scrollParam is the value of a request's Scroll field that asks for a scroll
+// kept for scrollKeepAlive. The client multiplies the field by time.Millisecond.
+const scrollParam = scrollKeepAlive / time.Millisecond
+
+// SupportsFilter implements driver.SupportsFilter. All filters are evaluated
+// on the client, whether or not they are also sent to Elasticsearch.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// A searchPlan says how to search for the documents that may match a query.
+type searchPlan struct {
+	body      map[string]interface{} // the body of the search request
+	pushed    []driver.Filter        // the filters in body
+	local     []driver.Filter        // the filters only evaluated on the client
+	sortLocal bool                   // whether to sort the results on the client
+	scroll    bool                   // whether to use the scroll API
+}
+
+// scan returns the kind of scan the plan needs: without filters in the request,
+// every document is examined, and with them, Elasticsearch's indexes are used.
+func (p searchPlan) scan() driver.ScanKind {
+	if len(p.pushed) == 0 {
+		return driver.ScanFull
+	}
+	return driver.ScanRange
+}
+
+// planSearch returns the search for q.
+func (c *collection) planSearch(q *driver.Query) searchPlan {
+	var (
+		p       searchPlan
+		clauses []interface{}
+	)
+	for _, f := range q.Filters {
+		if cl, ok := c.filterClause(f); ok {
+			clauses = append(clauses, cl)
+			p.pushed = append(p.pushed, f)
+		} else {
+			p.local = append(p.local, f)
+		}
+	}
+	query := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if len(clauses) > 0 {
+		query = map[string]interface{}{"bool": map[string]interface{}{"filter": clauses}}
+	}
+	// Sorting by _doc is the cheapest order for scrolling.
+	var order interface{} = []interface{}{"_doc"}
+	if q.OrderByField != "" {
+		if sf, ok := c.searchField([]string{q.OrderByField}); ok && sf.Type != SearchBoolean {
+			dir := "desc"
+			if q.OrderAscending {
+				dir = "asc"
+			}
+			order = []interface{}{map[string]interface{}{q.OrderByField: map[string]interface{}{"order": dir}}}
+		} else {
+			p.sortLocal = true
+		}
+	}
+	size := batchSize
+	if q.Limit > 0 && q.Limit <= batchSize && len(p.local) == 0 && !p.sortLocal {
+		// The first page holds all the results.
+		size = q.Limit
+	} else {
+		p.scroll = true
+	}
+	p.body = map[string]interface{}{
+		"query":               query,
+		"sort":                order,
+		"size":                size,
+		"seq_no_primary_term": true,
+	}
+	return p
+}
+
+// searchField returns the search field for fp, if there is one.
+func (c *collection) searchField(fp []string) (SearchField, bool) {
+	path := strings.Join(fp, ".")
+	for _, sf := range c.opts.SearchFields {
+		if sf.FieldPath == path {
+			return sf, true
+		}
+	}
+	return SearchField{}, false
+}
+
+// filterClause returns the query DSL clause for f, if there is a search field
+// that can evaluate it.
+func (c *collection) filterClause(f driver.Filter) (interface{}, bool) {
+	sf, ok := c.searchField(f.FieldPath)
+	if !ok {
+		return nil, false
+	}
+	v, ok := searchValue(f.Value)
+	if !ok {
+		return nil, false
+	}
+	switch v.(type) {
+	case string:
+		ok = sf.Type == SearchKeyword
+	case bool:
+		ok = sf.Type == SearchBoolean && f.Op == driver.EqualOp
+	default:
+		ok = sf.Type == SearchNumeric && f.Op != driver.HasPrefixOp
+	}
+	if !ok {
+		return nil, false
+	}
+	var (
+		kind string
+		arg  interface{}
+	)
+	switch f.Op {
+	case driver.EqualOp:
+		kind, arg = "term", v
+	case ">":
+		kind, arg = "range", map[string]interface{}{"gt": v}
+	case ">=":
+		kind, arg = "range", map[string]interface{}{"gte": v}
+	case "<":
+		kind, arg = "range", map[string]interface{}{"lt": v}
+	case "<=":
+		kind, arg = "range", map[string]interface{}{"lte": v}
+	case driver.HasPrefixOp:
+		kind, arg = "prefix", v
+	default:
+		return nil, false
+	}
+	return map[string]interface{}{kind: map[string]interface{}{sf.FieldPath: arg}}, true
+}
+
+// searchValue returns the value of a filter as it appears in the query DSL, if
+// Elasticsearch can compare it: a string, finite number or bool. Times are
+// compared as the strings they are stored as.
+func searchValue(v interface{}) (interface{}, bool) {
+	ev, err := codec.EncodeValue(v)
+	if err != nil {
+		return nil, false
+	}
+	switch ev := ev.(type) {
+	case string, int64, uint64, bool:
+		return ev, true
+	case float64:
+		return ev, !math.IsNaN(ev) && !math.IsInf(ev, 0)
+	default:
+		return nil, false
+	}
+}
+
+// newSearchRequest returns the search request for p.
+func (c *collection) newSearchRequest(p searchPlan) (*esapi.SearchRequest, error) {
+	b, err := body(p.body)
+	if err != nil {
+		return nil, err
+	}
+	req := &esapi.SearchRequest{Index: []string{c.index}, Body: b}
+	if p.scroll {
+		req.Scroll = scrollParam
+	}
+	return req, nil
+}
+
+// beforeQuery calls q.BeforeQuery, if any, with an as function that exposes
+// req.
+func beforeQuery(q *driver.Query, req interface{}) error {
+	if q.BeforeQuery == nil {
+		return nil
+	}
+	return q.BeforeQuery(driver.AsFunc(req))
+}
+
+// SearchResponse is a page of the results of a search, as returned by the
+// search and scroll APIs.
+type SearchResponse struct {
+	ScrollID string     `json:"_scroll_id"`
+	Took     int        `json:"took"`
+	TimedOut bool       `json:"timed_out"`
+	Hits     SearchHits `json:"hits"`
+}
+
+// SearchHits are the hits of a SearchResponse.
+type SearchHits struct {
+	// Total is the total number of hits: a number, or an object with value and
+	// relation fields in Elasticsearch 7 and later.
+	Total    json.RawMessage `json:"total"`
+	MaxScore *float64        `json:"max_score"`
+	Hits     []SearchHit     `json:"hits"`
+}
+
+// A SearchHit is a document in a SearchResponse.
+type SearchHit struct {
+	Index       string          `json:"_index"`
+	ID          string          `json:"_id"`
+	Score       *float64        `json:"_score"`
+	SeqNo       int             `json:"_seq_no"`
+	PrimaryTerm int             `json:"_primary_term"`
+	Source      json.RawMessage `json:"_source"`
+	Sort        []interface{}   `json:"sort"`
+}
+
+// A scroller pages through the results of a search.
+type scroller struct {
+	coll *collection
+	req  *esapi.SearchRequest
+	res  *SearchResponse // the most recent page
+	done bool            // no pages remain
+}
+
+// next returns the next page of results, or io.EOF when there are no more.
+func (s *scroller) next(ctx context.Context) (*SearchResponse, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	var (
+		res SearchResponse
+		err error
+	)
+	if s.res == nil {
+		err = s.coll.do(ctx, s.req, &res)
+	} else {
+		err = s.coll.do(ctx, esapi.ScrollRequest{ScrollID: s.res.ScrollID, Scroll: scrollParam}, &res)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.ScrollID == "" && s.res != nil {
+		res.ScrollID = s.res.ScrollID
+	}
+	s.res = &res
+	// Without a scroll, the first page is the only one.
+	s.done = s.req.Scroll == 0 || len(res.Hits.Hits) == 0
+	if s.done {
+		s.close()
+	}
+	return &res, nil
+}
+
+// close releases the scroll, if any.
+func (s *scroller) close() {
+	if s.res == nil || s.res.ScrollID == "" {
+		return
+	}
+	// The scroll expires anyway, so ignore errors. The request must be made even
+	// if the context of the query is done.
+	_ = s.coll.do(context.Background(), esapi.ClearScrollRequest{ScrollID: []string{s.res.ScrollID}}, nil)
+	s.res.ScrollID = ""
+}
+
+// A match is a document that matches a query.
+type match struct {
+	id  string
+	rev revision
+	doc map[string]interface{}
+}
+
+// matches returns the documents among hits that satisfy fs.
+func (c *collection) matches(hits []SearchHit, fs []driver.Filter) ([]match, error) {
+	var ms []match
+	for _, h := range hits {
+		rev := revision{h.SeqNo, h.PrimaryTerm}
+		doc, err := decodeSource(h.Source, rev, c.opts.RevisionField)
+		if err != nil {
+			return nil, err
+		}
+		if eval.FiltersMatch(fs, doc) {
+			ms = append(ms, match{h.ID, rev, doc})
+		}
+	}
+	return ms, nil
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	p := c.planSearch(q)
+	req, err := c.newSearchRequest(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := beforeQuery(q, req); err != nil {
+		return nil, err
+	}
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	it := &docIterator{
+		coll:       c,
+		scroller:   &scroller{coll: c, req: req},
+		filters:    q.Filters,
+		limit:      q.Limit,
+		fieldPaths: fps,
+	}
+	// Read the first page now, so that As can expose it.
+	if err := it.nextPage(ctx); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if p.sortLocal {
+		// Elasticsearch cannot sort on the field, so read all the results and sort
+		// them here.
+		for {
+			err := it.nextPage(ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				it.scroller.close()
+				return nil, err
+			}
+		}
+		eval.SortDocs(it.docs, strings.Split(q.OrderByField, "."), q.OrderAscending)
+	}
+	return it, nil
+}
+
+// docIterator returns the documents that match a query, reading them a page at
+// a time.
+type docIterator struct {
+	coll       *collection
+	scroller   *scroller
+	docs       []map[string]interface{}
+	filters    []driver.Filter
+	limit      int
+	count      int
+	fieldPaths [][]string
+	err        error
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.limit > 0 && it.count >= it.limit {
+		it.Stop()
+		return it.err
+	}
+	for len(it.docs) == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := it.nextPage(ctx); err != nil {
+			it.err = err
+			return err
+		}
+	}
+	if err := codec.DecodeDoc(it.docs[0], doc, it.fieldPaths, it.coll.opts.RevisionField); err != nil {
+		it.err = err
+		return it.err
+	}
+	it.docs = it.docs[1:]
+	it.count++
+	return nil
+}
+
+// nextPage appends the matching documents of the next page of results to
+// it.docs. It returns io.EOF if there are no more pages.
+func (it *docIterator) nextPage(ctx context.Context) error {
+	res, err := it.scroller.next(ctx)
+	if err != nil {
+		return err
+	}
+	ms, err := it.coll.matches(res.Hits.Hits, it.filters)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		it.docs = append(it.docs, m.doc)
+	}
+	return nil
+}
+
+func (it *docIterator) Stop() {
+	it.scroller.close()
+	it.err = io.EOF
+}
+
+// As implements driver.DocumentIterator.As. It exposes the most recent page of
+// results as *SearchResponse.
+func (it *docIterator) As(i interface{}) bool {
+	p, ok := i.(**SearchResponse)
+	if !ok || it.scroller.res == nil {
+		return false
+	}
+	*p = it.scroller.res
+	return true
+}
+
+// QueryPlan implements driver.QueryPlan. The description is the body of the
+// search request.
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	p := c.planSearch(q)
+	b, err := jsoncodec.Marshal(p.body)
+	if err != nil {
+		return nil, err
+	}
+	return &driver.QueryPlan{
+		Description:   fmt.Sprintf("search %s %s", c.index, b),
+		Scan:          p.scan(),
+		ServerFilters: p.pushed,
+		ClientFilters: p.local,
+	}, nil
+}
+
+// matchingDocs returns the documents that match q. It reads them all before
+// returning, so that changing them cannot affect the search.
+func (c *collection) matchingDocs(ctx context.Context, q *driver.Query) ([]match, error) {
+	p := c.planSearch(&driver.Query{Filters: q.Filters})
+	req, err := c.newSearchRequest(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := beforeQuery(q, req); err != nil {
+		return nil, err
+	}
+	s := &scroller{coll: c, req: req}
+	defer s.close()
+	var ms []match
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		res, err := s.next(ctx)
+		if err == io.EOF {
+			return ms, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch, err := c.matches(res.Hits.Hits, q.Filters)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, batch...)
+	}
+}
+
+// RunDeleteQuery implements driver.RunDeleteQuery. If Elasticsearch can
+// evaluate all of the query's filters, it uses the delete by query API.
+// Otherwise, each matching document is deleted on its own, provided it still
+// matches.
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	p := c.planSearch(&driver.Query{Filters: q.Filters})
+	if len(p.local) > 0 {
+		return c.rewriteMatches(ctx, q, nil)
+	}
+	b, err := body(map[string]interface{}{"query": p.body["query"]})
+	if err != nil {
+		return err
+	}
+	refresh := c.opts.Refresh == "true" || c.opts.Refresh == "wait_for"
+	req := &esapi.DeleteByQueryRequest{
+		Index: []string{c.index},
+		Body:  b,
+		// Skip documents that change during the request, rather than fail.
+		Conflicts: "proceed",
+		Refresh:   &refresh,
+	}
+	if err := beforeQuery(q, req); err != nil {
+		return err
+	}
+	return c.do(ctx, req, nil)
+}
+
+// RunUpdateQuery implements driver.RunUpdateQuery. Each matching document is
+// updated on its own, provided it still matches.
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	return c.rewriteMatches(ctx, q, mods)
+}
+
+// rewriteMatches applies mods to each document that matches q, or deletes it if
+// mods is nil. A document that changes before it is written is read again, and
+// rewritten if it still matches.
+func (c *collection) rewriteMatches(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	ms, err := c.matchingDocs(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		for i := 1; ; i++ {
+			err := c.rewrite(ctx, m, q.Filters, mods)
+			if !isConflict(err) || i == mapdoc.MaxWriteAttempts {
+				if err != nil {
+					return err
+				}
+				break
+			}
+			if m.doc, m.rev, err = c.read(ctx, m.id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewrite applies mods to the matching document m, or deletes it if mods is
+// nil, if m still satisfies fs.
+func (c *collection) rewrite(ctx context.Context, m match, fs []driver.Filter, mods []driver.Mod) error {
+	if m.doc == nil || !eval.FiltersMatch(fs, m.doc) {
+		return nil
+	}
+	if mods == nil {
+		return c.delete(ctx, m.id, &m.rev)
+	}
+	if err := eval.ApplyMods(m.doc, mods); err != nil {
+		return err
+	}
+	delete(m.doc, c.opts.RevisionField)
+	_, err := c.indexSource(ctx, m.id, m.doc, &m.rev, "")
+	return err
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elasticdocstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch"
+	"gocloud.dev/docstore"
+)
+
+func init() {
+	docstore.DefaultURLMux().RegisterCollection(Scheme, new(defaultDialer))
+}
+
+// defaultDialer connects to the Elasticsearch cluster at the addresses in the
+// environment variable ELASTICSEARCH_URL, separated by commas, or at
+// http://localhost:9200 if it is not set.
+type defaultDialer struct {
+	init   sync.Once
+	opener *URLOpener
+	err    error
+}
+
+func (o *defaultDialer) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	o.init.Do(func() {
+		client, err := elasticsearch.NewDefaultClient()
+		if err != nil {
+			o.err = fmt.Errorf("failed to create default Elasticsearch client: %v", err)
+			return
+		}
+		o.opener = &URLOpener{Client: client}
+	})
+	if o.err != nil {
+		return nil, fmt.Errorf("open collection %s: %v", u, o.err)
+	}
+	return o.opener.OpenCollectionURL(ctx, u)
+}
+
+// Scheme is the URL scheme elasticdocstore registers its URLOpener under on
+// docstore.DefaultMux.
+const Scheme = "elasticsearch"
+
+// URLOpener opens URLs like "elasticsearch://myindex/_id".
+//
+// The URL's host is the name of the index.
+// The URL's path is used as the keyField.
+//
+// The following query parameters are supported:
+//
+//   - refresh (optional): the value of Options.Refresh.
+type URLOpener struct {
+	// Client is the Elasticsearch client, which must be non-nil.
+	Client *elasticsearch.Client
+
+	// Options specifies the options to pass to OpenCollection.
+	Options Options
+}
+
+// OpenCollectionURL opens a docstore.Collection based on u.
+func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	opts := o.Options
+	q := u.Query()
+	if r := q.Get("refresh"); r != "" {
+		opts.Refresh = r
+	}
+	q.Del("refresh")
+	for param := range q {
+		return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+	}
+	index := u.Host
+	if index == "" {
+		return nil, fmt.Errorf("open collection %v: empty index name", u)
+	}
+	keyName := strings.TrimPrefix(u.Path, "/")
+	if keyName == "" || strings.ContainsRune(keyName, '/') {
+		return nil, fmt.Errorf("open collection %v: invalid key name %q (must be non-empty and have no slashes)", u, keyName)
+	}
+	return OpenCollection(o.Client, index, keyName, &opts)
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elasticdocstore
+
+import (
+	"context"
+	"testing"
+
+	"gocloud.dev/docstore"
+)
+
+func TestOpenCollectionFromURL(t *testing.T) {
+	// Opening a collection makes no requests, so no server is needed.
+	tests := []struct {
+		URL     string
+		wantErr bool
+	}{
+		// OK.
+		{"elasticsearch://myindex/_id", false},
+		// OK, with refresh.
+		{"elasticsearch://myindex/_id?refresh=wait_for", false},
+		{"elasticsearch://myindex/_id?refresh=sometimes", true}, // invalid refresh
+		{"elasticsearch:///_id", true},                          // missing index
+		{"elasticsearch://myindex", true},                       // missing key
+		{"elasticsearch://myindex/my/key", true},                // key with slash
+		{"elasticsearch://myindex/_id?param=value", true},       // invalid parameter
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		_, err := docstore.OpenCollection(ctx, test.URL)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.wantErr)
+		}
+	}
+}
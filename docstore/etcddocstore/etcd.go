@@ -0,0 +1,554 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcddocstore provides an implementation of the docstore API for
+// etcd, storing each document as the value of an etcd key. It suits small
+// collections that change rarely, like configuration.
+//
+// The etcd key of a document is the collection's key prefix followed by the
+// document's key, which must be a non-empty string. The value is the gob
+// encoding of the document, without its revision field. The revision of a
+// document is the mod revision of its key, an int64 that etcd increases each
+// time the key is written.
+//
+//
+// URLs
+//
+// For docstore.OpenCollection, etcddocstore registers for the scheme "etcd".
+// The default URL opener will dial an etcd server based on the environment
+// variable "ETCD_SERVER_URL".
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://gocloud.dev/concepts/urls/ for background information.
+//
+//
+// Action Lists
+//
+// The Get actions in each group of an action list are executed with a single
+// etcd transaction. Each write action is a transaction of its own, and the
+// write actions run concurrently. Writes that depend on the stored document,
+// like Update or a Replace with a revision, first read the document, and then
+// apply their write only if the mod revision of its key has not changed,
+// retrying if it has. etcddocstore calls the BeforeDo function before the
+// transaction of the Gets, and before each attempt of a write, with an as
+// function that exposes *[]clientv3.OpOption: the options of each Get, or of
+// the Put or Delete of the write. For example, a BeforeDo function can add
+// clientv3.WithLease to make a document expire.
+//
+//
+// Queries
+//
+// A query reads the documents of a range of keys and evaluates its filters on
+// the client. If the collection has a key field, filters on that field with
+// string values narrow the range: "=", ">", ">=", "<", "<=" and the has-prefix
+// operator are answered by the range alone. Otherwise, the query reads every
+// document of the collection. All the reads of a query are made at the etcd
+// revision of its first read, so the query sees a consistent snapshot of the
+// collection.
+//
+// etcd returns keys in order, so Query.OrderBy on the key field in ascending
+// order costs nothing. Other orders are sorted on the client, after reading
+// all the matching documents.
+//
+//
+// As
+//
+// etcddocstore exposes the following types for As:
+// - Collection: *clientv3.Client
+// - ActionList.BeforeDo: *[]clientv3.OpOption
+// - Query.BeforeQuery: *[]clientv3.OpOption, the options of each read
+// - DocumentIterator: *clientv3.GetResponse, the latest read
+// - Error: rpctypes.EtcdError
+//
+//
+// Special Considerations
+//
+// Field values are stored in the gob encoding, which preserves their types but
+// is not readily decoded outside of Go. Unsigned integers are stored as int64s.
+//
+// A query that runs while etcd compacts its history past the query's revision
+// fails with rpctypes.ErrCompacted.
+package etcddocstore // import "gocloud.dev/docstore/etcddocstore"
+
+import (
+	"context"
+	"sync"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+	"google.golang.org/grpc/status"
+)
+
+// maxTxnOps is the largest number of operations an etcd server accepts in a
+// transaction by default.
+const maxTxnOps = 128
+
+// MaxDocumentSize is the largest request an etcd server accepts by default, in
+// bytes. See https://etcd.io/docs/v3.3/dev-guide/limit/.
+const MaxDocumentSize = 1536 << 10
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// The maximum number of write actions that run concurrently for a single
+	// call to ActionList.Do. If less than 1, there is no limit.
+	MaxOutstandingActionRPCs int
+}
+
+type collection struct {
+	client   *clientv3.Client
+	prefix   string
+	keyField string
+	keyFunc  func(docstore.Document) interface{}
+	opts     *Options
+
+	beforeDoMu sync.Mutex // serializes calls to BeforeDo
+}
+
+// OpenCollection opens a docstore collection whose documents are stored under
+// the etcd keys that begin with prefix. keyField is the document field holding
+// the primary key, which must be a string. The prefix should end with a
+// separator, like "/", so that the keys of the collection do not mix with
+// other keys.
+func OpenCollection(client *clientv3.Client, prefix, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, prefix, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens a docstore collection whose documents are
+// stored under the etcd keys that begin with prefix. keyFunc takes a document
+// and returns its primary key, which must be a string. It should return nil if
+// the document is missing the information to construct a key. This will cause
+// all actions, even Create, to fail.
+func OpenCollectionWithKeyFunc(client *clientv3.Client, prefix string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, prefix, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(client *clientv3.Client, prefix, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if client == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "etcddocstore: client is nil")
+	}
+	if prefix == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "etcddocstore: key prefix is empty")
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "etcddocstore: must provide either keyField or keyFunc")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	return &collection{
+		client:   client,
+		prefix:   prefix,
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+	}, nil
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// etcdKey returns the etcd key of the document of a, whose key must be a
+// non-empty string.
+func (c *collection) etcdKey(a *driver.Action) (string, error) {
+	s, ok := a.Key.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "etcddocstore: key %v is a %T, not a string", a.Key, a.Key)
+	}
+	if s == "" {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "etcddocstore: key is empty")
+	}
+	return c.prefix + s, nil
+}
+
+func (c *collection) RevisionField() string { return c.opts.RevisionField }
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return MaxDocumentSize }
+
+// A storedDoc is a document read from etcd.
+type storedDoc struct {
+	doc map[string]interface{} // with the revision in the revision field
+	rev int64                  // the mod revision of the key
+}
+
+// decodeValue decodes the document stored under key in value, whose key has
+// the mod revision rev.
+func (c *collection) decodeValue(key string, value []byte, rev int64) (*storedDoc, error) {
+	m, err := gobcodec.Unmarshal(value)
+	if err != nil {
+		return nil, gcerr.Newf(gcerr.Internal, err, "etcddocstore: decoding the value of key %q", key)
+	}
+	m[c.opts.RevisionField] = rev
+	return &storedDoc{doc: m, rev: rev}, nil
+}
+
+// get reads the document stored under the etcd key ekey. It returns nil if
+// there is none.
+func (c *collection) get(ctx context.Context, ekey string) (*storedDoc, error) {
+	resp, err := c.client.Get(ctx, ekey)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	kv := resp.Kvs[0]
+	return c.decodeValue(ekey, kv.Value, kv.ModRevision)
+}
+
+// value returns the stored encoding of doc, an encoded document. The revision
+// is not stored.
+func (c *collection) value(doc map[string]interface{}) (string, error) {
+	delete(doc, c.opts.RevisionField)
+	b, err := gobcodec.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	for _, group := range [][]*driver.Action{beforeGets, gets, writes, afterGets} {
+		if driver.ShouldStop(opts, errs) {
+			driver.SkipActions(group, errs)
+			continue
+		}
+		if len(group) > 0 && group[0].Kind == driver.Get {
+			c.runGets(ctx, group, errs, opts)
+		} else {
+			c.runWrites(ctx, group, errs, opts)
+		}
+	}
+	return driver.NewActionListError(errs)
+}
+
+// beforeDo calls opts.BeforeDo, if any, with an as function that exposes the
+// options of an etcd operation, and returns them.
+func (c *collection) beforeDo(opts *driver.RunActionsOptions) ([]clientv3.OpOption, error) {
+	if opts.BeforeDo == nil {
+		return nil, nil
+	}
+	var ops []clientv3.OpOption
+	c.beforeDoMu.Lock()
+	defer c.beforeDoMu.Unlock()
+	if err := opts.BeforeDo(driver.AsFunc(&ops)); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// runGets reads the documents of gets with a single transaction, or with one
+// for each maxTxnOps distinct keys.
+func (c *collection) runGets(ctx context.Context, gets []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	var (
+		ekeys  []string
+		byEKey = map[string][]*driver.Action{}
+	)
+	for _, a := range gets {
+		ekey, err := c.etcdKey(a)
+		if err != nil {
+			errs[a.Index] = err
+			continue
+		}
+		if byEKey[ekey] == nil {
+			ekeys = append(ekeys, ekey)
+		}
+		byEKey[ekey] = append(byEKey[ekey], a)
+	}
+	if len(ekeys) == 0 {
+		return
+	}
+	setErr := func(err error) {
+		for _, as := range byEKey {
+			for _, a := range as {
+				errs[a.Index] = err
+			}
+		}
+	}
+	ops, err := c.beforeDo(opts)
+	if err != nil {
+		setErr(err)
+		return
+	}
+	docs := map[string]*storedDoc{}
+	for len(ekeys) > 0 {
+		n := len(ekeys)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		gops := make([]clientv3.Op, n)
+		for i, ekey := range ekeys[:n] {
+			gops[i] = clientv3.OpGet(ekey, ops...)
+		}
+		resp, err := c.client.Txn(ctx).Then(gops...).Commit()
+		if err != nil {
+			setErr(err)
+			return
+		}
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				sd, err := c.decodeValue(string(kv.Key), kv.Value, kv.ModRevision)
+				if err != nil {
+					setErr(err)
+					return
+				}
+				docs[string(kv.Key)] = sd
+			}
+		}
+		ekeys = ekeys[n:]
+	}
+	for ekey, as := range byEKey {
+		for _, a := range as {
+			if sd := docs[ekey]; sd == nil {
+				errs[a.Index] = gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+			} else {
+				errs[a.Index] = gobcodec.DecodeDoc(sd.doc, a.Doc, a.FieldPaths, c.opts.RevisionField)
+			}
+		}
+	}
+}
+
+// runWrites runs each write action concurrently. With FailFast, it stops
+// starting actions once one fails.
+func (c *collection) runWrites(ctx context.Context, writes []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	mapdoc.RunConcurrently(writes, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+		return c.runWrite(ctx, a, opts)
+	})
+}
+
+// runWrite executes a single write action, retrying it if the document changes
+// between reading it and writing it.
+func (c *collection) runWrite(ctx context.Context, a *driver.Action, opts *driver.RunActionsOptions) error {
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	ekey, err := c.etcdKey(a)
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		done, err := c.write(ctx, ekey, a, opts)
+		if err != nil || done {
+			return err
+		}
+		if i == mapdoc.MaxWriteAttempts {
+			return gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q kept changing during the write", a.Key)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// write makes one attempt at the write action a on the etcd key ekey. It
+// reports false if the document changed after it was read, so that the write
+// was not applied.
+func (c *collection) write(ctx context.Context, ekey string, a *driver.Action, opts *driver.RunActionsOptions) (bool, error) {
+	wantRev, err := c.revision(a.Doc)
+	if err != nil {
+		return false, err
+	}
+	blind := wantRev == nil && len(a.Conditions) == 0
+	switch {
+	case a.Kind == driver.Create && len(a.Conditions) == 0:
+		// Write the document only if the key does not exist.
+		doc, err := gobcodec.EncodeDoc(a.Doc)
+		if err != nil {
+			return false, err
+		}
+		ok, err := c.writeDoc(ctx, ekey, a, doc, []clientv3.Cmp{unchanged(ekey, nil)}, opts)
+		if err == nil && !ok {
+			err = gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %q exists", a.Key)
+		}
+		return true, err
+	case blind && a.Kind == driver.Put:
+		doc, err := gobcodec.EncodeDoc(a.Doc)
+		if err != nil {
+			return false, err
+		}
+		return c.writeDoc(ctx, ekey, a, doc, nil, opts)
+	case blind && a.Kind == driver.Delete:
+		return c.deleteKey(ctx, ekey, nil, opts)
+	}
+
+	current, err := c.get(ctx, ekey)
+	if err != nil {
+		return false, err
+	}
+	exists := current != nil
+	switch {
+	case exists && a.Kind == driver.Create:
+		return false, gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %q exists", a.Key)
+	case !exists && a.Kind == driver.Delete:
+		return true, nil
+	case !exists && len(a.Conditions) > 0:
+		return false, gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q does not exist", a.Key)
+	case !exists && (a.Kind == driver.Replace || a.Kind == driver.Update):
+		return false, gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+	case exists && !eval.FiltersMatch(a.Conditions, current.doc):
+		return false, gcerr.Newf(gcerr.FailedPrecondition, nil, "conditions not satisfied for document with key %q", a.Key)
+	}
+	if exists && wantRev != nil && *wantRev != current.rev {
+		return false, gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %d, current %d", *wantRev, current.rev)
+	}
+	guard := []clientv3.Cmp{unchanged(ekey, current)}
+
+	switch a.Kind {
+	case driver.Delete:
+		return c.deleteKey(ctx, ekey, guard, opts)
+	case driver.Update:
+		if err := eval.ApplyMods(current.doc, a.Mods); err != nil {
+			return false, err
+		}
+		return c.writeDoc(ctx, ekey, a, current.doc, guard, opts)
+	default:
+		doc, err := gobcodec.EncodeDoc(a.Doc)
+		if err != nil {
+			return false, err
+		}
+		return c.writeDoc(ctx, ekey, a, doc, guard, opts)
+	}
+}
+
+// revision returns the revision in doc, or nil if it has none.
+func (c *collection) revision(doc driver.Document) (*int64, error) {
+	rev, err := doc.GetField(c.opts.RevisionField)
+	if err != nil || rev == nil {
+		return nil, nil // no incoming revision information: nothing to check
+	}
+	n, ok := rev.(int64)
+	if !ok {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want int64", c.opts.RevisionField, rev)
+	}
+	return &n, nil
+}
+
+// unchanged returns a comparison that is true of the etcd key ekey if it still
+// holds current, a document read from it, or if current is nil, if the key
+// does not exist.
+func unchanged(ekey string, current *storedDoc) clientv3.Cmp {
+	if current == nil {
+		return clientv3.Compare(clientv3.CreateRevision(ekey), "=", 0)
+	}
+	return clientv3.Compare(clientv3.ModRevision(ekey), "=", current.rev)
+}
+
+// writeDoc writes doc to the etcd key ekey if all the comparisons of guard are
+// true, and reports whether it did. The new revision is set in the document of
+// a.
+func (c *collection) writeDoc(ctx context.Context, ekey string, a *driver.Action, doc map[string]interface{}, guard []clientv3.Cmp, opts *driver.RunActionsOptions) (bool, error) {
+	val, err := c.value(doc)
+	if err != nil {
+		return false, err
+	}
+	ops, err := c.beforeDo(opts)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.client.Txn(ctx).If(guard...).Then(clientv3.OpPut(ekey, val, ops...)).Commit()
+	if err != nil || !resp.Succeeded {
+		return false, err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, resp.Header.Revision)
+	return true, nil
+}
+
+// deleteKey deletes the etcd key ekey if all the comparisons of guard are
+// true, and reports whether it did.
+func (c *collection) deleteKey(ctx context.Context, ekey string, guard []clientv3.Cmp, opts *driver.RunActionsOptions) (bool, error) {
+	ops, err := c.beforeDo(opts)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.client.Txn(ctx).If(guard...).Then(clientv3.OpDelete(ekey, ops...)).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool {
+	p, ok := i.(**clientv3.Client)
+	if !ok {
+		return false
+	}
+	*p = c.client
+	return true
+}
+
+// ErrorAs implements driver.Collection.ErrorAs.
+func (c *collection) ErrorAs(err error, i interface{}) bool {
+	e, ok := err.(rpctypes.EtcdError)
+	if !ok {
+		return false
+	}
+	p, ok := i.(*rpctypes.EtcdError)
+	if !ok {
+		return false
+	}
+	*p = e
+	return true
+}
+
+// ErrorCode implements driver.Collection.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	switch e := err.(type) {
+	case *gcerr.Error:
+		return e.Code
+	case rpctypes.EtcdError:
+		return gcerr.GRPCCode(status.Error(e.Code(), e.Error()))
+	default:
+		return gcerr.GRPCCode(err)
+	}
+}
+
+// Close implements driver.Collection.Close. It does not close the client.
+func (c *collection) Close() error { return nil }
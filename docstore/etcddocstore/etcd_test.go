@@ -0,0 +1,220 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcddocstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.etcd.io/etcd/clientv3"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/testing/setup"
+)
+
+// To run these tests against a local etcd server, first run
+// ../../runtimevar/etcdvar/localetcd.sh. Then wait a few seconds for the
+// server to be ready.
+
+const (
+	serverURL = "http://localhost:2379"
+	prefix1   = "docstore-test-1/"
+	prefix2   = "docstore-test-2/"
+	prefix3   = "docstore-test-3/"
+)
+
+func newClient(t testing.TB) *clientv3.Client {
+	if !setup.HasDockerTestEnvironment() {
+		t.Skip("Skipping etcd tests since the etcd server is not available")
+	}
+	c, err := clientv3.NewFromURL(serverURL)
+	if err != nil {
+		t.Fatalf("No local etcd server running: %v; see runtimevar/etcdvar/localetcd.sh", err)
+	}
+	return c
+}
+
+// clear deletes the keys that begin with prefix.
+func clear(ctx context.Context, client *clientv3.Client, prefix string) error {
+	_, err := client.Delete(ctx, prefix, clientv3.WithPrefix())
+	return err
+}
+
+type harness struct {
+	client *clientv3.Client
+}
+
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	return &harness{newClient(t)}, nil
+}
+
+func (h *harness) MakeCollection(ctx context.Context) (driver.Collection, error) {
+	if err := clear(ctx, h.client, prefix1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, prefix1, drivertest.KeyField, nil, nil)
+}
+
+func (h *harness) MakeTwoKeyCollection(ctx context.Context) (driver.Collection, error) {
+	if err := clear(ctx, h.client, prefix2); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, prefix2, "", drivertest.HighScoreKey, nil)
+}
+
+func (h *harness) MakeAlternateRevisionFieldCollection(ctx context.Context) (driver.Collection, error) {
+	if err := clear(ctx, h.client, prefix1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, prefix1, drivertest.KeyField, nil, &Options{RevisionField: drivertest.AlternateRevisionField})
+}
+
+func (*harness) BeforeDoTypes() []interface{} {
+	return []interface{}{&[]clientv3.OpOption{}}
+}
+
+func (*harness) BeforeQueryTypes() []interface{} {
+	return []interface{}{&[]clientv3.OpOption{}}
+}
+
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
+func (h *harness) Close() { h.client.Close() }
+
+// asMatrix lists the types that the As methods support. The error of a Create
+// of an existing document comes from the driver, not from etcd, so it is not an
+// rpctypes.EtcdError.
+var asMatrix = drivertest.AsMatrix{
+	Collection: []interface{}{new(*clientv3.Client)},
+	Iterator:   []interface{}{new(*clientv3.GetResponse)},
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, nil, []drivertest.AsTest{asMatrix})
+}
+
+func BenchmarkConformance(b *testing.B) {
+	ctx := context.Background()
+	client := newClient(b)
+	defer client.Close()
+	if err := clear(ctx, client, prefix3); err != nil {
+		b.Fatal(err)
+	}
+	coll, err := newCollection(client, prefix3, drivertest.KeyField, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	drivertest.RunBenchmarks(b, docstore.NewCollection(coll))
+}
+
+// etcd-specific tests.
+
+func TestPlanRange(t *testing.T) {
+	c := &collection{prefix: "p/", keyField: "name"}
+	key := func(op string, v interface{}) driver.Filter {
+		return driver.Filter{FieldPath: []string{"name"}, Op: op, Value: v}
+	}
+	for _, test := range []struct {
+		fs         []driver.Filter
+		start, end string // etcd keys
+		pushed     int
+		empty      bool
+	}{
+		{nil, "p/", "p0", 0, false},
+		{[]driver.Filter{key("=", "b")}, "p/b", "p/b\x00", 1, false},
+		{[]driver.Filter{key(">", "b")}, "p/b\x00", "p0", 1, false},
+		{[]driver.Filter{key(">=", "b"), key("<", "d")}, "p/b", "p/d", 2, false},
+		{[]driver.Filter{key(">", "b"), key("<=", "d")}, "p/b\x00", "p/d\x00", 2, false},
+		{[]driver.Filter{key(driver.HasPrefixOp, "ab")}, "p/ab", "p/ac", 1, false},
+		{[]driver.Filter{key(driver.HasPrefixOp, "\xff")}, "p/\xff", "p0", 1, false},
+		{[]driver.Filter{key(driver.HasPrefixOp, "a"), key(">=", "b")}, "p/b", "p/b", 2, true},
+		{[]driver.Filter{key("<", "")}, "p/\x00", "p/\x00", 1, true},
+		// Not on the key, or not a string.
+		{[]driver.Filter{{FieldPath: []string{"other"}, Op: "=", Value: "b"}}, "p/", "p0", 0, false},
+		{[]driver.Filter{key("=", 1)}, "p/", "p0", 0, false},
+		{[]driver.Filter{key(driver.EqualFoldOp, "b")}, "p/", "p0", 0, false},
+		{[]driver.Filter{key(driver.ExistsOp, nil)}, "p/", "p0", 0, false},
+	} {
+		p := c.planRange(test.fs)
+		start, end := c.keys(p)
+		if start != test.start || end != test.end || len(p.pushed) != test.pushed || len(p.pushed)+len(p.local) != len(test.fs) || p.empty() != test.empty {
+			t.Errorf("%+v: got [%q, %q) with %d pushed, %d local, empty %t; want [%q, %q) with %d pushed, empty %t",
+				test.fs, start, end, len(p.pushed), len(p.local), p.empty(), test.start, test.end, test.pushed, test.empty)
+		}
+	}
+}
+
+func TestNewCollectionErrors(t *testing.T) {
+	client := &clientv3.Client{}
+	for _, test := range []struct {
+		name     string
+		client   *clientv3.Client
+		prefix   string
+		keyField string
+	}{
+		{"nil client", nil, "p/", "name"},
+		{"no prefix", client, "", "name"},
+		{"no key", client, "p/", ""},
+	} {
+		_, err := newCollection(test.client, test.prefix, test.keyField, nil, nil)
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", test.name, err)
+		}
+	}
+}
+
+// TestStorage checks that a document is stored under the prefix and its key,
+// without its revision, and that its revision is the mod revision of the key.
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t)
+	defer client.Close()
+	if err := clear(ctx, client, prefix1); err != nil {
+		t.Fatal(err)
+	}
+	coll, err := OpenCollection(client, prefix1, "name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	doc := map[string]interface{}{"name": "k", "a": 1, "b": "two"}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(ctx, prefix1+"k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("got %d keys, want 1", len(resp.Kvs))
+	}
+	kv := resp.Kvs[0]
+	got, err := gobcodec.Unmarshal(kv.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"name": "k", "a": int64(1), "b": "two"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("value: got=-, want=+: %s", diff)
+	}
+	if rev := doc[docstore.DefaultRevisionField]; rev != kv.ModRevision {
+		t.Errorf("got revision %v, want the mod revision %d", rev, kv.ModRevision)
+	}
+}
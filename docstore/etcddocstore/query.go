@@ -0,0 +1,443 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcddocstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"go.etcd.io/etcd/clientv3"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+)
+
+// eval evaluates filters and sort orders on the documents read from etcd, and
+// applies modifications to them.
+var eval = mapdoc.Evaluator{EncodeValue: gobcodec.EncodeValue}
+
+// batchSize is the number of keys read by each Get call of a query.
+const batchSize = 1000
+
+// SupportsFilter implements driver.SupportsFilter. Filters that do not narrow
+// the range of keys are evaluated on the client.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// A rangePlan says which document keys to read for a query.
+type rangePlan struct {
+	start  string          // the first document key that may match
+	end    string          // the document key after the last that may match, or "" for none
+	pushed []driver.Filter // the filters that the range answers
+	local  []driver.Filter // the filters evaluated on the client
+}
+
+// scan returns the kind of scan the plan needs.
+func (p rangePlan) scan() driver.ScanKind {
+	if len(p.pushed) == 0 {
+		return driver.ScanFull
+	}
+	return driver.ScanRange
+}
+
+// planRange returns the range of document keys that may hold the documents
+// matching fs.
+func (c *collection) planRange(fs []driver.Filter) rangePlan {
+	var p rangePlan
+	raise := func(s string) {
+		if s > p.start {
+			p.start = s
+		}
+	}
+	lower := func(s string) {
+		if p.end == "" || (s != "" && s < p.end) {
+			p.end = s
+		}
+	}
+	for _, f := range fs {
+		s, ok := c.keyValue(f)
+		if !ok {
+			p.local = append(p.local, f)
+			continue
+		}
+		switch f.Op {
+		case driver.EqualOp:
+			raise(s)
+			lower(s + "\x00")
+		case ">":
+			raise(s + "\x00")
+		case ">=":
+			raise(s)
+		case "<":
+			if s == "" {
+				// No key is less than the empty string. Document keys cannot be
+				// empty, so this range is empty.
+				raise("\x00")
+				lower("\x00")
+			} else {
+				lower(s)
+			}
+		case "<=":
+			lower(s + "\x00")
+		case driver.HasPrefixOp:
+			raise(s)
+			lower(prefixSuccessor(s))
+		default:
+			p.local = append(p.local, f)
+			continue
+		}
+		p.pushed = append(p.pushed, f)
+	}
+	return p
+}
+
+// empty reports whether no document key is in the range.
+func (p rangePlan) empty() bool { return p.end != "" && p.start >= p.end }
+
+// keys returns the range of etcd keys to read, as the arguments of a Get with
+// clientv3.WithRange.
+func (c *collection) keys(p rangePlan) (start, end string) {
+	start = c.prefix + p.start
+	if p.end == "" {
+		return start, clientv3.GetPrefixRangeEnd(c.prefix)
+	}
+	return start, c.prefix + p.end
+}
+
+// keyValue returns the value of f as a string if f is a filter on the key
+// field with a string value.
+func (c *collection) keyValue(f driver.Filter) (string, bool) {
+	if c.keyField == "" || len(f.FieldPath) != 1 || f.FieldPath[0] != c.keyField {
+		return "", false
+	}
+	v := reflect.ValueOf(f.Value)
+	if v.Kind() != reflect.String {
+		return "", false
+	}
+	return v.String(), true
+}
+
+// prefixSuccessor returns the smallest string greater than every string that
+// begins with prefix, or "" if there is none.
+func prefixSuccessor(prefix string) string {
+	n := len(prefix) - 1
+	for n >= 0 && prefix[n] == '\xff' {
+		n--
+	}
+	if n < 0 {
+		return ""
+	}
+	return prefix[:n] + string([]byte{prefix[n] + 1})
+}
+
+// beforeQuery calls q.BeforeQuery, if any, with an as function that exposes the
+// options of the query's reads, and returns them.
+func (c *collection) beforeQuery(q *driver.Query) ([]clientv3.OpOption, error) {
+	if q.BeforeQuery == nil {
+		return nil, nil
+	}
+	var ops []clientv3.OpOption
+	if err := q.BeforeQuery(driver.AsFunc(&ops)); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// A keyReader reads the keys of a range in batches, all at the revision of the
+// first batch.
+type keyReader struct {
+	coll       *collection
+	start, end string // the remaining range of etcd keys
+	ops        []clientv3.OpOption
+	rev        int64 // the revision of the reads, once known
+	done       bool
+	resp       *clientv3.GetResponse // the latest response
+}
+
+// newKeyReader returns a keyReader for the range of p. It reads nothing if the
+// range is empty.
+func (c *collection) newKeyReader(p rangePlan, ops []clientv3.OpOption) *keyReader {
+	r := &keyReader{coll: c, ops: ops, done: p.empty()}
+	r.start, r.end = c.keys(p)
+	return r
+}
+
+// next returns the documents of the next batch of keys, or io.EOF if there are
+// no more.
+func (r *keyReader) next(ctx context.Context) ([]match, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	ops := append([]clientv3.OpOption{clientv3.WithRange(r.end), clientv3.WithLimit(batchSize)}, r.ops...)
+	if r.rev > 0 {
+		ops = append(ops, clientv3.WithRev(r.rev))
+	}
+	resp, err := r.coll.client.Get(ctx, r.start, ops...)
+	if err != nil {
+		return nil, err
+	}
+	r.resp = resp
+	if r.rev == 0 {
+		r.rev = resp.Header.Revision
+	}
+	if !resp.More {
+		r.done = true
+	} else {
+		// Continue after the last key read.
+		r.start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, io.EOF
+	}
+	ms := make([]match, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		ekey := string(kv.Key)
+		sd, err := r.coll.decodeValue(ekey, kv.Value, kv.ModRevision)
+		if err != nil {
+			return nil, err
+		}
+		ms[i] = match{ekey, sd}
+	}
+	return ms, nil
+}
+
+// A match is a stored document that satisfies a query's filters.
+type match struct {
+	ekey string
+	sd   *storedDoc
+}
+
+// matching returns the documents of ms that satisfy fs.
+func matching(ms []match, fs []driver.Filter) []match {
+	var res []match
+	for _, m := range ms {
+		if eval.FiltersMatch(fs, m.sd.doc) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	p := c.planRange(q.Filters)
+	ops, err := c.beforeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	it := &docIterator{
+		coll:       c,
+		reader:     c.newKeyReader(p, ops),
+		filters:    p.local,
+		limit:      q.Limit,
+		fieldPaths: fps,
+	}
+	// Read the first batch now, to fix the revision of the query.
+	if err := it.nextBatch(ctx); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if q.OrderByField != "" && !(q.OrderByField == c.keyField && q.OrderAscending) {
+		// Keys are read in order, so read all the results and sort them here.
+		for {
+			err := it.nextBatch(ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		eval.SortDocs(it.docs, strings.Split(q.OrderByField, "."), q.OrderAscending)
+	}
+	return it, nil
+}
+
+// docIterator returns the documents that match a query, reading them a batch
+// of keys at a time.
+type docIterator struct {
+	coll       *collection
+	reader     *keyReader
+	docs       []map[string]interface{}
+	filters    []driver.Filter
+	limit      int
+	count      int
+	fieldPaths [][]string
+	err        error
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.limit > 0 && it.count >= it.limit {
+		it.Stop()
+		return it.err
+	}
+	for len(it.docs) == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := it.nextBatch(ctx); err != nil {
+			it.err = err
+			return err
+		}
+	}
+	if err := gobcodec.DecodeDoc(it.docs[0], doc, it.fieldPaths, it.coll.opts.RevisionField); err != nil {
+		it.err = err
+		return it.err
+	}
+	it.docs = it.docs[1:]
+	it.count++
+	return nil
+}
+
+// nextBatch appends the matching documents of the next batch of keys to
+// it.docs. It returns io.EOF if there are no more keys.
+func (it *docIterator) nextBatch(ctx context.Context) error {
+	ms, err := it.reader.next(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range matching(ms, it.filters) {
+		it.docs = append(it.docs, m.sd.doc)
+	}
+	return nil
+}
+
+func (it *docIterator) Stop() {
+	it.docs = nil
+	it.err = io.EOF
+}
+
+// As implements driver.DocumentIterator.As. It exposes the response of the
+// latest read as *clientv3.GetResponse.
+func (it *docIterator) As(i interface{}) bool {
+	p, ok := i.(**clientv3.GetResponse)
+	if !ok || it.reader.resp == nil {
+		return false
+	}
+	*p = it.reader.resp
+	return true
+}
+
+// QueryPlan implements driver.QueryPlan. The description is the range of etcd
+// keys read.
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	p := c.planRange(q.Filters)
+	start, end := c.keys(p)
+	return &driver.QueryPlan{
+		Description:   fmt.Sprintf("Range [%q, %q)", start, end),
+		Scan:          p.scan(),
+		ServerFilters: p.pushed,
+		ClientFilters: p.local,
+	}, nil
+}
+
+// matchingDocs returns the documents that match q. It reads them all before
+// returning, so that changing them cannot affect the read.
+func (c *collection) matchingDocs(ctx context.Context, q *driver.Query) ([]match, error) {
+	p := c.planRange(q.Filters)
+	ops, err := c.beforeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	r := c.newKeyReader(p, ops)
+	var ms []match
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch, err := r.next(ctx)
+		if err == io.EOF {
+			return ms, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, matching(batch, p.local)...)
+	}
+}
+
+// RunDeleteQuery implements driver.RunDeleteQuery. Each matching document is
+// deleted on its own, provided it still matches.
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	return c.rewriteMatches(ctx, q, nil)
+}
+
+// RunUpdateQuery implements driver.RunUpdateQuery. Each matching document is
+// updated on its own, provided it still matches.
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	return c.rewriteMatches(ctx, q, mods)
+}
+
+// rewriteMatches applies mods to each document that matches q, or deletes it if
+// mods is nil. A document that changes before it is written is read again, and
+// rewritten if it still matches.
+func (c *collection) rewriteMatches(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	ms, err := c.matchingDocs(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		for i := 1; ; i++ {
+			done, err := c.rewrite(ctx, m, q.Filters, mods)
+			if err != nil {
+				return err
+			}
+			if done || i == mapdoc.MaxWriteAttempts {
+				break
+			}
+			if m.sd, err = c.get(ctx, m.ekey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewrite applies mods to the matching document m, or deletes it if mods is
+// nil, if m still satisfies fs. It reports false if the document changed after
+// it was read.
+func (c *collection) rewrite(ctx context.Context, m match, fs []driver.Filter, mods []driver.Mod) (bool, error) {
+	if m.sd == nil || !eval.FiltersMatch(fs, m.sd.doc) {
+		return true, nil
+	}
+	var op clientv3.Op
+	if mods == nil {
+		op = clientv3.OpDelete(m.ekey)
+	} else {
+		if err := eval.ApplyMods(m.sd.doc, mods); err != nil {
+			return false, err
+		}
+		val, err := c.value(m.sd.doc)
+		if err != nil {
+			return false, err
+		}
+		op = clientv3.OpPut(m.ekey, val)
+	}
+	resp, err := c.client.Txn(ctx).If(unchanged(m.ekey, m.sd)).Then(op).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcddocstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+
+	"go.etcd.io/etcd/clientv3"
+	"gocloud.dev/docstore"
+)
+
+func init() {
+	docstore.DefaultURLMux().RegisterCollection(Scheme, new(defaultDialer))
+}
+
+// Scheme is the URL scheme etcddocstore registers its URLOpener under on
+// docstore.DefaultMux.
+const Scheme = "etcd"
+
+type defaultDialer struct {
+	init   sync.Once
+	opener *URLOpener
+	err    error
+}
+
+func (o *defaultDialer) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	o.init.Do(func() {
+		serverURL := os.Getenv("ETCD_SERVER_URL")
+		if serverURL == "" {
+			o.err = errors.New("ETCD_SERVER_URL environment variable is not set")
+			return
+		}
+		client, err := clientv3.NewFromURL(serverURL)
+		if err != nil {
+			o.err = fmt.Errorf("failed to connect to default client %q: %v", serverURL, err)
+			return
+		}
+		o.opener = &URLOpener{Client: client}
+	})
+	if o.err != nil {
+		return nil, fmt.Errorf("open collection %v: %v", u, o.err)
+	}
+	return o.opener.OpenCollectionURL(ctx, u)
+}
+
+// URLOpener opens etcd URLs like "etcd://config/players/?key_field=name".
+//
+// The URL's host followed by its path is the key prefix of the collection.
+//
+// The following query parameters are supported:
+//
+//   - key_field (required): the document field holding the primary key.
+type URLOpener struct {
+	// The Client to use; required.
+	Client *clientv3.Client
+
+	// Options specifies the options to pass to OpenCollection.
+	Options Options
+}
+
+// OpenCollectionURL opens a docstore.Collection based on u.
+func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	q := u.Query()
+	keyField := q.Get("key_field")
+	if keyField == "" {
+		return nil, fmt.Errorf("open collection %v: key_field is required", u)
+	}
+	q.Del("key_field")
+	for param := range q {
+		return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+	}
+	prefix := u.Host + u.Path
+	if prefix == "" {
+		return nil, fmt.Errorf("open collection %v: URL must have a key prefix", u)
+	}
+	opts := o.Options
+	return OpenCollection(o.Client, prefix, keyField, &opts)
+}
@@ -0,0 +1,510 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filedocstore provides an implementation of the docstore API that
+// stores each document of a collection as a JSON file in a directory. It plays
+// the role for docstore that fileblob plays for blob: it is suitable for tests,
+// examples and development without a network, and the files are easy to read
+// and edit by hand.
+//
+// The key of each document must be a non-empty string. The document is stored
+// in the file named by the key, escaped, followed by ".json". The file holds
+// the document as a JSON object, including its revision field.
+//
+// Documents are read from and written to the files on every action, and each
+// write replaces a file by renaming a new one over it, so the files are never
+// partly written. Collections in the same process that use the same directory
+// serialize their writes, but filedocstore does not coordinate with other
+// processes that write to the directory.
+//
+//
+// Action Lists
+//
+// Action lists are executed concurrently, like those of memdocstore. Each action
+// in an action list is executed in a separate goroutine.
+//
+// filedocstore calls the BeforeDo function of an ActionList once before
+// executing the actions. Its as function never returns true.
+//
+//
+// Queries
+//
+// Queries read every file in the directory, unless they have an equality filter
+// on the key field, in which case they read only the file of that key. Filters
+// are evaluated on each document read. A query with an OrderBy clause reads all
+// the matching documents before sorting them. RunDeleteQuery and RunUpdateQuery
+// hold the collection's write lock, so they are atomic with respect to other
+// actions in the process.
+//
+//
+// Revisions
+//
+// Revisions are strings holding the time of the write in RFC 3339 format with
+// nanosecond precision. The times of the writes to a directory in a process are
+// strictly increasing.
+//
+//
+// Escaping
+//
+// Go CDK supports all UTF-8 strings; to make this work with filesystems, keys
+// are escaped in file names. ASCII characters 0-31, "/", "\", the characters
+// "<>:"|?*" and a leading "." are escaped to "__0x<hex>__". On filesystems
+// that ignore case, such as the defaults on Windows and macOS, keys that
+// differ only in case name the same file. Keys whose file names would be
+// longer than 255 bytes are rejected.
+//
+//
+// Special Considerations
+//
+// JSON has no binary or time types. []byte values are stored as objects like
+// {"$binary": "AAEC"}, whose only field holds the bytes in base64, and which
+// are decoded as []byte. time.Time values are stored as RFC 3339 strings in UTC
+// with nanosecond precision. They are decoded to time.Time when the destination
+// has that type, but as strings when decoding into an interface{}. Query
+// filters on time.Time values compare the strings, which sort in time order.
+//
+//
+// As
+//
+// filedocstore exposes the following types for As:
+// - ErrorAs: *os.PathError
+//
+//
+// URLs
+//
+// For docstore.OpenCollection, filedocstore registers for the scheme "file".
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://gocloud.dev/concepts/urls/ for background information.
+package filedocstore // import "gocloud.dev/docstore/filedocstore"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/escape"
+	"gocloud.dev/internal/gcerr"
+)
+
+// fileSuffix ends the name of each document's file.
+const fileSuffix = ".json"
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// The maximum number of concurrent goroutines started for a single call to
+	// ActionList.Do. If less than 1, there is no limit.
+	MaxOutstandingActionRPCs int
+}
+
+// OpenCollection opens a *docstore.Collection whose documents are stored in
+// files in dir, which must exist. keyField is the document field holding the
+// primary key of the collection, which must be a string.
+func OpenCollection(dir, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(dir, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens a *docstore.Collection whose documents are
+// stored in files in dir, which must exist. keyFunc takes a document and
+// returns the document's primary key, which must be a string. It should return
+// nil if the document is missing the information to construct a key. This will
+// cause all actions, even Create, to fail.
+func OpenCollectionWithKeyFunc(dir string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(dir, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(dir, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if dir == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "filedocstore: directory is empty")
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "must provide either keyField or keyFunc")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "filedocstore: %s is not a directory", dir)
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	return &collection{
+		dir:      dir,
+		lock:     lockFor(dir),
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+	}, nil
+}
+
+// A dirLock serializes the writes to a directory.
+type dirLock struct {
+	sync.RWMutex
+	lastWrite time.Time // the time of the most recent write
+}
+
+var dirLocks = struct {
+	sync.Mutex
+	m map[string]*dirLock
+}{m: map[string]*dirLock{}}
+
+// lockFor returns the lock of dir, an absolute path.
+func lockFor(dir string) *dirLock {
+	dirLocks.Lock()
+	defer dirLocks.Unlock()
+	l := dirLocks.m[dir]
+	if l == nil {
+		l = &dirLock{}
+		dirLocks.m[dir] = l
+	}
+	return l
+}
+
+type collection struct {
+	dir      string
+	lock     *dirLock
+	keyField string
+	keyFunc  func(docstore.Document) interface{}
+	opts     *Options
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// path returns the path of the file of the document with the given key.
+func (c *collection) path(key interface{}) (string, error) {
+	s, ok := key.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "filedocstore: key %v is a %T, not a string", key, key)
+	}
+	if s == "" {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "filedocstore: key is empty")
+	}
+	name := escapeKey(s) + fileSuffix
+	if len(name) > maxFileNameLen {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "filedocstore: key %.20q... is too long for a file name", s)
+	}
+	return filepath.Join(c.dir, name), nil
+}
+
+// maxFileNameLen is the length in bytes of the longest file name that most
+// filesystems allow.
+const maxFileNameLen = 255
+
+// escapeKey escapes key for use in a file name.
+func escapeKey(key string) string {
+	return escape.HexEscape(key, func(r []rune, i int) bool {
+		c := r[i]
+		switch {
+		case c < 32:
+			return true
+		// The file must be in the directory, and not hidden.
+		case c == '/' || c == '\\' || (i == 0 && c == '.'):
+			return true
+		// https://docs.microsoft.com/en-us/windows/desktop/fileio/naming-a-file
+		case c == '>' || c == '<' || c == ':' || c == '"' || c == '|' || c == '?' || c == '*':
+			return true
+		}
+		return false
+	})
+}
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return 0 }
+
+func (c *collection) RevisionField() string {
+	return c.opts.RevisionField
+}
+
+// ErrorCode implements driver.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	switch {
+	case os.IsNotExist(err):
+		return gcerr.NotFound
+	case os.IsPermission(err):
+		return gcerr.PermissionDenied
+	}
+	return gcerrors.Code(err)
+}
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+
+	// Run the actions concurrently with each other. With FailFast, stop starting
+	// actions once one fails.
+	run := func(as []*driver.Action) {
+		mapdoc.RunConcurrently(as, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+			return c.runAction(ctx, a)
+		})
+	}
+
+	if opts.BeforeDo != nil {
+		if err := opts.BeforeDo(func(interface{}) bool { return false }); err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return driver.NewActionListError(errs)
+		}
+	}
+
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	run(beforeGets)
+	run(gets)
+	run(writes)
+	run(afterGets)
+	return driver.NewActionListError(errs)
+}
+
+// runAction executes a single action.
+func (c *collection) runAction(ctx context.Context, a *driver.Action) error {
+	// Stop if the context is done.
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if a.Kind == driver.Get {
+		path, err := c.path(a.Key)
+		if err != nil {
+			return err
+		}
+		c.lock.RLock()
+		current, err := readDoc(path)
+		c.lock.RUnlock()
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return gcerr.Newf(gcerr.NotFound, nil, "document with key %v does not exist", a.Key)
+		}
+		return codec.DecodeDoc(current, a.Doc, a.FieldPaths, c.opts.RevisionField)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.runWrite(a)
+}
+
+// readDoc returns the document in the file at path, or nil if there is none.
+func readDoc(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, err := jsoncodec.Unmarshal(b)
+	if err != nil {
+		return nil, gcerr.Newf(gcerr.Internal, err, "filedocstore: decoding %s", path)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, gcerr.Newf(gcerr.Internal, nil, "filedocstore: %s holds a JSON %T, not an object", path, v)
+	}
+	return m, nil
+}
+
+// writeDoc replaces the file at path with one holding doc.
+func writeDoc(path string, doc map[string]interface{}) error {
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		// Only non-finite floats fail to marshal.
+		return fmt.Errorf("filedocstore: %v", err)
+	}
+	// Write a hidden temporary file and rename it, so that the file at path is
+	// never partly written.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".filedocstore")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// deleteDoc removes the file at path, if there is one.
+func deleteDoc(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// runWrite executes the write action a. It must be called with the write lock
+// held.
+func (c *collection) runWrite(a *driver.Action) error {
+	// If the user didn't supply a value for the key field of a Create, create a
+	// new one.
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		// Set the new key in the document.
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	path, err := c.path(a.Key)
+	if err != nil {
+		return err
+	}
+	current, err := readDoc(path)
+	if err != nil {
+		return err
+	}
+	exists := current != nil
+	// Check for a NotFound error.
+	if !exists && (a.Kind == driver.Replace || a.Kind == driver.Update) {
+		return gcerr.Newf(gcerr.NotFound, nil, "document with key %v does not exist", a.Key)
+	}
+	if len(a.Conditions) > 0 && (exists || a.Kind != driver.Delete) {
+		if current == nil {
+			return gcerr.Newf(gcerr.FailedPrecondition, nil, "document does not exist")
+		}
+		if !eval.FiltersMatch(a.Conditions, current) {
+			return gcerr.Newf(gcerr.FailedPrecondition, nil, "conditions not satisfied for document with key %v", a.Key)
+		}
+	}
+	if err := c.checkRevision(a.Doc, current); err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	switch a.Kind {
+	case driver.Create:
+		// It is an error to attempt to create an existing document.
+		if exists {
+			return gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %v exists", a.Key)
+		}
+		fallthrough
+
+	case driver.Replace, driver.Put:
+		if doc, err = codec.EncodeDoc(a.Doc); err != nil {
+			return err
+		}
+
+	case driver.Delete:
+		return deleteDoc(path)
+
+	case driver.Update:
+		if err := eval.ApplyMods(current, a.Mods); err != nil {
+			return err
+		}
+		doc = current
+
+	default:
+		return gcerr.Newf(gcerr.Internal, nil, "unknown kind %v", a.Kind)
+	}
+	doc[c.opts.RevisionField] = c.nextRevision()
+	if err := writeDoc(path, doc); err != nil {
+		return err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, doc[c.opts.RevisionField])
+	return nil
+}
+
+// nextRevision returns the revision of a write to the collection. It must be
+// called with the write lock held.
+func (c *collection) nextRevision() string {
+	t := time.Now().UTC()
+	if !t.After(c.lock.lastWrite) {
+		t = c.lock.lastWrite.Add(time.Nanosecond)
+	}
+	c.lock.lastWrite = t
+	return t.Format(jsoncodec.TimeLayout)
+}
+
+func (c *collection) checkRevision(arg driver.Document, current map[string]interface{}) error {
+	if current == nil {
+		return nil // no existing document
+	}
+	curRev := current[c.opts.RevisionField]
+	wantRev, err := arg.GetField(c.opts.RevisionField)
+	if err != nil || wantRev == nil {
+		return nil // no incoming revision information: nothing to check
+	}
+	if _, ok := wantRev.(string); !ok {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want string", c.opts.RevisionField, wantRev)
+	}
+	if wantRev != curRev {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %v, current %v", wantRev, curRev)
+	}
+	return nil
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool { return false }
+
+// ErrorAs implements driver.Collection.ErrorAs.
+func (c *collection) ErrorAs(err error, i interface{}) bool {
+	e, ok := err.(*os.PathError)
+	if !ok {
+		return false
+	}
+	p, ok := i.(**os.PathError)
+	if !ok {
+		return false
+	}
+	*p = e
+	return true
+}
+
+// Close implements driver.Collection.Close.
+func (c *collection) Close() error { return nil }
@@ -0,0 +1,246 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filedocstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/gcerrors"
+)
+
+// tempDir creates a temporary directory, and returns it with a function that
+// removes it.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "filedocstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+type harness struct {
+	dir   string
+	done  func()
+	nColl int
+}
+
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	dir, done := tempDir(t)
+	return &harness{dir: dir, done: done}, nil
+}
+
+// collDir returns a new, empty directory, so that each test starts with an
+// empty collection.
+func (h *harness) collDir() (string, error) {
+	h.nColl++
+	dir := filepath.Join(h.dir, fmt.Sprintf("coll%d", h.nColl))
+	return dir, os.Mkdir(dir, 0777)
+}
+
+func (h *harness) collection(keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (driver.Collection, error) {
+	dir, err := h.collDir()
+	if err != nil {
+		return nil, err
+	}
+	return newCollection(dir, keyField, keyFunc, opts)
+}
+
+func (h *harness) MakeCollection(context.Context) (driver.Collection, error) {
+	return h.collection(drivertest.KeyField, nil, nil)
+}
+
+func (h *harness) MakeTwoKeyCollection(context.Context) (driver.Collection, error) {
+	return h.collection("", drivertest.HighScoreKey, nil)
+}
+
+func (h *harness) MakeAlternateRevisionFieldCollection(context.Context) (driver.Collection, error) {
+	return h.collection(drivertest.KeyField, nil, &Options{RevisionField: drivertest.AlternateRevisionField})
+}
+
+func (*harness) BeforeDoTypes() []interface{}          { return nil }
+func (*harness) BeforeQueryTypes() []interface{}       { return nil }
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
+func (h *harness) Close() { h.done() }
+
+// asMatrix lists the types that the As methods support: none.
+var asMatrix = drivertest.AsMatrix{Unsupported: []interface{}{new(string)}}
+
+func TestConformance(t *testing.T) {
+	// CodecTester is nil because filedocstore encodes []byte values as tagged
+	// objects, which the JSON codec cannot match.
+	drivertest.RunConformanceTests(t, newHarness, nil, []drivertest.AsTest{asMatrix})
+}
+
+type docmap = map[string]interface{}
+
+func TestFiles(t *testing.T) {
+	// Check that each document is a readable file, and that documents survive
+	// reopening the collection.
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	coll, err := OpenCollection(dir, "name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	now := time.Now().UTC()
+	doc := docmap{"name": "a/b", "b": []byte{1, 2}, "t": now, "m": docmap{"x": int64(1)}}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "a__0x2f__b.json")
+	if len(names) != 1 || names[0] != want {
+		t.Fatalf("got files %q, want %q", names, want)
+	}
+	b, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"name": "a/b"`, `"$binary": "AQI="`, `"x": 1`, `"DocstoreRevision": "`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("file does not contain %s:\n%s", s, b)
+		}
+	}
+
+	coll2, err := OpenCollection(dir, "name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll2.Close()
+	got := docmap{"name": "a/b"}
+	if err := coll2.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	// A time read into an interface{} is a string.
+	doc["t"] = now.Format(jsoncodec.TimeLayout)
+	if !cmp.Equal(got, doc) {
+		t.Errorf("got %v, want %v", got, doc)
+	}
+	// Revisions increase across collections.
+	rev := doc[docstore.DefaultRevisionField].(string)
+	if err := coll2.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	if r := doc[docstore.DefaultRevisionField].(string); r <= rev {
+		t.Errorf("got revision %q after %q, want a later one", r, rev)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	coll, err := OpenCollection(dir, "name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	for _, key := range []interface{}{1, ""} {
+		err = coll.Put(ctx, docmap{"name": key})
+		if errc := gcerrors.Code(err); errc != gcerrors.InvalidArgument {
+			t.Errorf("key %#v: got %v, want InvalidArgument", key, errc)
+		}
+	}
+	// Keys that name other files are escaped.
+	for _, key := range []string{"..", ".hidden", `a\b`, "c:d", "x?*"} {
+		if err := coll.Put(ctx, docmap{"name": key}); err != nil {
+			t.Fatal(err)
+		}
+		got := docmap{"name": key}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Errorf("key %q: %v", key, err)
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 5 {
+		t.Errorf("got files %q, want 5", names)
+	}
+}
+
+func TestNewCollectionErrors(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		dir      string
+		keyField string
+	}{
+		{"no dir", "", "name"},
+		{"no key", dir, ""},
+		{"not a dir", file, "name"},
+	} {
+		_, err := OpenCollection(test.dir, test.keyField, nil)
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", test.name, err)
+		}
+	}
+	if _, err := OpenCollection(filepath.Join(dir, "x"), "name", nil); !os.IsNotExist(err) {
+		t.Errorf("missing directory: got %v, want a not-exist error", err)
+	}
+}
+
+func TestQueryPlan(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+	coll, err := OpenCollection(dir, "name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	for _, test := range []struct {
+		q    *docstore.Query
+		want string
+		scan docstore.ScanKind
+	}{
+		{coll.Query(), "read every document in " + dir, docstore.ScanFull},
+		{coll.Query().Where("a", "=", "x"), "read every document in " + dir, docstore.ScanFull},
+		{coll.Query().Where("name", "=", "x"), "read " + filepath.Join(dir, "x.json"), docstore.ScanLookup},
+	} {
+		plan, err := test.q.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.Description != test.want || plan.Scan != test.scan {
+			t.Errorf("got %q (%v scan), want %q (%v scan)", plan.Description, plan.Scan, test.want, test.scan)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filedocstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/mapdoc"
+)
+
+// eval evaluates filters and sort orders on the documents read from files, and
+// applies modifications to them.
+var eval = mapdoc.Evaluator{ToGo: codec.ToGo, EncodeValue: codec.EncodeValue}
+
+// SupportsFilter implements driver.SupportsFilter. All filters are evaluated
+// on the documents as they are read.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// keyFilter returns the key of an equality filter on the key field among fs,
+// if there is one.
+func (c *collection) keyFilter(fs []driver.Filter) (string, bool) {
+	if c.keyField == "" {
+		return "", false
+	}
+	for _, f := range fs {
+		if f.Op == driver.EqualOp && len(f.FieldPath) == 1 && f.FieldPath[0] == c.keyField {
+			if s, ok := f.Value.(string); ok && s != "" {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+// paths returns the paths of the files that may hold documents matching fs, in
+// sorted order.
+func (c *collection) paths(fs []driver.Filter) ([]string, error) {
+	if key, ok := c.keyFilter(fs); ok {
+		path, err := c.path(key)
+		if err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		name := info.Name()
+		// Skip temporary files, and anything else that isn't a document.
+		if info.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		paths = append(paths, filepath.Join(c.dir, name))
+	}
+	return paths, nil
+}
+
+// readMatch returns the document in the file at path if it satisfies fs, or
+// nil if it does not or there is no such file. It must be called with the read
+// or write lock held.
+func readMatch(path string, fs []driver.Filter) (map[string]interface{}, error) {
+	doc, err := readDoc(path)
+	if err != nil || doc == nil || !eval.FiltersMatch(fs, doc) {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	paths, err := c.paths(q.Filters)
+	if err != nil {
+		return nil, err
+	}
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
+	it := &docIterator{
+		coll:       c,
+		paths:      paths,
+		filters:    q.Filters,
+		limit:      q.Limit,
+		fieldPaths: fps,
+	}
+	if q.OrderByField != "" {
+		// Read all the matching documents and sort them.
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		for _, p := range paths {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			doc, err := readMatch(p, q.Filters)
+			if err != nil {
+				return nil, err
+			}
+			if doc != nil {
+				it.docs = append(it.docs, doc)
+			}
+		}
+		it.paths = nil
+		eval.SortDocs(it.docs, strings.Split(q.OrderByField, "."), q.OrderAscending)
+	}
+	return it, nil
+}
+
+// docIterator returns the documents that match a query. Unless the query is
+// ordered, it reads the files one at a time, as the documents are needed, and
+// skips those that have been removed since the query started.
+type docIterator struct {
+	coll       *collection
+	paths      []string                 // the files not yet read
+	docs       []map[string]interface{} // the documents of an ordered query
+	filters    []driver.Filter
+	limit      int
+	count      int
+	fieldPaths [][]string
+	err        error
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.limit > 0 && it.count >= it.limit {
+		it.Stop()
+		return it.err
+	}
+	for len(it.docs) == 0 {
+		if len(it.paths) == 0 {
+			it.err = io.EOF
+			return it.err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		it.coll.lock.RLock()
+		m, err := readMatch(it.paths[0], it.filters)
+		it.coll.lock.RUnlock()
+		if err != nil {
+			it.err = err
+			return err
+		}
+		it.paths = it.paths[1:]
+		if m != nil {
+			it.docs = append(it.docs, m)
+		}
+	}
+	if err := codec.DecodeDoc(it.docs[0], doc, it.fieldPaths, it.coll.opts.RevisionField); err != nil {
+		it.err = err
+		return it.err
+	}
+	it.docs = it.docs[1:]
+	it.count++
+	return nil
+}
+
+func (it *docIterator) Stop() {
+	it.paths = nil
+	it.docs = nil
+	it.err = io.EOF
+}
+
+func (it *docIterator) As(i interface{}) bool { return false }
+
+// QueryPlan implements driver.QueryPlan.
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	if key, ok := c.keyFilter(q.Filters); ok {
+		path, err := c.path(key)
+		if err != nil {
+			return nil, err
+		}
+		return &driver.QueryPlan{
+			Description:   fmt.Sprintf("read %s", path),
+			Scan:          driver.ScanLookup,
+			ClientFilters: q.Filters,
+		}, nil
+	}
+	return &driver.QueryPlan{
+		Description:   fmt.Sprintf("read every document in %s", c.dir),
+		Scan:          driver.ScanFull,
+		ClientFilters: q.Filters,
+	}, nil
+}
+
+// RunDeleteQuery implements driver.RunDeleteQuery. It holds the write lock, so
+// it is atomic with respect to the other actions on the directory.
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	return c.rewriteMatches(ctx, q, nil)
+}
+
+// RunUpdateQuery implements driver.RunUpdateQuery. It holds the write lock, so
+// it is atomic with respect to the other actions on the directory.
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	return c.rewriteMatches(ctx, q, mods)
+}
+
+// rewriteMatches applies mods to each document that matches q, or deletes it if
+// mods is nil.
+func (c *collection) rewriteMatches(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(func(interface{}) bool { return false }); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	paths, err := c.paths(q.Filters)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		doc, err := readMatch(p, q.Filters)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			continue
+		}
+		if mods == nil {
+			if err := deleteDoc(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := eval.ApplyMods(doc, mods); err != nil {
+			return err
+		}
+		doc[c.opts.RevisionField] = c.nextRevision()
+		if err := writeDoc(p, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filedocstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gocloud.dev/docstore"
+)
+
+func init() {
+	docstore.DefaultURLMux().RegisterCollection(Scheme, &URLOpener{})
+}
+
+// Scheme is the URL scheme filedocstore registers its URLOpener under on
+// docstore.DefaultMux.
+const Scheme = "file"
+
+// URLOpener opens URLs like "file:///path/to/dir?key_field=name".
+//
+// The URL's path is the directory of the collection, which must exist, and
+// the URL's host is ignored. As with fileblob, if os.PathSeparator != "/", any
+// leading "/" is dropped from the path and the remaining '/' characters are
+// converted to os.PathSeparator, so "file:///c:/foo/bar" names "c:\foo\bar" on
+// Windows.
+//
+// The following query parameters are supported:
+//   - key_field (required): the document field holding the primary key.
+type URLOpener struct {
+	// Options specifies the options to pass to OpenCollection.
+	Options Options
+}
+
+// OpenCollectionURL opens a docstore.Collection based on u.
+func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	q := u.Query()
+	keyField := q.Get("key_field")
+	if keyField == "" {
+		return nil, fmt.Errorf("open collection %v: key_field is required", u)
+	}
+	q.Del("key_field")
+	for param := range q {
+		return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+	}
+	path := u.Path
+	if os.PathSeparator != '/' {
+		path = strings.TrimPrefix(path, "/")
+	}
+	opts := o.Options
+	return OpenCollection(filepath.FromSlash(path), keyField, &opts)
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filedocstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gocloud.dev/docstore"
+)
+
+func TestOpenCollectionFromURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedocstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	dirpath := filepath.ToSlash(dir)
+	if os.PathSeparator != '/' && !strings.HasPrefix(dirpath, "/") {
+		dirpath = "/" + dirpath
+	}
+
+	tests := []struct {
+		URL     string
+		wantErr bool
+	}{
+		// OK.
+		{"file://" + dirpath + "?key_field=name", false},
+		// OK, host is ignored.
+		{"file://localhost" + dirpath + "?key_field=name", false},
+		{"file://" + dirpath, true},                                 // missing key_field
+		{"file://" + dirpath + "?key_field=name&param=value", true}, // invalid parameter
+		{"file://" + dirpath + "/x?key_field=name", true},           // directory does not exist
+		{"file://" + dirpath + "/file?key_field=name", true},        // not a directory
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		_, err := docstore.OpenCollection(ctx, test.URL)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.wantErr)
+		}
+	}
+}
@@ -39,5 +39,9 @@
 // not exist. You must create the index manually. See
 // https://cloud.google.com/firestore/docs/query-data/indexing for details.
 //
+// To query all the collections with the same ID, wherever they are nested, open
+// the collection with Options.CollectionGroup set. Such a collection supports
+// only Get queries; actions and delete and update queries fail.
+//
 // See https://cloud.google.com/firestore/docs/query-data/queries for more information on Firestore queries.
 package firedocstore // import "gocloud.dev/docstore/firedocstore"
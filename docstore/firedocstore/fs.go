@@ -48,6 +48,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	vkit "cloud.google.com/go/firestore/apiv1"
 	tspb "github.com/golang/protobuf/ptypes/timestamp"
@@ -91,6 +92,17 @@ type Options struct {
 	// ActionList.Do.
 	// If less than 1, there is no limit.
 	MaxOutstandingActionRPCs int
+
+	// If true, the collection represents a collection group: all collections
+	// in the database whose ID is the last component of the collection path,
+	// at any depth. A collection group can only be read with Get queries.
+	// Actions and delete and update queries on it fail with InvalidArgument,
+	// because a document's name does not identify it in the group.
+	//
+	// Documents in different collections of the group can have the same name,
+	// so filters on the name field are evaluated by the client, and queries
+	// cannot be ordered by it.
+	CollectionGroup bool
 }
 
 // CollectionResourceID constructs a resource ID for a collection from the project ID and the collection path.
@@ -200,26 +212,76 @@ func (c *collection) RevisionField() string {
 	return c.opts.RevisionField
 }
 
+// MaxDocumentSize is the largest document Firestore accepts, in bytes.
+// See https://firebase.google.com/docs/firestore/quotas.
+const MaxDocumentSize = 1024*1024 - 4
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return MaxDocumentSize }
+
+// maxCommitWrites is the largest number of writes in a Commit RPC.
+const maxCommitWrites = 500
+
+// MaxActions implements driver.ActionLimiter. The writes without preconditions
+// of an action list are committed together, and an Update may need two writes,
+// so at most half of maxCommitWrites actions can be run at once.
+func (c *collection) MaxActions() int { return maxCommitWrites / 2 }
+
+// errCollectionGroupWrite is returned for actions and write queries on a
+// collection group.
+var errCollectionGroupWrite = gcerr.Newf(gcerr.InvalidArgument, nil, "collection groups support only Get queries")
+
 // RunActions implements driver.RunActions.
 func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
 	errs := make([]error, len(actions))
+	if c.opts.CollectionGroup {
+		for _, a := range actions {
+			errs[a.Index] = errCollectionGroupWrite
+		}
+		return driver.NewActionListError(errs)
+	}
 	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
 	calls := c.buildCommitCalls(writes, errs)
 	// runGets does not issue concurrent RPCs, so it doesn't need a throttle.
 	c.runGets(ctx, beforeGets, errs, opts)
+	if driver.ShouldStop(opts, errs) {
+		driver.SkipActions(gets, errs)
+		driver.SkipActions(writes, errs)
+		driver.SkipActions(afterGets, errs)
+		return driver.NewActionListError(errs)
+	}
+	var (
+		failed  int32 // set when a commit fails, for opts.FailFast
+		skipped []*driver.Action
+	)
 	t := driver.NewThrottle(c.opts.MaxOutstandingActionRPCs)
 	for _, call := range calls {
 		call := call
 		t.Acquire()
+		if opts.FailFast && atomic.LoadInt32(&failed) != 0 {
+			t.Release()
+			skipped = append(skipped, call.actions...)
+			continue
+		}
 		go func() {
 			defer t.Release()
 			c.doCommitCall(ctx, call, errs, opts)
+			for _, a := range call.actions {
+				if errs[a.Index] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
 		}()
 	}
 	t.Acquire()
 	c.runGets(ctx, gets, errs, opts)
 	t.Release()
 	t.Wait()
+	driver.SkipActions(skipped, errs)
+	if driver.ShouldStop(opts, errs) {
+		driver.SkipActions(afterGets, errs)
+		return driver.NewActionListError(errs)
+	}
 	c.runGets(ctx, afterGets, errs, opts)
 	return driver.NewActionListError(errs)
 }
@@ -357,11 +419,15 @@ func (c *collection) actionToWrites(a *driver.Action) ([]*pb.Write, string, erro
 	if a.Key != nil {
 		docName = a.Key.(string)
 	}
+	if len(a.Conditions) > 0 {
+		// Firestore preconditions can only check existence and update time.
+		return nil, "", gcerr.Newf(gcerr.Unimplemented, nil, "Firestore does not support conditions on document fields")
+	}
 	switch a.Kind {
 	case driver.Create:
 		// Make a name for this document if it doesn't have one.
 		if a.Key == nil {
-			docName = driver.UniqueString()
+			docName = driver.GenerateKey(a)
 			newName = docName
 		}
 		w, err = c.putWrite(a.Doc, docName, &pb.Precondition{ConditionType: &pb.Precondition_Exists{Exists: false}})
@@ -45,6 +45,7 @@ type harness struct {
 }
 
 func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	setup.SkipIfNotRecorded(t)
 	conn, done := setup.NewGCPgRPCConn(ctx, t, endPoint, "docstore")
 	client, err := vkit.NewClient(ctx, option.WithGRPCConn(conn))
 	if err != nil {
@@ -78,6 +79,12 @@ func (*harness) BeforeQueryTypes() []interface{} {
 	return []interface{}{&pb.RunQueryRequest{}}
 }
 
+// Capabilities excludes Concurrency, Cancellation and Stress because the tests
+// replay recorded RPCs.
+func (*harness) Capabilities() drivertest.Capabilities {
+	return drivertest.AllCapabilities &^ (drivertest.Concurrency | drivertest.Cancellation | drivertest.Stress)
+}
+
 func (h *harness) Close() {
 	_ = h.client.Close()
 	h.done()
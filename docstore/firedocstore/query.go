@@ -27,6 +27,7 @@ import (
 	"reflect"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"gocloud.dev/docstore/driver"
@@ -34,6 +35,32 @@ import (
 	pb "google.golang.org/genproto/googleapis/firestore/v1"
 )
 
+// SupportsFilter implements driver.SupportsFilter.
+// Firestore has no test for the presence of a field and no case-insensitive
+// comparison, so ExistsOp, NotExistsOp, EqualFoldOp and HasPrefixFoldOp filters
+// are left to the docstore package. Other filters that Firestore can't evaluate
+// are handled by the driver itself; see Options.AllowLocalFilters.
+// In a collection group query, a name doesn't identify a document, so filters
+// on the name field are also left to the docstore package.
+func (c *collection) SupportsFilter(f driver.Filter) bool {
+	if c.opts.CollectionGroup && c.isNameField(f.FieldPath) {
+		return false
+	}
+	return f.Op != driver.ExistsOp && f.Op != driver.NotExistsOp && !driver.IsFoldOp(f.Op)
+}
+
+func (c *collection) isNameField(fp []string) bool {
+	return c.nameField != "" && driver.FieldPathEqualsField(fp, c.nameField)
+}
+
+// queryParent returns the parent resource of the collection's queries.
+func (c *collection) queryParent() string {
+	if c.opts.CollectionGroup {
+		return c.dbPath + "/documents"
+	}
+	return path.Dir(c.collPath)
+}
+
 func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
 	return c.newDocIterator(ctx, q)
 }
@@ -44,7 +71,7 @@ func (c *collection) newDocIterator(ctx context.Context, q *driver.Query) (*docI
 		return nil, err
 	}
 	req := &pb.RunQueryRequest{
-		Parent:    path.Dir(c.collPath),
+		Parent:    c.queryParent(),
 		QueryType: &pb.RunQueryRequest_StructuredQuery{sq},
 	}
 	if q.BeforeQuery != nil {
@@ -230,7 +257,10 @@ func (c *collection) queryToProto(q *driver.Query) (*pb.StructuredQuery, []drive
 	// The collection ID is the last component of the collection path.
 	collID := path.Base(c.collPath)
 	p := &pb.StructuredQuery{
-		From: []*pb.StructuredQuery_CollectionSelector{{CollectionId: collID}},
+		From: []*pb.StructuredQuery_CollectionSelector{{
+			CollectionId:   collID,
+			AllDescendants: c.opts.CollectionGroup,
+		}},
 	}
 	if len(q.FieldPaths) > 0 {
 		p.Select = &pb.StructuredQuery_Projection{}
@@ -243,7 +273,7 @@ func (c *collection) queryToProto(q *driver.Query) (*pb.StructuredQuery, []drive
 	}
 
 	// TODO(jba): make sure we retrieve the fields needed for local filters.
-	sendFilters, localFilters := splitFilters(q.Filters)
+	sendFilters, localFilters := splitFilters(expandPrefixFilters(q.Filters))
 	if len(localFilters) > 0 && !c.opts.AllowLocalFilters {
 		return nil, nil, gcerr.Newf(gcerr.InvalidArgument, nil, "query requires local filters; set Options.AllowLocalFilters to true to enable")
 	}
@@ -273,6 +303,9 @@ func (c *collection) queryToProto(q *driver.Query) (*pb.StructuredQuery, []drive
 		// TODO(jba): reorder filters so order-by one is first of inequalities?
 		// TODO(jba): see if it's OK if filter inequality direction differs from sort direction.
 		fref := []string{q.OrderByField}
+		if c.opts.CollectionGroup && q.OrderByField == c.nameField {
+			return nil, nil, gcerr.Newf(gcerr.Unimplemented, nil, "collection group queries cannot be ordered by the name field %q", c.nameField)
+		}
 		if q.OrderByField == c.nameField {
 			fref[0] = "__name__"
 		}
@@ -289,6 +322,44 @@ func (c *collection) queryToProto(q *driver.Query) (*pb.StructuredQuery, []drive
 	return p, localFilters, nil
 }
 
+// expandPrefixFilters replaces each HasPrefixOp filter in fs with the range of
+// strings that begin with its value, since Firestore has no prefix match.
+func expandPrefixFilters(fs []driver.Filter) []driver.Filter {
+	var res []driver.Filter
+	for _, f := range fs {
+		if f.Op != driver.HasPrefixOp {
+			res = append(res, f)
+			continue
+		}
+		prefix := f.Value.(string)
+		res = append(res, driver.Filter{FieldPath: f.FieldPath, Op: ">=", Value: prefix})
+		if end, ok := prefixEnd(prefix); ok {
+			res = append(res, driver.Filter{FieldPath: f.FieldPath, Op: "<", Value: end})
+		}
+	}
+	return res
+}
+
+// prefixEnd returns the smallest string that is greater than every string
+// beginning with prefix. Firestore orders strings by their UTF-8 encodings, which
+// is the same as ordering them by code point. It returns false if there is no
+// such string, because prefix is empty or consists of utf8.MaxRune.
+func prefixEnd(prefix string) (string, bool) {
+	rs := []rune(prefix)
+	for i := len(rs) - 1; i >= 0; i-- {
+		if rs[i] == utf8.MaxRune {
+			continue
+		}
+		r := rs[i] + 1
+		if r == 0xD800 {
+			// Skip the surrogate halves, which are not valid in UTF-8.
+			r = 0xE000
+		}
+		return string(append(rs[:i], r)), true
+	}
+	return "", false
+}
+
 // splitFilters separates the list of query filters into those we can send to the Firestore service,
 // and those we must evaluate here on the client.
 func splitFilters(fs []driver.Filter) (sendToFirestore, evaluateLocally []driver.Filter) {
@@ -312,7 +383,7 @@ func splitFilters(fs []driver.Filter) (sendToFirestore, evaluateLocally []driver
 
 func (c *collection) filterToProto(f driver.Filter) (*pb.StructuredQuery_Filter, error) {
 	// Treat filters on the name field specially.
-	if c.nameField != "" && driver.FieldPathEqualsField(f.FieldPath, c.nameField) {
+	if c.isNameField(f.FieldPath) {
 		v := reflect.ValueOf(f.Value)
 		if v.Kind() != reflect.String {
 			return nil, gcerr.Newf(gcerr.InvalidArgument, nil,
@@ -400,11 +471,20 @@ func newFieldFilter(fp []string, op string, val *pb.Value) (*pb.StructuredQuery_
 	}, nil
 }
 
-func (c *collection) QueryPlan(q *driver.Query) (string, error) {
-	return "unknown", nil
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	// The index that Firestore chooses is unknown.
+	send, local := splitFilters(q.Filters)
+	return &driver.QueryPlan{
+		Description:   "unknown",
+		ServerFilters: send,
+		ClientFilters: local,
+	}, nil
 }
 
 func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	if c.opts.CollectionGroup {
+		return errCollectionGroupWrite
+	}
 	return c.runWriteQuery(ctx, q, func(doc *pb.Document) ([]*pb.Write, error) {
 		return []*pb.Write{{
 			Operation:       &pb.Write_Delete{Delete: doc.Name},
@@ -414,6 +494,9 @@ func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error
 }
 
 func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	if c.opts.CollectionGroup {
+		return errCollectionGroupWrite
+	}
 	fields, paths, transforms, err := processMods(mods)
 	if err != nil {
 		return err
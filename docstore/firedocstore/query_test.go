@@ -15,6 +15,7 @@
 package firedocstore
 
 import (
+	"context"
 	"math"
 	"testing"
 	"time"
@@ -23,6 +24,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"gocloud.dev/docstore/driver"
 	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/gcerrors"
 	pb "google.golang.org/genproto/googleapis/firestore/v1"
 )
 
@@ -85,6 +87,49 @@ func TestFilterToProto(t *testing.T) {
 	}
 }
 
+func TestCollectionGroupQuery(t *testing.T) {
+	c := &collection{
+		nameField: "name",
+		dbPath:    "projects/P/databases/(default)",
+		collPath:  "projects/P/databases/(default)/documents/States/Wisconsin/cities",
+		opts:      &Options{CollectionGroup: true},
+	}
+	if got, want := c.queryParent(), "projects/P/databases/(default)/documents"; got != want {
+		t.Errorf("parent: got %q, want %q", got, want)
+	}
+	sq, _, err := c.queryToProto(&driver.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*pb.StructuredQuery_CollectionSelector{{CollectionId: "cities", AllDescendants: true}}
+	if diff := cmp.Diff(sq.From, want, cmp.Comparer(proto.Equal)); diff != "" {
+		t.Error(diff)
+	}
+	if c.SupportsFilter(driver.Filter{FieldPath: []string{"name"}, Op: "=", Value: "x"}) {
+		t.Error("name field filter is supported, want unsupported")
+	}
+	if _, _, err := c.queryToProto(&driver.Query{OrderByField: "name", OrderAscending: true}); err == nil {
+		t.Error("ordering by the name field: got nil error, want error")
+	}
+
+	// Writes are rejected before any RPC is made.
+	ctx := context.Background()
+	if err := c.RunDeleteQuery(ctx, &driver.Query{}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("delete query: got %v, want InvalidArgument", err)
+	}
+	if err := c.RunUpdateQuery(ctx, &driver.Query{}, []driver.Mod{{FieldPath: []string{"a"}, Value: 1}}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("update query: got %v, want InvalidArgument", err)
+	}
+	doc, err := driver.NewDocument(map[string]interface{}{"name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerr := c.RunActions(ctx, []*driver.Action{{Kind: driver.Put, Doc: doc, Key: "x"}}, &driver.RunActionsOptions{})
+	if len(alerr) != 1 || gcerrors.Code(alerr[0].Err) != gcerrors.InvalidArgument {
+		t.Errorf("action: got %v, want one InvalidArgument error", alerr)
+	}
+}
+
 func TestSplitFilters(t *testing.T) {
 	aEqual := driver.Filter{[]string{"a"}, "=", 1}
 	aLess := driver.Filter{[]string{"a"}, "<", 1}
@@ -142,6 +187,35 @@ func TestSplitFilters(t *testing.T) {
 	}
 }
 
+func TestExpandPrefixFilters(t *testing.T) {
+	aEqual := driver.Filter{[]string{"a"}, "=", 1}
+	got := expandPrefixFilters([]driver.Filter{aEqual, {[]string{"b"}, driver.HasPrefixOp, "ab"}})
+	want := []driver.Filter{
+		aEqual,
+		{[]string{"b"}, ">=", "ab"},
+		{[]string{"b"}, "<", "ac"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error(diff)
+	}
+
+	for _, test := range []struct {
+		in, want string
+		wantOK   bool
+	}{
+		{"", "", false},
+		{"a", "b", true},
+		{"a\U0010FFFF", "b", true},
+		{"\U0010FFFF", "", false},
+		{"\uD7FF", "\uE000", true},
+	} {
+		got, ok := prefixEnd(test.in)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("prefixEnd(%q) = %q, %t, want %q, %t", test.in, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
 func TestEvaluateFilter(t *testing.T) {
 	m := map[string]interface{}{
 		"i":  32,
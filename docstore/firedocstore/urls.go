@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"strconv"
 	"sync"
 
 	vkit "cloud.google.com/go/firestore/apiv1"
@@ -72,6 +73,9 @@ const Scheme = "firestore"
 // name_field, be designated the primary key. Its values must be unique over all
 // documents in the collection, and the primary key must be provided to retrieve
 // a document.
+//   - collection_group: if true, query the collection group named by the last
+// component of the path; see Options.CollectionGroup. The value is parsed with
+// strconv.ParseBool.
 type URLOpener struct {
 	// Client must be set to a non-nil client authenticated with Cloud Firestore
 	// scope or equivalent.
@@ -87,9 +91,18 @@ func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstor
 		return nil, errors.New("open collection %s: name_field is required to open a collection")
 	}
 	q.Del("name_field")
+	opts := &Options{}
+	if v := q.Get("collection_group"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("open collection %s: invalid collection_group %q: %v", u, v, err)
+		}
+		opts.CollectionGroup = b
+	}
+	q.Del("collection_group")
 	for param := range q {
 		return nil, fmt.Errorf("open collection %s: invalid query parameter %q", u, param)
 	}
 	collResourceID := path.Join(u.Host, u.Path)
-	return OpenCollection(o.Client, collResourceID, nameField, nil)
+	return OpenCollection(o.Client, collResourceID, nameField, opts)
 }
@@ -34,12 +34,16 @@ func TestOpenCollection(t *testing.T) {
 		{"firestore://projects/myproject/databases/(default)/documents/mycoll?name_field=_id", false},
 		// OK, hierarchical collection.
 		{"firestore://projects/myproject/databases/(default)/documents/mycoll/mydoc/subcoll?name_field=_id", false},
+		// OK, collection group.
+		{"firestore://projects/myproject/databases/(default)/documents/subcoll?name_field=_id&collection_group=true", false},
 		// Missing project ID.
 		{"firestore:///mycoll?name_field=_id", true},
 		// Empty collection.
 		{"firestore://projects/myproject/", true},
 		// Missing name field.
 		{"firestore://projects/myproject/databases/(default)/documents/mycoll", true},
+		// Invalid collection_group value.
+		{"firestore://projects/myproject/databases/(default)/documents/subcoll?name_field=_id&collection_group=yes", true},
 		// Invalid param.
 		{"firestore://projects/myproject/databases/(default)/documents/mycoll?name_field=_id&param=value", true},
 	}
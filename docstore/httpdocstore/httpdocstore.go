@@ -0,0 +1,639 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpdocstore provides an implementation of the docstore API for any
+// service that speaks a small REST protocol over HTTP, so that an existing
+// service can be used as a docstore collection without writing a driver for
+// it.
+//
+//
+// Protocol
+//
+// A collection is identified by a base URL, like
+// https://example.com/api/players. Each document is a JSON object stored under
+// its key, which must be a non-empty string, at the base URL followed by a
+// slash and the path-escaped key. The document does not include the revision
+// field: its revision is the ETag the service returns for it, which must be a
+// strong entity tag that changes on every write.
+//
+// The service must implement these requests:
+//
+// - GET {base}/{key} returns the document with status 200 and its ETag in the
+//   ETag header, or status 404 if there is none.
+//
+// - PUT {base}/{key} stores the JSON object in the request body as the
+//   document, and returns a 2xx status with the new ETag in the ETag header.
+//   With an If-Match header, it must store the document only if it exists with
+//   that ETag. With "If-None-Match: *", it must store the document only if it
+//   does not exist. Otherwise it returns status 412.
+//
+// - DELETE {base}/{key} deletes the document and returns a 2xx status, or 404
+//   if there is none. It observes If-Match as PUT does.
+//
+// - POST {base} with a QueryRequest as its JSON body returns a page of
+//   documents as a QueryResponse, with status 200. The filters in the request
+//   are a hint: the service may use them to leave out documents that cannot
+//   match, but the driver evaluates them all again, so the service may return
+//   every document. A response with a NextPageToken is followed by a request
+//   with that PageToken, until a response has none.
+//
+// Any other status is an error, described by the response body if it is text.
+// Every request has an "Accept: application/json" header, and those with a
+// body also have "Content-Type: application/json".
+//
+//
+// Action Lists
+//
+// Each action in an action list is a separate request, and they run
+// concurrently. Writes that depend on the current document, such as those with
+// a revision or conditions, read it and write it back with If-Match. If the
+// document changes in between, the write is retried.
+//
+// httpdocstore calls the BeforeDo function before each request, with an as
+// function that exposes *http.Request, so that it can add headers such as
+// those used for authentication.
+//
+//
+// Queries
+//
+// Queries are evaluated on the client, over the documents the service returns
+// for them. Query.OrderBy reads all the matching documents before sorting them.
+// Query.Delete and Query.Update change each matching document on its own,
+// provided it still matches. The BeforeQuery function is called before each
+// query request, with an as function that exposes *http.Request.
+//
+//
+// As
+//
+// httpdocstore exposes the following types for As:
+// - Collection: *http.Client
+// - ActionList.BeforeDo: *http.Request
+// - Query.BeforeQuery: *http.Request
+// - DocumentIterator: *QueryResponse, the most recent page of results
+// - ErrorAs: *Error
+//
+//
+// Special Considerations
+//
+// JSON has no binary or time types. []byte values are stored as objects like
+// {"$binary": "AAEC"}, whose only field holds the bytes in base64, and which
+// are decoded as []byte. time.Time values are stored as RFC 3339 strings in UTC
+// with nanosecond precision. They are decoded to time.Time when the destination
+// has that type, but as strings when decoding into an interface{}. Query
+// filters on time.Time values compare the strings, which sort in time order.
+package httpdocstore // import "gocloud.dev/docstore/httpdocstore"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+)
+
+// maxErrorMessage is the number of bytes of an error response that are kept as
+// the message of an Error.
+const maxErrorMessage = 1 << 10
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// The maximum number of actions that run concurrently for a single call to
+	// ActionList.Do. If less than 1, there is no limit.
+	MaxOutstandingActionRPCs int
+}
+
+type collection struct {
+	client   *http.Client
+	base     string // the base URL, without a trailing slash
+	keyField string
+	keyFunc  func(docstore.Document) interface{}
+	opts     *Options
+
+	beforeMu sync.Mutex // serializes calls to BeforeDo and BeforeQuery
+}
+
+// OpenCollection opens a docstore collection whose documents are served under
+// baseURL, which must be an absolute http or https URL. If client is nil,
+// http.DefaultClient is used. keyField is the document field holding the
+// primary key, which must be a string.
+func OpenCollection(client *http.Client, baseURL, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, baseURL, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens a docstore collection whose documents are
+// served under baseURL. keyFunc takes a document and returns its primary key,
+// which must be a string. It should return nil if the document is missing the
+// information to construct a key. This will cause all actions, even Create, to
+// fail.
+func OpenCollectionWithKeyFunc(client *http.Client, baseURL string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, baseURL, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(client *http.Client, baseURL, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, err, "httpdocstore: invalid base URL %q", baseURL)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "httpdocstore: base URL %q must be an http or https URL without a query or fragment", baseURL)
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "httpdocstore: must provide either keyField or keyFunc")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	return &collection{
+		client:   client,
+		base:     strings.TrimSuffix(baseURL, "/"),
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+	}, nil
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// docKey returns the key of the document of a.
+func docKey(a *driver.Action) (string, error) {
+	s, ok := a.Key.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "httpdocstore: key %v is a %T, not a string", a.Key, a.Key)
+	}
+	if s == "" {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "httpdocstore: key is empty")
+	}
+	return s, nil
+}
+
+func (c *collection) RevisionField() string { return c.opts.RevisionField }
+
+// MaxDocumentSize implements driver.MaxDocumentSize. Any limit is up to the
+// service, so there is none here.
+func (c *collection) MaxDocumentSize() int { return 0 }
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	for _, group := range [][]*driver.Action{beforeGets, gets, writes, afterGets} {
+		if driver.ShouldStop(opts, errs) {
+			driver.SkipActions(group, errs)
+			continue
+		}
+		c.runGroup(ctx, group, errs, opts)
+	}
+	return driver.NewActionListError(errs)
+}
+
+// runGroup runs each action of a group concurrently. With FailFast, it stops
+// starting actions once one fails.
+func (c *collection) runGroup(ctx context.Context, group []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	mapdoc.RunConcurrently(group, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+		if a.Kind == driver.Get {
+			return c.runGet(ctx, a, opts.BeforeDo)
+		}
+		return c.runWrite(ctx, a, opts.BeforeDo)
+	})
+}
+
+// docURL returns the URL of the document with the given key.
+func (c *collection) docURL(key string) string {
+	return c.base + "/" + url.PathEscape(key)
+}
+
+// newRequest returns a request with the JSON encoding of body, if it is
+// non-nil.
+func (c *collection) newRequest(ctx context.Context, method, url string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := jsoncodec.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// send calls before, if it is non-nil, with an as function that exposes req,
+// and then sends req. It returns the body and the ETag of a successful
+// response. An unsuccessful response is returned as an *Error.
+func (c *collection) send(req *http.Request, before func(func(interface{}) bool) error) ([]byte, string, error) {
+	if before != nil {
+		c.beforeMu.Lock()
+		err := before(driver.AsFunc(req))
+		c.beforeMu.Unlock()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, "", ctxErr
+		}
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, "", newError(res)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, res.Header.Get("ETag"), nil
+}
+
+// decodeObject decodes the JSON object b, a document stored by the service,
+// and adds its revision.
+func decodeObject(b []byte, etag, revField string) (map[string]interface{}, error) {
+	if etag == "" {
+		return nil, gcerr.Newf(gcerr.Internal, nil, "httpdocstore: document has no ETag")
+	}
+	v, err := jsoncodec.Unmarshal(b)
+	if err != nil {
+		return nil, gcerr.Newf(gcerr.Internal, err, "httpdocstore: decoding document")
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, gcerr.Newf(gcerr.Internal, nil, "httpdocstore: document is a JSON %T, not an object", v)
+	}
+	m[revField] = etag
+	return m, nil
+}
+
+// read reads the document with the given key. It returns a nil document if
+// there is none.
+func (c *collection) read(ctx context.Context, key string, before func(func(interface{}) bool) error) (map[string]interface{}, string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.docURL(key), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	b, etag, err := c.send(req, before)
+	if isNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	doc, err := decodeObject(b, etag, c.opts.RevisionField)
+	if err != nil {
+		return nil, "", err
+	}
+	return doc, etag, nil
+}
+
+// runGet reads the document of the Get action a.
+func (c *collection) runGet(ctx context.Context, a *driver.Action, before func(func(interface{}) bool) error) error {
+	key, err := docKey(a)
+	if err != nil {
+		return err
+	}
+	doc, _, err := c.read(ctx, key, before)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+	}
+	return codec.DecodeDoc(doc, a.Doc, a.FieldPaths, c.opts.RevisionField)
+}
+
+// runWrite executes a single write action, retrying it if the document changes
+// between reading and writing it.
+func (c *collection) runWrite(ctx context.Context, a *driver.Action, before func(func(interface{}) bool) error) error {
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	key, err := docKey(a)
+	if err != nil {
+		return err
+	}
+	wantRev, err := c.revisionOf(a.Doc)
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		err := c.write(ctx, key, a, wantRev, before)
+		if !isConflict(err) || i == mapdoc.MaxWriteAttempts {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// revisionOf returns the revision of doc, or the empty string if it has none.
+func (c *collection) revisionOf(doc driver.Document) (string, error) {
+	v, err := doc.GetField(c.opts.RevisionField)
+	if err != nil || v == nil {
+		return "", nil // no incoming revision information
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want string", c.opts.RevisionField, v)
+	}
+	return s, nil
+}
+
+// A precondition is the condition on the current document under which a write
+// is made.
+type precondition struct {
+	ifMatch     string // the ETag the document must have
+	ifNoneMatch bool   // the document must not exist
+}
+
+// write executes the write action a on the document with the given key. If a
+// depends on the current document, it writes only if the document has not
+// changed since it was read, and returns a conflict error otherwise.
+func (c *collection) write(ctx context.Context, key string, a *driver.Action, wantRev string, before func(func(interface{}) bool) error) error {
+	blind := len(a.Conditions) == 0 && wantRev == ""
+	switch {
+	case a.Kind == driver.Create:
+		err := c.putDoc(ctx, key, a, precondition{ifNoneMatch: true}, before)
+		if isConflict(err) {
+			return gcerr.Newf(gcerr.AlreadyExists, err, "Create: document with key %q exists", a.Key)
+		}
+		return err
+	case blind && a.Kind == driver.Put:
+		return c.putDoc(ctx, key, a, precondition{}, before)
+	case blind && a.Kind == driver.Delete:
+		return c.delete(ctx, key, precondition{}, before)
+	}
+
+	current, rev, err := c.read(ctx, key, before)
+	if err != nil {
+		return err
+	}
+	exists := current != nil
+	switch {
+	case !exists && a.Kind == driver.Delete:
+		return nil
+	case !exists && (len(a.Conditions) > 0 || wantRev != ""):
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q does not exist", a.Key)
+	case !exists && (a.Kind == driver.Replace || a.Kind == driver.Update):
+		return gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+	case !eval.FiltersMatch(a.Conditions, current):
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "conditions not satisfied for document with key %q", a.Key)
+	case wantRev != "" && wantRev != rev:
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %s, current %s", wantRev, rev)
+	}
+
+	pre := precondition{ifMatch: rev}
+	switch a.Kind {
+	case driver.Delete:
+		return c.delete(ctx, key, pre, before)
+	case driver.Replace, driver.Put:
+		return c.putDoc(ctx, key, a, pre, before)
+	case driver.Update:
+		if err := eval.ApplyMods(current, a.Mods); err != nil {
+			return err
+		}
+		delete(current, c.opts.RevisionField)
+		newRev, err := c.put(ctx, key, current, pre, before)
+		if err != nil {
+			return err
+		}
+		// Ignore errors. It's fine if the doc doesn't have a revision field.
+		_ = a.Doc.SetField(c.opts.RevisionField, newRev)
+		return nil
+	default:
+		return gcerr.Newf(gcerr.Internal, nil, "unknown kind %v", a.Kind)
+	}
+}
+
+// putDoc stores the document of a under key, and sets the document's revision
+// field.
+func (c *collection) putDoc(ctx context.Context, key string, a *driver.Action, pre precondition, before func(func(interface{}) bool) error) error {
+	doc, err := codec.EncodeDoc(a.Doc)
+	if err != nil {
+		return err
+	}
+	// The revision is not part of the stored document.
+	delete(doc, c.opts.RevisionField)
+	rev, err := c.put(ctx, key, doc, pre, before)
+	if err != nil {
+		return err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, rev)
+	return nil
+}
+
+// put stores doc under key if pre holds, and returns its new revision.
+func (c *collection) put(ctx context.Context, key string, doc map[string]interface{}, pre precondition, before func(func(interface{}) bool) error) (string, error) {
+	req, err := c.newRequest(ctx, http.MethodPut, c.docURL(key), doc)
+	if err != nil {
+		return "", err
+	}
+	pre.setHeaders(req)
+	_, etag, err := c.send(req, before)
+	if err != nil {
+		return "", err
+	}
+	if etag == "" {
+		return "", gcerr.Newf(gcerr.Internal, nil, "httpdocstore: PUT response has no ETag")
+	}
+	return etag, nil
+}
+
+// delete deletes the document with the given key if pre holds. Deleting a
+// missing document succeeds.
+func (c *collection) delete(ctx context.Context, key string, pre precondition, before func(func(interface{}) bool) error) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, c.docURL(key), nil)
+	if err != nil {
+		return err
+	}
+	pre.setHeaders(req)
+	_, _, err = c.send(req, before)
+	if isNotFound(err) {
+		if pre.ifMatch != "" {
+			// The document was deleted after it was read.
+			return &Error{StatusCode: http.StatusPreconditionFailed}
+		}
+		return nil
+	}
+	return err
+}
+
+func (p precondition) setHeaders(req *http.Request) {
+	if p.ifMatch != "" {
+		req.Header.Set("If-Match", p.ifMatch)
+	}
+	if p.ifNoneMatch {
+		req.Header.Set("If-None-Match", "*")
+	}
+}
+
+// Error is an unsuccessful response from the service.
+type Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Message is the body of the response, if it is text, with surrounding
+	// white space removed. It is truncated to the first kilobyte.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("httpdocstore: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("httpdocstore: %s: %s", http.StatusText(e.StatusCode), e.Message)
+}
+
+// newError returns the *Error for the unsuccessful response res.
+func newError(res *http.Response) error {
+	e := &Error{StatusCode: res.StatusCode}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorMessage))
+	if err != nil {
+		e.Message = err.Error()
+		return e
+	}
+	ct := res.Header.Get("Content-Type")
+	if ct == "" || strings.HasPrefix(ct, "text/") || strings.HasPrefix(ct, "application/json") {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	return e
+}
+
+// isConflict reports whether err means that a precondition of a write did not
+// hold.
+func isConflict(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusPreconditionFailed
+}
+
+// isNotFound reports whether err means that the document does not exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool {
+	p, ok := i.(**http.Client)
+	if !ok {
+		return false
+	}
+	*p = c.client
+	return true
+}
+
+// ErrorAs implements driver.Collection.ErrorAs.
+func (c *collection) ErrorAs(err error, i interface{}) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	p, ok := i.(**Error)
+	if !ok {
+		return false
+	}
+	*p = e
+	return true
+}
+
+// ErrorCode implements driver.Collection.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	if g, ok := err.(*gcerr.Error); ok {
+		return g.Code
+	}
+	switch err {
+	case context.Canceled:
+		return gcerr.Canceled
+	case context.DeadlineExceeded:
+		return gcerr.DeadlineExceeded
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return gcerr.Unknown
+	}
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return gcerr.InvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return gcerr.PermissionDenied
+	case http.StatusNotFound:
+		return gcerr.NotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		// The document kept changing during the write.
+		return gcerr.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return gcerr.ResourceExhausted
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return gcerr.DeadlineExceeded
+	case http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		return gcerr.Unimplemented
+	case http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusBadGateway:
+		return gcerr.Internal
+	}
+	return gcerr.Unknown
+}
+
+// Close implements driver.Collection.Close. It does not close the client's
+// idle connections.
+func (c *collection) Close() error { return nil }
@@ -0,0 +1,291 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpdocstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/gcerrors"
+)
+
+// testServer is an in-memory implementation of the protocol. It ignores the
+// filters of queries, and returns their results a few at a time.
+type testServer struct {
+	mu    sync.Mutex
+	colls map[string]map[string]storedDoc // by collection path, then key
+	etag  int                             // the most recent ETag
+}
+
+type storedDoc struct {
+	etag string
+	body []byte
+}
+
+const testPageSize = 3
+
+func newTestServer() *testServer {
+	return &testServer{colls: map[string]map[string]storedDoc{}}
+}
+
+// clear removes all the documents of the collection at path.
+func (s *testServer) clear(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.colls, path)
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := r.URL.EscapedPath()
+	if r.Method == http.MethodPost {
+		s.query(w, r, path)
+		return
+	}
+	i := strings.LastIndexByte(path, '/')
+	key, err := url.PathUnescape(path[i+1:])
+	if err != nil || key == "" {
+		http.Error(w, "bad key", http.StatusBadRequest)
+		return
+	}
+	coll := s.colls[path[:i]]
+	if coll == nil {
+		coll = map[string]storedDoc{}
+		s.colls[path[:i]] = coll
+	}
+	cur, exists := coll[key]
+	if m := r.Header.Get("If-Match"); m != "" && (!exists || m != cur.etag) {
+		http.Error(w, "ETag mismatch", http.StatusPreconditionFailed)
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		http.Error(w, "document exists", http.StatusPreconditionFailed)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", cur.etag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(cur.body)
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.etag++
+		etag := strconv.Quote(strconv.Itoa(s.etag))
+		coll[key] = storedDoc{etag, body}
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		delete(coll, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *testServer) query(w http.ResponseWriter, r *http.Request, path string) {
+	var qr QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&qr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	coll := s.colls[path]
+	var keys []string
+	for k := range coll {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	start := 0
+	if qr.PageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(qr.PageToken); err != nil {
+			http.Error(w, "bad page token", http.StatusBadRequest)
+			return
+		}
+	}
+	res := QueryResponse{Documents: []QueryResult{}}
+	for i := start; i < len(keys) && i < start+testPageSize; i++ {
+		d := coll[keys[i]]
+		res.Documents = append(res.Documents, QueryResult{Key: keys[i], ETag: d.etag, Document: d.body})
+	}
+	if start+testPageSize < len(keys) {
+		res.NextPageToken = strconv.Itoa(start + testPageSize)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+type harness struct {
+	server *testServer
+	ts     *httptest.Server
+}
+
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	s := newTestServer()
+	return &harness{server: s, ts: httptest.NewServer(s)}, nil
+}
+
+// collection returns an empty collection at path.
+func (h *harness) collection(path, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (driver.Collection, error) {
+	h.server.clear(path)
+	return newCollection(h.ts.Client(), h.ts.URL+path, keyField, keyFunc, opts)
+}
+
+func (h *harness) MakeCollection(ctx context.Context) (driver.Collection, error) {
+	return h.collection("/docstore-test-1", drivertest.KeyField, nil, nil)
+}
+
+func (h *harness) MakeTwoKeyCollection(ctx context.Context) (driver.Collection, error) {
+	return h.collection("/docstore-test-2", "", drivertest.HighScoreKey, nil)
+}
+
+func (h *harness) MakeAlternateRevisionFieldCollection(ctx context.Context) (driver.Collection, error) {
+	return h.collection("/docstore-test-1", drivertest.KeyField, nil, &Options{RevisionField: drivertest.AlternateRevisionField})
+}
+
+func (*harness) BeforeDoTypes() []interface{} {
+	return []interface{}{&http.Request{}}
+}
+
+func (*harness) BeforeQueryTypes() []interface{} {
+	return []interface{}{&http.Request{}}
+}
+
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
+func (h *harness) Close() { h.ts.Close() }
+
+// asMatrix lists the types that the As methods support.
+var asMatrix = drivertest.AsMatrix{
+	Collection: []interface{}{new(*http.Client)},
+	Iterator:   []interface{}{new(*QueryResponse)},
+	Error:      []interface{}{new(*Error)},
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, nil, []drivertest.AsTest{asMatrix})
+}
+
+func BenchmarkConformance(b *testing.B) {
+	ts := httptest.NewServer(newTestServer())
+	defer ts.Close()
+	coll, err := newCollection(ts.Client(), ts.URL+"/docstore-test-3", drivertest.KeyField, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	drivertest.RunBenchmarks(b, docstore.NewCollection(coll))
+}
+
+// httpdocstore-specific tests.
+
+func TestNewCollectionErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		baseURL  string
+		keyField string
+	}{
+		{"no key", "https://example.com/players", ""},
+		{"bad URL", "https://example.com/%zz", "name"},
+		{"not HTTP", "ftp://example.com/players", "name"},
+		{"relative", "/players", "name"},
+		{"query", "https://example.com/players?a=b", "name"},
+	} {
+		_, err := newCollection(nil, test.baseURL, test.keyField, nil, nil)
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", test.name, err)
+		}
+	}
+}
+
+// TestRequests checks the requests the driver makes: the path of a document,
+// and the headers that BeforeDo can add.
+func TestRequests(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer()
+	var gotPaths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		gotPaths = append(gotPaths, r.Method+" "+r.URL.EscapedPath())
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	coll, err := OpenCollection(ts.Client(), ts.URL+"/api/players/", "name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+
+	doc := map[string]interface{}{"name": "a/b c", "score": 1}
+	err = coll.Actions().Put(doc).Do(ctx)
+	if gcerrors.Code(err) != gcerrors.PermissionDenied {
+		t.Fatalf("without a token: got %v, want PermissionDenied", err)
+	}
+	var e *Error
+	if !coll.ErrorAs(err.(docstore.ActionListError)[0].Err, &e) || e.Message != "no token" {
+		t.Errorf("got error %v, want an *Error with message %q", err, "no token")
+	}
+
+	auth := func(as func(interface{}) bool) error {
+		var req *http.Request
+		if !as(&req) {
+			return errors.New("As failed for *http.Request")
+		}
+		req.Header.Set("Authorization", "Bearer token")
+		return nil
+	}
+	if err := coll.Actions().BeforeDo(auth).Put(doc).Get(doc).Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"PUT /api/players/a%2Fb%20c", "GET /api/players/a%2Fb%20c"}
+	if strings.Join(gotPaths, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got requests %q, want %q", gotPaths, want)
+	}
+	if rev, _ := doc[docstore.DefaultRevisionField].(string); rev == "" {
+		t.Errorf("got revision %v, want the ETag", doc[docstore.DefaultRevisionField])
+	}
+}
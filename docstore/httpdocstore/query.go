@@ -0,0 +1,379 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpdocstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+)
+
+// eval evaluates filters and sort orders on the documents read from the server,
+// and applies modifications to them.
+var eval = mapdoc.Evaluator{ToGo: codec.ToGo, EncodeValue: codec.EncodeValue}
+
+// QueryRequest is the body of a query request.
+type QueryRequest struct {
+	// Filters are the filters of the query. A document matches the query if it
+	// satisfies all of them.
+	Filters []QueryFilter `json:"filters,omitempty"`
+
+	// PageToken is the NextPageToken of the previous page of results, or empty
+	// for the first page.
+	PageToken string `json:"pageToken,omitempty"`
+}
+
+// A QueryFilter is a filter of a query.
+type QueryFilter struct {
+	// Field is the field path of the filter, with components separated by dots,
+	// as in "a.b".
+	Field string `json:"field"`
+
+	// Op is the operator of the filter: one of "=", "<", "<=", ">", ">=",
+	// "exists", "not-exists", "has-prefix", "equal-fold" and
+	// "has-prefix-fold". See the constants of gocloud.dev/docstore/driver for
+	// the meaning of the last five.
+	Op string `json:"op"`
+
+	// Value is the value the field is compared to, encoded as it would be in a
+	// document. It is absent for "exists" and "not-exists".
+	Value interface{} `json:"value,omitempty"`
+}
+
+// QueryResponse is a page of the results of a query.
+type QueryResponse struct {
+	// Documents are the documents of the page.
+	Documents []QueryResult `json:"documents"`
+
+	// NextPageToken is the token of the next page of results, or empty if this
+	// is the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// A QueryResult is a document in a QueryResponse.
+type QueryResult struct {
+	// Key is the key of the document.
+	Key string `json:"key"`
+
+	// ETag is the ETag of the document, as GET would return it.
+	ETag string `json:"etag"`
+
+	// Document is the document, as GET would return it.
+	Document json.RawMessage `json:"document"`
+}
+
+// SupportsFilter implements driver.SupportsFilter. All filters are evaluated
+// on the client, whether or not the service also uses them.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// newQueryRequest returns the first query request for the filters fs.
+func newQueryRequest(fs []driver.Filter) (*QueryRequest, error) {
+	qr := &QueryRequest{}
+	for _, f := range fs {
+		qf := QueryFilter{Field: strings.Join(f.FieldPath, "."), Op: f.Op}
+		if f.Op != driver.ExistsOp && f.Op != driver.NotExistsOp {
+			v, err := codec.EncodeValue(f.Value)
+			if err != nil {
+				return nil, err
+			}
+			qf.Value = v
+		}
+		qr.Filters = append(qr.Filters, qf)
+	}
+	return qr, nil
+}
+
+// A pager reads the pages of results of a query.
+type pager struct {
+	coll   *collection
+	qr     *QueryRequest
+	before func(func(interface{}) bool) error
+	res    *QueryResponse // the most recent page
+	done   bool           // no pages remain
+}
+
+// next returns the next page of results, or io.EOF when there are no more.
+func (p *pager) next(ctx context.Context) (*QueryResponse, error) {
+	if p.done {
+		return nil, io.EOF
+	}
+	if p.res != nil {
+		p.qr.PageToken = p.res.NextPageToken
+	}
+	req, err := p.coll.newRequest(ctx, http.MethodPost, p.coll.base, p.qr)
+	if err != nil {
+		return nil, err
+	}
+	b, _, err := p.coll.send(req, p.before)
+	if err != nil {
+		return nil, err
+	}
+	var res QueryResponse
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, gcerr.Newf(gcerr.Internal, err, "httpdocstore: decoding query response")
+	}
+	p.res = &res
+	p.done = res.NextPageToken == ""
+	return &res, nil
+}
+
+// A match is a document that matches a query.
+type match struct {
+	key string
+	rev string
+	doc map[string]interface{}
+}
+
+// matches returns the documents among results that satisfy fs.
+func (c *collection) matches(results []QueryResult, fs []driver.Filter) ([]match, error) {
+	var ms []match
+	for _, r := range results {
+		if r.Key == "" {
+			return nil, gcerr.Newf(gcerr.Internal, nil, "httpdocstore: query result has no key")
+		}
+		doc, err := decodeObject(r.Document, r.ETag, c.opts.RevisionField)
+		if err != nil {
+			return nil, err
+		}
+		if eval.FiltersMatch(fs, doc) {
+			ms = append(ms, match{r.Key, r.ETag, doc})
+		}
+	}
+	return ms, nil
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	qr, err := newQueryRequest(q.Filters)
+	if err != nil {
+		return nil, err
+	}
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	it := &docIterator{
+		coll:       c,
+		pager:      &pager{coll: c, qr: qr, before: q.BeforeQuery},
+		filters:    q.Filters,
+		limit:      q.Limit,
+		fieldPaths: fps,
+	}
+	// Read the first page now, so that As can expose it.
+	if err := it.nextPage(ctx); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if q.OrderByField != "" {
+		// Read all the results and sort them.
+		for {
+			err := it.nextPage(ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		eval.SortDocs(it.docs, strings.Split(q.OrderByField, "."), q.OrderAscending)
+	}
+	return it, nil
+}
+
+// docIterator returns the documents that match a query, reading them a page at
+// a time.
+type docIterator struct {
+	coll       *collection
+	pager      *pager
+	docs       []map[string]interface{}
+	filters    []driver.Filter
+	limit      int
+	count      int
+	fieldPaths [][]string
+	err        error
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.limit > 0 && it.count >= it.limit {
+		it.Stop()
+		return it.err
+	}
+	for len(it.docs) == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := it.nextPage(ctx); err != nil {
+			it.err = err
+			return err
+		}
+	}
+	if err := codec.DecodeDoc(it.docs[0], doc, it.fieldPaths, it.coll.opts.RevisionField); err != nil {
+		it.err = err
+		return it.err
+	}
+	it.docs = it.docs[1:]
+	it.count++
+	return nil
+}
+
+// nextPage appends the matching documents of the next page of results to
+// it.docs. It returns io.EOF if there are no more pages.
+func (it *docIterator) nextPage(ctx context.Context) error {
+	res, err := it.pager.next(ctx)
+	if err != nil {
+		return err
+	}
+	ms, err := it.coll.matches(res.Documents, it.filters)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		it.docs = append(it.docs, m.doc)
+	}
+	return nil
+}
+
+func (it *docIterator) Stop() {
+	it.docs = nil
+	it.err = io.EOF
+}
+
+// As implements driver.DocumentIterator.As. It exposes the most recent page of
+// results as *QueryResponse.
+func (it *docIterator) As(i interface{}) bool {
+	p, ok := i.(**QueryResponse)
+	if !ok || it.pager.res == nil {
+		return false
+	}
+	*p = it.pager.res
+	return true
+}
+
+// QueryPlan implements driver.QueryPlan. The description is the body of the
+// first query request.
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	qr, err := newQueryRequest(q.Filters)
+	if err != nil {
+		return nil, err
+	}
+	b, err := jsoncodec.Marshal(qr)
+	if err != nil {
+		return nil, err
+	}
+	// With filters, whether the service uses them is unknown.
+	plan := &driver.QueryPlan{
+		Description:   fmt.Sprintf("POST %s %s", c.base, b),
+		ClientFilters: q.Filters,
+	}
+	if len(q.Filters) == 0 {
+		plan.Scan = driver.ScanFull
+	}
+	return plan, nil
+}
+
+// matchingDocs returns the documents that match q. It reads them all before
+// returning, so that changing them cannot affect the query.
+func (c *collection) matchingDocs(ctx context.Context, q *driver.Query) ([]match, error) {
+	qr, err := newQueryRequest(q.Filters)
+	if err != nil {
+		return nil, err
+	}
+	p := &pager{coll: c, qr: qr, before: q.BeforeQuery}
+	var ms []match
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		res, err := p.next(ctx)
+		if err == io.EOF {
+			return ms, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch, err := c.matches(res.Documents, q.Filters)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, batch...)
+	}
+}
+
+// RunDeleteQuery implements driver.RunDeleteQuery. Each matching document is
+// deleted on its own, provided it still matches.
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	return c.rewriteMatches(ctx, q, nil)
+}
+
+// RunUpdateQuery implements driver.RunUpdateQuery. Each matching document is
+// updated on its own, provided it still matches.
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	return c.rewriteMatches(ctx, q, mods)
+}
+
+// rewriteMatches applies mods to each document that matches q, or deletes it if
+// mods is nil. A document that changes before it is written is read again, and
+// rewritten if it still matches.
+func (c *collection) rewriteMatches(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	ms, err := c.matchingDocs(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		for i := 1; ; i++ {
+			err := c.rewrite(ctx, m, q.Filters, mods)
+			if !isConflict(err) || i == mapdoc.MaxWriteAttempts {
+				if err != nil {
+					return err
+				}
+				break
+			}
+			if m.doc, m.rev, err = c.read(ctx, m.key, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewrite applies mods to the matching document m, or deletes it if mods is
+// nil, if m still satisfies fs.
+func (c *collection) rewrite(ctx context.Context, m match, fs []driver.Filter, mods []driver.Mod) error {
+	if m.doc == nil || !eval.FiltersMatch(fs, m.doc) {
+		return nil
+	}
+	pre := precondition{ifMatch: m.rev}
+	if mods == nil {
+		return c.delete(ctx, m.key, pre, nil)
+	}
+	if err := eval.ApplyMods(m.doc, mods); err != nil {
+		return err
+	}
+	delete(m.doc, c.opts.RevisionField)
+	_, err := c.put(ctx, m.key, m.doc, pre, nil)
+	return err
+}
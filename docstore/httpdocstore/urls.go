@@ -0,0 +1,68 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpdocstore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"gocloud.dev/docstore"
+)
+
+func init() {
+	o := &URLOpener{Client: http.DefaultClient}
+	for _, scheme := range Schemes {
+		docstore.DefaultURLMux().RegisterCollection(scheme, o)
+	}
+}
+
+// Schemes are the URL schemes httpdocstore registers its URLOpener under on
+// docstore.DefaultMux.
+var Schemes = []string{"http", "https"}
+
+// URLOpener opens HTTP URLs like
+// "https://example.com/api/players?key_field=name".
+//
+// The URL without its query parameters is the base URL of the collection.
+//
+// The following query parameters are supported:
+//
+//   - key_field (required): the document field holding the primary key.
+type URLOpener struct {
+	// The Client to use. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Options specifies the options to pass to OpenCollection.
+	Options Options
+}
+
+// OpenCollectionURL opens a docstore.Collection based on u.
+func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
+	q := u.Query()
+	keyField := q.Get("key_field")
+	if keyField == "" {
+		return nil, fmt.Errorf("open collection %v: key_field is required", u)
+	}
+	q.Del("key_field")
+	for param := range q {
+		return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+	}
+	base := *u
+	base.RawQuery = ""
+	opts := o.Options
+	return OpenCollection(o.Client, base.String(), keyField, &opts)
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpdocstore
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestOpenCollectionURL(t *testing.T) {
+	o := &URLOpener{}
+	tests := []struct {
+		URL     string
+		wantErr bool
+	}{
+		// OK.
+		{"https://example.com/api/players?key_field=name", false},
+		// OK, with a trailing slash.
+		{"http://localhost:8080/players/?key_field=name", false},
+		{"https://example.com/api/players", true},                            // missing key_field
+		{"https://example.com/api/players?key_field=name&param=value", true}, // invalid parameter
+		{"ftp://example.com/api/players?key_field=name", true},               // not HTTP
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		u, err := url.Parse(test.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = o.OpenCollectionURL(ctx, u)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.wantErr)
+		}
+	}
+}
@@ -65,6 +65,7 @@ package fields
 
 import (
 	"bytes"
+	"fmt"
 	"reflect"
 	"sort"
 	"strings"
@@ -88,6 +89,29 @@ type Field struct {
 // with the field information to avoid having to parse the tag again, and an error.
 type ParseTagFunc func(reflect.StructTag) (name string, keep bool, other interface{}, err error)
 
+// An Embedding controls whether the fields of a struct-valued field are
+// promoted into the struct that contains it, as the fields of an anonymous
+// struct field are by default.
+type Embedding int
+
+const (
+	// DefaultEmbedding follows the Go rules: the fields of an anonymous struct
+	// field without a tag name are promoted.
+	DefaultEmbedding Embedding = iota
+	// Inline promotes the fields of the struct field, even if it is named. Its
+	// type must be a struct or a pointer to a struct.
+	Inline
+	// NoInline treats the struct field as a single field, even if it is
+	// anonymous.
+	NoInline
+)
+
+// EmbeddingTag can be implemented by the additional data returned by a
+// ParseTagFunc to choose the Embedding of a field.
+type EmbeddingTag interface {
+	Embedding() Embedding
+}
+
 // ValidateFunc is a function that accepts a reflect.Type and returns an error if the struct type is invalid in any
 // way.
 type ValidateFunc func(reflect.Type) error
@@ -325,23 +349,31 @@ func (c *Cache) listFields(t reflect.Type) ([]Field, error) {
 				if !keep {
 					continue
 				}
-				if c.leafTypes(f.Type) {
+				embedding := DefaultEmbedding
+				if et, ok := other.(EmbeddingTag); ok {
+					embedding = et.Embedding()
+				}
+				if c.leafTypes(f.Type) && embedding != Inline {
 					fields = append(fields, newField(f, tagName, other, scan.index, i))
 					continue
 				}
 
 				var ntyp reflect.Type
-				if f.Anonymous {
-					// Anonymous field of type T or *T.
+				if f.Anonymous || embedding == Inline {
+					// Anonymous or inlined field of type T or *T.
 					ntyp = f.Type
 					if ntyp.Kind() == reflect.Ptr {
 						ntyp = ntyp.Elem()
 					}
 				}
+				if embedding == Inline && ntyp.Kind() != reflect.Struct {
+					return nil, fmt.Errorf("fields: inlined field %s of %s has type %s, which is not a struct", f.Name, t, f.Type)
+				}
 
-				// Record fields with a tag name, non-anonymous fields, or
-				// anonymous non-struct fields.
-				if tagName != "" || ntyp == nil || ntyp.Kind() != reflect.Struct {
+				// Record fields with a tag name, non-anonymous fields,
+				// anonymous non-struct fields, and fields that are not
+				// inlined, unless they are forced to be.
+				if embedding == NoInline || (embedding == DefaultEmbedding && (tagName != "" || ntyp == nil || ntyp.Kind() != reflect.Struct)) {
 					if !exported {
 						continue
 					}
@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 type embed1 struct {
@@ -377,6 +378,66 @@ func TestParsedTag(t *testing.T) {
 	}
 }
 
+// embeddingTag is the parsed tag of embeddingTagParser.
+type embeddingTag Embedding
+
+func (e embeddingTag) Embedding() Embedding { return Embedding(e) }
+
+// embeddingTagParser parses json tags, with the options "inline" and
+// "noinline".
+func embeddingTagParser(t reflect.StructTag) (name string, keep bool, other interface{}, err error) {
+	n, k, opts := ParseStandardTag("json", t)
+	e := DefaultEmbedding
+	for _, o := range opts {
+		switch o {
+		case "inline":
+			e = Inline
+		case "noinline":
+			e = NoInline
+		}
+	}
+	return n, k, embeddingTag(e), nil
+}
+
+func TestEmbeddingTag(t *testing.T) {
+	type Inner struct{ A, B int }
+	type S struct {
+		Inner `json:",noinline"`
+		N     Inner  `json:",inline"`
+		P     *Embed `json:",inline"`
+		C     int
+	}
+	got, err := NewCache(embeddingTagParser, nil, nil).Fields(reflect.TypeOf(S{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type nameIndex struct {
+		Name  string
+		Index []int
+	}
+	var gotNames []nameIndex
+	for _, f := range got {
+		gotNames = append(gotNames, nameIndex{f.Name, f.Index})
+	}
+	want := []nameIndex{
+		{"A", []int{1, 0}},
+		{"B", []int{1, 1}},
+		{"C", []int{3}},
+		{"Inner", []int{0}},
+		{"Em", []int{2, 0}},
+	}
+	if diff := cmp.Diff(gotNames, want, cmpopts.SortSlices(func(a, b nameIndex) bool { return a.Name < b.Name })); diff != "" {
+		t.Errorf("got=-, want=+:\n%s", diff)
+	}
+
+	type Bad struct {
+		X int `json:",inline"`
+	}
+	if _, err := NewCache(embeddingTagParser, nil, nil).Fields(reflect.TypeOf(Bad{})); err == nil {
+		t.Error("inlining an int: got nil, want error")
+	}
+}
+
 func TestValidateFunc(t *testing.T) {
 	type MyInvalidStruct struct {
 		A string
@@ -12,18 +12,81 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package memdocstore
+// Package gobcodec encodes documents for memdocstore and for the docstore
+// drivers that store them as opaque bytes.
+//
+// Documents are encoded as maps holding nil, bool, int64, float64, string,
+// []byte, time.Time, []interface{} and map[string]interface{} values. Marshal
+// and MarshalValue store them in the gob encoding, which preserves those types.
+package gobcodec // import "gocloud.dev/docstore/internal/gobcodec"
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"gocloud.dev/docstore/driver"
+	"gocloud.dev/internal/gcerr"
 )
 
-// encodeDoc encodes a driver.Document as a map[string]interface{}.
-func encodeDoc(doc driver.Document) (map[string]interface{}, error) {
+func init() {
+	// gob knows the other types already.
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+}
+
+// Marshal returns the gob encoding of the encoded document doc.
+func Marshal(doc map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a document stored by Marshal. It does not retain b.
+func Unmarshal(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		// gob does not transmit empty maps.
+		doc = map[string]interface{}{}
+	}
+	return doc, nil
+}
+
+// A cell wraps a value so that gob records its type.
+type cell struct {
+	V interface{}
+}
+
+// MarshalValue returns the gob encoding of the encoded value v, which may be a
+// field of a document.
+func MarshalValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cell{v}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalValue decodes a value stored by MarshalValue. It does not retain b.
+func UnmarshalValue(b []byte) (interface{}, error) {
+	var c cell
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&c); err != nil {
+		return nil, err
+	}
+	return c.V, nil
+}
+
+// EncodeDoc encodes a driver.Document as a map[string]interface{}.
+func EncodeDoc(doc driver.Document) (map[string]interface{}, error) {
 	var e encoder
 	if err := doc.Encode(&e); err != nil {
 		return nil, err
@@ -31,7 +94,8 @@ func encodeDoc(doc driver.Document) (map[string]interface{}, error) {
 	return e.val.(map[string]interface{}), nil
 }
 
-func encodeValue(v interface{}) (interface{}, error) {
+// EncodeValue encodes v as it would be stored in a document.
+func EncodeValue(v interface{}) (interface{}, error) {
 	var e encoder
 	if err := driver.Encode(reflect.ValueOf(v), &e); err != nil {
 		return nil, err
@@ -92,8 +156,9 @@ func (e *mapEncoder) MapKey(k string) { e.m[k] = e.val }
 
 ////////////////////////////////////////////////////////////////
 
-// decodeDoc decodes m into ddoc.
-func decodeDoc(m map[string]interface{}, ddoc driver.Document, fps [][]string, revField string) error {
+// DecodeDoc decodes m into ddoc. If fps is non-empty, only those field paths
+// and the revision field are decoded.
+func DecodeDoc(m map[string]interface{}, ddoc driver.Document, fps [][]string, revField string) error {
 	var m2 map[string]interface{}
 	if len(fps) == 0 {
 		m2 = m
@@ -102,18 +167,48 @@ func decodeDoc(m map[string]interface{}, ddoc driver.Document, fps [][]string, r
 		// (We don't need the key field because ddoc must already have it.)
 		m2 = map[string]interface{}{revField: m[revField]}
 		for _, fp := range fps {
-			val, err := getAtFieldPath(m, fp)
+			parent, err := getParentMap(m, fp, false)
 			if err != nil {
 				return err
 			}
-			if err := setAtFieldPath(m2, fp, val); err != nil {
+			val, ok := parent[fp[len(fp)-1]]
+			if !ok {
+				// Leave fields that are missing from the document, like
+				// omitempty fields, missing from the result.
+				continue
+			}
+			parent, err = getParentMap(m2, fp, true)
+			if err != nil {
 				return err
 			}
+			parent[fp[len(fp)-1]] = val
 		}
 	}
 	return ddoc.Decode(decoder{m2})
 }
 
+// getParentMap returns the map that directly contains the given field path;
+// that is, the value of m at the field path that excludes the last component
+// of fp. If a non-map is encountered along the way, an InvalidArgument error is
+// returned. If nil is encountered, nil is returned unless create is true, in
+// which case a map is added at that point.
+func getParentMap(m map[string]interface{}, fp []string, create bool) (map[string]interface{}, error) {
+	var ok bool
+	for _, k := range fp[:len(fp)-1] {
+		if m[k] == nil {
+			if !create {
+				return nil, nil
+			}
+			m[k] = map[string]interface{}{}
+		}
+		m, ok = m[k].(map[string]interface{})
+		if !ok {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "invalid field path %q at %q", strings.Join(fp, "."), k)
+		}
+	}
+	return m, nil
+}
+
 type decoder struct {
 	val interface{}
 }
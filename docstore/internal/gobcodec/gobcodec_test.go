@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package memdocstore
+package gobcodec
 
 import (
 	"testing"
@@ -20,6 +20,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/gcerrors"
 )
 
 type aStruct struct {
@@ -86,7 +87,7 @@ func TestEncodeDoc(t *testing.T) {
 		},
 	} {
 		doc := drivertest.MustDocument(test.in)
-		got, err := encodeDoc(doc)
+		got, err := EncodeDoc(doc)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -149,7 +150,7 @@ func TestDecodeDoc(t *testing.T) {
 	} {
 		got := test.val
 		doc := drivertest.MustDocument(test.val)
-		if err := decodeDoc(test.in, doc, nil, ""); err != nil {
+		if err := DecodeDoc(test.in, doc, nil, ""); err != nil {
 			t.Fatal(err)
 		}
 		if diff := cmp.Diff(got, test.want, cmp.AllowUnexported(aStruct{})); diff != "" {
@@ -157,3 +158,71 @@ func TestDecodeDoc(t *testing.T) {
 		}
 	}
 }
+
+func TestMarshal(t *testing.T) {
+	tm := time.Date(2019, 7, 4, 12, 0, 0, 5, time.UTC)
+	doc := map[string]interface{}{
+		"n": nil,
+		"b": true,
+		"i": int64(-3),
+		"f": 2.5,
+		"s": "x",
+		"y": []byte("abc"),
+		"t": tm,
+		"l": []interface{}{int64(1), "a"},
+		"m": map[string]interface{}{"k": int64(2)},
+	}
+	b, err := Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, doc); diff != "" {
+		t.Errorf("Marshal (got=-, want=+):\n%s", diff)
+	}
+
+	for _, v := range doc {
+		b, err := MarshalValue(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := UnmarshalValue(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(got, v); diff != "" {
+			t.Errorf("MarshalValue(%v) (got=-, want=+):\n%s", v, diff)
+		}
+	}
+}
+
+func TestDecodeDocFieldPaths(t *testing.T) {
+	m := map[string]interface{}{
+		"a":   int64(1),
+		"b":   map[string]interface{}{"c": "x", "d": "y"},
+		"s":   "str",
+		"rev": "r",
+	}
+	got := map[string]interface{}{}
+	fps := [][]string{{"a"}, {"b", "c"}, {"missing"}, {"b", "missing"}}
+	if err := DecodeDoc(m, drivertest.MustDocument(got), fps, "rev"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"a":   int64(1),
+		"b":   map[string]interface{}{"c": "x"},
+		"rev": "r",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("got=-, want=+:\n%s", diff)
+	}
+
+	// A field path through a value that is not a map is invalid.
+	err := DecodeDoc(m, drivertest.MustDocument(map[string]interface{}{}), [][]string{{"s", "x"}}, "rev")
+	if gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsoncodec encodes documents for the docstore drivers that store them
+// as JSON.
+//
+// Documents are encoded as trees of the Go values that encoding/json marshals
+// to JSON objects, arrays, strings, numbers, booleans and null. Times are
+// encoded as strings in UTC. Documents are decoded from JSON with
+// json.Decoder.UseNumber, so numbers are json.Numbers.
+package jsoncodec // import "gocloud.dev/docstore/internal/jsoncodec"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+)
+
+// TimeLayout is time.RFC3339Nano, but with trailing zeroes kept, so that times
+// in UTC sort in time order as strings.
+const TimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// A Codec encodes and decodes documents. The zero value encodes a []byte as
+// the base64 string that encoding/json produces for it, which decodes as a
+// string into an interface{}.
+type Codec struct {
+	// Binary encodes a []byte as an object whose only field, "$binary", is the
+	// base64 encoding of the bytes, since JSON has no binary type. Such an
+	// object is decoded as a []byte, even into an interface{}.
+	Binary bool
+}
+
+// binaryField is the field of the JSON object that holds a []byte.
+const binaryField = "$binary"
+
+// A binary is an encoded []byte.
+type binary []byte
+
+func (b binary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]byte{binaryField: b})
+}
+
+// asBinary returns the bytes of v, if c encodes binaries and v is an object
+// read from JSON that holds a []byte.
+func (c Codec) asBinary(v interface{}) ([]byte, bool) {
+	if !c.Binary {
+		return nil, false
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return nil, false
+	}
+	s, ok := m[binaryField].(string)
+	if !ok {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return b, err == nil
+}
+
+// EncodeDoc encodes a driver.Document as a map[string]interface{}.
+func (c Codec) EncodeDoc(doc driver.Document) (map[string]interface{}, error) {
+	e := encoder{c: c}
+	if err := doc.Encode(&e); err != nil {
+		return nil, err
+	}
+	return e.val.(map[string]interface{}), nil
+}
+
+// EncodeValue encodes v as it would be stored in a document.
+func (c Codec) EncodeValue(v interface{}) (interface{}, error) {
+	e := encoder{c: c}
+	if err := driver.Encode(reflect.ValueOf(v), &e); err != nil {
+		return nil, err
+	}
+	return e.val, nil
+}
+
+// Marshal returns the JSON encoding of the encoded document or value v.
+func Marshal(v interface{}) ([]byte, error) {
+	// Only non-finite floats fail to marshal.
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON in b.
+func Unmarshal(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type encoder struct {
+	c   Codec
+	val interface{}
+}
+
+func (e *encoder) EncodeNil()            { e.val = nil }
+func (e *encoder) EncodeBool(x bool)     { e.val = x }
+func (e *encoder) EncodeInt(x int64)     { e.val = x }
+func (e *encoder) EncodeUint(x uint64)   { e.val = x }
+func (e *encoder) EncodeFloat(x float64) { e.val = x }
+func (e *encoder) EncodeString(x string) { e.val = x }
+func (e *encoder) ListIndex(int)         { panic("impossible") }
+func (e *encoder) MapKey(string)         { panic("impossible") }
+
+func (e *encoder) EncodeBytes(x []byte) {
+	if e.c.Binary {
+		e.val = binary(x)
+	} else {
+		e.val = x // encoding/json uses base64
+	}
+}
+
+var typeOfGoTime = reflect.TypeOf(time.Time{})
+
+// EncodeSpecial encodes time.Time as a string in UTC.
+func (e *encoder) EncodeSpecial(v reflect.Value) (bool, error) {
+	if v.Type() == typeOfGoTime {
+		e.val = v.Interface().(time.Time).UTC().Format(TimeLayout)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (e *encoder) EncodeList(n int) driver.Encoder {
+	s := make([]interface{}, n)
+	e.val = s
+	return &listEncoder{s: s, encoder: encoder{c: e.c}}
+}
+
+type listEncoder struct {
+	s []interface{}
+	encoder
+}
+
+func (e *listEncoder) ListIndex(i int) { e.s[i] = e.val }
+
+type mapEncoder struct {
+	m map[string]interface{}
+	encoder
+}
+
+func (e *encoder) EncodeMap(n int) driver.Encoder {
+	m := make(map[string]interface{}, n)
+	e.val = m
+	return &mapEncoder{m: m, encoder: encoder{c: e.c}}
+}
+
+func (e *mapEncoder) MapKey(k string) { e.m[k] = e.val }
+
+////////////////////////////////////////////////////////////////
+
+// DecodeDoc decodes m, a document read from the provider, into ddoc. If fps is
+// non-empty, only those field paths and the revision field are decoded.
+func (c Codec) DecodeDoc(m map[string]interface{}, ddoc driver.Document, fps [][]string, revField string) error {
+	var m2 map[string]interface{}
+	if len(fps) == 0 {
+		m2 = m
+	} else {
+		m2 = map[string]interface{}{revField: m[revField]}
+		for _, fp := range fps {
+			val, ok := mapdoc.GetAtFieldPath(m, fp)
+			if !ok {
+				continue
+			}
+			if err := setAtFieldPath(m2, fp, val); err != nil {
+				return err
+			}
+		}
+	}
+	return ddoc.Decode(decoder{c, m2})
+}
+
+// setAtFieldPath sets m's value at fp to val, creating intermediate maps as
+// needed.
+func setAtFieldPath(m map[string]interface{}, fp []string, val interface{}) error {
+	for i, k := range fp[:len(fp)-1] {
+		if m[k] == nil {
+			m[k] = map[string]interface{}{}
+		}
+		var ok bool
+		if m, ok = m[k].(map[string]interface{}); !ok {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "invalid field path %q at %q", strings.Join(fp, "."), fp[i])
+		}
+	}
+	m[fp[len(fp)-1]] = val
+	return nil
+}
+
+type decoder struct {
+	c   Codec
+	val interface{}
+}
+
+func (d decoder) String() string {
+	return fmt.Sprint(d.val)
+}
+
+func (d decoder) AsNull() bool {
+	return d.val == nil
+}
+
+func (d decoder) AsBool() (bool, bool) {
+	b, ok := d.val.(bool)
+	return b, ok
+}
+
+func (d decoder) AsString() (string, bool) {
+	s, ok := d.val.(string)
+	return s, ok
+}
+
+func (d decoder) AsInt() (int64, bool) {
+	n, ok := d.val.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return i, err == nil
+}
+
+func (d decoder) AsUint() (uint64, bool) {
+	n, ok := d.val.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	u, err := strconv.ParseUint(string(n), 10, 64)
+	return u, err == nil
+}
+
+func (d decoder) AsFloat() (float64, bool) {
+	n, ok := d.val.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// AsBytes decodes a binary, or the base64 string that encoding/json produces
+// for a []byte.
+func (d decoder) AsBytes() ([]byte, bool) {
+	if b, ok := d.c.asBinary(d.val); ok {
+		return b, true
+	}
+	s, ok := d.val.(string)
+	if !ok {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return b, err == nil
+}
+
+// AsInterface decodes as ToGo does.
+func (d decoder) AsInterface() (interface{}, error) {
+	return d.c.ToGo(d.val), nil
+}
+
+// ToGo converts v, a value read from JSON, to the value that decoding it into
+// an interface{} produces. Numbers become int64s if they are integers that
+// fit, and float64s otherwise. Binaries become []bytes; times and other byte
+// slices remain strings.
+func (c Codec) ToGo(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = c.ToGo(e)
+		}
+		return s
+	case map[string]interface{}:
+		if b, ok := c.asBinary(v); ok {
+			return b
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = c.ToGo(e)
+		}
+		return m
+	default:
+		return v
+	}
+}
+
+func (d decoder) ListLen() (int, bool) {
+	if s, ok := d.val.([]interface{}); ok {
+		return len(s), true
+	}
+	return 0, false
+}
+
+func (d decoder) DecodeList(f func(i int, d2 driver.Decoder) bool) {
+	for i, e := range d.val.([]interface{}) {
+		if !f(i, decoder{d.c, e}) {
+			return
+		}
+	}
+}
+
+func (d decoder) MapLen() (int, bool) {
+	if _, ok := d.c.asBinary(d.val); ok {
+		return 0, false
+	}
+	if m, ok := d.val.(map[string]interface{}); ok {
+		return len(m), true
+	}
+	return 0, false
+}
+
+func (d decoder) DecodeMap(f func(key string, d2 driver.Decoder) bool) {
+	for k, v := range d.val.(map[string]interface{}) {
+		if !f(k, decoder{d.c, v}) {
+			return
+		}
+	}
+}
+
+func (d decoder) AsSpecial(v reflect.Value) (bool, interface{}, error) {
+	if v.Type() == typeOfGoTime {
+		s, ok := d.val.(string)
+		if !ok {
+			return true, nil, fmt.Errorf("expected string field for time.Time, got %T", d.val)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return true, t, err
+	}
+	return false, nil, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsoncodec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore/drivertest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	type doc struct {
+		S    string
+		I    int
+		U    uint64
+		F    float64
+		B    []byte
+		T    time.Time
+		L    []int
+		M    map[string]bool
+		Rev  interface{}
+		Skip string
+	}
+	in := &doc{
+		S:    "x",
+		I:    -3,
+		U:    1 << 63,
+		F:    2.5,
+		B:    []byte("bytes"),
+		T:    time.Date(2019, 7, 4, 12, 0, 0, 5, time.UTC),
+		L:    []int{1, 2},
+		M:    map[string]bool{"a": true},
+		Rev:  "r",
+		Skip: "skipped",
+	}
+	for _, c := range []Codec{{}, {Binary: true}} {
+		m, err := c.EncodeDoc(drivertest.MustDocument(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &doc{}
+		fps := [][]string{{"S"}, {"I"}, {"U"}, {"F"}, {"B"}, {"T"}, {"L"}, {"M"}}
+		if err := c.DecodeDoc(v.(map[string]interface{}), drivertest.MustDocument(got), fps, "Rev"); err != nil {
+			t.Fatal(err)
+		}
+		want := *in
+		want.Skip = ""
+		if diff := cmp.Diff(got, &want); diff != "" {
+			t.Errorf("Binary=%t: got=-, want=+:\n%s", c.Binary, diff)
+		}
+
+		// Decoding into a map produces bytes only from binaries.
+		gotMap := map[string]interface{}{}
+		if err := c.DecodeDoc(v.(map[string]interface{}), drivertest.MustDocument(gotMap), [][]string{{"B"}}, "Rev"); err != nil {
+			t.Fatal(err)
+		}
+		var wantB interface{} = "Ynl0ZXM="
+		if c.Binary {
+			wantB = []byte("bytes")
+		}
+		if diff := cmp.Diff(gotMap, map[string]interface{}{"B": wantB, "Rev": "r"}); diff != "" {
+			t.Errorf("Binary=%t: got=-, want=+:\n%s", c.Binary, diff)
+		}
+	}
+}
+
+func TestTimeLayout(t *testing.T) {
+	// Times in UTC sort in time order as strings.
+	t1 := time.Date(2019, 7, 4, 12, 0, 0, 1, time.UTC).Format(TimeLayout)
+	t2 := time.Date(2019, 7, 4, 12, 0, 1, 0, time.UTC).Format(TimeLayout)
+	if t1 >= t2 {
+		t.Errorf("%q sorts after %q", t1, t2)
+	}
+}
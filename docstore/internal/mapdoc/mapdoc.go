@@ -0,0 +1,306 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mapdoc evaluates filters and sort orders on encoded documents held
+// as maps, for the docstore drivers that run some or all of a query locally.
+// It also applies modifications to such documents, and runs actions
+// concurrently, for the drivers that implement updates by reading a document,
+// changing it and writing it back.
+package mapdoc // import "gocloud.dev/docstore/internal/mapdoc"
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/internal/gcerr"
+)
+
+// MaxWriteAttempts is the number of times a driver attempts a write that must
+// not overwrite concurrent changes to the document before giving up because
+// the document keeps changing.
+const MaxWriteAttempts = 10
+
+// GetAtFieldPath returns the value of m at fp, and whether there is one. It
+// returns false if a component of fp other than the last is missing or is not
+// a map.
+func GetAtFieldPath(m map[string]interface{}, fp []string) (interface{}, bool) {
+	for _, k := range fp[:len(fp)-1] {
+		var ok bool
+		if m, ok = m[k].(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	v, ok := m[fp[len(fp)-1]]
+	return v, ok
+}
+
+// An Evaluator evaluates filters and sort orders on documents in the encoding
+// of a driver. The zero value compares document values and filter values as
+// they are.
+type Evaluator struct {
+	// ToGo, if non-nil, converts a value of a document to the value that
+	// driver.CompareValues and driver.MatchString expect, for encodings like
+	// JSON in which numbers are not Go numbers.
+	ToGo func(interface{}) interface{}
+
+	// EncodeValue, if non-nil, encodes a filter value as it would be stored in
+	// a document, so that, for instance, a time.Time compares with the string
+	// that a time is stored as. ApplyMods also uses it to encode the values
+	// of modifications.
+	EncodeValue func(interface{}) (interface{}, error)
+}
+
+func (e Evaluator) encodeValue(v interface{}) (interface{}, error) {
+	if e.EncodeValue == nil {
+		return v, nil
+	}
+	return e.EncodeValue(v)
+}
+
+func (e Evaluator) toGo(v interface{}) interface{} {
+	if e.ToGo == nil {
+		return v
+	}
+	return e.ToGo(v)
+}
+
+// FiltersMatch reports whether doc satisfies all of fs.
+func (e Evaluator) FiltersMatch(fs []driver.Filter, doc map[string]interface{}) bool {
+	for _, f := range fs {
+		if !e.filterMatches(f, doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e Evaluator) filterMatches(f driver.Filter, doc map[string]interface{}) bool {
+	docval, ok := GetAtFieldPath(doc, f.FieldPath)
+	switch f.Op {
+	case driver.ExistsOp:
+		return ok
+	case driver.NotExistsOp:
+		return !ok
+	}
+	// missing or bad field path => no match
+	if !ok {
+		return false
+	}
+	docval = e.toGo(docval)
+	if driver.IsStringOp(f.Op) {
+		return driver.MatchString(f.Op, docval, f.Value)
+	}
+	fval := f.Value
+	if e.EncodeValue != nil {
+		var err error
+		if fval, err = e.EncodeValue(fval); err != nil {
+			return false
+		}
+	}
+	c, ok := driver.CompareValues(docval, fval)
+	if !ok {
+		return false
+	}
+	return driver.ApplyComparison(f.Op, c)
+}
+
+// ApplyMods applies mods to doc, an encoded document. It may modify doc even if
+// it fails, so doc must not be written in that case.
+func (e Evaluator) ApplyMods(doc map[string]interface{}, mods []driver.Mod) error {
+	for _, mod := range mods {
+		parent, err := GetParentMap(doc, mod.FieldPath, true)
+		if err != nil {
+			return err
+		}
+		key := mod.FieldPath[len(mod.FieldPath)-1]
+		switch v := mod.Value.(type) {
+		case nil:
+			delete(parent, key)
+		case driver.IncOp:
+			amt, err := e.encodeValue(v.Amount)
+			if err != nil {
+				return err
+			}
+			if parent[key], err = e.add(parent[key], amt); err != nil {
+				return err
+			}
+		default:
+			if parent[key], err = e.encodeValue(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add adds the encoded number y to x, a number of a document. Integers stay
+// integers unless either operand is a float.
+func (e Evaluator) add(x, y interface{}) (interface{}, error) {
+	if x == nil {
+		return y, nil
+	}
+	var xf float64
+	switch x := e.toGo(x).(type) {
+	case int64:
+		switch y := y.(type) {
+		case int64:
+			return x + y, nil
+		case uint64:
+			return x + int64(y), nil
+		}
+		xf = float64(x)
+	case float64:
+		xf = x
+	default:
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "value %v being incremented is not a number", x)
+	}
+	switch y := y.(type) {
+	case int64:
+		return xf + float64(y), nil
+	case uint64:
+		return xf + float64(y), nil
+	case float64:
+		return xf + y, nil
+	default:
+		// This shouldn't happen because it should be checked by docstore.
+		return nil, gcerr.Newf(gcerr.Internal, nil, "bad increment amount type %T", y)
+	}
+}
+
+// GetParentMap returns the map that directly contains the given field path;
+// that is, the value of m at the field path that excludes the last component
+// of fp. If a non-map is encountered along the way, an InvalidArgument error is
+// returned. If nil is encountered, nil is returned unless create is true, in
+// which case a map is added at that point.
+func GetParentMap(m map[string]interface{}, fp []string, create bool) (map[string]interface{}, error) {
+	var ok bool
+	for _, k := range fp[:len(fp)-1] {
+		if m[k] == nil {
+			if !create {
+				return nil, nil
+			}
+			m[k] = map[string]interface{}{}
+		}
+		m, ok = m[k].(map[string]interface{})
+		if !ok {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "invalid field path %q at %q", strings.Join(fp, "."), k)
+		}
+	}
+	return m, nil
+}
+
+// RunConcurrently calls run on each of actions, each on its own goroutine, with
+// at most max calls in progress at once if max is positive, and stores the
+// error of each call in errs at the index of its action. If opts.FailFast is
+// true, it starts no more calls once errs holds an error, including one stored
+// before RunConcurrently was called, and reports the actions it did not start
+// as not attempted.
+func RunConcurrently(actions []*driver.Action, errs []error, max int, opts *driver.RunActionsOptions, run func(*driver.Action) error) {
+	var (
+		mu     sync.Mutex
+		failed = driver.ShouldStop(opts, errs)
+	)
+	t := driver.NewThrottle(max)
+	for i, a := range actions {
+		a := a
+		t.Acquire()
+		mu.Lock()
+		stop := opts.FailFast && failed
+		mu.Unlock()
+		if stop {
+			t.Release()
+			t.Wait()
+			driver.SkipActions(actions[i:], errs)
+			return
+		}
+		go func() {
+			defer t.Release()
+			err := run(a)
+			errs[a.Index] = err
+			if err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}()
+	}
+	t.Wait()
+}
+
+// A SortKey is a field path to sort documents by.
+type SortKey struct {
+	FieldPath  []string
+	Descending bool
+}
+
+// SortDocs sorts docs by the value at fp, in ascending order if asc is true
+// and in descending order otherwise. It is SortDocsByKeys with a single key.
+func (e Evaluator) SortDocs(docs []map[string]interface{}, fp []string, asc bool) {
+	e.SortDocsByKeys(docs, []SortKey{{FieldPath: fp, Descending: !asc}})
+}
+
+// SortDocsByKeys sorts docs by keys. A document that is missing a key's field
+// sorts after those that have it, in either direction. Documents whose values
+// cannot otherwise be compared keep their relative order.
+func (e Evaluator) SortDocsByKeys(docs []map[string]interface{}, keys []SortKey) {
+	vals := make([][]interface{}, len(docs))
+	for i, doc := range docs {
+		vals[i] = make([]interface{}, len(keys))
+		for j, k := range keys {
+			v, _ := GetAtFieldPath(doc, k.FieldPath)
+			vals[i][j] = e.toGo(v)
+		}
+	}
+	idx := make([]int, len(docs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		vi, vj := vals[idx[i]], vals[idx[j]]
+		for k, key := range keys {
+			if c := compareSortValues(vi[k], vj[k], key.Descending); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	sorted := make([]map[string]interface{}, len(docs))
+	for i, k := range idx {
+		sorted[i] = docs[k]
+	}
+	copy(docs, sorted)
+}
+
+// compareSortValues compares two values of a sort key, reversing the order of
+// values other than nil if desc is true.
+func compareSortValues(v1, v2 interface{}, desc bool) int {
+	switch {
+	case v1 == nil && v2 == nil:
+		return 0
+	case v1 == nil:
+		return 1
+	case v2 == nil:
+		return -1
+	}
+	c, ok := driver.CompareValues(v1, v2)
+	if !ok {
+		return 0
+	}
+	if desc {
+		return -c
+	}
+	return c
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapdoc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/gcerrors"
+)
+
+func TestFiltersMatch(t *testing.T) {
+	doc := map[string]interface{}{
+		"n":   int64(3),
+		"s":   "Hello",
+		"nil": nil,
+		"m":   map[string]interface{}{"x": int64(1)},
+	}
+	for _, test := range []struct {
+		fp   string
+		op   string
+		val  interface{}
+		want bool
+	}{
+		{"n", "=", 3, true},
+		{"n", ">", 3, false},
+		{"n", "<=", uint(3), true},
+		{"s", "<", "World", true},
+		{"s", driver.HasPrefixFoldOp, "he", true},
+		{"m.x", "=", 1, true},
+		{"m.y", "=", 1, false},
+		{"n.x", "=", 1, false}, // not a map
+		{"missing", ">", 0, false},
+		{"nil", driver.ExistsOp, nil, true},
+		{"m.x", driver.ExistsOp, nil, true},
+		{"m.y", driver.ExistsOp, nil, false},
+		{"missing", driver.NotExistsOp, nil, true},
+		{"s", driver.NotExistsOp, nil, false},
+	} {
+		f := driver.Filter{FieldPath: strings.Split(test.fp, "."), Op: test.op, Value: test.val}
+		if got := (Evaluator{}).FiltersMatch([]driver.Filter{f}, doc); got != test.want {
+			t.Errorf("%s %s %v: got %t, want %t", test.fp, test.op, test.val, got, test.want)
+		}
+	}
+}
+
+func TestEvaluatorHooks(t *testing.T) {
+	// Values are stored as strings, and filter values are encoded the same way.
+	e := Evaluator{
+		ToGo:        func(v interface{}) interface{} { return fmt.Sprintf("<%v>", v) },
+		EncodeValue: func(v interface{}) (interface{}, error) { return fmt.Sprintf("<%v>", v), nil },
+	}
+	doc := map[string]interface{}{"a": 2}
+	if !e.FiltersMatch([]driver.Filter{{FieldPath: []string{"a"}, Op: "=", Value: 2}}, doc) {
+		t.Error("encoded values do not match")
+	}
+	if e.FiltersMatch([]driver.Filter{{FieldPath: []string{"a"}, Op: "=", Value: 3}}, doc) {
+		t.Error("different encoded values match")
+	}
+	// String filters compare with the converted value, without encoding.
+	if !e.FiltersMatch([]driver.Filter{{FieldPath: []string{"a"}, Op: driver.HasPrefixOp, Value: "<2"}}, doc) {
+		t.Error("prefix does not match the converted value")
+	}
+}
+
+func TestSortDocs(t *testing.T) {
+	docs := func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{"id": 1, "a": int64(2)},
+			{"id": 2},
+			{"id": 3, "a": int64(1), "b": map[string]interface{}{"c": "y"}},
+			{"id": 4, "a": int64(2), "b": map[string]interface{}{"c": "x"}},
+		}
+	}
+	ids := func(docs []map[string]interface{}) []int {
+		var ids []int
+		for _, d := range docs {
+			ids = append(ids, d["id"].(int))
+		}
+		return ids
+	}
+	for _, test := range []struct {
+		keys []SortKey
+		want []int
+	}{
+		// Missing values sort last in either direction, and ties keep their order.
+		{[]SortKey{{FieldPath: []string{"a"}}}, []int{3, 1, 4, 2}},
+		{[]SortKey{{FieldPath: []string{"a"}, Descending: true}}, []int{1, 4, 3, 2}},
+		{[]SortKey{{FieldPath: []string{"b", "c"}}}, []int{4, 3, 1, 2}},
+		{[]SortKey{{FieldPath: []string{"a"}}, {FieldPath: []string{"b", "c"}}}, []int{3, 4, 1, 2}},
+	} {
+		d := docs()
+		(Evaluator{}).SortDocsByKeys(d, test.keys)
+		if diff := cmp.Diff(ids(d), test.want); diff != "" {
+			t.Errorf("%v: got=-, want=+:\n%s", test.keys, diff)
+		}
+	}
+
+	d := docs()
+	(Evaluator{}).SortDocs(d, []string{"a"}, false)
+	if diff := cmp.Diff(ids(d), []int{1, 4, 3, 2}); diff != "" {
+		t.Errorf("SortDocs: got=-, want=+:\n%s", diff)
+	}
+}
+
+func TestApplyMods(t *testing.T) {
+	mods := []driver.Mod{
+		{FieldPath: []string{"n"}, Value: driver.IncOp{Amount: int64(2)}},
+		{FieldPath: []string{"f"}, Value: driver.IncOp{Amount: int64(1)}},
+		{FieldPath: []string{"new"}, Value: driver.IncOp{Amount: 0.5}},
+		{FieldPath: []string{"m", "z"}, Value: "w"},
+		{FieldPath: []string{"a", "b"}, Value: "c"},
+		{FieldPath: []string{"gone"}, Value: nil},
+	}
+	want := map[string]interface{}{
+		"n":   int64(3),
+		"f":   2.5,
+		"new": 0.5,
+		"m":   map[string]interface{}{"x": "y", "z": "w"},
+		"a":   map[string]interface{}{"b": "c"},
+	}
+
+	doc := map[string]interface{}{"n": int64(1), "f": 1.5, "m": map[string]interface{}{"x": "y"}, "gone": true}
+	if err := (Evaluator{}).ApplyMods(doc, mods); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(doc, want); diff != "" {
+		t.Error(diff)
+	}
+
+	// Numbers that are not Go numbers are converted before they are incremented.
+	e := Evaluator{ToGo: func(v interface{}) interface{} {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				return i
+			}
+			f, _ := n.Float64()
+			return f
+		}
+		return v
+	}}
+	doc = map[string]interface{}{"n": json.Number("1"), "f": json.Number("1.5"), "m": map[string]interface{}{"x": "y"}, "gone": true}
+	if err := e.ApplyMods(doc, mods); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(doc, want); diff != "" {
+		t.Error(diff)
+	}
+
+	// Values are encoded.
+	e = Evaluator{EncodeValue: func(v interface{}) (interface{}, error) { return fmt.Sprintf("<%v>", v), nil }}
+	doc = map[string]interface{}{}
+	if err := e.ApplyMods(doc, []driver.Mod{{FieldPath: []string{"a"}, Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := doc["a"]; got != "<1>" {
+		t.Errorf("got %v, want the encoded value", got)
+	}
+
+	for _, mod := range []driver.Mod{
+		{FieldPath: []string{"s"}, Value: driver.IncOp{Amount: int64(1)}}, // not a number
+		{FieldPath: []string{"s", "x"}, Value: 1},                         // not a map
+	} {
+		doc := map[string]interface{}{"s": "str"}
+		if err := (Evaluator{}).ApplyMods(doc, []driver.Mod{mod}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", mod, err)
+		}
+	}
+}
+
+func TestRunConcurrently(t *testing.T) {
+	newActions := func(n int) ([]*driver.Action, []error) {
+		var as []*driver.Action
+		for i := 0; i < n; i++ {
+			as = append(as, &driver.Action{Index: i})
+		}
+		return as, make([]error, n)
+	}
+	errFail := errors.New("fail")
+
+	// Without FailFast, every action runs, and at most max at once.
+	as, errs := newActions(10)
+	var (
+		mu            sync.Mutex
+		running, most int
+	)
+	RunConcurrently(as, errs, 3, &driver.RunActionsOptions{}, func(a *driver.Action) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if a.Index%2 == 0 {
+			return errFail
+		}
+		return nil
+	})
+	for i, err := range errs {
+		if want := i%2 == 0; (err != nil) != want {
+			t.Errorf("action %d: got %v, want error %t", i, err, want)
+		}
+	}
+	if most > 3 {
+		t.Errorf("%d concurrent calls, want at most 3", most)
+	}
+
+	// With FailFast, the actions after a failure are not started.
+	as, errs = newActions(5)
+	RunConcurrently(as, errs, 1, &driver.RunActionsOptions{FailFast: true}, func(a *driver.Action) error {
+		if a.Index == 1 {
+			return errFail
+		}
+		return nil
+	})
+	want := []gcerrors.ErrorCode{gcerrors.OK, gcerrors.Unknown, gcerrors.Canceled, gcerrors.Canceled, gcerrors.Canceled}
+	for i, err := range errs {
+		if got := gcerrors.Code(err); got != want[i] {
+			t.Errorf("FailFast: action %d: got %v, want %v", i, got, want[i])
+		}
+	}
+
+	// An error from an earlier group of actions also stops them.
+	as, errs = newActions(2)
+	errs[0] = errFail
+	RunConcurrently(as[1:], errs, 0, &driver.RunActionsOptions{FailFast: true}, func(*driver.Action) error {
+		t.Error("action started after an earlier failure")
+		return nil
+	})
+	if gcerrors.Code(errs[1]) != gcerrors.Canceled {
+		t.Errorf("after earlier failure: got %v, want Canceled", errs[1])
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"gocloud.dev/docstore/driver"
+)
+
+// A KeyGenerator returns a new key for a document that is created without one.
+// It must be safe to call concurrently, and should return a different key on
+// each call.
+//
+// Providers generate keys in different ways by default: for example, MongoDB
+// uses ObjectIDs and the others use UUIDs. To generate keys the same way
+// everywhere, pass UUIDKeys, ULIDKeys or your own function to WithKeyGenerator.
+type KeyGenerator func() string
+
+// WithKeyGenerator returns a *Collection based on coll that generates the keys
+// of the documents it creates without one with gen, instead of in the
+// provider's own way. If a provider's keys are made of several fields, gen
+// generates only the field that the provider would otherwise generate.
+//
+// coll will be closed and no longer usable after this function returns.
+func WithKeyGenerator(coll *Collection, gen KeyGenerator) *Collection {
+	c := coll.derive()
+	c.keyGen = gen
+	return c
+}
+
+// UUIDKeys is a KeyGenerator that returns random (version 4) UUIDs, like
+// "7fd3c2a5-3c35-4b6e-9a1f-5b0d8d7e3e21".
+func UUIDKeys() string { return driver.UniqueString() }
+
+// ULIDKeys is a KeyGenerator that returns ULIDs (see https://github.com/ulid/spec),
+// like "01DJ4V2V4X3JX4Y1ZM6FS3AV1K". A ULID is 26 characters long and begins with
+// the time it was generated, so the keys generated by a process sort in the
+// order they were generated, and keys from different processes sort roughly by
+// time.
+func ULIDKeys() string { return ulids.next(time.Now()) }
+
+// ulids is the state of ULIDKeys.
+var ulids ulidGenerator
+
+// A ulidGenerator generates monotonic ULIDs: within a millisecond, it increments
+// the random part of the previous ULID instead of choosing a new one.
+type ulidGenerator struct {
+	mu   sync.Mutex
+	ms   uint64   // the timestamp of the last ULID
+	rand [10]byte // the random part of the last ULID
+}
+
+func (g *ulidGenerator) next(t time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	if ms > g.ms || !increment(g.rand[:]) {
+		// A new millisecond, or the random part overflowed. The latter is
+		// vanishingly unlikely; starting over loses only monotonicity.
+		if _, err := rand.Read(g.rand[:]); err != nil {
+			panic(err)
+		}
+	}
+	if ms > g.ms {
+		g.ms = ms
+	}
+	var id [16]byte
+	var tb [8]byte
+	binary.BigEndian.PutUint64(tb[:], g.ms)
+	copy(id[:6], tb[2:])
+	copy(id[6:], g.rand[:])
+	return encodeULID(id)
+}
+
+// increment adds one to the big-endian number b, reporting false if it overflows.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// crockford is the Base32 alphabet of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeULID encodes the 128 bits of id as 26 Base32 digits, most significant
+// first. The first digit holds only three bits.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var s [26]byte
+	for i := 25; i >= 0; i-- {
+		s[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
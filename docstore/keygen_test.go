@@ -0,0 +1,116 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/gcerrors"
+)
+
+func TestEncodeULID(t *testing.T) {
+	var max [16]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+	for _, test := range []struct {
+		id   [16]byte
+		want string
+	}{
+		{[16]byte{}, "00000000000000000000000000"},
+		{max, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		{[16]byte{15: 1}, "00000000000000000000000001"},
+		{[16]byte{15: 32}, "00000000000000000000000010"},
+		// The timestamp of the example in the ULID spec, 1469922850259.
+		{[16]byte{0x01, 0x56, 0x3e, 0x3a, 0xb5, 0xd3}, "01ARZ3NDEK0000000000000000"},
+	} {
+		if got := encodeULID(test.id); got != test.want {
+			t.Errorf("%x: got %s, want %s", test.id, got, test.want)
+		}
+	}
+}
+
+func TestULIDKeys(t *testing.T) {
+	re := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	var g ulidGenerator
+	now := time.Now()
+	// Keys generated in the same millisecond, or after the clock goes backwards,
+	// still increase.
+	times := []time.Time{now, now, now.Add(time.Millisecond), now.Add(-time.Second), now.Add(time.Second)}
+	prev := ""
+	for _, tm := range times {
+		got := g.next(tm)
+		if !re.MatchString(got) {
+			t.Errorf("%q is not a ULID", got)
+		}
+		if got <= prev {
+			t.Errorf("got %s after %s, want increasing keys", got, prev)
+		}
+		prev = got
+	}
+	if a, b := ULIDKeys(), ULIDKeys(); a == b {
+		t.Errorf("ULIDKeys returned %s twice", a)
+	}
+}
+
+// actionRecorder is a driver collection that records the actions it runs.
+type actionRecorder struct {
+	fakeDriverCollection
+	actions []*driver.Action
+}
+
+func (*actionRecorder) Key(doc driver.Document) (interface{}, error) {
+	k, _ := doc.GetField("key")
+	return k, nil
+}
+
+func (d *actionRecorder) RunActions(ctx context.Context, as []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	d.actions = append(d.actions, as...)
+	return nil
+}
+
+func TestWithKeyGenerator(t *testing.T) {
+	ctx := context.Background()
+	d := &actionRecorder{}
+	c := WithKeyGenerator(NewCollection(d), func() string { return "gen" })
+	// Setting another option keeps the key generator.
+	c = WithStringOptions(c, &StringOptions{RejectInvalidUTF8: true})
+	defer c.Close()
+	if err := c.Actions().Create(map[string]interface{}{"a": 1}).Put(map[string]interface{}{"key": 1}).Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range d.actions {
+		switch a.Kind {
+		case driver.Create:
+			if a.KeyGenerator == nil {
+				t.Fatal("Create has no KeyGenerator")
+			}
+			if got := driver.GenerateKey(a); got != "gen" {
+				t.Errorf("got key %q, want %q", got, "gen")
+			}
+		default:
+			if a.KeyGenerator != nil {
+				t.Errorf("%s has a KeyGenerator", a.Kind)
+			}
+		}
+	}
+	if err := c.Put(ctx, map[string]interface{}{"key": "\xff"}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("Put with invalid UTF-8: got %v, want InvalidArgument", err)
+	}
+}
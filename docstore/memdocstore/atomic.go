@@ -0,0 +1,103 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"context"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/internal/gcerr"
+)
+
+// A txn records the writes of an atomic action list, so that they can be
+// undone if an action fails, and reported only if none does.
+type txn struct {
+	writes []txnWrite
+}
+
+type txnWrite struct {
+	sh       *shard
+	a        *driver.Action // nil for the removal of an expired document
+	kind     ChangeKind
+	key      interface{}
+	old, new map[string]interface{}
+}
+
+// store replaces the document with key in sh, which must be locked for
+// writing, with new, or removes it if new is nil. old is the document it
+// replaces. If tx is nil, the write is reported at once; otherwise it is
+// recorded in tx.
+func (c *collection) store(tx *txn, sh *shard, a *driver.Action, kind ChangeKind, key interface{}, old, new map[string]interface{}) {
+	if new == nil {
+		delete(sh.docs, key)
+	} else {
+		sh.docs[key] = new
+	}
+	if tx != nil {
+		tx.writes = append(tx.writes, txnWrite{sh, a, kind, key, old, new})
+		return
+	}
+	c.finishWrite(a, kind, key, old, new)
+}
+
+// finishWrite sets the revision of a's document, if a wrote one, and reports
+// the write to the indexes and watchers.
+func (c *collection) finishWrite(a *driver.Action, kind ChangeKind, key interface{}, old, new map[string]interface{}) {
+	if a != nil && new != nil {
+		// Ignore errors. It's fine if the doc doesn't have a revision field.
+		_ = a.Doc.SetField(c.opts.RevisionField, new[c.opts.RevisionField])
+	}
+	c.changed(kind, key, old, new)
+}
+
+// runAtomic runs actions one at a time with all shards locked, undoing their
+// writes if one fails, and sets their errors in errs.
+func (c *collection) runAtomic(ctx context.Context, actions []*driver.Action, errs []error) {
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	var ordered []*driver.Action
+	for _, as := range [][]*driver.Action{beforeGets, gets, writes, afterGets} {
+		ordered = append(ordered, as...)
+	}
+
+	c.lockAll()
+	defer c.unlockAll()
+	tx := &txn{}
+	for i, a := range ordered {
+		err := c.startAction(ctx, a)
+		if err == nil {
+			err = c.applyAction(c.shard(a.Key), a, tx)
+		}
+		if err == nil {
+			continue
+		}
+		errs[a.Index] = err
+		driver.SkipActions(ordered[i+1:], errs)
+		for j := len(tx.writes) - 1; j >= 0; j-- {
+			w := tx.writes[j]
+			if w.old == nil {
+				delete(w.sh.docs, w.key)
+			} else {
+				w.sh.docs[w.key] = w.old
+			}
+		}
+		for _, b := range ordered[:i] {
+			errs[b.Index] = gcerr.Newf(gcerr.Canceled, nil, "memdocstore: action rolled back because action %d failed", a.Index)
+		}
+		return
+	}
+	for _, w := range tx.writes {
+		c.finishWrite(w.a, w.kind, w.key, w.old, w.new)
+	}
+}
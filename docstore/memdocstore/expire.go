@@ -0,0 +1,84 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import "time"
+
+// DefaultSweepInterval is the interval between sweeps for expired documents
+// when Options.SweepInterval is zero.
+const DefaultSweepInterval = time.Minute
+
+// expired reports whether doc has expired. A document expires at the time in
+// its expiration field, which is either a time.Time or a number of seconds
+// since the Unix epoch, as DynamoDB's time to live attribute is. A document
+// without a time there never expires.
+func (c *collection) expired(doc map[string]interface{}, now time.Time) bool {
+	if c.opts.ExpirationField == "" {
+		return false
+	}
+	var exp time.Time
+	switch v := doc[c.opts.ExpirationField].(type) {
+	case time.Time:
+		exp = v
+	case int64:
+		exp = time.Unix(v, 0)
+	case uint64:
+		exp = time.Unix(int64(v), 0)
+	case float64:
+		exp = time.Unix(0, int64(v*1e9))
+	default:
+		return false
+	}
+	return !exp.After(now)
+}
+
+// startSweeper starts a goroutine that removes expired documents until the
+// collection is closed.
+func (c *collection) startSweeper() {
+	interval := c.opts.SweepInterval
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go func() {
+		defer close(c.stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-t.C:
+				c.sweep(time.Now())
+			}
+		}
+	}()
+}
+
+// sweep removes the documents that have expired by now.
+func (c *collection) sweep(now time.Time) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for key, doc := range sh.docs {
+			if c.expired(doc, now) {
+				delete(sh.docs, key)
+				c.changed(Expired, key, doc, nil)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
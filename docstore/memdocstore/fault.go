@@ -0,0 +1,145 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+)
+
+// The operations of a collection that a Fault can apply to, besides the action
+// kinds: "Create", "Replace", "Put", "Get", "Delete" and "Update".
+const (
+	GetQueryOp    = "GetQuery"
+	DeleteQueryOp = "DeleteQuery"
+	UpdateQueryOp = "UpdateQuery"
+)
+
+// A Fault is an error or a delay that a collection injects into its
+// operations, so that applications can test how they handle a slow or failing
+// service. See Options.Faults.
+type Fault struct {
+	// Ops are the operations that the fault applies to: the names of action
+	// kinds, like "Put", and GetQueryOp, DeleteQueryOp and UpdateQueryOp. If
+	// empty, the fault applies to every operation.
+	Ops []string
+
+	// Probability is the chance, from 0 to 1, that the fault applies to an
+	// operation. Zero means that it always applies.
+	Probability float64
+
+	// PerSecond, if positive, limits the fault to operations beyond the first
+	// PerSecond in each second. With Code set to gcerrors.ResourceExhausted, it
+	// simulates a service that throttles requests.
+	PerSecond int
+
+	// Latency delays the operation before it runs, or until its context is
+	// done.
+	Latency time.Duration
+
+	// Err is the error that the operation returns, instead of running. If Err
+	// is nil and Code is not gcerrors.OK, the operation returns an error with
+	// that code. If both are unset, the operation runs after the delay.
+	Err  error
+	Code gcerrors.ErrorCode
+}
+
+// faultInjector decides which faults apply to each operation of a collection.
+type faultInjector struct {
+	faults []Fault
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	windowStart []time.Time // per fault, the start of the current second
+	windowCount []int       // per fault, the operations in the current second
+}
+
+func newFaultInjector(faults []Fault) *faultInjector {
+	if len(faults) == 0 {
+		return nil
+	}
+	return &faultInjector{
+		faults:      append([]Fault(nil), faults...),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		windowStart: make([]time.Time, len(faults)),
+		windowCount: make([]int, len(faults)),
+	}
+}
+
+// inject applies the faults for op, in order. It waits out the latency of each
+// fault that applies, and returns the error of the first one that has one.
+func (fi *faultInjector) inject(ctx context.Context, op string) error {
+	if fi == nil {
+		return nil
+	}
+	for i := range fi.faults {
+		f := &fi.faults[i]
+		if !fi.applies(i, op) {
+			continue
+		}
+		if f.Latency > 0 {
+			t := time.NewTimer(f.Latency)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+		if f.Err != nil {
+			return f.Err
+		}
+		if f.Code != gcerrors.OK {
+			return gcerr.Newf(f.Code, nil, "memdocstore: injected fault for %s", op)
+		}
+	}
+	return nil
+}
+
+// applies reports whether the ith fault applies to this occurrence of op.
+func (fi *faultInjector) applies(i int, op string) bool {
+	f := &fi.faults[i]
+	if len(f.Ops) > 0 {
+		found := false
+		for _, o := range f.Ops {
+			if o == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if f.PerSecond > 0 {
+		now := time.Now()
+		if now.Sub(fi.windowStart[i]) >= time.Second {
+			fi.windowStart[i] = now
+			fi.windowCount[i] = 0
+		}
+		fi.windowCount[i]++
+		if fi.windowCount[i] <= f.PerSecond {
+			return false
+		}
+	}
+	return f.Probability <= 0 || fi.rand.Float64() < f.Probability
+}
@@ -0,0 +1,243 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/internal/gcerr"
+)
+
+// An index holds the keys of the documents that have an indexable value at a
+// field path, ordered by that value.
+type index struct {
+	name    string // the field path, joined with "."
+	fp      []string
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	val interface{}
+	key interface{}
+}
+
+// Classes of indexable values. Values of different classes never compare
+// equal, and an index orders them by class first.
+const (
+	notIndexable = iota
+	boolClass
+	numberClass
+	stringClass
+	timeClass
+)
+
+// valueClass returns the class of an encoded document value or a filter value.
+func valueClass(v interface{}) int {
+	if _, ok := v.(time.Time); ok {
+		return timeClass
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Bool:
+		return boolClass
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return numberClass
+	case reflect.String:
+		return stringClass
+	default:
+		return notIndexable
+	}
+}
+
+// compareIndexValues compares two indexable values, ordering them by class and
+// then by driver.CompareValues.
+func compareIndexValues(v1, v2 interface{}) int {
+	c1, c2 := valueClass(v1), valueClass(v2)
+	if c1 != c2 {
+		return c1 - c2
+	}
+	c, _ := driver.CompareValues(v1, v2)
+	return c
+}
+
+// indexValue returns the value of doc at the index's field path, if doc is not
+// nil and the value is indexable.
+func (x *index) indexValue(doc map[string]interface{}) (interface{}, bool) {
+	if doc == nil {
+		return nil, false
+	}
+	v, err := getAtFieldPath(doc, x.fp)
+	if err != nil || valueClass(v) == notIndexable {
+		return nil, false
+	}
+	return v, true
+}
+
+// bounds returns the range of entries whose values compare to v as op
+// requires. ok is false if the index cannot serve op.
+func (x *index) bounds(op string, v interface{}) (lo, hi int, ok bool) {
+	class := valueClass(v)
+	if class == notIndexable {
+		return 0, 0, false
+	}
+	n := len(x.entries)
+	// The first entry not less than v, and the first greater than v.
+	geq := sort.Search(n, func(i int) bool { return compareIndexValues(x.entries[i].val, v) >= 0 })
+	gt := sort.Search(n, func(i int) bool { return compareIndexValues(x.entries[i].val, v) > 0 })
+	// The entries of v's class.
+	classLo := sort.Search(n, func(i int) bool { return valueClass(x.entries[i].val) >= class })
+	classHi := sort.Search(n, func(i int) bool { return valueClass(x.entries[i].val) > class })
+	switch op {
+	case driver.EqualOp:
+		return geq, gt, true
+	case ">":
+		return gt, classHi, true
+	case ">=":
+		return geq, classHi, true
+	case "<":
+		return classLo, geq, true
+	case "<=":
+		return classLo, gt, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// insert adds an entry for key, after the others with the same value.
+func (x *index) insert(val, key interface{}) {
+	i := sort.Search(len(x.entries), func(i int) bool { return compareIndexValues(x.entries[i].val, val) > 0 })
+	x.entries = append(x.entries, indexEntry{})
+	copy(x.entries[i+1:], x.entries[i:])
+	x.entries[i] = indexEntry{val, key}
+}
+
+// remove removes the entry for key with value val.
+func (x *index) remove(val, key interface{}) {
+	i := sort.Search(len(x.entries), func(i int) bool { return compareIndexValues(x.entries[i].val, val) >= 0 })
+	for ; i < len(x.entries) && compareIndexValues(x.entries[i].val, val) == 0; i++ {
+		if x.entries[i].key == key {
+			x.entries = append(x.entries[:i], x.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// reindex updates the indexes for the document with key, which has changed
+// from old to new. Either may be nil. It must be called with the lock of the
+// document's shard held.
+func (c *collection) reindex(key interface{}, old, new map[string]interface{}) {
+	if len(c.indexes) == 0 {
+		return
+	}
+	c.idxMu.Lock()
+	defer c.idxMu.Unlock()
+	for _, x := range c.indexes {
+		oldVal, hadOld := x.indexValue(old)
+		newVal, hasNew := x.indexValue(new)
+		if hadOld && hasNew && compareIndexValues(oldVal, newVal) == 0 {
+			continue
+		}
+		if hadOld {
+			x.remove(oldVal, key)
+		}
+		if hasNew {
+			x.insert(newVal, key)
+		}
+	}
+}
+
+// An indexScan describes how a query uses an index.
+type indexScan struct {
+	x       *index
+	lo, hi  int  // the range of entries to read
+	ordered bool // whether the entries are read in the query's order
+}
+
+// chooseIndex returns the index scan that reads the fewest entries for q, or
+// nil if q cannot use an index. The scan is ordered if the index is on the
+// field orderBy, which is empty if an index cannot supply q's order. It must
+// be called with c.idxMu held.
+func (c *collection) chooseIndex(q *driver.Query, orderBy string) *indexScan {
+	var best *indexScan
+	for _, x := range c.indexes {
+		s := &indexScan{x: x, lo: 0, hi: len(x.entries)}
+		filtered := false
+		for _, f := range q.Filters {
+			if !driver.FieldPathsEqual(f.FieldPath, x.fp) {
+				continue
+			}
+			lo, hi, ok := x.bounds(f.Op, f.Value)
+			if !ok {
+				continue
+			}
+			filtered = true
+			if lo > s.lo {
+				s.lo = lo
+			}
+			if hi < s.hi {
+				s.hi = hi
+			}
+		}
+		if s.hi < s.lo {
+			s.hi = s.lo
+		}
+		s.ordered = orderBy != "" && orderBy == x.name
+		if !filtered && !s.ordered {
+			continue
+		}
+		if best == nil || s.hi-s.lo < best.hi-best.lo || (s.hi-s.lo == best.hi-best.lo && s.ordered && !best.ordered) {
+			best = s
+		}
+	}
+	return best
+}
+
+// read returns a copy of the entries that s reads, in the query's order. It
+// must be called with c.idxMu held.
+func (s *indexScan) read(ascending bool) []indexEntry {
+	es := make([]indexEntry, s.hi-s.lo)
+	copy(es, s.x.entries[s.lo:s.hi])
+	if s.ordered && !ascending {
+		for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+			es[i], es[j] = es[j], es[i]
+		}
+	}
+	return es
+}
+
+// newIndexes returns empty indexes for the field paths in names.
+func newIndexes(names []string) ([]*index, error) {
+	var xs []*index
+	seen := map[string]bool{}
+	for _, name := range names {
+		fp := strings.Split(name, ".")
+		for _, s := range fp {
+			if s == "" {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "bad index field path %q", name)
+			}
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		xs = append(xs, &index{name: name, fp: fp})
+	}
+	return xs, nil
+}
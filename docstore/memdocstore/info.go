@@ -0,0 +1,75 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+// CollectionInfo describes a memdocstore collection. Collection.As exposes
+// it as *CollectionInfo, so that code that handles the As types of providers
+// can be tested against memdocstore.
+type CollectionInfo struct {
+	// KeyField is the name of the key field, or empty if the collection was
+	// opened with a key function.
+	KeyField string
+
+	// RevisionField is the name of the field holding document revisions.
+	RevisionField string
+
+	// Indexes are the field paths of the collection's indexes, as in
+	// Options.Indexes.
+	Indexes []string
+
+	// Documents is the number of documents in the collection when As was
+	// called, including expired documents not yet removed.
+	Documents int
+}
+
+// QueryInfo describes how memdocstore ran a get query. DocumentIterator.As
+// exposes it as *QueryInfo.
+type QueryInfo struct {
+	// Index is the field path of the index that the query read, or empty if
+	// it examined every document.
+	Index string
+
+	// Ordered reports whether the index supplied the query's order, so that
+	// the results did not need sorting.
+	Ordered bool
+
+	// SortKeys are the keys the results are ordered by, if any.
+	SortKeys []SortKey
+
+	// Matches is the number of documents that matched the query's filters.
+	// It counts documents beyond the query's limit, unless the query read an
+	// index in order and so could stop at the limit.
+	Matches int
+}
+
+// info returns the CollectionInfo of c.
+func (c *collection) info() *CollectionInfo {
+	ci := &CollectionInfo{
+		KeyField:      c.keyField,
+		RevisionField: c.opts.RevisionField,
+	}
+	c.idxMu.RLock()
+	for _, x := range c.indexes {
+		ci.Indexes = append(ci.Indexes, x.name)
+	}
+	c.idxMu.RUnlock()
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.RLock()
+		ci.Documents += len(sh.docs)
+		sh.mu.RUnlock()
+	}
+	return ci
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"sync"
+	"time"
+
+	"gocloud.dev/internal/gcerr"
+)
+
+// DynamoDBLimits returns Options that enforce the limits of DynamoDB: items
+// of at most 400 KiB, and at most 100 items in a transaction or batch read.
+// Write throughput depends on the table's capacity, so it is not limited; set
+// MaxWritesPerSecond to match it.
+func DynamoDBLimits() *Options {
+	return &Options{
+		MaxDocumentSize: 400 * 1024,
+		MaxActions:      100,
+	}
+}
+
+// FirestoreLimits returns Options that enforce the limits of Firestore:
+// documents of at most 1 MiB, and at most 250 actions run together, which is
+// as many as firedocstore commits in one batch of at most 500 writes. Write
+// throughput is not limited; set MaxWritesPerSecond to match the rate the
+// database is expected to sustain.
+func FirestoreLimits() *Options {
+	return &Options{
+		MaxDocumentSize: 1 << 20,
+		MaxActions:      250,
+	}
+}
+
+// MaxActions implements driver.ActionLimiter, so that the docstore package
+// runs an action list longer than Options.MaxActions in parts. Atomic action
+// lists are not split, since their parts would not be atomic together.
+func (c *collection) MaxActions() int {
+	if c.opts.AtomicActionLists {
+		return 0
+	}
+	return c.opts.MaxActions
+}
+
+// checkActions returns an error if an atomic action list has more actions than
+// Options.MaxActions allows.
+func (c *collection) checkActions(n int) error {
+	if max := c.opts.MaxActions; c.opts.AtomicActionLists && max > 0 && n > max {
+		return gcerr.Newf(gcerr.InvalidArgument, nil,
+			"memdocstore: action list has %d actions, more than the limit of %d", n, max)
+	}
+	return nil
+}
+
+// writeLimiter fails writes beyond a number per second.
+type writeLimiter struct {
+	perSecond int
+
+	mu          sync.Mutex
+	windowStart time.Time // the start of the current second
+	windowCount int       // the writes in the current second
+}
+
+func newWriteLimiter(perSecond int) *writeLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &writeLimiter{perSecond: perSecond}
+}
+
+// allow counts a write, and returns an error if there have been too many in
+// the current second.
+func (l *writeLimiter) allow() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart = now
+		l.windowCount = 0
+	}
+	if l.windowCount >= l.perSecond {
+		return gcerr.Newf(gcerr.ResourceExhausted, nil,
+			"memdocstore: more than %d writes per second", l.perSecond)
+	}
+	l.windowCount++
+	return nil
+}
@@ -16,7 +16,9 @@
 // API. It is suitable for local development and testing.
 //
 // Every document in a memdocstore collection has a unique primary key. The primary
-// key values need not be strings; they may be any comparable Go value.
+// key values need not be strings; they may be any comparable Go value. Integer keys
+// are equal if their values are, whatever their types, so a document stored with
+// key int(1) can be retrieved with key int64(1).
 //
 //
 // Action Lists
@@ -24,9 +26,61 @@
 // Action lists are executed concurrently. Each action in an action list is executed
 // in a separate goroutine.
 //
+// Collections are safe for concurrent use. The documents of a collection are
+// divided among shards by key, each with its own lock, so actions on different
+// documents seldom wait for each other. Queries lock one shard at a time, so a
+// query that runs concurrently with writes may see some of the writes but not
+// others.
+//
 // memdocstore calls the BeforeDo function of an ActionList once before executing the
 // actions. Its as function never returns true.
 //
+// Set Options.AtomicActionLists to make action lists behave like
+// transactions: either all of a list's writes are applied, or, if any action
+// fails, none are. The other actions of a failed list fail with
+// gcerrors.Canceled, and the watchers and the revision fields of documents
+// see only the writes of lists that succeed. Atomic action lists run their
+// actions one at a time, with the whole collection locked.
+//
+//
+// Query Order
+//
+// Queries can be ordered by fields in nested maps and structs, as in
+// OrderBy("a.b", docstore.Ascending). A query's BeforeQuery function can add
+// secondary sort keys; see SortKey.
+//
+//
+// Revisions
+//
+// By default, revisions are int64 values. Set Options.RevisionStrategy to use
+// timestamps or content hashes instead, which are strings, as revisions are for
+// some other providers.
+//
+//
+// Expiration
+//
+// Set Options.ExpirationField to give documents a time to live, as DynamoDB
+// and other providers can. A document expires at the time in that field,
+// either a time.Time or a number of seconds since the Unix epoch. An expired
+// document is invisible to actions and queries, as if it had been deleted,
+// and a background goroutine removes it at the next sweep.
+//
+//
+// Watching
+//
+// Watch returns a Watcher that receives an event for every change to the
+// documents of a collection, so that code that reacts to changes, like cache
+// invalidation, can be tested without a provider that supports change
+// streams.
+//
+//
+// As
+//
+// memdocstore exposes the following types for As:
+//  - Collection: *CollectionInfo
+//  - Query.BeforeQuery: *[]SortKey
+//  - DocumentIterator: *QueryInfo
+//
 //
 // URLs
 //
@@ -39,12 +93,18 @@ package memdocstore // import "gocloud.dev/docstore/memdocstore"
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"gocloud.dev/docstore"
 	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/internal/gcerr"
 )
@@ -55,12 +115,78 @@ type Options struct {
 	// Defaults to docstore.RevisionField.
 	RevisionField string
 
+	// RevisionStrategy determines the values used as document revisions.
+	// Defaults to CounterRevisions.
+	RevisionStrategy RevisionStrategy
+
 	// The maximum number of concurrent goroutines started for a single call to
 	// ActionList.Do. If less than 1, there is no limit.
 	MaxOutstandingActionRPCs int
-}
 
-// TODO(jba): make this package thread-safe.
+	// The maximum size of a document in bytes, as estimated by
+	// driver.EstimateSize. If less than 1, there is no limit.
+	MaxDocumentSize int
+
+	// The maximum number of actions that run together. ActionList.Do runs a
+	// longer action list in parts, one after the other, as it does for
+	// services that limit the size of batches. An atomic action list cannot be
+	// split, so a longer one fails as a whole, with gcerrors.InvalidArgument,
+	// as a transaction would. If less than 1, there is no limit. See also
+	// DynamoDBLimits and FirestoreLimits.
+	MaxActions int
+
+	// The maximum number of write actions that the collection accepts in each
+	// second. Writes beyond it fail with gcerrors.ResourceExhausted, as they
+	// would on a service with limited write throughput. Queries that delete
+	// or update documents are not counted. If less than 1, there is no limit.
+	MaxWritesPerSecond int
+
+	// Indexes are the field paths, with components separated by dots, of the
+	// fields to index. A query with a filter on an indexed field, other than a
+	// string operator like has-prefix, reads only the documents in the range
+	// of the index that the filter selects. A query ordered only by an indexed
+	// field reads the documents in index order, and so returns only those
+	// that have a string, number, boolean or time value in that field.
+	// Each index slows every write a little.
+	Indexes []string
+
+	// Faults are injected into the collection's operations, in order, to
+	// simulate a slow or failing service. Each action of an action list is a
+	// separate operation, as is each query.
+	Faults []Fault
+
+	// ExpirationField is the name of the field holding the time at which a
+	// document expires: a time.Time, or a number of seconds since the Unix
+	// epoch. If empty, documents never expire.
+	ExpirationField string
+
+	// SweepInterval is how often expired documents are removed, if there is
+	// an ExpirationField. Defaults to DefaultSweepInterval.
+	SweepInterval time.Duration
+
+	// Filename, if set, is the name of a file that holds the collection's
+	// documents between runs. They are read from the file when the
+	// collection is opened, if it exists, and written to it when the
+	// collection is closed. The file is written with encoding/gob, so keys
+	// and field values of types other than the ones memdocstore stores must
+	// be registered with gob.Register.
+	Filename string
+
+	// CopyOnRead makes every document read by a Get action or a query a deep
+	// copy of the stored one, including byte slices. Otherwise, nested maps,
+	// slices and byte slices decoded into interface{} or []byte values may
+	// be shared with the stored document, so that modifying them changes
+	// what later reads return, which no other provider does. Set it in tests
+	// of code that modifies the documents it reads.
+	CopyOnRead bool
+
+	// AtomicActionLists makes each action list apply all or none of its
+	// writes. Its actions run one at a time, in the order of
+	// driver.GroupActions, with every document of the collection locked, and
+	// if one fails, the writes before it are undone. See the package
+	// documentation.
+	AtomicActionLists bool
+}
 
 // OpenCollection creates a *docstore.Collection backed by memory. keyField is the
 // document field holding the primary key of the collection.
@@ -94,39 +220,116 @@ func newCollection(keyField string, keyFunc func(docstore.Document) interface{},
 	if opts.RevisionField == "" {
 		opts.RevisionField = docstore.DefaultRevisionField
 	}
-	return &collection{
-		keyField:    keyField,
-		keyFunc:     keyFunc,
-		opts:        opts,
-		docs:        map[interface{}]map[string]interface{}{},
-		curRevision: 0,
-	}, nil
+	indexes, err := newIndexes(opts.Indexes)
+	if err != nil {
+		return nil, err
+	}
+	c := &collection{
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+		indexes:  indexes,
+		faults:   newFaultInjector(opts.Faults),
+		writes:   newWriteLimiter(opts.MaxWritesPerSecond),
+	}
+	for i := range c.shards {
+		c.shards[i].docs = map[interface{}]map[string]interface{}{}
+	}
+	if opts.Filename != "" {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ExpirationField != "" {
+		c.startSweeper()
+	}
+	return c, nil
+}
+
+// numShards is the number of shards that a collection's documents are divided
+// among.
+const numShards = 32
+
+// A shard holds the documents whose keys hash to it.
+type shard struct {
+	mu sync.RWMutex
+	// map from keys to documents. Documents are represented as map[string]interface{},
+	// regardless of what their original representation is. Even if the user is using
+	// map[string]interface{}, we make our own copy. A stored document is never
+	// modified: writes replace it, so readers may use it after releasing the lock.
+	docs map[interface{}]map[string]interface{}
 }
 
 type collection struct {
 	keyField string
 	keyFunc  func(docstore.Document) interface{}
 	opts     *Options
-	mu       sync.Mutex
-	// map from keys to documents. Documents are represented as map[string]interface{},
-	// regardless of what their original representation is. Even if the user is using
-	// map[string]interface{}, we make our own copy.
-	docs        map[interface{}]map[string]interface{}
-	curRevision int64 // incremented on each write
+	shards   [numShards]shard
+
+	// idxMu guards the entries of the indexes. It is acquired after a shard
+	// lock, never before.
+	idxMu   sync.RWMutex
+	indexes []*index
+
+	// watchMu guards watchers. It is acquired after a shard lock, never
+	// before.
+	watchMu  sync.RWMutex
+	watchers map[*Watcher]bool
+
+	faults *faultInjector // nil if there are no faults
+	writes *writeLimiter  // nil if writes are not limited
+
+	// The sweeper for expired documents stops when stop is closed, and closes
+	// stopped. Both are nil if documents do not expire.
+	closeOnce sync.Once
+	stop      chan struct{}
+	stopped   chan struct{}
+
+	revMu         sync.Mutex
+	curRevision   int64     // incremented on each write, for CounterRevisions and HashRevisions
+	lastWriteTime time.Time // the time of the last write, for TimestampRevisions
+}
+
+// shard returns the shard that holds the document with the given key. Keys are
+// hashed by how they print, which is the same for equal keys.
+func (c *collection) shard(key interface{}) *shard {
+	h := fnv.New32a()
+	fmt.Fprint(h, key)
+	return &c.shards[h.Sum32()%numShards]
 }
 
 func (c *collection) Key(doc driver.Document) (interface{}, error) {
 	if c.keyField != "" {
 		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
-		return key, nil
+		return normalizeKey(key), nil
 	}
 	key := c.keyFunc(doc.Origin)
 	if key == nil {
 		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
 	}
-	return key, nil
+	return normalizeKey(key), nil
 }
 
+// normalizeKey converts integer keys to int64, or to uint64 if they are too
+// large, so that keys of different integer types with the same value are equal.
+func normalizeKey(key interface{}) interface{} {
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := v.Uint(); u <= math.MaxInt64 {
+			return int64(u)
+		}
+		return v.Uint()
+	default:
+		return key
+	}
+}
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return c.opts.MaxDocumentSize }
+
 func (c *collection) RevisionField() string {
 	return c.opts.RevisionField
 }
@@ -139,16 +342,42 @@ func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
 // RunActions implements driver.RunActions.
 func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
 	errs := make([]error, len(actions))
+	if err := c.checkActions(len(actions)); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return driver.NewActionListError(errs)
+	}
 
-	// Run the actions concurrently with each other.
+	// Run the actions concurrently with each other. With FailFast, stop starting
+	// actions once one fails.
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
 	run := func(as []*driver.Action) {
 		t := driver.NewThrottle(c.opts.MaxOutstandingActionRPCs)
-		for _, a := range as {
+		for i, a := range as {
 			a := a
 			t.Acquire()
+			mu.Lock()
+			stop := opts.FailFast && failed
+			mu.Unlock()
+			if stop {
+				t.Release()
+				t.Wait()
+				driver.SkipActions(as[i:], errs)
+				return
+			}
 			go func() {
 				defer t.Release()
-				errs[a.Index] = c.runAction(ctx, a)
+				err := c.runAction(ctx, a)
+				errs[a.Index] = err
+				if err != nil {
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
 			}()
 		}
 		t.Wait()
@@ -163,6 +392,10 @@ func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, o
 		}
 	}
 
+	if c.opts.AtomicActionLists {
+		c.runAtomic(ctx, actions, errs)
+		return driver.NewActionListError(errs)
+	}
 	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
 	run(beforeGets)
 	run(gets)
@@ -173,73 +406,120 @@ func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, o
 
 // runAction executes a single action.
 func (c *collection) runAction(ctx context.Context, a *driver.Action) error {
+	if err := c.startAction(ctx, a); err != nil {
+		return err
+	}
+	sh := c.shard(a.Key)
+	if a.Kind == driver.Get {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	} else {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+	}
+	return c.applyAction(sh, a, nil)
+}
+
+// startAction does the work of running an action that needs no lock: it
+// injects faults, limits writes, and generates a missing key.
+func (c *collection) startAction(ctx context.Context, a *driver.Action) error {
 	// Stop if the context is done.
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
-	// Get the key from the doc so we can look it up in the map.
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	if err := c.faults.inject(ctx, a.Kind.String()); err != nil {
+		return err
+	}
+	if a.Kind != driver.Get {
+		if err := c.writes.allow(); err != nil {
+			return err
+		}
+	}
+	// If the user didn't supply a value for the key field of a Create, create a
+	// new one, so that we know which shard to lock.
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		// Set the new key in the document.
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	return nil
+}
+
+// applyAction executes a, whose shard sh must be locked, for writing unless a
+// is a Get. If tx is not nil, writes are recorded in it and not yet reported.
+func (c *collection) applyAction(sh *shard, a *driver.Action, tx *txn) error {
 	// If there is a key, get the current document with that key.
 	var (
 		current map[string]interface{}
 		exists  bool
 	)
 	if a.Key != nil {
-		current, exists = c.docs[a.Key]
+		current, exists = sh.docs[a.Key]
+	}
+	// An expired document is gone. Remove it now if the shard is locked for
+	// writing.
+	if exists && c.expired(current, time.Now()) {
+		if a.Kind != driver.Get {
+			c.store(tx, sh, nil, Expired, a.Key, current, nil)
+		}
+		current, exists = nil, false
 	}
 	// Check for a NotFound error.
 	if !exists && (a.Kind == driver.Replace || a.Kind == driver.Update || a.Kind == driver.Get) {
 		return gcerr.Newf(gcerr.NotFound, nil, "document with key %v does not exist", a.Key)
 	}
+	if len(a.Conditions) > 0 && (exists || a.Kind != driver.Delete) {
+		if err := checkConditions(current, a.Conditions); err != nil {
+			return err
+		}
+	}
 	switch a.Kind {
 	case driver.Create:
 		// It is an error to attempt to create an existing document.
 		if exists {
 			return gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %v exists", a.Key)
 		}
-		// If the user didn't supply a value for the key field, create a new one.
-		if a.Key == nil {
-			a.Key = driver.UniqueString()
-			// Set the new key in the document.
-			if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
-				return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
-			}
-		}
 		fallthrough
 
 	case driver.Replace, driver.Put:
 		if err := c.checkRevision(a.Doc, current); err != nil {
 			return err
 		}
-		doc, err := encodeDoc(a.Doc)
+		doc, err := gobcodec.EncodeDoc(a.Doc)
 		if err != nil {
 			return err
 		}
 		c.changeRevision(doc)
-		// Ignore errors. It's fine if the doc doesn't have a revision field.
-		a.Doc.SetField(c.opts.RevisionField, doc[c.opts.RevisionField])
-		c.docs[a.Key] = doc
+		c.store(tx, sh, a, writeKind(current), a.Key, current, doc)
 
 	case driver.Delete:
 		if err := c.checkRevision(a.Doc, current); err != nil {
 			return err
 		}
-		delete(c.docs, a.Key)
+		if !exists {
+			break
+		}
+		c.store(tx, sh, a, Deleted, a.Key, current, nil)
 
 	case driver.Update:
 		if err := c.checkRevision(a.Doc, current); err != nil {
 			return err
 		}
-		if err := c.update(current, a.Mods); err != nil {
+		doc, changes, err := c.update(current, a.Mods)
+		if err != nil {
 			return err
 		}
-		_ = a.Doc.SetField(c.opts.RevisionField, current[c.opts.RevisionField])
+		if a.ReportChanges {
+			a.Changes = changes
+		}
+		c.store(tx, sh, a, Updated, a.Key, current, doc)
 
 	case driver.Get:
 		// We've already retrieved the document into current, above.
 		// Now we copy its fields into the user-provided document.
-		if err := decodeDoc(current, a.Doc, a.FieldPaths, c.opts.RevisionField); err != nil {
+		if err := gobcodec.DecodeDoc(c.readCopy(current), a.Doc, a.FieldPaths, c.opts.RevisionField); err != nil {
 			return err
 		}
 	default:
@@ -248,8 +528,30 @@ func (c *collection) runAction(ctx context.Context, a *driver.Action) error {
 	return nil
 }
 
-// Must be called with the lock held.
-func (c *collection) update(doc map[string]interface{}, mods []driver.Mod) error {
+// checkConditions returns a FailedPrecondition error unless doc, which may be
+// nil, satisfies all the conditions.
+func checkConditions(doc map[string]interface{}, conds []driver.Filter) error {
+	if doc == nil {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "document does not exist")
+	}
+	ddoc, err := driver.NewDocument(doc)
+	if err != nil {
+		return err
+	}
+	for _, f := range conds {
+		if !driver.EvaluateFilter(f, ddoc) {
+			return gcerr.Newf(gcerr.FailedPrecondition, nil, "condition %s %s %v not satisfied",
+				strings.Join(f.FieldPath, "."), f.Op, f.Value)
+		}
+	}
+	return nil
+}
+
+// update returns a copy of doc with mods applied and a new revision, and the
+// changes that the mods made. It must be called with the lock of doc's shard
+// held.
+func (c *collection) update(current map[string]interface{}, mods []driver.Mod) (map[string]interface{}, []driver.Change, error) {
+	doc := copyMap(current)
 	// Sort mods by first field path element so tests are deterministic.
 	sort.Slice(mods, func(i, j int) bool { return mods[i].FieldPath[0] < mods[j].FieldPath[0] })
 
@@ -268,26 +570,34 @@ func (c *collection) update(doc map[string]interface{}, mods []driver.Mod) error
 		// Check that the field path is valid. That is, every component of the path
 		// but the last refers to a map, and no component along the way is nil.
 		if gmod.parentMap, err = getParentMap(doc, mod.FieldPath, false); err != nil {
-			return err
+			return nil, nil, err
 		}
 		gmod.key = mod.FieldPath[len(mod.FieldPath)-1]
 		if inc, ok := mod.Value.(driver.IncOp); ok {
-			amt, err := encodeValue(inc.Amount)
+			amt, err := gobcodec.EncodeValue(inc.Amount)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 			if gmod.encodedValue, err = add(gmod.parentMap[gmod.key], amt); err != nil {
-				return err
+				return nil, nil, err
 			}
 		} else if mod.Value != nil {
 			// Make sure the value encodes successfully.
-			if gmod.encodedValue, err = encodeValue(mod.Value); err != nil {
-				return err
+			if gmod.encodedValue, err = gobcodec.EncodeValue(mod.Value); err != nil {
+				return nil, nil, err
 			}
 		}
 	}
 	// Now execute the guaranteed mods.
-	for _, m := range gmods {
+	changes := make([]driver.Change, len(gmods))
+	for i, m := range gmods {
+		// The values are copied, so that the caller cannot modify the document
+		// through them.
+		changes[i] = driver.Change{
+			FieldPath: mods[i].FieldPath,
+			Old:       isolateValue(m.parentMap[m.key]),
+			New:       isolateValue(m.encodedValue),
+		}
 		if m.encodedValue == nil {
 			delete(m.parentMap, m.key)
 		} else {
@@ -295,7 +605,63 @@ func (c *collection) update(doc map[string]interface{}, mods []driver.Mod) error
 		}
 	}
 	c.changeRevision(doc)
-	return nil
+	return doc, changes, nil
+}
+
+// copyMap returns a deep copy of m, an encoded document or map value. Byte
+// slices are shared, because they are never modified.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	m2 := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		m2[k] = copyValue(v)
+	}
+	return m2
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copyMap(v)
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = copyValue(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// readCopy returns m, or a copy of it that shares nothing with m if
+// Options.CopyOnRead is set.
+func (c *collection) readCopy(m map[string]interface{}) map[string]interface{} {
+	if !c.opts.CopyOnRead {
+		return m
+	}
+	return isolateValue(m).(map[string]interface{})
+}
+
+// isolateValue is like copyValue, but also copies byte slices.
+func isolateValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = isolateValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = isolateValue(e)
+		}
+		return s
+	case []byte:
+		return append([]byte(nil), v...)
+	default:
+		return v
+	}
 }
 
 // Add two encoded numbers.
@@ -332,27 +698,20 @@ func add(x, y interface{}) (interface{}, error) {
 	}
 }
 
-// Must be called with the lock held.
-func (c *collection) changeRevision(doc map[string]interface{}) {
-	c.curRevision++
-	doc[c.opts.RevisionField] = c.curRevision
-}
-
 func (c *collection) checkRevision(arg driver.Document, current map[string]interface{}) error {
 	if current == nil {
 		return nil // no existing document
 	}
-	curRev := current[c.opts.RevisionField].(int64)
-	r, err := arg.GetField(c.opts.RevisionField)
-	if err != nil || r == nil {
+	curRev := current[c.opts.RevisionField]
+	wantRev, err := arg.GetField(c.opts.RevisionField)
+	if err != nil || wantRev == nil {
 		return nil // no incoming revision information: nothing to check
 	}
-	wantRev, ok := r.(int64)
-	if !ok {
-		return gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is not an int64", c.opts.RevisionField)
+	if reflect.TypeOf(wantRev) != reflect.TypeOf(curRev) {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want %T", c.opts.RevisionField, wantRev, curRev)
 	}
 	if wantRev != curRev {
-		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %d, current %d", wantRev, curRev)
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %v, current %v", wantRev, curRev)
 	}
 	return nil
 }
@@ -367,17 +726,6 @@ func getAtFieldPath(m map[string]interface{}, fp []string) (interface{}, error)
 	return m2[fp[len(fp)-1]], nil
 }
 
-// setAtFieldPath sets m's value at fp to val. It creates intermediate maps as
-// needed. It returns an error if a non-final component of fp does not denote a map.
-func setAtFieldPath(m map[string]interface{}, fp []string, val interface{}) error {
-	m2, err := getParentMap(m, fp, true)
-	if err != nil {
-		return err
-	}
-	m2[fp[len(fp)-1]] = val
-	return nil
-}
-
 // Delete the value from m at the given field path, if it exists.
 func deleteAtFieldPath(m map[string]interface{}, fp []string) {
 	m2, _ := getParentMap(m, fp, false) // ignore error
@@ -408,11 +756,37 @@ func getParentMap(m map[string]interface{}, fp []string, create bool) (map[strin
 	return m, nil
 }
 
-// As implements driver.As.
-func (c *collection) As(i interface{}) bool { return false }
+// ReportsChanges implements driver.ChangeReporter.
+func (c *collection) ReportsChanges() bool { return true }
+
+// As implements driver.As. Besides *CollectionInfo, it exposes c itself to
+// the functions of this package, like TakeSnapshot.
+func (c *collection) As(i interface{}) bool {
+	switch p := i.(type) {
+	case **CollectionInfo:
+		*p = c.info()
+		return true
+	case **collection:
+		*p = c
+		return true
+	}
+	return false
+}
 
 // As implements driver.Collection.ErrorAs.
 func (c *collection) ErrorAs(err error, i interface{}) bool { return false }
 
 // Close implements driver.Collection.Close.
-func (c *collection) Close() error { return nil }
+func (c *collection) Close() error {
+	c.stopWatchers()
+	if c.stop != nil {
+		c.closeOnce.Do(func() {
+			close(c.stop)
+			<-c.stopped
+		})
+	}
+	if c.opts.Filename != "" {
+		return c.save()
+	}
+	return nil
+}
@@ -16,39 +16,149 @@ package memdocstore
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"gocloud.dev/docstore"
 	"gocloud.dev/docstore/driver"
 	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/gcerrors"
+	"golang.org/x/xerrors"
 )
 
-type harness struct{}
+type harness struct {
+	revs        RevisionStrategy
+	indexes     []string
+	unsupported drivertest.Capabilities
+	maxSize     int
+}
 
 func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
 	return &harness{}, nil
 }
 
 func (h *harness) MakeCollection(context.Context) (driver.Collection, error) {
-	return newCollection(drivertest.KeyField, nil, nil)
+	return newCollection(drivertest.KeyField, nil, &Options{RevisionStrategy: h.revs, Indexes: h.indexes, MaxDocumentSize: h.maxSize})
 }
 
 func (h *harness) MakeTwoKeyCollection(context.Context) (driver.Collection, error) {
-	return newCollection("", drivertest.HighScoreKey, nil)
+	return newCollection("", drivertest.HighScoreKey, &Options{RevisionStrategy: h.revs, Indexes: h.indexes, MaxDocumentSize: h.maxSize})
+}
+
+func (h *harness) MakeIntKeyCollection(context.Context) (driver.Collection, error) {
+	return newCollection(drivertest.KeyField, nil, &Options{RevisionStrategy: h.revs, MaxDocumentSize: h.maxSize})
+}
+
+func (h *harness) MakeStructKeyCollection(context.Context) (driver.Collection, error) {
+	return newCollection("", drivertest.RankingKey, &Options{RevisionStrategy: h.revs, MaxDocumentSize: h.maxSize})
 }
 
 func (h *harness) MakeAlternateRevisionFieldCollection(context.Context) (driver.Collection, error) {
-	return newCollection(drivertest.KeyField, nil, &Options{RevisionField: drivertest.AlternateRevisionField})
+	return newCollection(drivertest.KeyField, nil, &Options{RevisionField: drivertest.AlternateRevisionField, RevisionStrategy: h.revs, MaxDocumentSize: h.maxSize})
 }
 
 func (*harness) BeforeDoTypes() []interface{}    { return nil }
 func (*harness) BeforeQueryTypes() []interface{} { return nil }
+func (h *harness) Capabilities() drivertest.Capabilities {
+	return drivertest.AllCapabilities &^ h.unsupported
+}
 
 func (*harness) Close() {}
 
 func TestConformance(t *testing.T) {
 	// CodecTester is nil because memdocstore has no native representation.
+	drivertest.RunConformanceTests(t, newHarness, nil, []drivertest.AsTest{verifyAs{}})
+}
+
+func BenchmarkConformance(b *testing.B) {
+	coll, err := newCollection(drivertest.KeyField, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	drivertest.RunBenchmarks(b, docstore.NewCollection(coll))
+}
+
+// TestConformanceMaxDocumentSize runs the conformance tests with a limit on the
+// size of documents, which the stress tests approach and exceed.
+func TestConformanceMaxDocumentSize(t *testing.T) {
+	newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
+		return &harness{maxSize: 64 << 10}, nil
+	}
+	drivertest.RunConformanceTests(t, newHarness, nil, nil)
+}
+
+type verifyAs struct{}
+
+func (verifyAs) Name() string {
+	return "verify As"
+}
+
+func (verifyAs) CollectionCheck(coll *docstore.Collection) error {
+	var info *CollectionInfo
+	if !coll.As(&info) {
+		return errors.New("Collection.As failed")
+	}
+	if info.RevisionField == "" {
+		return fmt.Errorf("got %+v, want a revision field", info)
+	}
+	return nil
+}
+
+func (verifyAs) QueryCheck(it *docstore.DocumentIterator) error {
+	var info *QueryInfo
+	if !it.As(&info) {
+		return errors.New("DocumentIterator.As failed")
+	}
+	if info == nil {
+		return errors.New("DocumentIterator.As returned a nil *QueryInfo")
+	}
+	return nil
+}
+
+func (verifyAs) ErrorCheck(c *docstore.Collection, err error) error {
+	var e error
+	if c.ErrorAs(err, &e) {
+		return errors.New("Collection.ErrorAs succeeded, want failure")
+	}
+	return nil
+}
+
+func TestConformanceRevisionStrategies(t *testing.T) {
+	for _, revs := range []RevisionStrategy{TimestampRevisions, HashRevisions} {
+		revs := revs
+		t.Run(revs.String(), func(t *testing.T) {
+			newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
+				return &harness{revs: revs}, nil
+			}
+			drivertest.RunConformanceTests(t, newHarness, nil, nil)
+		})
+	}
+}
+
+func TestConformanceIndexes(t *testing.T) {
+	newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
+		return &harness{indexes: []string{"Game", "Player", "Score", "Time", "n", "s"}}, nil
+	}
+	drivertest.RunConformanceTests(t, newHarness, nil, nil)
+}
+
+// TestConformanceCapabilities checks that the conformance tests run without the
+// features a harness says it lacks.
+func TestConformanceCapabilities(t *testing.T) {
+	newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
+		return &harness{unsupported: drivertest.Updates | drivertest.DeleteQueries | drivertest.UpdateQueries}, nil
+	}
 	drivertest.RunConformanceTests(t, newHarness, nil, nil)
 }
 
@@ -159,9 +269,1327 @@ func TestSortDocs(t *testing.T) {
 		{"c", false, []docmap{inorder[1], inorder[0], inorder[2]}},
 	} {
 		got := newDocs()
-		sortDocs(got, test.field, test.ascending)
+		keys := []SortKey{{FieldPath: test.field, Descending: !test.ascending}}
+		fps, err := sortKeyFieldPaths(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortDocs(got, keys, fps)
 		if diff := cmp.Diff(got, test.want); diff != "" {
 			t.Errorf("%q, asc=%t:\n%s", test.field, test.ascending, diff)
 		}
 	}
 }
+
+func TestSortKeys(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+	docs := []docmap{
+		{drivertest.KeyField: "a", "p": docmap{"level": int64(2), "name": "x"}},
+		{drivertest.KeyField: "b", "p": docmap{"level": int64(1), "name": "y"}},
+		{drivertest.KeyField: "c", "p": docmap{"level": int64(2), "name": "z"}},
+		{drivertest.KeyField: "d", "p": docmap{"name": "w"}}, // missing level
+		{drivertest.KeyField: "e", "p": docmap{"level": int64(1), "name": "v"}},
+	}
+	actions := coll.Actions()
+	for _, d := range docs {
+		actions.Put(d)
+	}
+	if err := actions.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// addKeys returns a BeforeQuery function that appends keys to the query's.
+	addKeys := func(keys ...SortKey) func(func(interface{}) bool) error {
+		return func(asFunc func(interface{}) bool) error {
+			var p *[]SortKey
+			if !asFunc(&p) {
+				return errors.New("no sort keys")
+			}
+			*p = append(*p, keys...)
+			return nil
+		}
+	}
+	for _, test := range []struct {
+		name string
+		q    *docstore.Query
+		want string
+	}{
+		{"nested", coll.Query().OrderBy("p.name", docstore.Ascending), "edabc"},
+		{"nested descending", coll.Query().OrderBy("p.name", docstore.Descending), "cbade"},
+		{"missing last", coll.Query().OrderBy("p.level", docstore.Descending).BeforeQuery(addKeys(SortKey{FieldPath: "p.name"})), "acebd"},
+		{"secondary", coll.Query().OrderBy("p.level", docstore.Ascending).BeforeQuery(addKeys(SortKey{FieldPath: "p.name", Descending: true})), "becad"},
+		{"no OrderBy", coll.Query().BeforeQuery(addKeys(SortKey{FieldPath: "p.level"}, SortKey{FieldPath: "p.name"})), "ebacd"},
+		{"nested filter", coll.Query().Where("p.level", ">", 0).OrderBy("p.level", docstore.Descending).BeforeQuery(addKeys(SortKey{FieldPath: "p.name"})), "aceb"},
+		{"limit", coll.Query().OrderBy("p.level", docstore.Ascending).Limit(2).BeforeQuery(addKeys(SortKey{FieldPath: "p.name"})), "eb"},
+	} {
+		iter := test.q.Get(ctx)
+		var got string
+		for {
+			d := docmap{}
+			err := iter.Next(ctx, d)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			got += d[drivertest.KeyField].(string)
+		}
+		iter.Stop()
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	iter := coll.Query().BeforeQuery(addKeys(SortKey{FieldPath: "p..name"})).Get(ctx)
+	defer iter.Stop()
+	if err := iter.Next(ctx, docmap{}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("bad field path: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestAs(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, &Options{Indexes: []string{"a", "b.c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+	actions := coll.Actions()
+	for i := 0; i < 5; i++ {
+		actions.Put(docmap{drivertest.KeyField: fmt.Sprint(i), "a": int64(i)})
+	}
+	if err := actions.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var info *CollectionInfo
+	if !coll.As(&info) {
+		t.Fatal("Collection.As failed")
+	}
+	want := &CollectionInfo{
+		KeyField:      drivertest.KeyField,
+		RevisionField: docstore.DefaultRevisionField,
+		Indexes:       []string{"a", "b.c"},
+		Documents:     5,
+	}
+	if diff := cmp.Diff(info, want); diff != "" {
+		t.Errorf("CollectionInfo: %s", diff)
+	}
+
+	for _, test := range []struct {
+		q    *docstore.Query
+		want *QueryInfo
+	}{
+		{
+			coll.Query().Where("a", ">", 1),
+			&QueryInfo{Index: "a", Matches: 3},
+		},
+		{
+			coll.Query().Where("a", ">", 1).OrderBy("a", docstore.Descending).Limit(2),
+			&QueryInfo{Index: "a", Ordered: true, SortKeys: []SortKey{{FieldPath: "a", Descending: true}}, Matches: 2},
+		},
+		{
+			coll.Query().Where(drivertest.KeyField, "<", "2").Limit(1),
+			&QueryInfo{Matches: 2},
+		},
+	} {
+		iter := test.q.Get(ctx)
+		var got *QueryInfo
+		if !iter.As(&got) {
+			t.Fatal("DocumentIterator.As failed")
+		}
+		iter.Stop()
+		if diff := cmp.Diff(got, test.want); diff != "" {
+			t.Errorf("QueryInfo: %s", diff)
+		}
+	}
+}
+
+func TestQueryPlan(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := coll.Put(ctx, docmap{drivertest.KeyField: k, "n": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan, err := coll.Query().Where("n", ">", 0).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &docstore.QueryPlan{
+		Description:   "full scan",
+		Scan:          docstore.ScanFull,
+		ServerFilters: []docstore.PlanFilter{{FieldPath: "n", Op: ">", Value: 0}},
+		EstimatedScan: 3,
+	}
+	if diff := cmp.Diff(plan, want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestGetOrCreate(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+
+	// Concurrent GetOrCreates on an absent document: exactly one creates it, and
+	// all of them end up with the same contents.
+	const n = 10
+	docs := make([]docmap, n)
+	errc := make(chan error, n)
+	for i := range docs {
+		docs[i] = docmap{drivertest.KeyField: "goc", "n": int64(i)}
+		go func(doc docmap) { errc <- coll.GetOrCreate(ctx, doc) }(docs[i])
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := docmap{drivertest.KeyField: "goc"}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	for i, doc := range docs {
+		if diff := cmp.Diff(doc, got); diff != "" {
+			t.Errorf("#%d: %s", i, diff)
+		}
+	}
+
+	// A missing key is an error.
+	if err := coll.GetOrCreate(ctx, docmap{"n": 1}); err == nil {
+		t.Error("missing key: got nil, want error")
+	}
+}
+
+func TestMaxDocumentSize(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, &Options{MaxDocumentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+
+	doc := docmap{drivertest.KeyField: "big", "small": "x", "large": strings.Repeat("x", 100)}
+	err = coll.Put(ctx, doc)
+	if gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Fatalf("Put: got %v, want InvalidArgument", err)
+	}
+	if !strings.Contains(err.Error(), `"large"`) {
+		t.Errorf("Put: error %q does not name the large field", err)
+	}
+
+	doc["large"] = "x"
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	err = coll.Update(ctx, doc, docstore.Mods{"large": strings.Repeat("x", 100)})
+	if gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Fatalf("Update: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx := context.Background()
+	opts := DynamoDBLimits()
+	opts.MaxWritesPerSecond = 3
+	dc, err := newCollection(drivertest.KeyField, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+
+	err = coll.Put(ctx, docmap{drivertest.KeyField: "big", "s": strings.Repeat("x", 400*1024)})
+	if gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("Put of a large document: got %v, want InvalidArgument", err)
+	}
+
+	// Longer action lists are run in parts.
+	if got := dc.(driver.ActionLimiter).MaxActions(); got != 100 {
+		t.Errorf("MaxActions: got %d, want 100", got)
+	}
+	actions := coll.Actions()
+	for i := 0; i < 101; i++ {
+		actions.Get(docmap{drivertest.KeyField: fmt.Sprint(i)})
+	}
+	var alerr docstore.ActionListError
+	if err := actions.Do(ctx); !xerrors.As(err, &alerr) || len(alerr) != 101 {
+		t.Fatalf("101 actions: got %v, want an error for each action", err)
+	}
+	if gcerrors.Code(alerr[100].Err) != gcerrors.NotFound {
+		t.Errorf("101 actions: got %v, want NotFound", alerr[100].Err)
+	}
+
+	// Longer atomic action lists fail together, before any runs.
+	acoll, err := OpenCollection(drivertest.KeyField, &Options{MaxActions: 2, AtomicActionLists: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acoll.Close()
+	actions = acoll.Actions()
+	for i := 0; i < 3; i++ {
+		actions.Put(docmap{drivertest.KeyField: fmt.Sprint(i)})
+	}
+	alerr = nil
+	if err := actions.Do(ctx); !xerrors.As(err, &alerr) || len(alerr) != 3 {
+		t.Fatalf("3 atomic actions: got %v, want an error for each action", err)
+	}
+	if gcerrors.Code(alerr[0].Err) != gcerrors.InvalidArgument {
+		t.Errorf("3 atomic actions: got %v, want InvalidArgument", alerr[0].Err)
+	}
+
+	// Writes beyond the limit are throttled; reads are not.
+	var codes []gcerrors.ErrorCode
+	for i := 0; i < 4; i++ {
+		codes = append(codes, gcerrors.Code(coll.Put(ctx, docmap{drivertest.KeyField: "k", "n": i})))
+	}
+	want := []gcerrors.ErrorCode{gcerrors.OK, gcerrors.OK, gcerrors.OK, gcerrors.ResourceExhausted}
+	if diff := cmp.Diff(codes, want); diff != "" {
+		t.Errorf("writes: %s", diff)
+	}
+	if err := coll.Get(ctx, docmap{drivertest.KeyField: "k"}); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, &Options{
+		ExpirationField: "expires",
+		SweepInterval:   time.Hour,
+		Indexes:         []string{"n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dc.(*collection)
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	for _, doc := range []docmap{
+		{drivertest.KeyField: "gone", "n": 1, "expires": past},
+		{drivertest.KeyField: "gone-unix", "n": 2, "expires": past.Unix()},
+		{drivertest.KeyField: "later", "n": 3, "expires": future},
+		{drivertest.KeyField: "never", "n": 4},
+	} {
+		if err := coll.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := coll.Get(ctx, docmap{drivertest.KeyField: "gone"}); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("Get of an expired document: got %v, want NotFound", err)
+	}
+	if err := coll.Update(ctx, docmap{drivertest.KeyField: "gone-unix"}, docstore.Mods{"n": 5}); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("Update of an expired document: got %v, want NotFound", err)
+	}
+	query := func(q *docstore.Query) []string {
+		t.Helper()
+		var keys []string
+		iter := q.Get(ctx)
+		defer iter.Stop()
+		for {
+			doc := docmap{}
+			err := iter.Next(ctx, doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, doc[drivertest.KeyField].(string))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	want := []string{"later", "never"}
+	if diff := cmp.Diff(query(coll.Query()), want); diff != "" {
+		t.Errorf("full scan: %s", diff)
+	}
+	if diff := cmp.Diff(query(coll.Query().Where("n", ">", 0)), want); diff != "" {
+		t.Errorf("index scan: %s", diff)
+	}
+
+	// An expired document can be created again.
+	if err := coll.Create(ctx, docmap{drivertest.KeyField: "gone", "n": 6}); err != nil {
+		t.Fatal(err)
+	}
+	// The sweep removes the rest.
+	c.sweep(time.Now())
+	var keys []string
+	for i := range c.shards {
+		for k := range c.shards[i].docs {
+			keys = append(keys, k.(string))
+		}
+	}
+	sort.Strings(keys)
+	if diff := cmp.Diff(keys, []string{"gone", "later", "never"}); diff != "" {
+		t.Errorf("after sweep: %s", diff)
+	}
+	if diff := cmp.Diff(query(coll.Query().Where("n", ">", 0)), []string{"gone", "later", "never"}); diff != "" {
+		t.Errorf("index after sweep: %s", diff)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	dc, err := newCollection(drivertest.KeyField, nil, &Options{ExpirationField: "expires", SweepInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dc.(*collection)
+	coll := docstore.NewCollection(dc)
+	if err := coll.Put(context.Background(), docmap{drivertest.KeyField: "k", "expires": time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	sh := c.shard("k")
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		sh.mu.RLock()
+		n := len(sh.docs)
+		sh.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expired document was not removed")
+		}
+	}
+	if err := coll.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.stopped:
+	default:
+		t.Error("sweeper still running after Close")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	coll, err := OpenCollection(drivertest.KeyField, &Options{Indexes: []string{"n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	keys := func(c *docstore.Collection) []string {
+		t.Helper()
+		var ks []string
+		iter := c.Query().Where("n", ">=", 0).OrderBy("n", docstore.Ascending).Get(ctx)
+		defer iter.Stop()
+		for {
+			doc := docmap{}
+			err := iter.Next(ctx, doc)
+			if err == io.EOF {
+				return ks
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ks = append(ks, doc[drivertest.KeyField].(string))
+		}
+	}
+	put := func(key string, n int) {
+		t.Helper()
+		if err := coll.Put(ctx, docmap{drivertest.KeyField: key, "n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("a", 1)
+	put("b", 2)
+	snap, err := TakeSnapshot(coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Len() != 2 {
+		t.Errorf("got %d documents in the snapshot, want 2", snap.Len())
+	}
+	put("a", 3)
+	put("c", 0)
+	if diff := cmp.Diff(keys(coll), []string{"c", "b", "a"}); diff != "" {
+		t.Errorf("before restore: %s", diff)
+	}
+	if err := Restore(coll, snap); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(keys(coll), []string{"a", "b"}); diff != "" {
+		t.Errorf("after restore: %s", diff)
+	}
+
+	// A snapshot can be restored to another collection.
+	other, err := OpenCollection(drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := Restore(other, snap); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(keys(other), []string{"a", "b"}); diff != "" {
+		t.Errorf("other collection: %s", diff)
+	}
+
+	if err := Clear(coll); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(coll); len(got) != 0 {
+		t.Errorf("after Clear: got %v, want none", got)
+	}
+	// The snapshot is unaffected.
+	if snap.Len() != 2 {
+		t.Errorf("got %d documents in the snapshot after Clear, want 2", snap.Len())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, &Options{ExpirationField: "expires", SweepInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dc.(*collection)
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+	if err := coll.Put(ctx, docmap{drivertest.KeyField: "before", "n": int64(0)}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Watch(coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	next := func() ChangeEvent {
+		t.Helper()
+		select {
+		case e := <-w.Events():
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return ChangeEvent{}
+		}
+	}
+	check := func(kind ChangeKind, key string, oldN, newN interface{}) {
+		t.Helper()
+		e := next()
+		if e.Kind != kind || e.Key != key {
+			t.Fatalf("got %s of %v, want %s of %s", e.Kind, e.Key, kind, key)
+		}
+		if (e.Old == nil) != (oldN == nil) || (e.New == nil) != (newN == nil) {
+			t.Fatalf("%s of %s: got old %v and new %v", kind, key, e.Old, e.New)
+		}
+		if oldN != nil && e.Old["n"] != oldN {
+			t.Errorf("%s of %s: got old n %v, want %v", kind, key, e.Old["n"], oldN)
+		}
+		if newN != nil && e.New["n"] != newN {
+			t.Errorf("%s of %s: got new n %v, want %v", kind, key, e.New["n"], newN)
+		}
+		if e.New != nil && e.New[docstore.DefaultRevisionField] == nil {
+			t.Errorf("%s of %s: new document has no revision", kind, key)
+		}
+	}
+
+	err = coll.Actions().
+		Create(docmap{drivertest.KeyField: "a", "n": int64(1)}).
+		Put(docmap{drivertest.KeyField: "b", "n": int64(2)}).
+		Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Actions in a list run concurrently, so their events may be in any order.
+	e1, e2 := next(), next()
+	if e1.Key.(string) > e2.Key.(string) {
+		e1, e2 = e2, e1
+	}
+	if e1.Kind != Created || e1.Key != "a" || e2.Kind != Created || e2.Key != "b" {
+		t.Fatalf("got %s of %v and %s of %v, want creations of a and b", e1.Kind, e1.Key, e2.Kind, e2.Key)
+	}
+	if err := coll.Replace(ctx, docmap{drivertest.KeyField: "a", "n": int64(3)}); err != nil {
+		t.Fatal(err)
+	}
+	check(Updated, "a", int64(1), int64(3))
+	if err := coll.Update(ctx, docmap{drivertest.KeyField: "a"}, docstore.Mods{"n": docstore.Increment(1)}); err != nil {
+		t.Fatal(err)
+	}
+	check(Updated, "a", int64(3), int64(4))
+	if err := coll.Delete(ctx, docmap{drivertest.KeyField: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	check(Deleted, "a", int64(4), nil)
+	// Deleting a missing document changes nothing.
+	if err := coll.Delete(ctx, docmap{drivertest.KeyField: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// Nor does a failed write.
+	if err := coll.Create(ctx, docmap{drivertest.KeyField: "b"}); gcerrors.Code(err) != gcerrors.AlreadyExists {
+		t.Fatalf("got %v, want AlreadyExists", err)
+	}
+	if err := coll.Query().Where("n", "=", 2).Update(ctx, docstore.Mods{"n": int64(5)}); err != nil {
+		t.Fatal(err)
+	}
+	check(Updated, "b", int64(2), int64(5))
+	if err := coll.Query().Where("n", "=", 5).Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(Deleted, "b", int64(5), nil)
+
+	if err := coll.Put(ctx, docmap{drivertest.KeyField: "x", "n": int64(8), "expires": time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	check(Created, "x", nil, int64(8))
+	c.sweep(time.Now())
+	check(Expired, "x", int64(8), nil)
+
+	// Restore and Clear report the difference.
+	snap, err := TakeSnapshot(coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Put(ctx, docmap{drivertest.KeyField: "before", "n": int64(6)}); err != nil {
+		t.Fatal(err)
+	}
+	check(Updated, "before", int64(0), int64(6))
+	if err := coll.Put(ctx, docmap{drivertest.KeyField: "c", "n": int64(7)}); err != nil {
+		t.Fatal(err)
+	}
+	check(Created, "c", nil, int64(7))
+	if err := Restore(coll, snap); err != nil {
+		t.Fatal(err)
+	}
+	e1, e2 = next(), next()
+	if e1.Key.(string) > e2.Key.(string) {
+		e1, e2 = e2, e1
+	}
+	if e1.Kind != Updated || e1.Key != "before" || e2.Kind != Deleted || e2.Key != "c" {
+		t.Fatalf("Restore: got %s of %v and %s of %v, want update of before and deletion of c", e1.Kind, e1.Key, e2.Kind, e2.Key)
+	}
+	if err := Clear(coll); err != nil {
+		t.Fatal(err)
+	}
+	check(Deleted, "before", int64(0), nil)
+
+	// Another watcher sees only later changes, and a stopped one sees none.
+	w2, err := Watch(coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Stop()
+	if _, ok := <-w.Events(); ok {
+		t.Error("got an event after Stop")
+	}
+	if err := coll.Put(ctx, docmap{drivertest.KeyField: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-w2.Events(); e.Kind != Created || e.Key != "d" {
+		t.Errorf("second watcher: got %s of %v, want creation of d", e.Kind, e.Key)
+	}
+
+	// Close stops the watchers.
+	if err := coll.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w2.Events(); ok {
+		t.Error("got an event after Close")
+	}
+}
+
+func TestWatchDoesNotBlockWrites(t *testing.T) {
+	ctx := context.Background()
+	coll, err := OpenCollection(drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	w, err := Watch(coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	// Writes succeed while nobody reads the events.
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := coll.Put(ctx, docmap{drivertest.KeyField: fmt.Sprint(i % 10), "n": int64(i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// The events for each key are in the order of its writes.
+	last := map[interface{}]map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		e := <-w.Events()
+		if !reflect.DeepEqual(e.Old, last[e.Key]) {
+			t.Fatalf("event %d for %v: got old %v, want the previous new document %v", i, e.Key, e.Old, last[e.Key])
+		}
+		last[e.Key] = e.New
+	}
+}
+
+func TestFilename(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "memdocstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := &Options{Filename: filepath.Join(dir, "coll.gob"), Indexes: []string{"n"}}
+	coll, err := OpenCollection(drivertest.KeyField, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	doc := docmap{
+		drivertest.KeyField: "a",
+		"n":                 int64(1),
+		"s":                 "x",
+		"t":                 when,
+		"list":              []interface{}{int64(1), "two"},
+		"m":                 map[string]interface{}{"b": true},
+		"bytes":             []byte("raw"),
+	}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	rev := doc[docstore.DefaultRevisionField]
+	if err := coll.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	coll, err = OpenCollection(drivertest.KeyField, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	got := docmap{drivertest.KeyField: "a"}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, doc); diff != "" {
+		t.Errorf("reloaded document: %s", diff)
+	}
+	// The index is rebuilt, and revisions continue from where they were.
+	var ks []string
+	iter := coll.Query().Where("n", "=", 1).Get(ctx)
+	defer iter.Stop()
+	for {
+		d := docmap{}
+		if err := iter.Next(ctx, d); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, d[drivertest.KeyField].(string))
+	}
+	if diff := cmp.Diff(ks, []string{"a"}); diff != "" {
+		t.Errorf("index query: %s", diff)
+	}
+	if err := coll.Put(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got[docstore.DefaultRevisionField].(int64) <= rev.(int64) {
+		t.Errorf("got revision %v after reloading, want more than %v", got[docstore.DefaultRevisionField], rev)
+	}
+
+	// A corrupt file is an error.
+	if err := ioutil.WriteFile(opts.Filename, []byte("junk"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCollection(drivertest.KeyField, opts); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("corrupt file: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	dc, err := newCollection(drivertest.KeyField, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := docstore.NewCollection(dc)
+	defer coll.Close()
+
+	doc := docmap{drivertest.KeyField: "cond", "Status": "pending", "n": 1}
+	if err := coll.Put(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	newDoc := func(status string) docmap {
+		return docmap{drivertest.KeyField: "cond", "Status": status, "n": 1}
+	}
+	check := func(name string, err error, want gcerrors.ErrorCode) {
+		t.Helper()
+		if err != nil {
+			err = err.(docstore.ActionListError).Unwrap()
+		}
+		if got := gcerrors.Code(err); got != want {
+			t.Errorf("%s: got %v (%v), want %v", name, got, err, want)
+		}
+	}
+
+	check("Put mismatch",
+		coll.Actions().Put(newDoc("done")).If("Status", "=", "running").Do(ctx), gcerrors.FailedPrecondition)
+	check("Put match",
+		coll.Actions().Put(newDoc("running")).If("Status", "=", "pending").If("n", ">=", 1).Do(ctx), gcerrors.OK)
+	check("Update mismatch",
+		coll.Actions().Update(newDoc(""), docstore.Mods{"n": 2}).If("n", ">", 1).Do(ctx), gcerrors.FailedPrecondition)
+	check("Delete mismatch",
+		coll.Actions().Delete(newDoc("")).If("Status", "=", "pending").Do(ctx), gcerrors.FailedPrecondition)
+	check("Delete match",
+		coll.Actions().Delete(newDoc("")).If("Status", "=", "running").Do(ctx), gcerrors.OK)
+	check("Delete missing",
+		coll.Actions().Delete(newDoc("")).If("Status", "=", "running").Do(ctx), gcerrors.OK)
+	check("Put missing",
+		coll.Actions().Put(newDoc("x")).If("Status", "=", "running").Do(ctx), gcerrors.FailedPrecondition)
+	check("Create",
+		coll.Actions().Create(newDoc("x")).If("Status", "=", "running").Do(ctx), gcerrors.InvalidArgument)
+	check("bad op",
+		coll.Actions().Put(newDoc("x")).If("Status", "!=", "running").Do(ctx), gcerrors.InvalidArgument)
+	check("empty list",
+		coll.Actions().If("Status", "=", "running").Do(ctx), gcerrors.InvalidArgument)
+}
+
+func TestRevisionStrategies(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		revs  RevisionStrategy
+		check func(interface{}) bool
+	}{
+		{CounterRevisions, func(r interface{}) bool { _, ok := r.(int64); return ok }},
+		{TimestampRevisions, func(r interface{}) bool {
+			s, ok := r.(string)
+			_, err := time.Parse(time.RFC3339Nano, s)
+			return ok && err == nil
+		}},
+		{HashRevisions, func(r interface{}) bool { s, ok := r.(string); return ok && len(s) == 64 }},
+	} {
+		t.Run(test.revs.String(), func(t *testing.T) {
+			dc, err := newCollection(drivertest.KeyField, nil, &Options{RevisionStrategy: test.revs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			coll := docstore.NewCollection(dc)
+			defer coll.Close()
+			doc := docmap{drivertest.KeyField: "k", "a": 1}
+			var revs []interface{}
+			for i := 0; i < 2; i++ {
+				// Writing the same content still changes the revision.
+				delete(doc, docstore.DefaultRevisionField)
+				if err := coll.Put(ctx, doc); err != nil {
+					t.Fatal(err)
+				}
+				rev := doc[docstore.DefaultRevisionField]
+				if !test.check(rev) {
+					t.Fatalf("bad revision %v of type %T", rev, rev)
+				}
+				revs = append(revs, rev)
+			}
+			if revs[0] == revs[1] {
+				t.Errorf("revision %v did not change", revs[0])
+			}
+		})
+	}
+}
+
+func TestKeyGenerator(t *testing.T) {
+	ctx := context.Background()
+	n := 0
+	gen := func() string { n++; return fmt.Sprintf("key%d", n) }
+	coll, err := OpenCollection(drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll = docstore.WithKeyGenerator(coll, gen)
+	defer coll.Close()
+	for _, want := range []string{"key1", "key2"} {
+		doc := docmap{"a": 1}
+		if err := coll.Create(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+		if got := doc[drivertest.KeyField]; got != want {
+			t.Errorf("got key %v, want %s", got, want)
+		}
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	// Run with -race to check that collections are safe for concurrent use.
+	ctx := context.Background()
+	coll, err := OpenCollection(drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	const (
+		nWorkers = 8
+		nDocs    = 50
+	)
+	// Create the documents the workers update.
+	for i := 0; i < nDocs; i++ {
+		if err := coll.Put(ctx, docmap{drivertest.KeyField: fmt.Sprintf("k%d", i), "n": int64(0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < nWorkers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < nDocs; i++ {
+				key := fmt.Sprintf("k%d", i)
+				actions := coll.Actions().
+					Put(docmap{drivertest.KeyField: fmt.Sprintf("w%d-%d", w, i), "n": int64(i)}).
+					Update(docmap{drivertest.KeyField: key}, docstore.Mods{"n": docstore.Increment(1)}).
+					Get(docmap{drivertest.KeyField: key})
+				if err := actions.Do(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+				iter := coll.Query().Where("n", ">", int64(0)).Get(ctx)
+				err := iter.Next(ctx, docmap{})
+				iter.Stop()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := coll.Query().Where("n", "<", int64(0)).Update(ctx, docstore.Mods{"x": 1}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// Every increment happened.
+	for i := 0; i < nDocs; i++ {
+		got := docmap{drivertest.KeyField: fmt.Sprintf("k%d", i)}
+		if err := coll.Get(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if got["n"] != int64(nWorkers) {
+			t.Errorf("%s: got n = %v, want %d", got[drivertest.KeyField], got["n"], nWorkers)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	ctx := context.Background()
+	plain, err := OpenCollection(drivertest.KeyField, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	indexed, err := OpenCollection(drivertest.KeyField, &Options{Indexes: []string{"n", "a.b", "n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexed.Close()
+
+	// Give the two collections the same documents, by way of every kind of
+	// write.
+	for _, coll := range []*docstore.Collection{plain, indexed} {
+		for i := 0; i < 20; i++ {
+			doc := docmap{drivertest.KeyField: fmt.Sprintf("k%02d", i), "n": i % 7, "a": docmap{"b": fmt.Sprint(i % 3)}}
+			if i%5 == 0 {
+				doc["n"] = "s"
+			}
+			if err := coll.Put(ctx, doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := coll.Actions().
+			Delete(docmap{drivertest.KeyField: "k01"}).
+			Update(docmap{drivertest.KeyField: "k02"}, docstore.Mods{"n": 100, "a.b": nil}).
+			Replace(docmap{drivertest.KeyField: "k03", "n": 2.5}).
+			Create(docmap{drivertest.KeyField: "k99", "n": -1}).
+			Do(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := coll.Query().Where("n", "=", 6).Update(ctx, docstore.Mods{"n": docstore.Increment(10)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := coll.Query().Where("n", "=", 4).Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(coll *docstore.Collection, q func(*docstore.Query) *docstore.Query) []string {
+		t.Helper()
+		iter := q(coll.Query()).Get(ctx)
+		defer iter.Stop()
+		var keys []string
+		for {
+			doc := docmap{}
+			err := iter.Next(ctx, doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, doc[drivertest.KeyField].(string))
+		}
+		return keys
+	}
+	for _, test := range []struct {
+		name      string
+		q         func(*docstore.Query) *docstore.Query
+		ordered   bool
+		wantIndex string
+	}{
+		{"eq", func(q *docstore.Query) *docstore.Query { return q.Where("n", "=", 3) }, false, "n"},
+		{"float", func(q *docstore.Query) *docstore.Query { return q.Where("n", ">", 2.1) }, false, "n"},
+		{"range", func(q *docstore.Query) *docstore.Query { return q.Where("n", ">=", 1).Where("n", "<", 5) }, false, "n"},
+		{"empty", func(q *docstore.Query) *docstore.Query { return q.Where("n", ">", 5).Where("n", "<", 3) }, false, "n"},
+		{"string", func(q *docstore.Query) *docstore.Query { return q.Where("n", "<=", "s") }, false, "n"},
+		{"nested", func(q *docstore.Query) *docstore.Query { return q.Where("a.b", "=", "1").Where("n", "<", 100) }, false, "a.b"},
+		{"prefix", func(q *docstore.Query) *docstore.Query { return q.WhereHasPrefix("a.b", "1") }, false, ""},
+		{"ordered", func(q *docstore.Query) *docstore.Query { return q.Where("n", ">", 0).OrderBy("n", docstore.Ascending) }, true, "n"},
+		{"desc", func(q *docstore.Query) *docstore.Query {
+			return q.Where("n", "<", 10).OrderBy("n", docstore.Descending).Limit(4)
+		}, true, "n"},
+		{"unindexed", func(q *docstore.Query) *docstore.Query { return q.Where("x", "=", 1) }, false, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := run(indexed, test.q)
+			want := run(plain, test.q)
+			if !test.ordered {
+				sort.Strings(got)
+				sort.Strings(want)
+			} else {
+				// Documents with equal values may come in any order.
+				got, want = valuesOf(t, indexed, got), valuesOf(t, plain, want)
+			}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("indexed results differ from unindexed (-got +want):\n%s", diff)
+			}
+			plan, err := test.q(indexed.Query()).Plan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Index != test.wantIndex {
+				t.Errorf("got index %q, want %q", plan.Index, test.wantIndex)
+			}
+			if wantFull := test.wantIndex == ""; (plan.Scan == docstore.ScanFull) != wantFull {
+				t.Errorf("got Scan %v, want full scan %t", plan.Scan, wantFull)
+			}
+		})
+	}
+
+	plan, err := indexed.Query().Where("n", "=", 3).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &docstore.QueryPlan{
+		Description:   "index scan",
+		Index:         "n",
+		Scan:          docstore.ScanRange,
+		ServerFilters: []docstore.PlanFilter{{FieldPath: "n", Op: "=", Value: 3}},
+		EstimatedScan: 1,
+	}
+	if diff := cmp.Diff(plan, want); diff != "" {
+		t.Error(diff)
+	}
+
+	if _, err := OpenCollection(drivertest.KeyField, &Options{Indexes: []string{"a..b"}}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("bad index: got %v, want InvalidArgument", err)
+	}
+}
+
+// valuesOf returns the values of the n field of the documents with keys.
+func valuesOf(t *testing.T, coll *docstore.Collection, keys []string) []string {
+	t.Helper()
+	var vals []string
+	for _, k := range keys {
+		doc := docmap{drivertest.KeyField: k}
+		if err := coll.Get(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+		vals = append(vals, fmt.Sprint(doc["n"]))
+	}
+	return vals
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	errFlaky := errors.New("flaky")
+	coll, err := OpenCollection(drivertest.KeyField, &Options{Faults: []Fault{
+		{Ops: []string{"Put"}, Code: gcerrors.Internal},
+		{Ops: []string{"Delete"}, Err: errFlaky},
+		{Ops: []string{"Update"}, Latency: time.Hour},
+		{Ops: []string{GetQueryOp}, PerSecond: 2, Code: gcerrors.ResourceExhausted},
+		{Ops: []string{"Replace"}, Probability: 0.5, Code: gcerrors.Canceled},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+
+	doc := docmap{drivertest.KeyField: "a", "n": 1}
+	if err := coll.Put(ctx, doc); gcerrors.Code(err) != gcerrors.Internal {
+		t.Errorf("Put: got %v, want Internal", err)
+	}
+	// Other actions run as usual.
+	if err := coll.Create(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Get(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Delete(ctx, doc); !xerrors.Is(err, errFlaky) {
+		t.Errorf("Delete: got %v, want %v", err, errFlaky)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := coll.Update(tctx, doc, docstore.Mods{"n": 2}); gcerrors.Code(err) != gcerrors.DeadlineExceeded {
+		t.Errorf("Update: got %v, want DeadlineExceeded", err)
+	}
+
+	var codes []gcerrors.ErrorCode
+	for i := 0; i < 3; i++ {
+		iter := coll.Query().Get(ctx)
+		err := iter.Next(ctx, docmap{})
+		iter.Stop()
+		codes = append(codes, gcerrors.Code(err))
+	}
+	want := []gcerrors.ErrorCode{gcerrors.OK, gcerrors.OK, gcerrors.ResourceExhausted}
+	if diff := cmp.Diff(codes, want); diff != "" {
+		t.Errorf("queries: %s", diff)
+	}
+
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if err := coll.Replace(ctx, docmap{drivertest.KeyField: "a", "n": i}); err != nil {
+			if gcerrors.Code(err) != gcerrors.Canceled {
+				t.Fatal(err)
+			}
+			failed++
+		}
+	}
+	if failed < 50 || failed > 150 {
+		t.Errorf("%d of 200 Replaces failed with probability 0.5", failed)
+	}
+}
+
+func TestCopyOnRead(t *testing.T) {
+	ctx := context.Background()
+	coll, err := OpenCollection("key", &Options{CopyOnRead: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	if err := coll.Put(ctx, docmap{
+		"key":   "a",
+		"m":     docmap{"x": int64(1)},
+		"list":  []interface{}{"y"},
+		"bytes": []byte("z"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// modify changes the parts of a document that could be shared with the
+	// stored one.
+	modify := func(got docmap) {
+		got["m"].(docmap)["x"] = int64(2)
+		got["list"].([]interface{})[0] = "changed"
+		got["bytes"].([]byte)[0] = '!'
+	}
+	got := docmap{"key": "a"}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	modify(got)
+	iter := coll.Query().Get(ctx)
+	got = docmap{}
+	err = iter.Next(ctx, got)
+	iter.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify(got)
+
+	got = docmap{"key": "a"}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	want := docmap{
+		"key":                         "a",
+		"m":                           docmap{"x": int64(1)},
+		"list":                        []interface{}{"y"},
+		"bytes":                       []byte("z"),
+		docstore.DefaultRevisionField: got[docstore.DefaultRevisionField],
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestAtomicActionLists(t *testing.T) {
+	ctx := context.Background()
+	coll, err := OpenCollection("key", &Options{AtomicActionLists: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	w, err := Watch(coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if err := coll.Put(ctx, docmap{"key": "a", "n": int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-w.Events(); e.Kind != Created {
+		t.Fatalf("got %v, want Created", e.Kind)
+	}
+
+	// The third action fails, so the others are rolled back or not run.
+	put := docmap{"key": "b", "n": int64(2)}
+	got := docmap{"key": "a"}
+	err = coll.Actions().
+		Update(docmap{"key": "a"}, docstore.Mods{"n": int64(10)}).
+		Put(put).
+		Replace(docmap{"key": "missing"}).
+		Create(docmap{"key": "c", "n": int64(3)}).
+		Get(got).
+		Do(ctx)
+	alerr, ok := err.(docstore.ActionListError)
+	if !ok || len(alerr) != 5 {
+		t.Fatalf("got %v, want an error for every action", err)
+	}
+	for _, e := range alerr {
+		want := gcerrors.Canceled
+		if e.Index == 2 {
+			want = gcerrors.NotFound
+		}
+		if gcerrors.Code(e.Err) != want {
+			t.Errorf("action %d: got %v, want %s", e.Index, e.Err, want)
+		}
+	}
+	if _, ok := put[docstore.DefaultRevisionField]; ok {
+		t.Error("rolled-back Put set the revision field")
+	}
+	check := func(want map[string]int64) {
+		t.Helper()
+		iter := coll.Query().Get(ctx)
+		defer iter.Stop()
+		gotN := map[string]int64{}
+		for {
+			d := docmap{}
+			err := iter.Next(ctx, d)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotN[d["key"].(string)] = d["n"].(int64)
+		}
+		if diff := cmp.Diff(gotN, want); diff != "" {
+			t.Error(diff)
+		}
+	}
+	check(map[string]int64{"a": 1})
+
+	// A list whose actions all succeed applies all its writes, and reports them
+	// to watchers.
+	got = docmap{"key": "a"}
+	if err := coll.Actions().
+		Update(docmap{"key": "a"}, docstore.Mods{"n": int64(10)}).
+		Put(put).
+		Get(got).
+		Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]int64{"a": 10, "b": 2})
+	if got["n"] != int64(10) {
+		t.Errorf("Get after Update: got %v, want 10", got["n"])
+	}
+	if _, ok := put[docstore.DefaultRevisionField]; !ok {
+		t.Error("Put did not set the revision field")
+	}
+	var kinds []string
+	for i := 0; i < 2; i++ {
+		e := <-w.Events()
+		kinds = append(kinds, fmt.Sprintf("%s %v", e.Kind, e.Key))
+	}
+	sort.Strings(kinds)
+	if diff := cmp.Diff(kinds, []string{"Created b", "Updated a"}); diff != "" {
+		t.Errorf("events: %s", diff)
+	}
+}
+
+func TestReportChanges(t *testing.T) {
+	ctx := context.Background()
+	coll, err := OpenCollection("key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	if err := coll.Put(ctx, docmap{
+		"key":   "a",
+		"n":     int64(1),
+		"s":     "x",
+		"m":     docmap{"x": int64(1)},
+		"gone":  true,
+		"other": "unchanged",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var cs docstore.ChangeSet
+	err = coll.Actions().Update(docmap{"key": "a"}, docstore.Mods{
+		"n":    docstore.Increment(2),
+		"s":    "y",
+		"m.x":  int64(5),
+		"gone": nil,
+		"new":  "z",
+	}).ReportChanges(&cs).Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := docstore.ChangeSet{
+		"n":    {Old: int64(1), New: int64(3)},
+		"s":    {Old: "x", New: "y"},
+		"m.x":  {Old: int64(1), New: int64(5)},
+		"gone": {Old: true, New: nil},
+		"new":  {Old: nil, New: "z"},
+	}
+	if diff := cmp.Diff(cs, want); diff != "" {
+		t.Error(diff)
+	}
+
+	// A failed Update leaves the ChangeSet alone.
+	cs = nil
+	err = coll.Actions().Update(docmap{"key": "a"}, docstore.Mods{"s": "w"}).
+		If("s", "=", "x").ReportChanges(&cs).Do(ctx)
+	if gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("got %v, want FailedPrecondition", err)
+	}
+	if cs != nil {
+		t.Errorf("got %v after a failed Update, want nil", cs)
+	}
+}
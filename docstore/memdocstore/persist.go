@@ -0,0 +1,90 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gocloud.dev/internal/gcerr"
+)
+
+func init() {
+	// The types of stored values that gob does not know about already.
+	gob.Register([]interface{}(nil))
+	gob.Register(map[string]interface{}(nil))
+	gob.Register(time.Time{})
+}
+
+// savedCollection is the contents of a collection's file.
+type savedCollection struct {
+	Docs     map[interface{}]map[string]interface{}
+	Revision int64 // the collection's revision counter
+}
+
+// load reads the documents of c from its file, if the file exists.
+func (c *collection) load() error {
+	f, err := os.Open(c.opts.Filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var saved savedCollection
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return gcerr.Newf(gcerr.InvalidArgument, err, "memdocstore: reading %s", c.opts.Filename)
+	}
+	c.replaceAll(saved.Docs)
+	c.revMu.Lock()
+	c.curRevision = saved.Revision
+	c.revMu.Unlock()
+	return nil
+}
+
+// save writes the documents of c to its file, replacing the file only once
+// they are all written.
+func (c *collection) save() error {
+	c.lockAll()
+	saved := savedCollection{Docs: map[interface{}]map[string]interface{}{}}
+	for i := range c.shards {
+		for k, d := range c.shards[i].docs {
+			saved.Docs[k] = d
+		}
+	}
+	c.unlockAll()
+	c.revMu.Lock()
+	saved.Revision = c.curRevision
+	c.revMu.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(c.opts.Filename), filepath.Base(c.opts.Filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(&saved); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return gcerr.Newf(gcerr.InvalidArgument, err, "memdocstore: writing %s", c.opts.Filename)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), c.opts.Filename)
+}
@@ -17,154 +17,172 @@ package memdocstore
 import (
 	"context"
 	"io"
-	"math/big"
-	"reflect"
-	"sort"
 	"strings"
 	"time"
 
 	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/gobcodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
 )
 
-func (c *collection) RunGetQuery(_ context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+// eval evaluates filters and sort orders on the stored documents.
+var eval = mapdoc.Evaluator{}
+
+// SupportsFilter implements driver.SupportsFilter.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	if err := c.faults.inject(ctx, GetQueryOp); err != nil {
+		return nil, err
+	}
+	var keys []SortKey
+	if q.OrderByField != "" {
+		keys = []SortKey{{FieldPath: q.OrderByField, Descending: !q.OrderAscending}}
+	}
 	if q.BeforeQuery != nil {
-		if err := q.BeforeQuery(func(interface{}) bool { return false }); err != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**[]SortKey)
+			if !ok {
+				return false
+			}
+			*p = &keys
+			return true
+		}
+		if err := q.BeforeQuery(asFunc); err != nil {
 			return nil, err
 		}
 	}
+	fps, err := sortKeyFieldPaths(keys)
+	if err != nil {
+		return nil, err
+	}
+	// An index can supply the order only if it is the order of a single key.
+	orderBy, ascending := "", q.OrderAscending
+	if len(keys) == 1 {
+		orderBy, ascending = keys[0].FieldPath, !keys[0].Descending
+	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
+	// Stored documents are never modified, so they can be decoded after the
+	// shard locks are released.
 	var resultDocs []map[string]interface{}
-	for _, doc := range c.docs {
-		if q.Limit > 0 && len(resultDocs) == q.Limit {
-			break
-		}
-		if filtersMatch(q.Filters, doc) {
-			resultDocs = append(resultDocs, doc)
+	now := time.Now()
+	c.idxMu.RLock()
+	scan := c.chooseIndex(q, orderBy)
+	var entries []indexEntry
+	if scan != nil {
+		entries = scan.read(ascending)
+	}
+	c.idxMu.RUnlock()
+	if scan != nil {
+		resultDocs = c.lookupEntries(scan, entries, q, now)
+	} else {
+		for i := range c.shards {
+			sh := &c.shards[i]
+			sh.mu.RLock()
+			for _, doc := range sh.docs {
+				if eval.FiltersMatch(q.Filters, doc) && !c.expired(doc, now) {
+					resultDocs = append(resultDocs, doc)
+				}
+			}
+			sh.mu.RUnlock()
 		}
 	}
-	if q.OrderByField != "" {
-		sortDocs(resultDocs, q.OrderByField, q.OrderAscending)
+	info := &QueryInfo{SortKeys: keys, Matches: len(resultDocs)}
+	if scan != nil {
+		info.Index = scan.x.name
+		info.Ordered = scan.ordered
+	}
+	if len(keys) > 0 && (scan == nil || !scan.ordered) {
+		sortDocs(resultDocs, keys, fps)
+	}
+	if q.Limit > 0 && len(resultDocs) > q.Limit {
+		resultDocs = resultDocs[:q.Limit]
 	}
 	// Include the key field in the field paths if there is one.
-	var fps [][]string
+	fieldPaths := q.FieldPaths
 	if len(q.FieldPaths) > 0 && c.keyField != "" {
-		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
-	} else {
-		fps = q.FieldPaths
+		fieldPaths = append([][]string{{c.keyField}}, q.FieldPaths...)
 	}
 
 	return &docIterator{
 		docs:       resultDocs,
-		fieldPaths: fps,
+		copy:       c.readCopy,
+		fieldPaths: fieldPaths,
 		revField:   c.opts.RevisionField,
+		info:       info,
 	}, nil
 }
 
-func filtersMatch(fs []driver.Filter, doc map[string]interface{}) bool {
-	for _, f := range fs {
-		if !filterMatches(f, doc) {
-			return false
+// lookupEntries returns the documents of entries, read from scan's index,
+// that match q. A document whose indexed value has changed since the entries
+// were read is skipped: it has an entry elsewhere in the index now.
+func (c *collection) lookupEntries(scan *indexScan, entries []indexEntry, q *driver.Query, now time.Time) []map[string]interface{} {
+	var docs []map[string]interface{}
+	for _, e := range entries {
+		if scan.ordered && q.Limit > 0 && len(docs) == q.Limit {
+			break
+		}
+		sh := c.shard(e.key)
+		sh.mu.RLock()
+		doc := sh.docs[e.key]
+		sh.mu.RUnlock()
+		if v, ok := scan.x.indexValue(doc); !ok || compareIndexValues(v, e.val) != 0 {
+			continue
+		}
+		if eval.FiltersMatch(q.Filters, doc) && !c.expired(doc, now) {
+			docs = append(docs, doc)
 		}
 	}
-	return true
+	return docs
 }
 
-func filterMatches(f driver.Filter, doc map[string]interface{}) bool {
-	docval, err := getAtFieldPath(doc, f.FieldPath)
-	// missing or bad field path => no match
-	if err != nil {
-		return false
-	}
-	c, ok := compare(docval, f.Value)
-	if !ok {
-		return false
-	}
-	return applyComparison(f.Op, c)
-}
+// A SortKey is a key by which memdocstore sorts the results of a query.
+//
+// The BeforeQuery function of a get query can convert its argument to
+// *[]SortKey, which points to the query's sort keys. If the query has an
+// OrderBy clause, the slice holds its key. Appending to the slice adds
+// secondary keys, which order documents that are equal by the keys before
+// them; replacing its elements changes the order entirely.
+type SortKey struct {
+	// FieldPath is the path of the field to sort by, with components
+	// separated by dots.
+	FieldPath string
 
-// op is one of the five permitted docstore operators ("=", "<", etc.)
-// c is the result of strings.Compare or the like.
-// TODO(jba): dedup from firedocstore/query?
-func applyComparison(op string, c int) bool {
-	switch op {
-	case driver.EqualOp:
-		return c == 0
-	case ">":
-		return c > 0
-	case "<":
-		return c < 0
-	case ">=":
-		return c >= 0
-	case "<=":
-		return c <= 0
-	default:
-		panic("bad op")
-	}
+	// Descending reverses the order.
+	Descending bool
 }
 
-func compare(x1, x2 interface{}) (int, bool) {
-	v1 := reflect.ValueOf(x1)
-	v2 := reflect.ValueOf(x2)
-	if v1.Kind() == reflect.String && v2.Kind() == reflect.String {
-		return strings.Compare(v1.String(), v2.String()), true
-	}
-	bf1 := toBigFloat(v1)
-	bf2 := toBigFloat(v2)
-	if bf1 != nil && bf2 != nil {
-		return bf1.Cmp(bf2), true
-	}
-	if t1, ok := x1.(time.Time); ok {
-		if t2, ok := x2.(time.Time); ok {
-			s := t1.Sub(t2)
-			switch {
-			case s < 0:
-				return -1, true
-			case s > 0:
-				return 1, true
-			default:
-				return 0, true
+// sortKeyFieldPaths returns the field paths of keys, split into components.
+func sortKeyFieldPaths(keys []SortKey) ([][]string, error) {
+	fps := make([][]string, len(keys))
+	for i, k := range keys {
+		fps[i] = strings.Split(k.FieldPath, ".")
+		for _, c := range fps[i] {
+			if c == "" {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "memdocstore: bad sort key field path %q", k.FieldPath)
 			}
 		}
 	}
-	return 0, false
-}
-
-func toBigFloat(x reflect.Value) *big.Float {
-	var f big.Float
-	switch x.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		f.SetInt64(x.Int())
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		f.SetUint64(x.Uint())
-	case reflect.Float32, reflect.Float64:
-		f.SetFloat64(x.Float())
-	default:
-		return nil
-	}
-	return &f
+	return fps, nil
 }
 
-func sortDocs(docs []map[string]interface{}, field string, asc bool) {
-	sort.Slice(docs, func(i, j int) bool {
-		c, ok := compare(docs[i][field], docs[j][field])
-		if !ok {
-			return false
-		}
-		if asc {
-			return c < 0
-		} else {
-			return c > 0
-		}
-	})
+// sortDocs sorts docs by keys, whose field paths are fps. A document that is
+// missing a key's field sorts after those that have it, in either direction.
+func sortDocs(docs []map[string]interface{}, keys []SortKey, fps [][]string) {
+	mkeys := make([]mapdoc.SortKey, len(keys))
+	for i, k := range keys {
+		mkeys[i] = mapdoc.SortKey{FieldPath: fps[i], Descending: k.Descending}
+	}
+	eval.SortDocsByKeys(docs, mkeys)
 }
 
 type docIterator struct {
 	docs       []map[string]interface{}
+	copy       func(map[string]interface{}) map[string]interface{}
 	fieldPaths [][]string
 	revField   string
+	info       *QueryInfo
 	err        error
 }
 
@@ -176,7 +194,7 @@ func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
 		it.err = io.EOF
 		return it.err
 	}
-	if err := decodeDoc(it.docs[0], doc, it.fieldPaths, it.revField); err != nil {
+	if err := gobcodec.DecodeDoc(it.copy(it.docs[0]), doc, it.fieldPaths, it.revField); err != nil {
 		it.err = err
 		return it.err
 	}
@@ -186,43 +204,108 @@ func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
 
 func (it *docIterator) Stop() { it.err = io.EOF }
 
-func (it *docIterator) As(i interface{}) bool { return false }
+func (it *docIterator) As(i interface{}) bool {
+	p, ok := i.(**QueryInfo)
+	if !ok {
+		return false
+	}
+	*p = it.info
+	return true
+}
 
-func (c *collection) QueryPlan(q *driver.Query) (string, error) {
-	return "", nil
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	c.idxMu.RLock()
+	scan := c.chooseIndex(q, q.OrderByField)
+	c.idxMu.RUnlock()
+	if scan != nil {
+		desc := "index scan"
+		if scan.ordered {
+			desc = "ordered index scan"
+		}
+		return &driver.QueryPlan{
+			Description:   desc,
+			Index:         scan.x.name,
+			Scan:          driver.ScanRange,
+			ServerFilters: q.Filters,
+			EstimatedScan: int64(scan.hi - scan.lo),
+		}, nil
+	}
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.RLock()
+		n += len(sh.docs)
+		sh.mu.RUnlock()
+	}
+	// Without a usable index, the query examines every document.
+	return &driver.QueryPlan{
+		Description:   "full scan",
+		Scan:          driver.ScanFull,
+		ServerFilters: q.Filters,
+		EstimatedScan: int64(n),
+	}, nil
 }
 
 func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	if err := c.faults.inject(ctx, DeleteQueryOp); err != nil {
+		return err
+	}
 	if q.BeforeQuery != nil {
 		if err := q.BeforeQuery(func(interface{}) bool { return false }); err != nil {
 			return err
 		}
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	for key, doc := range c.docs {
-		if filtersMatch(q.Filters, doc) {
-			delete(c.docs, key)
+	now := time.Now()
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for key, doc := range sh.docs {
+			if c.expired(doc, now) {
+				delete(sh.docs, key)
+				c.changed(Expired, key, doc, nil)
+			} else if eval.FiltersMatch(q.Filters, doc) {
+				delete(sh.docs, key)
+				c.changed(Deleted, key, doc, nil)
+			}
 		}
+		sh.mu.Unlock()
 	}
 	return nil
 }
 
 func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	if err := c.faults.inject(ctx, UpdateQueryOp); err != nil {
+		return err
+	}
 	if q.BeforeQuery != nil {
 		if err := q.BeforeQuery(func(interface{}) bool { return false }); err != nil {
 			return err
 		}
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	for _, doc := range c.docs {
-		if filtersMatch(q.Filters, doc) {
-			if err := c.update(doc, mods); err != nil {
+	now := time.Now()
+	for i := range c.shards {
+		if err := c.updateShard(&c.shards[i], q.Filters, mods, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateShard applies mods to the documents in sh that match fs and have not
+// expired by now.
+func (c *collection) updateShard(sh *shard, fs []driver.Filter, mods []driver.Mod, now time.Time) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for key, doc := range sh.docs {
+		if eval.FiltersMatch(fs, doc) && !c.expired(doc, now) {
+			newDoc, _, err := c.update(doc, mods)
+			if err != nil {
 				return err
 			}
+			sh.docs[key] = newDoc
+			c.changed(Updated, key, doc, newDoc)
 		}
 	}
 	return nil
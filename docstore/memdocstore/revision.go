@@ -0,0 +1,132 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"time"
+)
+
+// A RevisionStrategy determines the values that a collection uses as document
+// revisions.
+type RevisionStrategy int
+
+const (
+	// CounterRevisions, the default, uses int64 values from a counter that is
+	// incremented on each write to the collection.
+	CounterRevisions RevisionStrategy = iota
+
+	// TimestampRevisions uses the time of each write, as a string in RFC 3339
+	// format with nanosecond precision, like Firestore's update times. The times
+	// of writes to a collection are strictly increasing, so no two writes have
+	// the same revision.
+	TimestampRevisions
+
+	// HashRevisions uses a hex-encoded SHA-256 hash of the document's content,
+	// excluding the revision field. The hash also covers a counter that is
+	// incremented on each write to the collection, so that every write changes
+	// the revision, even one that leaves the content unchanged.
+	HashRevisions
+)
+
+func (s RevisionStrategy) String() string {
+	switch s {
+	case CounterRevisions:
+		return "CounterRevisions"
+	case TimestampRevisions:
+		return "TimestampRevisions"
+	case HashRevisions:
+		return "HashRevisions"
+	default:
+		return fmt.Sprintf("RevisionStrategy(%d)", int(s))
+	}
+}
+
+// timestampLayout is time.RFC3339Nano, but with trailing zeroes kept so that
+// revisions sort in time order.
+const timestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// changeRevision sets the revision field of doc, a document being written.
+func (c *collection) changeRevision(doc map[string]interface{}) {
+	c.revMu.Lock()
+	defer c.revMu.Unlock()
+	switch c.opts.RevisionStrategy {
+	case TimestampRevisions:
+		t := time.Now().UTC()
+		if !t.After(c.lastWriteTime) {
+			t = c.lastWriteTime.Add(time.Nanosecond)
+		}
+		c.lastWriteTime = t
+		doc[c.opts.RevisionField] = t.Format(timestampLayout)
+	case HashRevisions:
+		c.curRevision++
+		delete(doc, c.opts.RevisionField)
+		doc[c.opts.RevisionField] = hashDocument(doc, c.curRevision)
+	default:
+		c.curRevision++
+		doc[c.opts.RevisionField] = c.curRevision
+	}
+}
+
+// hashDocument returns a hash of the encoded document doc and the write counter n.
+func hashDocument(doc map[string]interface{}, n int64) string {
+	h := sha256.New()
+	hashValue(h, n)
+	hashValue(h, doc)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashValue writes an unambiguous representation of the encoded value v to h.
+// Each value is preceded by a tag for its type, and strings by their length.
+func hashValue(h hash.Hash, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		fmt.Fprint(h, "n")
+	case bool:
+		fmt.Fprintf(h, "b%t", v)
+	case int64:
+		fmt.Fprintf(h, "i%d;", v)
+	case float64:
+		fmt.Fprintf(h, "f%b;", v)
+	case string:
+		fmt.Fprintf(h, "s%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(h, "y%d:%s", len(v), v)
+	case time.Time:
+		fmt.Fprintf(h, "t%s;", v.UTC().Format(timestampLayout))
+	case []interface{}:
+		fmt.Fprintf(h, "l%d:", len(v))
+		for _, e := range v {
+			hashValue(h, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(h, "m%d:", len(v))
+		for _, k := range keys {
+			fmt.Fprintf(h, "%d:%s", len(k), k)
+			hashValue(h, v[k])
+		}
+	default:
+		panic(fmt.Sprintf("memdocstore: unexpected encoded value %v of type %T", v, v))
+	}
+}
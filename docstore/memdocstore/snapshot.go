@@ -0,0 +1,130 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"sort"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/internal/gcerr"
+)
+
+// A Snapshot is a copy of the documents of a collection at one time. It can
+// be restored to the collection, or to another memdocstore collection with
+// the same key, to undo the changes made after it was taken.
+type Snapshot struct {
+	docs map[interface{}]map[string]interface{}
+}
+
+// Len returns the number of documents in s.
+func (s *Snapshot) Len() int { return len(s.docs) }
+
+// TakeSnapshot returns a Snapshot of the documents of coll, which must be a
+// memdocstore collection. It is consistent: no write is partly included.
+// Taking a snapshot is fast, because stored documents are never modified and
+// so need not be copied.
+func TakeSnapshot(coll *docstore.Collection) (*Snapshot, error) {
+	c, err := fromCollection(coll)
+	if err != nil {
+		return nil, err
+	}
+	c.lockAll()
+	defer c.unlockAll()
+	s := &Snapshot{docs: map[interface{}]map[string]interface{}{}}
+	for i := range c.shards {
+		for k, d := range c.shards[i].docs {
+			s.docs[k] = d
+		}
+	}
+	return s, nil
+}
+
+// Restore replaces the documents of coll, which must be a memdocstore
+// collection, with those in s. The restored documents keep the revisions they
+// had when s was taken.
+func Restore(coll *docstore.Collection, s *Snapshot) error {
+	c, err := fromCollection(coll)
+	if err != nil {
+		return err
+	}
+	c.replaceAll(s.docs)
+	return nil
+}
+
+// Clear deletes every document of coll, which must be a memdocstore
+// collection.
+func Clear(coll *docstore.Collection) error {
+	c, err := fromCollection(coll)
+	if err != nil {
+		return err
+	}
+	c.replaceAll(nil)
+	return nil
+}
+
+// fromCollection returns the driver collection of coll.
+func fromCollection(coll *docstore.Collection) (*collection, error) {
+	var c *collection
+	if !coll.As(&c) {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "memdocstore: not a memdocstore collection")
+	}
+	return c, nil
+}
+
+func (c *collection) lockAll() {
+	for i := range c.shards {
+		c.shards[i].mu.Lock()
+	}
+}
+
+func (c *collection) unlockAll() {
+	for i := range c.shards {
+		c.shards[i].mu.Unlock()
+	}
+}
+
+// replaceAll replaces the documents of c with docs, rebuilds the indexes and
+// reports the changes to watchers.
+func (c *collection) replaceAll(docs map[interface{}]map[string]interface{}) {
+	c.lockAll()
+	defer c.unlockAll()
+	old := map[interface{}]map[string]interface{}{}
+	for i := range c.shards {
+		for k, d := range c.shards[i].docs {
+			old[k] = d
+		}
+		c.shards[i].docs = map[interface{}]map[string]interface{}{}
+	}
+	for k, d := range docs {
+		c.shard(k).docs[k] = d
+	}
+	c.notifyAll(c.replacedEvents(old, docs))
+	if len(c.indexes) == 0 {
+		return
+	}
+	c.idxMu.Lock()
+	defer c.idxMu.Unlock()
+	for _, x := range c.indexes {
+		x.entries = nil
+		for k, d := range docs {
+			if v, ok := x.indexValue(d); ok {
+				x.entries = append(x.entries, indexEntry{v, k})
+			}
+		}
+		sort.SliceStable(x.entries, func(i, j int) bool {
+			return compareIndexValues(x.entries[i].val, x.entries[j].val) < 0
+		})
+	}
+}
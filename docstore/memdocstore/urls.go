@@ -18,10 +18,13 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 
 	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
 )
 
 func init() {
@@ -35,23 +38,56 @@ const Scheme = "mem"
 // URLOpener opens URLs like "mem://collection/_id".
 //
 // The URL's host is the name of the collection.
-// The URL's path is used as the keyField.
+// The URL's path is used as the keyField. A path with several field names
+// separated by commas, like "mem://scores/Game,Player", makes a collection
+// whose key is composed of the values of those fields, as if opened by
+// OpenCollectionWithKeyFunc. Each document must have all of them.
 //
-// No query parameters are supported.
+// The following query parameters are supported:
+//   - revision_field: the name of the revision field; see Options.RevisionField.
+//   - filename: the file that holds the documents between runs; see
+//       Options.Filename.
+//   - max_outstanding: the maximum number of goroutines started for an action
+//       list; see Options.MaxOutstandingActionRPCs.
+//
+// The collection is created the first time a URL with its name is opened.
+// Later URLs with that name return the same collection, and must have the
+// same key and query parameters.
 type URLOpener struct {
+	// Options specifies the options to pass to OpenCollection. Query
+	// parameters override them.
+	Options Options
+
 	mu          sync.Mutex
 	collections map[string]urlColl
 }
 
 type urlColl struct {
 	keyName string
+	params  string // the encoded query parameters
 	coll    *docstore.Collection
 }
 
 // OpenCollectionURL opens a docstore.Collection based on u.
 func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstore.Collection, error) {
-	for param := range u.Query() {
-		return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+	opts := o.Options
+	q := u.Query()
+	for param, values := range q {
+		value := values[0]
+		switch param {
+		case "revision_field":
+			opts.RevisionField = value
+		case "filename":
+			opts.Filename = value
+		case "max_outstanding":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("open collection %v: invalid max_outstanding %q: %v", u, value, err)
+			}
+			opts.MaxOutstandingActionRPCs = n
+		default:
+			return nil, fmt.Errorf("open collection %v: invalid query parameter %q", u, param)
+		}
 	}
 	collName := u.Host
 	if collName == "" {
@@ -64,6 +100,12 @@ func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstor
 	if keyName == "" || strings.ContainsRune(keyName, '/') {
 		return nil, fmt.Errorf("open collection %v: invalid key name %q (must be non-empty and have no slashes)", u, keyName)
 	}
+	keyFields := strings.Split(keyName, ",")
+	for _, f := range keyFields {
+		if f == "" {
+			return nil, fmt.Errorf("open collection %v: invalid key name %q (has an empty field name)", u, keyName)
+		}
+	}
 	o.mu.Lock()
 	defer o.mu.Unlock()
 	if o.collections == nil {
@@ -71,16 +113,50 @@ func (o *URLOpener) OpenCollectionURL(ctx context.Context, u *url.URL) (*docstor
 	}
 	ucoll, ok := o.collections[collName]
 	if !ok {
-		coll, err := OpenCollection(keyName, nil)
+		var (
+			coll *docstore.Collection
+			err  error
+		)
+		if len(keyFields) == 1 {
+			coll, err = OpenCollection(keyName, &opts)
+		} else {
+			coll, err = OpenCollectionWithKeyFunc(compositeKeyFunc(keyFields), &opts)
+		}
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("open collection %v: %v", u, err)
 		}
-		o.collections[collName] = urlColl{keyName, coll}
+		o.collections[collName] = urlColl{keyName, q.Encode(), coll}
 		return coll, nil
 	}
 	if ucoll.keyName != keyName {
 		return nil, fmt.Errorf("open collection %v: key name %q does not equal existing key name %q",
 			u, keyName, ucoll.keyName)
 	}
+	if params := q.Encode(); ucoll.params != params {
+		return nil, fmt.Errorf("open collection %v: query parameters %q do not equal existing parameters %q",
+			u, params, ucoll.params)
+	}
 	return ucoll.coll, nil
 }
+
+// compositeKeyFunc returns a function that returns the values of fields in a
+// document, as an array of type [len(fields)]interface{}, or nil if any of
+// them is missing.
+func compositeKeyFunc(fields []string) func(docstore.Document) interface{} {
+	keyType := reflect.ArrayOf(len(fields), reflect.TypeOf((*interface{})(nil)).Elem())
+	return func(doc docstore.Document) interface{} {
+		ddoc, err := driver.NewDocument(doc)
+		if err != nil {
+			return nil
+		}
+		key := reflect.New(keyType).Elem()
+		for i, f := range fields {
+			v, err := ddoc.GetField(f)
+			if err != nil || v == nil || !reflect.TypeOf(v).Comparable() {
+				return nil
+			}
+			key.Index(i).Set(reflect.ValueOf(v))
+		}
+		return key.Interface()
+	}
+}
@@ -16,6 +16,10 @@ package memdocstore
 
 import (
 	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"gocloud.dev/docstore"
@@ -34,6 +38,12 @@ func TestOpenCollectionFromURL(t *testing.T) {
 		{"mem://coll", true},                 // missing key
 		{"mem://coll/my/key", true},          // key with slash
 		{"mem://coll/key?param=value", true}, // invalid parameter
+		{"mem://coll3/_id?revision_field=rev&max_outstanding=2", false},
+		{"mem://coll3/_id?revision_field=rev&max_outstanding=2", false}, // same parameters
+		{"mem://coll3/_id?revision_field=other", true},                  // different parameters
+		{"mem://coll4/_id?max_outstanding=x", true},                     // invalid number
+		{"mem://coll5/Game,Player", false},
+		{"mem://coll6/Game,", true}, // empty field name
 	}
 	ctx := context.Background()
 	for _, test := range tests {
@@ -43,3 +53,74 @@ func TestOpenCollectionFromURL(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenCollectionURLOptions(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "memdocstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "coll.gob")
+	o := &URLOpener{}
+	u, err := url.Parse("mem://coll/_id?revision_field=rev&max_outstanding=3&filename=" + url.QueryEscape(fname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll, err := o.OpenCollectionURL(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c *collection
+	if !coll.As(&c) {
+		t.Fatal("not a memdocstore collection")
+	}
+	if c.opts.RevisionField != "rev" || c.opts.MaxOutstandingActionRPCs != 3 || c.opts.Filename != fname {
+		t.Errorf("got options %+v", c.opts)
+	}
+	if err := coll.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fname); err != nil {
+		t.Errorf("collection file was not written: %v", err)
+	}
+}
+
+func TestOpenCollectionURLCompositeKey(t *testing.T) {
+	ctx := context.Background()
+	o := &URLOpener{}
+	u, err := url.Parse("mem://scores/Game,Player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll, err := o.OpenCollectionURL(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	type score struct {
+		Game, Player     string
+		Score            int
+		DocstoreRevision interface{}
+	}
+	for _, s := range []*score{
+		{Game: "g1", Player: "p1", Score: 1},
+		{Game: "g1", Player: "p2", Score: 2},
+		{Game: "g2", Player: "p1", Score: 3},
+	} {
+		if err := coll.Put(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Structs and maps have the same keys.
+	got := map[string]interface{}{"Game": "g1", "Player": "p2"}
+	if err := coll.Get(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got["Score"] != int64(2) {
+		t.Errorf("got %v, want score 2", got)
+	}
+	if err := coll.Put(ctx, map[string]interface{}{"Game": "g3"}); err == nil {
+		t.Error("Put without a player: got nil, want error")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memdocstore
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"gocloud.dev/docstore"
+)
+
+// ChangeKind is the kind of a ChangeEvent.
+type ChangeKind int
+
+const (
+	// Created means a document was added to the collection.
+	Created ChangeKind = iota
+	// Updated means a document was replaced or modified.
+	Updated
+	// Deleted means a document was removed from the collection.
+	Deleted
+	// Expired means a document was removed because it expired. See
+	// Options.ExpirationField.
+	Expired
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Created:
+		return "Created"
+	case Updated:
+		return "Updated"
+	case Deleted:
+		return "Deleted"
+	case Expired:
+		return "Expired"
+	default:
+		return "ChangeKind(?)"
+	}
+}
+
+// A ChangeEvent describes a change to one document of a collection.
+type ChangeEvent struct {
+	Kind ChangeKind
+
+	// Key is the key of the document.
+	Key interface{}
+
+	// Old is the document before the change, or nil if it was created. New
+	// is the document after the change, or nil if it was deleted. They are
+	// the collection's stored documents, including the revision field, and
+	// must not be modified.
+	Old, New map[string]interface{}
+
+	// Time is when the change was made.
+	Time time.Time
+}
+
+// A Watcher receives the changes made to a collection after it was created
+// by Watch.
+type Watcher struct {
+	c      *collection
+	events chan ChangeEvent
+
+	mu      sync.Mutex
+	pending []ChangeEvent
+	wake    chan struct{} // signaled when pending becomes non-empty
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Watch returns a Watcher for the changes made to coll, which must be a
+// memdocstore collection. Every write to a document produces one
+// ChangeEvent: actions, update and delete queries, expiration, and Restore
+// and Clear, which report the difference between the old and new documents.
+//
+// Events are delivered in the order the changes were made. Writes never wait
+// for a Watcher: events are queued until they are received, so a Watcher
+// that is not read holds on to memory until it is stopped.
+func Watch(coll *docstore.Collection) (*Watcher, error) {
+	c, err := fromCollection(coll)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		c:      c,
+		events: make(chan ChangeEvent),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	c.watchMu.Lock()
+	if c.watchers == nil {
+		c.watchers = map[*Watcher]bool{}
+	}
+	c.watchers[w] = true
+	c.watchMu.Unlock()
+	go w.deliver()
+	return w, nil
+}
+
+// Events returns the channel that the Watcher's events are sent on. It is
+// closed when the Watcher is stopped or the collection is closed.
+func (w *Watcher) Events() <-chan ChangeEvent { return w.events }
+
+// Stop stops the Watcher and closes its events channel. Events not yet
+// received are discarded.
+func (w *Watcher) Stop() {
+	w.c.watchMu.Lock()
+	delete(w.c.watchers, w)
+	w.c.watchMu.Unlock()
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// push queues e for delivery.
+func (w *Watcher) push(e ChangeEvent) {
+	w.mu.Lock()
+	w.pending = append(w.pending, e)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends queued events on w.events until w is stopped.
+func (w *Watcher) deliver() {
+	defer close(w.done)
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		var (
+			e  ChangeEvent
+			ok bool
+		)
+		if len(w.pending) > 0 {
+			e, ok = w.pending[0], true
+			w.pending[0] = ChangeEvent{}
+			w.pending = w.pending[1:]
+		}
+		w.mu.Unlock()
+		if !ok {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.stop:
+				return
+			}
+		}
+		select {
+		case w.events <- e:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// changed updates the indexes for a change to the document with key from old
+// to new, either of which may be nil, and reports the change to watchers. It
+// is called with the document's shard locked for writing.
+func (c *collection) changed(kind ChangeKind, key interface{}, old, new map[string]interface{}) {
+	c.reindex(key, old, new)
+	c.watchMu.RLock()
+	defer c.watchMu.RUnlock()
+	if len(c.watchers) == 0 {
+		return
+	}
+	e := ChangeEvent{Kind: kind, Key: key, Old: old, New: new, Time: time.Now()}
+	for w := range c.watchers {
+		w.push(e)
+	}
+}
+
+// writeKind returns the kind of a write that replaces current, which is nil
+// if there was no document.
+func writeKind(current map[string]interface{}) ChangeKind {
+	if current == nil {
+		return Created
+	}
+	return Updated
+}
+
+// replacedEvents returns the events for replacing the documents old with new,
+// if there are watchers.
+func (c *collection) replacedEvents(old, new map[interface{}]map[string]interface{}) []ChangeEvent {
+	c.watchMu.RLock()
+	n := len(c.watchers)
+	c.watchMu.RUnlock()
+	if n == 0 {
+		return nil
+	}
+	now := time.Now()
+	var es []ChangeEvent
+	for k, od := range old {
+		nd, ok := new[k]
+		switch {
+		case !ok:
+			es = append(es, ChangeEvent{Kind: Deleted, Key: k, Old: od, Time: now})
+		// Stored documents are never modified, so an unchanged document is the
+		// same map.
+		case reflect.ValueOf(od).Pointer() != reflect.ValueOf(nd).Pointer():
+			es = append(es, ChangeEvent{Kind: Updated, Key: k, Old: od, New: nd, Time: now})
+		}
+	}
+	for k, nd := range new {
+		if _, ok := old[k]; !ok {
+			es = append(es, ChangeEvent{Kind: Created, Key: k, New: nd, Time: now})
+		}
+	}
+	return es
+}
+
+// notifyAll reports es to watchers.
+func (c *collection) notifyAll(es []ChangeEvent) {
+	if len(es) == 0 {
+		return
+	}
+	c.watchMu.RLock()
+	defer c.watchMu.RUnlock()
+	for w := range c.watchers {
+		for _, e := range es {
+			w.push(e)
+		}
+	}
+}
+
+// stopWatchers stops all of c's watchers.
+func (c *collection) stopWatchers() {
+	c.watchMu.Lock()
+	ws := c.watchers
+	c.watchers = nil
+	c.watchMu.Unlock()
+	for w := range ws {
+		w.Stop()
+	}
+}
@@ -52,5 +52,5 @@ func TestConformanceCosmos(t *testing.T) {
 	newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
 		return &harness{client.Database(dbName)}, nil
 	}
-	drivertest.RunConformanceTests(t, newHarness, codecTester{}, []drivertest.AsTest{verifyAs{}})
+	drivertest.RunConformanceTests(t, newHarness, codecTester{}, []drivertest.AsTest{asMatrix})
 }
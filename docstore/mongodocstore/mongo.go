@@ -53,6 +53,10 @@
 // struct field names; other docstore drivers do not. This means that you have to choose
 // between interoperating with the MongoDB driver and interoperating with other docstore drivers.
 // See Options.LowercaseFields for more information.
+//
+// MongoDB stores the document key in the _id field. Unless _id is the collection's
+// key field, mongodocstore removes it from the documents it returns; set
+// Options.ExposeIDField to keep it.
 package mongodocstore // import "gocloud.dev/docstore/mongodocstore"
 
 // MongoDB reference manual: https://docs.mongodb.com/manual
@@ -117,6 +121,13 @@ type Options struct {
 	// The name of the field holding the document revision.
 	// Defaults to docstore.RevisionField.
 	RevisionField string
+	// If true, documents read from a collection opened with
+	// OpenCollectionWithIDFunc keep MongoDB's _id field. By default it is removed,
+	// so that documents have only the fields that were written.
+	//
+	// An exposed _id field is reported as a provider-internal field, so
+	// docstore.Collection.CleanDocument removes it.
+	ExposeIDField bool
 }
 
 // OpenCollection opens a MongoDB collection for use with Docstore.
@@ -184,6 +195,35 @@ func (c *collection) RevisionField() string {
 	return c.opts.RevisionField
 }
 
+// InternalFields implements driver.InternalFieldLister.
+func (c *collection) InternalFields() []string {
+	var fs []string
+	if c.idField == "" && c.opts.ExposeIDField {
+		fs = append(fs, mongoIDField)
+	}
+	// With LowercaseFields, documents read from MongoDB hold the revision under
+	// its lowercased name.
+	if c.revisionField != c.opts.RevisionField {
+		fs = append(fs, c.revisionField)
+	}
+	return fs
+}
+
+// decodeIDField returns the idField argument to decodeDoc.
+func (c *collection) decodeIDField() string {
+	if c.idField == "" && c.opts.ExposeIDField {
+		return mongoIDField // leave _id in place
+	}
+	return c.idField
+}
+
+// MaxDocumentSize is the largest BSON document MongoDB accepts, in bytes.
+// See https://docs.mongodb.com/manual/reference/limits.
+const MaxDocumentSize = 16 * 1024 * 1024
+
+// MaxDocumentSize implements driver.MaxDocumentSize.
+func (c *collection) MaxDocumentSize() int { return MaxDocumentSize }
+
 // From https://docs.mongodb.com/manual/core/document: "The field name _id is
 // reserved for use as a primary key; its value must be unique in the collection, is
 // immutable, and may be of any type other than an array."
@@ -193,11 +233,21 @@ func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, o
 	errs := make([]error, len(actions))
 	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
 	c.runGets(ctx, beforeGets, errs, opts)
+	if driver.ShouldStop(opts, errs) {
+		driver.SkipActions(gets, errs)
+		driver.SkipActions(writes, errs)
+		driver.SkipActions(afterGets, errs)
+		return driver.NewActionListError(errs)
+	}
 	ch := make(chan []error)
 	go func() { ch <- c.bulkWrite(ctx, writes, errs, opts) }()
 	c.runGets(ctx, gets, errs, opts)
 	writeErrs := <-ch
-	c.runGets(ctx, afterGets, errs, opts)
+	if (opts.FailFast && len(writeErrs) > 0) || driver.ShouldStop(opts, errs) {
+		driver.SkipActions(afterGets, errs)
+	} else {
+		c.runGets(ctx, afterGets, errs, opts)
+	}
 	alerr := driver.NewActionListError(errs)
 	for _, werr := range writeErrs {
 		alerr = append(alerr, indexedError{-1, werr})
@@ -264,7 +314,7 @@ func (c *collection) bulkFind(ctx context.Context, gets []*driver.Action, errs [
 			continue
 		}
 		a := idToAction[m[mongoIDField]]
-		errs[a.Index] = decodeDoc(m, a.Doc, c.idField)
+		errs[a.Index] = decodeDoc(m, a.Doc, c.decodeIDField())
 		found[a] = true
 	}
 	for _, a := range gets {
@@ -302,7 +352,11 @@ func (c *collection) prepareCreate(a *driver.Action) (mdoc, createdID interface{
 	if id == nil {
 		// Create a unique ID here. (The MongoDB Go client does this for us when calling InsertOne,
 		// but not for BulkWrite.)
-		id = primitive.NewObjectID()
+		if a.KeyGenerator != nil {
+			id = a.KeyGenerator()
+		} else {
+			id = primitive.NewObjectID()
+		}
 		createdID = id
 	} else {
 		id, err = encodeValue(id)
@@ -322,7 +376,7 @@ func (c *collection) prepareReplace(a *driver.Action) (filter bson.D, mdoc map[s
 	if err != nil {
 		return nil, nil, "", err
 	}
-	filter, _, err = c.makeFilter(id, a.Doc)
+	filter, _, err = c.makeFilter(id, a)
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -356,7 +410,7 @@ func (c *collection) prepareUpdate(a *driver.Action) (filter bson.D, updateDoc m
 	if err != nil {
 		return nil, nil, "", err
 	}
-	filter, _, err = c.makeFilter(id, a.Doc)
+	filter, _, err = c.makeFilter(id, a)
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -403,9 +457,10 @@ func (c *collection) newUpdateDoc(mods []driver.Mod) (map[string]bson.D, string,
 	return updateDoc, rev, nil
 }
 
-// makeFilter constructs a filter using the given encoded id and the document's revision field, if any.
-func (c *collection) makeFilter(id interface{}, doc driver.Document) (filter bson.D, rev interface{}, err error) {
-	rev, err = doc.GetField(c.revisionField)
+// makeFilter constructs a filter using the given encoded id, the revision field of
+// the action's document, if any, and the action's conditions.
+func (c *collection) makeFilter(id interface{}, a *driver.Action) (filter bson.D, rev interface{}, err error) {
+	rev, err = a.Doc.GetField(c.revisionField)
 	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
 		return nil, nil, err
 	}
@@ -415,6 +470,13 @@ func (c *collection) makeFilter(id interface{}, doc driver.Document) (filter bso
 	if rev != nil {
 		filter = append(filter, bson.E{Key: c.revisionField, Value: rev})
 	}
+	for _, f := range a.Conditions {
+		e, err := c.filterToBSON(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		filter = append(filter, e)
+	}
 	return filter, rev, nil
 }
 
@@ -431,6 +493,8 @@ func (c *collection) bulkWrite(ctx context.Context, actions []*driver.Action, er
 		revs            []string         // new revisions, corresponding to models slice
 		nDeletes        int64
 		nNonCreateWrite int64 // total operations expected from Put, Replace and Update
+		nConditional    int64 // number of those operations with conditions
+		buildFailed     bool  // an action could not be turned into a model
 	)
 	for _, a := range actions {
 		var m mongo.WriteModel
@@ -449,17 +513,24 @@ func (c *collection) bulkWrite(ctx context.Context, actions []*driver.Action, er
 			m, rev, err = c.newReplaceModel(a, a.Kind == driver.Put)
 			if err == nil {
 				nNonCreateWrite++
+				if len(a.Conditions) > 0 {
+					nConditional++
+				}
 			}
 		case driver.Update:
 			m, rev, err = c.newUpdateModel(a)
 			if err == nil && m != nil {
 				nNonCreateWrite++
+				if len(a.Conditions) > 0 {
+					nConditional++
+				}
 			}
 		default:
 			err = gcerr.Newf(gcerr.Internal, nil, "bad action %+v", a)
 		}
 		if err != nil {
 			errs[a.Index] = err
+			buildFailed = true
 		} else if m != nil { // m can be nil for a no-op update
 			models = append(models, m)
 			modelActions = append(modelActions, a)
@@ -470,8 +541,13 @@ func (c *collection) bulkWrite(ctx context.Context, actions []*driver.Action, er
 	if len(models) == 0 {
 		return nil
 	}
+	if dopts.FailFast && buildFailed {
+		driver.SkipActions(modelActions, errs)
+		return nil
+	}
 
-	bopts := options.BulkWrite().SetOrdered(false)
+	// An ordered bulk write stops at the first error.
+	bopts := options.BulkWrite().SetOrdered(dopts.FailFast)
 	if dopts.BeforeDo != nil {
 		asFunc := func(target interface{}) bool {
 			switch t := target.(type) {
@@ -528,7 +604,12 @@ func (c *collection) bulkWrite(ctx context.Context, actions []*driver.Action, er
 		c.determineDeleteErrors(ctx, models, modelActions, errs)
 	}
 	if res.MatchedCount+res.UpsertedCount != nNonCreateWrite {
-		reterrs = append(reterrs, gcerr.Newf(gcerr.NotFound, nil, "some writes failed (replaced %d, upserted %d, out of total %d)", res.MatchedCount, res.UpsertedCount, nNonCreateWrite))
+		// A write with conditions that matched nothing most likely failed a condition.
+		code := gcerr.NotFound
+		if nConditional > 0 {
+			code = gcerr.FailedPrecondition
+		}
+		reterrs = append(reterrs, gcerr.Newf(code, nil, "some writes failed (replaced %d, upserted %d, out of total %d)", res.MatchedCount, res.UpsertedCount, nNonCreateWrite))
 	}
 	return reterrs
 }
@@ -539,7 +620,7 @@ func (c *collection) determineDeleteErrors(ctx context.Context, models []mongo.W
 		if dm, ok := m.(*mongo.DeleteOneModel); ok {
 			filter := dm.Filter.(bson.D)
 			if len(filter) > 1 {
-				// Delete with both ID and revision. See if the document is still there.
+				// Delete with a revision or conditions. See if the document is still there.
 				idOnlyFilter := filter[:1]
 				// TODO(shantuo): use Find instead of FindOne.
 				res := c.coll.FindOne(ctx, idOnlyFilter)
@@ -550,9 +631,9 @@ func (c *collection) determineDeleteErrors(ctx context.Context, models []mongo.W
 				// TODO(jba): distinguish between not found and other errors.
 				if res.Err() == nil {
 					// The document exists, but we didn't delete it: assume we had the wrong
-					// revision.
+					// revision, or a condition wasn't satisfied.
 					errs[actions[i].Index] = gcerr.Newf(gcerr.FailedPrecondition, nil,
-						"wrong revision for document with ID %v", actions[i].Key)
+						"wrong revision or unsatisfied condition for document with ID %v", actions[i].Key)
 				}
 			}
 		}
@@ -572,7 +653,7 @@ func (c *collection) newDeleteModel(a *driver.Action) (*mongo.DeleteOneModel, er
 	if err != nil {
 		return nil, err
 	}
-	filter, _, err := c.makeFilter(id, a.Doc)
+	filter, _, err := c.makeFilter(id, a)
 	if err != nil {
 		return nil, err
 	}
@@ -584,6 +665,8 @@ func (c *collection) newReplaceModel(a *driver.Action, upsert bool) (*mongo.Repl
 	if err != nil {
 		return nil, "", err
 	}
+	// A Put with conditions requires an existing document, so it can't upsert.
+	upsert = upsert && len(a.Conditions) == 0
 	return &mongo.ReplaceOneModel{
 		Filter:      filter,
 		Replacement: mdoc,
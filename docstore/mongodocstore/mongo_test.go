@@ -19,8 +19,6 @@ package mongodocstore
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"testing"
 	"time"
 
@@ -31,7 +29,6 @@ import (
 	"gocloud.dev/docstore"
 	"gocloud.dev/docstore/driver"
 	"gocloud.dev/docstore/drivertest"
-	"gocloud.dev/internal/gcerr"
 	"gocloud.dev/internal/testing/setup"
 )
 
@@ -82,6 +79,8 @@ func (*harness) BeforeQueryTypes() []interface{} {
 	return []interface{}{&options.FindOptions{}, bson.D{}}
 }
 
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
 func (*harness) Close() {}
 
 type codecTester struct{}
@@ -114,39 +113,12 @@ func (codecTester) NativeDecode(value, dest interface{}) error {
 	return bson.Unmarshal(value.([]byte), dest)
 }
 
-type verifyAs struct{}
-
-func (verifyAs) Name() string {
-	return "verify As"
-}
-
-func (verifyAs) CollectionCheck(coll *docstore.Collection) error {
-	var mc *mongo.Collection
-	if !coll.As(&mc) {
-		return errors.New("Collection.As failed")
-	}
-	return nil
-}
-
-func (verifyAs) QueryCheck(it *docstore.DocumentIterator) error {
-	var c *mongo.Cursor
-	if !it.As(&c) {
-		return errors.New("DocumentIterator.As failed")
-	}
-	return nil
-}
-
-func (verifyAs) ErrorCheck(c *docstore.Collection, err error) error {
-	var cmderr mongo.CommandError
-	var bwerr mongo.BulkWriteError
-	var bwexc mongo.BulkWriteException
-	if !c.ErrorAs(err, &cmderr) && !c.ErrorAs(err, &bwerr) && !c.ErrorAs(err, &bwexc) {
-		if e, ok := err.(*gcerr.Error); ok {
-			err = e.Unwrap()
-		}
-		return fmt.Errorf("Collection.ErrorAs failed, got %T", err)
-	}
-	return nil
+// asMatrix lists the types that the As methods support. Errors come from
+// either commands or bulk writes.
+var asMatrix = drivertest.AsMatrix{
+	Collection: []interface{}{new(*mongo.Collection)},
+	Iterator:   []interface{}{new(*mongo.Cursor)},
+	Error:      []interface{}{new(mongo.CommandError), new(mongo.BulkWriteError), new(mongo.BulkWriteException)},
 }
 
 func TestConformance(t *testing.T) {
@@ -156,7 +128,7 @@ func TestConformance(t *testing.T) {
 	newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
 		return &harness{client.Database(dbName)}, nil
 	}
-	drivertest.RunConformanceTests(t, newHarness, codecTester{}, []drivertest.AsTest{verifyAs{}})
+	drivertest.RunConformanceTests(t, newHarness, codecTester{}, []drivertest.AsTest{asMatrix})
 }
 
 func newTestClient(t *testing.T) *mongo.Client {
@@ -18,14 +18,19 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"regexp"
 	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gocloud.dev/docstore/driver"
 )
 
+// SupportsFilter implements driver.SupportsFilter.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
 func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
 	opts := options.Find()
 	if len(q.FieldPaths) > 0 {
@@ -66,7 +71,7 @@ func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.D
 	if err != nil {
 		return nil, err
 	}
-	return &docIterator{cursor: cursor, idField: c.idField, ctx: ctx}, nil
+	return &docIterator{cursor: cursor, idField: c.decodeIDField(), ctx: ctx}, nil
 }
 
 var mongoQueryOps = map[string]string{
@@ -101,6 +106,25 @@ func (c *collection) filterToBSON(f driver.Filter) (bson.E, error) {
 	if c.idField != "" && key == c.idField {
 		key = mongoIDField
 	}
+	switch f.Op {
+	case driver.ExistsOp:
+		return bson.E{Key: key, Value: bson.D{{Key: "$exists", Value: true}}}, nil
+	case driver.NotExistsOp:
+		return bson.E{Key: key, Value: bson.D{{Key: "$exists", Value: false}}}, nil
+	case driver.HasPrefixOp:
+		// MongoDB can use an index for a case-sensitive regular expression
+		// anchored at the start.
+		pat := "^" + regexp.QuoteMeta(f.Value.(string))
+		return bson.E{Key: key, Value: primitive.Regex{Pattern: pat}}, nil
+	case driver.EqualFoldOp, driver.HasPrefixFoldOp:
+		// A collation would apply to every string comparison in the query, so
+		// use a case-insensitive regular expression instead.
+		pat := "^" + regexp.QuoteMeta(f.Value.(string))
+		if f.Op == driver.EqualFoldOp {
+			pat += `\z`
+		}
+		return bson.E{Key: key, Value: primitive.Regex{Pattern: pat, Options: "i"}}, nil
+	}
 	val, err := encodeValue(f.Value)
 	if err != nil {
 		return bson.E{}, err
@@ -154,8 +178,12 @@ func (it *docIterator) As(i interface{}) bool {
 	return true
 }
 
-func (c *collection) QueryPlan(q *driver.Query) (string, error) {
-	return "unknown", nil
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	// All filters are sent to the service, but the index it chooses is unknown.
+	return &driver.QueryPlan{
+		Description:   "unknown",
+		ServerFilters: q.Filters,
+	}, nil
 }
 
 func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
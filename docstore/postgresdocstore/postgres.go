@@ -0,0 +1,559 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package postgresdocstore provides an implementation of the docstore API for
+// PostgreSQL, storing each document as a JSONB value in a table.
+//
+// The table must have a text primary key column and a JSONB column, by default
+// named "key" and "doc":
+//
+//   CREATE TABLE docs (key TEXT PRIMARY KEY, doc JSONB NOT NULL);
+//
+// The whole document, including its key field and revision, is stored in the
+// JSONB column, and the key is also stored in the key column. Keys must be
+// strings.
+//
+// postgresdocstore works with any database/sql driver for PostgreSQL, such as
+// github.com/lib/pq; open a *sql.DB with the driver, or with gocloud.dev/postgres,
+// and pass it to OpenCollection.
+//
+//
+// Action Lists
+//
+// The Get actions in each group of an action list are executed with a single
+// SELECT statement. Each write action runs in its own transaction, which locks
+// the document's row to check its revision and the action's conditions, and the
+// write actions run concurrently. postgresdocstore calls the BeforeDo function
+// before the SELECT statement, with an as function that exposes *sql.DB, and
+// before each write, with an as function that exposes the write's *sql.Tx.
+//
+//
+// Queries
+//
+// Query filters are translated to SQL conditions on the JSONB column, and so
+// are evaluated by PostgreSQL. A filter on a field path like "a.b" refers to
+// the expression doc->'a'->>'b' (or doc->'a'->'b' for booleans and existence
+// tests), and a filter on the key field refers to the key column. Create
+// expression indexes on those expressions, or a GIN index on the JSONB column,
+// to make queries on them efficient; QueryPlan reports the SQL that will be run,
+// which can be passed to EXPLAIN.
+//
+// Strings are compared byte by byte, using the "C" collation. Query.OrderBy
+// sorts by the field's JSONB value, so numbers sort numerically and strings
+// according to the database's default collation.
+//
+//
+// As
+//
+// postgresdocstore exposes the following types for As:
+// - Collection: *sql.DB
+// - ActionList.BeforeDo: *sql.DB for Gets, *sql.Tx for writes
+// - Query.BeforeQuery: string, the SQL statement to be run
+// - DocumentIterator: *sql.Rows
+//
+//
+// Special Considerations
+//
+// JSON has no binary or time types. []byte values are stored as base64 strings,
+// and time.Time values as RFC 3339 strings in UTC with nanosecond precision.
+// They are decoded to those types when the destination has them, but as strings
+// when decoding into an interface{}. Query filters on time.Time values compare
+// the strings, which sort in time order.
+package postgresdocstore // import "gocloud.dev/docstore/postgresdocstore"
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+)
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// The name of the table's text primary key column. Defaults to "key".
+	KeyColumn string
+
+	// The name of the table's JSONB column. Defaults to "doc".
+	DocColumn string
+
+	// The maximum number of write actions, each in its own transaction, that run
+	// concurrently for a single call to ActionList.Do. If less than 1, there is
+	// no limit other than that of the *sql.DB's connection pool.
+	MaxOutstandingActionRPCs int
+}
+
+type collection struct {
+	db       *sql.DB
+	table    string // quoted
+	keyCol   string // quoted
+	docCol   string // quoted
+	keyField string
+	keyFunc  func(docstore.Document) interface{}
+	opts     *Options
+
+	beforeDoMu sync.Mutex // serializes calls to BeforeDo
+}
+
+// OpenCollection opens the table named table in db as a docstore collection.
+// keyField is the document field holding the primary key, which must be a
+// string. table may be qualified by a schema name, as in "myschema.docs".
+func OpenCollection(db *sql.DB, table, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(db, table, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens the table named table in db as a docstore
+// collection. keyFunc takes a document and returns its primary key, which must
+// be a string. It should return nil if the document is missing the information
+// to construct a key. This will cause all actions, even Create, to fail.
+func OpenCollectionWithKeyFunc(db *sql.DB, table string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(db, table, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(db *sql.DB, table, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if db == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "postgresdocstore: db is nil")
+	}
+	if table == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "postgresdocstore: table name is empty")
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "postgresdocstore: must provide either keyField or keyFunc")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	if opts.KeyColumn == "" {
+		opts.KeyColumn = "key"
+	}
+	if opts.DocColumn == "" {
+		opts.DocColumn = "doc"
+	}
+	var parts []string
+	for _, p := range strings.Split(table, ".") {
+		parts = append(parts, quoteIdent(p))
+	}
+	return &collection{
+		db:       db,
+		table:    strings.Join(parts, "."),
+		keyCol:   quoteIdent(opts.KeyColumn),
+		docCol:   quoteIdent(opts.DocColumn),
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+	}, nil
+}
+
+// quoteIdent quotes a PostgreSQL identifier.
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// quoteLiteral quotes a PostgreSQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// keyString returns the key of a, which must be a string.
+func keyString(a *driver.Action) (string, error) {
+	s, ok := a.Key.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "postgresdocstore: key %v is a %T, not a string", a.Key, a.Key)
+	}
+	return s, nil
+}
+
+func (c *collection) RevisionField() string { return c.opts.RevisionField }
+
+// MaxDocumentSize implements driver.MaxDocumentSize. PostgreSQL limits a JSONB
+// value to about 255MB, which the size estimate cannot track closely, so there
+// is no limit.
+func (c *collection) MaxDocumentSize() int { return 0 }
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	for _, group := range [][]*driver.Action{beforeGets, gets, writes, afterGets} {
+		if driver.ShouldStop(opts, errs) {
+			driver.SkipActions(group, errs)
+			continue
+		}
+		if len(group) > 0 && group[0].Kind == driver.Get {
+			c.runGets(ctx, group, errs, opts)
+		} else {
+			c.runWrites(ctx, group, errs, opts)
+		}
+	}
+	return driver.NewActionListError(errs)
+}
+
+// beforeDo calls opts.BeforeDo, if any, with an as function that exposes val.
+func (c *collection) beforeDo(opts *driver.RunActionsOptions, val interface{}) error {
+	if opts.BeforeDo == nil {
+		return nil
+	}
+	c.beforeDoMu.Lock()
+	defer c.beforeDoMu.Unlock()
+	return opts.BeforeDo(driver.AsFunc(val))
+}
+
+// runGets reads the documents of gets with a single query.
+func (c *collection) runGets(ctx context.Context, gets []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	var (
+		b      sqlBuilder
+		params []string
+		byKey  = map[string][]*driver.Action{}
+	)
+	for _, a := range gets {
+		key, err := keyString(a)
+		if err != nil {
+			errs[a.Index] = err
+			continue
+		}
+		if byKey[key] == nil {
+			params = append(params, b.arg(key))
+		}
+		byKey[key] = append(byKey[key], a)
+	}
+	if len(byKey) == 0 {
+		return
+	}
+	setErr := func(err error) {
+		for _, as := range byKey {
+			for _, a := range as {
+				errs[a.Index] = err
+			}
+		}
+	}
+	if err := c.beforeDo(opts, c.db); err != nil {
+		setErr(err)
+		return
+	}
+	query := "SELECT " + c.keyCol + ", " + c.docCol + " FROM " + c.table +
+		" WHERE " + c.keyCol + " IN (" + strings.Join(params, ", ") + ")"
+	rows, err := c.db.QueryContext(ctx, query, b.args...)
+	if err != nil {
+		setErr(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			key string
+			raw []byte
+		)
+		if err := rows.Scan(&key, &raw); err != nil {
+			setErr(err)
+			return
+		}
+		doc, err := unmarshalDoc(raw)
+		for _, a := range byKey[key] {
+			if err == nil {
+				errs[a.Index] = codec.DecodeDoc(doc, a.Doc, a.FieldPaths, c.opts.RevisionField)
+			} else {
+				errs[a.Index] = err
+			}
+		}
+		delete(byKey, key)
+	}
+	if err := rows.Err(); err != nil {
+		setErr(err)
+		return
+	}
+	for key, as := range byKey {
+		for _, a := range as {
+			errs[a.Index] = gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", key)
+		}
+	}
+}
+
+// unmarshalDoc decodes the JSON object in raw.
+func unmarshalDoc(raw []byte) (map[string]interface{}, error) {
+	v, err := jsoncodec.Unmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, gcerr.Newf(gcerr.Internal, nil, "postgresdocstore: stored document is a JSON %T, not an object", v)
+	}
+	return m, nil
+}
+
+// runWrites runs each write action concurrently, in its own transaction. With
+// FailFast, it stops starting actions once one fails.
+func (c *collection) runWrites(ctx context.Context, writes []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	mapdoc.RunConcurrently(writes, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+		return c.runWrite(ctx, a, opts)
+	})
+}
+
+// runWrite executes a single write action in a transaction.
+func (c *collection) runWrite(ctx context.Context, a *driver.Action, opts *driver.RunActionsOptions) (err error) {
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	key, err := keyString(a)
+	if err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	if err := c.beforeDo(opts, tx); err != nil {
+		return err
+	}
+	if a.Kind == driver.Create {
+		return c.create(ctx, tx, key, a)
+	}
+
+	// Lock the current document, if any, and check the action's conditions
+	// against it.
+	var b sqlBuilder
+	cond := "TRUE"
+	if len(a.Conditions) > 0 {
+		if cond, err = c.filtersSQL(&b, a.Conditions); err != nil {
+			return err
+		}
+	}
+	query := "SELECT " + c.docCol + ", " + cond + " FROM " + c.table +
+		" WHERE " + c.keyCol + " = " + b.arg(key) + " FOR UPDATE"
+	var (
+		raw    []byte
+		condOK bool
+	)
+	err = tx.QueryRowContext(ctx, query, b.args...).Scan(&raw, &condOK)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	var current map[string]interface{}
+	if exists {
+		if current, err = unmarshalDoc(raw); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !exists && a.Kind == driver.Delete:
+		return nil
+	case !exists && len(a.Conditions) > 0:
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q does not exist", key)
+	case !exists && a.Kind != driver.Put:
+		return gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", key)
+	case exists && !condOK:
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "conditions not satisfied for document with key %q", key)
+	}
+	if exists {
+		if err := c.checkRevision(a.Doc, current); err != nil {
+			return err
+		}
+	}
+
+	switch a.Kind {
+	case driver.Delete:
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+c.table+" WHERE "+c.keyCol+" = $1", key)
+		return err
+	case driver.Replace, driver.Put:
+		doc, err := codec.EncodeDoc(a.Doc)
+		if err != nil {
+			return err
+		}
+		return c.write(ctx, tx, key, doc, a, exists)
+	case driver.Update:
+		if err := eval.ApplyMods(current, a.Mods); err != nil {
+			return err
+		}
+		return c.write(ctx, tx, key, current, a, true)
+	default:
+		return gcerr.Newf(gcerr.Internal, nil, "unknown kind %v", a.Kind)
+	}
+}
+
+// create inserts the document of a Create action.
+func (c *collection) create(ctx context.Context, tx *sql.Tx, key string, a *driver.Action) error {
+	doc, err := codec.EncodeDoc(a.Doc)
+	if err != nil {
+		return err
+	}
+	rev := driver.UniqueString()
+	doc[c.opts.RevisionField] = rev
+	js, err := jsoncodec.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO "+c.table+" ("+c.keyCol+", "+c.docCol+") VALUES ($1, $2) ON CONFLICT DO NOTHING", key, string(js))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %q exists", key)
+	}
+	_ = a.Doc.SetField(c.opts.RevisionField, rev)
+	return nil
+}
+
+// write stores doc under key with a new revision, updating the row if exists is
+// true and inserting it otherwise.
+func (c *collection) write(ctx context.Context, tx *sql.Tx, key string, doc map[string]interface{}, a *driver.Action, exists bool) error {
+	rev := driver.UniqueString()
+	doc[c.opts.RevisionField] = rev
+	js, err := jsoncodec.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var stmt string
+	if exists {
+		stmt = "UPDATE " + c.table + " SET " + c.docCol + " = $2 WHERE " + c.keyCol + " = $1"
+	} else {
+		// Another writer may have inserted the document since it was found
+		// missing; a Put replaces it.
+		stmt = "INSERT INTO " + c.table + " (" + c.keyCol + ", " + c.docCol + ") VALUES ($1, $2)" +
+			" ON CONFLICT (" + c.keyCol + ") DO UPDATE SET " + c.docCol + " = EXCLUDED." + c.docCol
+	}
+	if _, err := tx.ExecContext(ctx, stmt, key, string(js)); err != nil {
+		return err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, rev)
+	return nil
+}
+
+func (c *collection) checkRevision(arg driver.Document, current map[string]interface{}) error {
+	wantRev, err := arg.GetField(c.opts.RevisionField)
+	if err != nil || wantRev == nil {
+		return nil // no incoming revision information: nothing to check
+	}
+	curRev := current[c.opts.RevisionField]
+	if s, ok := wantRev.(string); !ok {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want string", c.opts.RevisionField, wantRev)
+	} else if s != curRev {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %v, current %v", wantRev, curRev)
+	}
+	return nil
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool {
+	p, ok := i.(**sql.DB)
+	if !ok {
+		return false
+	}
+	*p = c.db
+	return true
+}
+
+// ErrorAs implements driver.Collection.ErrorAs. Errors from the database/sql
+// driver are returned unchanged, so use errors.As to access them.
+func (c *collection) ErrorAs(err error, i interface{}) bool { return false }
+
+// sqlStater is implemented by the errors of some PostgreSQL drivers, such as
+// github.com/jackc/pgx.
+type sqlStater interface {
+	SQLState() string
+}
+
+// ErrorCode implements driver.Collection.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	if g, ok := err.(*gcerr.Error); ok {
+		return g.Code
+	}
+	switch err {
+	case sql.ErrNoRows:
+		return gcerr.NotFound
+	case context.Canceled:
+		return gcerr.Canceled
+	case context.DeadlineExceeded:
+		return gcerr.DeadlineExceeded
+	}
+	if s, ok := err.(sqlStater); ok {
+		return sqlStateCode(s.SQLState())
+	}
+	// github.com/lib/pq's *pq.Error has a Code field of a string type.
+	if v := reflect.ValueOf(err); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+		if f := v.Elem().FieldByName("Code"); f.IsValid() && f.Kind() == reflect.String {
+			return sqlStateCode(f.String())
+		}
+	}
+	return gcerr.Unknown
+}
+
+// sqlStateCode maps a PostgreSQL error code (SQLSTATE) to an error code. See
+// https://www.postgresql.org/docs/current/errcodes-appendix.html.
+func sqlStateCode(state string) gcerr.ErrorCode {
+	switch {
+	case state == "23505": // unique_violation
+		return gcerr.AlreadyExists
+	case state == "57014": // query_canceled
+		return gcerr.Canceled
+	case strings.HasPrefix(state, "22"): // data exception
+		return gcerr.InvalidArgument
+	case state == "42501": // insufficient_privilege
+		return gcerr.PermissionDenied
+	case strings.HasPrefix(state, "53"): // insufficient resources
+		return gcerr.ResourceExhausted
+	default:
+		return gcerr.Unknown
+	}
+}
+
+// Close implements driver.Collection.Close. It does not close the *sql.DB.
+func (c *collection) Close() error { return nil }
@@ -0,0 +1,338 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresdocstore
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"strconv"
+	"strings"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/internal/gcerr"
+)
+
+// A sqlBuilder collects the arguments of a SQL statement.
+type sqlBuilder struct {
+	args []interface{}
+}
+
+// arg adds an argument and returns its placeholder.
+func (b *sqlBuilder) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+// SupportsFilter implements driver.SupportsFilter.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// jsonPath returns the expression for the value at fp in the document: a JSONB
+// value, or text if asText is true.
+func (c *collection) jsonPath(fp []string, asText bool) string {
+	var sb strings.Builder
+	sb.WriteString(c.docCol)
+	for i, f := range fp {
+		if asText && i == len(fp)-1 {
+			sb.WriteString("->>")
+		} else {
+			sb.WriteString("->")
+		}
+		sb.WriteString(quoteLiteral(f))
+	}
+	return sb.String()
+}
+
+// filtersSQL returns a SQL condition that is true of the documents that satisfy
+// all of fs.
+func (c *collection) filtersSQL(b *sqlBuilder, fs []driver.Filter) (string, error) {
+	var conds []string
+	for _, f := range fs {
+		cond, err := c.filterSQL(b, f)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+// filterSQL returns a SQL condition that is true of the documents that satisfy
+// f. Values of different types never compare equal, less or greater.
+func (c *collection) filterSQL(b *sqlBuilder, f driver.Filter) (string, error) {
+	j := c.jsonPath(f.FieldPath, false)
+	t := c.jsonPath(f.FieldPath, true)
+	isString := "jsonb_typeof(" + j + ") = 'string'"
+	switch f.Op {
+	case driver.ExistsOp:
+		return j + " IS NOT NULL", nil
+	case driver.NotExistsOp:
+		return j + " IS NULL", nil
+	case driver.HasPrefixOp:
+		return "(" + isString + " AND " + t + " LIKE " + b.arg(likePrefix(f.Value.(string))) + ")", nil
+	case driver.EqualFoldOp:
+		return "(" + isString + " AND lower(" + t + ") = lower(" + b.arg(f.Value.(string)) + "))", nil
+	case driver.HasPrefixFoldOp:
+		return "(" + isString + " AND lower(" + t + ") LIKE lower(" + b.arg(likePrefix(f.Value.(string))) + "))", nil
+	}
+	if !validOps[f.Op] {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "postgresdocstore: unsupported filter operator %q", f.Op)
+	}
+	v, err := codec.EncodeValue(f.Value)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case bool:
+		js, err := jsoncodec.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return j + " " + f.Op + " " + b.arg(string(js)) + "::jsonb", nil
+	case int64, float64:
+		return "(jsonb_typeof(" + j + ") = 'number' AND (" + t + ")::numeric " + f.Op + " " + b.arg(v) + ")", nil
+	case uint64:
+		// database/sql does not accept uint64 values with the high bit set.
+		return "(jsonb_typeof(" + j + ") = 'number' AND (" + t + ")::numeric " + f.Op + " " + b.arg(strconv.FormatUint(v, 10)) + "::numeric)", nil
+	case string:
+		if len(f.FieldPath) == 1 && f.FieldPath[0] == c.keyField {
+			// Use the primary key index.
+			return c.keyCol + ` COLLATE "C" ` + f.Op + " " + b.arg(v), nil
+		}
+		return "(" + isString + " AND " + t + ` COLLATE "C" ` + f.Op + " " + b.arg(v) + ")", nil
+	default:
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "postgresdocstore: unsupported filter value %v of type %T", f.Value, f.Value)
+	}
+}
+
+var validOps = map[string]bool{
+	driver.EqualOp: true,
+	">":            true,
+	">=":           true,
+	"<":            true,
+	"<=":           true,
+}
+
+// likePrefix returns a LIKE pattern that matches strings beginning with prefix.
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(prefix) + "%"
+}
+
+// whereSQL returns a WHERE clause for fs, or the empty string if there are no
+// filters.
+func (c *collection) whereSQL(b *sqlBuilder, fs []driver.Filter) (string, error) {
+	if len(fs) == 0 {
+		return "", nil
+	}
+	cond, err := c.filtersSQL(b, fs)
+	if err != nil {
+		return "", err
+	}
+	return " WHERE " + cond, nil
+}
+
+// selectSQL returns the SELECT statement for q and its arguments.
+func (c *collection) selectSQL(q *driver.Query) (string, []interface{}, error) {
+	var b sqlBuilder
+	where, err := c.whereSQL(&b, q.Filters)
+	if err != nil {
+		return "", nil, err
+	}
+	query := "SELECT " + c.keyCol + ", " + c.docCol + " FROM " + c.table + where
+	if q.OrderByField != "" {
+		if q.OrderByField == c.keyField {
+			query += " ORDER BY " + c.keyCol + ` COLLATE "C"`
+		} else {
+			query += " ORDER BY " + c.jsonPath([]string{q.OrderByField}, false)
+		}
+		if q.OrderAscending {
+			query += " ASC"
+		} else {
+			query += " DESC"
+		}
+	}
+	if q.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(q.Limit)
+	}
+	return query, b.args, nil
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	query, args, err := c.selectSQL(q)
+	if err != nil {
+		return nil, err
+	}
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(driver.AsFunc(query)); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	return &docIterator{rows: rows, fieldPaths: fps, revField: c.opts.RevisionField}, nil
+}
+
+type docIterator struct {
+	rows       *sql.Rows
+	fieldPaths [][]string
+	revField   string
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if !it.rows.Next() {
+		if err := it.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	var (
+		key string
+		raw []byte
+	)
+	if err := it.rows.Scan(&key, &raw); err != nil {
+		return err
+	}
+	m, err := unmarshalDoc(raw)
+	if err != nil {
+		return err
+	}
+	return codec.DecodeDoc(m, doc, it.fieldPaths, it.revField)
+}
+
+func (it *docIterator) Stop() { it.rows.Close() }
+
+func (it *docIterator) As(i interface{}) bool {
+	p, ok := i.(**sql.Rows)
+	if !ok {
+		return false
+	}
+	*p = it.rows
+	return true
+}
+
+// QueryPlan implements driver.QueryPlan. The description is the SQL statement
+// that will be run; pass it to EXPLAIN to see PostgreSQL's plan.
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	query, _, err := c.selectSQL(q)
+	if err != nil {
+		return nil, err
+	}
+	// With filters, whether PostgreSQL uses an index is unknown.
+	plan := &driver.QueryPlan{
+		Description:   query,
+		ServerFilters: q.Filters,
+	}
+	if len(q.Filters) == 0 {
+		plan.Scan = driver.ScanFull
+	}
+	return plan, nil
+}
+
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	var b sqlBuilder
+	where, err := c.whereSQL(&b, q.Filters)
+	if err != nil {
+		return err
+	}
+	stmt := "DELETE FROM " + c.table + where
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(driver.AsFunc(stmt)); err != nil {
+			return err
+		}
+	}
+	_, err = c.db.ExecContext(ctx, stmt, b.args...)
+	return err
+}
+
+// RunUpdateQuery implements driver.RunUpdateQuery. It reads and locks the
+// matching documents, applies the mods to them and writes them back, all in a
+// single transaction.
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) (err error) {
+	var b sqlBuilder
+	where, err := c.whereSQL(&b, q.Filters)
+	if err != nil {
+		return err
+	}
+	query := "SELECT " + c.keyCol + ", " + c.docCol + " FROM " + c.table + where + " FOR UPDATE"
+	if q.BeforeQuery != nil {
+		if err := q.BeforeQuery(driver.AsFunc(query)); err != nil {
+			return err
+		}
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	rows, err := tx.QueryContext(ctx, query, b.args...)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		key string
+		doc map[string]interface{}
+	}
+	var matched []row
+	for rows.Next() {
+		var (
+			r   row
+			raw []byte
+		)
+		if err := rows.Scan(&r.key, &raw); err != nil {
+			rows.Close()
+			return err
+		}
+		if r.doc, err = unmarshalDoc(raw); err != nil {
+			rows.Close()
+			return err
+		}
+		matched = append(matched, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	stmt := "UPDATE " + c.table + " SET " + c.docCol + " = $2 WHERE " + c.keyCol + " = $1"
+	for _, r := range matched {
+		if err := eval.ApplyMods(r.doc, mods); err != nil {
+			return err
+		}
+		r.doc[c.opts.RevisionField] = driver.UniqueString()
+		js, err := jsoncodec.Marshal(r.doc)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, stmt, r.key, string(js)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,8 +16,12 @@ package docstore
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"gocloud.dev/docstore/driver"
@@ -29,6 +33,10 @@ type Query struct {
 	coll *Collection
 	dq   *driver.Query
 	err  error
+
+	// The maximum number of documents to hold when sorting locally, or zero if
+	// the query cannot be sorted locally.
+	maxLocalSort int
 }
 
 // Query creates a new Query over the collection.
@@ -37,8 +45,13 @@ func (c *Collection) Query() *Query {
 }
 
 // Where expresses a condition on the query.
+// The field path may be dotted, like "m.a", to filter on a field within a
+// nested map or struct. A document in which some component of the path is
+// missing, or is not a map or struct, does not match.
 // Valid ops are: "=", ">", "<", ">=", "<=".
 // Valid values are strings, integers, floating-point numbers, and time.Time values.
+// A bool value is also valid, with the "=" op. A value that implements
+// DocstoreMarshaler is replaced by the result of its MarshalDocstore method.
 func (q *Query) Where(fp FieldPath, op string, value interface{}) *Query {
 	if q.err != nil {
 		return q
@@ -51,9 +64,18 @@ func (q *Query) Where(fp FieldPath, op string, value interface{}) *Query {
 	if !validOp[op] {
 		return q.invalidf("invalid filter operator: %q. Use one of: =, >, <, >=, <=", op)
 	}
+	cv, err := driver.Convert(value)
+	if err != nil {
+		q.err = gcerr.Newf(gcerr.InvalidArgument, err, "invalid filter value: %v", value)
+		return q
+	}
+	value = cv
 	if !validFilterValue(value) {
 		return q.invalidf("invalid filter value: %v", value)
 	}
+	if reflect.TypeOf(value).Kind() == reflect.Bool && op != driver.EqualOp {
+		return q.invalidf("invalid filter operator %q for bool value: use =", op)
+	}
 	q.dq.Filters = append(q.dq.Filters, driver.Filter{
 		FieldPath: pfp,
 		Op:        op,
@@ -62,6 +84,77 @@ func (q *Query) Where(fp FieldPath, op string, value interface{}) *Query {
 	return q
 }
 
+// WhereExists restricts the query to documents that have a value, possibly nil,
+// at fp.
+//
+// For providers that cannot evaluate the condition, it is evaluated by docstore
+// after decoding each document into a value of the type passed to
+// DocumentIterator.Next. Use a map[string]interface{} in that case: every field
+// of a struct exists.
+func (q *Query) WhereExists(fp FieldPath) *Query {
+	return q.whereExists(fp, driver.ExistsOp)
+}
+
+// WhereNotExists restricts the query to documents that have no value at fp.
+// See WhereExists for a caveat about providers that cannot evaluate the
+// condition.
+func (q *Query) WhereNotExists(fp FieldPath) *Query {
+	return q.whereExists(fp, driver.NotExistsOp)
+}
+
+func (q *Query) whereExists(fp FieldPath, op string) *Query {
+	if q.err != nil {
+		return q
+	}
+	pfp, err := parseFieldPath(fp)
+	if err != nil {
+		q.err = err
+		return q
+	}
+	q.dq.Filters = append(q.dq.Filters, driver.Filter{FieldPath: pfp, Op: op})
+	return q
+}
+
+// WhereHasPrefix restricts the query to documents whose value at fp is a string
+// that begins with prefix.
+//
+// Providers evaluate the condition with their own prefix match if they have one,
+// and otherwise as a range of strings, so it can use an index on fp. Providers
+// that can do neither leave it to docstore, as with WhereEqualFold.
+func (q *Query) WhereHasPrefix(fp FieldPath, prefix string) *Query {
+	return q.whereString(fp, driver.HasPrefixOp, prefix)
+}
+
+// WhereEqualFold restricts the query to documents whose value at fp is a string
+// equal to s under Unicode case folding, as with strings.EqualFold.
+//
+// Providers that can compare strings case-insensitively do so. For others, the
+// condition is evaluated by docstore on the documents that match the rest of
+// the query.
+func (q *Query) WhereEqualFold(fp FieldPath, s string) *Query {
+	return q.whereString(fp, driver.EqualFoldOp, s)
+}
+
+// WhereHasPrefixFold restricts the query to documents whose value at fp is a
+// string that begins with prefix under Unicode case folding.
+// See WhereEqualFold for how providers evaluate the condition.
+func (q *Query) WhereHasPrefixFold(fp FieldPath, prefix string) *Query {
+	return q.whereString(fp, driver.HasPrefixFoldOp, prefix)
+}
+
+func (q *Query) whereString(fp FieldPath, op, s string) *Query {
+	if q.err != nil {
+		return q
+	}
+	pfp, err := parseFieldPath(fp)
+	if err != nil {
+		q.err = err
+		return q
+	}
+	q.dq.Filters = append(q.dq.Filters, driver.Filter{FieldPath: pfp, Op: op, Value: s})
+	return q
+}
+
 var validOp = map[string]bool{
 	"=":  true,
 	">":  true,
@@ -78,7 +171,7 @@ func validFilterValue(v interface{}) bool {
 		return true
 	}
 	switch reflect.TypeOf(v).Kind() {
-	case reflect.String:
+	case reflect.String, reflect.Bool:
 		return true
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return true
@@ -140,6 +233,29 @@ func (q *Query) OrderBy(field, direction string) *Query {
 	return q
 }
 
+// AllowLocalSort allows the docstore package to sort the results of the query
+// when the provider cannot. For example, DynamoDB can only sort by the sort key
+// of the table or of an index, and only when there is an equality filter on the
+// partition key. It has no effect on providers that can sort every query, or on
+// queries without an OrderBy clause.
+//
+// A query sorted locally reads every document that matches its filters, which
+// may be costly; Plan reports whether it will be sorted locally. It holds up to
+// maxDocs documents in memory. If the query has a limit of at most maxDocs, only
+// the first documents in order are kept; otherwise, if more than maxDocs
+// documents match, the query fails with an error whose code is
+// gcerrors.ResourceExhausted.
+func (q *Query) AllowLocalSort(maxDocs int) *Query {
+	if q.err != nil {
+		return q
+	}
+	if maxDocs <= 0 {
+		return q.invalidf("AllowLocalSort: maxDocs must be positive, got %d", maxDocs)
+	}
+	q.maxLocalSort = maxDocs
+	return q
+}
+
 // BeforeQuery takes a callback function that will be called before the Query is
 // executed to the underlying provider's query functionality. The callback takes
 // a parameter, asFunc, that converts its argument to provider-specific types.
@@ -154,12 +270,153 @@ func (q *Query) BeforeQuery(f func(asFunc func(interface{}) bool) error) *Query
 //
 // Call Stop on the iterator when finished.
 func (q *Query) Get(ctx context.Context, fps ...FieldPath) *DocumentIterator {
+	start := time.Now()
 	dcoll := q.coll.driver
 	if err := q.initGet(fps); err != nil {
 		return &DocumentIterator{err: wrapError(dcoll, err)}
 	}
-	it, err := dcoll.RunGetQuery(ctx, q.dq)
-	return &DocumentIterator{iter: it, coll: q.coll, err: wrapError(dcoll, err)}
+	dq, local := q.driverQuery()
+	if sdq := q.localSortQuery(dq); sdq != nil {
+		it, err := dcoll.RunGetQuery(ctx, sdq)
+		return &DocumentIterator{
+			slow:    q.slowQuery(sdq, start),
+			iter:    it,
+			coll:    q.coll,
+			filters: local,
+			strip:   addedFieldPaths(q.dq.FieldPaths, sdq.FieldPaths),
+			sort: &localSort{
+				fieldPath: strings.Split(q.dq.OrderByField, "."),
+				ascending: q.dq.OrderAscending,
+				limit:     q.dq.Limit,
+				maxDocs:   q.maxLocalSort,
+			},
+			err: wrapError(dcoll, err),
+		}
+	}
+	it, err := dcoll.RunGetQuery(ctx, dq)
+	return &DocumentIterator{
+		iter:    it,
+		coll:    q.coll,
+		filters: local,
+		strip:   addedFieldPaths(q.dq.FieldPaths, dq.FieldPaths),
+		limit:   q.dq.Limit,
+		err:     wrapError(dcoll, err),
+		slow:    q.slowQuery(dq, start),
+	}
+}
+
+// slowQuery returns the state for logging the get query dq if it is slow, or
+// nil if the collection has no slow log.
+func (q *Query) slowQuery(dq *driver.Query, start time.Time) *slowQuery {
+	if q.coll.slowLog == nil {
+		return nil
+	}
+	return &slowQuery{dq: dq, start: start}
+}
+
+// localSortQuery returns the query to pass to the driver if the results of dq
+// must be sorted locally, or nil if they need not be.
+func (q *Query) localSortQuery(dq *driver.Query) *driver.Query {
+	if q.maxLocalSort == 0 || dq.OrderByField == "" {
+		return nil
+	}
+	s, ok := q.coll.driver.(driver.OrderBySupporter)
+	if !ok || s.SupportsOrderBy(dq) {
+		return nil
+	}
+	sdq := *dq
+	sdq.OrderByField = ""
+	sdq.OrderAscending = false
+	// The driver can't apply the limit to unsorted results.
+	sdq.Limit = 0
+	// Make sure the field to sort by is retrieved.
+	fp := strings.Split(dq.OrderByField, ".")
+	if len(sdq.FieldPaths) > 0 && !hasFieldPath(sdq.FieldPaths, fp) {
+		sdq.FieldPaths = append(append([][]string(nil), sdq.FieldPaths...), fp)
+	}
+	return &sdq
+}
+
+// driverQuery returns the query to pass to the driver, along with the filters
+// that the driver cannot evaluate and that must be applied to its results.
+func (q *Query) driverQuery() (*driver.Query, []driver.Filter) {
+	var pushed, local []driver.Filter
+	for _, f := range q.dq.Filters {
+		if q.coll.driver.SupportsFilter(f) {
+			pushed = append(pushed, f)
+		} else {
+			local = append(local, f)
+		}
+	}
+	if len(local) == 0 {
+		return q.dq, nil
+	}
+	dq := *q.dq
+	dq.Filters = pushed
+	// The driver can't apply the limit, because it doesn't know which of the
+	// documents it returns will be filtered out.
+	dq.Limit = 0
+	// Make sure the fields needed by the local filters are retrieved.
+	if len(dq.FieldPaths) > 0 {
+		fps := append([][]string(nil), dq.FieldPaths...)
+		for _, f := range local {
+			if !hasFieldPath(fps, f.FieldPath) {
+				fps = append(fps, f.FieldPath)
+			}
+		}
+		dq.FieldPaths = fps
+	}
+	return &dq, local
+}
+
+// addedFieldPaths returns the field paths to clear from the documents returned
+// for a query that selected the field paths orig, so that the fields that were
+// only retrieved to filter or sort the documents locally are not returned.
+func addedFieldPaths(orig, fps [][]string) [][]string {
+	var added [][]string
+	for _, fp := range fps[len(orig):] {
+		// Clear the shortest prefix of fp that holds nothing selected. If a
+		// selected field holds fp, there is nothing to clear.
+		for i := 1; i <= len(fp); i++ {
+			if hasFieldPathPrefix(orig, fp[:i]) {
+				continue
+			}
+			if !hasPrefixOf(orig, fp[:i]) {
+				added = append(added, fp[:i])
+			}
+			break
+		}
+	}
+	return added
+}
+
+// hasFieldPathPrefix reports whether a field path in fps begins with prefix.
+func hasFieldPathPrefix(fps [][]string, prefix []string) bool {
+	for _, p := range fps {
+		if len(p) >= len(prefix) && driver.FieldPathsEqual(p[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrefixOf reports whether a field path in fps is a prefix of fp.
+func hasPrefixOf(fps [][]string, fp []string) bool {
+	for _, p := range fps {
+		if len(p) <= len(fp) && driver.FieldPathsEqual(p, fp[:len(p)]) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFieldPath(fps [][]string, fp []string) bool {
+	for _, p := range fps {
+		if driver.FieldPathsEqual(p, fp) {
+			return true
+		}
+	}
+	return false
 }
 
 func (q *Query) initGet(fps []FieldPath) error {
@@ -177,7 +434,7 @@ func (q *Query) initGet(fps []FieldPath) error {
 	if q.dq.OrderByField != "" && len(q.dq.Filters) > 0 {
 		found := false
 		for _, f := range q.dq.Filters {
-			if len(f.FieldPath) == 1 && f.FieldPath[0] == q.dq.OrderByField {
+			if strings.Join(f.FieldPath, ".") == q.dq.OrderByField {
 				found = true
 				break
 			}
@@ -187,21 +444,48 @@ func (q *Query) initGet(fps []FieldPath) error {
 				q.dq.OrderByField)
 		}
 	}
-	return nil
+	return applyStringOptionsToFilters(q.coll.stringOpts, q.dq.Filters)
 }
 
 // Delete deletes all the documents specified by the query.
 // It is an error if the query has a limit.
-func (q *Query) Delete(ctx context.Context) error {
+//
+// If the provider cannot evaluate some of the query's filters, Delete reads
+// the documents that match the query and deletes them with action lists of up
+// to 100 documents. Such a delete is not atomic: if it fails, some of the
+// documents may have been deleted and others not, and documents written while
+// it runs may or may not be deleted. The documents are read as maps, so a
+// collection opened with a key function must accept documents of type
+// map[string]interface{}.
+func (q *Query) Delete(ctx context.Context) (err error) {
+	if s := q.coll.slowLog; s != nil {
+		start := time.Now()
+		defer func() { s.logQuery(q.coll, SlowDeleteQuery, q.dq, start, 0, err) }()
+	}
 	if err := q.validateWrite("delete"); err != nil {
 		return err
 	}
+	if dq, local := q.driverQuery(); len(local) > 0 {
+		return q.runLocalWrite(ctx, dq, local, nil)
+	}
 	return q.coll.driver.RunDeleteQuery(ctx, q.dq)
 }
 
 // Update updates all the documents specified by the query.
 // It is an error if the query has a limit.
-func (q *Query) Update(ctx context.Context, mods Mods) error {
+//
+// If the provider cannot evaluate some of the query's filters, Update reads
+// the documents that match the query and updates them with action lists of up
+// to 100 documents. Such an update is not atomic: if it fails, some of the
+// documents may have been updated and others not, and documents written while
+// it runs may or may not be updated. The documents are read as maps, so a
+// collection opened with a key function must accept documents of type
+// map[string]interface{}.
+func (q *Query) Update(ctx context.Context, mods Mods) (err error) {
+	if s := q.coll.slowLog; s != nil {
+		start := time.Now()
+		defer func() { s.logQuery(q.coll, SlowUpdateQuery, q.dq, start, 0, err) }()
+	}
 	if err := q.validateWrite("update"); err != nil {
 		return err
 	}
@@ -209,9 +493,61 @@ func (q *Query) Update(ctx context.Context, mods Mods) error {
 	if err != nil {
 		return err
 	}
+	if err := applyStringOptionsToMods(q.coll.stringOpts, dmods); err != nil {
+		return err
+	}
+	if dq, local := q.driverQuery(); len(local) > 0 {
+		return q.runLocalWrite(ctx, dq, local, mods)
+	}
 	return q.coll.driver.RunUpdateQuery(ctx, q.dq, dmods)
 }
 
+// localWriteBatchSize is the largest number of documents that a delete or
+// update query whose filters are evaluated locally writes in one action list.
+const localWriteBatchSize = 100
+
+// runLocalWrite executes a delete or update query, some of whose filters must be
+// evaluated locally. It retrieves the documents that match all the filters, and
+// deletes them (if mods is nil) or updates them with action lists of at most
+// localWriteBatchSize actions, so that it holds only that many documents at a
+// time. It stops at the first action list that fails.
+func (q *Query) runLocalWrite(ctx context.Context, dq *driver.Query, local []driver.Filter, mods Mods) error {
+	dit, err := q.coll.driver.RunGetQuery(ctx, dq)
+	if err != nil {
+		return wrapError(q.coll.driver, err)
+	}
+	it := &DocumentIterator{iter: dit, coll: q.coll, filters: local}
+	defer it.Stop()
+	actions := q.coll.Actions()
+	for {
+		doc := map[string]interface{}{}
+		err := it.Next(ctx, doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Write queries don't check revisions.
+		delete(doc, q.coll.revisionField())
+		if mods == nil {
+			actions.Delete(doc)
+		} else {
+			actions.Update(doc, mods)
+		}
+		if len(actions.actions) == localWriteBatchSize {
+			if err := actions.Do(ctx); err != nil {
+				return err
+			}
+			actions = q.coll.Actions()
+		}
+	}
+	if len(actions.actions) == 0 {
+		return nil
+	}
+	return actions.Do(ctx)
+}
+
 func (q *Query) validateWrite(kind string) error {
 	if q.err != nil {
 		return q.err
@@ -225,7 +561,7 @@ func (q *Query) validateWrite(kind string) error {
 	if q.dq.OrderByField != "" {
 		return gcerr.Newf(gcerr.InvalidArgument, nil, "%s queries cannot have an OrderBy clause", kind)
 	}
-	return nil
+	return applyStringOptionsToFilters(q.coll.stringOpts, q.dq.Filters)
 }
 
 func (q *Query) invalidf(format string, args ...interface{}) *Query {
@@ -240,12 +576,50 @@ type DocumentIterator struct {
 	iter driver.DocumentIterator
 	coll *Collection
 	err  error // already wrapped
+
+	// For queries with filters that the driver cannot evaluate:
+	filters []driver.Filter // filters to evaluate on each document
+	strip   [][]string      // field paths retrieved only to filter or sort locally
+	limit   int             // maximum number of documents to return, if > 0
+	count   int             // number of documents returned so far
+
+	// For queries sorted locally.
+	sort *localSort
+
+	// For collections with a slow log.
+	slow *slowQuery
+}
+
+// slowQuery holds the state of a get query for the slow log.
+type slowQuery struct {
+	dq     *driver.Query
+	start  time.Time
+	n      int  // number of documents returned so far
+	logged bool // whether the iteration has ended
+}
+
+// localSort holds the state of a query that is sorted locally.
+type localSort struct {
+	fieldPath []string
+	ascending bool
+	limit     int // maximum number of documents to return, if > 0
+	maxDocs   int // maximum number of documents to hold
+	loaded    bool
+	docs      []Document // sorted, once loaded is true
 }
 
 // Next stores the next document in dst. It returns io.EOF if there are no more
 // documents.
 // Once Next returns an error, it will always return the same error.
 func (it *DocumentIterator) Next(ctx context.Context, dst Document) error {
+	err := it.next(ctx, dst)
+	if it.slow != nil {
+		it.slow.record(it.coll, err)
+	}
+	return err
+}
+
+func (it *DocumentIterator) next(ctx context.Context, dst Document) error {
 	if it.err != nil {
 		return it.err
 	}
@@ -253,15 +627,189 @@ func (it *DocumentIterator) Next(ctx context.Context, dst Document) error {
 		it.err = err
 		return it.err
 	}
+	// Stop when ctx is done, even if the driver has documents buffered.
+	if err := ctx.Err(); err != nil {
+		it.err = err
+		return it.err
+	}
 	ddoc, err := driver.NewDocument(dst)
 	if err != nil {
 		it.err = wrapError(it.coll.driver, err)
 		return it.err
 	}
+	if it.sort != nil {
+		it.err = wrapError(it.coll.driver, it.stripFields(ddoc, it.nextSorted(ctx, ddoc)))
+		return it.err
+	}
+	if len(it.filters) > 0 {
+		it.err = wrapError(it.coll.driver, it.stripFields(ddoc, it.nextFiltered(ctx, ddoc)))
+		return it.err
+	}
 	it.err = wrapError(it.coll.driver, it.iter.Next(ctx, ddoc))
 	return it.err
 }
 
+// stripFields clears it.strip from doc, unless err, the error from reading
+// doc, is non-nil, in which case it returns err.
+func (it *DocumentIterator) stripFields(doc driver.Document, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, fp := range it.strip {
+		if err := doc.Clear(fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextFiltered stores in dst the next document that satisfies it.filters.
+func (it *DocumentIterator) nextFiltered(ctx context.Context, dst driver.Document) error {
+	if it.limit > 0 && it.count >= it.limit {
+		return io.EOF
+	}
+	for {
+		// Decode into a fresh document, so that fields of documents that don't
+		// match never leak into dst.
+		tmp := newDocumentLike(dst.Origin)
+		tdoc, err := driver.NewDocument(tmp)
+		if err != nil {
+			return err
+		}
+		if err := it.iter.Next(ctx, tdoc); err != nil {
+			return err
+		}
+		if filtersMatch(it.filters, tdoc) {
+			copyDocument(dst.Origin, tmp)
+			it.count++
+			return nil
+		}
+	}
+}
+
+// nextSorted stores in dst the next document of a query sorted locally. The
+// first call reads and sorts all the matching documents.
+func (it *DocumentIterator) nextSorted(ctx context.Context, dst driver.Document) error {
+	s := it.sort
+	if !s.loaded {
+		if err := it.loadSorted(ctx, dst.Origin); err != nil {
+			return err
+		}
+		s.loaded = true
+	}
+	if len(s.docs) == 0 {
+		return io.EOF
+	}
+	copyDocument(dst.Origin, s.docs[0])
+	s.docs[0] = nil
+	s.docs = s.docs[1:]
+	return nil
+}
+
+// loadSorted reads the documents that match the query into it.sort.docs, as
+// documents like example, and sorts them.
+func (it *DocumentIterator) loadSorted(ctx context.Context, example Document) error {
+	s := it.sort
+	// With a small enough limit, only the first limit documents need to be kept,
+	// so drop the rest from time to time.
+	trim := s.limit > 0 && s.limit <= s.maxDocs
+	for {
+		doc := newDocumentLike(example)
+		ddoc, err := driver.NewDocument(doc)
+		if err != nil {
+			return err
+		}
+		err = it.iter.Next(ctx, ddoc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(it.filters) > 0 && !filtersMatch(it.filters, ddoc) {
+			continue
+		}
+		s.docs = append(s.docs, doc)
+		switch {
+		case trim && len(s.docs) > s.limit && (len(s.docs) >= 2*s.limit || len(s.docs) > s.maxDocs):
+			s.sortDocs()
+			s.docs = s.docs[:s.limit]
+		case !trim && len(s.docs) > s.maxDocs:
+			return gcerr.Newf(gcerr.ResourceExhausted, nil,
+				"more than %d documents to sort locally; raise the argument to AllowLocalSort, or add a limit", s.maxDocs)
+		}
+	}
+	s.sortDocs()
+	if s.limit > 0 && len(s.docs) > s.limit {
+		s.docs = s.docs[:s.limit]
+	}
+	return nil
+}
+
+// sortDocs sorts s.docs by the value at s.fieldPath. Documents whose values
+// cannot be compared keep their relative order.
+func (s *localSort) sortDocs() {
+	vals := make([]interface{}, len(s.docs))
+	for i, doc := range s.docs {
+		ddoc, err := driver.NewDocument(doc)
+		if err == nil {
+			vals[i], _ = ddoc.Get(s.fieldPath)
+		}
+	}
+	idx := make([]int, len(s.docs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		c, ok := driver.CompareValues(vals[idx[i]], vals[idx[j]])
+		if !ok {
+			return false
+		}
+		if s.ascending {
+			return c < 0
+		}
+		return c > 0
+	})
+	docs := make([]Document, len(s.docs))
+	for i, k := range idx {
+		docs[i] = s.docs[k]
+	}
+	s.docs = docs
+}
+
+func filtersMatch(fs []driver.Filter, doc driver.Document) bool {
+	for _, f := range fs {
+		if !driver.EvaluateFilter(f, doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// newDocumentLike returns an empty document of the same type as doc, which must
+// be a map[string]interface{} or a struct pointer.
+func newDocumentLike(doc Document) Document {
+	if _, ok := doc.(map[string]interface{}); ok {
+		return map[string]interface{}{}
+	}
+	return reflect.New(reflect.TypeOf(doc).Elem()).Interface()
+}
+
+// copyDocument replaces the contents of dst with those of src. The two must have
+// the same type.
+func copyDocument(dst, src Document) {
+	if m, ok := dst.(map[string]interface{}); ok {
+		for k := range m {
+			delete(m, k)
+		}
+		for k, v := range src.(map[string]interface{}) {
+			m[k] = v
+		}
+		return
+	}
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+}
+
 // Stop stops the iterator. Calling Next on a stopped iterator will return io.EOF, or
 // the error that Next previously returned.
 func (it *DocumentIterator) Stop() {
@@ -270,6 +818,136 @@ func (it *DocumentIterator) Stop() {
 	}
 	it.err = io.EOF
 	it.iter.Stop()
+	if it.slow != nil {
+		it.slow.record(it.coll, io.EOF)
+	}
+}
+
+// record notes the result of a call to Next, logging the query if the
+// iteration has ended and it was slow.
+func (s *slowQuery) record(c *Collection, err error) {
+	if err == nil {
+		s.n++
+		return
+	}
+	if s.logged {
+		return
+	}
+	s.logged = true
+	if err == io.EOF {
+		err = nil
+	}
+	c.slowLog.logQuery(c, SlowGetQuery, s.dq, s.start, s.n, err)
+}
+
+// ForEach calls fn on each remaining document of the iteration, in order. It
+// decodes each document into a new Document obtained from newDoc, which should
+// return a map[string]interface{} or a pointer to a struct.
+//
+// ForEach returns nil when there are no more documents, or else the first error
+// returned by Next or fn. It does not call Stop.
+func (it *DocumentIterator) ForEach(ctx context.Context, newDoc func() Document, fn func(Document) error) error {
+	return it.ForEachConcurrent(ctx, 1, newDoc, fn)
+}
+
+// ForEachConcurrent is like ForEach, but calls fn on up to n documents
+// concurrently, each on its own goroutine, so the calls may finish in any order.
+// Documents are still retrieved one at a time. After an error, ForEachConcurrent
+// retrieves no more documents, and waits for the calls to fn that are in
+// progress to return.
+//
+// An error from fn does not interrupt a call to Next that is in progress, so
+// the iterator remains usable afterwards. If fn fails while Next is retrieving
+// a document, that document is not passed to fn, and a later call to Next
+// returns the document after it.
+func (it *DocumentIterator) ForEachConcurrent(ctx context.Context, n int, newDoc func() Document, fn func(Document) error) error {
+	if n < 1 {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "ForEachConcurrent: n must be positive, got %d", n)
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	sem := make(chan struct{}, n)
+	for !failed() {
+		doc := newDoc()
+		if err := it.Next(ctx, doc); err != nil {
+			if err != io.EOF {
+				setErr(err)
+			}
+			break
+		}
+		if n == 1 {
+			if err := fn(doc); err != nil {
+				setErr(err)
+			}
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(doc); err != nil {
+				setErr(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Chan starts a goroutine that sends each remaining document of the iteration
+// on the returned channel, in order, and closes the channel when there are no
+// more documents or Next returns an error. It decodes each document into a new
+// Document obtained from newDoc, as ForEach does.
+//
+// After the channel is closed, the returned function returns the error that
+// ended the iteration, or nil if there were no more documents. To stop early,
+// cancel ctx; the goroutine then exits without waiting for the channel to be
+// read. Chan does not call Stop.
+func (it *DocumentIterator) Chan(ctx context.Context, newDoc func() Document) (<-chan Document, func() error) {
+	ch := make(chan Document)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		defer close(ch)
+		for {
+			doc := newDoc()
+			if err = it.Next(ctx, doc); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			select {
+			case ch <- doc:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+	}()
+	return ch, func() error {
+		<-done
+		return err
+	}
 }
 
 // As converts i to provider-specific types.
@@ -286,9 +964,124 @@ func (it *DocumentIterator) As(i interface{}) bool {
 // Plan describes how the query would be executed if its Get method were called with
 // the given field paths. Plan uses only information available to the client, so it
 // cannot know whether a service uses indexes or scans internally.
-func (q *Query) Plan(fps ...FieldPath) (string, error) {
+//
+// Filters that the provider cannot evaluate are applied by the docstore package
+// to the documents the provider returns; they appear in the plan's ClientFilters.
+func (q *Query) Plan(fps ...FieldPath) (*QueryPlan, error) {
 	if err := q.initGet(fps); err != nil {
-		return "", err
+		return nil, err
+	}
+	dq, local := q.driverQuery()
+	sdq := q.localSortQuery(dq)
+	if sdq != nil {
+		dq = sdq
+	}
+	dplan, err := q.coll.driver.QueryPlan(dq)
+	if err != nil {
+		return nil, wrapError(q.coll.driver, err)
+	}
+	plan := newQueryPlan(dplan)
+	plan.ClientFilters = append(plan.ClientFilters, toPlanFilters(local)...)
+	plan.SortedLocally = sdq != nil
+	return plan, nil
+}
+
+// A QueryPlan describes how a query will be executed. Drivers fill in as much of
+// it as they know; zero values mean that the information is unavailable.
+//
+// Tools can use a QueryPlan to detect expensive queries, such as those that scan
+// the entire collection, before they are run.
+type QueryPlan struct {
+	// Description is a short, provider-specific summary of the plan.
+	Description string
+
+	// Index is the name of the index used to satisfy the query, or the empty string
+	// if no secondary index is used or the provider cannot tell.
+	Index string
+
+	// Scan describes which documents are examined to execute the query.
+	// ScanUnknown means that the provider chooses how to execute the query, so
+	// it may examine every document.
+	Scan ScanKind
+
+	// ServerFilters are the Where clauses evaluated by the provider service.
+	ServerFilters []PlanFilter
+
+	// ClientFilters are the Where clauses evaluated locally, after documents
+	// have been retrieved from the service.
+	ClientFilters []PlanFilter
+
+	// EstimatedScan is the estimated number of documents that will be examined.
+	// Zero means no estimate is available.
+	EstimatedScan int64
+
+	// SortedLocally reports whether the results are sorted by the docstore
+	// package, after all of them have been retrieved, because the provider
+	// cannot sort them. See Query.AllowLocalSort.
+	SortedLocally bool
+}
+
+// ScanKind describes which documents a query examines.
+type ScanKind = driver.ScanKind
+
+// The kinds of scans.
+const (
+	// ScanUnknown means the provider cannot tell which documents will be
+	// examined, because the service chooses how to execute the query.
+	ScanUnknown = driver.ScanUnknown
+	// ScanFull means every document in the collection is examined.
+	ScanFull = driver.ScanFull
+	// ScanRange means only the documents in a range of the primary key or of an
+	// index are examined.
+	ScanRange = driver.ScanRange
+	// ScanLookup means the documents are read directly by their keys.
+	ScanLookup = driver.ScanLookup
+)
+
+// A PlanFilter describes a single Where clause of a query.
+type PlanFilter struct {
+	FieldPath FieldPath
+	Op        string
+	Value     interface{}
+}
+
+func (f PlanFilter) String() string {
+	if f.Op == driver.ExistsOp || f.Op == driver.NotExistsOp {
+		return fmt.Sprintf("%s %s", f.FieldPath, f.Op)
+	}
+	return fmt.Sprintf("%s %s %v", f.FieldPath, f.Op, f.Value)
+}
+
+// String returns the plan's description.
+func (p *QueryPlan) String() string {
+	if p.Description == "" {
+		return "unknown"
+	}
+	return p.Description
+}
+
+func newQueryPlan(dp *driver.QueryPlan) *QueryPlan {
+	if dp == nil {
+		return &QueryPlan{}
+	}
+	return &QueryPlan{
+		Description:   dp.Description,
+		Index:         dp.Index,
+		Scan:          dp.Scan,
+		ServerFilters: toPlanFilters(dp.ServerFilters),
+		ClientFilters: toPlanFilters(dp.ClientFilters),
+		EstimatedScan: dp.EstimatedScan,
+	}
+}
+
+func toPlanFilters(fs []driver.Filter) []PlanFilter {
+	var pfs []PlanFilter
+	for _, f := range fs {
+		pfs = append(pfs, PlanFilter{
+			FieldPath: FieldPath(strings.Join(f.FieldPath, ".")),
+			Op:        f.Op,
+			Value:     f.Value,
+		})
 	}
-	return q.coll.driver.QueryPlan(q.dq)
+	return pfs
 }
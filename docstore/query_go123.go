@@ -0,0 +1,83 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+// +build go1.23
+
+package docstore
+
+import (
+	"context"
+	"io"
+	"iter"
+)
+
+// All returns an iterator over the remaining documents of the iteration, for
+// use with a range loop:
+//
+//	for doc, err := range it.All(ctx, newDoc) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// It decodes each document into a new Document obtained from newDoc, as
+// ForEach does. If Next returns an error other than io.EOF, the iterator
+// yields it with a nil Document and ends. All does not call Stop.
+func (it *DocumentIterator) All(ctx context.Context, newDoc func() Document) iter.Seq2[Document, error] {
+	return func(yield func(Document, error) bool) {
+		for {
+			doc := newDoc()
+			if err := it.Next(ctx, doc); err != nil {
+				if err != io.EOF {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(doc, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Docs runs the query and returns an iterator over its results, decoded into
+// maps, for use with a range loop:
+//
+//	for doc, err := range coll.Query().Where("Game", "=", "Chess").Docs(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// The field paths are passed to Get. The query's DocumentIterator is stopped
+// when the loop ends, including when it ends early. To decode the results
+// into structs, use DocumentIterator.All.
+func (q *Query) Docs(ctx context.Context, fps ...FieldPath) iter.Seq2[map[string]interface{}, error] {
+	return func(yield func(map[string]interface{}, error) bool) {
+		it := q.Get(ctx, fps...)
+		defer it.Stop()
+		for doc, err := range it.All(ctx, func() Document { return map[string]interface{}{} }) {
+			var m map[string]interface{}
+			if doc != nil {
+				m = doc.(map[string]interface{})
+			}
+			if !yield(m, err) {
+				return
+			}
+		}
+	}
+}
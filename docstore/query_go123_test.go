@@ -0,0 +1,76 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+// +build go1.23
+
+package docstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/gcerrors"
+)
+
+func TestAll(t *testing.T) {
+	ctx := context.Background()
+	var docs []map[string]interface{}
+	for i := 0; i < 5; i++ {
+		docs = append(docs, map[string]interface{}{"n": i})
+	}
+	c := &Collection{driver: &localFilterDriver{docs: docs}}
+	newDoc := func() Document { return map[string]interface{}{} }
+
+	// All yields the documents in order.
+	var got []int
+	for doc, err := range c.Query().Get(ctx).All(ctx, newDoc) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, doc.(map[string]interface{})["n"].(int))
+	}
+	if want := []int{0, 1, 2, 3, 4}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Docs stops the iterator when the loop ends early.
+	got = nil
+	for doc, err := range c.Query().Docs(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, doc["n"].(int))
+		if len(got) == 2 {
+			break
+		}
+	}
+	if want := []int{0, 1}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// An error ends the iteration after it is yielded.
+	q := c.Query().Where("", "=", 1)
+	n := 0
+	for doc, err := range q.Docs(ctx) {
+		n++
+		if doc != nil || gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("got (%v, %v), want (nil, InvalidArgument)", doc, err)
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d iterations for an invalid query, want 1", n)
+	}
+}
@@ -16,11 +16,17 @@ package docstore
 
 import (
 	"context"
+	"errors"
+	"io"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"gocloud.dev/docstore/driver"
 	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
 )
 
 func TestQueryValidFilter(t *testing.T) {
@@ -84,3 +90,409 @@ func TestInvalidQuery(t *testing.T) {
 		check(test.q.Update(ctx, nil))
 	}
 }
+
+func TestLocalFilters(t *testing.T) {
+	ctx := context.Background()
+	type score struct {
+		Game  string
+		Score int
+	}
+	d := &localFilterDriver{
+		unsupported: "Score",
+		docs: []map[string]interface{}{
+			{"Game": "a", "Score": 1},
+			{"Game": "a", "Score": 5},
+			{"Game": "b", "Score": 7},
+			{"Game": "a", "Score": 9},
+			{"Game": "a", "Score": 2},
+		},
+	}
+	c := &Collection{driver: d}
+	q := c.Query().Where("Game", "=", "a").Where("Score", ">", 3).Limit(1)
+	iter := q.Get(ctx, "Game")
+	defer iter.Stop()
+	var got []score
+	for {
+		var s score
+		err := iter.Next(ctx, &s)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	// Score was retrieved to evaluate the local filter, but was not selected.
+	if want := []score{{"a", 0}}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The driver should only see the filter it supports, no limit, and the field
+	// path needed to evaluate the local filter.
+	want := &driver.Query{
+		Filters:    []driver.Filter{{FieldPath: []string{"Game"}, Op: "=", Value: "a"}},
+		FieldPaths: [][]string{{"Game"}, {"Score"}},
+	}
+	if diff := cmp.Diff(d.gotQuery, want); diff != "" {
+		t.Errorf("driver query: %s", diff)
+	}
+
+	plan, err := q.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPlan := &QueryPlan{
+		ServerFilters: []PlanFilter{{FieldPath: "Game", Op: "=", Value: "a"}},
+		ClientFilters: []PlanFilter{{FieldPath: "Score", Op: ">", Value: 3}},
+	}
+	if diff := cmp.Diff(plan, wantPlan); diff != "" {
+		t.Errorf("plan: %s", diff)
+	}
+
+	// Only the unselected part of a nested field retrieved for a local filter
+	// is removed.
+	d = &localFilterDriver{
+		unsupported: "Stats",
+		docs: []map[string]interface{}{
+			{"Game": "a", "Stats": map[string]interface{}{"Score": 5, "Wins": 2}},
+		},
+	}
+	c = &Collection{driver: d}
+	iter = c.Query().Where("Stats.Score", ">", 3).Get(ctx, "Game", "Stats.Wins")
+	defer iter.Stop()
+	m := map[string]interface{}{}
+	if err := iter.Next(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	wantDoc := map[string]interface{}{"Game": "a", "Stats": map[string]interface{}{"Wins": 2}}
+	if diff := cmp.Diff(m, wantDoc); diff != "" {
+		t.Errorf("nested field: %s", diff)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	ctx := context.Background()
+	var docs []map[string]interface{}
+	for i := 0; i < 10; i++ {
+		docs = append(docs, map[string]interface{}{"n": i})
+	}
+	c := &Collection{driver: &localFilterDriver{docs: docs}}
+	newDoc := func() Document { return map[string]interface{}{} }
+
+	// ForEach visits the documents in order.
+	var got []int
+	err := c.Query().Get(ctx).ForEach(ctx, newDoc, func(doc Document) error {
+		got = append(got, doc.(map[string]interface{})["n"].(int))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// An error from fn stops the iteration.
+	errStop := errors.New("stop")
+	count := 0
+	err = c.Query().Get(ctx).ForEach(ctx, newDoc, func(Document) error {
+		count++
+		if count == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || count != 3 {
+		t.Errorf("got %v after %d calls, want %v after 3", err, count, errStop)
+	}
+
+	// The iterator can still be used after fn fails.
+	iter := c.Query().Get(ctx)
+	defer iter.Stop()
+	err = iter.ForEach(ctx, newDoc, func(doc Document) error {
+		if doc.(map[string]interface{})["n"] == 1 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("got %v, want %v", err, errStop)
+	}
+	m := map[string]interface{}{}
+	if err := iter.Next(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if m["n"] != 2 {
+		t.Errorf("after ForEach: got document %v, want n = 2", m)
+	}
+
+	// ForEachConcurrent runs at most n calls at once.
+	var (
+		mu            sync.Mutex
+		running, most int
+		sum           int
+	)
+	err = c.Query().Get(ctx).ForEachConcurrent(ctx, 3, newDoc, func(doc Document) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		sum += doc.(map[string]interface{})["n"].(int)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 45 {
+		t.Errorf("got sum %d, want 45", sum)
+	}
+	if most > 3 {
+		t.Errorf("%d concurrent calls, want at most 3", most)
+	}
+	if err := c.Query().Get(ctx).ForEachConcurrent(ctx, 0, newDoc, nil); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("n = 0: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestChan(t *testing.T) {
+	ctx := context.Background()
+	docs := []map[string]interface{}{{"n": 0}, {"n": 1}, {"n": 2}}
+	c := &Collection{driver: &localFilterDriver{docs: docs}}
+	newDoc := func() Document { return map[string]interface{}{} }
+
+	ch, errf := c.Query().Get(ctx).Chan(ctx, newDoc)
+	var got []int
+	for doc := range ch {
+		got = append(got, doc.(map[string]interface{})["n"].(int))
+	}
+	if err := errf(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1, 2}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Canceling the context stops the goroutine, even if the channel isn't read.
+	cctx, cancel := context.WithCancel(ctx)
+	ch, errf = c.Query().Get(ctx).Chan(cctx, newDoc)
+	<-ch
+	cancel()
+	if err := errf(); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestLocalSort(t *testing.T) {
+	ctx := context.Background()
+	type score struct {
+		Game  string
+		Score int
+	}
+	var docs []map[string]interface{}
+	for i, n := range []int{3, 1, 4, 1, 5, 9, 2, 6} {
+		docs = append(docs, map[string]interface{}{"Game": string(rune('a' + i%2)), "Score": n})
+	}
+	d := &noSortDriver{&localFilterDriver{docs: docs, unsupported: "Game"}}
+	c := &Collection{driver: d}
+	scores := func(q *Query) ([]int, error) {
+		t.Helper()
+		iter := q.Get(ctx)
+		defer iter.Stop()
+		var got []int
+		for {
+			var s score
+			err := iter.Next(ctx, &s)
+			if err == io.EOF {
+				return got, nil
+			}
+			if err != nil {
+				return got, err
+			}
+			got = append(got, s.Score)
+		}
+	}
+
+	for _, test := range []struct {
+		q    *Query
+		want []int
+	}{
+		{c.Query().OrderBy("Score", Ascending).AllowLocalSort(10), []int{1, 1, 2, 3, 4, 5, 6, 9}},
+		{c.Query().OrderBy("Score", Descending).AllowLocalSort(10), []int{9, 6, 5, 4, 3, 2, 1, 1}},
+		// With a limit, only the first documents are kept.
+		{c.Query().OrderBy("Score", Descending).Limit(3).AllowLocalSort(3), []int{9, 6, 5}},
+		{c.Query().OrderBy("Score", Ascending).Limit(1).AllowLocalSort(2), []int{1}},
+		// Filters that the driver doesn't support are applied before sorting.
+		{c.Query().Where("Game", "=", "b").Where("Score", ">", 0).OrderBy("Score", Ascending).AllowLocalSort(4), []int{1, 1, 6, 9}},
+	} {
+		got, err := scores(test.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+		if d.gotQuery.OrderByField != "" || d.gotQuery.Limit != 0 {
+			t.Errorf("driver got OrderByField %q and limit %d, want neither", d.gotQuery.OrderByField, d.gotQuery.Limit)
+		}
+		plan, err := test.q.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !plan.SortedLocally {
+			t.Error("plan: got SortedLocally false, want true")
+		}
+	}
+
+	// More matching documents than the maximum is an error.
+	_, err := scores(c.Query().OrderBy("Score", Ascending).AllowLocalSort(7))
+	if gcerrors.Code(err) != gcerrors.ResourceExhausted {
+		t.Errorf("got %v, want ResourceExhausted", err)
+	}
+	if err := c.Query().AllowLocalSort(0).Get(ctx).Next(ctx, &score{}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("maxDocs = 0: got %v, want InvalidArgument", err)
+	}
+
+	// Without AllowLocalSort, or with a driver that can sort, the driver sorts.
+	c2 := &Collection{driver: d.localFilterDriver}
+	for _, q := range []*Query{
+		c.Query().OrderBy("Score", Ascending),
+		c2.Query().OrderBy("Score", Ascending).AllowLocalSort(10),
+	} {
+		if _, err := scores(q); err != nil {
+			t.Fatal(err)
+		}
+		if d.gotQuery.OrderByField != "Score" {
+			t.Error("driver did not get the OrderByField")
+		}
+	}
+}
+
+func TestLocalWriteBatches(t *testing.T) {
+	ctx := context.Background()
+	var docs []map[string]interface{}
+	for i := 0; i < 250; i++ {
+		docs = append(docs, map[string]interface{}{"key": i, "Score": i % 2})
+	}
+	d := &localWriteDriver{localFilterDriver: &localFilterDriver{docs: docs, unsupported: "Score"}}
+	c := &Collection{driver: d}
+
+	// A delete whose filter is evaluated locally writes in bounded batches.
+	if err := c.Query().Where("Score", ">=", 0).Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{100, 100, 50}; !cmp.Equal(d.sizes, want) {
+		t.Errorf("delete: got batch sizes %v, want %v", d.sizes, want)
+	}
+
+	// Only matching documents are updated.
+	d.sizes = nil
+	if err := c.Query().Where("Score", "=", 1).Update(ctx, Mods{"Score": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{100, 25}; !cmp.Equal(d.sizes, want) {
+		t.Errorf("update: got batch sizes %v, want %v", d.sizes, want)
+	}
+
+	// A failed batch stops the write.
+	d.sizes = nil
+	d.fail = true
+	if err := c.Query().Where("Score", ">=", 0).Delete(ctx); err == nil {
+		t.Error("got nil, want error")
+	}
+	if want := []int{100}; !cmp.Equal(d.sizes, want) {
+		t.Errorf("failed delete: got batch sizes %v, want %v", d.sizes, want)
+	}
+}
+
+// localWriteDriver is a localFilterDriver that records the lengths of the
+// action lists it runs, and fails them all if fail is set.
+type localWriteDriver struct {
+	*localFilterDriver
+	fail  bool
+	sizes []int
+}
+
+func (*localWriteDriver) Key(doc driver.Document) (interface{}, error) {
+	return doc.GetField("key")
+}
+
+func (*localWriteDriver) RevisionField() string { return DefaultRevisionField }
+
+func (*localWriteDriver) MaxDocumentSize() int { return 0 }
+
+func (d *localWriteDriver) RunActions(ctx context.Context, as []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	d.sizes = append(d.sizes, len(as))
+	if !d.fail {
+		return nil
+	}
+	errs := make([]error, len(as))
+	for i := range errs {
+		errs[i] = gcerr.Newf(gcerr.Internal, nil, "fail")
+	}
+	return driver.NewActionListError(errs)
+}
+
+// noSortDriver is a localFilterDriver that cannot sort.
+type noSortDriver struct {
+	*localFilterDriver
+}
+
+func (*noSortDriver) SupportsOrderBy(*driver.Query) bool { return false }
+
+// localFilterDriver is a driver.Collection that supports queries, except for
+// filters on the field named by unsupported.
+type localFilterDriver struct {
+	driver.Collection
+	unsupported string
+	docs        []map[string]interface{}
+	gotQuery    *driver.Query
+}
+
+func (d *localFilterDriver) SupportsFilter(f driver.Filter) bool {
+	return f.FieldPath[0] != d.unsupported
+}
+
+func (d *localFilterDriver) RunGetQuery(_ context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	d.gotQuery = q
+	var docs []map[string]interface{}
+	for _, doc := range d.docs {
+		ddoc, err := driver.NewDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		if filtersMatch(q.Filters, ddoc) {
+			docs = append(docs, doc)
+		}
+	}
+	return &sliceIterator{docs: docs}, nil
+}
+
+func (d *localFilterDriver) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	return &driver.QueryPlan{ServerFilters: q.Filters}, nil
+}
+
+type sliceIterator struct {
+	driver.DocumentIterator
+	docs []map[string]interface{}
+}
+
+func (it *sliceIterator) Next(_ context.Context, doc driver.Document) error {
+	if len(it.docs) == 0 {
+		return io.EOF
+	}
+	for k, v := range it.docs[0] {
+		if err := doc.SetField(k, v); err != nil {
+			return err
+		}
+	}
+	it.docs = it.docs[1:]
+	return nil
+}
+
+func (it *sliceIterator) Stop() {}
@@ -0,0 +1,52 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisdocstore
+
+import (
+	"fmt"
+
+	"gocloud.dev/docstore/internal/jsoncodec"
+)
+
+// codec encodes documents as trees of the Go values that encoding/json
+// marshals to JSON.
+var codec jsoncodec.Codec
+
+// encodeHash returns the fields of the hash that stores doc: the JSON encoding
+// of each top-level field's value.
+func encodeHash(doc map[string]interface{}) (map[string]interface{}, error) {
+	fields := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		b, err := jsoncodec.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[k] = string(b)
+	}
+	return fields, nil
+}
+
+// decodeHash reverses encodeHash.
+func decodeHash(fields map[string]string) (map[string]interface{}, error) {
+	doc := make(map[string]interface{}, len(fields))
+	for k, s := range fields {
+		v, err := jsoncodec.Unmarshal([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("redisdocstore: hash field %q: %v", k, err)
+		}
+		doc[k] = v
+	}
+	return doc, nil
+}
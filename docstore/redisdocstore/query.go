@@ -0,0 +1,489 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisdocstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+)
+
+// eval evaluates filters and sort orders on the documents read from Redis, and
+// applies modifications to them.
+var eval = mapdoc.Evaluator{ToGo: codec.ToGo, EncodeValue: codec.EncodeValue}
+
+// batchSize is the number of keys requested by each SCAN or FT.SEARCH.
+const batchSize = 1000
+
+// SupportsFilter implements driver.SupportsFilter. All filters are evaluated
+// on the client, whether or not they are also sent to RediSearch.
+func (c *collection) SupportsFilter(driver.Filter) bool { return true }
+
+// A queryPlan says how to find the documents that may match a query.
+type queryPlan struct {
+	search string          // the RediSearch query, or empty to SCAN
+	pushed []driver.Filter // the filters in search
+	local  []driver.Filter // the filters only evaluated on the client
+}
+
+// planQuery chooses between FT.SEARCH and SCAN for fs.
+func (c *collection) planQuery(fs []driver.Filter) queryPlan {
+	var p queryPlan
+	var terms []string
+	for _, f := range fs {
+		if term, ok := c.searchTerm(f); ok {
+			terms = append(terms, term)
+			p.pushed = append(p.pushed, f)
+		} else {
+			p.local = append(p.local, f)
+		}
+	}
+	p.search = strings.Join(terms, " ")
+	return p
+}
+
+// pattern returns the SCAN pattern for the keys of the collection.
+func (c *collection) pattern() string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return r.Replace(c.prefix) + "*"
+}
+
+// searchTerm returns the RediSearch query term for f, if the search index has a
+// suitable field. The term may match more documents than f, but never fewer.
+func (c *collection) searchTerm(f driver.Filter) (string, bool) {
+	if c.opts.SearchIndex == nil {
+		return "", false
+	}
+	fp := strings.Join(f.FieldPath, ".")
+	for _, sf := range c.opts.SearchIndex.Fields {
+		if sf.FieldPath != fp {
+			continue
+		}
+		attr := sf.Attribute
+		if attr == "" {
+			attr = sf.FieldPath
+		}
+		switch sf.Type {
+		case SearchTag:
+			s, ok := f.Value.(string)
+			if !ok || f.Op != driver.EqualOp {
+				continue
+			}
+			if !c.opts.UseRedisJSON {
+				// Hash fields hold JSON, so strings have their quotes.
+				s = strconv.Quote(s)
+			}
+			return "@" + escapeSearch(attr) + ":{" + escapeSearch(s) + "}", true
+		case SearchNumeric:
+			v, ok := toFloat(f.Value)
+			if !ok {
+				continue
+			}
+			// RediSearch compares float64s, which cannot represent every integer.
+			// Inclusive bounds avoid excluding documents that round to v.
+			lo, hi := "-inf", "+inf"
+			n := strconv.FormatFloat(v, 'g', -1, 64)
+			switch f.Op {
+			case driver.EqualOp:
+				lo, hi = n, n
+			case ">", ">=":
+				lo = n
+			case "<", "<=":
+				hi = n
+			default:
+				continue
+			}
+			return "@" + escapeSearch(attr) + ":[" + lo + " " + hi + "]", true
+		}
+	}
+	return "", false
+}
+
+// toFloat converts the number v, if it is one, to a finite float64.
+func toFloat(v interface{}) (float64, bool) {
+	ev, err := codec.EncodeValue(v)
+	if err != nil {
+		return 0, false
+	}
+	var f float64
+	switch ev := ev.(type) {
+	case int64:
+		f = float64(ev)
+	case uint64:
+		f = float64(ev)
+	case float64:
+		f = ev
+	default:
+		return 0, false
+	}
+	return f, !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// escapeSearch escapes the punctuation and spaces in s, which RediSearch
+// otherwise treats as syntax or separators.
+func escapeSearch(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if r == '_' || r > 0x7f || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// beforeQuery calls q.BeforeQuery, if any, with an as function that exposes
+// the client and the search query or SCAN pattern.
+func (c *collection) beforeQuery(q *driver.Query, p queryPlan) error {
+	if q.BeforeQuery == nil {
+		return nil
+	}
+	s := p.search
+	if s == "" {
+		s = c.pattern()
+	}
+	return q.BeforeQuery(func(i interface{}) bool {
+		switch i := i.(type) {
+		case **redis.Client:
+			*i = c.client
+		case *string:
+			*i = s
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+// A keySource returns the Redis keys of the documents that may match a query,
+// in batches.
+type keySource struct {
+	client *redis.Client
+	index  string
+	search string
+	match  string
+
+	cursor uint64
+	offset int
+	done   bool
+	seen   map[string]bool // SCAN may return a key more than once
+}
+
+func (c *collection) newKeySource(client *redis.Client, p queryPlan) *keySource {
+	s := &keySource{client: client, search: p.search}
+	if p.search != "" {
+		s.index = c.opts.SearchIndex.Name
+	} else {
+		s.match = c.pattern()
+		s.seen = map[string]bool{}
+	}
+	return s
+}
+
+// next returns the next batch of keys, or io.EOF when there are no more.
+func (s *keySource) next() ([]string, error) {
+	for !s.done {
+		var (
+			keys []string
+			err  error
+		)
+		if s.search != "" {
+			keys, err = s.nextSearch()
+		} else {
+			keys, err = s.nextScan()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			return keys, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+func (s *keySource) nextScan() ([]string, error) {
+	keys, cursor, err := s.client.Scan(s.cursor, s.match, batchSize).Result()
+	if err != nil {
+		return nil, err
+	}
+	s.cursor = cursor
+	s.done = cursor == 0
+	var fresh []string
+	for _, k := range keys {
+		if !s.seen[k] {
+			s.seen[k] = true
+			fresh = append(fresh, k)
+		}
+	}
+	return fresh, nil
+}
+
+func (s *keySource) nextSearch() ([]string, error) {
+	res, err := s.client.Do("FT.SEARCH", s.index, s.search, "NOCONTENT", "LIMIT", s.offset, batchSize).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := searchKeys(res)
+	if err != nil {
+		return nil, err
+	}
+	s.offset += len(keys)
+	s.done = len(keys) < batchSize
+	return keys, nil
+}
+
+// searchKeys returns the keys in the reply to FT.SEARCH with NOCONTENT: the
+// total number of results, followed by the keys.
+func searchKeys(res interface{}) ([]string, error) {
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) == 0 {
+		return nil, gcerr.Newf(gcerr.Internal, nil, "redisdocstore: unexpected FT.SEARCH reply %v", res)
+	}
+	keys := make([]string, 0, len(vals)-1)
+	for _, v := range vals[1:] {
+		k, ok := v.(string)
+		if !ok {
+			return nil, gcerr.Newf(gcerr.Internal, nil, "redisdocstore: unexpected FT.SEARCH key %v", v)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// nextMatches reads the documents of the next batch of keys from s and returns
+// those that satisfy fs, with their keys.
+func (c *collection) nextMatches(client *redis.Client, s *keySource, fs []driver.Filter) ([]string, []map[string]interface{}, error) {
+	keys, err := s.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	docs, err := c.readAll(client, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		mkeys []string
+		mdocs []map[string]interface{}
+	)
+	for i, doc := range docs {
+		// The document may have been deleted since it was found.
+		if doc != nil && eval.FiltersMatch(fs, doc) {
+			mkeys = append(mkeys, keys[i])
+			mdocs = append(mdocs, doc)
+		}
+	}
+	return mkeys, mdocs, nil
+}
+
+func (c *collection) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	p := c.planQuery(q.Filters)
+	if err := c.beforeQuery(q, p); err != nil {
+		return nil, err
+	}
+	client := c.client.WithContext(ctx)
+	// Include the key field in the field paths if there is one.
+	var fps [][]string
+	if len(q.FieldPaths) > 0 && c.keyField != "" {
+		fps = append([][]string{{c.keyField}}, q.FieldPaths...)
+	} else {
+		fps = q.FieldPaths
+	}
+	it := &docIterator{
+		coll:       c,
+		client:     client,
+		source:     c.newKeySource(client, p),
+		filters:    q.Filters,
+		limit:      q.Limit,
+		fieldPaths: fps,
+	}
+	if q.OrderByField != "" {
+		// Redis cannot sort the documents, so read them all and sort them here.
+		var docs []map[string]interface{}
+		for {
+			_, batch, err := c.nextMatches(client, it.source, q.Filters)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, batch...)
+		}
+		eval.SortDocs(docs, strings.Split(q.OrderByField, "."), q.OrderAscending)
+		it.docs = docs
+		it.source = nil
+	}
+	return it, nil
+}
+
+// docIterator returns the documents that match a query, reading them in
+// batches, or from docs if they were read and sorted up front.
+type docIterator struct {
+	coll       *collection
+	client     *redis.Client
+	source     *keySource // nil if docs holds all the results
+	docs       []map[string]interface{}
+	filters    []driver.Filter
+	limit      int
+	count      int
+	fieldPaths [][]string
+	err        error
+}
+
+func (it *docIterator) Next(ctx context.Context, doc driver.Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.limit > 0 && it.count >= it.limit {
+		it.err = io.EOF
+		return it.err
+	}
+	for len(it.docs) == 0 {
+		if it.source == nil {
+			it.err = io.EOF
+			return it.err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, docs, err := it.coll.nextMatches(it.client, it.source, it.filters)
+		if err != nil {
+			it.err = err
+			return err
+		}
+		it.docs = docs
+	}
+	if err := codec.DecodeDoc(it.docs[0], doc, it.fieldPaths, it.coll.opts.RevisionField); err != nil {
+		it.err = err
+		return it.err
+	}
+	it.docs = it.docs[1:]
+	it.count++
+	return nil
+}
+
+func (it *docIterator) Stop() { it.err = io.EOF }
+
+func (it *docIterator) As(i interface{}) bool { return false }
+
+// QueryPlan implements driver.QueryPlan. The description is the FT.SEARCH or
+// SCAN command that finds the documents to read.
+func (c *collection) QueryPlan(q *driver.Query) (*driver.QueryPlan, error) {
+	p := c.planQuery(q.Filters)
+	if p.search == "" {
+		return &driver.QueryPlan{
+			Description:   fmt.Sprintf("SCAN MATCH %q", c.pattern()),
+			Scan:          driver.ScanFull,
+			ClientFilters: q.Filters,
+		}, nil
+	}
+	return &driver.QueryPlan{
+		Description:   fmt.Sprintf("FT.SEARCH %s %q", c.opts.SearchIndex.Name, p.search),
+		Index:         c.opts.SearchIndex.Name,
+		Scan:          driver.ScanRange,
+		ServerFilters: p.pushed,
+		ClientFilters: p.local,
+	}, nil
+}
+
+// matchingKeys returns the Redis keys of the documents that match q. It reads
+// them all before returning, because changing documents while paging through
+// FT.SEARCH results could skip some.
+func (c *collection) matchingKeys(ctx context.Context, q *driver.Query) ([]string, error) {
+	p := c.planQuery(q.Filters)
+	if err := c.beforeQuery(q, p); err != nil {
+		return nil, err
+	}
+	client := c.client.WithContext(ctx)
+	s := c.newKeySource(client, p)
+	var keys []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch, _, err := c.nextMatches(client, s, q.Filters)
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+	}
+}
+
+// RunDeleteQuery implements driver.RunDeleteQuery. Each matching document is
+// deleted in its own transaction, provided it still matches.
+func (c *collection) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	keys, err := c.matchingKeys(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, rkey := range keys {
+		err := c.watch(ctx, rkey, func(tx *redis.Tx) error {
+			doc, err := c.read(tx, rkey).result()
+			if err != nil || doc == nil || !eval.FiltersMatch(q.Filters, doc) {
+				return err
+			}
+			_, err = tx.Pipelined(func(p redis.Pipeliner) error {
+				p.Del(rkey)
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunUpdateQuery implements driver.RunUpdateQuery. Each matching document is
+// updated in its own transaction, provided it still matches.
+func (c *collection) RunUpdateQuery(ctx context.Context, q *driver.Query, mods []driver.Mod) error {
+	keys, err := c.matchingKeys(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, rkey := range keys {
+		err := c.watch(ctx, rkey, func(tx *redis.Tx) error {
+			doc, err := c.read(tx, rkey).result()
+			if err != nil || doc == nil || !eval.FiltersMatch(q.Filters, doc) {
+				return err
+			}
+			if err := eval.ApplyMods(doc, mods); err != nil {
+				return err
+			}
+			doc[c.opts.RevisionField] = driver.UniqueString()
+			_, err = tx.Pipelined(func(p redis.Pipeliner) error { return c.write(p, rkey, doc) })
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,582 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redisdocstore provides an implementation of the docstore API for
+// Redis, storing each document under its own Redis key.
+//
+// The Redis key of a document is the collection's key prefix followed by the
+// document's key, which must be a string. The prefix, like "users:", should be
+// used only by the collection, since queries examine every key that begins
+// with it.
+//
+// By default, a document is stored as a hash with a field for each top-level
+// field of the document, holding the JSON encoding of the field's value. Set
+// Options.UseRedisJSON to store each document as a single JSON value with the
+// RedisJSON module (https://oss.redislabs.com/redisjson) instead.
+//
+//
+// Action Lists
+//
+// The Get actions in each group of an action list are executed in a single
+// pipeline. Each write action runs in a transaction: it WATCHes the document's
+// key, reads the document to check its revision and the action's conditions,
+// and writes it with MULTI and EXEC. If the document changes before EXEC, the
+// transaction is retried. The write actions run concurrently.
+// redisdocstore calls the BeforeDo function before the pipeline of Gets, with
+// an as function that exposes *redis.Client, and before each attempt of a
+// write, with an as function that exposes the write's *redis.Tx.
+//
+//
+// Queries
+//
+// By default, a query SCANs the keys of the collection, reads the documents and
+// evaluates the query's filters on the client. If Options.SearchIndex describes
+// a RediSearch index (https://oss.redislabs.com/redisearch) over the
+// collection, filters on the index's fields are also sent to RediSearch with
+// FT.SEARCH, so only the documents that may match are read. The filters are
+// always evaluated on the client, so the results do not depend on how the
+// index tokenizes or folds values. QueryPlan reports the command that will be
+// run.
+//
+// Query.OrderBy sorts the results on the client, after reading all the
+// matching documents.
+//
+//
+// As
+//
+// redisdocstore exposes the following types for As:
+// - Collection: *redis.Client
+// - ActionList.BeforeDo: *redis.Client for Gets, *redis.Tx for writes
+// - Query.BeforeQuery: *redis.Client, and string: the RediSearch query, or the
+//   SCAN pattern
+//
+//
+// Special Considerations
+//
+// JSON has no binary or time types. []byte values are stored as base64 strings,
+// and time.Time values as RFC 3339 strings in UTC with nanosecond precision.
+// They are decoded to those types when the destination has them, but as strings
+// when decoding into an interface{}. Query filters on time.Time values compare
+// the strings, which sort in time order.
+package redisdocstore // import "gocloud.dev/docstore/redisdocstore"
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/docstore/internal/mapdoc"
+	"gocloud.dev/internal/gcerr"
+)
+
+// Options are optional arguments to the OpenCollection functions.
+type Options struct {
+	// The name of the field holding the document revision.
+	// Defaults to docstore.DefaultRevisionField.
+	RevisionField string
+
+	// UseRedisJSON stores each document as a JSON value with the RedisJSON
+	// module's JSON.SET command, rather than as a hash. The module must be
+	// loaded in the server.
+	UseRedisJSON bool
+
+	// SearchIndex, if non-nil, describes a RediSearch index over the documents
+	// of the collection, which queries use to narrow the documents they read.
+	SearchIndex *SearchIndex
+
+	// The maximum number of write actions, each in its own transaction, that run
+	// concurrently for a single call to ActionList.Do. If less than 1, there is
+	// no limit other than that of the client's connection pool.
+	MaxOutstandingActionRPCs int
+}
+
+// A SearchIndex describes a RediSearch index, created with FT.CREATE over the
+// hashes or JSON values of a collection's key prefix.
+type SearchIndex struct {
+	// Name is the name of the index.
+	Name string
+
+	// Fields are the fields of the index's schema that queries can use.
+	Fields []SearchField
+}
+
+// Types of SearchField.
+const (
+	SearchTag     = "TAG"
+	SearchNumeric = "NUMERIC"
+)
+
+// A SearchField is a field of a RediSearch index's schema.
+//
+// With hashes, only top-level document fields can be indexed, and the values of
+// string fields are stored with their JSON quotes: a TAG field holding "go"
+// indexes the value `"go"`. redisdocstore takes care of the quoting in the
+// queries it sends.
+type SearchField struct {
+	// FieldPath is the document field path, with components separated by
+	// dots, as in "a.b".
+	FieldPath string
+
+	// Attribute is the name of the field in the index's schema. Defaults to
+	// FieldPath.
+	Attribute string
+
+	// Type is the type of the field in the index's schema, SearchTag or
+	// SearchNumeric. Filters with "=" on string values use TAG fields, and
+	// comparisons of numbers use NUMERIC fields.
+	Type string
+}
+
+type collection struct {
+	client   *redis.Client
+	prefix   string
+	keyField string
+	keyFunc  func(docstore.Document) interface{}
+	opts     *Options
+
+	beforeDoMu sync.Mutex // serializes calls to BeforeDo
+}
+
+// OpenCollection opens a docstore collection whose documents are stored in
+// client under keys that begin with prefix. keyField is the document field
+// holding the primary key, which must be a string.
+func OpenCollection(client *redis.Client, prefix, keyField string, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, prefix, keyField, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+// OpenCollectionWithKeyFunc opens a docstore collection whose documents are
+// stored in client under keys that begin with prefix. keyFunc takes a document
+// and returns its primary key, which must be a string. It should return nil if
+// the document is missing the information to construct a key. This will cause
+// all actions, even Create, to fail.
+func OpenCollectionWithKeyFunc(client *redis.Client, prefix string, keyFunc func(docstore.Document) interface{}, opts *Options) (*docstore.Collection, error) {
+	c, err := newCollection(client, prefix, "", keyFunc, opts)
+	if err != nil {
+		return nil, err
+	}
+	return docstore.NewCollection(c), nil
+}
+
+func newCollection(client *redis.Client, prefix, keyField string, keyFunc func(docstore.Document) interface{}, opts *Options) (*collection, error) {
+	if client == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "redisdocstore: client is nil")
+	}
+	if keyField == "" && keyFunc == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "redisdocstore: must provide either keyField or keyFunc")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.RevisionField == "" {
+		opts.RevisionField = docstore.DefaultRevisionField
+	}
+	if idx := opts.SearchIndex; idx != nil {
+		if idx.Name == "" {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "redisdocstore: search index name is empty")
+		}
+		for _, f := range idx.Fields {
+			if f.Type != SearchTag && f.Type != SearchNumeric {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "redisdocstore: search field %q has type %q, want %q or %q",
+					f.FieldPath, f.Type, SearchTag, SearchNumeric)
+			}
+			if !opts.UseRedisJSON && strings.Contains(f.FieldPath, ".") {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "redisdocstore: search field %q is not a top-level field, which hashes require", f.FieldPath)
+			}
+		}
+	}
+	return &collection{
+		client:   client,
+		prefix:   prefix,
+		keyField: keyField,
+		keyFunc:  keyFunc,
+		opts:     opts,
+	}, nil
+}
+
+func (c *collection) Key(doc driver.Document) (interface{}, error) {
+	if c.keyField != "" {
+		key, _ := doc.GetField(c.keyField) // no error on missing key, and it will be nil
+		return key, nil
+	}
+	key := c.keyFunc(doc.Origin)
+	if key == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "missing document key")
+	}
+	return key, nil
+}
+
+// redisKey returns the Redis key of the document of a, whose key must be a
+// string.
+func (c *collection) redisKey(a *driver.Action) (string, error) {
+	s, ok := a.Key.(string)
+	if !ok {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "redisdocstore: key %v is a %T, not a string", a.Key, a.Key)
+	}
+	return c.prefix + s, nil
+}
+
+func (c *collection) RevisionField() string { return c.opts.RevisionField }
+
+// MaxDocumentSize implements driver.MaxDocumentSize. Redis limits a value to
+// 512MB, which the size estimate cannot track closely, so there is no limit.
+func (c *collection) MaxDocumentSize() int { return 0 }
+
+// RunActions implements driver.RunActions.
+func (c *collection) RunActions(ctx context.Context, actions []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	errs := make([]error, len(actions))
+	beforeGets, gets, writes, afterGets := driver.GroupActions(actions)
+	for _, group := range [][]*driver.Action{beforeGets, gets, writes, afterGets} {
+		if driver.ShouldStop(opts, errs) {
+			driver.SkipActions(group, errs)
+			continue
+		}
+		if len(group) > 0 && group[0].Kind == driver.Get {
+			c.runGets(ctx, group, errs, opts)
+		} else {
+			c.runWrites(ctx, group, errs, opts)
+		}
+	}
+	return driver.NewActionListError(errs)
+}
+
+// beforeDo calls opts.BeforeDo, if any, with an as function that exposes val.
+func (c *collection) beforeDo(opts *driver.RunActionsOptions, val interface{}) error {
+	if opts.BeforeDo == nil {
+		return nil
+	}
+	c.beforeDoMu.Lock()
+	defer c.beforeDoMu.Unlock()
+	return opts.BeforeDo(driver.AsFunc(val))
+}
+
+// A reader is a Redis client, transaction or pipeline that can read documents.
+type reader interface {
+	HGetAll(key string) *redis.StringStringMapCmd
+	Do(args ...interface{}) *redis.Cmd
+}
+
+// A docRead is a read of a stored document. Its result is available once the
+// command has been executed, which for a pipeline is after Exec.
+type docRead struct {
+	hash *redis.StringStringMapCmd
+	json *redis.Cmd
+}
+
+// read reads the document at the Redis key rkey with r.
+func (c *collection) read(r reader, rkey string) docRead {
+	if c.opts.UseRedisJSON {
+		return docRead{json: r.Do("JSON.GET", rkey)}
+	}
+	return docRead{hash: r.HGetAll(rkey)}
+}
+
+// result returns the document read, or nil if there is none.
+func (d docRead) result() (map[string]interface{}, error) {
+	if d.json != nil {
+		s, err := d.json.String()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return unmarshalDoc([]byte(s))
+	}
+	fields, err := d.hash.Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 { // Redis has no empty hashes.
+		return nil, nil
+	}
+	return decodeHash(fields)
+}
+
+// unmarshalDoc decodes the JSON object in raw.
+func unmarshalDoc(raw []byte) (map[string]interface{}, error) {
+	v, err := jsoncodec.Unmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, gcerr.Newf(gcerr.Internal, nil, "redisdocstore: stored document is a JSON %T, not an object", v)
+	}
+	return m, nil
+}
+
+// readAll reads the documents at rkeys in a single pipeline. The document of a
+// missing key is nil.
+func (c *collection) readAll(client *redis.Client, rkeys []string) ([]map[string]interface{}, error) {
+	reads := make([]docRead, len(rkeys))
+	// The error returned by Pipelined is that of the first failed command, which
+	// may be redis.Nil for a missing key. Check each command instead.
+	_, _ = client.Pipelined(func(p redis.Pipeliner) error {
+		for i, k := range rkeys {
+			reads[i] = c.read(p, k)
+		}
+		return nil
+	})
+	docs := make([]map[string]interface{}, len(rkeys))
+	for i, r := range reads {
+		doc, err := r.result()
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = doc
+	}
+	return docs, nil
+}
+
+// write stores doc at the Redis key rkey with p, replacing any document there.
+func (c *collection) write(p redis.Pipeliner, rkey string, doc map[string]interface{}) error {
+	if c.opts.UseRedisJSON {
+		js, err := jsoncodec.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		p.Do("JSON.SET", rkey, ".", string(js))
+		return nil
+	}
+	fields, err := encodeHash(doc)
+	if err != nil {
+		return err
+	}
+	// Remove the fields that the new document lacks.
+	p.Del(rkey)
+	p.HMSet(rkey, fields)
+	return nil
+}
+
+// runGets reads the documents of gets with a single pipeline.
+func (c *collection) runGets(ctx context.Context, gets []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	var (
+		rkeys  []string
+		byRKey = map[string][]*driver.Action{}
+	)
+	for _, a := range gets {
+		rkey, err := c.redisKey(a)
+		if err != nil {
+			errs[a.Index] = err
+			continue
+		}
+		if byRKey[rkey] == nil {
+			rkeys = append(rkeys, rkey)
+		}
+		byRKey[rkey] = append(byRKey[rkey], a)
+	}
+	if len(rkeys) == 0 {
+		return
+	}
+	setErr := func(err error) {
+		for _, as := range byRKey {
+			for _, a := range as {
+				errs[a.Index] = err
+			}
+		}
+	}
+	client := c.client.WithContext(ctx)
+	if err := c.beforeDo(opts, client); err != nil {
+		setErr(err)
+		return
+	}
+	docs, err := c.readAll(client, rkeys)
+	if err != nil {
+		setErr(err)
+		return
+	}
+	for i, rkey := range rkeys {
+		for _, a := range byRKey[rkey] {
+			if docs[i] == nil {
+				errs[a.Index] = gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+			} else {
+				errs[a.Index] = codec.DecodeDoc(docs[i], a.Doc, a.FieldPaths, c.opts.RevisionField)
+			}
+		}
+	}
+}
+
+// runWrites runs each write action concurrently, in its own transaction. With
+// FailFast, it stops starting actions once one fails.
+func (c *collection) runWrites(ctx context.Context, writes []*driver.Action, errs []error, opts *driver.RunActionsOptions) {
+	mapdoc.RunConcurrently(writes, errs, c.opts.MaxOutstandingActionRPCs, opts, func(a *driver.Action) error {
+		return c.runWrite(ctx, a, opts)
+	})
+}
+
+// runWrite executes a single write action in a transaction, retrying it if the
+// document changes before the transaction commits.
+func (c *collection) runWrite(ctx context.Context, a *driver.Action, opts *driver.RunActionsOptions) error {
+	if a.Kind == driver.Create && a.Key == nil {
+		a.Key = driver.GenerateKey(a)
+		if err := a.Doc.SetField(c.keyField, a.Key); err != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "cannot set key field %q", c.keyField)
+		}
+	}
+	rkey, err := c.redisKey(a)
+	if err != nil {
+		return err
+	}
+	return c.watch(ctx, rkey, func(tx *redis.Tx) error {
+		if err := c.beforeDo(opts, tx); err != nil {
+			return err
+		}
+		return c.writeTx(tx, rkey, a)
+	})
+}
+
+// watch calls fn in a transaction that watches rkey, until fn succeeds or fails
+// for a reason other than a change to rkey, or mapdoc.MaxWriteAttempts is
+// reached.
+func (c *collection) watch(ctx context.Context, rkey string, fn func(*redis.Tx) error) error {
+	client := c.client.WithContext(ctx)
+	for i := 1; ; i++ {
+		err := client.Watch(fn, rkey)
+		if err != redis.TxFailedErr || i == mapdoc.MaxWriteAttempts {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// writeTx executes the write action a on the document at rkey with tx, which
+// watches rkey.
+func (c *collection) writeTx(tx *redis.Tx, rkey string, a *driver.Action) error {
+	current, err := c.read(tx, rkey).result()
+	if err != nil {
+		return err
+	}
+	exists := current != nil
+	switch {
+	case exists && a.Kind == driver.Create:
+		return gcerr.Newf(gcerr.AlreadyExists, nil, "Create: document with key %q exists", a.Key)
+	case !exists && a.Kind == driver.Delete:
+		return nil
+	case !exists && len(a.Conditions) > 0:
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "document with key %q does not exist", a.Key)
+	case !exists && (a.Kind == driver.Replace || a.Kind == driver.Update):
+		return gcerr.Newf(gcerr.NotFound, nil, "document with key %q does not exist", a.Key)
+	case exists && !eval.FiltersMatch(a.Conditions, current):
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "conditions not satisfied for document with key %q", a.Key)
+	}
+	if exists {
+		if err := c.checkRevision(a.Doc, current); err != nil {
+			return err
+		}
+	}
+
+	var doc map[string]interface{}
+	switch a.Kind {
+	case driver.Delete:
+		_, err := tx.Pipelined(func(p redis.Pipeliner) error {
+			p.Del(rkey)
+			return nil
+		})
+		return err
+	case driver.Create, driver.Replace, driver.Put:
+		if doc, err = codec.EncodeDoc(a.Doc); err != nil {
+			return err
+		}
+	case driver.Update:
+		if err := eval.ApplyMods(current, a.Mods); err != nil {
+			return err
+		}
+		doc = current
+	default:
+		return gcerr.Newf(gcerr.Internal, nil, "unknown kind %v", a.Kind)
+	}
+	rev := driver.UniqueString()
+	doc[c.opts.RevisionField] = rev
+	if _, err := tx.Pipelined(func(p redis.Pipeliner) error { return c.write(p, rkey, doc) }); err != nil {
+		return err
+	}
+	// Ignore errors. It's fine if the doc doesn't have a revision field.
+	_ = a.Doc.SetField(c.opts.RevisionField, rev)
+	return nil
+}
+
+func (c *collection) checkRevision(arg driver.Document, current map[string]interface{}) error {
+	wantRev, err := arg.GetField(c.opts.RevisionField)
+	if err != nil || wantRev == nil {
+		return nil // no incoming revision information: nothing to check
+	}
+	curRev := current[c.opts.RevisionField]
+	if s, ok := wantRev.(string); !ok {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "revision field %s is a %T, want string", c.opts.RevisionField, wantRev)
+	} else if s != curRev {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "mismatched revisions: want %v, current %v", wantRev, curRev)
+	}
+	return nil
+}
+
+// As implements driver.As.
+func (c *collection) As(i interface{}) bool {
+	p, ok := i.(**redis.Client)
+	if !ok {
+		return false
+	}
+	*p = c.client
+	return true
+}
+
+// ErrorAs implements driver.Collection.ErrorAs. The errors that Redis returns
+// have no exported type.
+func (c *collection) ErrorAs(err error, i interface{}) bool { return false }
+
+// ErrorCode implements driver.Collection.ErrorCode.
+func (c *collection) ErrorCode(err error) gcerr.ErrorCode {
+	if g, ok := err.(*gcerr.Error); ok {
+		return g.Code
+	}
+	switch err {
+	case redis.Nil:
+		return gcerr.NotFound
+	case redis.TxFailedErr:
+		// The document kept changing during the write.
+		return gcerr.FailedPrecondition
+	case context.Canceled:
+		return gcerr.Canceled
+	case context.DeadlineExceeded:
+		return gcerr.DeadlineExceeded
+	}
+	// Redis error replies begin with an error code.
+	// See https://redis.io/topics/protocol#resp-errors.
+	msg := err.Error()
+	switch {
+	case strings.HasPrefix(msg, "WRONGTYPE"):
+		return gcerr.InvalidArgument
+	case strings.HasPrefix(msg, "NOAUTH"), strings.HasPrefix(msg, "NOPERM"):
+		return gcerr.PermissionDenied
+	case strings.HasPrefix(msg, "OOM"):
+		return gcerr.ResourceExhausted
+	case strings.HasPrefix(msg, "ERR unknown command"):
+		// Typically a RedisJSON or RediSearch command without the module.
+		return gcerr.Unimplemented
+	default:
+		return gcerr.Unknown
+	}
+}
+
+// Close implements driver.Collection.Close. It does not close the client.
+func (c *collection) Close() error { return nil }
@@ -0,0 +1,368 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisdocstore
+
+// To run these tests against a real Redis server, first run ./localredis.sh.
+// The server it starts has the RedisJSON and RediSearch modules.
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/docstore/drivertest"
+	"gocloud.dev/docstore/internal/jsoncodec"
+	"gocloud.dev/internal/testing/setup"
+)
+
+const (
+	serverAddr = "localhost:6379"
+	prefix1    = "docstore-test-1:"
+	prefix2    = "docstore-test-2:"
+	prefix3    = "docstore-test-3:"
+)
+
+type harness struct {
+	client   *redis.Client
+	useJSON  bool
+	useIndex bool
+}
+
+// reset deletes the documents of a collection, and the collection's search
+// index if h uses one.
+func (h *harness) reset(ctx context.Context, prefix string) error {
+	client := h.client.WithContext(ctx)
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(cursor, prefix+"*", batchSize).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := client.Del(keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if !h.useIndex {
+		return nil
+	}
+	// The index may not exist yet.
+	_ = client.Do("FT.DROPINDEX", indexName(prefix)).Err()
+	on := "HASH"
+	if h.useJSON {
+		on = "JSON"
+	}
+	args := []interface{}{"FT.CREATE", indexName(prefix), "ON", on, "PREFIX", 1, prefix, "SCHEMA"}
+	for _, f := range searchFields {
+		path := f.FieldPath
+		if h.useJSON {
+			path = "$." + path
+		}
+		args = append(args, path, "AS", f.Attribute, f.Type)
+	}
+	return client.Do(args...).Err()
+}
+
+func indexName(prefix string) string { return "idx:" + prefix }
+
+// searchFields index the fields of drivertest.HighScore that the conformance
+// tests query.
+var searchFields = []SearchField{
+	{FieldPath: "Game", Attribute: "game", Type: SearchTag},
+	{FieldPath: "Player", Attribute: "player", Type: SearchTag},
+	{FieldPath: "Score", Attribute: "score", Type: SearchNumeric},
+}
+
+func (h *harness) options(prefix, revField string) *Options {
+	opts := &Options{RevisionField: revField, UseRedisJSON: h.useJSON}
+	if h.useIndex {
+		opts.SearchIndex = &SearchIndex{Name: indexName(prefix), Fields: searchFields}
+	}
+	return opts
+}
+
+func (h *harness) MakeCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, prefix1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, prefix1, drivertest.KeyField, nil, h.options(prefix1, ""))
+}
+
+func (h *harness) MakeTwoKeyCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, prefix2); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, prefix2, "", drivertest.HighScoreKey, h.options(prefix2, ""))
+}
+
+func (h *harness) MakeAlternateRevisionFieldCollection(ctx context.Context) (driver.Collection, error) {
+	if err := h.reset(ctx, prefix1); err != nil {
+		return nil, err
+	}
+	return newCollection(h.client, prefix1, drivertest.KeyField, nil,
+		h.options(prefix1, drivertest.AlternateRevisionField))
+}
+
+func (*harness) BeforeDoTypes() []interface{} {
+	return []interface{}{&redis.Client{}, &redis.Tx{}}
+}
+
+func (*harness) BeforeQueryTypes() []interface{} {
+	return []interface{}{&redis.Client{}, ""}
+}
+
+func (*harness) Capabilities() drivertest.Capabilities { return drivertest.AllCapabilities }
+
+func (*harness) Close() {}
+
+type codecTester struct{}
+
+func (codecTester) UnsupportedTypes() []drivertest.UnsupportedType {
+	return []drivertest.UnsupportedType{drivertest.BinarySet}
+}
+
+func (codecTester) DocstoreEncode(x interface{}) (interface{}, error) {
+	m, err := codec.EncodeDoc(drivertest.MustDocument(x))
+	if err != nil {
+		return nil, err
+	}
+	return jsoncodec.Marshal(m)
+}
+
+func (codecTester) DocstoreDecode(value, dest interface{}) error {
+	m, err := unmarshalDoc(value.([]byte))
+	if err != nil {
+		return err
+	}
+	return codec.DecodeDoc(m, drivertest.MustDocument(dest), nil, docstore.DefaultRevisionField)
+}
+
+func (codecTester) NativeEncode(x interface{}) (interface{}, error) {
+	return json.Marshal(x)
+}
+
+func (codecTester) NativeDecode(value, dest interface{}) error {
+	return json.Unmarshal(value.([]byte), dest)
+}
+
+// asMatrix lists the types that the As methods support. The iterators expose
+// no types.
+var asMatrix = drivertest.AsMatrix{
+	Collection: []interface{}{new(*redis.Client)},
+}
+
+func TestConformance(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+
+	for _, h := range []*harness{
+		{client: client},
+		{client: client, useIndex: true},
+		{client: client, useJSON: true},
+		{client: client, useJSON: true, useIndex: true},
+	} {
+		h := h
+		name := "hash"
+		if h.useJSON {
+			name = "json"
+		}
+		if h.useIndex {
+			name += "-search"
+		}
+		t.Run(name, func(t *testing.T) {
+			newHarness := func(context.Context, *testing.T) (drivertest.Harness, error) {
+				return h, nil
+			}
+			drivertest.RunConformanceTests(t, newHarness, codecTester{}, []drivertest.AsTest{asMatrix})
+		})
+	}
+}
+
+func newTestClient(t *testing.T) *redis.Client {
+	if !setup.HasDockerTestEnvironment() {
+		t.Skip("Skipping Redis tests since the Redis server is not available")
+	}
+	client := redis.NewClient(&redis.Options{Addr: serverAddr})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := client.WithContext(ctx).Ping().Err(); err != nil {
+		t.Fatalf("connecting to %s: %v", serverAddr, err)
+	}
+	return client
+}
+
+func BenchmarkConformance(b *testing.B) {
+	client := redis.NewClient(&redis.Options{Addr: serverAddr})
+	defer client.Close()
+	h := &harness{client: client}
+	if err := h.reset(context.Background(), prefix3); err != nil {
+		b.Fatal(err)
+	}
+	coll, err := newCollection(client, prefix3, drivertest.KeyField, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	drivertest.RunBenchmarks(b, docstore.NewCollection(coll))
+}
+
+// Redis-specific tests.
+
+func TestSearchTerm(t *testing.T) {
+	fields := []SearchField{
+		{FieldPath: "tag", Type: SearchTag},
+		{FieldPath: "n", Attribute: "num", Type: SearchNumeric},
+	}
+	newColl := func(useJSON bool) *collection {
+		c, err := newCollection(&redis.Client{}, "p:", "name", nil,
+			&Options{UseRedisJSON: useJSON, SearchIndex: &SearchIndex{Name: "idx", Fields: fields}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	for _, test := range []struct {
+		f       driver.Filter
+		useJSON bool
+		want    string // empty if the filter is not sent to RediSearch
+	}{
+		{driver.Filter{FieldPath: []string{"tag"}, Op: "=", Value: "a b"}, true, `@tag:{a\ b}`},
+		{driver.Filter{FieldPath: []string{"tag"}, Op: "=", Value: "go"}, false, `@tag:{\"go\"}`},
+		{driver.Filter{FieldPath: []string{"tag"}, Op: "<", Value: "go"}, true, ""},
+		{driver.Filter{FieldPath: []string{"tag"}, Op: "=", Value: 1}, true, ""},
+		{driver.Filter{FieldPath: []string{"n"}, Op: "=", Value: 3}, true, "@num:[3 3]"},
+		{driver.Filter{FieldPath: []string{"n"}, Op: ">", Value: 2.5}, true, "@num:[2.5 +inf]"},
+		{driver.Filter{FieldPath: []string{"n"}, Op: "<=", Value: uint(7)}, false, "@num:[-inf 7]"},
+		{driver.Filter{FieldPath: []string{"n"}, Op: driver.ExistsOp}, true, ""},
+		{driver.Filter{FieldPath: []string{"other"}, Op: "=", Value: 1}, true, ""},
+	} {
+		got, ok := newColl(test.useJSON).searchTerm(test.f)
+		if !ok {
+			got = ""
+		}
+		if got != test.want {
+			t.Errorf("%+v, JSON %t: got %q, want %q", test.f, test.useJSON, got, test.want)
+		}
+	}
+
+	c := newColl(false)
+	tagFilter := driver.Filter{FieldPath: []string{"tag"}, Op: "=", Value: "x"}
+	existsFilter := driver.Filter{FieldPath: []string{"n"}, Op: driver.ExistsOp}
+	plan, err := c.QueryPlan(&driver.Query{Filters: []driver.Filter{tagFilter, existsFilter}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &driver.QueryPlan{
+		Description:   `FT.SEARCH idx "@tag:{\\\"x\\\"}"`,
+		Index:         "idx",
+		Scan:          driver.ScanRange,
+		ServerFilters: []driver.Filter{tagFilter},
+		ClientFilters: []driver.Filter{existsFilter},
+	}
+	if diff := cmp.Diff(plan, want); diff != "" {
+		t.Error(diff)
+	}
+	if plan, err = c.QueryPlan(&driver.Query{Filters: []driver.Filter{existsFilter}}); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Scan != driver.ScanFull || plan.Description != `SCAN MATCH "p:*"` {
+		t.Errorf("got %+v, want a full SCAN", plan)
+	}
+}
+
+func TestNewCollectionErrors(t *testing.T) {
+	for _, opts := range []*Options{
+		{SearchIndex: &SearchIndex{}},
+		{SearchIndex: &SearchIndex{Name: "idx", Fields: []SearchField{{FieldPath: "a", Type: "TEXT"}}}},
+		{SearchIndex: &SearchIndex{Name: "idx", Fields: []SearchField{{FieldPath: "a.b", Type: SearchTag}}}},
+	} {
+		if _, err := newCollection(&redis.Client{}, "p:", "name", nil, opts); err == nil {
+			t.Errorf("%+v: got nil error, want error", opts.SearchIndex)
+		}
+	}
+	// Nested fields can be indexed in JSON.
+	opts := &Options{UseRedisJSON: true, SearchIndex: &SearchIndex{Name: "idx", Fields: []SearchField{{FieldPath: "a.b", Type: SearchTag}}}}
+	if _, err := newCollection(&redis.Client{}, "p:", "name", nil, opts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	doc, err := codec.EncodeDoc(drivertest.MustDocument(map[string]interface{}{
+		"s": "x",
+		"n": 1,
+		"m": map[string]interface{}{"a": []interface{}{true, nil}},
+		"t": time.Date(2019, 6, 1, 2, 0, 0, 0, time.FixedZone("X", 3600)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := encodeHash(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fields["s"], `"x"`; got != want {
+		t.Errorf("hash field s: got %v, want %v", got, want)
+	}
+	strs := map[string]string{}
+	for k, v := range fields {
+		strs[k] = v.(string)
+	}
+	got, err := decodeHash(strs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"s": "x",
+		"n": int64(1),
+		"m": map[string]interface{}{"a": []interface{}{true, nil}},
+		"t": "2019-06-01T01:00:00.000000000Z",
+	}
+	if diff := cmp.Diff(codec.ToGo(got), want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestFiltersMatch(t *testing.T) {
+	doc, err := unmarshalDoc([]byte(`{"n": 3, "s": "Go", "t": "2019-06-01T01:00:00.000000000Z", "m": {"x": null}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		f    driver.Filter
+		want bool
+	}{
+		{driver.Filter{FieldPath: []string{"n"}, Op: ">", Value: 2.5}, true},
+		{driver.Filter{FieldPath: []string{"n"}, Op: "=", Value: "3"}, false},
+		{driver.Filter{FieldPath: []string{"s"}, Op: driver.EqualFoldOp, Value: "go"}, true},
+		{driver.Filter{FieldPath: []string{"t"}, Op: "<", Value: time.Date(2019, 6, 1, 2, 0, 0, 0, time.UTC)}, true},
+		{driver.Filter{FieldPath: []string{"m", "x"}, Op: driver.ExistsOp}, true},
+		{driver.Filter{FieldPath: []string{"m", "y"}, Op: driver.NotExistsOp}, true},
+		{driver.Filter{FieldPath: []string{"s", "y"}, Op: "=", Value: 1}, false},
+	} {
+		if got := eval.FiltersMatch([]driver.Filter{test.f}, doc); got != test.want {
+			t.Errorf("%+v: got %t, want %t", test.f, got, test.want)
+		}
+	}
+}
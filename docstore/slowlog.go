@@ -0,0 +1,171 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloud.dev/docstore/driver"
+)
+
+// SlowLogOptions configure the slow-operation log of a collection. See
+// WithSlowLog.
+type SlowLogOptions struct {
+	// Threshold is the shortest duration of an operation that is logged.
+	Threshold time.Duration
+
+	// SampleRate is the fraction of slow operations that are logged, from 0
+	// to 1. Zero means that all of them are.
+	SampleRate float64
+
+	// Log is called with each slow operation that is logged, after the
+	// operation finishes. It may be called concurrently.
+	Log func(*SlowOperation)
+}
+
+// The kinds of SlowOperation.
+const (
+	SlowActionList  = "ActionList"
+	SlowGetQuery    = "GetQuery"
+	SlowDeleteQuery = "DeleteQuery"
+	SlowUpdateQuery = "UpdateQuery"
+)
+
+// A SlowOperation describes an operation on a collection that took at least
+// the threshold of its SlowLogOptions.
+type SlowOperation struct {
+	// Kind is SlowActionList, SlowGetQuery, SlowDeleteQuery or
+	// SlowUpdateQuery.
+	Kind string
+
+	// Description describes the action list or query.
+	Description string
+
+	// Plan is the plan of the query, or nil for an action list or if the
+	// driver could not describe it.
+	Plan *QueryPlan
+
+	// Duration is how long the operation took. For a get query, it is the
+	// time from the call to Query.Get until the iterator returned an error,
+	// like io.EOF, or was stopped.
+	Duration time.Duration
+
+	// Documents is the number of documents returned by a get query, or the
+	// number of actions in an action list.
+	Documents int
+
+	// Err is the error the operation returned, if any. For a get query, it is
+	// nil if the iteration ended with io.EOF or Stop.
+	Err error
+}
+
+// WithSlowLog returns a *Collection based on coll that reports its slow
+// action lists and queries to opts.Log, to help find the operations that
+// hold up an application without tracing every one of them. The plan of a
+// slow query is computed when the query is logged, not before.
+//
+// coll will be closed and no longer usable after this function returns.
+func WithSlowLog(coll *Collection, opts *SlowLogOptions) *Collection {
+	c := coll.derive()
+	c.slowLog = newSlowLog(opts)
+	return c
+}
+
+// slowLog decides which operations to log.
+type slowLog struct {
+	opts SlowLogOptions
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newSlowLog(opts *SlowLogOptions) *slowLog {
+	if opts == nil || opts.Log == nil {
+		return nil
+	}
+	return &slowLog{opts: *opts, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// sampled reports whether an operation that took d should be logged.
+func (s *slowLog) sampled(d time.Duration) bool {
+	if s == nil || d < s.opts.Threshold {
+		return false
+	}
+	if s.opts.SampleRate <= 0 || s.opts.SampleRate >= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < s.opts.SampleRate
+}
+
+// logActions logs the action list l if it is slow.
+func (s *slowLog) logActions(l *ActionList, start time.Time, err error) {
+	if d := time.Since(start); s.sampled(d) {
+		s.opts.Log(&SlowOperation{
+			Kind:        SlowActionList,
+			Description: l.String(),
+			Duration:    d,
+			Documents:   len(l.actions),
+			Err:         err,
+		})
+	}
+}
+
+// logQuery logs the query dq of kind if it is slow.
+func (s *slowLog) logQuery(c *Collection, kind string, dq *driver.Query, start time.Time, n int, err error) {
+	d := time.Since(start)
+	if !s.sampled(d) {
+		return
+	}
+	var plan *QueryPlan
+	if dp, perr := c.driver.QueryPlan(dq); perr == nil {
+		plan = newQueryPlan(dp)
+	}
+	s.opts.Log(&SlowOperation{
+		Kind:        kind,
+		Description: queryString(dq),
+		Plan:        plan,
+		Duration:    d,
+		Documents:   n,
+		Err:         err,
+	})
+}
+
+// queryString describes dq, like "Where a > 1, OrderBy a asc, Limit 10".
+func queryString(dq *driver.Query) string {
+	var parts []string
+	for _, f := range toPlanFilters(dq.Filters) {
+		parts = append(parts, "Where "+f.String())
+	}
+	if dq.OrderByField != "" {
+		dir := Descending
+		if dq.OrderAscending {
+			dir = Ascending
+		}
+		parts = append(parts, fmt.Sprintf("OrderBy %s %s", dq.OrderByField, dir))
+	}
+	if dq.Limit > 0 {
+		parts = append(parts, fmt.Sprintf("Limit %d", dq.Limit))
+	}
+	if len(parts) == 0 {
+		return "all documents"
+	}
+	return strings.Join(parts, ", ")
+}
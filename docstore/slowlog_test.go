@@ -0,0 +1,132 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"gocloud.dev/docstore/driver"
+)
+
+// slowDriver is a localFilterDriver whose operations take delay.
+type slowDriver struct {
+	*localFilterDriver
+	delay time.Duration
+}
+
+func (d *slowDriver) Key(doc driver.Document) (interface{}, error) { return doc.GetField("Game") }
+func (d *slowDriver) RevisionField() string                        { return DefaultRevisionField }
+func (d *slowDriver) MaxDocumentSize() int                         { return 0 }
+func (d *slowDriver) Close() error                                 { return nil }
+
+func (d *slowDriver) RunActions(ctx context.Context, as []*driver.Action, opts *driver.RunActionsOptions) driver.ActionListError {
+	time.Sleep(d.delay)
+	return nil
+}
+
+func (d *slowDriver) RunGetQuery(ctx context.Context, q *driver.Query) (driver.DocumentIterator, error) {
+	time.Sleep(d.delay)
+	return d.localFilterDriver.RunGetQuery(ctx, q)
+}
+
+func (d *slowDriver) RunDeleteQuery(ctx context.Context, q *driver.Query) error {
+	time.Sleep(d.delay)
+	return nil
+}
+
+func TestSlowLog(t *testing.T) {
+	ctx := context.Background()
+	d := &slowDriver{localFilterDriver: &localFilterDriver{docs: []map[string]interface{}{
+		{"Game": "a", "Score": 1},
+		{"Game": "b", "Score": 2},
+	}}}
+	var (
+		mu  sync.Mutex
+		got []*SlowOperation
+	)
+	c := WithSlowLog(NewCollection(d), &SlowLogOptions{
+		Threshold: 10 * time.Millisecond,
+		Log: func(op *SlowOperation) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, op)
+		},
+	})
+	defer c.Close()
+	run := func() {
+		t.Helper()
+		if err := c.Put(ctx, map[string]interface{}{"Game": "c"}); err != nil {
+			t.Fatal(err)
+		}
+		iter := c.Query().Where("Score", ">", 0).Limit(5).Get(ctx)
+		for {
+			err := iter.Next(ctx, map[string]interface{}{})
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Calls after the end are not logged again.
+		iter.Next(ctx, map[string]interface{}{})
+		iter.Stop()
+		if err := c.Query().Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fast operations are not logged.
+	run()
+	if len(got) != 0 {
+		t.Fatalf("got %d slow operations, want none", len(got))
+	}
+
+	d.delay = 20 * time.Millisecond
+	run()
+	if len(got) != 3 {
+		t.Fatalf("got %d slow operations, want 3", len(got))
+	}
+	for i, want := range []struct {
+		kind, desc string
+		docs       int
+		plan       bool
+	}{
+		{SlowActionList, "[Put(map[Game:c])]", 1, false},
+		{SlowGetQuery, "Where Score > 0, Limit 5", 2, true},
+		{SlowDeleteQuery, "all documents", 0, true},
+	} {
+		op := got[i]
+		if op.Kind != want.kind || op.Description != want.desc || op.Documents != want.docs || (op.Plan != nil) != want.plan {
+			t.Errorf("#%d: got %+v, want kind %s, description %q, %d documents, plan %t",
+				i, op, want.kind, want.desc, want.docs, want.plan)
+		}
+		if op.Duration < d.delay || op.Err != nil {
+			t.Errorf("#%d: got duration %s and error %v, want at least %s and no error", i, op.Duration, op.Err, d.delay)
+		}
+	}
+
+	// With a tiny sample rate, hardly anything is logged.
+	got = nil
+	c.slowLog.opts.SampleRate = 1e-9
+	run()
+	if len(got) != 0 {
+		t.Errorf("got %d sampled operations, want none", len(got))
+	}
+}
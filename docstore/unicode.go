@@ -0,0 +1,198 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"gocloud.dev/docstore/driver"
+	"gocloud.dev/internal/gcerr"
+	"golang.org/x/text/unicode/norm"
+)
+
+// StringOptions control how a Collection checks and normalizes strings before
+// passing them to the provider. Set them with WithStringOptions. The zero value
+// passes strings through unchanged, and what happens to invalid UTF-8 then
+// depends on the provider: some reject it, and some store it, possibly after
+// replacing the invalid bytes.
+type StringOptions struct {
+	// RejectInvalidUTF8 causes actions and queries to fail with InvalidArgument if
+	// a key, a field name or a string value in a document, mod or filter is not
+	// valid UTF-8.
+	RejectInvalidUTF8 bool
+
+	// NormalizeNFC converts string keys and string values in documents, mods and
+	// filters to Unicode Normalization Form C, so that canonically equivalent
+	// strings are stored and compared alike. Documents are modified in place.
+	// Field names are not normalized.
+	NormalizeNFC bool
+}
+
+// WithStringOptions returns a *Collection based on coll that checks and
+// normalizes strings according to opts. A nil opts passes strings through
+// unchanged.
+//
+// coll will be closed and no longer usable after this function returns.
+func WithStringOptions(coll *Collection, opts *StringOptions) *Collection {
+	c := coll.derive()
+	c.stringOpts = StringOptions{}
+	if opts != nil {
+		c.stringOpts = *opts
+	}
+	return c
+}
+
+// normalizeDocument normalizes the strings in doc, if opts ask for it. It must be
+// called before the document's key is computed.
+func normalizeDocument(opts StringOptions, doc Document) {
+	if opts.NormalizeNFC {
+		normalizeNFC(reflect.ValueOf(doc))
+	}
+}
+
+// checkActionStrings checks the strings of a, whose document is ddoc and whose key
+// is key, if opts ask for it. The whole document is checked for writes that
+// store it, and only the key for other actions.
+func checkActionStrings(opts StringOptions, a *Action, ddoc driver.Document, key interface{}) error {
+	if !opts.RejectInvalidUTF8 {
+		return nil
+	}
+	var (
+		s     string
+		found bool
+		err   error
+	)
+	switch a.kind {
+	case driver.Create, driver.Replace, driver.Put:
+		s, found, err = driver.FindInvalidUTF8(ddoc)
+	default:
+		// Only the key of the document is used.
+		if key != nil {
+			s, found, err = driver.FindInvalidUTF8Value(key)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if found {
+		return invalidUTF8(s)
+	}
+	return nil
+}
+
+// applyStringOptionsToMods checks and normalizes the values of mods according
+// to opts.
+func applyStringOptionsToMods(opts StringOptions, mods []driver.Mod) error {
+	for i, m := range mods {
+		if _, ok := m.Value.(driver.IncOp); ok || m.Value == nil {
+			continue
+		}
+		if opts.RejectInvalidUTF8 {
+			s, found, err := driver.FindInvalidUTF8Value(m.Value)
+			if err != nil {
+				return err
+			}
+			if found {
+				return invalidUTF8(s)
+			}
+		}
+		if opts.NormalizeNFC {
+			// Normalize a copy, so that the Mods passed to Update are unchanged unless
+			// they hold maps or slices.
+			v := reflect.New(reflect.TypeOf(m.Value)).Elem()
+			v.Set(reflect.ValueOf(m.Value))
+			normalizeNFC(v)
+			mods[i].Value = v.Interface()
+		}
+	}
+	return nil
+}
+
+// applyStringOptionsToFilters checks and normalizes the string values of fs
+// according to opts.
+func applyStringOptionsToFilters(opts StringOptions, fs []driver.Filter) error {
+	for i, f := range fs {
+		v := reflect.ValueOf(f.Value)
+		if f.Value == nil || v.Kind() != reflect.String {
+			continue
+		}
+		s := v.String()
+		if opts.RejectInvalidUTF8 && !utf8.ValidString(s) {
+			return invalidUTF8(s)
+		}
+		if opts.NormalizeNFC && !norm.NFC.IsNormalString(s) {
+			fs[i].Value = reflect.ValueOf(norm.NFC.String(s)).Convert(v.Type()).Interface()
+		}
+	}
+	return nil
+}
+
+func invalidUTF8(s string) error {
+	return gcerr.Newf(gcerr.InvalidArgument, nil, "string %q is not valid UTF-8", s)
+}
+
+// normalizeNFC converts the strings in v to NFC in place. Strings that cannot be
+// set, such as those in unexported struct fields, are left alone, as are map keys.
+func normalizeNFC(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if s := v.String(); v.CanSet() && !norm.NFC.IsNormalString(s) {
+			v.SetString(norm.NFC.String(s))
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			normalizeNFC(v.Elem())
+		}
+	case reflect.Interface:
+		if v.IsNil() || !v.CanSet() {
+			return
+		}
+		// The value in an interface cannot be set, so normalize a copy.
+		v.Set(normalizedCopy(v.Elem()))
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return // []byte
+		}
+		for i := 0; i < v.Len(); i++ {
+			normalizeNFC(v.Index(i))
+		}
+	case reflect.Map:
+		// Neither can map elements.
+		iter := v.MapRange()
+		for iter.Next() {
+			v.SetMapIndex(iter.Key(), normalizedCopy(iter.Value()))
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			// Unexported fields are not part of the document.
+			if f := v.Field(i); f.CanInterface() {
+				normalizeNFC(f)
+			}
+		}
+	}
+}
+
+// normalizedCopy returns a settable copy of v, normalized with normalizeNFC.
+func normalizedCopy(v reflect.Value) reflect.Value {
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	normalizeNFC(c)
+	return c
+}
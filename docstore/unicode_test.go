@@ -0,0 +1,67 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNormalizeNFC(t *testing.T) {
+	const (
+		composed   = "café"
+		decomposed = "café"
+	)
+	type Inner struct{ S string }
+	type S struct {
+		Key   string
+		P     *string
+		L     []string
+		M     map[string]interface{}
+		I     interface{}
+		In    Inner
+		B     []byte
+		inner string
+	}
+	p := decomposed
+	s := &S{
+		Key:   decomposed,
+		P:     &p,
+		L:     []string{decomposed},
+		M:     map[string]interface{}{decomposed: decomposed, "l": []interface{}{decomposed}},
+		I:     decomposed,
+		In:    Inner{decomposed},
+		B:     []byte(decomposed),
+		inner: decomposed,
+	}
+	normalizeNFC(reflect.ValueOf(s))
+	pc := composed
+	want := &S{
+		Key: composed,
+		P:   &pc,
+		L:   []string{composed},
+		// Map keys are field names, which are not normalized.
+		M:     map[string]interface{}{decomposed: composed, "l": []interface{}{composed}},
+		I:     composed,
+		In:    Inner{composed},
+		B:     []byte(decomposed),
+		inner: decomposed,
+	}
+	if diff := cmp.Diff(s, want, cmp.AllowUnexported(S{})); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -18,6 +18,7 @@ package gcerrors
 
 import (
 	"context"
+	"fmt"
 
 	"gocloud.dev/internal/gcerr"
 	"golang.org/x/xerrors"
@@ -68,6 +69,31 @@ const (
 	DeadlineExceeded ErrorCode = gcerr.DeadlineExceeded
 )
 
+// NewError returns an error with code c and message msg, wrapping err, which
+// may be nil. Code returns c for the error and for any error that wraps it.
+// It is meant for drivers outside the Go CDK, which cannot import the
+// internal package that the Go CDK's own drivers use, and whose ErrorCode
+// methods must map provider errors to codes: a driver can return an error
+// made by NewError to give its code directly.
+//
+// The error records the caller of NewError, and prints it when formatted
+// with "%+v".
+func NewError(c ErrorCode, err error, msg string) error {
+	return gcerr.New(c, err, 2, msg)
+}
+
+// NewErrorf is like NewError, but formats the message with fmt.Sprintf.
+func NewErrorf(c ErrorCode, err error, format string, args ...interface{}) error {
+	return gcerr.New(c, err, 2, fmt.Sprintf(format, args...))
+}
+
+// GRPCCode returns the ErrorCode that corresponds to the gRPC status code of
+// err, or Unknown if err does not come from gRPC. Drivers for gRPC services
+// can use it in their ErrorCode methods.
+func GRPCCode(err error) ErrorCode {
+	return gcerr.GRPCCode(err)
+}
+
 // Code returns the ErrorCode of err if it, or some error it wraps, is an *Error.
 // If err is context.Canceled or context.DeadlineExceeded, or wraps one of those errors,
 // it returns the Canceled or DeadlineExceeded codes, respectively.
@@ -16,10 +16,14 @@ package gcerrors
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"regexp"
 	"testing"
 
 	"gocloud.dev/internal/gcerr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type wrappedErr struct {
@@ -50,3 +54,37 @@ func TestCode(t *testing.T) {
 		}
 	}
 }
+
+func TestNewError(t *testing.T) {
+	wrapped := io.ErrUnexpectedEOF
+	for _, test := range []struct {
+		err  error
+		want string
+	}{
+		{NewError(NotFound, nil, "no such thing"), "no such thing (code=NotFound)"},
+		{NewError(Internal, wrapped, "read failed"), "read failed (code=Internal): unexpected EOF"},
+		{NewErrorf(InvalidArgument, nil, "bad %s %d", "value", 3), "bad value 3 (code=InvalidArgument)"},
+	} {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+
+	err := wrappedErr{NewError(PermissionDenied, wrapped, "denied")}
+	if got := Code(err); got != PermissionDenied {
+		t.Errorf("Code: got %s, want PermissionDenied", got)
+	}
+	// The error records where it was made.
+	if got := fmt.Sprintf("%+v", NewErrorf(Internal, nil, "x")); !regexp.MustCompile(`gcerrors/errors_test.go:\d+`).MatchString(got) {
+		t.Errorf("%%+v: got %q, want the caller's file and line", got)
+	}
+}
+
+func TestGRPCCode(t *testing.T) {
+	if got := GRPCCode(status.Error(codes.NotFound, "x")); got != NotFound {
+		t.Errorf("got %s, want NotFound", got)
+	}
+	if got := GRPCCode(io.EOF); got != Unknown {
+		t.Errorf("got %s, want Unknown", got)
+	}
+}
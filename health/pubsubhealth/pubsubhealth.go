@@ -0,0 +1,95 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pubsubhealth provides a health check that detects stalled consumers
+// of a pubsub subscription.
+//
+// Add a Checker to server.Options.HealthChecks, and serve its result as a
+// liveness probe, so that an orchestrator restarts a consumer that has stopped
+// making progress.
+package pubsubhealth // import "gocloud.dev/health/pubsubhealth"
+
+import (
+	"fmt"
+	"time"
+
+	"gocloud.dev/pubsub"
+)
+
+// DefaultAckTimeout is the default value of Options.AckTimeout.
+const DefaultAckTimeout = 5 * time.Minute
+
+// Options sets options for New.
+type Options struct {
+	// AckTimeout is how long messages may be outstanding without any message
+	// being acked or nacked before the consumer is considered stalled.
+	// Defaults to DefaultAckTimeout.
+	AckTimeout time.Duration
+
+	// ReceiveTimeout, if non-zero, is how long the consumer may go without
+	// receiving a message before it is considered stalled. Only set it for
+	// subscriptions that always have messages to deliver; otherwise an idle
+	// topic makes the consumer unhealthy.
+	ReceiveTimeout time.Duration
+}
+
+// Checker checks whether a consumer of a subscription is making progress.
+type Checker struct {
+	sub  *pubsub.Subscription
+	opts Options
+	// start is when the Checker was created. It stands in for the last receive
+	// until there is one.
+	start time.Time
+	now   func() time.Time // for testing
+}
+
+// New returns a Checker for the consumer of sub.
+func New(sub *pubsub.Subscription, opts *Options) *Checker {
+	if opts == nil {
+		opts = &Options{}
+	}
+	o := *opts
+	if o.AckTimeout == 0 {
+		o.AckTimeout = DefaultAckTimeout
+	}
+	return &Checker{sub: sub, opts: o, start: time.Now(), now: time.Now}
+}
+
+// CheckHealth returns an error if the consumer has had messages outstanding
+// for longer than Options.AckTimeout without acking or nacking any of them, or,
+// if Options.ReceiveTimeout is set, if it has not received a message for longer
+// than that.
+func (c *Checker) CheckHealth() error {
+	a := c.sub.Activity()
+	now := c.now()
+	if a.Outstanding > 0 {
+		since := a.OutstandingSince
+		if a.LastAck.After(since) {
+			since = a.LastAck
+		}
+		if d := now.Sub(since); d > c.opts.AckTimeout {
+			return fmt.Errorf("pubsubhealth: %d messages outstanding and none acked or nacked for %v", a.Outstanding, d)
+		}
+	}
+	if c.opts.ReceiveTimeout > 0 {
+		last := a.LastReceive
+		if last.IsZero() {
+			last = c.start
+		}
+		if d := now.Sub(last); d > c.opts.ReceiveTimeout {
+			return fmt.Errorf("pubsubhealth: no message received for %v", d)
+		}
+	}
+	return nil
+}
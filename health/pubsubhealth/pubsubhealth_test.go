@@ -0,0 +1,81 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsubhealth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gocloud.dev/health"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+var _ = health.Checker((*Checker)(nil))
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(topic, time.Minute)
+	defer sub.Shutdown(ctx)
+
+	c := New(sub, &Options{AckTimeout: time.Minute, ReceiveTimeout: time.Hour})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	check := func(wantHealthy bool) {
+		t.Helper()
+		err := c.CheckHealth()
+		if got := err == nil; got != wantHealthy {
+			t.Errorf("got healthy %t (error %v), want %t", got, err, wantHealthy)
+		}
+	}
+
+	// Nothing has happened yet.
+	check(true)
+
+	for i := 0; i < 2; i++ {
+		if err := topic.Send(ctx, &pubsub.Message{Body: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m1, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = time.Now()
+	check(true)
+
+	// A message has been outstanding for too long.
+	now = now.Add(2 * time.Minute)
+	check(false)
+
+	// An ack makes progress, so the remaining message gets a new AckTimeout.
+	m2, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1.Ack()
+	now = time.Now()
+	check(true)
+	m2.Ack()
+	now = now.Add(2 * time.Minute)
+	check(true)
+
+	// No message has been received for longer than ReceiveTimeout.
+	now = now.Add(2 * time.Hour)
+	check(false)
+}
@@ -65,6 +65,18 @@ func awsSession(region string, client *http.Client) (*session.Session, error) {
 	})
 }
 
+// SkipIfNotRecorded skips t if it would replay recorded RPCs but has no replay
+// file, as for a test added after the recordings were last made. Running the
+// test with -record creates the file.
+func SkipIfNotRecorded(t *testing.T) {
+	if *Record {
+		return
+	}
+	if _, err := os.Stat(filepath.Join("testdata", t.Name()+".replay")); os.IsNotExist(err) {
+		t.Skip("no replay file; run with -record to create one")
+	}
+}
+
 // NewRecordReplayClient creates a new http.Client for tests. This client's
 // activity is being either recorded to files (when *Record is set) or replayed
 // from files. rf is a modifier function that will be invoked with the address
@@ -25,4 +25,7 @@ set -euo pipefail
 ./pubsub/rabbitpubsub/localrabbit.sh
 ./runtimevar/etcdvar/localetcd.sh
 ./docstore/mongodocstore/localmongo.sh
+./docstore/postgresdocstore/localpostgres.sh
+./docstore/redisdocstore/localredis.sh
+./docstore/elasticdocstore/localelasticsearch.sh
 ./secrets/vault/localvault.sh
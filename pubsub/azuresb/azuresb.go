@@ -42,6 +42,17 @@
 // See https://godoc.org/gocloud.dev/pubsub#hdr-At_most_once_and_At_least_once_Delivery
 // for more background.
 //
+// Sessions and Scheduled Messages
+//
+// Service Bus sessions deliver the messages with the same session ID in order,
+// to one receiver at a time. To send a message in a session, set the
+// SessionIDKey metadata key to its ordering key. To receive from a Service Bus
+// Subscription that requires sessions, set SubscriptionOptions.Sessions; the
+// session ID of each message received is in the SessionIDKey metadata key.
+//
+// To have Service Bus enqueue a message at a later time, set the
+// ScheduledEnqueueTimeKey metadata key to the time in RFC 3339 format.
+//
 // As
 //
 // azuresb exposes the following types for As:
@@ -60,6 +71,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -141,6 +153,9 @@ const Scheme = "azuresb"
 //   - The URL's host+path is used as the topic name.
 //   - For subscriptions, the subscription name must be provided in the
 //     "subscription" query parameter.
+//   - For subscriptions, "sessions=true" sets SubscriptionOptions.Sessions,
+//     and "session_id" receives from a single session, setting
+//     SubscriptionOptions.SessionID and SubscriptionOptions.Sessions.
 //
 // No other query parameters are supported.
 type URLOpener struct {
@@ -205,6 +220,20 @@ func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsu
 		return nil, fmt.Errorf("open subscription %v: missing required query parameter subscription", u)
 	}
 
+	opts := o.SubscriptionOptions
+	if v := q.Get("sessions"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("open subscription %v: invalid value %q for sessions: %v", u, v, err)
+		}
+		opts.Sessions = b
+		q.Del("sessions")
+	}
+	if id := q.Get("session_id"); id != "" {
+		opts.Sessions = true
+		opts.SessionID = id
+		q.Del("session_id")
+	}
 	for param := range q {
 		return nil, fmt.Errorf("open subscription %v: invalid query parameter %q", u, param)
 	}
@@ -212,7 +241,7 @@ func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsu
 	if err != nil {
 		return nil, fmt.Errorf("open subscription %v: couldn't open subscription %q: %v", u, subName, err)
 	}
-	return OpenSubscription(ctx, ns, t, sub, &o.SubscriptionOptions)
+	return OpenSubscription(ctx, ns, t, sub, &opts)
 }
 
 type topic struct {
@@ -222,6 +251,18 @@ type topic struct {
 // TopicOptions provides configuration options for an Azure SB Topic.
 type TopicOptions struct{}
 
+const (
+	// SessionIDKey is the Message.Metadata key that holds the Service Bus
+	// session ID of a message: its ordering key. Messages with the same session
+	// ID are received in order, by one receiver at a time.
+	SessionIDKey = "azuresb-session-id"
+
+	// ScheduledEnqueueTimeKey is the Message.Metadata key that holds the time,
+	// in RFC 3339 format, at which Service Bus enqueues a message, making it
+	// available to subscriptions.
+	ScheduledEnqueueTimeKey = "azuresb-scheduled-enqueue-time"
+)
+
 // NewNamespaceFromConnectionString returns a *servicebus.Namespace from a Service Bus connection string.
 // https://docs.microsoft.com/en-us/azure/service-bus-messaging/service-bus-dotnet-get-started-with-queues
 func NewNamespaceFromConnectionString(connectionString string) (*servicebus.Namespace, error) {
@@ -263,9 +304,9 @@ func (t *topic) SendBatch(ctx context.Context, dms []*driver.Message) error {
 		panic("azuresb.SendBatch should only get one message at a time")
 	}
 	dm := dms[0]
-	sbms := servicebus.NewMessage(dm.Body)
-	for k, v := range dm.Metadata {
-		sbms.Set(k, v)
+	sbms, err := toServiceBusMessage(dm)
+	if err != nil {
+		return err
 	}
 	if dm.BeforeSend != nil {
 		asFunc := func(i interface{}) bool {
@@ -282,6 +323,29 @@ func (t *topic) SendBatch(ctx context.Context, dms []*driver.Message) error {
 	return t.sbTopic.Send(ctx, sbms)
 }
 
+// toServiceBusMessage converts dm to a Service Bus message. The metadata keys
+// SessionIDKey and ScheduledEnqueueTimeKey set the message's system properties
+// rather than user properties.
+func toServiceBusMessage(dm *driver.Message) (*servicebus.Message, error) {
+	sbms := servicebus.NewMessage(dm.Body)
+	for k, v := range dm.Metadata {
+		switch k {
+		case SessionIDKey:
+			id := v
+			sbms.SessionID = &id
+		case ScheduledEnqueueTimeKey:
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("azuresb: invalid %s %q: %v", ScheduledEnqueueTimeKey, v, err)
+			}
+			sbms.ScheduleAt(t)
+		default:
+			sbms.Set(k, v)
+		}
+	}
+	return sbms, nil
+}
+
 func (t *topic) IsRetryable(err error) bool {
 	// Let the Service Bus SDK recover from any transient connectivity issue.
 	return false
@@ -330,6 +394,9 @@ type subscription struct {
 
 	linkErr  error     // saved error for initializing amqpLink
 	amqpLink *rpc.Link // nil if linkErr != nil
+
+	mu       sync.Mutex
+	sessions *sessionReceiver // nil until the first ReceiveBatch with sessions
 }
 
 // SubscriptionOptions will contain configuration for subscriptions.
@@ -339,8 +406,26 @@ type SubscriptionOptions struct {
 	// When true: pubsub.Message.Ack will be a no-op, pubsub.Message.Nackable
 	// will return true, and pubsub.Message.Nack will panic.
 	ReceiveAndDelete bool
+
+	// Sessions must be true if the Service Bus Subscription requires sessions.
+	// The subscription then holds one session at a time, receiving its
+	// messages in order.
+	Sessions bool
+
+	// SessionID, if set along with Sessions, is the only session received from.
+	// Otherwise the subscription accepts whichever session has messages, and
+	// releases it once it has been idle for SessionIdleTimeout.
+	SessionID string
+
+	// SessionIdleTimeout is how long a session is held without delivering
+	// messages, and with all its messages acked or nacked, before it is
+	// released so that other sessions can be received.
+	// Defaults to 10 seconds.
+	SessionIdleTimeout time.Duration
 }
 
+const defaultSessionIdleTimeout = 10 * time.Second
+
 // OpenSubscription initializes a pubsub Subscription on a given Service Bus Subscription and its parent Service Bus Topic.
 func OpenSubscription(ctx context.Context, parentNamespace *servicebus.Namespace, parentTopic *servicebus.Topic, sbSubscription *servicebus.Subscription, opts *SubscriptionOptions) (*pubsub.Subscription, error) {
 	ds, err := openSubscription(ctx, parentNamespace, parentTopic, sbSubscription, opts)
@@ -364,6 +449,11 @@ func openSubscription(ctx context.Context, sbNs *servicebus.Namespace, sbTop *se
 	if opts == nil {
 		opts = &SubscriptionOptions{}
 	}
+	if opts.SessionIdleTimeout <= 0 {
+		o := *opts
+		o.SessionIdleTimeout = defaultSessionIdleTimeout
+		opts = &o
+	}
 	sub := &subscription{sbSub: sbSub, opts: opts}
 
 	// Initialize a link to the AMQP server, but save any errors to be
@@ -427,6 +517,9 @@ func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*dr
 	if s.linkErr != nil {
 		return nil, s.linkErr
 	}
+	if s.opts.Sessions {
+		return s.receiveSessionBatch(ctx, maxMessages)
+	}
 
 	rctx, cancel := context.WithTimeout(ctx, listenerTimeout)
 	defer cancel()
@@ -436,18 +529,7 @@ func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*dr
 
 	go func() {
 		s.sbSub.Receive(rctx, servicebus.HandlerFunc(func(innerctx context.Context, sbmsg *servicebus.Message) error {
-			metadata := map[string]string{}
-			for key, value := range sbmsg.GetKeyValues() {
-				if strVal, ok := value.(string); ok {
-					metadata[key] = strVal
-				}
-			}
-			messages = append(messages, &driver.Message{
-				Body:     sbmsg.Data,
-				Metadata: metadata,
-				AckID:    sbmsg.LockToken,
-				AsFunc:   messageAsFunc(sbmsg),
-			})
+			messages = append(messages, toDriverMessage(sbmsg, sbmsg.LockToken))
 			if len(messages) >= maxMessages {
 				cancel()
 			}
@@ -464,6 +546,208 @@ func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*dr
 	return messages, nil
 }
 
+// toDriverMessage converts a received Service Bus message to a driver.Message
+// with the given ack ID.
+func toDriverMessage(sbmsg *servicebus.Message, ackID driver.AckID) *driver.Message {
+	metadata := map[string]string{}
+	for key, value := range sbmsg.GetKeyValues() {
+		if strVal, ok := value.(string); ok {
+			metadata[key] = strVal
+		}
+	}
+	if sbmsg.SessionID != nil {
+		metadata[SessionIDKey] = *sbmsg.SessionID
+	}
+	if sp := sbmsg.SystemProperties; sp != nil && sp.ScheduledEnqueueTime != nil {
+		metadata[ScheduledEnqueueTimeKey] = sp.ScheduledEnqueueTime.UTC().Format(time.RFC3339Nano)
+	}
+	return &driver.Message{
+		Body:     sbmsg.Data,
+		Metadata: metadata,
+		AckID:    ackID,
+		AsFunc:   messageAsFunc(sbmsg),
+	}
+}
+
+// A sessionAckID is the ack ID of a message received in a session. Service Bus
+// requires the session ID to settle the message.
+type sessionAckID struct {
+	lockToken *uuid.UUID
+	sessionID string
+}
+
+// receiveSessionBatch implements ReceiveBatch for subscriptions that require
+// sessions, receiving from the session held by s.sessions.
+func (s *subscription) receiveSessionBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	r := s.sessionReceiver()
+	rctx, cancel := context.WithTimeout(ctx, listenerTimeout)
+	defer cancel()
+	var messages []*driver.Message
+	for len(messages) < maxMessages {
+		select {
+		case sbmsg := <-r.msgs:
+			var ackID driver.AckID
+			if sbmsg.LockToken != nil && sbmsg.SessionID != nil {
+				ackID = &sessionAckID{lockToken: sbmsg.LockToken, sessionID: *sbmsg.SessionID}
+			} else {
+				ackID = sbmsg.LockToken
+			}
+			messages = append(messages, toDriverMessage(sbmsg, ackID))
+		case <-r.done:
+			// The receiver failed. Start a new one on the next call.
+			s.mu.Lock()
+			if s.sessions == r {
+				s.sessions = nil
+			}
+			s.mu.Unlock()
+			if len(messages) > 0 {
+				return messages, nil
+			}
+			return nil, r.err
+		case <-rctx.Done():
+			return messages, nil
+		}
+	}
+	return messages, nil
+}
+
+// sessionReceiver returns the receiver of s's sessions, starting it if needed.
+func (s *subscription) sessionReceiver() *sessionReceiver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = newSessionReceiver(s.sbSub, s.opts)
+	}
+	return s.sessions
+}
+
+// A sessionReceiver holds a session of a Service Bus Subscription open across
+// calls to ReceiveBatch, because the locks on a session's messages are lost
+// when the session is closed.
+type sessionReceiver struct {
+	sub  *servicebus.Subscription
+	id   *string // nil to accept any session
+	idle time.Duration
+	// Whether delivered messages hold locks until they are acked or nacked.
+	locks bool
+
+	msgs   chan *servicebus.Message
+	cancel context.CancelFunc
+	done   chan struct{} // closed when run returns
+	err    error         // why run returned; read after done is closed
+
+	mu          sync.Mutex
+	outstanding int       // messages delivered but not yet acked or nacked
+	last        time.Time // when the session was opened or last delivered a message
+}
+
+func newSessionReceiver(sub *servicebus.Subscription, opts *SubscriptionOptions) *sessionReceiver {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &sessionReceiver{
+		sub:    sub,
+		idle:   opts.SessionIdleTimeout,
+		locks:  !opts.ReceiveAndDelete,
+		msgs:   make(chan *servicebus.Message),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if opts.SessionID != "" {
+		id := opts.SessionID
+		r.id = &id
+	}
+	go r.run(ctx)
+	return r
+}
+
+// run receives from one session after another until ctx is done or receiving
+// fails.
+func (r *sessionReceiver) run(ctx context.Context) {
+	defer close(r.done)
+	for ctx.Err() == nil {
+		if err := r.receiveSession(ctx); err != nil && ctx.Err() == nil {
+			r.err = err
+			return
+		}
+	}
+	r.err = ctx.Err()
+}
+
+// receiveSession holds a session until it fails, or, if r accepts any
+// session, until the session is idle.
+func (r *sessionReceiver) receiveSession(ctx context.Context) error {
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.mu.Lock()
+	r.last = time.Now()
+	r.mu.Unlock()
+
+	handler := servicebus.HandlerFunc(func(_ context.Context, sbmsg *servicebus.Message) error {
+		r.mu.Lock()
+		r.last = time.Now()
+		if r.locks {
+			r.outstanding++
+		}
+		r.mu.Unlock()
+		select {
+		case r.msgs <- sbmsg:
+			return nil
+		case <-sctx.Done():
+			r.mu.Lock()
+			if r.locks {
+				r.outstanding--
+			}
+			r.mu.Unlock()
+			return sctx.Err()
+		}
+	})
+	errc := make(chan error, 1)
+	go func() {
+		sess := r.sub.NewSession(r.id)
+		errc <- sess.ReceiveOne(sctx, servicebus.NewSessionHandler(handler, func(*servicebus.MessageSession) error { return nil }, func() {}))
+	}()
+
+	ticker := time.NewTicker(r.idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-ticker.C:
+			if r.id == nil && r.isIdle() {
+				cancel()
+				<-errc
+				return nil
+			}
+		}
+	}
+}
+
+// isIdle reports whether the session can be released.
+func (r *sessionReceiver) isIdle() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.outstanding == 0 && time.Since(r.last) >= r.idle
+}
+
+// settled records that n messages were acked or nacked.
+func (r *sessionReceiver) settled(n int) {
+	if !r.locks {
+		return
+	}
+	r.mu.Lock()
+	r.outstanding -= n
+	if r.outstanding < 0 {
+		r.outstanding = 0
+	}
+	r.mu.Unlock()
+}
+
+// stop stops r and waits for it to release its session.
+func (r *sessionReceiver) stop() {
+	r.cancel()
+	<-r.done
+}
+
 func messageAsFunc(sbmsg *servicebus.Message) func(interface{}) bool {
 	return func(i interface{}) bool {
 		p, ok := i.(**servicebus.Message)
@@ -481,6 +765,7 @@ func (s *subscription) SendAcks(ctx context.Context, ids []driver.AckID) error {
 		// Ack is a no-op in Receive-and-Delete mode.
 		return nil
 	}
+	defer s.settled(len(ids))
 	return s.updateMessageDispositions(ctx, ids, dispositionForAck)
 }
 
@@ -497,26 +782,55 @@ func (s *subscription) SendNacks(ctx context.Context, ids []driver.AckID) error
 	if !s.CanNack() {
 		panic("unreachable")
 	}
+	defer s.settled(len(ids))
 	return s.updateMessageDispositions(ctx, ids, dispositionForNack)
 }
 
+// settled tells the session receiver, if any, that n messages were acked or
+// nacked, so their session can be released.
+func (s *subscription) settled(n int) {
+	s.mu.Lock()
+	r := s.sessions
+	s.mu.Unlock()
+	if r != nil {
+		r.settled(n)
+	}
+}
+
 // IMPORTANT: This is a workaround to issue message dispositions in bulk which is not supported in the Service Bus SDK.
 func (s *subscription) updateMessageDispositions(ctx context.Context, ids []driver.AckID, disposition string) error {
 	if len(ids) == 0 {
 		return nil
 	}
 
-	lockIds := []amqp.UUID{}
+	// Messages from different sessions are settled separately.
+	lockIDsBySession := map[string][]amqp.UUID{}
 	for _, mid := range ids {
-		if id, ok := mid.(*uuid.UUID); ok {
-			lockTokenBytes := [16]byte(*id)
-			lockIds = append(lockIds, amqp.UUID(lockTokenBytes))
+		switch id := mid.(type) {
+		case *uuid.UUID:
+			lockIDsBySession[""] = append(lockIDsBySession[""], amqp.UUID([16]byte(*id)))
+		case *sessionAckID:
+			lockIDsBySession[id.sessionID] = append(lockIDsBySession[id.sessionID], amqp.UUID([16]byte(*id.lockToken)))
+		}
+	}
+	for sessionID, lockIds := range lockIDsBySession {
+		if err := s.updateDispositions(ctx, sessionID, lockIds, disposition); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// updateDispositions settles the messages with the given lock tokens, which are
+// in the session sessionID, if it is not empty.
+func (s *subscription) updateDispositions(ctx context.Context, sessionID string, lockIds []amqp.UUID, disposition string) error {
 	value := map[string]interface{}{
 		"disposition-status": disposition,
 		"lock-tokens":        lockIds,
 	}
+	if sessionID != "" {
+		value["session-id"] = sessionID
+	}
 	msg := &amqp.Message{
 		ApplicationProperties: map[string]interface{}{
 			"operation": "com.microsoft:update-disposition",
@@ -539,7 +853,7 @@ func (s *subscription) updateMessageDispositions(ctx context.Context, ids []driv
 	// It's a "not found" error, probably due to the message already being
 	// deleted on the server. If we're just acking 1 message, we can just
 	// swallow the error, but otherwise we'll need to retry one by one.
-	if len(ids) == 1 {
+	if len(lockIds) == 1 {
 		return nil
 	}
 	for _, lockID := range lockIds {
@@ -596,4 +910,13 @@ func errorCode(err error) gcerrors.ErrorCode {
 }
 
 // Close implements driver.Subscription.Close.
-func (*subscription) Close() error { return nil }
+func (s *subscription) Close() error {
+	s.mu.Lock()
+	r := s.sessions
+	s.sessions = nil
+	s.mu.Unlock()
+	if r != nil {
+		r.stop()
+	}
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"gocloud.dev/internal/testing/setup"
 	"gocloud.dev/pubsub"
@@ -390,6 +391,12 @@ func TestOpenSubscriptionFromURL(t *testing.T) {
 		{"azuresb://mytopic", true},
 		// Invalid parameter.
 		{"azuresb://mytopic?subscription=mysub&param=value", true},
+		// OK, with sessions.
+		{"azuresb://mytopic?subscription=mysub&sessions=true", false},
+		// OK, with a single session.
+		{"azuresb://mytopic?subscription=mysub&session_id=s1", false},
+		// Invalid sessions.
+		{"azuresb://mytopic?subscription=mysub&sessions=maybe", true},
 	}
 
 	ctx := context.Background()
@@ -403,3 +410,39 @@ func TestOpenSubscriptionFromURL(t *testing.T) {
 		}
 	}
 }
+
+func TestSessionAndScheduleMetadata(t *testing.T) {
+	at := time.Date(2019, 6, 1, 2, 0, 0, 0, time.UTC)
+	dm := &driver.Message{
+		Body: []byte("hello"),
+		Metadata: map[string]string{
+			"k":                     "v",
+			SessionIDKey:            "order-1",
+			ScheduledEnqueueTimeKey: at.Format(time.RFC3339),
+		},
+	}
+	sbmsg, err := toServiceBusMessage(dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sbmsg.SessionID == nil || *sbmsg.SessionID != "order-1" {
+		t.Errorf("got SessionID %v, want order-1", sbmsg.SessionID)
+	}
+	if sp := sbmsg.SystemProperties; sp == nil || sp.ScheduledEnqueueTime == nil || !sp.ScheduledEnqueueTime.Equal(at) {
+		t.Errorf("got SystemProperties %+v, want ScheduledEnqueueTime %v", sp, at)
+	}
+	if got := sbmsg.GetKeyValues(); len(got) != 1 || got["k"] != "v" {
+		t.Errorf("got user properties %v, want only k=v", got)
+	}
+
+	// The metadata survives the trip back.
+	got := toDriverMessage(sbmsg, nil).Metadata
+	if got["k"] != "v" || got[SessionIDKey] != "order-1" || got[ScheduledEnqueueTimeKey] != "2019-06-01T02:00:00Z" {
+		t.Errorf("got metadata %v", got)
+	}
+
+	dm.Metadata[ScheduledEnqueueTimeKey] = "tomorrow"
+	if _, err := toServiceBusMessage(dm); err == nil {
+		t.Error("invalid scheduled enqueue time: got nil error, want error")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package checkpoint defines how subscription checkpoints are stored, for
+// pubsub drivers whose services do not remember the position of a
+// subscription.
+//
+// A checkpoint is a driver-specific string that identifies a position in a
+// topic, such that every message up to and including that position has been
+// acknowledged. A driver that supports checkpoints saves one as messages are
+// acknowledged and, when a subscription is reopened, resumes delivery after the
+// saved position instead of losing or redelivering every message.
+//
+// runtimevar variables are read-only, so they cannot store checkpoints. The
+// package gocloud.dev/pubsub/checkpoint/docstorecheckpoint stores them in a
+// docstore collection.
+package checkpoint // import "gocloud.dev/pubsub/checkpoint"
+
+import "context"
+
+// A Checkpointer loads and saves the checkpoint of a single subscription.
+// Its methods may be called concurrently.
+type Checkpointer interface {
+	// Load returns the saved checkpoint, or the empty string if none has been
+	// saved.
+	Load(ctx context.Context) (string, error)
+
+	// Save saves checkpoint, replacing the previous one.
+	Save(ctx context.Context, checkpoint string) error
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package docstorecheckpoint provides a checkpoint.Checkpointer that stores
+// the checkpoint of a subscription in a docstore collection.
+package docstorecheckpoint // import "gocloud.dev/pubsub/checkpoint/docstorecheckpoint"
+
+import (
+	"context"
+
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/checkpoint"
+)
+
+// CheckpointField is the name of the document field that holds the checkpoint.
+const CheckpointField = "Checkpoint"
+
+// New returns a Checkpointer that stores the checkpoint in a document of coll.
+// The document's key is name, in the field keyField; keyField must be the key
+// field coll was opened with. The checkpoint is stored in CheckpointField.
+//
+// Several subscriptions can share a collection, using different names.
+func New(coll *docstore.Collection, keyField, name string) checkpoint.Checkpointer {
+	return &checkpointer{coll: coll, keyField: keyField, name: name}
+}
+
+type checkpointer struct {
+	coll     *docstore.Collection
+	keyField string
+	name     string
+}
+
+// Load implements checkpoint.Checkpointer.Load.
+func (c *checkpointer) Load(ctx context.Context) (string, error) {
+	doc := map[string]interface{}{c.keyField: c.name}
+	if err := c.coll.Get(ctx, doc, CheckpointField); err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	s, _ := doc[CheckpointField].(string)
+	return s, nil
+}
+
+// Save implements checkpoint.Checkpointer.Save.
+func (c *checkpointer) Save(ctx context.Context, checkpoint string) error {
+	return c.coll.Put(ctx, map[string]interface{}{c.keyField: c.name, CheckpointField: checkpoint})
+}
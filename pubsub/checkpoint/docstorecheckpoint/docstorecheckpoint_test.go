@@ -0,0 +1,61 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstorecheckpoint
+
+import (
+	"context"
+	"testing"
+
+	"gocloud.dev/docstore/memdocstore"
+)
+
+func TestCheckpointer(t *testing.T) {
+	ctx := context.Background()
+	coll, err := memdocstore.OpenCollection("name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+
+	cp1 := New(coll, "name", "sub1")
+	cp2 := New(coll, "name", "sub2")
+	got, err := cp1.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("got %q before any Save, want empty string", got)
+	}
+	for _, want := range []string{"1", "5"} {
+		if err := cp1.Save(ctx, want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := cp1.Load(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	// Checkpointers with different names are independent.
+	got, err = cp2.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("sub2: got %q, want empty string", got)
+	}
+}
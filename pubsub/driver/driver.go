@@ -113,6 +113,21 @@ type Topic interface {
 	Close() error
 }
 
+// Warmer is an optional interface for Topics that connect to their service
+// lazily, or whose connections can go stale while they are idle. The pubsub
+// package calls Warm to establish the connections before the first send, and
+// to keep them healthy while the topic is idle.
+type Warmer interface {
+	// Warm establishes the connections, channels, producers or other
+	// resources that SendBatch uses, if they are not established already, and
+	// checks that they are healthy. It should return an error if they cannot
+	// be established, and should replace resources that have failed, so that
+	// the next SendBatch does not have to.
+	//
+	// Warm may be called concurrently with SendBatch.
+	Warm(ctx context.Context) error
+}
+
 // Subscription receives published messages.
 // Drivers may optionally also implement io.Closer; Close will be called
 // when the pubsub.Subscription is Shutdown.
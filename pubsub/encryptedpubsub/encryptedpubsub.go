@@ -0,0 +1,345 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryptedpubsub encrypts the bodies of pubsub messages with keys
+// protected by a secrets.Keeper.
+//
+// A Topic encrypts the body of each message it sends with AES-256-GCM under a
+// random data key, and sends the data key, encrypted by a Keeper, in the
+// message's metadata. This is envelope encryption: the Keeper, which is often a
+// remote key management service with a small limit on the size of what it can
+// encrypt, only ever sees data keys. A Subscription reverses the process.
+// Metadata is not encrypted.
+//
+// Each key version is a Keeper with a name. A Topic encrypts with the current
+// version and records its name in the metadata, and a Subscription decrypts
+// with whichever version a message names. To rotate keys, first add the new
+// version to the subscribers' Keys, then make it current for the publishers,
+// and remove the old version from the subscribers once the messages encrypted
+// with it have been processed.
+package encryptedpubsub // import "gocloud.dev/pubsub/encryptedpubsub"
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"sync"
+	"time"
+
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/secrets"
+)
+
+// The metadata keys that carry the encryption of a message.
+const (
+	// DataKeyMetadataKey holds the message's data key, encrypted by the
+	// Keeper and base64-encoded.
+	DataKeyMetadataKey = "gocloud_encryption_key"
+	// KeyVersionMetadataKey holds the name of the key version whose Keeper
+	// encrypted the data key.
+	KeyVersionMetadataKey = "gocloud_encryption_key_version"
+)
+
+// Keys are the versions of the key that protects the data keys of messages.
+type Keys struct {
+	// Versions maps the name of each version to its Keeper. Names must not be
+	// empty.
+	Versions map[string]*secrets.Keeper
+	// Current is the name of the version that a Topic encrypts with. It is
+	// ignored by a Subscription.
+	Current string
+}
+
+// TopicOptions sets options for a Topic.
+type TopicOptions struct {
+	// DataKeyLifetime is how long a Topic uses a data key before it makes a
+	// new one. If zero, each message has its own data key, which costs a call
+	// to Keeper.Encrypt for every Send and to Keeper.Decrypt for every
+	// Receive. Reusing data keys saves those calls, at the cost of exposing
+	// more messages if a data key is compromised.
+	DataKeyLifetime time.Duration
+}
+
+// A Topic encrypts the messages it sends to an underlying *pubsub.Topic.
+type Topic struct {
+	topic   *pubsub.Topic
+	keeper  *secrets.Keeper
+	version string
+	opts    TopicOptions
+
+	mu      sync.Mutex
+	dataKey []byte
+	wrapped string // dataKey encrypted by keeper, base64-encoded
+	expires time.Time
+}
+
+// NewTopic returns a Topic that encrypts messages with the current version
+// of keys and sends them to topic. opts may be nil.
+func NewTopic(topic *pubsub.Topic, keys *Keys, opts *TopicOptions) (*Topic, error) {
+	if keys == nil || keys.Current == "" {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "encryptedpubsub: no current key version")
+	}
+	k := keys.Versions[keys.Current]
+	if k == nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "encryptedpubsub: no Keeper for the current key version %q", keys.Current)
+	}
+	t := &Topic{topic: topic, keeper: k, version: keys.Current}
+	if opts != nil {
+		t.opts = *opts
+	}
+	return t, nil
+}
+
+// Send encrypts the body of m and sends it, with its metadata and the
+// encrypted data key, to the underlying topic. m is not modified.
+func (t *Topic) Send(ctx context.Context, m *pubsub.Message) error {
+	key, wrapped, err := t.key(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := seal(key, m.Body)
+	if err != nil {
+		return err
+	}
+	md := make(map[string]string, len(m.Metadata)+2)
+	for k, v := range m.Metadata {
+		md[k] = v
+	}
+	md[DataKeyMetadataKey] = wrapped
+	md[KeyVersionMetadataKey] = t.version
+	return t.topic.Send(ctx, &pubsub.Message{
+		Body:       body,
+		Metadata:   md,
+		Expiration: m.Expiration,
+		BeforeSend: m.BeforeSend,
+	})
+}
+
+// key returns the data key for a message, and its encrypted form.
+func (t *Topic) key(ctx context.Context) ([]byte, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dataKey != nil && time.Now().Before(t.expires) {
+		return t.dataKey, t.wrapped, nil
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, "", err
+	}
+	wrapped, err := t.keeper.Encrypt(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	w := base64.StdEncoding.EncodeToString(wrapped)
+	if t.opts.DataKeyLifetime > 0 {
+		t.dataKey, t.wrapped, t.expires = key, w, time.Now().Add(t.opts.DataKeyLifetime)
+	}
+	return key, w, nil
+}
+
+// Shutdown shuts down the underlying topic.
+func (t *Topic) Shutdown(ctx context.Context) error {
+	return t.topic.Shutdown(ctx)
+}
+
+// SubscriptionOptions sets options for a Subscription.
+type SubscriptionOptions struct {
+	// AllowPlaintext, if true, makes Receive return messages without a data
+	// key as they are. Set it while publishers are being moved to encryption.
+	AllowPlaintext bool
+
+	// OnError, if non-nil, is called with each message that cannot be
+	// decrypted and the reason, and Receive goes on to the next message.
+	// OnError must ack or nack the message. If OnError is nil, Receive nacks
+	// the message, if the provider supports it, and returns the error.
+	OnError func(*pubsub.Message, error)
+}
+
+// maxCachedKeys is the number of decrypted data keys that a Subscription
+// remembers, so that it need not decrypt data keys that Topics reuse again.
+const maxCachedKeys = 64
+
+// A Subscription decrypts the messages it receives from an underlying
+// *pubsub.Subscription.
+type Subscription struct {
+	sub  *pubsub.Subscription
+	keys map[string]*secrets.Keeper
+	opts SubscriptionOptions
+
+	mu     sync.Mutex
+	cache  map[string][]byte // by version and encrypted data key
+	cached []string          // the keys of cache, oldest first
+}
+
+// NewSubscription returns a Subscription that receives messages from sub and
+// decrypts them with keys. opts may be nil.
+func NewSubscription(sub *pubsub.Subscription, keys *Keys, opts *SubscriptionOptions) (*Subscription, error) {
+	if keys == nil || len(keys.Versions) == 0 {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "encryptedpubsub: no key versions")
+	}
+	s := &Subscription{sub: sub, keys: map[string]*secrets.Keeper{}, cache: map[string][]byte{}}
+	for v, k := range keys.Versions {
+		if v == "" || k == nil {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "encryptedpubsub: key version %q has no name or no Keeper", v)
+		}
+		s.keys[v] = k
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	return s, nil
+}
+
+// Receive receives a message from the underlying subscription and decrypts its
+// body. The returned message has the plaintext body, and its metadata no
+// longer has DataKeyMetadataKey or KeyVersionMetadataKey.
+//
+// Decryption fails with an error for which gcerrors.Code returns
+// FailedPrecondition if the message is not encrypted or names an unknown key
+// version, and with the Keeper's error if the Keeper cannot decrypt its data
+// key. See SubscriptionOptions.OnError.
+func (s *Subscription) Receive(ctx context.Context) (*pubsub.Message, error) {
+	for {
+		m, err := s.sub.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = s.decrypt(ctx, m)
+		if err == nil {
+			return m, nil
+		}
+		if s.opts.OnError != nil {
+			s.opts.OnError(m, err)
+			continue
+		}
+		if m.Nackable() {
+			m.Nack()
+		}
+		return nil, err
+	}
+}
+
+func (s *Subscription) decrypt(ctx context.Context, m *pubsub.Message) error {
+	wrapped, ok := m.Metadata[DataKeyMetadataKey]
+	if !ok {
+		if s.opts.AllowPlaintext {
+			return nil
+		}
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "encryptedpubsub: message is not encrypted")
+	}
+	version := m.Metadata[KeyVersionMetadataKey]
+	key, err := s.dataKey(ctx, version, wrapped)
+	if err != nil {
+		return err
+	}
+	body, err := open(key, m.Body)
+	if err != nil {
+		return err
+	}
+	// The metadata may be shared with the messages of other subscriptions, so
+	// copy it rather than deleting from it.
+	md := make(map[string]string, len(m.Metadata))
+	for k, v := range m.Metadata {
+		if k != DataKeyMetadataKey && k != KeyVersionMetadataKey {
+			md[k] = v
+		}
+	}
+	m.Body = body
+	m.Metadata = md
+	return nil
+}
+
+// dataKey returns the data key that the Keeper of version encrypted as wrapped.
+func (s *Subscription) dataKey(ctx context.Context, version, wrapped string) ([]byte, error) {
+	k := s.keys[version]
+	if k == nil {
+		return nil, gcerr.Newf(gcerr.FailedPrecondition, nil, "encryptedpubsub: unknown key version %q", version)
+	}
+	id := version + "\x00" + wrapped
+	s.mu.Lock()
+	key := s.cache[id]
+	s.mu.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, gcerr.Newf(gcerr.FailedPrecondition, err, "encryptedpubsub: bad data key")
+	}
+	key, err = k.Decrypt(ctx, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cache[id]; !ok {
+		if len(s.cached) == maxCachedKeys {
+			delete(s.cache, s.cached[0])
+			s.cached = s.cached[1:]
+		}
+		s.cache[id] = key
+		s.cached = append(s.cached, id)
+	}
+	return key, nil
+}
+
+// Shutdown shuts down the underlying subscription.
+func (s *Subscription) Shutdown(ctx context.Context) error {
+	return s.sub.Shutdown(ctx)
+}
+
+// seal encrypts plaintext with key, prefixing the result with a random nonce.
+func seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts a ciphertext made by seal.
+func open(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, gcerr.Newf(gcerr.FailedPrecondition, nil, "encryptedpubsub: message body is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, gcerr.Newf(gcerr.FailedPrecondition, err, "encryptedpubsub: cannot decrypt message body")
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, gcerr.Newf(gcerr.FailedPrecondition, nil, "encryptedpubsub: data key has %d bytes, want 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
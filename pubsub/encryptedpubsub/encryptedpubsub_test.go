@@ -0,0 +1,248 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryptedpubsub
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+	"gocloud.dev/secrets"
+	"gocloud.dev/secrets/localsecrets"
+)
+
+func newKeeper(t *testing.T) *secrets.Keeper {
+	t.Helper()
+	sk, err := localsecrets.NewRandomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return localsecrets.NewKeeper(sk)
+}
+
+// setup returns a topic, a subscription to it, and a function that shuts
+// them down.
+func setup() (*pubsub.Topic, *pubsub.Subscription, func()) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	sub := mempubsub.NewSubscription(topic, time.Minute)
+	return topic, sub, func() {
+		sub.Shutdown(ctx)
+		topic.Shutdown(ctx)
+	}
+}
+
+func receive(ctx context.Context, t *testing.T, sub *Subscription) *pubsub.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	m, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Ack()
+	return m
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	pt, ps, cleanup := setup()
+	defer cleanup()
+	// A raw subscription shows what is sent.
+	raw := mempubsub.NewSubscription(pt, time.Minute)
+	defer raw.Shutdown(ctx)
+	keys := &Keys{Versions: map[string]*secrets.Keeper{"v1": newKeeper(t)}, Current: "v1"}
+	topic, err := NewTopic(pt, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := NewSubscription(ps, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := map[string]string{"a": "b"}
+	body := []byte("secret message")
+	if err := topic.Send(ctx, &pubsub.Message{Body: body, Metadata: md}); err != nil {
+		t.Fatal(err)
+	}
+	if len(md) != 1 {
+		t.Errorf("Send modified the message's metadata: %v", md)
+	}
+	m := receive(ctx, t, sub)
+	if !bytes.Equal(m.Body, body) {
+		t.Errorf("got body %q, want %q", m.Body, body)
+	}
+	if diff := cmp.Diff(m.Metadata, md); diff != "" {
+		t.Errorf("metadata: %s", diff)
+	}
+
+	rm, err := raw.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.Ack()
+	if bytes.Contains(rm.Body, body) {
+		t.Error("the sent body contains the plaintext")
+	}
+	if rm.Metadata[KeyVersionMetadataKey] != "v1" || rm.Metadata[DataKeyMetadataKey] == "" {
+		t.Errorf("got sent metadata %v, want the key version and data key", rm.Metadata)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ctx := context.Background()
+	pt, ps, cleanup := setup()
+	defer cleanup()
+	k1, k2 := newKeeper(t), newKeeper(t)
+	oldTopic, err := NewTopic(pt, &Keys{Versions: map[string]*secrets.Keeper{"v1": k1}, Current: "v1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTopic, err := NewTopic(pt, &Keys{Versions: map[string]*secrets.Keeper{"v1": k1, "v2": k2}, Current: "v2"}, &TopicOptions{DataKeyLifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// During the rotation, subscribers accept both versions.
+	sub, err := NewSubscription(ps, &Keys{Versions: map[string]*secrets.Keeper{"v1": k1, "v2": k2}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []*Topic{oldTopic, newTopic, newTopic} {
+		if err := topic.Send(ctx, &pubsub.Message{Body: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		if m := receive(ctx, t, sub); string(m.Body) != "x" {
+			t.Errorf("got body %q, want %q", m.Body, "x")
+		}
+	}
+	if len(sub.cache) != 2 {
+		t.Errorf("got %d cached data keys, want 2", len(sub.cache))
+	}
+
+	// Afterwards, a message under the old version is rejected and nacked.
+	sub2, err := NewSubscription(ps, &Keys{Versions: map[string]*secrets.Keeper{"v2": k2}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := oldTopic.Send(ctx, &pubsub.Message{Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub2.Receive(ctx); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("got %v, want FailedPrecondition", err)
+	}
+	// The nacked message can be decrypted by the first subscription.
+	if m := receive(ctx, t, sub); string(m.Body) != "x" {
+		t.Errorf("got body %q, want %q", m.Body, "x")
+	}
+}
+
+func TestOnError(t *testing.T) {
+	ctx := context.Background()
+	pt, ps, cleanup := setup()
+	defer cleanup()
+	keys := &Keys{Versions: map[string]*secrets.Keeper{"v1": newKeeper(t)}}
+	var failed []string
+	sub, err := NewSubscription(ps, keys, &SubscriptionOptions{
+		OnError: func(m *pubsub.Message, err error) {
+			failed = append(failed, string(m.Body))
+			m.Ack()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"plain", "bad"} {
+		md := map[string]string{}
+		if body == "bad" {
+			md[DataKeyMetadataKey] = "!"
+			md[KeyVersionMetadataKey] = "v1"
+		}
+		if err := pt.Send(ctx, &pubsub.Message{Body: []byte(body), Metadata: md}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic, err := NewTopic(pt, &Keys{Versions: keys.Versions, Current: "v1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := topic.Send(ctx, &pubsub.Message{Body: []byte("encrypted")}); err != nil {
+		t.Fatal(err)
+	}
+	// sub skips the other messages, reporting them to OnError.
+	if m := receive(ctx, t, sub); string(m.Body) != "encrypted" {
+		t.Errorf("got body %q, want %q", m.Body, "encrypted")
+	}
+	if len(failed) < 2 {
+		// Some were received after the encrypted one.
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if m, err := sub.Receive(tctx); err == nil {
+			t.Fatalf("got message %q, want none", m.Body)
+		}
+	}
+	sort.Strings(failed)
+	if diff := cmp.Diff(failed, []string{"bad", "plain"}); diff != "" {
+		t.Errorf("OnError: %s", diff)
+	}
+}
+
+func TestAllowPlaintext(t *testing.T) {
+	ctx := context.Background()
+	pt, ps, cleanup := setup()
+	defer cleanup()
+	keys := &Keys{Versions: map[string]*secrets.Keeper{"v1": newKeeper(t)}}
+	sub, err := NewSubscription(ps, keys, &SubscriptionOptions{AllowPlaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.Send(ctx, &pubsub.Message{Body: []byte("plain")}); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(ctx, t, sub); string(m.Body) != "plain" {
+		t.Errorf("got body %q, want %q", m.Body, "plain")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	pt, ps, cleanup := setup()
+	defer cleanup()
+	k := newKeeper(t)
+	for _, keys := range []*Keys{
+		nil,
+		{Versions: map[string]*secrets.Keeper{"v1": k}},
+		{Versions: map[string]*secrets.Keeper{"v1": k}, Current: "v2"},
+	} {
+		if _, err := NewTopic(pt, keys, nil); gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("NewTopic(%v): got %v, want InvalidArgument", keys, err)
+		}
+	}
+	for _, keys := range []*Keys{
+		nil,
+		{},
+		{Versions: map[string]*secrets.Keeper{"": k}},
+		{Versions: map[string]*secrets.Keeper{"v1": nil}},
+	} {
+		if _, err := NewSubscription(ps, keys, nil); gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("NewSubscription(%v): got %v, want InvalidArgument", keys, err)
+		}
+	}
+}
@@ -69,6 +69,28 @@ func ExampleSubscription_Receive() {
 	}
 }
 
+func ExampleSubscription_ReceiveBatch() {
+	// Variables set up elsewhere:
+	ctx := context.Background()
+	var subscription *pubsub.Subscription
+
+	// Loop on batches of received messages.
+	for {
+		msgs, err := subscription.ReceiveBatch(ctx, 100)
+		if err != nil {
+			// Errors from ReceiveBatch indicate that it will no longer succeed.
+			log.Printf("Receiving messages: %v", err)
+			break
+		}
+		for _, msg := range msgs {
+			// Do work based on the message, for example:
+			fmt.Printf("Got message: %q\n", msg.Body)
+			// Messages must always be acknowledged with Ack.
+			msg.Ack()
+		}
+	}
+}
+
 func ExampleSubscription_Receive_concurrent() {
 	// This example is used in https://gocloud.dev/howto/pubsub/subscribe/
 
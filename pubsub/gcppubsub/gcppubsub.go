@@ -41,7 +41,15 @@
 //  - Subscription: *raw.SubscriberClient
 //  - Message.BeforeSend: *pb.PubsubMessage
 //  - Message: *pb.PubsubMessage
+//  - TopicOptions.BeforeCreateTopic: *pb.Topic
 //  - Error: *google.golang.org/grpc/status.Status
+//
+// Message Storage Policy and Encryption
+//
+// Users who must control where messages are stored, or which key encrypts them,
+// can set TopicOptions.AllowedPersistenceRegions and TopicOptions.KMSKeyName.
+// gcppubsub checks the topic's configuration before publishing to it, and can
+// create the topic with that configuration if it doesn't exist.
 package gcppubsub // import "gocloud.dev/pubsub/gcppubsub"
 
 import (
@@ -50,6 +58,7 @@ import (
 	"net/url"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -66,6 +75,7 @@ import (
 	"google.golang.org/api/option"
 	pb "google.golang.org/genproto/googleapis/pubsub/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/oauth"
 	"google.golang.org/grpc/status"
@@ -157,7 +167,12 @@ const Scheme = "gcppubsub"
 // The shortened forms "gcppubsub://myproject/mytopic" for topics or
 // "gcppubsub://myproject/mysub" for subscriptions are also supported.
 //
-// No URL parameters are supported.
+// The following query parameters are supported for topics, and set the
+// corresponding fields of TopicOptions:
+//   - allowed_persistence_regions: a comma-separated list of GCP regions.
+//   - kms_key_name: the resource name of a Cloud KMS key.
+//   - create_if_not_exists: a boolean, parsed by strconv.ParseBool.
+// No URL parameters are supported for subscriptions.
 type URLOpener struct {
 	// Conn must be set to a non-nil ClientConn authenticated with
 	// Cloud Pub/Sub scope or equivalent.
@@ -171,8 +186,23 @@ type URLOpener struct {
 
 // OpenTopicURL opens a pubsub.Topic based on u.
 func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
-	for param := range u.Query() {
-		return nil, fmt.Errorf("open topic %v: invalid query parameter %q", u, param)
+	opts := o.TopicOptions
+	for param, values := range u.Query() {
+		value := values[0]
+		switch param {
+		case "allowed_persistence_regions":
+			opts.AllowedPersistenceRegions = strings.Split(value, ",")
+		case "kms_key_name":
+			opts.KMSKeyName = value
+		case "create_if_not_exists":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("open topic %v: invalid value %q for query parameter %q: %v", u, value, param, err)
+			}
+			opts.CreateIfNotExists = b
+		default:
+			return nil, fmt.Errorf("open topic %v: invalid query parameter %q", u, param)
+		}
 	}
 	pc, err := PublisherClient(ctx, o.Conn)
 	if err != nil {
@@ -180,11 +210,11 @@ func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic
 	}
 	topicPath := path.Join(u.Host, u.Path)
 	if topicPathRE.MatchString(topicPath) {
-		return OpenTopicByPath(pc, topicPath, &o.TopicOptions)
+		return OpenTopicByPath(pc, topicPath, &opts)
 	}
 	// Shortened form?
 	topicName := strings.TrimPrefix(u.Path, "/")
-	return OpenTopic(pc, gcp.ProjectID(u.Host), topicName, &o.TopicOptions), nil
+	return OpenTopic(pc, gcp.ProjectID(u.Host), topicName, &opts), nil
 }
 
 // OpenSubscriptionURL opens a pubsub.Subscription based on u.
@@ -208,6 +238,10 @@ func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsu
 type topic struct {
 	path   string
 	client *raw.PublisherClient
+	opts   *TopicOptions
+
+	mu       sync.Mutex
+	verified bool // the topic's configuration satisfies opts
 }
 
 // Dial opens a gRPC connection to the GCP Pub Sub API.
@@ -236,8 +270,37 @@ func SubscriberClient(ctx context.Context, conn *grpc.ClientConn) (*raw.Subscrib
 	return raw.NewSubscriberClient(ctx, option.WithGRPCConn(conn))
 }
 
-// TopicOptions will contain configuration for topics.
-type TopicOptions struct{}
+// TopicOptions contains configuration for topics.
+type TopicOptions struct {
+	// AllowedPersistenceRegions, if non-empty, lists the GCP regions where the
+	// messages published to the topic may be stored. Before the first publish,
+	// the topic's message storage policy is checked: it must allow only regions
+	// in this list. Otherwise, publishing fails with an error whose code is
+	// FailedPrecondition.
+	AllowedPersistenceRegions []string
+
+	// KMSKeyName, if non-empty, is the resource name of the Cloud KMS key that
+	// must protect the topic's messages, of the form
+	// "projects/P/locations/L/keyRings/R/cryptoKeys/K". Before the first
+	// publish, the topic's key is checked, as for AllowedPersistenceRegions.
+	KMSKeyName string
+
+	// CreateIfNotExists makes the first publish create the topic, with the
+	// storage policy and key above, if it does not exist. The caller needs
+	// permission to create topics.
+	CreateIfNotExists bool
+
+	// BeforeCreateTopic, if non-nil, is called before the topic is created
+	// because of CreateIfNotExists. asFunc converts its argument to *pb.Topic,
+	// the topic to be created, so that other fields, like labels, can be set.
+	BeforeCreateTopic func(asFunc func(interface{}) bool) error
+}
+
+// checksConfig reports whether the topic's configuration must be checked or
+// created before publishing.
+func (o *TopicOptions) checksConfig() bool {
+	return len(o.AllowedPersistenceRegions) > 0 || o.KMSKeyName != "" || o.CreateIfNotExists
+}
 
 // OpenTopic returns a *pubsub.Topic backed by an existing GCP PubSub topic
 // in the given projectID. topicName is the last part of the full topic
@@ -245,7 +308,7 @@ type TopicOptions struct{}
 // See the package documentation for an example.
 func OpenTopic(client *raw.PublisherClient, projectID gcp.ProjectID, topicName string, opts *TopicOptions) *pubsub.Topic {
 	topicPath := fmt.Sprintf("projects/%s/topics/%s", projectID, topicName)
-	return pubsub.NewTopic(openTopic(client, topicPath), sendBatcherOpts)
+	return pubsub.NewTopic(openTopic(client, topicPath, opts), sendBatcherOpts)
 }
 
 var topicPathRE = regexp.MustCompile("^projects/.+/topics/.+$")
@@ -257,17 +320,99 @@ func OpenTopicByPath(client *raw.PublisherClient, topicPath string, opts *TopicO
 	if !topicPathRE.MatchString(topicPath) {
 		return nil, fmt.Errorf("invalid topicPath %q; must match %v", topicPath, topicPathRE)
 	}
-	return pubsub.NewTopic(openTopic(client, topicPath), sendBatcherOpts), nil
+	return pubsub.NewTopic(openTopic(client, topicPath, opts), sendBatcherOpts), nil
 }
 
 // openTopic returns the driver for OpenTopic. This function exists so the test
 // harness can get the driver interface implementation if it needs to.
-func openTopic(client *raw.PublisherClient, topicPath string) driver.Topic {
-	return &topic{topicPath, client}
+func openTopic(client *raw.PublisherClient, topicPath string, opts *TopicOptions) driver.Topic {
+	if opts == nil {
+		opts = &TopicOptions{}
+	}
+	return &topic{path: topicPath, client: client, opts: opts}
+}
+
+// ensureConfig checks that the topic's configuration satisfies t.opts, creating
+// the topic if necessary. Once the check succeeds, it is not repeated.
+func (t *topic) ensureConfig(ctx context.Context) error {
+	if !t.opts.checksConfig() {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.verified {
+		return nil
+	}
+	pt, err := t.client.GetTopic(ctx, &pb.GetTopicRequest{Topic: t.path})
+	if status.Code(err) == codes.NotFound && t.opts.CreateIfNotExists {
+		pt, err = t.createTopic(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkTopicConfig(pt, t.opts); err != nil {
+		return err
+	}
+	t.verified = true
+	return nil
+}
+
+// createTopic creates the topic with the configuration in t.opts.
+func (t *topic) createTopic(ctx context.Context) (*pb.Topic, error) {
+	pt := &pb.Topic{Name: t.path, KmsKeyName: t.opts.KMSKeyName}
+	if len(t.opts.AllowedPersistenceRegions) > 0 {
+		pt.MessageStoragePolicy = &pb.MessageStoragePolicy{AllowedPersistenceRegions: t.opts.AllowedPersistenceRegions}
+	}
+	if t.opts.BeforeCreateTopic != nil {
+		asFunc := func(i interface{}) bool {
+			if p, ok := i.(**pb.Topic); ok {
+				*p = pt
+				return true
+			}
+			return false
+		}
+		if err := t.opts.BeforeCreateTopic(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	created, err := t.client.CreateTopic(ctx, pt)
+	if status.Code(err) == codes.AlreadyExists {
+		// Someone else created it first; check their configuration.
+		return t.client.GetTopic(ctx, &pb.GetTopicRequest{Topic: t.path})
+	}
+	return created, err
+}
+
+// checkTopicConfig returns an error if the configuration of pt does not satisfy
+// opts.
+func checkTopicConfig(pt *pb.Topic, opts *TopicOptions) error {
+	if len(opts.AllowedPersistenceRegions) > 0 {
+		allowed := map[string]bool{}
+		for _, r := range opts.AllowedPersistenceRegions {
+			allowed[r] = true
+		}
+		// An empty policy allows every region.
+		regions := pt.GetMessageStoragePolicy().GetAllowedPersistenceRegions()
+		if len(regions) == 0 {
+			return status.Errorf(codes.FailedPrecondition, "topic %s has no message storage policy; want regions %v", pt.Name, opts.AllowedPersistenceRegions)
+		}
+		for _, r := range regions {
+			if !allowed[r] {
+				return status.Errorf(codes.FailedPrecondition, "topic %s allows messages to be stored in %s; want only %v", pt.Name, r, opts.AllowedPersistenceRegions)
+			}
+		}
+	}
+	if opts.KMSKeyName != "" && pt.KmsKeyName != opts.KMSKeyName {
+		return status.Errorf(codes.FailedPrecondition, "topic %s has KMS key %q; want %q", pt.Name, pt.KmsKeyName, opts.KMSKeyName)
+	}
+	return nil
 }
 
 // SendBatch implements driver.Topic.SendBatch.
 func (t *topic) SendBatch(ctx context.Context, dms []*driver.Message) error {
+	if err := t.ensureConfig(ctx); err != nil {
+		return err
+	}
 	var ms []*pb.PubsubMessage
 	for _, dm := range dms {
 		psm := &pb.PubsubMessage{Data: dm.Body, Attributes: dm.Metadata}
@@ -81,7 +81,7 @@ func createTopic(ctx context.Context, pubClient *raw.PublisherClient, topicName,
 	if err != nil {
 		return nil, nil, err
 	}
-	dt = openTopic(pubClient, path.Join("projects", projectID, "topics", topicName))
+	dt = openTopic(pubClient, path.Join("projects", projectID, "topics", topicName), nil)
 	cleanup = func() {
 		pubClient.DeleteTopic(ctx, &pubsubpb.DeleteTopicRequest{Topic: topicPath})
 	}
@@ -89,7 +89,7 @@ func createTopic(ctx context.Context, pubClient *raw.PublisherClient, topicName,
 }
 
 func (h *harness) MakeNonexistentTopic(ctx context.Context) (driver.Topic, error) {
-	return openTopic(h.pubClient, path.Join("projects", projectID, "topics", "nonexistent-topic")), nil
+	return openTopic(h.pubClient, path.Join("projects", projectID, "topics", "nonexistent-topic"), nil), nil
 }
 
 func (h *harness) CreateSubscription(ctx context.Context, dt driver.Topic, testName string) (ds driver.Subscription, cleanup func(), err error) {
@@ -370,6 +370,10 @@ func TestOpenTopicFromURL(t *testing.T) {
 		{"gcppubsub://myproject/mytopic", false},
 		// OK, long form.
 		{"gcppubsub://projects/myproject/topic/mytopic", false},
+		// OK, setting storage policy and encryption.
+		{"gcppubsub://myproject/mytopic?allowed_persistence_regions=us-east1,us-west1&kms_key_name=projects/p/locations/l/keyRings/r/cryptoKeys/k&create_if_not_exists=true", false},
+		// Invalid create_if_not_exists.
+		{"gcppubsub://myproject/mytopic?create_if_not_exists=maybe", true},
 		// Invalid parameter.
 		{"gcppubsub://myproject/mytopic?param=value", true},
 	}
@@ -386,6 +390,34 @@ func TestOpenTopicFromURL(t *testing.T) {
 	}
 }
 
+func TestCheckTopicConfig(t *testing.T) {
+	const key = "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+	regions := func(rs ...string) *pubsubpb.MessageStoragePolicy {
+		return &pubsubpb.MessageStoragePolicy{AllowedPersistenceRegions: rs}
+	}
+	for _, test := range []struct {
+		desc    string
+		topic   *pubsubpb.Topic
+		opts    TopicOptions
+		wantErr bool
+	}{
+		{"no requirements", &pubsubpb.Topic{}, TopicOptions{}, false},
+		{"regions subset", &pubsubpb.Topic{MessageStoragePolicy: regions("us-east1")}, TopicOptions{AllowedPersistenceRegions: []string{"us-east1", "us-west1"}}, false},
+		{"region not allowed", &pubsubpb.Topic{MessageStoragePolicy: regions("us-east1", "asia-east1")}, TopicOptions{AllowedPersistenceRegions: []string{"us-east1"}}, true},
+		{"no policy", &pubsubpb.Topic{}, TopicOptions{AllowedPersistenceRegions: []string{"us-east1"}}, true},
+		{"key matches", &pubsubpb.Topic{KmsKeyName: key}, TopicOptions{KMSKeyName: key}, false},
+		{"no key", &pubsubpb.Topic{}, TopicOptions{KMSKeyName: key}, true},
+	} {
+		err := checkTopicConfig(test.topic, &test.opts)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.desc, err, test.wantErr)
+		}
+		if err != nil && status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("%s: got %v, want FailedPrecondition", test.desc, err)
+		}
+	}
+}
+
 func TestOpenSubscriptionFromURL(t *testing.T) {
 	cleanup := setup.FakeGCPDefaultCredentials(t)
 	defer cleanup()
@@ -0,0 +1,474 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcptasks provides a pubsub topic implementation that dispatches
+// messages as HTTP tasks of a Google Cloud Tasks queue. Use OpenTopic to
+// construct a *pubsub.Topic.
+//
+// Cloud Tasks pushes each task to an HTTP endpoint, so there is no
+// Subscription; serve the endpoint with Handler instead. Handler calls a
+// function with each task's message, and a task is retried by Cloud Tasks,
+// according to the queue's retry configuration, until the function succeeds.
+//
+// URLs
+//
+// For pubsub.OpenTopic, gcptasks registers for the scheme "gcptasks".
+// The default URL opener will create a connection using default
+// credentials from the environment, as described in
+// https://cloud.google.com/docs/authentication/production.
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://gocloud.dev/concepts/urls/ for background information.
+//
+// Scheduling and Deadlines
+//
+// A message is dispatched as soon as possible, unless its Metadata has the
+// key ScheduleTimeMetadataKey. The time a task's endpoint has to respond is
+// TopicOptions.DispatchDeadline, unless the message's Metadata has the key
+// DispatchDeadlineMetadataKey. Neither key is sent with the message.
+//
+// Message Delivery Semantics
+//
+// Cloud Tasks supports at-least-once semantics: a task whose endpoint fails,
+// or does not respond in time, is dispatched again.
+// See https://godoc.org/gocloud.dev/pubsub#hdr-At_most_once_and_At_least_once_Delivery
+// for more background.
+//
+// As
+//
+// gcptasks exposes the following types for As:
+//  - Topic: *cloudtasks.Client
+//  - Message.BeforeSend: *taskspb.CreateTaskRequest
+//  - Error: *google.golang.org/grpc/status.Status
+package gcptasks // import "gocloud.dev/pubsub/gcptasks"
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2beta3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/wire"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/gcp"
+	"gocloud.dev/internal/batcher"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/internal/useragent"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/driver"
+	"google.golang.org/api/option"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/status"
+)
+
+const endPoint = "cloudtasks.googleapis.com:443"
+
+var sendBatcherOpts = &batcher.Options{
+	MaxBatchSize: 1,   // CreateTask only supports one task at a time
+	MaxHandlers:  100, // max concurrency for sends
+}
+
+const (
+	// ScheduleTimeMetadataKey is the Message.Metadata key for the time at which
+	// the message's task should be dispatched, formatted with time.RFC3339Nano.
+	// The task is dispatched as soon as possible if the time is missing or in
+	// the past. Cloud Tasks limits how far in the future it may be.
+	ScheduleTimeMetadataKey = "gocloud_schedule_time"
+
+	// DispatchDeadlineMetadataKey is the Message.Metadata key for the time the
+	// task's endpoint has to respond, formatted for time.ParseDuration. It
+	// overrides TopicOptions.DispatchDeadline.
+	DispatchDeadlineMetadataKey = "gocloud_dispatch_deadline"
+
+	// MetadataHeader is the HTTP header carrying the rest of a message's
+	// Metadata, encoded as by url.Values.Encode.
+	MetadataHeader = "X-Gocloud-Metadata"
+)
+
+func init() {
+	pubsub.DefaultURLMux().RegisterTopic(Scheme, new(lazyCredsOpener))
+}
+
+// Set holds Wire providers for this package.
+var Set = wire.NewSet(
+	Dial,
+	Client,
+	wire.Struct(new(TopicOptions)),
+	wire.Struct(new(URLOpener), "Conn", "TopicOptions"),
+)
+
+// lazyCredsOpener obtains Application Default Credentials on the first call
+// to OpenTopicURL.
+type lazyCredsOpener struct {
+	init   sync.Once
+	opener *URLOpener
+	err    error
+}
+
+func (o *lazyCredsOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
+	o.init.Do(func() {
+		creds, err := gcp.DefaultCredentials(ctx)
+		if err != nil {
+			o.err = err
+			return
+		}
+		conn, _, err := Dial(ctx, creds.TokenSource)
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.opener = &URLOpener{Conn: conn}
+	})
+	if o.err != nil {
+		return nil, fmt.Errorf("open topic %v: failed to open default connection: %v", u, o.err)
+	}
+	return o.opener.OpenTopicURL(ctx, u)
+}
+
+// Scheme is the URL scheme gcptasks registers its URLOpener under on pubsub.DefaultMux.
+const Scheme = "gcptasks"
+
+// URLOpener opens Cloud Tasks URLs like
+// "gcptasks://projects/myproject/locations/us-central1/queues/myqueue?url=https://example.com/tasks".
+//
+// The following query parameters are supported, and set the corresponding
+// fields of TopicOptions:
+//   - url: the URL tasks are sent to.
+//   - service_account: the email of the service account for OIDC tokens.
+//   - dispatch_deadline: a duration, parsed by time.ParseDuration.
+type URLOpener struct {
+	// Conn must be set to a non-nil ClientConn authenticated with
+	// Cloud Tasks scope or equivalent.
+	Conn *grpc.ClientConn
+
+	// TopicOptions specifies the options to pass to OpenTopic.
+	TopicOptions TopicOptions
+}
+
+// OpenTopicURL opens a pubsub.Topic based on u.
+func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
+	opts := o.TopicOptions
+	for param, values := range u.Query() {
+		value := values[0]
+		switch param {
+		case "url":
+			opts.URL = value
+		case "service_account":
+			opts.ServiceAccount = value
+		case "dispatch_deadline":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("open topic %v: invalid value %q for query parameter %q: %v", u, value, param, err)
+			}
+			opts.DispatchDeadline = d
+		default:
+			return nil, fmt.Errorf("open topic %v: invalid query parameter %q", u, param)
+		}
+	}
+	client, err := Client(ctx, o.Conn)
+	if err != nil {
+		return nil, err
+	}
+	return OpenTopic(client, path.Join(u.Host, u.Path), &opts)
+}
+
+// Dial opens a gRPC connection to the Cloud Tasks API.
+//
+// The second return value is a function that can be called to clean up
+// the connection opened by Dial.
+func Dial(ctx context.Context, ts gcp.TokenSource) (*grpc.ClientConn, func(), error) {
+	conn, err := grpc.DialContext(ctx, endPoint,
+		grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")),
+		grpc.WithPerRPCCredentials(oauth.TokenSource{TokenSource: ts}),
+		useragent.GRPCDialOption("pubsub"),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { conn.Close() }, nil
+}
+
+// Client returns a *cloudtasks.Client that can be used in OpenTopic.
+func Client(ctx context.Context, conn *grpc.ClientConn) (*cloudtasks.Client, error) {
+	return cloudtasks.NewClient(ctx, option.WithGRPCConn(conn))
+}
+
+// TopicOptions contains configuration for topics.
+type TopicOptions struct {
+	// URL is the URL that Cloud Tasks sends the messages' tasks to. It is
+	// required, and must begin with "http://" or "https://".
+	URL string
+
+	// ServiceAccount, if non-empty, is the email of a service account in the
+	// queue's project. Cloud Tasks adds an OIDC token for it to each request,
+	// which Cloud Run, Cloud Functions and Identity-Aware Proxy can check.
+	ServiceAccount string
+
+	// DispatchDeadline is the time a task's endpoint has to respond before the
+	// attempt fails. If zero, Cloud Tasks uses its default of 10 minutes.
+	DispatchDeadline time.Duration
+}
+
+var queuePathRE = regexp.MustCompile("^projects/.+/locations/.+/queues/.+$")
+
+// OpenTopic returns a *pubsub.Topic that creates tasks in an existing Cloud
+// Tasks queue. queuePath must be of the form
+// "projects/<projectID>/locations/<location>/queues/<queue>".
+func OpenTopic(client *cloudtasks.Client, queuePath string, opts *TopicOptions) (*pubsub.Topic, error) {
+	dt, err := openTopic(client, queuePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.NewTopic(dt, sendBatcherOpts), nil
+}
+
+// openTopic returns the driver for OpenTopic. This function exists so the test
+// harness can get the driver interface implementation if it needs to.
+func openTopic(client *cloudtasks.Client, queuePath string, opts *TopicOptions) (*topic, error) {
+	if !queuePathRE.MatchString(queuePath) {
+		return nil, fmt.Errorf("invalid queuePath %q; must match %v", queuePath, queuePathRE)
+	}
+	if opts == nil || opts.URL == "" {
+		return nil, fmt.Errorf("gcptasks: TopicOptions.URL is required")
+	}
+	if u, err := url.Parse(opts.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("gcptasks: invalid TopicOptions.URL %q; must begin with http:// or https://", opts.URL)
+	}
+	if opts.DispatchDeadline < 0 {
+		return nil, fmt.Errorf("gcptasks: TopicOptions.DispatchDeadline must not be negative")
+	}
+	return &topic{path: queuePath, client: client, opts: opts}, nil
+}
+
+type topic struct {
+	path   string
+	client *cloudtasks.Client
+	opts   *TopicOptions
+}
+
+// SendBatch implements driver.Topic.SendBatch.
+func (t *topic) SendBatch(ctx context.Context, dms []*driver.Message) error {
+	for _, dm := range dms {
+		req, err := t.createTaskRequest(dm)
+		if err != nil {
+			return err
+		}
+		if dm.BeforeSend != nil {
+			asFunc := func(i interface{}) bool {
+				if p, ok := i.(**taskspb.CreateTaskRequest); ok {
+					*p = req
+					return true
+				}
+				return false
+			}
+			if err := dm.BeforeSend(asFunc); err != nil {
+				return err
+			}
+		}
+		if _, err := t.client.CreateTask(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTaskRequest returns the request that creates the task for dm.
+func (t *topic) createTaskRequest(dm *driver.Message) (*taskspb.CreateTaskRequest, error) {
+	hr := &taskspb.HttpRequest{
+		Url:        t.opts.URL,
+		HttpMethod: taskspb.HttpMethod_POST,
+		Body:       dm.Body,
+		Headers:    map[string]string{},
+	}
+	if t.opts.ServiceAccount != "" {
+		hr.AuthorizationHeader = &taskspb.HttpRequest_OidcToken{
+			OidcToken: &taskspb.OidcToken{ServiceAccountEmail: t.opts.ServiceAccount},
+		}
+	}
+	task := &taskspb.Task{PayloadType: &taskspb.Task_HttpRequest{HttpRequest: hr}}
+	deadline := t.opts.DispatchDeadline
+	md := url.Values{}
+	for k, v := range dm.Metadata {
+		switch k {
+		case ScheduleTimeMetadataKey:
+			when, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, err, "gcptasks: invalid %s %q", k, v)
+			}
+			task.ScheduleTime, err = ptypes.TimestampProto(when)
+			if err != nil {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, err, "gcptasks: invalid %s %q", k, v)
+			}
+		case DispatchDeadlineMetadataKey:
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, err, "gcptasks: invalid %s %q", k, v)
+			}
+			deadline = d
+		default:
+			md.Set(k, v)
+		}
+	}
+	if len(md) > 0 {
+		hr.Headers[MetadataHeader] = md.Encode()
+	}
+	if deadline > 0 {
+		task.DispatchDeadline = ptypes.DurationProto(deadline)
+	}
+	return &taskspb.CreateTaskRequest{Parent: t.path, Task: task}, nil
+}
+
+// IsRetryable implements driver.Topic.IsRetryable.
+func (t *topic) IsRetryable(error) bool {
+	// The client handles retries.
+	return false
+}
+
+// As implements driver.Topic.As.
+func (t *topic) As(i interface{}) bool {
+	c, ok := i.(**cloudtasks.Client)
+	if !ok {
+		return false
+	}
+	*c = t.client
+	return true
+}
+
+// ErrorAs implements driver.Topic.ErrorAs
+func (*topic) ErrorAs(err error, i interface{}) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	p, ok := i.(**status.Status)
+	if !ok {
+		return false
+	}
+	*p = s
+	return true
+}
+
+func (*topic) ErrorCode(err error) gcerrors.ErrorCode {
+	if c := gcerrors.Code(err); c != gcerrors.Unknown {
+		return c
+	}
+	return gcerr.GRPCCode(err)
+}
+
+// Close implements driver.Topic.Close.
+func (*topic) Close() error { return nil }
+
+// Delivery describes the dispatch of a task to its endpoint.
+type Delivery struct {
+	// QueueName and TaskName are the short names of the task's queue and of
+	// the task.
+	QueueName, TaskName string
+	// RetryCount is the number of times the task was dispatched before; it
+	// does not count attempts whose endpoint could not be reached.
+	RetryCount int
+	// ExecutionCount is the number of times the endpoint responded to the
+	// task with an error.
+	ExecutionCount int
+	// ScheduleTime is the time the task was scheduled for.
+	ScheduleTime time.Time
+}
+
+type deliveryKey struct{}
+
+// DeliveryFromContext returns the Delivery of the task being handled, if ctx
+// is the context passed to the function of Handler.
+func DeliveryFromContext(ctx context.Context) (*Delivery, bool) {
+	d, ok := ctx.Value(deliveryKey{}).(*Delivery)
+	return d, ok
+}
+
+// Handler returns an http.Handler for the endpoint that receives the tasks of
+// a topic. For each task, it calls fn with the task's message, unless the
+// message has expired (see pubsub.Message.Expiration). If fn returns an
+// error, the handler responds with a server error, and Cloud Tasks dispatches
+// the task again later.
+//
+// The handler does not check who made the request; use
+// TopicOptions.ServiceAccount, or serve it where only Cloud Tasks can reach
+// it.
+func Handler(fn func(context.Context, *pubsub.Message) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, d, err := decodeRequest(r)
+		if err != nil {
+			// Not a task of a gcptasks topic; retrying won't help.
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !m.Expiration.IsZero() && time.Now().After(m.Expiration) {
+			// Like Subscription.Receive, drop expired messages.
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		ctx := context.WithValue(r.Context(), deliveryKey{}, d)
+		if err := fn(ctx, m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// decodeRequest returns the message and the delivery of a task's request.
+func decodeRequest(r *http.Request) (*pubsub.Message, *Delivery, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &pubsub.Message{Body: body}
+	if h := r.Header.Get(MetadataHeader); h != "" {
+		md, err := url.ParseQuery(h)
+		if err != nil {
+			return nil, nil, fmt.Errorf("gcptasks: invalid %s header: %v", MetadataHeader, err)
+		}
+		m.Metadata = map[string]string{}
+		for k, vs := range md {
+			if k != pubsub.ExpirationMetadataKey {
+				m.Metadata[k] = vs[0]
+				continue
+			}
+			if m.Expiration, err = time.Parse(time.RFC3339Nano, vs[0]); err != nil {
+				return nil, nil, fmt.Errorf("gcptasks: invalid expiration %q: %v", vs[0], err)
+			}
+		}
+		if len(m.Metadata) == 0 {
+			m.Metadata = nil
+		}
+	}
+	d := &Delivery{
+		QueueName: r.Header.Get("X-CloudTasks-QueueName"),
+		TaskName:  r.Header.Get("X-CloudTasks-TaskName"),
+	}
+	d.RetryCount, _ = strconv.Atoi(r.Header.Get("X-CloudTasks-TaskRetryCount"))
+	d.ExecutionCount, _ = strconv.Atoi(r.Header.Get("X-CloudTasks-TaskExecutionCount"))
+	if eta, err := strconv.ParseFloat(r.Header.Get("X-CloudTasks-TaskETA"), 64); err == nil {
+		d.ScheduleTime = time.Unix(0, int64(eta*1e9))
+	}
+	return m, d, nil
+}
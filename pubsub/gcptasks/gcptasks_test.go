@@ -0,0 +1,205 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcptasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/driver"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+const queuePath = "projects/p/locations/us-central1/queues/q"
+
+func TestOpenTopic(t *testing.T) {
+	for _, test := range []struct {
+		path    string
+		opts    *TopicOptions
+		wantErr bool
+	}{
+		{queuePath, &TopicOptions{URL: "https://example.com/tasks"}, false},
+		{queuePath, &TopicOptions{URL: "http://localhost:8080"}, false},
+		{"projects/p/queues/q", &TopicOptions{URL: "https://example.com"}, true},
+		{queuePath, nil, true},
+		{queuePath, &TopicOptions{URL: "example.com/tasks"}, true},
+		{queuePath, &TopicOptions{URL: "https://example.com", DispatchDeadline: -time.Second}, true},
+	} {
+		_, err := openTopic(nil, test.path, test.opts)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s, %+v: got error %v, want error %v", test.path, test.opts, err, test.wantErr)
+		}
+	}
+}
+
+func TestCreateTaskRequest(t *testing.T) {
+	top, err := openTopic(nil, queuePath, &TopicOptions{
+		URL:              "https://example.com/tasks",
+		ServiceAccount:   "tasks@p.iam.gserviceaccount.com",
+		DispatchDeadline: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	req, err := top.createTaskRequest(&driver.Message{
+		Body: []byte("work"),
+		Metadata: map[string]string{
+			"a":                         "1",
+			ScheduleTimeMetadataKey:     when.Format(time.RFC3339Nano),
+			DispatchDeadlineMetadataKey: "30s",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Parent != queuePath {
+		t.Errorf("got parent %q, want %q", req.Parent, queuePath)
+	}
+	if got, _ := ptypes.Timestamp(req.Task.ScheduleTime); !got.Equal(when) {
+		t.Errorf("got schedule time %v, want %v", got, when)
+	}
+	if got, _ := ptypes.Duration(req.Task.DispatchDeadline); got != 30*time.Second {
+		t.Errorf("got dispatch deadline %v, want 30s", got)
+	}
+	hr := req.Task.GetHttpRequest()
+	want := &taskspb.HttpRequest{
+		Url:        "https://example.com/tasks",
+		HttpMethod: taskspb.HttpMethod_POST,
+		Headers:    map[string]string{MetadataHeader: "a=1"},
+		Body:       []byte("work"),
+		AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
+			OidcToken: &taskspb.OidcToken{ServiceAccountEmail: "tasks@p.iam.gserviceaccount.com"},
+		},
+	}
+	if diff := cmp.Diff(hr, want); diff != "" {
+		t.Errorf("HTTP request: %s", diff)
+	}
+
+	// Without the metadata keys, the topic's deadline is used.
+	req, err = top.createTaskRequest(&driver.Message{Body: []byte("now")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Task.ScheduleTime != nil {
+		t.Errorf("got schedule time %v, want none", req.Task.ScheduleTime)
+	}
+	if got, _ := ptypes.Duration(req.Task.DispatchDeadline); got != time.Minute {
+		t.Errorf("got dispatch deadline %v, want 1m", got)
+	}
+	if _, ok := req.Task.GetHttpRequest().Headers[MetadataHeader]; ok {
+		t.Error("got a metadata header for a message without metadata")
+	}
+
+	for _, md := range []map[string]string{
+		{ScheduleTimeMetadataKey: "tomorrow"},
+		{DispatchDeadlineMetadataKey: "soon"},
+		{DispatchDeadlineMetadataKey: "-1s"},
+	} {
+		_, err := top.createTaskRequest(&driver.Message{Metadata: md})
+		if gcerrors.Code(err) != gcerrors.InvalidArgument {
+			t.Errorf("%v: got %v, want InvalidArgument", md, err)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var (
+		got      *pubsub.Message
+		delivery *Delivery
+		fail     bool
+	)
+	h := Handler(func(ctx context.Context, m *pubsub.Message) error {
+		got = m
+		delivery, _ = DeliveryFromContext(ctx)
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	exp := time.Now().Add(time.Hour).UTC().Round(0)
+	newRequest := func(md string) *http.Request {
+		r := httptest.NewRequest("POST", "/tasks", bytes.NewReader([]byte("work")))
+		if md != "" {
+			r.Header.Set(MetadataHeader, md)
+		}
+		r.Header.Set("X-CloudTasks-QueueName", "q")
+		r.Header.Set("X-CloudTasks-TaskName", "123")
+		r.Header.Set("X-CloudTasks-TaskRetryCount", "2")
+		r.Header.Set("X-CloudTasks-TaskExecutionCount", "1")
+		r.Header.Set("X-CloudTasks-TaskETA", "1561982400.5")
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("a=1&b=x+y&"+pubsub.ExpirationMetadataKey+"="+exp.Format(time.RFC3339Nano)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	if string(got.Body) != "work" {
+		t.Errorf("got body %q, want %q", got.Body, "work")
+	}
+	if diff := cmp.Diff(got.Metadata, map[string]string{"a": "1", "b": "x y"}); diff != "" {
+		t.Errorf("metadata: %s", diff)
+	}
+	if !got.Expiration.Equal(exp) {
+		t.Errorf("got expiration %v, want %v", got.Expiration, exp)
+	}
+	wantDelivery := &Delivery{
+		QueueName:      "q",
+		TaskName:       "123",
+		RetryCount:     2,
+		ExecutionCount: 1,
+		ScheduleTime:   time.Unix(1561982400, 5e8),
+	}
+	if diff := cmp.Diff(delivery, wantDelivery); diff != "" {
+		t.Errorf("delivery: %s", diff)
+	}
+
+	// A failure makes Cloud Tasks retry.
+	fail = true
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(""))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for a failure, want 500", w.Code)
+	}
+	if got.Metadata != nil {
+		t.Errorf("got metadata %v, want nil", got.Metadata)
+	}
+
+	// An expired message is dropped.
+	got = nil
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(pubsub.ExpirationMetadataKey+"=2019-01-01T00:00:00Z"))
+	if w.Code != http.StatusOK || got != nil {
+		t.Errorf("expired message: got status %d and message %v, want 200 and no call", w.Code, got)
+	}
+
+	// Malformed metadata is not retried.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("a=%zz"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for malformed metadata, want 400", w.Code)
+	}
+}
@@ -41,10 +41,16 @@
 // []byte for both key and value. These are converted to string for use in
 // Message.Metadata.
 //
+// Warming
+//
+// Topic.Warm and Topic.KeepWarm refresh the metadata of the Kafka topic and
+// connect to the leaders of its partitions, so that a send after an idle period
+// does not have to reconnect first.
+//
 // As
 //
 // kafkapubsub exposes the following types for As:
-//  - Topic: sarama.SyncProducer
+//  - Topic: sarama.SyncProducer, sarama.Client
 //  - Subscription: sarama.ConsumerGroup, sarama.ConsumerGroupSession (may be nil during session renegotiation, and session may go stale at any time)
 //  - Message: *sarama.ConsumerMessage
 //  - Message.BeforeSend: *sarama.ProducerMessage
@@ -183,6 +189,7 @@ func MinimalConfig() *sarama.Config {
 }
 
 type topic struct {
+	client    sarama.Client
 	producer  sarama.SyncProducer
 	topicName string
 	opts      TopicOptions
@@ -218,11 +225,47 @@ func openTopic(brokers []string, config *sarama.Config, topicName string, opts *
 	if opts == nil {
 		opts = &TopicOptions{}
 	}
-	producer, err := sarama.NewSyncProducer(brokers, config)
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
-	return &topic{producer: producer, topicName: topicName, opts: *opts}, nil
+	return &topic{client: client, producer: producer, topicName: topicName, opts: *opts}, nil
+}
+
+// Warm implements driver.Warmer. It refreshes the metadata of the Kafka topic
+// and connects to the leader of each of its partitions, which is where the
+// producer sends messages.
+func (t *topic) Warm(ctx context.Context) error {
+	// The sarama client does not take a context, so only check it up front.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := t.client.RefreshMetadata(t.topicName); err != nil {
+		return err
+	}
+	partitions, err := t.client.Partitions(t.topicName)
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		// Leader opens a connection to the broker if there is none.
+		b, err := t.client.Leader(t.topicName, p)
+		if err != nil {
+			return err
+		}
+		if ok, err := b.Connected(); !ok {
+			if err == nil {
+				err = fmt.Errorf("kafkapubsub: not connected to broker %s", b.Addr())
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 // SendBatch implements driver.Topic.SendBatch.
@@ -267,7 +310,12 @@ func (t *topic) SendBatch(ctx context.Context, dms []*driver.Message) error {
 
 // Close implements io.Closer.
 func (t *topic) Close() error {
-	return t.producer.Close()
+	// A producer made from a client does not close it.
+	err := t.producer.Close()
+	if cerr := t.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // IsRetryable implements driver.Topic.IsRetryable.
@@ -277,9 +325,13 @@ func (t *topic) IsRetryable(error) bool {
 
 // As implements driver.Topic.As.
 func (t *topic) As(i interface{}) bool {
-	if p, ok := i.(*sarama.SyncProducer); ok {
+	switch p := i.(type) {
+	case *sarama.SyncProducer:
 		*p = t.producer
 		return true
+	case *sarama.Client:
+		*p = t.client
+		return true
 	}
 	return false
 }
@@ -136,6 +136,10 @@ func (asTest) TopicCheck(topic *pubsub.Topic) error {
 	if !topic.As(&sp) {
 		return fmt.Errorf("cast failed for %T", sp)
 	}
+	var c sarama.Client
+	if !topic.As(&c) {
+		return fmt.Errorf("cast failed for %T", c)
+	}
 	return nil
 }
 
@@ -0,0 +1,425 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loadtest measures the latency, throughput and loss of a pubsub
+// provider through the portable API.
+//
+// Run publishes messages to a topic at a configured rate while receiving
+// them from a subscription to it, and returns a Report of how long sends and
+// deliveries took and how many messages were lost or delivered twice. Since
+// it uses only *pubsub.Topic and *pubsub.Subscription, the same load can be
+// run against any provider by changing the URLs passed to RunURLs:
+//
+//	report, err := loadtest.RunURLs(ctx, "mem://topic", "mem://topic", &loadtest.Config{
+//		Messages: 10000,
+//		Rate:     500,
+//	})
+//	...
+//	fmt.Println(report)
+//
+// Messages are marked with metadata identifying the run, so that other
+// messages on the subscription are acknowledged and ignored. The subscription
+// should still be used by no other receiver during a run, or its messages will
+// be counted as lost.
+//
+// End-to-end latencies are computed from the clock of the publishing process,
+// so they are only meaningful when one process both publishes and receives,
+// as Run does.
+package loadtest // import "gocloud.dev/pubsub/loadtest"
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocloud.dev/pubsub"
+)
+
+// Metadata keys of the messages that Run publishes.
+const (
+	runKey  = "gocdk-loadtest-run"
+	seqKey  = "gocdk-loadtest-seq"
+	sentKey = "gocdk-loadtest-sent"
+)
+
+// Config describes a load. The zero value is a valid Config.
+type Config struct {
+	// Messages is the number of messages to publish.
+	// Defaults to 1000.
+	Messages int
+
+	// Rate is the number of messages to publish per second. If zero, messages
+	// are published as fast as the publishers can send them.
+	Rate float64
+
+	// Publishers is the number of goroutines that call Topic.Send.
+	// Defaults to 1.
+	Publishers int
+
+	// Receivers is the number of goroutines that call Subscription.Receive.
+	// Defaults to 1.
+	Receivers int
+
+	// BodySize is the size of each message body in bytes.
+	// Defaults to 100.
+	BodySize int
+
+	// Drain is how long to wait, after the last message is published, for the
+	// rest to be received. Messages not received by then are lost.
+	// Defaults to 10 seconds.
+	Drain time.Duration
+}
+
+func (c *Config) withDefaults() Config {
+	var d Config
+	if c != nil {
+		d = *c
+	}
+	if d.Messages <= 0 {
+		d.Messages = 1000
+	}
+	if d.Publishers <= 0 {
+		d.Publishers = 1
+	}
+	if d.Receivers <= 0 {
+		d.Receivers = 1
+	}
+	if d.BodySize <= 0 {
+		d.BodySize = 100
+	}
+	if d.Drain <= 0 {
+		d.Drain = 10 * time.Second
+	}
+	return d
+}
+
+// A Report holds the results of a run.
+type Report struct {
+	// Sent is the number of messages published successfully, and SendErrors
+	// the number whose Send failed.
+	Sent, SendErrors int
+
+	// Received is the number of distinct messages received, and Duplicates
+	// the number of messages received more than once.
+	Received, Duplicates int
+
+	// Lost is the number of messages sent but not received.
+	Lost int
+
+	// PublishDuration is the time from the first send to the end of the last.
+	// Duration is the time from the first send to the end of the run.
+	PublishDuration, Duration time.Duration
+
+	// SendLatency summarizes the durations of Topic.Send calls that
+	// succeeded. EndToEndLatency summarizes the times from the start of the
+	// Send of a message to its first receipt.
+	SendLatency, EndToEndLatency Latency
+
+	// ReceiveError is the error that stopped receiving, if any.
+	ReceiveError error
+}
+
+// SendRate returns the number of messages sent per second.
+func (r *Report) SendRate() float64 {
+	return rate(r.Sent, r.PublishDuration)
+}
+
+// ReceiveRate returns the number of distinct messages received per second.
+func (r *Report) ReceiveRate() float64 {
+	return rate(r.Received, r.Duration)
+}
+
+func rate(n int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// LossRate returns the fraction of sent messages that were lost.
+func (r *Report) LossRate() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Lost) / float64(r.Sent)
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("sent %d (%d errors, %.1f/s), received %d (%d duplicates, %.1f/s), lost %d (%.2f%%)\nsend:       %s\nend-to-end: %s",
+		r.Sent, r.SendErrors, r.SendRate(), r.Received, r.Duplicates, r.ReceiveRate(), r.Lost, 100*r.LossRate(),
+		r.SendLatency, r.EndToEndLatency)
+	if r.ReceiveError != nil {
+		s += fmt.Sprintf("\nreceive error: %v", r.ReceiveError)
+	}
+	return s
+}
+
+// Latency summarizes a set of durations.
+type Latency struct {
+	N                   int
+	Min, Mean, Max      time.Duration
+	P50, P90, P99, P999 time.Duration
+}
+
+func (l Latency) String() string {
+	if l.N == 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("n=%d min=%v mean=%v p50=%v p90=%v p99=%v p99.9=%v max=%v",
+		l.N, l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+}
+
+// summarize returns a Latency for ds, which it sorts.
+func summarize(ds []time.Duration) Latency {
+	if len(ds) == 0 {
+		return Latency{}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return Latency{
+		N:    len(ds),
+		Min:  ds[0],
+		Mean: sum / time.Duration(len(ds)),
+		Max:  ds[len(ds)-1],
+		P50:  percentile(ds, 50),
+		P90:  percentile(ds, 90),
+		P99:  percentile(ds, 99),
+		P999: percentile(ds, 99.9),
+	}
+}
+
+// percentile returns the p'th percentile of the sorted durations ds, using
+// the nearest-rank method.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(ds))))
+	if rank < 1 {
+		rank = 1
+	}
+	return ds[rank-1]
+}
+
+// RunURLs opens the topic and subscription at the given URLs, runs the load
+// described by cfg, and shuts them down. cfg may be nil.
+func RunURLs(ctx context.Context, topicURL, subscriptionURL string, cfg *Config) (*Report, error) {
+	topic, err := pubsub.OpenTopic(ctx, topicURL)
+	if err != nil {
+		return nil, err
+	}
+	defer topic.Shutdown(ctx)
+	sub, err := pubsub.OpenSubscription(ctx, subscriptionURL)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Shutdown(ctx)
+	return Run(ctx, topic, sub, cfg)
+}
+
+// Run publishes the messages described by cfg to topic while receiving them
+// from sub, which must receive the messages sent to topic, and reports the
+// results. cfg may be nil. Run returns an error only if the run could not
+// start; failed sends and receives are counted in the Report.
+func Run(ctx context.Context, topic *pubsub.Topic, sub *pubsub.Subscription, cfg *Config) (*Report, error) {
+	c := cfg.withDefaults()
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	body := make([]byte, c.BodySize)
+	if _, err := rand.Read(body); err != nil {
+		return nil, err
+	}
+	r := &run{
+		cfg:      c,
+		id:       hex.EncodeToString(id),
+		body:     body,
+		received: make([]bool, c.Messages),
+		allIn:    make(chan struct{}),
+	}
+	return r.do(ctx, topic, sub), nil
+}
+
+// run holds the state of a call to Run.
+type run struct {
+	cfg  Config
+	id   string
+	body []byte
+
+	mu            sync.Mutex
+	published     bool // set when all sends have finished
+	sent          int
+	sendErrors    int
+	sendLatencies []time.Duration
+	received      []bool // by sequence number
+	nReceived     int
+	duplicates    int
+	e2eLatencies  []time.Duration
+	receiveErr    error
+	allIn         chan struct{} // closed when every sent message is received
+	allInClosed   bool
+}
+
+func (r *run) do(ctx context.Context, topic *pubsub.Topic, sub *pubsub.Subscription) *Report {
+	recvCtx, cancelRecv := context.WithCancel(ctx)
+	defer cancelRecv()
+	var recvWG sync.WaitGroup
+	for i := 0; i < r.cfg.Receivers; i++ {
+		recvWG.Add(1)
+		go func() {
+			defer recvWG.Done()
+			r.receive(recvCtx, sub)
+		}()
+	}
+
+	start := time.Now()
+	seqs := make(chan int)
+	go func() {
+		defer close(seqs)
+		for i := 0; i < r.cfg.Messages; i++ {
+			if r.cfg.Rate > 0 {
+				next := start.Add(time.Duration(float64(i) / r.cfg.Rate * float64(time.Second)))
+				if d := time.Until(next); d > 0 {
+					select {
+					case <-time.After(d):
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case seqs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var pubWG sync.WaitGroup
+	for i := 0; i < r.cfg.Publishers; i++ {
+		pubWG.Add(1)
+		go func() {
+			defer pubWG.Done()
+			for seq := range seqs {
+				r.send(ctx, topic, seq)
+			}
+		}()
+	}
+	pubWG.Wait()
+	publishDuration := time.Since(start)
+
+	r.mu.Lock()
+	r.published = true
+	r.checkAllIn()
+	r.mu.Unlock()
+	select {
+	case <-r.allIn:
+	case <-time.After(r.cfg.Drain):
+	case <-ctx.Done():
+	}
+	cancelRecv()
+	recvWG.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A message whose Send failed may still have been delivered.
+	lost := r.sent - r.nReceived
+	if lost < 0 {
+		lost = 0
+	}
+	return &Report{
+		Sent:            r.sent,
+		SendErrors:      r.sendErrors,
+		Received:        r.nReceived,
+		Duplicates:      r.duplicates,
+		Lost:            lost,
+		PublishDuration: publishDuration,
+		Duration:        time.Since(start),
+		SendLatency:     summarize(r.sendLatencies),
+		EndToEndLatency: summarize(r.e2eLatencies),
+		ReceiveError:    r.receiveErr,
+	}
+}
+
+func (r *run) send(ctx context.Context, topic *pubsub.Topic, seq int) {
+	start := time.Now()
+	err := topic.Send(ctx, &pubsub.Message{
+		Body: r.body,
+		Metadata: map[string]string{
+			runKey:  r.id,
+			seqKey:  strconv.Itoa(seq),
+			sentKey: strconv.FormatInt(start.UnixNano(), 10),
+		},
+	})
+	d := time.Since(start)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.sendErrors++
+		return
+	}
+	r.sent++
+	r.sendLatencies = append(r.sendLatencies, d)
+}
+
+func (r *run) receive(ctx context.Context, sub *pubsub.Subscription) {
+	for {
+		m, err := sub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.mu.Lock()
+				if r.receiveErr == nil {
+					r.receiveErr = err
+				}
+				r.mu.Unlock()
+			}
+			return
+		}
+		now := time.Now()
+		m.Ack()
+		if m.Metadata[runKey] != r.id {
+			continue
+		}
+		seq, err1 := strconv.Atoi(m.Metadata[seqKey])
+		sent, err2 := strconv.ParseInt(m.Metadata[sentKey], 10, 64)
+		if err1 != nil || err2 != nil || seq < 0 || seq >= len(r.received) {
+			continue
+		}
+		r.mu.Lock()
+		if r.received[seq] {
+			r.duplicates++
+		} else {
+			r.received[seq] = true
+			r.nReceived++
+			r.e2eLatencies = append(r.e2eLatencies, now.Sub(time.Unix(0, sent)))
+			r.checkAllIn()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// checkAllIn closes r.allIn if every message has been sent and every sent
+// message received. It must be called with r.mu held.
+func (r *run) checkAllIn() {
+	if r.published && !r.allInClosed && r.nReceived >= r.sent {
+		close(r.allIn)
+		r.allInClosed = true
+	}
+}
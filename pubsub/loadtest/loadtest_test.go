@@ -0,0 +1,107 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(topic, time.Minute)
+	defer sub.Shutdown(ctx)
+
+	// A message from elsewhere is ignored.
+	if err := topic.Send(ctx, &pubsub.Message{Body: []byte("other")}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Run(ctx, topic, sub, &Config{Messages: 200, Publishers: 4, Receivers: 2, BodySize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(r)
+	if r.Sent != 200 || r.SendErrors != 0 || r.Received != 200 || r.Lost != 0 || r.Duplicates != 0 {
+		t.Errorf("got %+v, want all 200 messages sent and received once", r)
+	}
+	if r.ReceiveError != nil {
+		t.Error(r.ReceiveError)
+	}
+	for _, l := range []Latency{r.SendLatency, r.EndToEndLatency} {
+		if l.N != 200 || l.Min > l.P50 || l.P50 > l.P99 || l.P99 > l.Max {
+			t.Errorf("bad latency summary %+v", l)
+		}
+	}
+}
+
+func TestRunRate(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(topic, time.Minute)
+	defer sub.Shutdown(ctx)
+
+	// 11 messages at 100 per second take at least 100ms to publish.
+	r, err := Run(ctx, topic, sub, &Config{Messages: 11, Rate: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PublishDuration < 100*time.Millisecond {
+		t.Errorf("published in %v, want at least 100ms", r.PublishDuration)
+	}
+	if r.Received != 11 {
+		t.Errorf("received %d, want 11", r.Received)
+	}
+}
+
+func TestRunLoss(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	// The subscription is to a different topic, so every message is lost.
+	other := mempubsub.NewTopic()
+	defer other.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(other, time.Minute)
+	defer sub.Shutdown(ctx)
+
+	r, err := Run(ctx, topic, sub, &Config{Messages: 10, Drain: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Sent != 10 || r.Lost != 10 || r.LossRate() != 1 || r.EndToEndLatency.N != 0 {
+		t.Errorf("got %+v, want 10 messages lost", r)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i >= 1; i-- {
+		ds = append(ds, time.Duration(i))
+	}
+	l := summarize(ds)
+	want := Latency{N: 100, Min: 1, Mean: 50, Max: 100, P50: 50, P90: 90, P99: 99, P999: 100}
+	if l != want {
+		t.Errorf("got %+v, want %+v", l, want)
+	}
+	if got := summarize(nil); got != (Latency{}) {
+		t.Errorf("got %+v for no samples", got)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mempubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/batcher"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/driver"
+)
+
+// fifoBatcherOpts makes the portable type receive and acknowledge messages
+// one at a time, so that it holds no more than the one message that the
+// subscription delivers.
+var fifoBatcherOpts = &batcher.Options{MaxBatchSize: 1, MaxHandlers: 1}
+
+// fifoSubscription delivers the messages of a topic in the order they were
+// sent. Only the oldest unacknowledged message is delivered; it is delivered
+// again if it is nacked or its ack deadline passes.
+type fifoSubscription struct {
+	mu          sync.Mutex
+	topic       *topic
+	ackDeadline time.Duration
+	queue       []*driver.Message // unacknowledged messages, oldest first
+	expiration  time.Time         // when queue[0] is redelivered; zero if it is deliverable now
+	changed     chan struct{}     // closed when queue[0] may have become deliverable
+}
+
+// NewFIFOSubscription is like NewSubscription, but the subscription delivers
+// messages strictly in the order they were sent to the topic, and only one at
+// a time: Receive does not return a message until the one before it has been
+// acknowledged. A message that is nacked, or not acked within ackDeadline, is
+// delivered again before any later message.
+//
+// It is intended for tests of logic that depends on the order of messages,
+// which would be flaky with the concurrent delivery of NewSubscription.
+// It panics if the given topic did not come from mempubsub.
+func NewFIFOSubscription(pstopic *pubsub.Topic, ackDeadline time.Duration) *pubsub.Subscription {
+	var t *topic
+	if !pstopic.As(&t) {
+		panic("mempubsub: NewFIFOSubscription passed a Topic not from mempubsub")
+	}
+	return pubsub.NewSubscription(newFIFOSubscription(t, ackDeadline), fifoBatcherOpts, fifoBatcherOpts)
+}
+
+func newFIFOSubscription(topic *topic, ackDeadline time.Duration) *fifoSubscription {
+	s := &fifoSubscription{
+		topic:       topic,
+		ackDeadline: ackDeadline,
+		changed:     make(chan struct{}),
+	}
+	if topic != nil {
+		topic.mu.Lock()
+		defer topic.mu.Unlock()
+		topic.subs = append(topic.subs, s)
+	}
+	return s
+}
+
+func (s *fifoSubscription) add(ms []*driver.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range ms {
+		m.AsFunc = func(interface{}) bool { return false }
+		s.queue = append(s.queue, m)
+	}
+	s.notify()
+}
+
+// notify wakes up the calls to ReceiveBatch that are waiting for a message.
+// s.mu must be held.
+func (s *fifoSubscription) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// receiveNoWait returns the oldest unacknowledged message if it can be
+// delivered at now, and a channel that is closed when that may change.
+func (s *fifoSubscription) receiveNoWait(now time.Time) (*driver.Message, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 || now.Before(s.expiration) {
+		return nil, s.changed
+	}
+	s.expiration = now.Add(s.ackDeadline)
+	return s.queue[0], s.changed
+}
+
+// ReceiveBatch implements driver.ReceiveBatch.
+// It returns at most one message, whatever maxMessages is.
+func (s *fifoSubscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	if s.topic == nil {
+		return nil, errNotExist
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m, changed := s.receiveNoWait(time.Now())
+	if m != nil {
+		return []*driver.Message{m}, nil
+	}
+	// Wait for the message to become deliverable, but not too long, since the
+	// ack deadline of the outstanding message may pass in the meantime.
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-changed:
+	case <-time.After(pollDuration):
+	}
+	if m, _ := s.receiveNoWait(time.Now()); m != nil {
+		return []*driver.Message{m}, nil
+	}
+	return nil, nil
+}
+
+// isHead reports whether id is the ack ID of the oldest unacknowledged
+// message. s.mu must be held.
+func (s *fifoSubscription) isHead(id driver.AckID) bool {
+	return len(s.queue) > 0 && s.queue[0].AckID == id
+}
+
+// SendAcks implements driver.SendAcks.
+func (s *fifoSubscription) SendAcks(ctx context.Context, ackIDs []driver.AckID) error {
+	if s.topic == nil {
+		return errNotExist
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ackIDs {
+		// Only the oldest message is ever delivered, so an ack for any other
+		// message is for one that has been acked already.
+		if s.isHead(id) {
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.expiration = time.Time{}
+			s.notify()
+		}
+	}
+	return nil
+}
+
+// CanNack implements driver.CanNack.
+func (s *fifoSubscription) CanNack() bool { return true }
+
+// SendNacks implements driver.SendNacks.
+func (s *fifoSubscription) SendNacks(ctx context.Context, ackIDs []driver.AckID) error {
+	if s.topic == nil {
+		return errNotExist
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ackIDs {
+		if s.isHead(id) {
+			s.expiration = time.Time{}
+			s.notify()
+		}
+	}
+	return nil
+}
+
+// IsRetryable implements driver.Subscription.IsRetryable.
+func (*fifoSubscription) IsRetryable(error) bool { return false }
+
+// As implements driver.Subscription.As.
+func (*fifoSubscription) As(i interface{}) bool { return false }
+
+// ErrorAs implements driver.Subscription.ErrorAs
+func (*fifoSubscription) ErrorAs(error, interface{}) bool {
+	return false
+}
+
+// ErrorCode implements driver.Subscription.ErrorCode
+func (*fifoSubscription) ErrorCode(err error) gcerrors.ErrorCode {
+	if err == errNotExist {
+		return gcerrors.NotFound
+	}
+	return gcerrors.Unknown
+}
+
+// Close implements driver.Subscription.Close.
+func (*fifoSubscription) Close() error { return nil }
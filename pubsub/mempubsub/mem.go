@@ -34,6 +34,25 @@
 // See https://godoc.org/gocloud.dev/pubsub#hdr-At_most_once_and_At_least_once_Delivery
 // for more background.
 //
+// Checkpoints
+//
+// A topic created with TopicOptions.RetainMessages keeps its most recent
+// messages, and a subscription created with NewSubscriptionWithCheckpoint saves
+// its position in the topic as messages are acknowledged. When the
+// subscription is reopened with the same checkpoint.Checkpointer, for example
+// after the component that uses it restarts, delivery resumes with the retained
+// messages after the saved position. Since topics live in memory, this only
+// works while the topic exists.
+//
+// Ordered Delivery
+//
+// Subscriptions created with NewSubscription deliver messages in no
+// particular order, and may deliver several at once, like most pub/sub
+// services. Tests of logic that depends on the order of messages can use
+// NewFIFOSubscription instead, which delivers messages strictly in the order
+// they were sent, one at a time: a message is not delivered until the one
+// before it has been acknowledged.
+//
 // As
 //
 // mempubsub does not support any types for As.
@@ -45,11 +64,13 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"strconv"
 	"sync"
 	"time"
 
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/checkpoint"
 	"gocloud.dev/pubsub/driver"
 )
 
@@ -126,13 +147,31 @@ var errNotExist = errors.New("mempubsub: topic does not exist")
 
 type topic struct {
 	mu        sync.Mutex
-	subs      []*subscription
+	subs      []receiver
 	nextAckID int
+	retain    int               // maximum length of log
+	log       []*driver.Message // the most recent messages, oldest first
+}
+
+// TopicOptions sets options for NewTopicWithOptions.
+type TopicOptions struct {
+	// RetainMessages is the number of most recent messages that the topic keeps,
+	// so that subscriptions created with NewSubscriptionWithCheckpoint can resume
+	// from their checkpoints. The default is 0, which keeps no messages.
+	RetainMessages int
 }
 
 // NewTopic creates a new in-memory topic.
 func NewTopic() *pubsub.Topic {
-	return pubsub.NewTopic(&topic{}, nil)
+	return NewTopicWithOptions(nil)
+}
+
+// NewTopicWithOptions is like NewTopic, but accepts options.
+func NewTopicWithOptions(opts *TopicOptions) *pubsub.Topic {
+	if opts == nil {
+		opts = &TopicOptions{}
+	}
+	return pubsub.NewTopic(&topic{retain: opts.RetainMessages}, nil)
 }
 
 // SendBatch implements driver.Topic.SendBatch.
@@ -159,6 +198,12 @@ func (t *topic) SendBatch(ctx context.Context, ms []*driver.Message) error {
 		}
 	}
 	t.nextAckID += len(ms)
+	if t.retain > 0 {
+		t.log = append(t.log, ms...)
+		if n := len(t.log) - t.retain; n > 0 {
+			t.log = append([]*driver.Message(nil), t.log[n:]...)
+		}
+	}
 	for _, s := range t.subs {
 		s.add(ms)
 	}
@@ -197,11 +242,21 @@ func (*topic) ErrorCode(err error) gcerrors.ErrorCode {
 // Close implements driver.Topic.Close.
 func (*topic) Close() error { return nil }
 
+// A receiver is a subscription that the topic delivers messages to.
+type receiver interface {
+	add(ms []*driver.Message)
+}
+
 type subscription struct {
 	mu          sync.Mutex
 	topic       *topic
 	ackDeadline time.Duration
 	msgs        map[driver.AckID]*message // all unacknowledged messages
+	last        int                       // the ack ID of the last message added
+
+	checkpointer checkpoint.Checkpointer // nil if no checkpoints are saved
+	saveMu       sync.Mutex              // held while saving a checkpoint
+	saved        int                     // the last checkpoint saved; protected by saveMu
 }
 
 // NewSubscription creates a new subscription for the given topic.
@@ -226,10 +281,66 @@ func newSubscription(topic *topic, ackDeadline time.Duration) *subscription {
 		topic.mu.Lock()
 		defer topic.mu.Unlock()
 		topic.subs = append(topic.subs, s)
+		s.last = topic.nextAckID - 1
 	}
 	return s
 }
 
+// NewSubscriptionWithCheckpoint is like NewSubscription, but the subscription
+// saves its position in the topic using cp as messages are acknowledged, and
+// resumes from the position loaded from cp. Messages after that position are
+// delivered if the topic still retains them; see TopicOptions.RetainMessages.
+// If cp has no checkpoint, or its checkpoint is not from this topic, delivery
+// starts with the messages the topic retains.
+func NewSubscriptionWithCheckpoint(ctx context.Context, pstopic *pubsub.Topic, ackDeadline time.Duration, cp checkpoint.Checkpointer) (*pubsub.Subscription, error) {
+	var t *topic
+	if !pstopic.As(&t) {
+		panic("mempubsub: NewSubscriptionWithCheckpoint passed a Topic not from mempubsub")
+	}
+	s, err := newCheckpointedSubscription(ctx, t, ackDeadline, cp)
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.NewSubscription(s, nil, nil), nil
+}
+
+func newCheckpointedSubscription(ctx context.Context, t *topic, ackDeadline time.Duration, cp checkpoint.Checkpointer) (*subscription, error) {
+	str, err := cp.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pos := -1
+	if str != "" {
+		pos, err = strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("mempubsub: invalid checkpoint %q", str)
+		}
+	}
+	s := &subscription{
+		topic:        t,
+		ackDeadline:  ackDeadline,
+		msgs:         map[driver.AckID]*message{},
+		checkpointer: cp,
+		saved:        pos,
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pos >= t.nextAckID {
+		// The checkpoint was saved for an earlier topic with the same name.
+		pos = -1
+	}
+	var ms []*driver.Message
+	for _, m := range t.log {
+		if m.AckID.(int) > pos {
+			ms = append(ms, m)
+		}
+	}
+	s.last = pos
+	s.add(ms)
+	t.subs = append(t.subs, s)
+	return s, nil
+}
+
 type message struct {
 	msg        *driver.Message
 	expiration time.Time
@@ -243,6 +354,7 @@ func (s *subscription) add(ms []*driver.Message) {
 		// The new message will expire at the zero time, which means it will be
 		// immediately eligible for delivery.
 		s.msgs[m.AckID] = &message{msg: m}
+		s.last = m.AckID.(int)
 	}
 }
 
@@ -309,15 +421,40 @@ func (s *subscription) SendAcks(ctx context.Context, ackIDs []driver.AckID) erro
 	// Since there is a single map, this correctly handles the case where a message
 	// is redelivered, but the first receiver acknowledges it.
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	for _, id := range ackIDs {
 		// It is OK if the message is not in the map; that just means it has been
 		// previously acked.
 		delete(s.msgs, id)
 	}
+	pos := s.position()
+	s.mu.Unlock()
+	if s.checkpointer == nil {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if pos <= s.saved {
+		return nil
+	}
+	if err := s.checkpointer.Save(ctx, strconv.Itoa(pos)); err != nil {
+		return err
+	}
+	s.saved = pos
 	return nil
 }
 
+// position returns the ack ID of the last message such that it and every
+// message before it has been acknowledged. s.mu must be held.
+func (s *subscription) position() int {
+	pos := s.last
+	for id := range s.msgs {
+		if n := id.(int); n <= pos {
+			pos = n - 1
+		}
+	}
+	return pos
+}
+
 // CanNack implements driver.CanNack.
 func (s *subscription) CanNack() bool { return true }
 
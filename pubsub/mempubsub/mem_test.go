@@ -16,6 +16,8 @@ package mempubsub
 
 import (
 	"context"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -76,6 +78,180 @@ func TestReceive(t *testing.T) {
 	}
 }
 
+// memCheckpointer is a checkpoint.Checkpointer that holds the checkpoint in
+// memory.
+type memCheckpointer struct {
+	mu sync.Mutex
+	cp string
+}
+
+func (c *memCheckpointer) Load(context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cp, nil
+}
+
+func (c *memCheckpointer) Save(_ context.Context, cp string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cp = cp
+	return nil
+}
+
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	cp := &memCheckpointer{}
+
+	topic := &topic{retain: 10}
+	send := func(bodies ...string) {
+		t.Helper()
+		var ms []*driver.Message
+		for _, b := range bodies {
+			ms = append(ms, &driver.Message{Body: []byte(b)})
+		}
+		if err := topic.SendBatch(ctx, ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// receive receives all available messages from sub, acks those whose bodies
+	// are in ack, and returns the bodies of all the received messages.
+	receive := func(sub *subscription, ack ...string) map[string]bool {
+		t.Helper()
+		got := map[string]bool{}
+		var ackIDs []driver.AckID
+		for _, m := range sub.receiveNoWait(time.Now(), 10) {
+			got[string(m.Body)] = true
+			for _, a := range ack {
+				if string(m.Body) == a {
+					ackIDs = append(ackIDs, m.AckID)
+				}
+			}
+		}
+		if err := sub.SendAcks(ctx, ackIDs); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// Messages sent before the first subscription with the checkpointer are
+	// retained, so they are delivered.
+	send("a", "b")
+	sub, err := newCheckpointedSubscription(ctx, topic, time.Minute, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send("c", "d")
+	if got := receive(sub, "a", "c"); len(got) != 4 {
+		t.Fatalf("got %v, want a, b, c and d", got)
+	}
+	// Only "a" is before the first unacknowledged message.
+	if got, err := cp.Load(ctx); err != nil || got != "0" {
+		t.Fatalf("got checkpoint %q, %v, want \"0\"", got, err)
+	}
+
+	// A new subscription resumes after the checkpoint: "c" was acknowledged, but
+	// "b" was not, so it is redelivered.
+	sub, err = newCheckpointedSubscription(ctx, topic, time.Minute, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(sub, "b", "c", "d"); len(got) != 3 || got["a"] {
+		t.Fatalf("got %v, want b, c and d", got)
+	}
+	if got, err := cp.Load(ctx); err != nil || got != "3" {
+		t.Fatalf("got checkpoint %q, %v, want \"3\"", got, err)
+	}
+
+	// Everything has been acknowledged, so a new subscription gets only new
+	// messages.
+	sub, err = newCheckpointedSubscription(ctx, topic, time.Minute, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send("e")
+	if got := receive(sub); len(got) != 1 || !got["e"] {
+		t.Fatalf("got %v, want e", got)
+	}
+}
+
+func TestFIFOSubscription(t *testing.T) {
+	ctx := context.Background()
+	topic := NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := NewFIFOSubscription(topic, time.Minute)
+	defer sub.Shutdown(ctx)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := topic.Send(ctx, &pubsub.Message{Body: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() *pubsub.Message {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		m, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	for i := 0; i < n; i++ {
+		want := strconv.Itoa(i)
+		m := receive()
+		if got := string(m.Body); got != want {
+			t.Fatalf("got message %s, want %s", got, want)
+		}
+		// Nack every third message: it must be delivered again before the
+		// next one.
+		if i%3 == 0 {
+			m.Nack()
+			m = receive()
+			if got := string(m.Body); got != want {
+				t.Fatalf("after nack: got message %s, want %s", got, want)
+			}
+		}
+		m.Ack()
+	}
+}
+
+func TestFIFOReceive(t *testing.T) {
+	ctx := context.Background()
+	topic := &topic{}
+	sub := newFIFOSubscription(topic, 3*time.Second)
+	if err := topic.SendBatch(ctx, []*driver.Message{
+		{Body: []byte("a")},
+		{Body: []byte("b")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	m, _ := sub.receiveNoWait(now)
+	if m == nil || string(m.Body) != "a" {
+		t.Fatalf("got %v, want a", m)
+	}
+	// "a" is outstanding, so nothing can be delivered, not even "b".
+	if m2, _ := sub.receiveNoWait(now); m2 != nil {
+		t.Fatalf("got %s, want no message", m2.Body)
+	}
+	// After the ack deadline, "a" is delivered again.
+	now = now.Add(time.Hour)
+	if m2, _ := sub.receiveNoWait(now); m2 == nil || string(m2.Body) != "a" {
+		t.Fatalf("got %v, want a again", m2)
+	}
+	// Acking "b" before it is delivered has no effect.
+	if err := sub.SendAcks(ctx, []driver.AckID{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.SendAcks(ctx, []driver.AckID{m.AckID}); err != nil {
+		t.Fatal(err)
+	}
+	if m2, _ := sub.receiveNoWait(now); m2 == nil || string(m2.Body) != "b" {
+		t.Fatalf("got %v, want b", m2)
+	}
+}
+
 func TestOpenTopicFromURL(t *testing.T) {
 	tests := []struct {
 		URL     string
@@ -50,7 +50,7 @@
 // characteristics are quite different. See the provider-specific package
 // documentation for more information about message delivery semantics.
 //
-// After receiving a Message via Subscription.Receive:
+// After receiving a Message via Subscription.Receive or ReceiveBatch:
 //  - Always call Message.Ack or Message.Nack after processing the message.
 //  - For some providers, Ack will be a no-op.
 //  - For some providers, Nack is not supported and will panic; you can call
@@ -65,6 +65,7 @@
 //  - Topic.Send
 //  - Topic.Shutdown
 //  - Subscription.Receive
+//  - Subscription.ReceiveBatch
 //  - Subscription.Shutdown
 //  - The internal driver methods SendBatch, SendAcks and ReceiveBatch.
 // All trace and metric names begin with the package import path.
@@ -94,6 +95,9 @@ import (
 	"unicode/utf8"
 
 	gax "github.com/googleapis/gax-go"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/internal/batcher"
 	"gocloud.dev/internal/gcerr"
@@ -119,6 +123,20 @@ type Message struct {
 	// associated metadata.
 	Metadata map[string]string
 
+	// Expiration is the time after which the message should no longer be
+	// processed. The zero value means the message never expires.
+	//
+	// When sending a message, set Expiration to time.Now().Add(ttl) to give the
+	// message a time-to-live. The expiration is carried in Metadata under the key
+	// ExpirationMetadataKey, so it works with every provider.
+	//
+	// Subscription.Receive and ReceiveBatch drop messages whose expiration has
+	// passed: they are acked and never returned to the caller. See the
+	// "expired_messages" metric in OpenCensusViews. For received messages,
+	// Expiration is set from the metadata, and ExpirationMetadataKey is removed
+	// from Metadata.
+	Expiration time.Time
+
 	// BeforeSend is a callback used when sending a message. It will always be
 	// set to nil for received messages.
 	//
@@ -145,6 +163,10 @@ type Message struct {
 	isAcked bool
 }
 
+// ExpirationMetadataKey is the Message.Metadata key used to carry
+// Message.Expiration, formatted as an RFC 3339 timestamp.
+const ExpirationMetadataKey = "gocloud_expiration"
+
 // Ack acknowledges the message, telling the server that it does not need to be
 // sent again to the associated Subscription. It will be a no-op for some
 // providers; see
@@ -207,7 +229,8 @@ func (m *Message) Nack() {
 // See https://gocloud.dev/concepts/as/ for background information, the "As"
 // examples in this package for examples, and the provider-specific package
 // documentation for the specific types supported for that provider.
-// As panics unless it is called on a message obtained from Subscription.Receive.
+// As panics unless it is called on a message obtained from Subscription.Receive
+// or ReceiveBatch.
 func (m *Message) As(i interface{}) bool {
 	if m.asFunc == nil {
 		panic("As called on a Message that was not obtained from Receive")
@@ -222,8 +245,15 @@ type Topic struct {
 	tracer  *oc.Tracer
 	mu      sync.Mutex
 	err     error
+	health  TopicHealth
 
-	// cancel cancels all SendBatch calls.
+	// warmDone is closed when the goroutine started by KeepWarm exits. It is
+	// nil if KeepWarm has not been called.
+	warmDone chan struct{}
+
+	// ctx is done when the Topic is shut down, and cancel cancels it, which
+	// cancels all SendBatch calls.
+	ctx    context.Context
 	cancel func()
 }
 
@@ -257,9 +287,18 @@ func (t *Topic) Send(ctx context.Context, m *Message) (err error) {
 			return gcerr.Newf(gcerr.InvalidArgument, nil, "pubsub: Message.Metadata values must be valid UTF-8 strings: %q", v)
 		}
 	}
+	md := m.Metadata
+	if !m.Expiration.IsZero() {
+		// Copy the metadata so the caller's map is not modified.
+		md = make(map[string]string, len(m.Metadata)+1)
+		for k, v := range m.Metadata {
+			md[k] = v
+		}
+		md[ExpirationMetadataKey] = m.Expiration.UTC().Format(time.RFC3339Nano)
+	}
 	dm := &driver.Message{
 		Body:       m.Body,
-		Metadata:   m.Metadata,
+		Metadata:   md,
 		BeforeSend: m.BeforeSend,
 	}
 	return t.batcher.Add(ctx, dm)
@@ -290,12 +329,133 @@ func (t *Topic) Shutdown(ctx context.Context) (err error) {
 	case <-c:
 	}
 	t.cancel()
+	t.mu.Lock()
+	warmDone := t.warmDone
+	t.mu.Unlock()
+	if warmDone != nil {
+		// Wait for a warmup in progress, which has been canceled.
+		<-warmDone
+	}
 	if err := t.driver.Close(); err != nil {
 		return wrapError(t.driver, err)
 	}
 	return ctx.Err()
 }
 
+// TopicHealth describes the recent activity and the health of a Topic's
+// connections to its service. It is returned by Topic.Health.
+type TopicHealth struct {
+	// LastSend is when messages were last sent successfully, or the zero time
+	// if they never have been.
+	LastSend time.Time
+
+	// LastWarm is when the Topic was last warmed, by Warm or KeepWarm, or the
+	// zero time if it never has been.
+	LastWarm time.Time
+
+	// WarmErr is the error from the last warmup, or nil if it succeeded.
+	WarmErr error
+}
+
+// Health returns a summary of the recent activity of t, for monitoring. For
+// example, a non-nil WarmErr shows that the Topic's connections failed while it
+// was idle, before any Send failed.
+func (t *Topic) Health() TopicHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.health
+}
+
+// Warm establishes the connections that t uses to send messages, if they are
+// not established already, and checks that they are healthy. Call it after
+// opening a Topic so that the first Send does not wait for the connections, or
+// to check that the service can be reached.
+//
+// Warm does nothing for providers that connect when the Topic is opened, or
+// that do not keep connections open.
+func (t *Topic) Warm(ctx context.Context) (err error) {
+	ctx = t.tracer.Start(ctx, "Topic.Warm")
+	defer func() { t.tracer.End(ctx, err) }()
+
+	t.mu.Lock()
+	err = t.err
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.warm(ctx)
+}
+
+// warm calls the driver's Warm method, if it has one, and records the result.
+func (t *Topic) warm(ctx context.Context) error {
+	w, ok := t.driver.(driver.Warmer)
+	if !ok {
+		return nil
+	}
+	err := w.Warm(ctx)
+	if err != nil {
+		err = wrapError(t.driver, err)
+	}
+	t.mu.Lock()
+	t.health.LastWarm = time.Now()
+	t.health.WarmErr = err
+	t.mu.Unlock()
+	return err
+}
+
+// DefaultKeepWarmInterval is the interval used by KeepWarm if it is passed
+// zero.
+const DefaultKeepWarmInterval = 30 * time.Second
+
+// KeepWarm warms t in the background whenever it has not sent messages or been
+// warmed for the given interval, until t is shut down. This re-establishes
+// connections that the service or the network drops while the topic is idle,
+// so that a Send after an idle period does not wait for them. Each warmup may
+// take up to the interval. The result of the last warmup is reported by Health.
+//
+// KeepWarm does nothing for providers whose topics cannot be warmed (see
+// Warm), or if it has been called before.
+func (t *Topic) KeepWarm(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultKeepWarmInterval
+	}
+	if _, ok := t.driver.(driver.Warmer); !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.warmDone != nil || t.err != nil {
+		return
+	}
+	t.warmDone = make(chan struct{})
+	go t.keepWarm(interval)
+}
+
+func (t *Topic) keepWarm(interval time.Duration) {
+	defer close(t.warmDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			last := t.health.LastSend
+			if t.health.LastWarm.After(last) {
+				last = t.health.LastWarm
+			}
+			t.mu.Unlock()
+			if now.Sub(last) < interval {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(t.ctx, interval)
+			_ = t.warm(ctx) // reported by Health
+			cancel()
+		}
+	}
+}
+
 // As converts i to provider-specific types.
 // See https://gocloud.dev/concepts/as/ for background information, the "As"
 // examples in this package for examples, and the provider-specific package
@@ -328,6 +488,9 @@ func newSendBatcher(ctx context.Context, t *Topic, dt driver.Topic, opts *batche
 		if err != nil {
 			return wrapError(dt, err)
 		}
+		t.mu.Lock()
+		t.health.LastSend = time.Now()
+		t.mu.Unlock()
 		return nil
 	}
 	return batcher.New(reflect.TypeOf(&driver.Message{}), opts, handler)
@@ -341,6 +504,7 @@ func newTopic(d driver.Topic, opts *batcher.Options) *Topic {
 	t := &Topic{
 		driver: d,
 		tracer: newTracer(d),
+		ctx:    ctx,
 		cancel: cancel,
 	}
 	t.batcher = newSendBatcher(ctx, t, d, opts)
@@ -350,12 +514,23 @@ func newTopic(d driver.Topic, opts *batcher.Options) *Topic {
 const pkgName = "gocloud.dev/pubsub"
 
 var (
-	latencyMeasure = oc.LatencyMeasure(pkgName)
+	latencyMeasure         = oc.LatencyMeasure(pkgName)
+	expiredMessagesMeasure = stats.Int64(pkgName+"/expired_messages", "Messages dropped because they expired", stats.UnitDimensionless)
 
 	// OpenCensusViews are predefined views for OpenCensus metrics.
-	// The views include counts and latency distributions for API method calls.
+	// The views include counts and latency distributions for API method calls,
+	// and a count of expired messages dropped by Subscription.Receive and
+	// ReceiveBatch.
 	// See the example at https://godoc.org/go.opencensus.io/stats/view for usage.
-	OpenCensusViews = oc.Views(pkgName, latencyMeasure)
+	OpenCensusViews = append(
+		oc.Views(pkgName, latencyMeasure),
+		&view.View{
+			Name:        pkgName + "/expired_messages",
+			Measure:     expiredMessagesMeasure,
+			Description: "Count of received messages dropped because they expired.",
+			TagKeys:     []tag.Key{oc.ProviderKey},
+			Aggregation: view.Count(),
+		})
 )
 
 func newTracer(driver interface{}) *oc.Tracer {
@@ -387,6 +562,7 @@ type Subscription struct {
 	throughputStart  time.Time         // start time for throughput measurement, or the zero Time if queue is empty
 	throughputEnd    time.Time         // end time for throughput measurement, or the zero Time if queue is not empty
 	throughputCount  int               // number of msgs given out via Receive since throughputStart
+	activity         SubscriptionActivity
 
 	// Used in tests.
 	preReceiveBatchHook func(maxMessages int)
@@ -539,6 +715,48 @@ func (s *Subscription) Receive(ctx context.Context) (_ *Message, err error) {
 	ctx = s.tracer.Start(ctx, "Subscription.Receive")
 	defer func() { s.tracer.End(ctx, err) }()
 
+	msgs, err := s.receive(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return msgs[0], nil
+}
+
+// ReceiveBatch receives and returns up to maxMessages messages from the
+// Subscription's queue, blocking and polling until at least one is available.
+// It returns the messages that are available without waiting for more, so it
+// may return fewer than maxMessages. It can be called concurrently from
+// multiple goroutines, and together with Receive.
+//
+// ReceiveBatch is for applications that process messages at a high rate,
+// because it avoids the overhead of a Receive call for each message. The
+// queue of messages is shared with Receive, and it is filled in the same way,
+// so ReceiveBatch does not change how messages are fetched from the provider.
+//
+// ReceiveBatch returns errors in the same cases as Receive. It panics if
+// maxMessages is less than 1.
+//
+// Each returned Message must be acked or nacked, as for Receive.
+func (s *Subscription) ReceiveBatch(ctx context.Context, maxMessages int) (_ []*Message, err error) {
+	if maxMessages < 1 {
+		panic("pubsub: Subscription.ReceiveBatch: maxMessages must be at least 1")
+	}
+	ctx = s.tracer.Start(ctx, "Subscription.ReceiveBatch")
+	defer func() { s.tracer.End(ctx, err) }()
+
+	return s.receive(ctx, maxMessages)
+}
+
+// receive returns between 1 and maxMessages messages from the queue, waiting
+// until at least one is available. It must be called directly by Receive,
+// ReceiveBatch or the iterator returned by Messages, so that the finalizers
+// of the messages can report their callers.
+func (s *Subscription) receive(ctx context.Context, maxMessages int) ([]*Message, error) {
+	var caller string
+	if _, file, lineno, ok := runtime.Caller(2); ok { // the caller of Receive, ReceiveBatch or the iterator
+		caller = fmt.Sprintf(" (%s:%d)", file, lineno)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for {
@@ -587,43 +805,21 @@ func (s *Subscription) Receive(ctx context.Context) (_ *Message, err error) {
 			}()
 		}
 		if len(s.q) > 0 {
-			// At least one message is available. Return it.
-			m := s.q[0]
-			s.q = s.q[1:]
-			s.throughputCount++
-
-			// Convert driver.Message to Message.
-			id := m.AckID
-			md := m.Metadata
-			if len(md) == 0 {
-				md = nil
-			}
-			m2 := &Message{
-				Body:     m.Body,
-				Metadata: md,
-				asFunc:   m.AsFunc,
-				nackable: s.canNack,
+			// At least one message is available. Return as many as are wanted.
+			var msgs []*Message
+			for len(s.q) > 0 && len(msgs) < maxMessages {
+				m := s.q[0]
+				s.q = s.q[1:]
+				s.throughputCount++
+				if m2 := s.toMessage(m, caller); m2 != nil {
+					msgs = append(msgs, m2)
+				}
 			}
-			m2.ack = func(isAck bool) {
-				// Ignore the error channel. Errors are dealt with
-				// in the ackBatcher handler.
-				_ = s.ackBatcher.AddNoWait(&driver.AckInfo{AckID: id, IsAck: isAck})
+			if len(msgs) == 0 {
+				// All the messages had expired.
+				continue
 			}
-			// Add a finalizer that complains if the Message we return isn't
-			// acked or nacked.
-			_, file, lineno, ok := runtime.Caller(1) // the caller of Receive
-			runtime.SetFinalizer(m2, func(m *Message) {
-				m.mu.Lock()
-				defer m.mu.Unlock()
-				if !m.isAcked {
-					var caller string
-					if ok {
-						caller = fmt.Sprintf(" (%s:%d)", file, lineno)
-					}
-					log.Printf("A pubsub.Message was never Acked or Nacked%s", caller)
-				}
-			})
-			return m2, nil
+			return msgs, nil
 		}
 		// No messages are available.
 		if s.throughputEnd.IsZero() && !s.throughputStart.IsZero() {
@@ -643,6 +839,108 @@ func (s *Subscription) Receive(ctx context.Context) (_ *Message, err error) {
 	}
 }
 
+// toMessage converts m, a message taken from the queue, to a Message that is
+// returned to the caller of Receive or ReceiveBatch. If m has expired, it is
+// acked and toMessage returns nil. caller describes where the message is
+// received, for the finalizer that complains if it is never acked.
+//
+// s.mu must be held.
+func (s *Subscription) toMessage(m *driver.Message, caller string) *Message {
+	now := time.Now()
+	id := m.AckID
+	md, exp := extractExpiration(m.Metadata)
+	if !exp.IsZero() && now.After(exp) {
+		// Drop the expired message. Ack it so it isn't redelivered.
+		_ = s.ackBatcher.AddNoWait(&driver.AckInfo{AckID: id, IsAck: true})
+		stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(oc.ProviderKey, s.tracer.Provider)},
+			expiredMessagesMeasure.M(1))
+		return nil
+	}
+	if len(md) == 0 {
+		md = nil
+	}
+	m2 := &Message{
+		Body:       m.Body,
+		Metadata:   md,
+		Expiration: exp,
+		asFunc:     m.AsFunc,
+		nackable:   s.canNack,
+	}
+	m2.ack = func(isAck bool) {
+		// Ignore the error channel. Errors are dealt with
+		// in the ackBatcher handler.
+		_ = s.ackBatcher.AddNoWait(&driver.AckInfo{AckID: id, IsAck: isAck})
+		s.mu.Lock()
+		s.activity.LastAck = time.Now()
+		s.activity.Outstanding--
+		s.mu.Unlock()
+	}
+	s.activity.LastReceive = now
+	if s.activity.Outstanding == 0 {
+		s.activity.OutstandingSince = now
+	}
+	s.activity.Outstanding++
+	// Add a finalizer that complains if the Message we return isn't
+	// acked or nacked.
+	runtime.SetFinalizer(m2, func(m *Message) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !m.isAcked {
+			log.Printf("A pubsub.Message was never Acked or Nacked%s", caller)
+		}
+	})
+	return m2
+}
+
+// SubscriptionActivity describes how a Subscription's messages are being
+// received and acknowledged. It is returned by Subscription.Activity.
+type SubscriptionActivity struct {
+	// LastReceive is when Receive last returned a message, or the zero time if it
+	// never has.
+	LastReceive time.Time
+
+	// LastAck is when a message was last acked or nacked, or the zero time if
+	// none has been.
+	LastAck time.Time
+
+	// Outstanding is the number of messages returned by Receive that have not
+	// been acked or nacked.
+	Outstanding int
+
+	// OutstandingSince is when Outstanding last became non-zero.
+	OutstandingSince time.Time
+}
+
+// Activity returns a summary of the recent activity of s, for monitoring. For
+// example, an application that has had outstanding messages for a long time
+// without acking any may be stuck.
+func (s *Subscription) Activity() SubscriptionActivity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activity
+}
+
+// extractExpiration returns md without ExpirationMetadataKey, and the
+// expiration time it holds. If md has no valid expiration, it is returned
+// unchanged along with the zero time.
+func extractExpiration(md map[string]string) (map[string]string, time.Time) {
+	v, ok := md[ExpirationMetadataKey]
+	if !ok {
+		return md, time.Time{}
+	}
+	exp, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return md, time.Time{}
+	}
+	md2 := make(map[string]string, len(md)-1)
+	for k, v := range md {
+		if k != ExpirationMetadataKey {
+			md2[k] = v
+		}
+	}
+	return md2, exp
+}
+
 // getNextBatch gets the next batch of messages from the server and returns it.
 func (s *Subscription) getNextBatch(nMessages int) ([]*driver.Message, error) {
 	var mu sync.Mutex
@@ -0,0 +1,57 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+// +build go1.23
+
+package pubsub
+
+import (
+	"context"
+	"iter"
+)
+
+// Messages returns an iterator over the messages received from the
+// Subscription, for use with a range loop in place of calls to Receive:
+//
+//	for msg, err := range sub.Messages(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//		msg.Ack()
+//	}
+//
+// The iterator receives messages until the loop ends or Receive would return
+// an error, which it yields with a nil Message before ending. In particular,
+// it ends with an error once ctx is Done. Breaking out of the loop does not
+// affect the Subscription, so Receive or Messages can be called again.
+//
+// Each yielded Message must be acked or nacked, as for Receive.
+func (s *Subscription) Messages(ctx context.Context) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		for {
+			rctx := s.tracer.Start(ctx, "Subscription.Receive")
+			msgs, err := s.receive(rctx, 1)
+			s.tracer.End(rctx, err)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(msgs[0], nil) {
+				return
+			}
+		}
+	}
+}
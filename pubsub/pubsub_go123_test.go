@@ -0,0 +1,76 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+// +build go1.23
+
+package pubsub_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+func TestMessages(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(topic, time.Second)
+	defer sub.Shutdown(ctx)
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		if err := topic.Send(ctx, &pubsub.Message{Body: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Breaking out of the loop leaves the subscription usable.
+	got := map[string]bool{}
+	for m, err := range sub.Messages(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[string(m.Body)] = true
+		m.Ack()
+		if len(got) == 2 {
+			break
+		}
+	}
+	// The loop ends with the error from Receive when ctx is done.
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var loopErr error
+	for m, err := range sub.Messages(cctx) {
+		if err != nil {
+			loopErr = err
+			continue
+		}
+		got[string(m.Body)] = true
+		m.Ack()
+		if len(got) == n {
+			cancel()
+		}
+	}
+	if len(got) != n {
+		t.Errorf("got %d distinct messages, want %d", len(got), n)
+	}
+	if loopErr == nil || cctx.Err() == nil {
+		t.Errorf("got error %v after the context was canceled, want an error", loopErr)
+	}
+}
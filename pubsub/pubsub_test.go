@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"net/url"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -135,6 +136,75 @@ func TestSendReceive(t *testing.T) {
 	m2.Ack()
 }
 
+func TestReceiveBatch(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(topic, time.Second)
+	defer sub.Shutdown(ctx)
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := topic.Send(ctx, &pubsub.Message{Body: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for len(got) < n {
+		msgs, err := sub.ReceiveBatch(ctx, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 || len(msgs) > 3 {
+			t.Fatalf("got %d messages, want between 1 and 3", len(msgs))
+		}
+		for _, m := range msgs {
+			got[string(m.Body)] = true
+			m.Ack()
+		}
+	}
+	if a := sub.Activity(); a.Outstanding != 0 {
+		t.Errorf("got %d outstanding messages, want 0", a.Outstanding)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	sub := mempubsub.NewSubscription(topic, time.Second)
+	defer sub.Shutdown(ctx)
+
+	md := map[string]string{"a": "1"}
+	expired := &pubsub.Message{Body: []byte("stale"), Metadata: md, Expiration: time.Now().Add(-time.Minute)}
+	if err := topic.Send(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Round(0)
+	live := &pubsub.Message{Body: []byte("fresh"), Metadata: md, Expiration: exp}
+	if err := topic.Send(ctx, live); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := md[pubsub.ExpirationMetadataKey]; ok {
+		t.Error("Send modified the caller's Metadata")
+	}
+
+	m, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Ack()
+	if got, want := string(m.Body), "fresh"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if !m.Expiration.Equal(exp) {
+		t.Errorf("got Expiration %v, want %v", m.Expiration, exp)
+	}
+	if diff := cmp.Diff(m.Metadata, md); diff != "" {
+		t.Errorf("Metadata: %s", diff)
+	}
+}
+
 func TestConcurrentReceivesGetAllTheMessages(t *testing.T) {
 	howManyToSend := int(1e3)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -222,6 +292,98 @@ func TestCancelSend(t *testing.T) {
 	}
 }
 
+// warmingTopic is a driverTopic that implements driver.Warmer.
+type warmingTopic struct {
+	driverTopic
+	mu    sync.Mutex
+	warms int
+	err   error // returned by Warm
+}
+
+func (t *warmingTopic) Warm(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.warms++
+	return t.err
+}
+
+func (t *warmingTopic) numWarms() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.warms
+}
+
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+	dt := &warmingTopic{}
+	topic := pubsub.NewTopic(dt, nil)
+	if err := topic.Warm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if h := topic.Health(); h.LastWarm.IsZero() || h.WarmErr != nil || !h.LastSend.IsZero() {
+		t.Errorf("after Warm: got health %+v, want a successful warmup and no sends", h)
+	}
+	if err := topic.Send(ctx, &pubsub.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	if h := topic.Health(); h.LastSend.IsZero() {
+		t.Errorf("after Send: got health %+v, want LastSend set", h)
+	}
+
+	dt.mu.Lock()
+	dt.err = errors.New("unreachable")
+	dt.mu.Unlock()
+	err := topic.Warm(ctx)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if h := topic.Health(); h.WarmErr != err {
+		t.Errorf("got WarmErr %v, want %v", h.WarmErr, err)
+	}
+
+	if err := topic.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := topic.Warm(ctx); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("Warm after Shutdown: got %v, want FailedPrecondition", err)
+	}
+
+	// Warm does nothing for topics that cannot be warmed.
+	topic = pubsub.NewTopic(&driverTopic{}, nil)
+	defer topic.Shutdown(ctx)
+	if err := topic.Warm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if h := topic.Health(); !h.LastWarm.IsZero() {
+		t.Errorf("got health %+v, want no warmups", h)
+	}
+}
+
+func TestKeepWarm(t *testing.T) {
+	ctx := context.Background()
+	dt := &warmingTopic{}
+	topic := pubsub.NewTopic(dt, nil)
+	const interval = 10 * time.Millisecond
+	topic.KeepWarm(interval)
+	topic.KeepWarm(interval) // no effect
+	deadline := time.Now().Add(5 * time.Second)
+	for dt.numWarms() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d warmups, want at least 2", dt.numWarms())
+		}
+		time.Sleep(interval)
+	}
+	if err := topic.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// No warmups happen after Shutdown.
+	n := dt.numWarms()
+	time.Sleep(5 * interval)
+	if got := dt.numWarms(); got != n {
+		t.Errorf("got %d warmups after Shutdown, want none", got-n)
+	}
+}
+
 func TestCancelReceive(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	ds := NewDriverSub()
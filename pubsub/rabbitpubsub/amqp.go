@@ -56,8 +56,9 @@ type amqpChannel interface {
 	NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
 	NotifyReturn(chan amqp.Return) chan amqp.Return
 	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	Confirm() error
 	ExchangeDeclare(string) error
-	QueueDeclareAndBind(qname, ename string) error
+	QueueDeclareAndBind(qname, ename string, opts *QueueOptions) error
 	ExchangeDelete(string) error
 	QueueDelete(qname string) error
 }
@@ -67,16 +68,14 @@ type connection struct {
 	conn *amqp.Connection
 }
 
-// Channel creates a new channel. We always want the channel in confirm mode (where
-// confirmations are delivered for each publish), so we do that here as well.
+// Channel creates a new channel. Topics put the channel in confirm mode (where
+// confirmations are delivered for each publish) unless TopicOptions.NoConfirm
+// is set.
 func (c *connection) Channel() (amqpChannel, error) {
 	ch, err := c.conn.Channel()
 	if err != nil {
 		return nil, err
 	}
-	if err := ch.Confirm(wait); err != nil {
-		return nil, err
-	}
 	return &channel{ch}, nil
 }
 
@@ -144,17 +143,24 @@ func (ch *channel) ExchangeDeclare(name string) error {
 		nil) // args
 }
 
-// QueueDeclareAndBind declares a queue and binds it to an exchange.
-func (ch *channel) QueueDeclareAndBind(queueName, exchangeName string) error {
+// QueueDeclareAndBind declares a queue and binds it to an exchange. If
+// exchangeName is empty, the queue is not bound.
+func (ch *channel) QueueDeclareAndBind(queueName, exchangeName string, opts *QueueOptions) error {
+	if opts == nil {
+		opts = &QueueOptions{}
+	}
 	q, err := ch.ch.QueueDeclare(queueName,
-		false, // durable
+		opts.durable(),
 		false, // delete when unused
 		false, // exclusive
 		wait,
-		nil) // args
+		opts.args())
 	if err != nil {
 		return err
 	}
+	if exchangeName == "" {
+		return nil
+	}
 	return ch.ch.QueueBind(q.Name, q.Name, exchangeName, wait, nil)
 }
 
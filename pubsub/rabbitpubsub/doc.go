@@ -42,6 +42,12 @@
 // See https://godoc.org/gocloud.dev/pubsub#hdr-At_most_once_and_At_least_once_Delivery
 // for more background.
 //
+// Warming
+//
+// A topic opens its AMQP channel when it first sends messages, and opens a new
+// one if the channel is closed. Topic.Warm opens the channel ahead of time, and
+// Topic.KeepWarm replaces it while the topic is idle if it has been closed.
+//
 // As
 //
 // rabbitpubsub exposes the following types for As:
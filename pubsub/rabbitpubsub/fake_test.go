@@ -129,26 +129,31 @@ func (ch *fakeChannel) ExchangeDeclare(name string) error {
 	return nil
 }
 
-// QueueDeclareAndBind binds a queue to the given exchange.
-// The exchange must exist.
-// If the queue doesn't exist, it's created.
-func (ch *fakeChannel) QueueDeclareAndBind(queueName, exchangeName string) error {
+// QueueDeclareAndBind binds a queue to the given exchange, if exchangeName is
+// not empty. The exchange must exist.
+// If the queue doesn't exist, it's created. The options are ignored.
+func (ch *fakeChannel) QueueDeclareAndBind(queueName, exchangeName string, opts *QueueOptions) error {
 	if ch.isClosed() {
 		return amqp.ErrClosed
 	}
 	ch.conn.mu.Lock()
 	defer ch.conn.mu.Unlock()
 
-	ex, err := ch.getExchange(exchangeName)
-	if err != nil {
-		return err
+	var ex *exchange
+	if exchangeName != "" {
+		var err error
+		if ex, err = ch.getExchange(exchangeName); err != nil {
+			return err
+		}
 	}
 	if _, ok := ch.conn.queues[queueName]; ok {
 		return nil
 	}
 	q := &queue{pendingAck: map[uint64]amqp.Delivery{}}
 	ch.conn.queues[queueName] = q
-	ex.queues = append(ex.queues, q)
+	if ex != nil {
+		ex.queues = append(ex.queues, q)
+	}
 	return nil
 }
 
@@ -188,6 +193,7 @@ func (ch *fakeChannel) Publish(exchangeName string, pub amqp.Publishing) error {
 		del := amqp.Delivery{
 			Headers:     pub.Headers,
 			Body:        pub.Body,
+			Priority:    pub.Priority,
 			DeliveryTag: ch.deliveryTag,
 			// We don't care about the other fields.
 		}
@@ -326,6 +332,15 @@ func (ch *fakeChannel) Cancel(consumerName string) error {
 	return nil
 }
 
+// Confirm puts the channel in confirm mode. The fake always confirms publishes
+// to channels registered with NotifyPublish.
+func (ch *fakeChannel) Confirm() error {
+	if ch.isClosed() {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
 // NotifyPublish remembers its argument channel so it can be notified for every
 // published message. It returns its argument.
 func (ch *fakeChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
@@ -21,6 +21,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -86,10 +87,23 @@ const Scheme = "rabbit"
 // topics or "rabbit://myqueue" for subscriptions.
 //
 // For topics, the URL's host+path is used as the exchange name.
+// The following query parameters are supported for topics:
+//
+//   - confirm: if "false", sets TopicOptions.NoConfirm.
+//   - confirm_timeout: sets TopicOptions.ConfirmTimeout, parsed with
+//     time.ParseDuration (for example, "5s").
 //
 // For subscriptions, the URL's host+path is used as the queue name.
+// If any of the following query parameters are set, the subscription declares
+// its queue with the corresponding QueueOptions:
+//
+//   - queue_type: sets QueueOptions.Type, "classic" or "quorum".
+//   - max_priority: sets QueueOptions.MaxPriority.
+//   - durable: if "true", sets QueueOptions.Durable.
+//   - exchange: sets QueueOptions.Exchange.
 //
-// No query parameters are supported.
+// For example, "rabbit://myqueue?queue_type=quorum&exchange=myexchange" declares
+// the quorum queue "myqueue" bound to the exchange "myexchange".
 type URLOpener struct {
 	// Connection to use for communication with the server.
 	Connection *amqp.Connection
@@ -102,25 +116,89 @@ type URLOpener struct {
 
 // OpenTopicURL opens a pubsub.Topic based on u.
 func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
-	for param := range u.Query() {
-		return nil, fmt.Errorf("open topic %v: invalid query parameter %q", u, param)
+	opts := o.TopicOptions
+	if err := setTopicOptionsFromURL(u.Query(), &opts); err != nil {
+		return nil, fmt.Errorf("open topic %v: %v", u, err)
 	}
 	exchangeName := path.Join(u.Host, u.Path)
-	return OpenTopic(o.Connection, exchangeName, &o.TopicOptions), nil
+	return OpenTopic(o.Connection, exchangeName, &opts), nil
 }
 
 // OpenSubscriptionURL opens a pubsub.Subscription based on u.
 func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsub.Subscription, error) {
-	for param := range u.Query() {
-		return nil, fmt.Errorf("open subscription %v: invalid query parameter %q", u, param)
+	opts := o.SubscriptionOptions
+	if err := setSubscriptionOptionsFromURL(u.Query(), &opts); err != nil {
+		return nil, fmt.Errorf("open subscription %v: %v", u, err)
 	}
 	queueName := path.Join(u.Host, u.Path)
-	return OpenSubscription(o.Connection, queueName, &o.SubscriptionOptions), nil
+	return OpenSubscription(o.Connection, queueName, &opts), nil
+}
+
+func setTopicOptionsFromURL(q url.Values, opts *TopicOptions) error {
+	for param, vals := range q {
+		v := vals[0]
+		switch param {
+		case "confirm":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for query parameter %q: %v", v, param, err)
+			}
+			opts.NoConfirm = !b
+		case "confirm_timeout":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for query parameter %q: %v", v, param, err)
+			}
+			opts.ConfirmTimeout = d
+		default:
+			return fmt.Errorf("invalid query parameter %q", param)
+		}
+	}
+	return nil
+}
+
+func setSubscriptionOptionsFromURL(q url.Values, opts *SubscriptionOptions) error {
+	if len(q) == 0 {
+		return nil
+	}
+	qopts := QueueOptions{}
+	if opts.Queue != nil {
+		qopts = *opts.Queue
+	}
+	for param, vals := range q {
+		v := vals[0]
+		switch param {
+		case "queue_type":
+			if v != QueueTypeClassic && v != QueueTypeQuorum {
+				return fmt.Errorf("invalid value %q for query parameter %q: want %q or %q", v, param, QueueTypeClassic, QueueTypeQuorum)
+			}
+			qopts.Type = v
+		case "max_priority":
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for query parameter %q: %v", v, param, err)
+			}
+			qopts.MaxPriority = int(n)
+		case "durable":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for query parameter %q: %v", v, param, err)
+			}
+			qopts.Durable = b
+		case "exchange":
+			qopts.Exchange = v
+		default:
+			return fmt.Errorf("invalid query parameter %q", param)
+		}
+	}
+	opts.Queue = &qopts
+	return nil
 }
 
 type topic struct {
 	exchange string // the AMQP exchange
 	conn     amqpConnection
+	opts     TopicOptions
 
 	mu     sync.Mutex
 	ch     amqpChannel              // AMQP channel used for all communication.
@@ -131,11 +209,79 @@ type topic struct {
 
 // TopicOptions sets options for constructing a *pubsub.Topic backed by
 // RabbitMQ.
-type TopicOptions struct{}
+type TopicOptions struct {
+	// NoConfirm disables publisher confirms. By default, the topic puts its
+	// AMQP channel in confirm mode, and SendBatch waits until the server has
+	// confirmed every message. With NoConfirm, SendBatch returns once the
+	// messages have been written to the connection; publishing is faster, but
+	// messages may be lost and unroutable messages are not reported.
+	NoConfirm bool
+
+	// ConfirmTimeout, if positive, limits how long SendBatch waits for the
+	// server to confirm the messages of a batch. SendBatch returns
+	// context.DeadlineExceeded if the confirmations don't arrive in time.
+	ConfirmTimeout time.Duration
+}
 
 // SubscriptionOptions sets options for constructing a *pubsub.Subscription
 // backed by RabbitMQ.
-type SubscriptionOptions struct{}
+type SubscriptionOptions struct {
+	// Queue, if non-nil, makes the subscription declare its queue with these
+	// options when it connects, instead of expecting the queue to exist. If the
+	// queue already exists, the options must match the ones it was declared
+	// with.
+	Queue *QueueOptions
+}
+
+// Queue types for QueueOptions.Type.
+// See https://www.rabbitmq.com/quorum-queues.html.
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+)
+
+// QueueOptions describes a queue declared by a subscription.
+type QueueOptions struct {
+	// Type is the type of the queue, QueueTypeClassic or QueueTypeQuorum.
+	// If empty, the server's default type is used.
+	Type string
+
+	// MaxPriority, if positive, makes the queue deliver messages with a higher
+	// priority first, for priorities up to MaxPriority (at most 255). Set the
+	// priority of a message with the PriorityKey metadata key.
+	MaxPriority int
+
+	// Durable makes the queue survive a server restart. Quorum queues are
+	// always durable.
+	Durable bool
+
+	// Exchange, if non-empty, is the exchange the queue is bound to.
+	Exchange string
+}
+
+func (o *QueueOptions) durable() bool {
+	return o.Durable || o.Type == QueueTypeQuorum
+}
+
+func (o *QueueOptions) args() amqp.Table {
+	args := amqp.Table{}
+	if o.Type != "" {
+		args["x-queue-type"] = o.Type
+	}
+	if o.MaxPriority > 0 {
+		args["x-max-priority"] = int32(o.MaxPriority)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// PriorityKey is the message metadata key for the priority of a message,
+// a number from 0 to 255. Messages are delivered by priority only from
+// queues declared with a maximum priority. The key is not sent as an AMQP
+// header; received messages carry it if they have a non-zero priority.
+const PriorityKey = "rabbitpubsub-priority"
 
 // OpenTopic returns a *pubsub.Topic corresponding to the named exchange.
 // See the package documentation for an example.
@@ -152,13 +298,17 @@ type SubscriptionOptions struct{}
 // The documentation of the amqp package recommends using separate connections for
 // publishing and subscribing.
 func OpenTopic(conn *amqp.Connection, name string, opts *TopicOptions) *pubsub.Topic {
-	return pubsub.NewTopic(newTopic(&connection{conn}, name), nil)
+	return pubsub.NewTopic(newTopic(&connection{conn}, name, opts), nil)
 }
 
-func newTopic(conn amqpConnection, name string) *topic {
+func newTopic(conn amqpConnection, name string, opts *TopicOptions) *topic {
+	if opts == nil {
+		opts = &TopicOptions{}
+	}
 	return &topic{
 		conn:     conn,
 		exchange: name,
+		opts:     *opts,
 	}
 }
 
@@ -181,10 +331,13 @@ func (t *topic) establishChannel(ctx context.Context) error {
 	}
 	var ch amqpChannel
 	err := runWithContext(ctx, func() error {
-		// Create a new channel in confirm mode.
+		// Create a new channel, in confirm mode unless confirms are disabled.
 		var err error
 		ch, err = t.conn.Channel()
-		return err
+		if err != nil || t.opts.NoConfirm {
+			return err
+		}
+		return ch.Confirm()
 	})
 	if err != nil {
 		return err
@@ -193,13 +346,25 @@ func (t *topic) establishChannel(ctx context.Context) error {
 	// Get Go channels which will hold acks and returns from the server. The server
 	// will send an ack for each published message to confirm that it was received.
 	// It will return undeliverable messages.
+	// Without confirms, nothing would read those channels, so don't ask for them;
+	// the amqp package blocks when a notification channel is full.
 	// All the Notify methods return their arg.
-	t.pubc = ch.NotifyPublish(make(chan amqp.Confirmation))
-	t.retc = ch.NotifyReturn(make(chan amqp.Return))
+	if !t.opts.NoConfirm {
+		t.pubc = ch.NotifyPublish(make(chan amqp.Confirmation))
+		t.retc = ch.NotifyReturn(make(chan amqp.Return))
+	}
 	t.closec = ch.NotifyClose(make(chan *amqp.Error, 1)) // closec will get at most one element
 	return nil
 }
 
+// Warm implements driver.Warmer. It opens the topic's AMQP channel if it has
+// not been opened, or has been closed.
+func (t *topic) Warm(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.establishChannel(ctx)
+}
+
 // Run f while checking to see if ctx is done.
 // Return the error from f if it completes, or ctx.Err() if ctx is done.
 func runWithContext(ctx context.Context, f func() error) error {
@@ -225,6 +390,22 @@ func (t *topic) SendBatch(ctx context.Context, ms []*driver.Message) error {
 		return err
 	}
 
+	pubs := make([]amqp.Publishing, len(ms))
+	for i, m := range ms {
+		pub, err := toPublishing(m)
+		if err != nil {
+			return err
+		}
+		pubs[i] = pub
+	}
+	if t.opts.NoConfirm {
+		if err := t.publish(ms, pubs, t.ch); err != nil {
+			t.ch = nil // an AMQP channel is broken after error
+			return err
+		}
+		return nil
+	}
+
 	// Receive from Go channels concurrently or we will deadlock with the Publish
 	// RPC. (The amqp package docs recommend setting the capacity of the Go channel
 	// to the number of messages to be published, but we can't do that because we
@@ -232,6 +413,9 @@ func (t *topic) SendBatch(ctx context.Context, ms []*driver.Message) error {
 	// up.)
 	errc := make(chan error, 1)
 	cctx, cancel := context.WithCancel(ctx)
+	if t.opts.ConfirmTimeout > 0 {
+		cctx, cancel = context.WithTimeout(ctx, t.opts.ConfirmTimeout)
+	}
 	defer cancel()
 	ch := t.ch // Avoid touching t.ch while goroutine is running.
 	go func() {
@@ -240,33 +424,17 @@ func (t *topic) SendBatch(ctx context.Context, ms []*driver.Message) error {
 		errc <- t.receiveFromPublishChannels(cctx, len(ms))
 	}()
 
-	var perr error
-	for _, m := range ms {
-		pub := toPublishing(m)
-		if m.BeforeSend != nil {
-			asFunc := func(i interface{}) bool {
-				if p, ok := i.(**amqp.Publishing); ok {
-					*p = &pub
-					return true
-				}
-				return false
-			}
-			if err := m.BeforeSend(asFunc); err != nil {
-				return err
-			}
-		}
-		if perr = ch.Publish(t.exchange, pub); perr != nil {
-			cancel()
-			break
-		}
+	perr := t.publish(ms, pubs, ch)
+	if perr != nil {
+		cancel()
 	}
 	// Wait for the goroutine to finish.
 	err := <-errc
 	// If we got an error from Publish, prefer that.
 	if perr != nil {
 		// Set t.ch to nil because an AMQP channel is broken after error.
-		// Do this here, after the goroutine has finished, rather than in the Publish loop
-		// above, to avoid a race condition.
+		// Do this here, after the goroutine has finished, rather than in publish,
+		// to avoid a race condition.
 		t.ch = nil
 		err = perr
 	}
@@ -278,6 +446,30 @@ func (t *topic) SendBatch(ctx context.Context, ms []*driver.Message) error {
 	return err
 }
 
+// publish publishes pubs, the AMQP messages for ms, on ch. It stops at the
+// first error.
+func (t *topic) publish(ms []*driver.Message, pubs []amqp.Publishing, ch amqpChannel) error {
+	for i, m := range ms {
+		pub := &pubs[i]
+		if m.BeforeSend != nil {
+			asFunc := func(i interface{}) bool {
+				if p, ok := i.(**amqp.Publishing); ok {
+					*p = pub
+					return true
+				}
+				return false
+			}
+			if err := m.BeforeSend(asFunc); err != nil {
+				return err
+			}
+		}
+		if err := ch.Publish(t.exchange, *pub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Read from the channels established with NotifyPublish and NotifyReturn.
 // Must be called with t.mu held.
 func (t *topic) receiveFromPublishChannels(ctx context.Context, nMessages int) error {
@@ -376,15 +568,25 @@ func closeErr(closec <-chan *amqp.Error) error {
 }
 
 // toPublishing converts a driver.Message to an amqp.Publishing.
-func toPublishing(m *driver.Message) amqp.Publishing {
+func toPublishing(m *driver.Message) (amqp.Publishing, error) {
 	h := amqp.Table{}
+	var priority uint8
 	for k, v := range m.Metadata {
+		if k == PriorityKey {
+			p, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return amqp.Publishing{}, fmt.Errorf("rabbitpubsub: invalid message priority %q: want a number from 0 to 255", v)
+			}
+			priority = uint8(p)
+			continue
+		}
 		h[k] = v
 	}
 	return amqp.Publishing{
-		Headers: h,
-		Body:    m.Body,
-	}
+		Headers:  h,
+		Body:     m.Body,
+		Priority: priority,
+	}, nil
 }
 
 // IsRetryable implements driver.Topic.IsRetryable.
@@ -492,7 +694,7 @@ func (*topic) Close() error { return nil }
 // See the package documentation for an example.
 //
 // The queue must have been previously created (for instance, by using
-// amqp.Channel.QueueDeclare) and bound to an exchange.
+// amqp.Channel.QueueDeclare) and bound to an exchange, unless opts.Queue is set.
 //
 // OpenSubscription uses the supplied amqp.Connection for all communication. It is
 // the caller's responsibility to establish this connection before calling
@@ -502,13 +704,14 @@ func (*topic) Close() error { return nil }
 // The documentation of the amqp package recommends using separate connections for
 // publishing and subscribing.
 func OpenSubscription(conn *amqp.Connection, name string, opts *SubscriptionOptions) *pubsub.Subscription {
-	return pubsub.NewSubscription(newSubscription(&connection{conn}, name), nil, nil)
+	return pubsub.NewSubscription(newSubscription(&connection{conn}, name, opts), nil, nil)
 }
 
 type subscription struct {
 	conn     amqpConnection
 	queue    string // the AMQP queue name
 	consumer string // the client-generated name for this particular subscriber
+	opts     SubscriptionOptions
 
 	mu     sync.Mutex
 	ch     amqpChannel // AMQP channel used for all communication.
@@ -520,11 +723,15 @@ type subscription struct {
 
 var nextConsumer int64 // atomic
 
-func newSubscription(conn amqpConnection, name string) *subscription {
+func newSubscription(conn amqpConnection, name string, opts *SubscriptionOptions) *subscription {
+	if opts == nil {
+		opts = &SubscriptionOptions{}
+	}
 	return &subscription{
 		conn:             conn,
 		queue:            name,
 		consumer:         fmt.Sprintf("c%d", atomic.AddInt64(&nextConsumer, 1)),
+		opts:             *opts,
 		receiveBatchHook: func() {},
 	}
 }
@@ -551,6 +758,11 @@ func (s *subscription) establishChannel(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
+		if q := s.opts.Queue; q != nil {
+			if err := ch.QueueDeclareAndBind(s.queue, q.Exchange, q); err != nil {
+				return err
+			}
+		}
 		// Subscribe to messages from the queue.
 		s.delc, err = ch.Consume(s.queue, s.consumer)
 		return err
@@ -626,6 +838,9 @@ func toMessage(d amqp.Delivery) *driver.Message {
 	for k, v := range d.Headers {
 		md[k] = fmt.Sprint(v)
 	}
+	if d.Priority != 0 {
+		md[PriorityKey] = strconv.Itoa(int(d.Priority))
+	}
 	return &driver.Message{
 		Body:     d.Body,
 		AckID:    d.DeliveryTag,
@@ -23,7 +23,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -119,11 +121,11 @@ func (h *harness) CreateTopic(_ context.Context, testName string) (dt driver.Top
 		}
 		ch.ExchangeDelete(exchange)
 	}
-	return newTopic(h.conn, exchange), cleanup, nil
+	return newTopic(h.conn, exchange, nil), cleanup, nil
 }
 
 func (h *harness) MakeNonexistentTopic(context.Context) (driver.Topic, error) {
-	return newTopic(h.conn, "nonexistent-topic"), nil
+	return newTopic(h.conn, "nonexistent-topic", nil), nil
 }
 
 func (h *harness) CreateSubscription(_ context.Context, dt driver.Topic, testName string) (ds driver.Subscription, cleanup func(), err error) {
@@ -138,12 +140,12 @@ func (h *harness) CreateSubscription(_ context.Context, dt driver.Topic, testNam
 		}
 		ch.QueueDelete(queue)
 	}
-	ds = newSubscription(h.conn, queue)
+	ds = newSubscription(h.conn, queue, nil)
 	return ds, cleanup, nil
 }
 
 func (h *harness) MakeNonexistentSubscription(_ context.Context) (driver.Subscription, error) {
-	return newSubscription(h.conn, "nonexistent-subscription"), nil
+	return newSubscription(h.conn, "nonexistent-subscription", nil), nil
 }
 
 func (h *harness) Close() {
@@ -164,7 +166,7 @@ func TestUnroutable(t *testing.T) {
 	if err := declareExchange(conn, "u"); err != nil {
 		t.Fatal(err)
 	}
-	topic := newTopic(conn, "u")
+	topic := newTopic(conn, "u", nil)
 	msgs := []*driver.Message{
 		{Body: []byte("")},
 		{Body: []byte("")},
@@ -189,6 +191,128 @@ func TestUnroutable(t *testing.T) {
 	}
 }
 
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+	conn := newFakeConnection()
+	topic := newTopic(conn, "w", nil)
+	if err := topic.Warm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ch := topic.ch
+	if ch == nil {
+		t.Fatal("Warm did not open a channel")
+	}
+	if err := topic.Warm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if topic.ch != ch {
+		t.Error("Warm replaced an open channel")
+	}
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := topic.Warm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if topic.ch == ch {
+		t.Error("Warm did not replace a closed channel")
+	}
+}
+
+func TestQueueOptionsAndPriority(t *testing.T) {
+	ctx := context.Background()
+	conn := newFakeConnection()
+	defer conn.Close()
+
+	if err := declareExchange(conn, "p"); err != nil {
+		t.Fatal(err)
+	}
+	// The subscription declares its queue and binds it to the exchange.
+	sub := newSubscription(conn, "pq", &SubscriptionOptions{
+		Queue: &QueueOptions{Type: QueueTypeQuorum, MaxPriority: 10, Exchange: "p"},
+	})
+	if _, err := sub.ReceiveBatch(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	topic := newTopic(conn, "p", &TopicOptions{NoConfirm: true})
+	md := map[string]string{"a": "b", PriorityKey: "7"}
+	if err := topic.SendBatch(ctx, []*driver.Message{{Body: []byte("x"), Metadata: md}}); err != nil {
+		t.Fatal(err)
+	}
+	var got []*driver.Message
+	for len(got) == 0 {
+		ms, err := sub.ReceiveBatch(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = ms
+	}
+	if !reflect.DeepEqual(got[0].Metadata, md) {
+		t.Errorf("got metadata %v, want %v", got[0].Metadata, md)
+	}
+
+	err := topic.SendBatch(ctx, []*driver.Message{{Metadata: map[string]string{PriorityKey: "high"}}})
+	if err == nil {
+		t.Error("invalid priority: got nil error, want error")
+	}
+}
+
+func TestOptionsFromURL(t *testing.T) {
+	for _, test := range []struct {
+		query   string
+		want    TopicOptions
+		wantErr bool
+	}{
+		{"", TopicOptions{}, false},
+		{"confirm=false", TopicOptions{NoConfirm: true}, false},
+		{"confirm=true&confirm_timeout=5s", TopicOptions{ConfirmTimeout: 5 * time.Second}, false},
+		{"confirm=maybe", TopicOptions{}, true},
+		{"confirm_timeout=5", TopicOptions{}, true},
+		{"queue_type=quorum", TopicOptions{}, true},
+	} {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got TopicOptions
+		err = setTopicOptionsFromURL(q, &got)
+		if (err != nil) != test.wantErr {
+			t.Errorf("topic %q: got error %v, want error %v", test.query, err, test.wantErr)
+		}
+		if err == nil && got != test.want {
+			t.Errorf("topic %q: got %+v, want %+v", test.query, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		query   string
+		want    *QueueOptions
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"queue_type=quorum&exchange=e", &QueueOptions{Type: QueueTypeQuorum, Exchange: "e"}, false},
+		{"max_priority=10&durable=true", &QueueOptions{MaxPriority: 10, Durable: true}, false},
+		{"queue_type=stream", nil, true},
+		{"max_priority=256", nil, true},
+		{"durable=maybe", nil, true},
+		{"confirm=false", nil, true},
+	} {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got SubscriptionOptions
+		err = setSubscriptionOptionsFromURL(q, &got)
+		if (err != nil) != test.wantErr {
+			t.Errorf("subscription %q: got error %v, want error %v", test.query, err, test.wantErr)
+		}
+		if err == nil && !reflect.DeepEqual(got.Queue, test.want) {
+			t.Errorf("subscription %q: got %+v, want %+v", test.query, got.Queue, test.want)
+		}
+	}
+}
+
 func TestErrorCode(t *testing.T) {
 	for _, test := range []struct {
 		in   error
@@ -272,7 +396,7 @@ func bindQueue(conn amqpConnection, queueName, exchangeName string) error {
 		return err
 	}
 	defer ch.Close()
-	return ch.QueueDeclareAndBind(queueName, exchangeName)
+	return ch.QueueDeclareAndBind(queueName, exchangeName, nil)
 }
 
 type rabbitAsTest struct {
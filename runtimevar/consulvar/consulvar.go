@@ -0,0 +1,456 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consulvar provides a runtimevar implementation with variables
+// backed by keys in Consul's KV store. Use OpenVariable to construct a
+// *runtimevar.Variable.
+//
+// consulvar watches a key with Consul's blocking queries: a request for the
+// key waits on the server until the key changes, so changes are seen almost
+// as soon as they are made, without polling.
+//
+// URLs
+//
+// For runtimevar.OpenVariable, consulvar registers for the scheme "consul".
+// The default URL opener connects to the agent at the address in the
+// environment variable "CONSUL_HTTP_ADDR", or at "127.0.0.1:8500" if it is
+// not set, with the ACL token in the environment variable
+// "CONSUL_HTTP_TOKEN", if it is set.
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://gocloud.dev/concepts/urls/ for background information.
+//
+// As
+//
+// consulvar exposes the following types for As:
+//  - Snapshot: *KVPair
+//  - Error: *RequestError
+package consulvar // import "gocloud.dev/runtimevar/consulvar"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/driver"
+)
+
+func init() {
+	runtimevar.DefaultURLMux().RegisterVariable(Scheme, &defaultOpener{})
+}
+
+// Scheme is the URL scheme consulvar registers its URLOpener under on runtimevar.DefaultMux.
+const Scheme = "consul"
+
+// defaultOpener creates a URLOpener from the environment for each call, so
+// that changes to the environment take effect.
+type defaultOpener struct{}
+
+func (*defaultOpener) OpenVariableURL(ctx context.Context, u *url.URL) (*runtimevar.Variable, error) {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:8500"
+	}
+	o := &URLOpener{Address: addr, Options: Options{Token: os.Getenv("CONSUL_HTTP_TOKEN")}}
+	return o.OpenVariableURL(ctx, u)
+}
+
+// URLOpener opens Consul URLs like "consul://myapp/config?decoder=string".
+//
+// The host+path is used as the key.
+//
+// The following URL parameters are supported:
+//   - decoder: The decoder to use. Defaults to runtimevar.BytesDecoder.
+//       See runtimevar.DecoderByName for supported values.
+//   - dc: The datacenter to read the key from. Defaults to the agent's.
+//   - wait: The longest time a blocking query waits for a change, parsed by
+//       time.ParseDuration. Defaults to Options.WaitTime.
+// The ACL token is not a URL parameter, so that it does not leak into logs;
+// set it in Options.
+type URLOpener struct {
+	// Address is the address of the Consul agent, like "127.0.0.1:8500" or
+	// "https://consul.example.com". The scheme defaults to "http".
+	Address string
+
+	// Decoder specifies the decoder to use if one is not specified in the URL.
+	// Defaults to runtimevar.BytesDecoder.
+	Decoder *runtimevar.Decoder
+
+	// Options specifies the options to pass to OpenVariable.
+	Options Options
+}
+
+// OpenVariableURL opens a consulvar Variable for u.
+func (o *URLOpener) OpenVariableURL(ctx context.Context, u *url.URL) (*runtimevar.Variable, error) {
+	q := u.Query()
+
+	decoderName := q.Get("decoder")
+	q.Del("decoder")
+	decoder, err := runtimevar.DecoderByName(ctx, decoderName, o.Decoder)
+	if err != nil {
+		return nil, fmt.Errorf("open variable %v: invalid decoder: %v", u, err)
+	}
+	opts := o.Options
+	if dc := q.Get("dc"); dc != "" {
+		opts.Datacenter = dc
+	}
+	q.Del("dc")
+	if wait := q.Get("wait"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil {
+			return nil, fmt.Errorf("open variable %v: invalid wait %q: %v", u, wait, err)
+		}
+		opts.WaitTime = d
+	}
+	q.Del("wait")
+	for param := range q {
+		return nil, fmt.Errorf("open variable %v: invalid query parameter %q", u, param)
+	}
+	return OpenVariable(o.Address, path.Join(u.Host, u.Path), decoder, &opts)
+}
+
+// Options sets options.
+type Options struct {
+	// Token is the ACL token sent with each request. If empty, the agent's
+	// default token is used.
+	Token string
+
+	// Datacenter is the datacenter to read the key from. If empty, the
+	// agent's datacenter is used.
+	Datacenter string
+
+	// WaitTime is the longest time a blocking query waits for the key to
+	// change before Consul responds with its current value; consulvar then
+	// queries again. Consul limits it to 10 minutes. Defaults to 5 minutes.
+	WaitTime time.Duration
+
+	// ErrorWaitTime is how long consulvar waits after a failed request
+	// before trying again. Defaults to driver.DefaultWaitDuration.
+	ErrorWaitTime time.Duration
+
+	// Client is the HTTP client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// defaultWaitTime is the default for Options.WaitTime.
+const defaultWaitTime = 5 * time.Minute
+
+// OpenVariable constructs a *runtimevar.Variable that watches key on the
+// Consul agent at addr, like "127.0.0.1:8500".
+// Consul stores raw bytes; provide a decoder to decode the raw bytes into
+// the appropriate type for runtimevar.Snapshot.Value.
+// See the runtimevar package documentation for examples of decoders.
+func OpenVariable(addr, key string, decoder *runtimevar.Decoder, opts *Options) (*runtimevar.Variable, error) {
+	w, err := newWatcher(addr, key, decoder, opts)
+	if err != nil {
+		return nil, err
+	}
+	return runtimevar.New(w), nil
+}
+
+func newWatcher(addr, key string, decoder *runtimevar.Decoder, opts *Options) (*watcher, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("consulvar: invalid address %q: %v", addr, err)
+	}
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return nil, errors.New("consulvar: empty key")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/kv/" + key
+	q := url.Values{}
+	if opts.Datacenter != "" {
+		q.Set("dc", opts.Datacenter)
+	}
+	u.RawQuery = q.Encode()
+	w := &watcher{
+		endpoint: u,
+		decoder:  decoder,
+		token:    opts.Token,
+		wait:     opts.WaitTime,
+		errWait:  driver.WaitDuration(opts.ErrorWaitTime),
+		client:   opts.Client,
+	}
+	if w.wait <= 0 {
+		w.wait = defaultWaitTime
+	}
+	if w.client == nil {
+		w.client = http.DefaultClient
+	}
+	return w, nil
+}
+
+// KVPair is an entry of Consul's KV store, as returned by its HTTP API.
+type KVPair struct {
+	Key         string
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Flags       uint64
+	Value       []byte
+	Session     string
+}
+
+// RequestError is an error response from Consul.
+type RequestError struct {
+	StatusCode int
+	// Message is the body of the response.
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("consulvar: received status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("consulvar: received status code %d: %s", e.StatusCode, e.Message)
+}
+
+// errNotExist is a sentinel error for nonexistent variables.
+var errNotExist = errors.New("variable does not exist")
+
+// state implements driver.State.
+type state struct {
+	val        interface{}
+	raw        *KVPair
+	updateTime time.Time
+	err        error
+}
+
+// Value implements driver.State.Value.
+func (s *state) Value() (interface{}, error) {
+	return s.val, s.err
+}
+
+// UpdateTime implements driver.State.UpdateTime.
+func (s *state) UpdateTime() time.Time {
+	return s.updateTime
+}
+
+// As implements driver.State.As.
+func (s *state) As(i interface{}) bool {
+	if s.raw == nil {
+		return false
+	}
+	p, ok := i.(**KVPair)
+	if !ok {
+		return false
+	}
+	*p = s.raw
+	return true
+}
+
+// errorState returns a new State with err, unless prevS also represents
+// the same error, in which case it returns nil.
+func errorState(err error, prevS driver.State) driver.State {
+	s := &state{err: err}
+	if prevS == nil {
+		return s
+	}
+	prev := prevS.(*state)
+	if prev.err == nil {
+		// New error.
+		return s
+	}
+	if equivalentError(err, prev.err) {
+		// Same error, return nil to indicate no change.
+		return nil
+	}
+	return s
+}
+
+// equivalentError returns true if err1 and err2 represent an equivalent error;
+// i.e., we don't want to return it to the user as a different error.
+func equivalentError(err1, err2 error) bool {
+	if err1 == err2 || err1.Error() == err2.Error() {
+		return true
+	}
+	var code1, code2 int
+	if e, ok := err1.(*RequestError); ok {
+		code1 = e.StatusCode
+	}
+	if e, ok := err2.(*RequestError); ok {
+		code2 = e.StatusCode
+	}
+	return code1 != 0 && code1 == code2
+}
+
+// watcher implements driver.Watcher.
+type watcher struct {
+	endpoint *url.URL
+	decoder  *runtimevar.Decoder
+	token    string
+	wait     time.Duration
+	errWait  time.Duration
+	client   *http.Client
+
+	// index is the X-Consul-Index of the last response. It is only used by
+	// WatchVariable, which is never called concurrently.
+	index uint64
+}
+
+// WatchVariable implements driver.WatchVariable.
+func (w *watcher) WatchVariable(ctx context.Context, prev driver.State) (driver.State, time.Duration) {
+	for {
+		// Block only if there is a value to wait for a change from.
+		var index uint64
+		if prev != nil {
+			index = w.index
+		}
+		kv, err := w.get(ctx, index)
+		if ctx.Err() != nil {
+			return &state{err: ctx.Err()}, 0
+		}
+		if err != nil && err != errNotExist {
+			if s := errorState(err, prev); s != nil {
+				return s, w.errWait
+			}
+			return nil, w.errWait
+		}
+		var s driver.State
+		if err == errNotExist {
+			s = errorState(err, prev)
+		} else if p, _ := prev.(*state); p == nil || p.raw == nil || p.raw.ModifyIndex != kv.ModifyIndex {
+			val, err := w.decoder.Decode(ctx, kv.Value)
+			if err != nil {
+				s = errorState(err, prev)
+			} else {
+				s = &state{val: val, raw: kv, updateTime: time.Now()}
+			}
+		}
+		if s != nil {
+			return s, 0
+		}
+		// Nothing changed; block until something does.
+	}
+}
+
+// get reads the key. If index is not zero, it is a blocking query that
+// returns when the key's index passes index, or after w.wait. It returns
+// errNotExist if the key does not exist.
+func (w *watcher) get(ctx context.Context, index uint64) (*KVPair, error) {
+	u := *w.endpoint
+	if index > 0 {
+		q := u.Query()
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", strconv.FormatInt(int64(w.wait/time.Millisecond), 10)+"ms")
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if w.token != "" {
+		req.Header.Set("X-Consul-Token", w.token)
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, &RequestError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	w.updateIndex(resp.Header.Get("X-Consul-Index"))
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotExist
+	}
+	var kvs []*KVPair
+	if err := json.Unmarshal(body, &kvs); err != nil {
+		return nil, fmt.Errorf("consulvar: decoding response: %v", err)
+	}
+	if len(kvs) != 1 {
+		return nil, fmt.Errorf("consulvar: got %d entries for key, want 1", len(kvs))
+	}
+	return kvs[0], nil
+}
+
+// updateIndex sets w.index from the X-Consul-Index header h, following
+// Consul's advice for blocking queries: an index that goes backwards, as it
+// can after a snapshot restore, restarts the blocking from the current value,
+// and the index is never zero.
+func (w *watcher) updateIndex(h string) {
+	index, err := strconv.ParseUint(h, 10, 64)
+	if err != nil {
+		// No index; don't block on the next query.
+		w.index = 0
+		return
+	}
+	if index < w.index {
+		index = 0
+	}
+	if index == 0 {
+		index = 1
+	}
+	w.index = index
+}
+
+// Close implements driver.Close.
+func (w *watcher) Close() error {
+	return nil
+}
+
+// ErrorAs implements driver.ErrorAs.
+func (w *watcher) ErrorAs(err error, i interface{}) bool {
+	if e, ok := err.(*RequestError); ok {
+		if p, ok := i.(**RequestError); ok {
+			*p = e
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorCode implements driver.ErrorCode.
+func (*watcher) ErrorCode(err error) gcerrors.ErrorCode {
+	if err == errNotExist {
+		return gcerrors.NotFound
+	}
+	if e, ok := err.(*RequestError); ok {
+		switch e.StatusCode {
+		case http.StatusBadRequest:
+			return gcerr.InvalidArgument
+		case http.StatusNotFound:
+			return gcerr.NotFound
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return gcerr.PermissionDenied
+		case http.StatusTooManyRequests:
+			return gcerr.ResourceExhausted
+		case http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusBadGateway:
+			return gcerr.Internal
+		}
+	}
+	return gcerr.Unknown
+}
@@ -0,0 +1,360 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consulvar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/driver"
+	"gocloud.dev/runtimevar/drivertest"
+)
+
+// fakeConsul serves the KV endpoint of Consul's HTTP API, including blocking
+// queries.
+type fakeConsul struct {
+	token string // the required ACL token, if not empty
+
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every change
+	index   uint64
+	kvs     map[string]*KVPair
+	queries int // the number of requests served
+}
+
+func newFakeConsul(token string) (*fakeConsul, *httptest.Server) {
+	f := &fakeConsul{token: token, changed: make(chan struct{}), index: 1, kvs: map[string]*KVPair{}}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeConsul) put(key string, val []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	kv := f.kvs[key]
+	if kv == nil {
+		kv = &KVPair{Key: key, CreateIndex: f.index}
+		f.kvs[key] = kv
+	}
+	kv.Value = val
+	kv.ModifyIndex = f.index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) delete(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	delete(f.kvs, key)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/kv/") || r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.token != "" && r.Header.Get("X-Consul-Token") != f.token {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	f.mu.Lock()
+	f.queries++
+	if index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); index > 0 {
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil {
+			f.mu.Unlock()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout := time.After(wait)
+		for f.index <= index {
+			ch := f.changed
+			f.mu.Unlock()
+			select {
+			case <-ch:
+			case <-timeout:
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+			if ch == f.changed {
+				break // timed out
+			}
+		}
+	}
+	defer f.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	kv := f.kvs[key]
+	if kv == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode([]*KVPair{kv})
+}
+
+type harness struct {
+	fake *fakeConsul
+	srv  *httptest.Server
+}
+
+func newHarness(t *testing.T) (drivertest.Harness, error) {
+	fake, srv := newFakeConsul("secret")
+	return &harness{fake: fake, srv: srv}, nil
+}
+
+func (h *harness) MakeWatcher(ctx context.Context, name string, decoder *runtimevar.Decoder) (driver.Watcher, error) {
+	return newWatcher(h.srv.URL, name, decoder, &Options{Token: "secret", ErrorWaitTime: time.Millisecond})
+}
+
+func (h *harness) CreateVariable(ctx context.Context, name string, val []byte) error {
+	h.fake.put(name, val)
+	return nil
+}
+
+func (h *harness) UpdateVariable(ctx context.Context, name string, val []byte) error {
+	h.fake.put(name, val)
+	return nil
+}
+
+func (h *harness) DeleteVariable(ctx context.Context, name string) error {
+	h.fake.delete(name)
+	return nil
+}
+
+func (h *harness) Close() { h.srv.Close() }
+
+func (h *harness) Mutable() bool { return true }
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, []drivertest.AsTest{verifyAs{}})
+}
+
+type verifyAs struct{}
+
+func (verifyAs) Name() string {
+	return "verify As"
+}
+
+func (verifyAs) SnapshotCheck(s *runtimevar.Snapshot) error {
+	var kv *KVPair
+	if !s.As(&kv) {
+		return errors.New("Snapshot.As failed")
+	}
+	if kv.ModifyIndex == 0 {
+		return errors.New("Snapshot.As returned a KVPair without a ModifyIndex")
+	}
+	return nil
+}
+
+func (verifyAs) ErrorCheck(v *runtimevar.Variable, err error) error {
+	var e *RequestError
+	if v.ErrorAs(errors.New("example error"), &e) {
+		return errors.New("ErrorAs was expected to fail")
+	}
+	if !v.ErrorAs(&RequestError{StatusCode: http.StatusForbidden}, &e) {
+		return errors.New("ErrorAs expected to succeed with *consulvar.RequestError")
+	}
+	return nil
+}
+
+// consulvar-specific tests.
+
+func TestBlockingQuery(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeConsul("")
+	defer srv.Close()
+	fake.put("app/config", []byte("one"))
+	v, err := OpenVariable(srv.URL, "app/config", runtimevar.StringDecoder, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	snap, err := v.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Value != "one" {
+		t.Fatalf("got %v, want %q", snap.Value, "one")
+	}
+
+	// Changes to other keys wake the blocking query up, but are not reported.
+	fake.put("other", []byte("x"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		fake.put("app/config", []byte("two"))
+	}()
+	start := time.Now()
+	snap, err = v.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Value != "two" {
+		t.Errorf("got %v, want %q", snap.Value, "two")
+	}
+	// The default wait time is minutes, so only a blocking query sees the
+	// change this quickly.
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("saw the change after %v", d)
+	}
+	fake.mu.Lock()
+	queries := fake.queries
+	fake.mu.Unlock()
+	if queries > 4 {
+		t.Errorf("got %d queries, want at most 4", queries)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeConsul("")
+	defer srv.Close()
+	fake.put("k", []byte("v"))
+	w, err := newWatcher(srv.URL, "k", runtimevar.StringDecoder, &Options{WaitTime: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := w.WatchVariable(ctx, nil)
+	if _, err := s.Value(); err != nil {
+		t.Fatal(err)
+	}
+	// The blocking queries time out without a change, and are made again.
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	s2, _ := w.WatchVariable(tctx, s)
+	if _, err := s2.Value(); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.queries < 3 {
+		t.Errorf("got %d queries, want several", fake.queries)
+	}
+}
+
+func TestToken(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeConsul("secret")
+	defer srv.Close()
+	fake.put("k", []byte("v"))
+	v, err := OpenVariable(srv.URL, "k", runtimevar.StringDecoder, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	_, err = v.Watch(ctx)
+	if gcerrors.Code(err) != gcerrors.PermissionDenied {
+		t.Errorf("without a token: got %v, want PermissionDenied", err)
+	}
+	var e *RequestError
+	if !v.ErrorAs(err, &e) || e.StatusCode != http.StatusForbidden || e.Message != "Permission denied" {
+		t.Errorf("got %+v, want the 403 response", e)
+	}
+
+	v2, err := OpenVariable(srv.URL, "k", runtimevar.StringDecoder, &Options{Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	if snap, err := v2.Watch(ctx); err != nil || snap.Value != "v" {
+		t.Errorf("with a token: got %v, %v; want %q", snap.Value, err, "v")
+	}
+}
+
+func TestUpdateIndex(t *testing.T) {
+	w := &watcher{}
+	for _, test := range []struct {
+		header string
+		want   uint64
+	}{
+		{"10", 10},
+		{"12", 12},
+		{"5", 1}, // went backwards: reset
+		{"0", 1},
+		{"", 0},
+	} {
+		w.updateIndex(test.header)
+		if w.index != test.want {
+			t.Errorf("after %q: got index %d, want %d", test.header, w.index, test.want)
+		}
+	}
+}
+
+func TestOpenVariableURL(t *testing.T) {
+	_, srv := newFakeConsul("")
+	defer srv.Close()
+	ctx := context.Background()
+	mux := new(runtimevar.URLMux)
+	mux.RegisterVariable(Scheme, &URLOpener{Address: srv.URL})
+	tests := []struct {
+		URL     string
+		WantErr bool
+	}{
+		{"consul://app/config", false},
+		{"consul://app/config?decoder=string", false},
+		{"consul://app/config?dc=dc2&wait=30s", false},
+		// Invalid decoder.
+		{"consul://app/config?decoder=notadecoder", true},
+		// Invalid wait.
+		{"consul://app/config?wait=soon", true},
+		// Invalid parameter.
+		{"consul://app/config?param=value", true},
+		// The token is not a parameter.
+		{"consul://app/config?token=secret", true},
+		// No key.
+		{"consul://", true},
+	}
+	for _, test := range tests {
+		v, err := mux.OpenVariable(ctx, test.URL)
+		if (err != nil) != test.WantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.WantErr)
+		}
+		if v != nil {
+			v.Close()
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	w := &watcher{}
+	for _, test := range []struct {
+		err  error
+		want gcerrors.ErrorCode
+	}{
+		{errNotExist, gcerrors.NotFound},
+		{&RequestError{StatusCode: http.StatusForbidden}, gcerrors.PermissionDenied},
+		{&RequestError{StatusCode: http.StatusBadRequest}, gcerrors.InvalidArgument},
+		{&RequestError{StatusCode: http.StatusTooManyRequests}, gcerrors.ResourceExhausted},
+		{&RequestError{StatusCode: http.StatusInternalServerError}, gcerrors.Internal},
+		{errors.New("other"), gcerrors.Unknown},
+	} {
+		if got := w.ErrorCode(test.err); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package featureflag evaluates simple feature flags stored in a
+// runtimevar.Variable, so that flags can be changed at runtime without
+// adopting a separate flag service.
+//
+// The variable holds a JSON object mapping flag names to Flags, like
+//
+//   {
+//     "new-ui": {
+//       "enabled": true,
+//       "audiences": [
+//         {"match": {"plan": ["beta"]}},
+//         {"match": {"country": ["NZ", "AU"]}, "percentage": 10}
+//       ]
+//     }
+//   }
+//
+// Open it with Decoder, for example:
+//
+//   v, err := filevar.OpenVariable("/etc/flags.json", featureflag.Decoder, nil)
+//
+// A flag is on for a Subject when it is enabled, the subject matches one of
+// the flag's audiences, and the subject falls within that audience's rollout
+// percentage. Subjects are placed in a rollout by hashing their key with the
+// flag's name, so a subject stays in or out of a rollout as long as its
+// percentage does not shrink, and different flags roll out to different
+// subjects.
+package featureflag // import "gocloud.dev/runtimevar/featureflag"
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"gocloud.dev/runtimevar"
+)
+
+// Config is the value of a feature flag variable: a map from flag names to
+// flags.
+type Config map[string]Flag
+
+// Decoder decodes a JSON feature flag variable into a Config.
+var Decoder = runtimevar.NewDecoder(Config{}, runtimevar.JSONDecode)
+
+// A Flag describes who a feature is on for.
+type Flag struct {
+	// Enabled must be true for the flag to be on for anyone.
+	Enabled bool `json:"enabled"`
+
+	// Audiences lists the groups of subjects the flag is on for. If it is
+	// empty, an enabled flag is on for every subject.
+	Audiences []Audience `json:"audiences,omitempty"`
+}
+
+// An Audience is a group of subjects, chosen by their attributes, and a
+// percentage of them that a flag is rolled out to.
+type Audience struct {
+	// Match maps attribute names to allowed values. A subject matches if, for
+	// every attribute in Match, the subject's value for it is one of the allowed
+	// values. An empty Match matches every subject.
+	Match map[string][]string `json:"match,omitempty"`
+
+	// Percentage is the percentage, from 0 to 100, of the matching subjects
+	// that the flag is on for. If it is nil, the flag is on for all of them.
+	Percentage *float64 `json:"percentage,omitempty"`
+}
+
+// A Subject is the user, request, host or other entity a flag is evaluated for.
+type Subject struct {
+	// Key identifies the subject for percentage rollouts, for example a user ID.
+	Key string
+
+	// Attributes are matched against audiences.
+	Attributes map[string]string
+}
+
+// Flags evaluates the feature flags held in a variable.
+type Flags struct {
+	v *runtimevar.Variable
+}
+
+// New returns a Flags that evaluates the flags in v. v must have been opened
+// with Decoder. New does not take ownership of v; the caller must still close
+// it.
+func New(v *runtimevar.Variable) *Flags {
+	return &Flags{v: v}
+}
+
+// Enabled reports whether the flag named name is on for s, according to the
+// latest value of the variable. A flag that is not in the variable is off.
+//
+// Enabled blocks until the variable has a value, or ctx is done; see
+// runtimevar.Variable.Latest.
+func (f *Flags) Enabled(ctx context.Context, name string, s Subject) (bool, error) {
+	snap, err := f.v.Latest(ctx)
+	if err != nil {
+		return false, err
+	}
+	cfg, ok := snap.Value.(Config)
+	if !ok {
+		return false, fmt.Errorf("featureflag: variable holds a %T, not a Config; open it with featureflag.Decoder", snap.Value)
+	}
+	return cfg.Enabled(name, s), nil
+}
+
+// Enabled reports whether the flag named name is on for s.
+func (c Config) Enabled(name string, s Subject) bool {
+	fl, ok := c[name]
+	if !ok {
+		return false
+	}
+	return fl.on(name, s)
+}
+
+// on reports whether fl, whose name is name, is on for s.
+func (fl Flag) on(name string, s Subject) bool {
+	if !fl.Enabled {
+		return false
+	}
+	if len(fl.Audiences) == 0 {
+		return true
+	}
+	for _, a := range fl.Audiences {
+		if a.matches(s) && (a.Percentage == nil || bucket(name, s.Key) < *a.Percentage) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether s belongs to the audience.
+func (a Audience) matches(s Subject) bool {
+	for attr, allowed := range a.Match {
+		v, ok := s.Attributes[attr]
+		if !ok || !contains(allowed, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(vals []string, v string) bool {
+	for _, x := range vals {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// bucket places key in [0, 100) for the rollout of the flag named name. The
+// result is uniformly distributed and the same in every process.
+func bucket(name, key string) float64 {
+	h := sha256.Sum256([]byte(name + "\x00" + key))
+	return float64(binary.BigEndian.Uint64(h[:8])>>11) / (1 << 53) * 100
+}
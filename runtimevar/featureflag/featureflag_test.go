@@ -0,0 +1,119 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package featureflag
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+const testConfig = `{
+  "off": {"enabled": false},
+  "everyone": {"enabled": true},
+  "beta": {
+    "enabled": true,
+    "audiences": [
+      {"match": {"plan": ["beta", "internal"]}},
+      {"match": {"country": ["NZ"], "plan": ["free"]}, "percentage": 0}
+    ]
+  },
+  "half": {"enabled": true, "audiences": [{"percentage": 50}]},
+  "none": {"enabled": true, "audiences": [{"percentage": 0}]},
+  "all": {"enabled": true, "audiences": [{"percentage": 100}]}
+}`
+
+func TestEnabled(t *testing.T) {
+	ctx := context.Background()
+	v := constantvar.NewBytes([]byte(testConfig), Decoder)
+	defer v.Close()
+	f := New(v)
+
+	for _, test := range []struct {
+		flag  string
+		attrs map[string]string
+		want  bool
+	}{
+		{"off", nil, false},
+		{"everyone", nil, true},
+		{"missing", nil, false},
+		{"beta", map[string]string{"plan": "beta"}, true},
+		{"beta", map[string]string{"plan": "internal", "country": "NZ"}, true},
+		{"beta", map[string]string{"plan": "free"}, false},
+		{"beta", map[string]string{"plan": "free", "country": "NZ"}, false},
+		{"beta", nil, false},
+		{"none", nil, false},
+		{"all", nil, true},
+	} {
+		got, err := f.Enabled(ctx, test.flag, Subject{Key: "user", Attributes: test.attrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s, %v: got %t, want %t", test.flag, test.attrs, got, test.want)
+		}
+	}
+}
+
+func TestPercentage(t *testing.T) {
+	ctx := context.Background()
+	v := constantvar.NewBytes([]byte(testConfig), Decoder)
+	defer v.Close()
+	f := New(v)
+
+	const n = 10000
+	on := 0
+	for i := 0; i < n; i++ {
+		s := Subject{Key: strconv.Itoa(i)}
+		got, err := f.Enabled(ctx, "half", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Evaluation is deterministic.
+		if again, _ := f.Enabled(ctx, "half", s); again != got {
+			t.Fatalf("key %s: got %t, then %t", s.Key, got, again)
+		}
+		if got {
+			on++
+		}
+	}
+	if on < n*45/100 || on > n*55/100 {
+		t.Errorf("flag on for %d of %d subjects, want about half", on, n)
+	}
+}
+
+func TestBucketVariesByFlag(t *testing.T) {
+	// The same keys should fall in different buckets for different flags.
+	same := 0
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		if (bucket("a", k) < 50) == (bucket("b", k) < 50) {
+			same++
+		}
+	}
+	if same > 75 {
+		t.Errorf("%d of 100 keys in the same half for both flags", same)
+	}
+}
+
+func TestWrongDecoder(t *testing.T) {
+	v := constantvar.New("not a config")
+	defer v.Close()
+	if _, err := New(v).Enabled(context.Background(), "everyone", Subject{}); err == nil {
+		t.Error("got nil error, want error for a variable not holding a Config")
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package refvar provides a runtimevar implementation with Variables whose
+// values may refer to other variables, in any backend, by their URLs. Use
+// OpenVariable to construct a *runtimevar.Variable.
+//
+// A reference has the form ${ref:URL}, as in
+// "${ref:awsparamstore://myapp/db-host?region=us-east-2&decoder=string}". The
+// value of the variable is its raw value with each reference replaced by the
+// value of the variable the URL names, which may have references of its own.
+// The result is decoded with the Decoder passed to OpenVariable. The raw values
+// of the variable and of those it refers to must be strings or byte slices, so
+// the URLs should use the "string" or "bytes" decoder, which is the default for
+// most providers. A URL cannot contain "}", and there is no way to escape
+// "${ref:" in a value.
+//
+// refvar watches every variable that the value refers to, directly or not, and
+// updates the value when any of them changes. A variable that refers to itself,
+// directly or not, has an error for which gcerrors.Code returns
+// gcerrors.InvalidArgument. A variable that refers to one with an error has an
+// error with the same code.
+//
+// As
+//
+// refvar does not support any types for As.
+package refvar // import "gocloud.dev/runtimevar/refvar"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/driver"
+)
+
+// refPattern matches a reference, with the URL as its first submatch.
+var refPattern = regexp.MustCompile(`\$\{ref:([^}]*)\}`)
+
+// Options sets options.
+type Options struct {
+	// URLMux opens the variable and the variables it refers to.
+	// Defaults to runtimevar.DefaultURLMux().
+	URLMux *runtimevar.URLMux
+}
+
+// OpenVariable constructs a *runtimevar.Variable whose value is the value of
+// the variable at urlstr, with its references replaced, decoded by decoder.
+// The variable at urlstr is opened immediately, and the ones it refers to when
+// their references are first seen.
+func OpenVariable(ctx context.Context, urlstr string, decoder *runtimevar.Decoder, opts *Options) (*runtimevar.Variable, error) {
+	if decoder == nil {
+		return nil, fmt.Errorf("refvar: decoder is required")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	mux := opts.URLMux
+	if mux == nil {
+		mux = runtimevar.DefaultURLMux()
+	}
+	w := newWatcher(mux, urlstr, decoder)
+	if _, err := w.open(ctx, urlstr); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return runtimevar.New(w), nil
+}
+
+// A node is a variable that the value depends on.
+type node struct {
+	v     *runtimevar.Variable
+	ready chan struct{} // closed when the first snapshot or error arrives
+
+	// Protected by watcher.mu.
+	snap runtimevar.Snapshot
+	err  error
+}
+
+type watcher struct {
+	mux     *runtimevar.URLMux
+	root    string
+	decoder *runtimevar.Decoder
+
+	changed chan struct{} // signaled when a node gets a new snapshot or error
+	ctx     context.Context
+	cancel  func()
+	wg      sync.WaitGroup
+
+	mu    sync.Mutex
+	nodes map[string]*node // by URL
+}
+
+func newWatcher(mux *runtimevar.URLMux, root string, decoder *runtimevar.Decoder) *watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &watcher{
+		mux:     mux,
+		root:    root,
+		decoder: decoder,
+		changed: make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		nodes:   map[string]*node{},
+	}
+}
+
+// open returns the node for urlstr, opening its variable and starting to watch
+// it if it is not open already.
+func (w *watcher) open(ctx context.Context, urlstr string) (*node, error) {
+	w.mu.Lock()
+	n := w.nodes[urlstr]
+	w.mu.Unlock()
+	if n != nil {
+		return n, nil
+	}
+	v, err := w.mux.OpenVariable(ctx, urlstr)
+	if err != nil {
+		return nil, err
+	}
+	n = &node{v: v, ready: make(chan struct{})}
+	w.mu.Lock()
+	w.nodes[urlstr] = n
+	w.mu.Unlock()
+	w.wg.Add(1)
+	go w.watch(n)
+	return n, nil
+}
+
+// watch records each new snapshot or error of n's variable until it is closed.
+func (w *watcher) watch(n *node) {
+	defer w.wg.Done()
+	for first := true; ; first = false {
+		snap, err := n.v.Watch(w.ctx)
+		if err == runtimevar.ErrClosed || w.ctx.Err() != nil {
+			return
+		}
+		w.mu.Lock()
+		n.snap, n.err = snap, err
+		w.mu.Unlock()
+		if first {
+			close(n.ready)
+		}
+		select {
+		case w.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// state implements driver.State.
+type state struct {
+	val        interface{}
+	raw        []byte
+	updateTime time.Time
+	err        error
+}
+
+func (s *state) Value() (interface{}, error) { return s.val, s.err }
+func (s *state) UpdateTime() time.Time       { return s.updateTime }
+func (s *state) As(i interface{}) bool       { return false }
+
+// WatchVariable implements driver.WatchVariable.
+func (w *watcher) WatchVariable(ctx context.Context, prev driver.State) (driver.State, time.Duration) {
+	if prev != nil {
+		select {
+		case <-w.changed:
+		case <-ctx.Done():
+			return nil, 0
+		}
+	}
+	used := map[string]bool{}
+	raw, updateTime, err := w.expand(ctx, w.root, nil, used)
+	if ctx.Err() != nil {
+		return nil, 0
+	}
+	if err == nil {
+		// Stop watching the variables that the value no longer refers to.
+		w.closeUnused(used)
+	}
+	s := &state{raw: raw, updateTime: updateTime, err: err}
+	if err == nil {
+		s.val, s.err = w.decoder.Decode(ctx, raw)
+	}
+	if prev != nil && sameState(prev.(*state), s) {
+		return nil, 0
+	}
+	return s, 0
+}
+
+// sameState reports whether s1 and s2 have the same raw value, or errors with
+// the same text.
+func sameState(s1, s2 *state) bool {
+	if s1.err != nil || s2.err != nil {
+		return s1.err != nil && s2.err != nil && s1.err.Error() == s2.err.Error()
+	}
+	return bytes.Equal(s1.raw, s2.raw)
+}
+
+// expand returns the value of the variable at urlstr with its references
+// replaced, and the latest update time of the variables involved. path holds
+// the URLs of the variables that refer to it, in order, and used collects the
+// URLs of all the variables involved.
+func (w *watcher) expand(ctx context.Context, urlstr string, path []string, used map[string]bool) ([]byte, time.Time, error) {
+	for i, u := range path {
+		if u == urlstr {
+			cycle := strings.Join(path[i:], " -> ")
+			return nil, time.Time{}, gcerr.Newf(gcerr.InvalidArgument, nil, "refvar: reference cycle: %s -> %s", cycle, urlstr)
+		}
+	}
+	used[urlstr] = true
+	n, err := w.open(ctx, urlstr)
+	if err != nil {
+		return nil, time.Time{}, refError(urlstr, err)
+	}
+	select {
+	case <-n.ready:
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+	w.mu.Lock()
+	snap, err := n.snap, n.err
+	w.mu.Unlock()
+	if err != nil {
+		return nil, time.Time{}, refError(urlstr, err)
+	}
+	var raw []byte
+	switch v := snap.Value.(type) {
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return nil, time.Time{}, gcerr.Newf(gcerr.InvalidArgument, nil, "refvar: value of %s is a %T, want string or []byte", urlstr, snap.Value)
+	}
+
+	updateTime := snap.UpdateTime
+	path = append(path, urlstr)
+	var expandErr error
+	out := refPattern.ReplaceAllFunc(raw, func(ref []byte) []byte {
+		if expandErr != nil {
+			return nil
+		}
+		u := string(refPattern.FindSubmatch(ref)[1])
+		b, t, err := w.expand(ctx, u, path, used)
+		if err != nil {
+			expandErr = err
+			return nil
+		}
+		if t.After(updateTime) {
+			updateTime = t
+		}
+		return b
+	})
+	if expandErr != nil {
+		return nil, time.Time{}, expandErr
+	}
+	return out, updateTime, nil
+}
+
+// refError returns the error of the variable that the value refers to at
+// urlstr.
+func refError(urlstr string, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	code := gcerrors.Code(err)
+	if code == gcerrors.Unknown {
+		code = gcerrors.InvalidArgument
+	}
+	return gcerr.Newf(code, err, "refvar: %s", urlstr)
+}
+
+// closeUnused closes the variables whose URLs are not in used.
+func (w *watcher) closeUnused(used map[string]bool) {
+	w.mu.Lock()
+	var unused []*node
+	for u, n := range w.nodes {
+		if !used[u] {
+			unused = append(unused, n)
+			delete(w.nodes, u)
+		}
+	}
+	w.mu.Unlock()
+	for _, n := range unused {
+		n.v.Close()
+	}
+}
+
+// Close implements driver.Close.
+func (w *watcher) Close() error {
+	w.cancel()
+	w.closeUnused(nil)
+	w.wg.Wait()
+	return nil
+}
+
+// ErrorAs implements driver.ErrorAs.
+func (w *watcher) ErrorAs(err error, i interface{}) bool { return false }
+
+// ErrorCode implements driver.ErrorCode.
+func (*watcher) ErrorCode(err error) gcerrors.ErrorCode {
+	return gcerrors.Code(err)
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refvar
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/constantvar"
+	"gocloud.dev/runtimevar/driver"
+)
+
+// fakeVars holds variables, opened with URLs like "test://name", whose values
+// tests can change.
+type fakeVars struct {
+	mu   sync.Mutex
+	vars map[string]*fakeVar
+}
+
+func newMux() (*runtimevar.URLMux, *fakeVars) {
+	fv := &fakeVars{vars: map[string]*fakeVar{}}
+	mux := new(runtimevar.URLMux)
+	mux.RegisterVariable("test", fv)
+	mux.RegisterVariable(constantvar.Scheme, &constantvar.URLOpener{})
+	return mux, fv
+}
+
+// get returns the variable with the given name, creating it if needed.
+func (fv *fakeVars) get(name string) *fakeVar {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	v := fv.vars[name]
+	if v == nil {
+		v = &fakeVar{changed: make(chan struct{}), err: gcerr.Newf(gcerr.NotFound, nil, "%s not found", name)}
+		fv.vars[name] = v
+	}
+	return v
+}
+
+func (fv *fakeVars) OpenVariableURL(ctx context.Context, u *url.URL) (*runtimevar.Variable, error) {
+	v := fv.get(u.Host)
+	v.mu.Lock()
+	v.opened++
+	v.mu.Unlock()
+	return runtimevar.New(v), nil
+}
+
+type fakeVar struct {
+	mu      sync.Mutex
+	val     string
+	err     error
+	changed chan struct{} // closed and replaced on every change
+	opened  int
+	closed  int
+}
+
+func (v *fakeVar) set(val string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.val, v.err = val, nil
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+func (v *fakeVar) open() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.opened - v.closed
+}
+
+type fakeState struct {
+	val string
+	err error
+}
+
+func (s *fakeState) Value() (interface{}, error) { return s.val, s.err }
+func (s *fakeState) UpdateTime() time.Time       { return time.Time{} }
+func (s *fakeState) As(interface{}) bool         { return false }
+
+func (v *fakeVar) WatchVariable(ctx context.Context, prev driver.State) (driver.State, time.Duration) {
+	v.mu.Lock()
+	changed := v.changed
+	v.mu.Unlock()
+	if prev != nil {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, 0
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return &fakeState{v.val, v.err}, 0
+}
+
+func (v *fakeVar) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.closed++
+	return nil
+}
+
+func (*fakeVar) ErrorAs(error, interface{}) bool { return false }
+
+func (*fakeVar) ErrorCode(err error) gcerrors.ErrorCode { return gcerrors.Code(err) }
+
+func TestOpenVariable(t *testing.T) {
+	ctx := context.Background()
+	mux, fv := newMux()
+	fv.get("db-host").set("db.example.com")
+	fv.get("db-port").set("5432")
+	fv.get("db").set("${ref:test://db-host}:${ref:test://db-port}")
+	fv.get("config").set(`{"db": "${ref:test://db}", "replica": "${ref:test://db}", "name": "${ref:constant://?val=app}"}`)
+
+	v, err := OpenVariable(ctx, "test://config", runtimevar.StringDecoder, &Options{URLMux: mux})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	snap, err := v.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"db": "db.example.com:5432", "replica": "db.example.com:5432", "name": "app"}`
+	if snap.Value != want {
+		t.Errorf("got %q, want %q", snap.Value, want)
+	}
+	// Each variable is watched once, however often it is referred to.
+	if n := fv.get("db").open(); n != 1 {
+		t.Errorf("db is open %d times, want 1", n)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	mux, fv := newMux()
+	fv.get("a").set("a")
+	fv.get("b").set("b")
+	root := fv.get("root")
+	root.set("${ref:test://a}+${ref:test://b}")
+
+	v, err := OpenVariable(ctx, "test://root", runtimevar.StringDecoder, &Options{URLMux: mux})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	watch := func(want string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		snap, err := v.Watch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snap.Value != want {
+			t.Errorf("got %q, want %q", snap.Value, want)
+		}
+	}
+	watch("a+b")
+
+	// A change to a referenced variable changes the value.
+	fv.get("b").set("B")
+	watch("a+B")
+
+	// A variable that is no longer referred to is no longer watched.
+	root.set("${ref:test://a}")
+	watch("a")
+	if n := fv.get("b").open(); n != 0 {
+		t.Errorf("b is open %d times, want 0", n)
+	}
+	fv.get("a").set("A")
+	watch("A")
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	mux, fv := newMux()
+	fv.get("self").set("${ref:test://self}")
+	fv.get("a").set("${ref:test://b}")
+	fv.get("b").set("x${ref:test://a}")
+	fv.get("missing-ref").set("${ref:test://missing}")
+	fv.get("bad-scheme").set("${ref:bad://x}")
+	fv.get("not-text").set("${ref:constant://?val=x&decoder=jsonmap}")
+
+	for _, test := range []struct {
+		name string
+		want gcerrors.ErrorCode
+	}{
+		{"self", gcerrors.InvalidArgument},
+		{"a", gcerrors.InvalidArgument},
+		{"missing-ref", gcerrors.NotFound},
+		{"bad-scheme", gcerrors.InvalidArgument},
+		{"not-text", gcerrors.InvalidArgument},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := OpenVariable(ctx, "test://"+test.name, runtimevar.StringDecoder, &Options{URLMux: mux})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+			_, err = v.Watch(ctx)
+			if got := gcerrors.Code(err); got != test.want {
+				t.Errorf("got error %v with code %v, want %v", err, got, test.want)
+			}
+		})
+	}
+
+	// Errors opening the variable itself are returned from OpenVariable.
+	if _, err := OpenVariable(ctx, "test://x", nil, &Options{URLMux: mux}); err == nil {
+		t.Error("got nil error with a nil decoder, want error")
+	}
+	if _, err := OpenVariable(ctx, "bad://x", runtimevar.StringDecoder, &Options{URLMux: mux}); err == nil {
+		t.Error("got nil error with an unregistered scheme, want error")
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	ctx := context.Background()
+	mux, fv := newMux()
+	fv.get("root").set("not JSON")
+	var m map[string]interface{}
+	decoder := runtimevar.NewDecoder(m, runtimevar.JSONDecode)
+	v, err := OpenVariable(ctx, "test://root", decoder, &Options{URLMux: mux})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if _, err := v.Watch(ctx); err == nil {
+		t.Error("got nil error, want a decoding error")
+	}
+}
@@ -41,6 +41,10 @@
 // Alternatively, you can construct a *Variable via a URL and OpenVariable.
 // See https://gocloud.dev/concepts/urls/ for more information.
 //
+// Applications that open the same variable in many components can use
+// OpenSharedVariable instead, so that the components share a single watch of
+// the provider.
+//
 //
 // OpenCensus Integration
 //
@@ -370,6 +374,9 @@ type VariableURLOpener interface {
 // The zero value is a multiplexer with no registered schemes.
 type URLMux struct {
 	schemes openurl.SchemeMap
+
+	sharedMu sync.Mutex
+	shared   map[string]*sharedVar // by URL; see OpenSharedVariable
 }
 
 // VariableSchemes returns a sorted slice of the registered Variable schemes.
@@ -534,6 +534,125 @@ func (o *fakeOpener) OpenVariableURL(ctx context.Context, u *url.URL) (*Variable
 	return nil, nil
 }
 
+// sharedOpener opens Variables with fakeWatchers, recording them.
+type sharedOpener struct {
+	mu       sync.Mutex
+	watchers []*closeWatcher
+}
+
+// closeWatcher is a fakeWatcher that records whether it has been closed.
+type closeWatcher struct {
+	fakeWatcher
+	closed bool // protected by fakeWatcher.mu
+}
+
+func (w *closeWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+func (w *closeWatcher) isClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closed
+}
+
+func (o *sharedOpener) OpenVariableURL(ctx context.Context, u *url.URL) (*Variable, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w := &closeWatcher{}
+	o.watchers = append(o.watchers, w)
+	return New(w), nil
+}
+
+func (o *sharedOpener) opened() []*closeWatcher {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*closeWatcher(nil), o.watchers...)
+}
+
+func TestOpenSharedVariable(t *testing.T) {
+	ctx := context.Background()
+	mux := new(URLMux)
+	opener := &sharedOpener{}
+	mux.RegisterVariable("foo", opener)
+
+	open := func(url string) *Variable {
+		t.Helper()
+		v, err := mux.OpenSharedVariable(ctx, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	watch := func(v *Variable) (Snapshot, error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		return v.Watch(ctx)
+	}
+
+	v1 := open("foo://myvar")
+	v2 := open("foo://myvar")
+	v3 := open("foo://othervar")
+	if got := len(opener.opened()); got != 2 {
+		t.Fatalf("opened %d variables, want 2", got)
+	}
+	src := opener.opened()[0]
+
+	// A value is passed on to all the shared Variables.
+	src.Set(&state{val: "a"})
+	for _, v := range []*Variable{v1, v2} {
+		if snap, err := watch(v); err != nil || snap.Value != "a" {
+			t.Fatalf("got %v, %v, want a", snap.Value, err)
+		}
+	}
+	// A Variable opened later gets the current value without a new provider
+	// call.
+	v4 := open("foo://myvar")
+	if snap, err := watch(v4); err != nil || snap.Value != "a" {
+		t.Fatalf("got %v, %v, want a", snap.Value, err)
+	}
+	// So is an error, which keeps its code.
+	src.Set(&state{err: errFake})
+	for _, v := range []*Variable{v1, v2, v4} {
+		if _, err := watch(v); gcerrors.Code(err) != gcerrors.Internal {
+			t.Fatalf("got error %v, want code Internal", err)
+		}
+	}
+
+	// The provider's Variable is closed with the last shared Variable.
+	for _, v := range []*Variable{v1, v2} {
+		if err := v.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if src.isClosed() {
+			t.Fatal("provider's Variable closed while still shared")
+		}
+	}
+	if err := v4.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !src.isClosed() {
+		t.Error("provider's Variable not closed after the last shared Variable was")
+	}
+	if opener.opened()[1].isClosed() {
+		t.Error("Variable for another URL closed")
+	}
+	if err := v3.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the URL again opens a new Variable.
+	v5 := open("foo://myvar")
+	defer v5.Close()
+	if got := len(opener.opened()); got != 3 {
+		t.Errorf("opened %d variables, want 3", got)
+	}
+}
+
 func TestDecoder(t *testing.T) {
 	type Struct struct {
 		FieldA string
@@ -0,0 +1,187 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimevar
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/runtimevar/driver"
+)
+
+// OpenSharedVariable is like OpenVariable, but Variables opened with the same
+// URL share a single Variable opened by the provider. Only that Variable
+// reads from the provider, and it passes each new value or error on to the
+// shared Variables, which cuts the number of provider calls for applications
+// that open the same variable in many components.
+//
+// The Snapshot values of the shared Variables are the same, not copies, so
+// they must not be modified.
+//
+// Each shared Variable must be closed. The Variable opened by the provider is
+// closed when the last of them is.
+//
+// OpenSharedVariable is safe to call from multiple goroutines.
+func (mux *URLMux) OpenSharedVariable(ctx context.Context, urlstr string) (*Variable, error) {
+	opener, u, err := mux.schemes.FromString("Variable", urlstr)
+	if err != nil {
+		return nil, err
+	}
+	key := u.String()
+	mux.sharedMu.Lock()
+	defer mux.sharedMu.Unlock()
+	s := mux.shared[key]
+	if s == nil {
+		src, err := opener.(VariableURLOpener).OpenVariableURL(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		s = newSharedVar(mux, key, src)
+		if mux.shared == nil {
+			mux.shared = map[string]*sharedVar{}
+		}
+		mux.shared[key] = s
+	}
+	s.refs++
+	return newVar(&sharedWatcher{s: s}), nil
+}
+
+// OpenSharedVariable opens the variable identified by the URL given, sharing
+// it with the other Variables opened with OpenSharedVariable and the same URL.
+// See URLMux.OpenSharedVariable for details.
+func OpenSharedVariable(ctx context.Context, urlstr string) (*Variable, error) {
+	return defaultURLMux.OpenSharedVariable(ctx, urlstr)
+}
+
+// A sharedVar fans out the snapshots of a Variable to sharedWatchers.
+type sharedVar struct {
+	mux  *URLMux
+	key  string
+	src  *Variable
+	refs int // the number of open sharedWatchers; protected by mux.sharedMu
+	done chan struct{}
+
+	mu      sync.Mutex
+	state   *sharedState  // nil until src has a value or error
+	changed chan struct{} // closed when state changes, and replaced
+}
+
+func newSharedVar(mux *URLMux, key string, src *Variable) *sharedVar {
+	s := &sharedVar{
+		mux:     mux,
+		key:     key,
+		src:     src,
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// run watches src until it is closed.
+func (s *sharedVar) run() {
+	defer close(s.done)
+	for {
+		snap, err := s.src.Watch(context.Background())
+		if err == ErrClosed {
+			return
+		}
+		s.mu.Lock()
+		s.state = &sharedState{snap: snap, err: unwrapError(err)}
+		close(s.changed)
+		s.changed = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
+
+// current returns the current state, and a channel that is closed when it
+// changes.
+func (s *sharedVar) current() (*sharedState, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.changed
+}
+
+// release closes src if no sharedWatcher uses it any more.
+func (s *sharedVar) release() error {
+	s.mux.sharedMu.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		delete(s.mux.shared, s.key)
+	}
+	s.mux.sharedMu.Unlock()
+	if !last {
+		return nil
+	}
+	err := s.src.Close()
+	<-s.done
+	return unwrapError(err)
+}
+
+// unwrapError undoes wrapError, so that the error is not wrapped twice when
+// it is returned by a shared Variable.
+func unwrapError(err error) error {
+	if e, ok := err.(*gcerr.Error); ok {
+		return e.Unwrap()
+	}
+	return err
+}
+
+// sharedState implements driver.State for a snapshot of a shared Variable.
+type sharedState struct {
+	snap Snapshot
+	err  error
+}
+
+func (s *sharedState) Value() (interface{}, error) { return s.snap.Value, s.err }
+func (s *sharedState) UpdateTime() time.Time       { return s.snap.UpdateTime }
+func (s *sharedState) As(i interface{}) bool       { return s.snap.As(i) }
+
+// sharedWatcher implements driver.Watcher for the Variables returned by
+// OpenSharedVariable.
+type sharedWatcher struct {
+	s *sharedVar
+}
+
+// WatchVariable implements driver.WatchVariable. It blocks until the shared
+// Variable has a state other than prev.
+func (w *sharedWatcher) WatchVariable(ctx context.Context, prev driver.State) (driver.State, time.Duration) {
+	st, changed := w.s.current()
+	if st != nil && st != prev {
+		return st, 0
+	}
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		return nil, 0
+	}
+	if st, _ = w.s.current(); st != nil && st != prev {
+		return st, 0
+	}
+	return nil, 0
+}
+
+// Close implements driver.Close.
+func (w *sharedWatcher) Close() error { return w.s.release() }
+
+// ErrorAs implements driver.ErrorAs.
+func (w *sharedWatcher) ErrorAs(err error, i interface{}) bool { return w.s.src.dw.ErrorAs(err, i) }
+
+// ErrorCode implements driver.ErrorCode.
+func (w *sharedWatcher) ErrorCode(err error) gcerrors.ErrorCode { return w.s.src.dw.ErrorCode(err) }
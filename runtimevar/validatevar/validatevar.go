@@ -0,0 +1,140 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package validatevar provides a runtimevar implementation with Variables
+// whose values are those of another Variable, but only after they have been
+// validated. Use New to construct a *runtimevar.Variable.
+//
+// A new value of the source Variable goes through two phases before it
+// becomes the value of the Variable:
+//   - If Options.Delay is set, the source must keep the value for that long.
+//     Run a few canary instances of an application on the source Variable
+//     directly, and the rest on a validated one with a delay: a bad value
+//     reaches the canaries first, and if it is rolled back before the delay is
+//     over, the rest never see it.
+//   - If Options.Validate is set, it is called with the value, and the value
+//     is rejected if Validate returns an error.
+//
+// A rejected value does not change the value returned by Latest, which keeps
+// returning the last value that was accepted. Watch returns the rejection as
+// an error for which gcerrors.Code returns gcerrors.FailedPrecondition. Errors
+// of the source Variable are passed on without delay.
+//
+// As
+//
+// validatevar exposes the types of the source Variable for Snapshot.As, and
+// does not support any types for ErrorAs.
+package validatevar // import "gocloud.dev/runtimevar/validatevar"
+
+import (
+	"context"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/driver"
+)
+
+// Options sets options.
+type Options struct {
+	// Validate, if non-nil, is called with each new value of the source
+	// Variable, after Delay. If it returns an error, the value is rejected.
+	// Validate may take as long as it needs, for example to apply the value
+	// to part of the application and check that it stays healthy; the source
+	// Variable's changes in the meantime are validated after it returns. ctx
+	// is canceled when the Variable is closed.
+	Validate func(ctx context.Context, s runtimevar.Snapshot) error
+
+	// Delay, if positive, is how long the source Variable must keep a new
+	// value before it is validated. If the source changes during the delay,
+	// its new value must then be kept for the whole delay. The first value of
+	// the source is not delayed, so that the Variable has a value as soon as
+	// possible.
+	Delay time.Duration
+}
+
+// New constructs a *runtimevar.Variable whose values are the values of src
+// that have been accepted as described in the package documentation. The
+// returned Variable owns src: closing it closes src, and src must not be used
+// otherwise.
+func New(src *runtimevar.Variable, opts *Options) *runtimevar.Variable {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return runtimevar.New(&watcher{src: src, opts: *opts})
+}
+
+// state implements driver.State.
+type state struct {
+	snap runtimevar.Snapshot
+	err  error
+}
+
+func (s *state) Value() (interface{}, error) { return s.snap.Value, s.err }
+func (s *state) UpdateTime() time.Time       { return s.snap.UpdateTime }
+func (s *state) As(i interface{}) bool       { return s.err == nil && s.snap.As(i) }
+
+type watcher struct {
+	src     *runtimevar.Variable
+	opts    Options
+	started bool // whether the source has had a value or error
+}
+
+// WatchVariable implements driver.WatchVariable.
+func (w *watcher) WatchVariable(ctx context.Context, prev driver.State) (driver.State, time.Duration) {
+	snap, err := w.src.Watch(ctx)
+	if w.started {
+		for err == nil && w.opts.Delay > 0 {
+			// Wait for the value to be kept for the delay, starting over if it
+			// changes.
+			dctx, cancel := context.WithTimeout(ctx, w.opts.Delay)
+			snap2, err2 := w.src.Watch(dctx)
+			cancel()
+			if err2 == context.DeadlineExceeded && ctx.Err() == nil {
+				break
+			}
+			snap, err = snap2, err2
+		}
+	}
+	if ctx.Err() != nil || err == runtimevar.ErrClosed {
+		return nil, 0
+	}
+	w.started = true
+	if err != nil {
+		return &state{err: err}, 0
+	}
+	if w.opts.Validate != nil {
+		if err := w.opts.Validate(ctx, snap); err != nil {
+			if ctx.Err() != nil {
+				return nil, 0
+			}
+			return &state{err: gcerr.Newf(gcerr.FailedPrecondition, err, "validatevar: value rejected: %v", err)}, 0
+		}
+	}
+	return &state{snap: snap}, 0
+}
+
+// Close implements driver.Close.
+func (w *watcher) Close() error {
+	return w.src.Close()
+}
+
+// ErrorAs implements driver.ErrorAs.
+func (w *watcher) ErrorAs(err error, i interface{}) bool { return false }
+
+// ErrorCode implements driver.ErrorCode.
+func (*watcher) ErrorCode(err error) gcerrors.ErrorCode {
+	return gcerrors.Code(err)
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validatevar
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/driver"
+)
+
+// fakeWatcher is a driver.Watcher whose values are sent on a channel.
+type fakeWatcher struct {
+	c chan string
+}
+
+type fakeState struct{ val string }
+
+func (s *fakeState) Value() (interface{}, error) { return s.val, nil }
+func (s *fakeState) UpdateTime() time.Time       { return time.Time{} }
+func (s *fakeState) As(i interface{}) bool       { return false }
+
+func (w *fakeWatcher) WatchVariable(ctx context.Context, prev driver.State) (driver.State, time.Duration) {
+	select {
+	case v := <-w.c:
+		return &fakeState{v}, 0
+	case <-ctx.Done():
+		return nil, 0
+	}
+}
+
+func (w *fakeWatcher) Close() error                       { return nil }
+func (w *fakeWatcher) ErrorAs(error, interface{}) bool    { return false }
+func (w *fakeWatcher) ErrorCode(error) gcerrors.ErrorCode { return gcerrors.Unknown }
+
+func newSource() (*runtimevar.Variable, chan<- string) {
+	c := make(chan string)
+	return runtimevar.New(&fakeWatcher{c}), c
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	src, set := newSource()
+	v := New(src, &Options{
+		Validate: func(_ context.Context, s runtimevar.Snapshot) error {
+			if s.Value == "bad" {
+				return errors.New("bad value")
+			}
+			return nil
+		},
+	})
+	defer v.Close()
+
+	set <- "a"
+	if snap, err := v.Watch(ctx); err != nil || snap.Value != "a" {
+		t.Fatalf("got %v, %v; want a", snap.Value, err)
+	}
+	set <- "bad"
+	_, err := v.Watch(ctx)
+	if gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("got %v, want FailedPrecondition", err)
+	}
+	if snap, err := v.Latest(ctx); err != nil || snap.Value != "a" {
+		t.Errorf("Latest after a rejected value: got %v, %v; want a", snap.Value, err)
+	}
+	set <- "b"
+	if snap, err := v.Watch(ctx); err != nil || snap.Value != "b" {
+		t.Errorf("got %v, %v; want b", snap.Value, err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	ctx := context.Background()
+	src, set := newSource()
+	const delay = 100 * time.Millisecond
+	v := New(src, &Options{Delay: delay})
+	defer v.Close()
+
+	// The first value is not delayed.
+	set <- "a"
+	start := time.Now()
+	if snap, err := v.Watch(ctx); err != nil || snap.Value != "a" {
+		t.Fatalf("got %v, %v; want a", snap.Value, err)
+	}
+	if d := time.Since(start); d >= delay {
+		t.Errorf("first value took %v, want less than the delay", d)
+	}
+
+	// A value that is replaced before the delay is over is never seen.
+	start = time.Now()
+	set <- "bad"
+	time.Sleep(delay / 4)
+	set <- "b"
+	snap, err := v.Watch(ctx)
+	if err != nil || snap.Value != "b" {
+		t.Fatalf("got %v, %v; want b", snap.Value, err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("value took %v, want at least the delay", d)
+	}
+}
+
+func TestClose(t *testing.T) {
+	src, set := newSource()
+	v := New(src, &Options{Delay: time.Hour})
+	set <- "a"
+	if _, err := v.Watch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	set <- "b" // waits for the delay
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Latest(context.Background()); err != runtimevar.ErrClosed {
+		t.Errorf("source after Close: got %v, want ErrClosed", err)
+	}
+}
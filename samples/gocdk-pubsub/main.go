@@ -23,9 +23,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/google/subcommands"
 	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/loadtest"
 
 	// Import the pubsub driver packages we want to be able to open.
 	_ "gocloud.dev/pubsub/awssnssqs"
@@ -48,6 +50,7 @@ func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(&pubCmd{}, "")
 	subcommands.Register(&subCmd{}, "")
+	subcommands.Register(&loadCmd{}, "")
 	log.SetFlags(0)
 	log.SetPrefix("gocdk-pubsub: ")
 	flag.Parse()
@@ -153,3 +156,45 @@ func (cmd *subCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{
 	}
 	return subcommands.ExitSuccess
 }
+
+type loadCmd struct {
+	cfg loadtest.Config
+}
+
+func (*loadCmd) Name() string     { return "load" }
+func (*loadCmd) Synopsis() string { return "Measure latency and throughput of a topic" }
+func (*loadCmd) Usage() string {
+	return `load [-n N] [-rate R] [-publishers P] [-receivers R] [-size S] [-drain D] <topic URL> <subscription URL>
+
+  Publish messages to <topic URL> while receiving them from
+  <subscription URL>, and report send and end-to-end latencies,
+  throughput and loss. The subscription must receive the messages
+  sent to the topic, and should not be used by anything else.
+
+  Example:
+    gocdk-pubsub load -n 10000 -rate 500 mem://mytopic mem://mytopic` + helpSuffix
+}
+
+func (cmd *loadCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&cmd.cfg.Messages, "n", 1000, "number of messages to publish")
+	f.Float64Var(&cmd.cfg.Rate, "rate", 0, "messages to publish per second, or 0 for as fast as possible")
+	f.IntVar(&cmd.cfg.Publishers, "publishers", 1, "number of concurrent publishers")
+	f.IntVar(&cmd.cfg.Receivers, "receivers", 1, "number of concurrent receivers")
+	f.IntVar(&cmd.cfg.BodySize, "size", 100, "size of each message body in bytes")
+	f.DurationVar(&cmd.cfg.Drain, "drain", 10*time.Second, "how long to wait for messages after publishing ends")
+}
+
+func (cmd *loadCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 2 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	fmt.Fprintf(os.Stderr, "Publishing %d messages to %q...\n", cmd.cfg.Messages, f.Arg(0))
+	report, err := loadtest.RunURLs(ctx, f.Arg(0), f.Arg(1), &cmd.cfg)
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	fmt.Println(report)
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cachesecrets provides a secrets implementation that caches the
+// plaintexts decrypted by another Keeper, for applications that decrypt the
+// same ciphertexts repeatedly, such as a data key stored next to the data it
+// encrypts. Use New to construct a *secrets.Keeper.
+//
+// A cached plaintext is returned without calling the underlying Keeper until
+// it expires, Options.TTL after it was decrypted, so a key that is disabled or
+// revoked in the provider can still decrypt cached ciphertexts for that long.
+// Concurrent calls to Decrypt with the same ciphertext that is not cached share
+// a single call to the underlying Keeper. If the context of the caller that
+// made that call is canceled, the other callers make another. Errors are not
+// cached. Encrypt is
+// passed through to the underlying Keeper.
+//
+// As
+//
+// cachesecrets exposes the error types of the underlying Keeper for ErrorAs.
+package cachesecrets // import "gocloud.dev/secrets/cachesecrets"
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"sync"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/secrets"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultMaxEntries is the number of plaintexts cached when
+	// Options.MaxEntries is zero.
+	DefaultMaxEntries = 1000
+
+	// DefaultTTL is how long plaintexts are cached when Options.TTL is zero.
+	DefaultTTL = 5 * time.Minute
+)
+
+// Options sets options.
+type Options struct {
+	// MaxEntries is the maximum number of plaintexts cached. When the cache is
+	// full, the least recently used plaintext is dropped. If zero,
+	// DefaultMaxEntries is used.
+	MaxEntries int
+
+	// TTL is how long a plaintext is cached after it is decrypted. If zero,
+	// DefaultTTL is used.
+	TTL time.Duration
+
+	// Protect keeps the cached plaintexts encrypted in memory, under a random
+	// key generated by New, so that they do not appear in heap dumps, core
+	// files or swap as cleartext. This costs a symmetric decryption per cache
+	// hit. It does not protect against an attacker who can read all of the
+	// process's memory, which holds the key. With or without Protect, the
+	// memory of a plaintext is overwritten with zeros when it leaves the cache.
+	Protect bool
+}
+
+// New returns a *secrets.Keeper that decrypts with k, caching the plaintexts
+// as described in the package documentation. The returned Keeper owns k:
+// closing it closes k, and k must not be used otherwise.
+func New(k *secrets.Keeper, opts *Options) *secrets.Keeper {
+	return secrets.NewKeeper(newKeeper(k, opts))
+}
+
+func newKeeper(k *secrets.Keeper, opts *Options) *keeper {
+	if opts == nil {
+		opts = &Options{}
+	}
+	c := &keeper{
+		k:          k,
+		maxEntries: opts.MaxEntries,
+		ttl:        opts.TTL,
+		entries:    map[[sha256.Size]byte]*list.Element{},
+		lru:        list.New(),
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = DefaultMaxEntries
+	}
+	if c.ttl <= 0 {
+		c.ttl = DefaultTTL
+	}
+	if opts.Protect {
+		c.secretKey = new([32]byte)
+		if _, err := io.ReadFull(rand.Reader, c.secretKey[:]); err != nil {
+			// crypto/rand does not fail on supported platforms.
+			panic(err)
+		}
+	}
+	return c
+}
+
+// now returns the current time. Tests replace it.
+var now = time.Now
+
+type keeper struct {
+	k          *secrets.Keeper
+	maxEntries int
+	ttl        time.Duration
+	secretKey  *[32]byte // for sealing plaintexts if non-nil
+	group      singleflight.Group
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element // of *entry, by hash of the ciphertext
+	lru     *list.List                          // of *entry, most recently used first
+}
+
+// An entry is a cached plaintext.
+type entry struct {
+	key     [sha256.Size]byte
+	data    []byte // the plaintext, or if sealed, the nonce followed by the sealed plaintext
+	expires time.Time
+}
+
+// Decrypt implements driver.Keeper.Decrypt.
+func (c *keeper) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	key := sha256.Sum256(ciphertext)
+	if pt, ok := c.lookup(key); ok {
+		return pt, nil
+	}
+	for {
+		v, err, shared := c.group.Do(string(key[:]), func() (interface{}, error) {
+			pt, err := c.k.Decrypt(ctx, ciphertext)
+			if err != nil {
+				return nil, err
+			}
+			c.add(key, pt)
+			return pt, nil
+		})
+		if err != nil {
+			// A shared call runs with the context of the caller that started
+			// it. If that context ended first, try again with ours.
+			if shared && ctx.Err() == nil && isContextError(err) {
+				continue
+			}
+			return nil, err
+		}
+		// The plaintext may be shared with other callers, so return a copy.
+		return append([]byte(nil), v.([]byte)...), nil
+	}
+}
+
+// isContextError reports whether err is the result of a canceled or expired
+// context.
+func isContextError(err error) bool {
+	code := gcerrors.Code(err)
+	return code == gcerrors.Canceled || code == gcerrors.DeadlineExceeded
+}
+
+// lookup returns a copy of the plaintext cached for key, if there is one that
+// has not expired.
+func (c *keeper) lookup(key [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.entries[key]
+	if elem == nil {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if !now().Before(e.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	if c.secretKey == nil {
+		return append([]byte(nil), e.data...), true
+	}
+	var nonce [24]byte
+	copy(nonce[:], e.data)
+	pt, ok := secretbox.Open(nil, e.data[len(nonce):], &nonce, c.secretKey)
+	if !ok {
+		// The cache sealed the data itself, so this cannot happen.
+		c.remove(elem)
+		return nil, false
+	}
+	return pt, true
+}
+
+// add caches pt for key, dropping the least recently used plaintext if the
+// cache is full.
+func (c *keeper) add(key [sha256.Size]byte, pt []byte) {
+	e := &entry{key: key, expires: now().Add(c.ttl)}
+	if c.secretKey == nil {
+		e.data = append([]byte(nil), pt...)
+	} else {
+		var nonce [24]byte
+		if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+			// Not caching is always safe.
+			return
+		}
+		e.data = secretbox.Seal(nonce[:], pt, &nonce, c.secretKey)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil { // closed
+		return
+	}
+	if elem := c.entries[key]; elem != nil {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes elem from the cache and zeroes its data. c.mu must be held.
+func (c *keeper) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	for i := range e.data {
+		e.data[i] = 0
+	}
+}
+
+// Encrypt implements driver.Keeper.Encrypt.
+func (c *keeper) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return c.k.Encrypt(ctx, plaintext)
+}
+
+// Close implements driver.Keeper.Close. It drops the cached plaintexts and
+// closes the underlying Keeper.
+func (c *keeper) Close() error {
+	c.mu.Lock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.entries = nil
+	c.mu.Unlock()
+	return c.k.Close()
+}
+
+// ErrorAs implements driver.Keeper.ErrorAs.
+func (c *keeper) ErrorAs(err error, i interface{}) bool {
+	return c.k.ErrorAs(err, i)
+}
+
+// ErrorCode implements driver.ErrorCode.
+func (c *keeper) ErrorCode(err error) gcerrors.ErrorCode {
+	return gcerrors.Code(err)
+}
@@ -0,0 +1,229 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachesecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/secrets"
+	"gocloud.dev/secrets/driver"
+	"gocloud.dev/secrets/drivertest"
+	"gocloud.dev/secrets/localsecrets"
+)
+
+type harness struct{}
+
+func (h *harness) MakeDriver(ctx context.Context) (driver.Keeper, driver.Keeper, error) {
+	var ks [2]driver.Keeper
+	for i := range ks {
+		key, err := localsecrets.NewRandomKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		ks[i] = newKeeper(localsecrets.NewKeeper(key), &Options{Protect: true})
+	}
+	return ks[0], ks[1], nil
+}
+
+func (h *harness) Close() {}
+
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	return &harness{}, nil
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, []drivertest.AsTest{verifyAs{}})
+}
+
+type verifyAs struct{}
+
+func (v verifyAs) Name() string {
+	return "verify As function"
+}
+
+func (v verifyAs) ErrorCheck(k *secrets.Keeper, err error) error {
+	var s string
+	if k.ErrorAs(err, &s) {
+		return errors.New("Keeper.ErrorAs expected to fail")
+	}
+	return nil
+}
+
+// countingKeeper is a driver.Keeper that "encrypts" by prefixing the plaintext
+// with "ct:", and counts its calls to Decrypt.
+type countingKeeper struct {
+	decrypts int32
+	release  chan struct{} // if non-nil, Decrypt waits for it to be closed
+}
+
+func (k *countingKeeper) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	atomic.AddInt32(&k.decrypts, 1)
+	if k.release != nil {
+		select {
+		case <-k.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if len(ciphertext) < 3 || string(ciphertext[:3]) != "ct:" {
+		return nil, errors.New("bad ciphertext")
+	}
+	return append([]byte(nil), ciphertext[3:]...), nil
+}
+
+func (k *countingKeeper) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return append([]byte("ct:"), plaintext...), nil
+}
+
+func (k *countingKeeper) Close() error                       { return nil }
+func (k *countingKeeper) ErrorAs(error, interface{}) bool    { return false }
+func (k *countingKeeper) ErrorCode(error) gcerrors.ErrorCode { return gcerrors.InvalidArgument }
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	for _, protect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Protect=%t", protect), func(t *testing.T) {
+			clock := time.Now()
+			now = func() time.Time { return clock }
+			defer func() { now = time.Now }()
+
+			ck := &countingKeeper{}
+			k := New(secrets.NewKeeper(ck), &Options{MaxEntries: 2, TTL: time.Minute, Protect: protect})
+			defer k.Close()
+
+			// decrypt decrypts the ciphertext of pt, and checks the number of
+			// calls to the underlying Keeper.
+			decrypt := func(pt string, wantDecrypts int32) {
+				t.Helper()
+				got, err := k.Decrypt(ctx, []byte("ct:"+pt))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != pt {
+					t.Errorf("got %q, want %q", got, pt)
+				}
+				// Changing the result does not change the cache.
+				for i := range got {
+					got[i] = 'x'
+				}
+				if n := atomic.LoadInt32(&ck.decrypts); n != wantDecrypts {
+					t.Errorf("after decrypting %q: got %d underlying decrypts, want %d", pt, n, wantDecrypts)
+				}
+			}
+
+			decrypt("a", 1)
+			decrypt("a", 1)
+			decrypt("b", 2)
+			decrypt("a", 2)
+
+			// The cache is full, so adding "c" drops "b", the least recently
+			// used.
+			decrypt("c", 3)
+			decrypt("a", 3)
+			decrypt("b", 4)
+
+			// Plaintexts expire after the TTL, even if they are used.
+			clock = clock.Add(time.Minute)
+			decrypt("b", 5)
+			decrypt("b", 5)
+
+			// Errors are not cached.
+			for i := 0; i < 2; i++ {
+				if _, err := k.Decrypt(ctx, []byte("bad")); gcerrors.Code(err) != gcerrors.InvalidArgument {
+					t.Errorf("got %v, want InvalidArgument", err)
+				}
+			}
+			if n := atomic.LoadInt32(&ck.decrypts); n != 7 {
+				t.Errorf("after failed decrypts: got %d underlying decrypts, want 7", n)
+			}
+		})
+	}
+}
+
+func TestConcurrentDecrypts(t *testing.T) {
+	ctx := context.Background()
+	ck := &countingKeeper{release: make(chan struct{})}
+	k := New(secrets.NewKeeper(ck), nil)
+	defer k.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := k.Decrypt(ctx, []byte("ct:a"))
+			if err != nil || string(got) != "a" {
+				t.Errorf(`got %q, %v; want "a"`, got, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(ck.release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&ck.decrypts); n != 1 {
+		t.Errorf("got %d underlying decrypts, want 1", n)
+	}
+}
+
+func TestCanceledSharedDecrypt(t *testing.T) {
+	ck := &countingKeeper{release: make(chan struct{})}
+	k := New(secrets.NewKeeper(ck), nil)
+	defer k.Close()
+
+	// The first caller's call to the underlying Keeper is shared with the
+	// second, until the first caller's context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := k.Decrypt(ctx, []byte("ct:a"))
+		firstErr <- err
+	}()
+	for atomic.LoadInt32(&ck.decrypts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan []byte, 1)
+	go func() {
+		got, err := k.Decrypt(context.Background(), []byte("ct:a"))
+		if err != nil {
+			t.Error(err)
+		}
+		second <- got
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-firstErr; gcerrors.Code(err) != gcerrors.Canceled {
+		t.Errorf("first caller: got %v, want Canceled", err)
+	}
+
+	// The second caller, whose context is live, decrypts again.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&ck.decrypts) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("second caller: no second underlying decrypt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(ck.release)
+	if got := <-second; string(got) != "a" {
+		t.Errorf(`second caller: got %q, want "a"`, got)
+	}
+}
@@ -0,0 +1,563 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pkcs11 provides a secrets implementation backed by a PKCS #11
+// token, such as a hardware security module (HSM) or SoftHSM.
+// Use OpenToken to log in to a token, and OpenKeeper to construct a
+// *secrets.Keeper that encrypts with one of the token's AES keys.
+//
+// The key never leaves the token: encryption and decryption are performed by
+// the PKCS #11 module. Ciphertexts consist of the initialization vector
+// followed by the output of the mechanism, so they can only be decrypted with
+// the mechanism that produced them (see KeeperOptions.Mechanism).
+//
+// The package uses cgo to load the PKCS #11 module.
+//
+// URLs
+//
+// For secrets.OpenKeeper, pkcs11 registers for the scheme "pkcs11".
+// The default URL opener opens a token using the environment variables
+// "PKCS11_MODULE_PATH", "PKCS11_TOKEN_LABEL" and "PKCS11_PIN".
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://gocloud.dev/concepts/urls/ for background information.
+//
+// Sessions
+//
+// PKCS #11 sessions may not be used by more than one goroutine at a time.
+// A Token keeps a pool of open sessions that are shared by all of its
+// Keepers; each Encrypt or Decrypt call takes a session from the pool, opening
+// a new one if none is idle, and waits when Config.MaxSessions sessions are in
+// use. Keepers are therefore safe for concurrent use.
+//
+// As
+//
+// pkcs11 exposes the following type for As:
+//  - Error: pkcs11.Error from github.com/miekg/pkcs11
+package pkcs11 // import "gocloud.dev/secrets/pkcs11"
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+
+	p11 "github.com/miekg/pkcs11"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/secrets"
+)
+
+// Config describes the PKCS #11 token to open.
+type Config struct {
+	// ModulePath is the path of the PKCS #11 module (shared library), for
+	// example "/usr/lib/softhsm/libsofthsm2.so". Required.
+	ModulePath string
+	// TokenLabel is the label of the token to use. Required.
+	TokenLabel string
+	// PIN is the user PIN of the token. If empty, sessions are not logged in,
+	// so only keys that are not private objects can be used.
+	PIN string
+	// MaxSessions is the maximum number of sessions open at once.
+	// Defaults to 8.
+	MaxSessions int
+}
+
+const defaultMaxSessions = 8
+
+// Token is a PKCS #11 token opened with OpenToken.
+// It is safe for concurrent use.
+type Token struct {
+	modulePath string
+	ctx        *p11.Ctx
+	slot       uint
+	pin        string
+	pool       *sessionPool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// OpenToken loads the module, finds the token with the configured label and
+// checks that a session can be logged in to it.
+// Call Close on the returned Token when it is no longer needed.
+func OpenToken(cfg *Config) (*Token, error) {
+	if cfg == nil || cfg.ModulePath == "" {
+		return nil, errors.New("pkcs11: no module path provided")
+	}
+	if cfg.TokenLabel == "" {
+		return nil, errors.New("pkcs11: no token label provided")
+	}
+	if cfg.MaxSessions < 0 {
+		return nil, fmt.Errorf("pkcs11: MaxSessions must be positive, got %d", cfg.MaxSessions)
+	}
+	ctx, err := loadModule(cfg.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := findSlot(ctx, cfg.TokenLabel)
+	if err != nil {
+		releaseModule(cfg.ModulePath)
+		return nil, err
+	}
+	t := &Token{modulePath: cfg.ModulePath, ctx: ctx, slot: slot, pin: cfg.PIN}
+	max := cfg.MaxSessions
+	if max == 0 {
+		max = defaultMaxSessions
+	}
+	t.pool = newSessionPool(max, t.openSession, t.closeSession)
+	// Open the first session now, so that a wrong PIN is reported here.
+	sh, err := t.pool.get(context.Background())
+	if err != nil {
+		t.pool.closeIdle()
+		releaseModule(cfg.ModulePath)
+		return nil, err
+	}
+	t.pool.put(sh, false)
+	return t, nil
+}
+
+// findSlot returns the slot holding the token labeled label.
+func findSlot(ctx *p11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		if info.Label == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("pkcs11: no token labeled %q", label)
+}
+
+func (t *Token) openSession() (p11.SessionHandle, error) {
+	sh, err := t.ctx.OpenSession(t.slot, p11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return 0, err
+	}
+	if t.pin == "" {
+		return sh, nil
+	}
+	// The login state is shared by all of the application's sessions with the
+	// token, so only the first session is actually logged in. It is lost when
+	// the last session is closed.
+	if err := t.ctx.Login(sh, p11.CKU_USER, t.pin); err != nil && err != p11.Error(p11.CKR_USER_ALREADY_LOGGED_IN) {
+		t.ctx.CloseSession(sh)
+		return 0, err
+	}
+	return sh, nil
+}
+
+func (t *Token) closeSession(sh p11.SessionHandle) {
+	t.ctx.CloseSession(sh)
+}
+
+// Close closes the token's sessions and unloads the module if no other Token
+// uses it. Keepers opened on the token must not be used after Close.
+func (t *Token) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	t.pool.closeIdle()
+	return releaseModule(t.modulePath)
+}
+
+// modules holds the loaded PKCS #11 modules. A module may only be initialized
+// once per process, so Tokens using the same module share it.
+var modules = struct {
+	sync.Mutex
+	m map[string]*module
+}{m: map[string]*module{}}
+
+type module struct {
+	ctx  *p11.Ctx
+	refs int
+}
+
+func loadModule(path string) (*p11.Ctx, error) {
+	modules.Lock()
+	defer modules.Unlock()
+	if m := modules.m[path]; m != nil {
+		m.refs++
+		return m.ctx, nil
+	}
+	ctx := p11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: failed to load module %q", path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: failed to initialize module %q: %v", path, err)
+	}
+	modules.m[path] = &module{ctx: ctx, refs: 1}
+	return ctx, nil
+}
+
+func releaseModule(path string) error {
+	modules.Lock()
+	defer modules.Unlock()
+	m := modules.m[path]
+	if m == nil {
+		return nil
+	}
+	if m.refs--; m.refs > 0 {
+		return nil
+	}
+	delete(modules.m, path)
+	err := m.ctx.Finalize()
+	m.ctx.Destroy()
+	return err
+}
+
+func init() {
+	secrets.DefaultURLMux().RegisterKeeper(Scheme, new(defaultOpener))
+}
+
+// defaultOpener opens a token based on the environment variables
+// PKCS11_MODULE_PATH, PKCS11_TOKEN_LABEL and PKCS11_PIN.
+type defaultOpener struct {
+	init   sync.Once
+	opener *URLOpener
+	err    error
+}
+
+func (o *defaultOpener) OpenKeeperURL(ctx context.Context, u *url.URL) (*secrets.Keeper, error) {
+	o.init.Do(func() {
+		cfg := &Config{
+			ModulePath: os.Getenv("PKCS11_MODULE_PATH"),
+			TokenLabel: os.Getenv("PKCS11_TOKEN_LABEL"),
+			PIN:        os.Getenv("PKCS11_PIN"),
+		}
+		if cfg.ModulePath == "" {
+			o.err = errors.New("PKCS11_MODULE_PATH environment variable is not set")
+			return
+		}
+		if cfg.TokenLabel == "" {
+			o.err = errors.New("PKCS11_TOKEN_LABEL environment variable is not set")
+			return
+		}
+		tok, err := OpenToken(cfg)
+		if err != nil {
+			o.err = err
+			return
+		}
+		o.opener = &URLOpener{Token: tok}
+	})
+	if o.err != nil {
+		return nil, fmt.Errorf("open keeper %v: %v", u, o.err)
+	}
+	return o.opener.OpenKeeperURL(ctx, u)
+}
+
+// Scheme is the URL scheme pkcs11 registers its URLOpener under on
+// secrets.DefaultMux.
+const Scheme = "pkcs11"
+
+// URLOpener opens PKCS #11 URLs like "pkcs11://mykey?mechanism=aes-gcm".
+//
+// The URL Host + Path are used as the label of the key.
+//
+// The following query parameters are supported:
+//   - mechanism: The Mechanism to encrypt with, overriding Options.Mechanism.
+type URLOpener struct {
+	// Token must be non-nil.
+	Token *Token
+
+	// Options specifies the options to pass to OpenKeeper.
+	Options KeeperOptions
+}
+
+// OpenKeeperURL opens the Keeper URL.
+func (o *URLOpener) OpenKeeperURL(ctx context.Context, u *url.URL) (*secrets.Keeper, error) {
+	opts := o.Options
+	for param, values := range u.Query() {
+		switch param {
+		case "mechanism":
+			opts.Mechanism = Mechanism(values[0])
+		default:
+			return nil, fmt.Errorf("open keeper %v: invalid query parameter %q", u, param)
+		}
+	}
+	label := path.Join(u.Host, u.Path)
+	if label == "" {
+		return nil, fmt.Errorf("open keeper %v: no key label", u)
+	}
+	k, err := OpenKeeper(o.Token, label, &opts)
+	if err != nil {
+		return nil, fmt.Errorf("open keeper %v: %v", u, err)
+	}
+	return k, nil
+}
+
+// Mechanism selects how a Keeper encrypts.
+type Mechanism string
+
+const (
+	// AESGCM encrypts with CKM_AES_GCM, using a random 96-bit IV and a
+	// 128-bit tag. It is the default.
+	AESGCM Mechanism = "aes-gcm"
+	// AESCBCPad encrypts with CKM_AES_CBC_PAD, using a random IV, for
+	// tokens without GCM support. The ciphertexts are not authenticated.
+	AESCBCPad Mechanism = "aes-cbc-pad"
+)
+
+const (
+	gcmIVSize  = 12
+	gcmTagBits = 128
+)
+
+// KeeperOptions controls Keeper behaviors.
+type KeeperOptions struct {
+	// Mechanism is the mechanism to encrypt and decrypt with.
+	// Defaults to AESGCM.
+	Mechanism Mechanism
+}
+
+// OpenKeeper returns a *secrets.Keeper that encrypts with the AES secret key
+// labeled label on tok.
+// The key is looked up on first use.
+func OpenKeeper(tok *Token, label string, opts *KeeperOptions) (*secrets.Keeper, error) {
+	if opts == nil {
+		opts = &KeeperOptions{}
+	}
+	mech := opts.Mechanism
+	switch mech {
+	case "":
+		mech = AESGCM
+	case AESGCM, AESCBCPad:
+	default:
+		return nil, fmt.Errorf("pkcs11: unsupported mechanism %q", mech)
+	}
+	return secrets.NewKeeper(&keeper{token: tok, label: label, mech: mech}), nil
+}
+
+type keeper struct {
+	token *Token
+	label string
+	mech  Mechanism
+
+	mu    sync.Mutex
+	key   p11.ObjectHandle
+	found bool
+}
+
+// keyError is returned when the key's label does not match exactly one
+// secret key on the token.
+type keyError struct {
+	label string
+	n     int // the number of matching keys
+}
+
+func (e *keyError) Error() string {
+	if e.n == 0 {
+		return fmt.Sprintf("pkcs11: no secret key labeled %q", e.label)
+	}
+	return fmt.Sprintf("pkcs11: %d secret keys labeled %q", e.n, e.label)
+}
+
+var errShortCiphertext = errors.New("pkcs11: ciphertext is too short")
+
+// findKey returns the handle of the keeper's key, looking it up with sh if
+// necessary. Object handles are valid in all of the token's sessions, so the
+// handle is looked up only once.
+func (k *keeper) findKey(sh p11.SessionHandle) (p11.ObjectHandle, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.found {
+		return k.key, nil
+	}
+	ctx := k.token.ctx
+	err := ctx.FindObjectsInit(sh, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_SECRET_KEY),
+		p11.NewAttribute(p11.CKA_LABEL, k.label),
+	})
+	if err != nil {
+		return 0, err
+	}
+	objs, _, err := ctx.FindObjects(sh, 2)
+	if ferr := ctx.FindObjectsFinal(sh); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) != 1 {
+		return 0, &keyError{label: k.label, n: len(objs)}
+	}
+	k.key, k.found = objs[0], true
+	return k.key, nil
+}
+
+// do runs op with a session from the token's pool and the keeper's key.
+func (k *keeper) do(ctx context.Context, op func(sh p11.SessionHandle, key p11.ObjectHandle) ([]byte, error)) ([]byte, error) {
+	sh, err := k.token.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := k.findKey(sh)
+	var out []byte
+	if err == nil {
+		out, err = op(sh, key)
+	}
+	// A failed operation may leave the session in an unknown state, so it is
+	// closed rather than reused.
+	_, failed := err.(p11.Error)
+	k.token.pool.put(sh, failed)
+	if err == p11.Error(p11.CKR_KEY_HANDLE_INVALID) || err == p11.Error(p11.CKR_OBJECT_HANDLE_INVALID) {
+		// The key was deleted or replaced; look it up again next time.
+		k.mu.Lock()
+		k.found = false
+		k.mu.Unlock()
+	}
+	return out, err
+}
+
+// Encrypt encrypts the plaintext into a ciphertext.
+func (k *keeper) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return k.do(ctx, func(sh p11.SessionHandle, key p11.ObjectHandle) ([]byte, error) {
+		c := k.token.ctx
+		switch k.mech {
+		case AESCBCPad:
+			iv := make([]byte, aes.BlockSize)
+			if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+				return nil, err
+			}
+			if err := c.EncryptInit(sh, []*p11.Mechanism{p11.NewMechanism(p11.CKM_AES_CBC_PAD, iv)}, key); err != nil {
+				return nil, err
+			}
+			ct, err := c.Encrypt(sh, plaintext)
+			if err != nil {
+				return nil, err
+			}
+			return append(iv, ct...), nil
+		default:
+			iv := make([]byte, gcmIVSize)
+			if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+				return nil, err
+			}
+			params := p11.NewGCMParams(iv, nil, gcmTagBits)
+			defer params.Free()
+			if err := c.EncryptInit(sh, []*p11.Mechanism{p11.NewMechanism(p11.CKM_AES_GCM, params)}, key); err != nil {
+				return nil, err
+			}
+			ct, err := c.Encrypt(sh, plaintext)
+			if err != nil {
+				return nil, err
+			}
+			// Some modules ignore the given IV and generate their own.
+			if tokIV := params.IV(); len(tokIV) == gcmIVSize {
+				iv = tokIV
+			}
+			return append(iv, ct...), nil
+		}
+	})
+}
+
+// Decrypt decrypts the ciphertext into a plaintext.
+func (k *keeper) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	ivSize := gcmIVSize
+	if k.mech == AESCBCPad {
+		ivSize = aes.BlockSize
+	}
+	if len(ciphertext) <= ivSize {
+		return nil, errShortCiphertext
+	}
+	iv, ct := ciphertext[:ivSize], ciphertext[ivSize:]
+	return k.do(ctx, func(sh p11.SessionHandle, key p11.ObjectHandle) ([]byte, error) {
+		c := k.token.ctx
+		var m *p11.Mechanism
+		if k.mech == AESCBCPad {
+			m = p11.NewMechanism(p11.CKM_AES_CBC_PAD, iv)
+		} else {
+			params := p11.NewGCMParams(iv, nil, gcmTagBits)
+			defer params.Free()
+			m = p11.NewMechanism(p11.CKM_AES_GCM, params)
+		}
+		if err := c.DecryptInit(sh, []*p11.Mechanism{m}, key); err != nil {
+			return nil, err
+		}
+		return c.Decrypt(sh, ct)
+	})
+}
+
+// Close implements driver.Keeper.Close.
+func (k *keeper) Close() error { return nil }
+
+// ErrorAs implements driver.Keeper.ErrorAs.
+func (k *keeper) ErrorAs(err error, i interface{}) bool {
+	e, ok := err.(p11.Error)
+	if !ok {
+		return false
+	}
+	p, ok := i.(*p11.Error)
+	if !ok {
+		return false
+	}
+	*p = e
+	return true
+}
+
+// ErrorCode implements driver.ErrorCode.
+func (k *keeper) ErrorCode(err error) gcerrors.ErrorCode {
+	switch err {
+	case context.Canceled:
+		return gcerrors.Canceled
+	case context.DeadlineExceeded:
+		return gcerrors.DeadlineExceeded
+	case errShortCiphertext:
+		return gcerrors.InvalidArgument
+	}
+	if e, ok := err.(*keyError); ok {
+		if e.n == 0 {
+			return gcerrors.NotFound
+		}
+		return gcerrors.FailedPrecondition
+	}
+	e, ok := err.(p11.Error)
+	if !ok {
+		return gcerrors.Unknown
+	}
+	switch e {
+	case p11.CKR_ENCRYPTED_DATA_INVALID, p11.CKR_ENCRYPTED_DATA_LEN_RANGE,
+		p11.CKR_DATA_INVALID, p11.CKR_DATA_LEN_RANGE, p11.CKR_ARGUMENTS_BAD:
+		return gcerrors.InvalidArgument
+	case p11.CKR_KEY_HANDLE_INVALID, p11.CKR_OBJECT_HANDLE_INVALID:
+		return gcerrors.NotFound
+	case p11.CKR_PIN_INCORRECT, p11.CKR_PIN_EXPIRED, p11.CKR_PIN_LOCKED,
+		p11.CKR_USER_NOT_LOGGED_IN, p11.CKR_KEY_FUNCTION_NOT_PERMITTED:
+		return gcerrors.PermissionDenied
+	case p11.CKR_MECHANISM_INVALID, p11.CKR_FUNCTION_NOT_SUPPORTED:
+		return gcerrors.Unimplemented
+	case p11.CKR_KEY_TYPE_INCONSISTENT, p11.CKR_TOKEN_NOT_PRESENT, p11.CKR_DEVICE_REMOVED:
+		return gcerrors.FailedPrecondition
+	case p11.CKR_SESSION_COUNT, p11.CKR_DEVICE_MEMORY, p11.CKR_HOST_MEMORY:
+		return gcerrors.ResourceExhausted
+	case p11.CKR_DEVICE_ERROR, p11.CKR_GENERAL_ERROR:
+		return gcerrors.Internal
+	}
+	return gcerrors.Unknown
+}
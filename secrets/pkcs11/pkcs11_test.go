@@ -0,0 +1,538 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	p11 "github.com/miekg/pkcs11"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/secrets"
+	"gocloud.dev/secrets/driver"
+	"gocloud.dev/secrets/drivertest"
+)
+
+// The SoftHSM tests run if SoftHSM is installed (e.g., "apt install softhsm2").
+// Set SOFTHSM2_MODULE if the module is not in a standard location.
+// Each test run creates its own token in a temporary directory.
+
+const (
+	tokenLabel = "gocloud-test"
+	soPIN      = "1234"
+	userPIN    = "5678"
+	keyLabel1  = "test-secrets"
+	keyLabel2  = "test-secrets2"
+)
+
+var softHSMPaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/usr/local/lib/libsofthsm2.so",
+}
+
+var (
+	softHSMOnce   sync.Once
+	softHSMConfig *Config
+	softHSMErr    error
+)
+
+// softHSM returns the Config for a SoftHSM token holding two AES keys,
+// creating it on the first call. It skips the test if SoftHSM is not
+// installed.
+func softHSM(t *testing.T) *Config {
+	softHSMOnce.Do(func() {
+		module := os.Getenv("SOFTHSM2_MODULE")
+		for _, p := range softHSMPaths {
+			if module != "" {
+				break
+			}
+			if _, err := os.Stat(p); err == nil {
+				module = p
+			}
+		}
+		if module == "" {
+			return
+		}
+		softHSMConfig, softHSMErr = initSoftHSM(module)
+	})
+	if softHSMErr != nil {
+		t.Fatal(softHSMErr)
+	}
+	if softHSMConfig == nil {
+		t.Skip("Skipping PKCS #11 tests since SoftHSM is not installed")
+	}
+	return softHSMConfig
+}
+
+func initSoftHSM(module string) (*Config, error) {
+	dir, err := ioutil.TempDir("", "softhsm")
+	if err != nil {
+		return nil, err
+	}
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		return nil, err
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens)), 0600); err != nil {
+		return nil, err
+	}
+	// SoftHSM reads its configuration when the module is initialized.
+	os.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx, err := loadModule(module)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseModule(module)
+	slots, err := ctx.GetSlotList(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(slots) == 0 {
+		return nil, errors.New("SoftHSM has no slots")
+	}
+	if err := ctx.InitToken(slots[0], soPIN, tokenLabel); err != nil {
+		return nil, err
+	}
+	slot, err := findSlot(ctx, tokenLabel)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.CloseSession(sh)
+	if err := ctx.Login(sh, p11.CKU_SO, soPIN); err != nil {
+		return nil, err
+	}
+	if err := ctx.InitPIN(sh, userPIN); err != nil {
+		return nil, err
+	}
+	if err := ctx.Logout(sh); err != nil {
+		return nil, err
+	}
+	if err := ctx.Login(sh, p11.CKU_USER, userPIN); err != nil {
+		return nil, err
+	}
+	for _, label := range []string{keyLabel1, keyLabel2} {
+		_, err := ctx.GenerateKey(sh, []*p11.Mechanism{p11.NewMechanism(p11.CKM_AES_KEY_GEN, nil)}, []*p11.Attribute{
+			p11.NewAttribute(p11.CKA_CLASS, p11.CKO_SECRET_KEY),
+			p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_AES),
+			p11.NewAttribute(p11.CKA_VALUE_LEN, 32),
+			p11.NewAttribute(p11.CKA_LABEL, label),
+			p11.NewAttribute(p11.CKA_TOKEN, true),
+			p11.NewAttribute(p11.CKA_PRIVATE, true),
+			p11.NewAttribute(p11.CKA_SENSITIVE, true),
+			p11.NewAttribute(p11.CKA_ENCRYPT, true),
+			p11.NewAttribute(p11.CKA_DECRYPT, true),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Config{ModulePath: module, TokenLabel: tokenLabel, PIN: userPIN}, nil
+}
+
+type harness struct {
+	token *Token
+}
+
+func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	tok, err := OpenToken(softHSM(t))
+	if err != nil {
+		return nil, err
+	}
+	return &harness{token: tok}, nil
+}
+
+func (h *harness) MakeDriver(ctx context.Context) (driver.Keeper, driver.Keeper, error) {
+	return &keeper{token: h.token, label: keyLabel1, mech: AESGCM}, &keeper{token: h.token, label: keyLabel2, mech: AESGCM}, nil
+}
+
+func (h *harness) Close() {
+	h.token.Close()
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, []drivertest.AsTest{verifyAs{}})
+}
+
+type verifyAs struct{}
+
+func (v verifyAs) Name() string {
+	return "verify As function"
+}
+
+func (v verifyAs) ErrorCheck(k *secrets.Keeper, err error) error {
+	var e p11.Error
+	if !k.ErrorAs(err, &e) {
+		return errors.New("Keeper.ErrorAs failed")
+	}
+	return nil
+}
+
+// PKCS #11-specific tests.
+
+func TestMechanisms(t *testing.T) {
+	ctx := context.Background()
+	tok, err := OpenToken(softHSM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tok.Close()
+
+	msg := []byte("I'm a secret message!")
+	ciphertexts := map[Mechanism][]byte{}
+	for _, mech := range []Mechanism{AESGCM, AESCBCPad} {
+		k, err := OpenKeeper(tok, keyLabel1, &KeeperOptions{Mechanism: mech})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer k.Close()
+		ct, err := k.Encrypt(ctx, msg)
+		if err != nil {
+			t.Fatalf("%s: %v", mech, err)
+		}
+		pt, err := k.Decrypt(ctx, ct)
+		if err != nil {
+			t.Fatalf("%s: %v", mech, err)
+		}
+		if string(pt) != string(msg) {
+			t.Errorf("%s: got %q, want %q", mech, pt, msg)
+		}
+		ciphertexts[mech] = ct
+	}
+
+	// A GCM ciphertext is authenticated, so decrypting anything else fails.
+	k, err := OpenKeeper(tok, keyLabel1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if _, err := k.Decrypt(ctx, ciphertexts[AESCBCPad]); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("decrypting a CBC ciphertext with GCM: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	ctx := context.Background()
+	tok, err := OpenToken(softHSM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tok.Close()
+	k, err := OpenKeeper(tok, "no-such-key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if _, err := k.Encrypt(ctx, []byte("x")); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("got %v, want NotFound", err)
+	}
+}
+
+func TestWrongPIN(t *testing.T) {
+	cfg := *softHSM(t)
+	cfg.PIN = "0000"
+	tok, err := OpenToken(&cfg)
+	if err == nil {
+		tok.Close()
+		t.Fatal("got nil error, want CKR_PIN_INCORRECT")
+	}
+	if err != p11.Error(p11.CKR_PIN_INCORRECT) {
+		t.Errorf("got %v, want CKR_PIN_INCORRECT", err)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	cfg := *softHSM(t)
+	cfg.MaxSessions = 2
+	tok, err := OpenToken(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tok.Close()
+	k, err := OpenKeeper(tok, keyLabel1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := []byte(fmt.Sprintf("message %d", i))
+			ct, err := k.Encrypt(ctx, msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pt, err := k.Decrypt(ctx, ct)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(pt) != string(msg) {
+				t.Errorf("got %q, want %q", pt, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSessionPool(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu      sync.Mutex
+		next    p11.SessionHandle
+		open    = map[p11.SessionHandle]bool{}
+		maxOpen int
+		fail    bool
+	)
+	p := newSessionPool(2, func() (p11.SessionHandle, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			return 0, p11.Error(p11.CKR_SESSION_COUNT)
+		}
+		next++
+		open[next] = true
+		if len(open) > maxOpen {
+			maxOpen = len(open)
+		}
+		return next, nil
+	}, func(sh p11.SessionHandle) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !open[sh] {
+			t.Errorf("closed session %d twice", sh)
+		}
+		delete(open, sh)
+	})
+
+	// Idle sessions are reused.
+	sh1, err := p.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.put(sh1, false)
+	if sh, _ := p.get(ctx); sh != sh1 {
+		t.Errorf("got session %d, want idle session %d", sh, sh1)
+	}
+
+	// At most two sessions are open; a third get waits.
+	sh2, err := p.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.get(tctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	done := make(chan p11.SessionHandle)
+	go func() {
+		sh, err := p.get(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- sh
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.put(sh2, false)
+	if sh := <-done; sh != sh2 {
+		t.Errorf("got session %d, want %d", sh, sh2)
+	}
+
+	// A discarded session is closed, making room for a new one.
+	p.put(sh1, true)
+	sh3, err := p.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh3 == sh1 || sh3 == sh2 {
+		t.Errorf("got session %d, want a new one", sh3)
+	}
+
+	// A failure to open a session does not use up room in the pool.
+	p.put(sh3, true)
+	fail = true
+	if _, err := p.get(ctx); err != p11.Error(p11.CKR_SESSION_COUNT) {
+		t.Errorf("got %v, want CKR_SESSION_COUNT", err)
+	}
+	fail = false
+	sh4, err := p.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.put(sh4, false)
+	p.put(sh2, false)
+
+	p.closeIdle()
+	if len(open) != 0 {
+		t.Errorf("got %d open sessions after closeIdle, want 0", len(open))
+	}
+	if maxOpen > 2 {
+		t.Errorf("got %d sessions open at once, want at most 2", maxOpen)
+	}
+}
+
+func TestSessionPoolConcurrency(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu            sync.Mutex
+		next          p11.SessionHandle
+		inUse         = map[p11.SessionHandle]bool{}
+		opened, limit = 0, 3
+	)
+	p := newSessionPool(limit, func() (p11.SessionHandle, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		next++
+		opened++
+		return next, nil
+	}, func(p11.SessionHandle) {
+		mu.Lock()
+		defer mu.Unlock()
+		opened--
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sh, err := p.get(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			if inUse[sh] {
+				t.Errorf("session %d handed out twice", sh)
+			}
+			inUse[sh] = true
+			if opened > limit {
+				t.Errorf("%d sessions open, want at most %d", opened, limit)
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			delete(inUse, sh)
+			mu.Unlock()
+			p.put(sh, i%5 == 0)
+		}(i)
+	}
+	wg.Wait()
+	p.closeIdle()
+	if opened != 0 {
+		t.Errorf("got %d open sessions after closeIdle, want 0", opened)
+	}
+}
+
+func TestOpenToken(t *testing.T) {
+	for _, cfg := range []*Config{
+		nil,
+		{TokenLabel: tokenLabel},
+		{ModulePath: "/no/such/module.so"},
+		{ModulePath: "/no/such/module.so", TokenLabel: tokenLabel, MaxSessions: -1},
+		{ModulePath: "/no/such/module.so", TokenLabel: tokenLabel},
+	} {
+		if tok, err := OpenToken(cfg); err == nil {
+			tok.Close()
+			t.Errorf("%+v: got nil error, want error", cfg)
+		}
+	}
+}
+
+func TestOpenKeeper(t *testing.T) {
+	tests := []struct {
+		URL     string
+		WantErr bool
+	}{
+		// OK.
+		{"pkcs11://mykey", false},
+		{"pkcs11://mykeys/one", false},
+		{"pkcs11://mykey?mechanism=aes-gcm", false},
+		{"pkcs11://mykey?mechanism=aes-cbc-pad", false},
+		// Invalid mechanism.
+		{"pkcs11://mykey?mechanism=rsa", true},
+		// Invalid parameter.
+		{"pkcs11://mykey?param=value", true},
+		// No key label.
+		{"pkcs11://", true},
+	}
+
+	ctx := context.Background()
+	mux := new(secrets.URLMux)
+	mux.RegisterKeeper(Scheme, &URLOpener{Token: &Token{}})
+	for _, test := range tests {
+		keeper, err := mux.OpenKeeper(ctx, test.URL)
+		if (err != nil) != test.WantErr {
+			t.Errorf("%s: got error %v, want error %v", test.URL, err, test.WantErr)
+		}
+		if err == nil {
+			if err = keeper.Close(); err != nil {
+				t.Errorf("%s: got error during close: %v", test.URL, err)
+			}
+		}
+	}
+}
+
+func TestDefaultOpener(t *testing.T) {
+	old := os.Getenv("PKCS11_MODULE_PATH")
+	os.Unsetenv("PKCS11_MODULE_PATH")
+	defer os.Setenv("PKCS11_MODULE_PATH", old)
+	if _, err := new(defaultOpener).OpenKeeperURL(context.Background(), nil); err == nil {
+		t.Error("got nil error, want error for missing PKCS11_MODULE_PATH")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	k := &keeper{}
+	for _, test := range []struct {
+		err  error
+		want gcerrors.ErrorCode
+	}{
+		{errShortCiphertext, gcerrors.InvalidArgument},
+		{&keyError{label: "k"}, gcerrors.NotFound},
+		{&keyError{label: "k", n: 2}, gcerrors.FailedPrecondition},
+		{p11.Error(p11.CKR_ENCRYPTED_DATA_INVALID), gcerrors.InvalidArgument},
+		{p11.Error(p11.CKR_PIN_INCORRECT), gcerrors.PermissionDenied},
+		{p11.Error(p11.CKR_MECHANISM_INVALID), gcerrors.Unimplemented},
+		{p11.Error(p11.CKR_SESSION_COUNT), gcerrors.ResourceExhausted},
+		{p11.Error(p11.CKR_KEY_HANDLE_INVALID), gcerrors.NotFound},
+		{p11.Error(p11.CKR_CANCEL), gcerrors.Unknown},
+		{context.Canceled, gcerrors.Canceled},
+		{errors.New("other"), gcerrors.Unknown},
+	} {
+		if got := k.ErrorCode(test.err); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"context"
+
+	p11 "github.com/miekg/pkcs11"
+)
+
+// sessionPool hands out sessions to one goroutine at a time, reusing idle
+// sessions and limiting the number of open ones.
+type sessionPool struct {
+	open  func() (p11.SessionHandle, error)
+	close func(p11.SessionHandle)
+
+	idle chan p11.SessionHandle // sessions that are open but not in use
+	sem  chan struct{}          // holds a value for every open session
+}
+
+func newSessionPool(max int, open func() (p11.SessionHandle, error), close func(p11.SessionHandle)) *sessionPool {
+	return &sessionPool{
+		open:  open,
+		close: close,
+		idle:  make(chan p11.SessionHandle, max),
+		sem:   make(chan struct{}, max),
+	}
+}
+
+// get returns an idle session, or opens a new one. If the maximum number of
+// sessions is open, it waits for one to be put back.
+func (p *sessionPool) get(ctx context.Context) (p11.SessionHandle, error) {
+	// Prefer idle sessions over opening new ones.
+	select {
+	case sh := <-p.idle:
+		return sh, nil
+	default:
+	}
+	select {
+	case sh := <-p.idle:
+		return sh, nil
+	case p.sem <- struct{}{}:
+		sh, err := p.open()
+		if err != nil {
+			<-p.sem
+			return 0, err
+		}
+		return sh, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// put returns a session obtained from get to the pool. If discard is true,
+// the session is closed instead.
+func (p *sessionPool) put(sh p11.SessionHandle, discard bool) {
+	if discard {
+		p.close(sh)
+		<-p.sem
+		return
+	}
+	p.idle <- sh
+}
+
+// closeIdle closes the sessions that are not in use.
+func (p *sessionPool) closeIdle() {
+	for {
+		select {
+		case sh := <-p.idle:
+			p.close(sh)
+			<-p.sem
+		default:
+			return
+		}
+	}
+}
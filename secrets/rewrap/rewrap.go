@@ -0,0 +1,269 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rewrap re-encrypts stored ciphertexts under a new key, to migrate
+// data from one secrets.Keeper to another.
+//
+// Bucket rewraps the blobs under a prefix, and Collection rewraps a field of
+// every document in a docstore collection. Both decrypt each ciphertext with
+// the old Keeper, encrypt the plaintext with the new one and write the result
+// back in place. They work in batches of bounded size, report progress after
+// each batch, and stop at the first error.
+//
+// A ciphertext that the old Keeper cannot decrypt but the new one can is
+// assumed to have been rewrapped already, and is skipped. So a run that fails
+// or is interrupted can simply be started again.
+//
+// Rewrapping is not atomic with respect to other writers. Collection uses
+// document revisions, so a document changed during the run fails with
+// FailedPrecondition and can be retried; Bucket has no such protection, so a
+// blob written between the read and the write of its rewrap will be
+// overwritten. Applications should stop writing ciphertexts under the old key
+// before rewrapping.
+package rewrap // import "gocloud.dev/secrets/rewrap"
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/secrets"
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultBatchSize is the batch size used when Options.BatchSize is zero.
+const DefaultBatchSize = 100
+
+// Options controls a rewrap.
+type Options struct {
+	// BatchSize is the maximum number of ciphertexts rewrapped at once. The
+	// ciphertexts in a batch are decrypted and encrypted concurrently, and a
+	// collection's documents in a batch are written with a single ActionList.
+	// If zero, DefaultBatchSize is used.
+	BatchSize int
+
+	// Progress, if non-nil, is called after each batch with the totals so far.
+	Progress func(Progress)
+}
+
+// Progress counts the items a rewrap has processed.
+type Progress struct {
+	// Scanned is the number of blobs or documents examined.
+	Scanned int
+
+	// Rewrapped is the number re-encrypted under the new key.
+	Rewrapped int
+
+	// Skipped is the number left as they were: those already encrypted under
+	// the new key, and documents whose field is missing or not a []byte.
+	Skipped int
+}
+
+func (o *Options) batchSize() int {
+	if o == nil || o.BatchSize <= 0 {
+		return DefaultBatchSize
+	}
+	return o.BatchSize
+}
+
+func (o *Options) report(p Progress) {
+	if o != nil && o.Progress != nil {
+		o.Progress(p)
+	}
+}
+
+// Bucket rewraps every blob in b whose key begins with prefix, replacing it
+// with its plaintext encrypted by newKeeper. The blob's attributes, such as
+// its content type and metadata, are preserved.
+//
+// Bucket returns the progress of the batches it completed, along with the first
+// error encountered.
+func Bucket(ctx context.Context, b *blob.Bucket, prefix string, oldKeeper, newKeeper *secrets.Keeper, opts *Options) (Progress, error) {
+	var p Progress
+	it := b.List(&blob.ListOptions{Prefix: prefix})
+	for done := false; !done; {
+		var keys []string
+		for len(keys) < opts.batchSize() {
+			obj, err := it.Next(ctx)
+			if err == io.EOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return p, err
+			}
+			keys = append(keys, obj.Key)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		rewrapped := make([]bool, len(keys))
+		g, gctx := errgroup.WithContext(ctx)
+		for i, key := range keys {
+			i, key := i, key
+			g.Go(func() error {
+				var err error
+				rewrapped[i], err = rewrapBlob(gctx, b, key, oldKeeper, newKeeper)
+				return err
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return p, err
+		}
+		p.add(rewrapped)
+		opts.report(p)
+	}
+	return p, nil
+}
+
+// rewrapBlob rewraps the blob at key, reporting whether it needed rewrapping.
+func rewrapBlob(ctx context.Context, b *blob.Bucket, key string, oldKeeper, newKeeper *secrets.Keeper) (bool, error) {
+	attrs, err := b.Attributes(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	ct, err := b.ReadAll(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	newCT, err := rewrap(ctx, ct, oldKeeper, newKeeper)
+	if err != nil || newCT == nil {
+		return false, wrapError(err, "blob %q", key)
+	}
+	err = b.WriteAll(ctx, key, newCT, &blob.WriterOptions{
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentType:        attrs.ContentType,
+		Metadata:           attrs.Metadata,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Collection rewraps field in every document of coll. The field must hold a
+// []byte ciphertext; documents where it is missing or has another type are
+// skipped. Each rewrapped document is updated with its revision, so documents
+// changed concurrently are not overwritten.
+//
+// Collection returns the progress of the batches it completed, along with the
+// first error encountered.
+func Collection(ctx context.Context, coll *docstore.Collection, field docstore.FieldPath, oldKeeper, newKeeper *secrets.Keeper, opts *Options) (Progress, error) {
+	var p Progress
+	it := coll.Query().Get(ctx)
+	defer it.Stop()
+	for done := false; !done; {
+		var docs []map[string]interface{}
+		for len(docs) < opts.batchSize() {
+			doc := map[string]interface{}{}
+			err := it.Next(ctx, doc)
+			if err == io.EOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return p, err
+			}
+			docs = append(docs, doc)
+		}
+		if len(docs) == 0 {
+			break
+		}
+		newCTs := make([][]byte, len(docs))
+		g, gctx := errgroup.WithContext(ctx)
+		for i, doc := range docs {
+			ct, ok := lookup(doc, field).([]byte)
+			if !ok {
+				continue
+			}
+			i := i
+			g.Go(func() error {
+				var err error
+				newCTs[i], err = rewrap(gctx, ct, oldKeeper, newKeeper)
+				return wrapError(err, "field %q", string(field))
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return p, err
+		}
+		actions := coll.Actions()
+		rewrapped := make([]bool, len(docs))
+		for i, ct := range newCTs {
+			if ct != nil {
+				actions.Update(docs[i], docstore.Mods{field: ct})
+				rewrapped[i] = true
+			}
+		}
+		if err := actions.Do(ctx); err != nil {
+			return p, err
+		}
+		p.add(rewrapped)
+		opts.report(p)
+	}
+	return p, nil
+}
+
+// lookup returns the value at the field path fp in doc, or nil if there is none.
+func lookup(doc map[string]interface{}, fp docstore.FieldPath) interface{} {
+	var v interface{} = doc
+	for _, f := range strings.Split(string(fp), ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[f]
+	}
+	return v
+}
+
+// add counts a batch of items, where rewrapped[i] reports whether the ith was
+// rewrapped.
+func (p *Progress) add(rewrapped []bool) {
+	for _, r := range rewrapped {
+		p.Scanned++
+		if r {
+			p.Rewrapped++
+		} else {
+			p.Skipped++
+		}
+	}
+}
+
+// rewrap returns ct, encrypted by oldKeeper, encrypted instead by newKeeper.
+// It returns nil if ct is already encrypted by newKeeper.
+func rewrap(ctx context.Context, ct []byte, oldKeeper, newKeeper *secrets.Keeper) ([]byte, error) {
+	pt, err := oldKeeper.Decrypt(ctx, ct)
+	if err != nil {
+		if _, err2 := newKeeper.Decrypt(ctx, ct); err2 == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return newKeeper.Encrypt(ctx, pt)
+}
+
+// wrapError adds the item being rewrapped to err, keeping its error code.
+func wrapError(err error, format string, arg string) error {
+	if err == nil {
+		return nil
+	}
+	return gcerr.Newf(gcerrors.Code(err), err, "rewrap: "+format, arg)
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rewrap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/docstore/memdocstore"
+	"gocloud.dev/secrets"
+	"gocloud.dev/secrets/localsecrets"
+)
+
+func newKeepers(t *testing.T) (oldKeeper, newKeeper *secrets.Keeper) {
+	t.Helper()
+	var keepers [2]*secrets.Keeper
+	for i := range keepers {
+		key, err := localsecrets.NewRandomKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keepers[i] = localsecrets.NewKeeper(key)
+	}
+	return keepers[0], keepers[1]
+}
+
+func encrypt(t *testing.T, k *secrets.Keeper, s string) []byte {
+	t.Helper()
+	ct, err := k.Encrypt(context.Background(), []byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ct
+}
+
+func decrypt(t *testing.T, k *secrets.Keeper, ct []byte) string {
+	t.Helper()
+	pt, err := k.Decrypt(context.Background(), ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pt)
+}
+
+func TestBucket(t *testing.T) {
+	ctx := context.Background()
+	oldKeeper, newKeeper := newKeepers(t)
+	b := memblob.OpenBucket(nil)
+	defer b.Close()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		opts := &blob.WriterOptions{ContentType: "application/octet-stream", Metadata: map[string]string{"i": fmt.Sprint(i)}}
+		if err := b.WriteAll(ctx, fmt.Sprintf("secret/%d", i), encrypt(t, oldKeeper, fmt.Sprint(i)), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One blob was already rewrapped, and one is outside the prefix.
+	if err := b.WriteAll(ctx, "secret/new", encrypt(t, newKeeper, "new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteAll(ctx, "other", []byte("plain"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []Progress
+	got, err := Bucket(ctx, b, "secret/", oldKeeper, newKeeper, &Options{
+		BatchSize: 2,
+		Progress:  func(p Progress) { reports = append(reports, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Progress{Scanned: n + 1, Rewrapped: n, Skipped: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if len(reports) != 3 || reports[len(reports)-1] != got {
+		t.Errorf("got progress reports %+v, want 3 ending with the total", reports)
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("secret/%d", i)
+		ct, err := b.ReadAll(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := decrypt(t, newKeeper, ct), fmt.Sprint(i); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+		attrs, err := b.Attributes(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.ContentType != "application/octet-stream" || attrs.Metadata["i"] != fmt.Sprint(i) {
+			t.Errorf("%s: attributes not preserved: %+v", key, attrs)
+		}
+	}
+
+	// Rewrapping again is a no-op.
+	got, err = Bucket(ctx, b, "secret/", oldKeeper, newKeeper, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Progress{Scanned: n + 1, Skipped: n + 1}); got != want {
+		t.Errorf("second run: got %+v, want %+v", got, want)
+	}
+
+	// A blob neither keeper can decrypt is an error.
+	if _, err := Bucket(ctx, b, "", oldKeeper, newKeeper, nil); err == nil {
+		t.Error("got nil error for an unencrypted blob, want error")
+	}
+}
+
+func TestCollection(t *testing.T) {
+	ctx := context.Background()
+	oldKeeper, newKeeper := newKeepers(t)
+	coll, err := memdocstore.OpenCollection("name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		doc := map[string]interface{}{
+			"name": fmt.Sprint(i),
+			"cred": map[string]interface{}{"token": encrypt(t, oldKeeper, fmt.Sprint(i))},
+		}
+		if err := coll.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, doc := range []map[string]interface{}{
+		{"name": "new", "cred": map[string]interface{}{"token": encrypt(t, newKeeper, "new")}},
+		{"name": "none"},
+		{"name": "string", "cred": map[string]interface{}{"token": "not a ciphertext"}},
+	} {
+		if err := coll.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Collection(ctx, coll, "cred.token", oldKeeper, newKeeper, &Options{BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Progress{Scanned: n + 3, Rewrapped: n, Skipped: 3}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for i := 0; i < n; i++ {
+		doc := map[string]interface{}{"name": fmt.Sprint(i)}
+		if err := coll.Get(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+		ct := doc["cred"].(map[string]interface{})["token"].([]byte)
+		if got, want := decrypt(t, newKeeper, ct), fmt.Sprint(i); got != want {
+			t.Errorf("%d: got %q, want %q", i, got, want)
+		}
+	}
+	doc := map[string]interface{}{"name": "string"}
+	if err := coll.Get(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(doc["cred"], map[string]interface{}{"token": "not a ciphertext"}); diff != "" {
+		t.Errorf("skipped document changed: %s", diff)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package liveconfig provides an http.Handler whose settings, like request
+// timeouts and rate limits, come from a runtimevar.Variable and change while
+// the server runs, without a restart.
+//
+// The variable holds a JSON object of Settings, like
+//
+//	{"requestTimeout": "5s", "rateLimit": 100, "rateBurst": 20, "debug": true}
+//
+// Open the variable with Decoder, or by URL with the bytes or string decoder,
+// and wrap the server's handler with NewHandler:
+//
+//	v, err := runtimevar.OpenVariable(ctx, "file:///etc/server.json?decoder=bytes")
+//	...
+//	h := liveconfig.NewHandler(v, mux, nil)
+//	defer h.Close()
+//	srv := server.New(h, nil)
+//
+// Handlers see the settings in effect for their request through FromContext,
+// so that application-specific toggles like Debug change with the rest.
+//
+// When the variable's value is invalid, or cannot be read, the handler keeps
+// the last good settings.
+package liveconfig // import "gocloud.dev/server/liveconfig"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gocloud.dev/runtimevar"
+)
+
+// Settings are the values of a liveconfig variable.
+type Settings struct {
+	// RequestTimeout, if positive, is how long a request may take. Requests
+	// that take longer fail with 503 Service Unavailable, and their contexts
+	// are canceled.
+	RequestTimeout Duration `json:"requestTimeout,omitempty"`
+
+	// RateLimit, if positive, is the number of requests per second that the
+	// handler serves on average. Requests beyond it fail with 429 Too Many
+	// Requests.
+	RateLimit float64 `json:"rateLimit,omitempty"`
+
+	// RateBurst is the number of requests that may be served at once beyond
+	// RateLimit. It defaults to RateLimit, rounded up.
+	RateBurst int `json:"rateBurst,omitempty"`
+
+	// Debug is a toggle for handlers to read with FromContext. The handler
+	// itself ignores it.
+	Debug bool `json:"debug,omitempty"`
+}
+
+func (s *Settings) validate() error {
+	switch {
+	case s.RequestTimeout < 0:
+		return fmt.Errorf("liveconfig: negative requestTimeout %v", s.RequestTimeout)
+	case s.RateLimit < 0 || math.IsNaN(s.RateLimit) || math.IsInf(s.RateLimit, 0):
+		return fmt.Errorf("liveconfig: invalid rateLimit %v", s.RateLimit)
+	case s.RateBurst < 0:
+		return fmt.Errorf("liveconfig: negative rateBurst %d", s.RateBurst)
+	}
+	return nil
+}
+
+// Duration is a time.Duration that is written in JSON as a string, like
+// "1.5s", in the format of time.ParseDuration.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("liveconfig: duration must be a string like \"1.5s\": %v", err)
+	}
+	td, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("liveconfig: %v", err)
+	}
+	*d = Duration(td)
+	return nil
+}
+
+// Decoder decodes a JSON liveconfig variable into a *Settings.
+var Decoder = runtimevar.NewDecoder(&Settings{}, runtimevar.JSONDecode)
+
+// Options sets options for NewHandler.
+type Options struct {
+	// Initial are the settings used until the variable has a valid value.
+	// If nil, requests are not limited until then.
+	Initial *Settings
+
+	// OnError, if not nil, is called with the errors from reading the
+	// variable and with invalid settings, which are ignored.
+	OnError func(error)
+}
+
+// A Handler serves requests with a wrapped handler, applying the settings of
+// a variable.
+type Handler struct {
+	next    http.Handler
+	onError func(error)
+	cur     atomic.Value // *state
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// state is a version of a Handler's settings.
+type state struct {
+	settings Settings
+	limiter  *limiter // nil if there is no rate limit
+}
+
+// NewHandler returns a Handler that serves requests with h, using the
+// settings of v, which must hold a *Settings, or JSON as []byte or a string.
+// It watches v until Close is called. opts may be nil.
+func NewHandler(v *runtimevar.Variable, h http.Handler, opts *Options) *Handler {
+	if opts == nil {
+		opts = &Options{}
+	}
+	hh := &Handler{next: h, onError: opts.OnError, done: make(chan struct{})}
+	initial := &state{}
+	if opts.Initial != nil {
+		initial = newState(*opts.Initial, nil)
+	}
+	hh.cur.Store(initial)
+	var ctx context.Context
+	ctx, hh.cancel = context.WithCancel(context.Background())
+	go hh.watch(ctx, v)
+	return hh
+}
+
+func newState(s Settings, prev *state) *state {
+	st := &state{settings: s}
+	if s.RateLimit > 0 {
+		burst := s.RateBurst
+		if burst == 0 {
+			burst = int(math.Ceil(s.RateLimit))
+		}
+		if prev != nil && prev.limiter != nil && prev.limiter.rate == s.RateLimit && prev.limiter.burst == burst {
+			// Keep the tokens of the current limiter.
+			st.limiter = prev.limiter
+		} else {
+			st.limiter = newLimiter(s.RateLimit, burst)
+		}
+	}
+	return st
+}
+
+// watch applies the values of v until ctx is done.
+func (h *Handler) watch(ctx context.Context, v *runtimevar.Variable) {
+	defer close(h.done)
+	for {
+		snap, err := v.Watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		var s *Settings
+		if err == nil {
+			s, err = settings(snap.Value)
+		}
+		if err == nil {
+			err = s.validate()
+		}
+		if err == nil {
+			h.cur.Store(newState(*s, h.state()))
+			continue
+		}
+		if h.onError != nil {
+			h.onError(err)
+		}
+	}
+}
+
+// settings returns the Settings in a variable's value.
+func settings(v interface{}) (*Settings, error) {
+	var data []byte
+	switch v := v.(type) {
+	case *Settings:
+		return v, nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return nil, fmt.Errorf("liveconfig: variable holds a %T; open it with liveconfig.Decoder", v)
+	}
+	s := &Settings{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("liveconfig: %v", err)
+	}
+	return s, nil
+}
+
+func (h *Handler) state() *state { return h.cur.Load().(*state) }
+
+// Settings returns the settings in effect.
+func (h *Handler) Settings() Settings { return h.state().settings }
+
+// Close stops watching the variable. It does not close the variable. The
+// Handler keeps serving requests with the last settings.
+func (h *Handler) Close() {
+	h.cancel()
+	<-h.done
+}
+
+type contextKey struct{}
+
+// FromContext returns the settings in effect for the request with context
+// ctx, and false if ctx is not from a request served by a Handler.
+func FromContext(ctx context.Context) (Settings, bool) {
+	s, ok := ctx.Value(contextKey{}).(Settings)
+	return s, ok
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := h.state()
+	if st.limiter != nil && !st.limiter.allow(time.Now()) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), contextKey{}, st.settings))
+	next := h.next
+	if d := time.Duration(st.settings.RequestTimeout); d > 0 {
+		next = http.TimeoutHandler(next, d, "request timed out")
+	}
+	next.ServeHTTP(w, r)
+}
+
+// limiter is a token bucket.
+type limiter struct {
+	rate  float64 // tokens per second
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{rate: rate, burst: burst, tokens: float64(burst)}
+}
+
+// allow reports whether a request at time now is within the limit, and
+// takes a token for it if so.
+func (l *limiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package liveconfig
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/blobvar"
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	write := func(s string) {
+		t.Helper()
+		if err := bucket.WriteAll(ctx, "settings.json", []byte(s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"rateLimit": 0.001, "rateBurst": 2, "debug": true}`)
+	v, err := blobvar.OpenVariable(bucket, "settings.json", Decoder, &blobvar.Options{WaitDuration: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	errs := make(chan error, 10)
+	h := NewHandler(v, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := FromContext(r.Context())
+		if !ok {
+			t.Error("no settings in request context")
+		}
+		if s.Debug {
+			w.Header().Set("Debug", "on")
+		}
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+		}
+	}), &Options{OnError: func(err error) { errs <- err }})
+	defer h.Close()
+
+	// waitFor waits until the handler's settings satisfy f.
+	waitFor := func(f func(Settings) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !f(h.Settings()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("settings are still %+v", h.Settings())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	waitFor(func(s Settings) bool { return s.Debug })
+	for i, want := range []int{200, 200, 429} {
+		w := get("/")
+		if w.Code != want {
+			t.Errorf("request %d: got status %d, want %d", i, w.Code, want)
+		}
+		if w.Code == 200 && w.Header().Get("Debug") != "on" {
+			t.Errorf("request %d: handler did not see Debug", i)
+		}
+	}
+
+	// New settings apply without restarting anything.
+	write(`{"requestTimeout": "10ms"}`)
+	waitFor(func(s Settings) bool { return s.RequestTimeout != 0 })
+	if w := get("/"); w.Code != 200 || w.Header().Get("Debug") != "" {
+		t.Errorf("got status %d, Debug %q; want 200 without Debug", w.Code, w.Header().Get("Debug"))
+	}
+	if w := get("/slow"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("slow request: got status %d, want 503", w.Code)
+	}
+
+	// Invalid settings are reported and ignored.
+	write(`{"requestTimeout": "-1s"}`)
+	select {
+	case err := <-errs:
+		t.Log(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid settings not reported")
+	}
+	if got := h.Settings().RequestTimeout; got != Duration(10*time.Millisecond) {
+		t.Errorf("got timeout %v, want the last good one", got)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	bv := constantvar.NewBytes([]byte(`{"debug": true}`), runtimevar.BytesDecoder)
+	defer bv.Close()
+	h := NewHandler(bv, http.NotFoundHandler(), &Options{Initial: &Settings{RateLimit: 1}})
+	// The initial settings apply until the variable's value replaces them.
+	defer h.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.Settings().Debug {
+		if time.Now().After(deadline) {
+			t.Fatalf("settings are still %+v", h.Settings())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if h.Settings().RateLimit != 0 {
+		t.Errorf("got %+v, want the variable's settings", h.Settings())
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(2, 1)
+	now := time.Now()
+	if !l.allow(now) {
+		t.Error("first request not allowed")
+	}
+	if l.allow(now) {
+		t.Error("second request allowed at once")
+	}
+	if !l.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("request after a token was added not allowed")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	var s Settings
+	if err := json.Unmarshal([]byte(`{"requestTimeout": "1m30s"}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.RequestTimeout != Duration(90*time.Second) {
+		t.Errorf("got %v", s.RequestTimeout)
+	}
+	if err := json.Unmarshal([]byte(`{"requestTimeout": 90}`), &s); err == nil {
+		t.Error("number accepted as duration")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resources provides an http.Handler that makes Go CDK resources
+// available to the handlers it wraps through the request context, so that they
+// need neither global variables nor a dependency injection scheme of their own.
+//
+// An application opens its resources once, when it starts, names them in a
+// Resources, and wraps its handler with NewHandler:
+//
+//	res := &resources.Resources{
+//		Buckets:     map[string]*blob.Bucket{"uploads": bucket},
+//		Collections: map[string]*docstore.Collection{"users": coll},
+//	}
+//	srv := server.New(resources.NewHandler(res, mux), nil)
+//
+// Handlers then look the resources up by name:
+//
+//	func handleUpload(w http.ResponseWriter, r *http.Request) {
+//		bucket, err := resources.Bucket(r.Context(), "uploads")
+//		...
+//	}
+//
+// The resources are shared by all requests, and are not closed by this
+// package.
+package resources // import "gocloud.dev/server/resources"
+
+import (
+	"context"
+	"net/http"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/docstore"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/runtimevar"
+)
+
+// Resources holds named Go CDK resources. Each map is keyed by the name that
+// handlers use to look the resource up. Nil maps are treated as empty.
+type Resources struct {
+	Buckets     map[string]*blob.Bucket
+	Collections map[string]*docstore.Collection
+	Topics      map[string]*pubsub.Topic
+	Variables   map[string]*runtimevar.Variable
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries res.
+func NewContext(ctx context.Context, res *Resources) context.Context {
+	return context.WithValue(ctx, contextKey{}, res)
+}
+
+// FromContext returns the Resources carried by ctx, or nil if there are none.
+func FromContext(ctx context.Context) *Resources {
+	res, _ := ctx.Value(contextKey{}).(*Resources)
+	return res
+}
+
+// A Handler adds Resources to the context of each request.
+type Handler struct {
+	res *Resources
+	h   http.Handler
+}
+
+// NewHandler returns a handler that adds res to the context of each request
+// and calls h.ServeHTTP.
+func NewHandler(res *Resources, h http.Handler) *Handler {
+	return &Handler{
+		res: res,
+		h:   h,
+	}
+}
+
+// ServeHTTP calls its underlying handler's ServeHTTP method with a request
+// whose context carries the handler's Resources.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), h.res)))
+}
+
+// Bucket returns the bucket with the given name from the Resources carried by
+// ctx. The error has code gcerrors.NotFound if there is no such bucket.
+func Bucket(ctx context.Context, name string) (*blob.Bucket, error) {
+	var m map[string]*blob.Bucket
+	if res := FromContext(ctx); res != nil {
+		m = res.Buckets
+	}
+	b := m[name]
+	if b == nil {
+		return nil, notFound(ctx, "bucket", name)
+	}
+	return b, nil
+}
+
+// Collection returns the collection with the given name from the Resources
+// carried by ctx. The error has code gcerrors.NotFound if there is no such
+// collection.
+func Collection(ctx context.Context, name string) (*docstore.Collection, error) {
+	var m map[string]*docstore.Collection
+	if res := FromContext(ctx); res != nil {
+		m = res.Collections
+	}
+	c := m[name]
+	if c == nil {
+		return nil, notFound(ctx, "collection", name)
+	}
+	return c, nil
+}
+
+// Topic returns the topic with the given name from the Resources carried by
+// ctx. The error has code gcerrors.NotFound if there is no such topic.
+func Topic(ctx context.Context, name string) (*pubsub.Topic, error) {
+	var m map[string]*pubsub.Topic
+	if res := FromContext(ctx); res != nil {
+		m = res.Topics
+	}
+	t := m[name]
+	if t == nil {
+		return nil, notFound(ctx, "topic", name)
+	}
+	return t, nil
+}
+
+// Variable returns the variable with the given name from the Resources carried
+// by ctx. The error has code gcerrors.NotFound if there is no such variable.
+func Variable(ctx context.Context, name string) (*runtimevar.Variable, error) {
+	var m map[string]*runtimevar.Variable
+	if res := FromContext(ctx); res != nil {
+		m = res.Variables
+	}
+	v := m[name]
+	if v == nil {
+		return nil, notFound(ctx, "variable", name)
+	}
+	return v, nil
+}
+
+// notFound returns the error for a missing resource of the given kind.
+func notFound(ctx context.Context, kind, name string) error {
+	if FromContext(ctx) == nil {
+		return gcerr.Newf(gcerr.NotFound, nil, "resources: no %s %q: the context has no resources", kind, name)
+	}
+	return gcerr.Newf(gcerr.NotFound, nil, "resources: no %s %q", kind, name)
+}
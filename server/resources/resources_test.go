@@ -0,0 +1,102 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/docstore"
+	"gocloud.dev/docstore/memdocstore"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+	"gocloud.dev/runtimevar"
+	"gocloud.dev/runtimevar/constantvar"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	coll, err := memdocstore.OpenCollection("name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	v := constantvar.New("value")
+	defer v.Close()
+	res := &Resources{
+		Buckets:     map[string]*blob.Bucket{"b": bucket},
+		Collections: map[string]*docstore.Collection{"c": coll},
+		Topics:      map[string]*pubsub.Topic{"t": topic},
+		Variables:   map[string]*runtimevar.Variable{"v": v},
+	}
+
+	called := false
+	h := NewHandler(res, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		ctx := r.Context()
+		if FromContext(ctx) != res {
+			t.Error("FromContext did not return the handler's Resources")
+		}
+		if got, err := Bucket(ctx, "b"); err != nil || got != bucket {
+			t.Errorf("Bucket: got %v, %v", got, err)
+		}
+		if got, err := Collection(ctx, "c"); err != nil || got != coll {
+			t.Errorf("Collection: got %v, %v", got, err)
+		}
+		if got, err := Topic(ctx, "t"); err != nil || got != topic {
+			t.Errorf("Topic: got %v, %v", got, err)
+		}
+		if got, err := Variable(ctx, "v"); err != nil || got != v {
+			t.Errorf("Variable: got %v, %v", got, err)
+		}
+		// Names are per kind.
+		if _, err := Bucket(ctx, "c"); gcerrors.Code(err) != gcerrors.NotFound {
+			t.Errorf("Bucket with a missing name: got %v, want NotFound", err)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !called {
+		t.Error("handler was not called")
+	}
+}
+
+func TestMissing(t *testing.T) {
+	for _, ctx := range []context.Context{
+		context.Background(),
+		NewContext(context.Background(), &Resources{}),
+	} {
+		for name, err := range map[string]error{
+			"Bucket":     second(Bucket(ctx, "x")),
+			"Collection": second(Collection(ctx, "x")),
+			"Topic":      second(Topic(ctx, "x")),
+			"Variable":   second(Variable(ctx, "x")),
+		} {
+			if gcerrors.Code(err) != gcerrors.NotFound {
+				t.Errorf("%s: got %v, want NotFound", name, err)
+			}
+		}
+	}
+}
+
+func second(_ interface{}, err error) error { return err }